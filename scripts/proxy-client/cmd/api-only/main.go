@@ -5,11 +5,15 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/atlanticproxy/proxy-client/internal/adblock"
 	"github.com/atlanticproxy/proxy-client/internal/api"
+	"github.com/atlanticproxy/proxy-client/internal/auth"
 	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
 	"github.com/atlanticproxy/proxy-client/internal/rotation"
 	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/google/uuid"
@@ -29,11 +33,17 @@ func main() {
 		cancel()
 	}()
 
-	store, err := storage.NewStore()
+	store, err := storage.Open(os.Getenv("DATABASE_URL"))
 	if err != nil {
 		log.Printf("Failed to initialize storage: %v. Running in-memory mode if possible.", err)
 	}
 
+	if store != nil {
+		if _, err := billing.LoadCatalogue(store); err != nil {
+			log.Printf("Failed to load plan catalogue: %v. Using the built-in plans.", err)
+		}
+	}
+
 	// SEEDER: Ensure a default user exists for easy testing
 	if store != nil {
 		testEmail := "admin@atlantic.com"
@@ -41,20 +51,133 @@ func main() {
 			hashed, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 			userID := uuid.New().String()
 			store.CreateUser(userID, testEmail, string(hashed))
+			store.MarkEmailVerified(userID)
 			log.Printf("Seeded test user: %s (password: password123)", testEmail)
 		}
 	}
 
+	// Credits, quotas, promotions, organizations, sub-users, invoices,
+	// webhooks, crypto payments and saved exchange rates need a database
+	persistent, _ := store.(storage.BillingRepository)
+
+	if persistent != nil {
+		ratesCfg := billing.DefaultExchangeConfig()
+		if url := os.Getenv("EXCHANGE_RATES_URL"); url != "" {
+			ratesCfg.URL = url
+		}
+		ratesCfg.File = os.Getenv("EXCHANGE_RATES_FILE")
+		rates := billing.NewRateTable(persistent, ratesCfg)
+		billing.UseExchangeRates(rates)
+		go rates.Run(ctx)
+	} else {
+		log.Println("Credits, quotas, promotions, organizations, sub-users, invoices, webhooks and crypto payments need a database and are disabled.")
+	}
+
 	// Initialize Minimal Managers for API functionality
 	bm := billing.NewManager(store)
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		bm.SetStripe(billing.NewStripeProvider(billing.StripeConfig{
+			SecretKey:     key,
+			WebhookSecret: os.Getenv("STRIPE_WEBHOOK_SECRET"),
+			SuccessURL:    os.Getenv("STRIPE_SUCCESS_URL"),
+			CancelURL:     os.Getenv("STRIPE_CANCEL_URL"),
+			BaseURL:       os.Getenv("STRIPE_API_URL"),
+		}))
+	}
 	am := rotation.NewAnalyticsManager()
 	rm := rotation.NewManager(am)
+	entitlements := bm.Entitlements()
+	rm.SetEntitlementCheck(func(cfg rotation.RotationConfig) error {
+		return entitlements.CheckRotation("", cfg.Mode.Sticky(), cfg.Country)
+	})
 	ab := adblock.NewEngine("US", store)
 
-	server := api.NewServer(ab, nil, nil, nil, rm, am, bm, store)
+	var authStore auth.Store
+	if store != nil {
+		authStore = store
+	}
+	authManager := auth.NewManager(authStore, auth.Config{Secret: []byte(os.Getenv("JWT_SECRET"))})
+	authManager.SetAPIAccessCheck(bm.CheckAPIAccess)
+	authManager.SetSubUserCheck(bm.ValidateSubUser)
+
+	server := api.NewServer(ab, nil, nil, nil, rm, am, bm, store, authManager)
+	server.SetAdmins(strings.Split(os.Getenv("ADMIN_EMAILS"), ","))
+
+	if persistent != nil {
+		bm.SetCredits(billing.NewCreditLedger(persistent, nil, billing.CreditConfig{}))
+		bm.SetQuotaMeter(billing.NewQuotaMeter(persistent, nil))
+		bm.SetPromotions(billing.NewPromotions(persistent, billing.PromotionConfig{}))
+		bm.SetOrgs(billing.NewOrgs(persistent, billing.OrgConfig{}))
+		bm.SetSubUsers(billing.NewSubUsers(persistent))
+		server.SetInvoicer(billing.NewInvoicer(persistent, billing.InvoiceConfig{
+			Seller:  os.Getenv("INVOICE_SELLER"),
+			Address: strings.ReplaceAll(os.Getenv("INVOICE_SELLER_ADDRESS"), `\n`, "\n"),
+			TaxID:   os.Getenv("INVOICE_SELLER_TAX_ID"),
+			Email:   os.Getenv("INVOICE_SELLER_EMAIL"),
+		}))
+
+		webhooks := queue.NewWorker(persistent, queue.Config{})
+		server.SetQueue(webhooks)
+		go webhooks.Run(ctx)
+
+		if cfg := cryptoConfig(); len(cfg.Wallets) > 0 {
+			crypto, err := billing.NewCryptoProvider(persistent, billing.NewCoinGeckoRates(cfg.RatesURL), cfg)
+			if err != nil {
+				log.Printf("Failed to initialize crypto payments: %v", err)
+			} else {
+				bm.SetCrypto(crypto)
+				watcher := billing.NewCryptoWatcher(persistent, billing.NewChainIndexers(cfg), cfg)
+				server.SetCryptoWatcher(watcher)
+				go watcher.Run(ctx)
+			}
+		}
+	}
+
+	// Trials and canceled plans end on time here too. Without a payment
+	// gateway, paid plans go past due at renewal and fall back to Starter
+	// once the grace period is over.
+	if store != nil {
+		lifecycle := billing.NewLifecycle(bm, store, nil, nil, billing.LifecycleConfig{})
+		server.SetLifecycle(lifecycle)
+		go lifecycle.Run(ctx)
+	}
+
+	// Backups are only taken on demand unless BACKUP_INTERVAL is set
+	if backuper, ok := store.(storage.Backuper); ok {
+		backupCfg := storage.DefaultBackupConfig()
+		backupCfg.Dir = os.Getenv("BACKUP_DIR")
+		if interval, err := time.ParseDuration(os.Getenv("BACKUP_INTERVAL")); err == nil {
+			backupCfg.Interval = interval
+		}
+		backups, err := storage.NewBackups(backuper, backupCfg)
+		if err != nil {
+			log.Printf("Failed to initialize backups: %v", err)
+		} else {
+			server.SetBackups(backups)
+			go backups.Run(ctx)
+		}
+	}
 
 	log.Println("Starting AtlanticProxy HTTP API Server...")
 	if err := server.Start(ctx, ":8082"); err != nil {
 		log.Fatal("API Server failed:", err)
 	}
 }
+
+// cryptoConfig reads the crypto wallets and chain APIs from the environment
+func cryptoConfig() billing.CryptoConfig {
+	cfg := billing.CryptoConfig{
+		Wallets:      make(map[string]string),
+		RatesURL:     os.Getenv("CRYPTO_RATES_URL"),
+		BitcoinAPI:   os.Getenv("BITCOIN_API_URL"),
+		EthereumAPI:  os.Getenv("ETHEREUM_API_URL"),
+		EtherscanKey: os.Getenv("ETHERSCAN_API_KEY"),
+	}
+	if xpub := os.Getenv("CRYPTO_BTC_XPUB"); xpub != "" {
+		cfg.Wallets["btc"] = xpub
+	}
+	if xpub := os.Getenv("CRYPTO_ETH_XPUB"); xpub != "" {
+		cfg.Wallets["eth"] = xpub
+	}
+	return cfg
+}
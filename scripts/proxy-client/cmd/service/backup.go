@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/atlanticproxy/proxy-client/pkg/config"
+)
+
+const backupUsage = `Usage: atlantic-service backup [-database URL] <command>
+
+Commands:
+  create [path]   back up the database to path, or else to the backup
+                  directory, dropping the oldest backups beyond the number kept
+  list            list the backups in the backup directory
+  restore <path>  replace the database with a backup; stop the service first
+
+SQLite is copied with VACUUM INTO. Postgres is written as a SQL script that
+restores into an empty or older database. A backup is only restored if this
+release knows its schema.
+
+The database is DATABASE_URL or database_url in config.yaml, or else the
+default SQLite database. The backup directory and number kept are
+BACKUP_DIR and BACKUP_KEEP, or backup in config.yaml.
+`
+
+const exportUsage = `Usage: atlantic-service export [-database URL] [-o file] <user ID or email>
+
+Writes everything kept about a user as JSON, to standard output by default.
+`
+
+// runBackup takes, lists and restores backups of the database
+func runBackup(args []string) error {
+	cfg := config.Load()
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, backupUsage) }
+	dbURL := fs.String("database", cfg.DatabaseURL, "postgres:// URL or SQLite path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing command")
+	}
+
+	switch cmd := fs.Arg(0); cmd {
+	case "create":
+		return createBackup(*dbURL, *cfg.Backup, fs.Arg(1))
+	case "list":
+		return listBackups(*dbURL, *cfg.Backup)
+	case "restore":
+		if fs.NArg() < 2 {
+			fs.Usage()
+			return fmt.Errorf("missing backup path")
+		}
+		version, err := storage.Restore(*dbURL, fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s at schema version %d\n", fs.Arg(1), version)
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// openBackuper opens a database that can be backed up
+func openBackuper(url string) (storage.Repository, storage.Backuper, error) {
+	store, err := storage.Open(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	backuper, ok := store.(storage.Backuper)
+	if !ok {
+		store.Close()
+		return nil, nil, fmt.Errorf("database %q can not be backed up", url)
+	}
+	return store, backuper, nil
+}
+
+func createBackup(url string, cfg storage.BackupConfig, path string) error {
+	store, backuper, err := openBackuper(url)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if path != "" {
+		if err := backuper.Backup(path); err != nil {
+			return err
+		}
+		fmt.Printf("Backed up to %s\n", path)
+		return nil
+	}
+
+	backups, err := storage.NewBackups(backuper, cfg)
+	if err != nil {
+		return err
+	}
+	file, err := backups.Create()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up to %s\n", file.Path)
+	return nil
+}
+
+func listBackups(url string, cfg storage.BackupConfig) error {
+	store, backuper, err := openBackuper(url)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	backups, err := storage.NewBackups(backuper, cfg)
+	if err != nil {
+		return err
+	}
+	files, err := backups.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tCREATED")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", f.Name, f.Size, f.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	return w.Flush()
+}
+
+// runExport writes everything kept about a user as JSON
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, exportUsage) }
+	dbURL := fs.String("database", config.Load().DatabaseURL, "postgres:// URL or SQLite path")
+	out := fs.String("o", "", "file to write the export to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("missing user")
+	}
+
+	store, err := storage.Open(*dbURL)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	userID := fs.Arg(0)
+	if strings.Contains(userID, "@") {
+		user, err := store.GetUserByEmail(userID)
+		if err != nil || user == nil {
+			return storage.ErrUserNotFound
+		}
+		userID = user.ID
+	}
+	export, err := store.ExportUser(userID)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
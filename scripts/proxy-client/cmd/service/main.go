@@ -11,6 +11,25 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		if err := runBackup(os.Args[2:]); err != nil {
+			log.Fatal("Backup failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			log.Fatal("Export failed: ", err)
+		}
+		return
+	}
+
 	if os.Getuid() != 0 {
 		log.Println("WARNING: AtlanticProxy Service is running without root privileges. Network interface configuration (TUN) will be skipped.")
 	}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/atlanticproxy/proxy-client/pkg/config"
+)
+
+const migrateUsage = `Usage: atlantic-service migrate [-database URL] <command>
+
+Commands:
+  status    list the migrations and whether they are applied
+  up        apply the pending migrations
+  down [n]  revert the latest n applied migrations (default 1)
+  redo      revert the latest applied migration and apply it again
+
+The database is DATABASE_URL or database_url in config.yaml, or else the
+default SQLite database.
+`
+
+// runMigrate manages the schema of the database
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, migrateUsage) }
+	dbURL := fs.String("database", config.Load().DatabaseURL, "postgres:// URL or SQLite path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing command")
+	}
+
+	db, dialect, err := storage.OpenDatabase(*dbURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	migrator, err := storage.NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	switch cmd := fs.Arg(0); cmd {
+	case "status":
+		return printMigrations(migrator, dialect)
+	case "up":
+		n, err := migrator.Up()
+		fmt.Printf("Applied %d migration(s)\n", n)
+		return err
+	case "down":
+		steps := 1
+		if fs.NArg() > 1 {
+			if steps, err = strconv.Atoi(fs.Arg(1)); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations: %s", fs.Arg(1))
+			}
+		}
+		n, err := migrator.Down(steps)
+		fmt.Printf("Reverted %d migration(s)\n", n)
+		return err
+	case "redo":
+		if err := migrator.Redo(); err != nil {
+			return err
+		}
+		fmt.Println("Redid the latest migration")
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func printMigrations(migrator *storage.Migrator, dialect storage.Dialect) error {
+	status, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Dialect: %s\n\n", dialect)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+	for _, st := range status {
+		state := "pending"
+		if st.AppliedAt != nil {
+			state = "applied " + st.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		switch {
+		case st.Unknown:
+			state += " (unknown to this release)"
+		case st.Modified:
+			state += " (changed since applied)"
+		}
+		fmt.Fprintf(w, "%03d\t%s\t%s\n", st.Version, st.Name, state)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/atlanticproxy/proxy-client/internal/auth"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DeleteAccountRequest confirms the deletion of the signed-in account. Code
+// is only needed if two-factor authentication is enabled.
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code"`
+}
+
+// SetBackups sets the backups of the database admins may take and download
+func (s *Server) SetBackups(b *storage.Backups) {
+	s.backups = b
+}
+
+// handleExportAccount returns everything kept about the signed-in user
+func (s *Server) handleExportAccount(c *gin.Context) {
+	s.exportUser(c, c.GetString("user_id"))
+}
+
+// handleDeleteAccount deletes the signed-in user and everything kept about
+// them, once they confirm their password
+func (s *Server) handleDeleteAccount(c *gin.Context) {
+	var req DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password required"})
+		return
+	}
+
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Confirmation guesses count like sign-in failures
+	attempt, ok := s.beginLogin(c, user.Email)
+	if !ok {
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		s.auth.LoginFailed(attempt, user)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	if err := s.auth.VerifySecondFactor(user.ID, req.Code); err != nil && err != auth.ErrTwoFactorNotEnabled {
+		s.auth.LoginFailed(attempt, user)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	s.auth.AbandonLogin(attempt)
+
+	s.deleteUser(c, user.ID)
+}
+
+// handleAdminExportUser returns everything kept about a user
+func (s *Server) handleAdminExportUser(c *gin.Context) {
+	s.exportUser(c, c.Param("id"))
+}
+
+// handleAdminDeleteUser deletes a user and everything kept about them
+func (s *Server) handleAdminDeleteUser(c *gin.Context) {
+	s.deleteUser(c, c.Param("id"))
+}
+
+// exportUser responds with a download of everything kept about a user
+func (s *Server) exportUser(c *gin.Context, userID string) {
+	export, err := s.store.ExportUser(userID)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to export user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export data"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=atlanticproxy-export.json")
+	c.JSON(http.StatusOK, export)
+}
+
+// deleteUser stops what a user is billed for, signs them out everywhere
+// and deletes everything kept about them
+func (s *Server) deleteUser(c *gin.Context, userID string) {
+	if user, err := s.store.GetUserByID(userID); err != nil || user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// A subscription still billed by a provider must be stopped before the
+	// record of it is gone. Members only leave the one they share.
+	if err := s.billingManager.CloseAccount(userID); err != nil {
+		s.logger.Errorf("Failed to close billing of %s before deletion: %v", userID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to cancel subscription"})
+		return
+	}
+	if _, err := s.auth.RevokeAllSessions(userID, ""); err != nil {
+		s.logger.Errorf("Failed to revoke sessions of %s before deletion: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	err := s.store.DeleteUser(userID)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to delete user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	s.billingManager.Forget(userID)
+
+	s.logger.Infof("Deleted user %s and their data", userID)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// handleAdminListBackups lists the database backups, newest first
+func (s *Server) handleAdminListBackups(c *gin.Context) {
+	if s.backups == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Backups not available"})
+		return
+	}
+	files, err := s.backups.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list backups"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"backups": files})
+}
+
+// handleAdminCreateBackup takes a backup of the database now
+func (s *Server) handleAdminCreateBackup(c *gin.Context) {
+	if s.backups == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Backups not available"})
+		return
+	}
+	file, err := s.backups.Create()
+	if err != nil {
+		s.logger.Errorf("Failed to back up database: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to back up database"})
+		return
+	}
+	c.JSON(http.StatusCreated, file)
+}
+
+// handleAdminDownloadBackup downloads a database backup
+func (s *Server) handleAdminDownloadBackup(c *gin.Context) {
+	if s.backups == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Backups not available"})
+		return
+	}
+	file, err := s.backups.Get(c.Param("name"))
+	if errors.Is(err, storage.ErrBackupNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read backup"})
+		return
+	}
+	c.FileAttachment(file.Path, file.Name)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/auth"
+	"github.com/atlanticproxy/proxy-client/internal/middleware"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" binding:"required,max=64"`
+	Scopes        []string `json:"scopes" binding:"required"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 means the key does not expire
+}
+
+// CreateAPIKeyResponse carries the plaintext key, which is only shown once
+type CreateAPIKeyResponse struct {
+	*storage.APIKey
+	Key string `json:"key"`
+}
+
+// handleListAPIKeys lists the user's API keys without their secrets
+func (s *Server) handleListAPIKeys(c *gin.Context) {
+	keys, err := s.auth.ListAPIKeys(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+	if keys == nil {
+		keys = []*storage.APIKey{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys, "available_scopes": auth.Scopes})
+}
+
+// handleCreateAPIKey creates a scoped API key for the user
+func (s *Server) handleCreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must not be negative"})
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	key, plaintext, err := s.auth.CreateAPIKey(c.GetString("user_id"), req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrAPIAccessDenied):
+			if !middleware.DenyEntitlement(c, err) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			}
+		case errors.Is(err, auth.ErrInvalidScope):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateAPIKeyResponse{APIKey: key, Key: plaintext})
+}
+
+// handleDeleteAPIKey revokes an API key
+func (s *Server) handleDeleteAPIKey(c *gin.Context) {
+	if err := s.auth.DeleteAPIKey(c.GetString("user_id"), c.Param("id")); err != nil {
+		if err == auth.ErrAPIKeyNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
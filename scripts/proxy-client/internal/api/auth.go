@@ -1,9 +1,13 @@
 package api
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/atlanticproxy/proxy-client/internal/auth"
 	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -11,8 +15,9 @@ import (
 )
 
 type RegisterRequest struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=8"`
+	Email        string `json:"email" binding:"required,email"`
+	Password     string `json:"password" binding:"required,min=8"`
+	ReferralCode string `json:"referral_code"`
 }
 
 type LoginRequest struct {
@@ -20,9 +25,31 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8"`
+}
+
 type AuthResponse struct {
-	Token string        `json:"token"`
-	User  *storage.User `json:"user"`
+	Token        string        `json:"token"`
+	RefreshToken string        `json:"refresh_token"`
+	ExpiresIn    int64         `json:"expires_in"`
+	User         *storage.User `json:"user"`
+}
+
+// SessionInfo describes one signed-in device
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
 }
 
 func (s *Server) handleRegister(c *gin.Context) {
@@ -58,30 +85,32 @@ func (s *Server) handleRegister(c *gin.Context) {
 		return
 	}
 
-	// Create session
-	session := &storage.Session{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		Token:     uuid.New().String(),
-		ExpiresAt: time.Now().Add(24 * time.Hour),
-		CreatedAt: time.Now(),
+	// A bad referral code does not stop the sign-up
+	if req.ReferralCode != "" && s.billingManager != nil {
+		if err := s.billingManager.Refer(user.ID, req.ReferralCode); err != nil {
+			s.logger.Warnf("Failed to record referral of %s: %v", user.ID, err)
+		}
 	}
 
-	if err := s.store.CreateSession(session.ID, session.UserID, session.Token, session.ExpiresAt); err != nil {
+	go func() {
+		if err := s.sendVerificationEmail(user); err != nil {
+			s.logger.Errorf("Failed to send verification email: %v", err)
+		}
+	}()
+
+	tokens, err := s.auth.IssueSession(user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		s.logger.Errorf("Failed to create session: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
 
-	// Set as active user for billing/proxy context
-	// In a real multi-user server, we wouldn't do this globally, but for a local desktop app verify flow, this is correct.
+	// The desktop app's local proxy listeners bill the signed-in user
 	if s.billingManager != nil {
-		s.billingManager.SetActiveUser(user.ID)
+		s.billingManager.SetLocalUser(user.ID)
 	}
 
-	c.JSON(http.StatusCreated, AuthResponse{
-		Token: session.Token,
-		User:  user,
-	})
+	c.JSON(http.StatusCreated, newAuthResponse(tokens, user))
 }
 
 func (s *Server) handleLogin(c *gin.Context) {
@@ -95,48 +124,118 @@ func (s *Server) handleLogin(c *gin.Context) {
 		return
 	}
 
+	attempt, ok := s.beginLogin(c, req.Email)
+	if !ok {
+		return
+	}
+
 	user, err := s.store.GetUserByEmail(req.Email)
 	if err != nil || user == nil {
+		s.auth.LoginFailed(attempt, nil)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
 
-	// Note: In production compare hash properly
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		s.auth.LoginFailed(attempt, user)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
 
-	// Create session
-	session := &storage.Session{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		Token:     uuid.New().String(),
-		ExpiresAt: time.Now().Add(24 * time.Hour),
-		CreatedAt: time.Now(),
+	// With 2FA enabled the password only earns a challenge, exchanged for a
+	// session at /api/auth/2fa/verify
+	if enabled, _, err := s.auth.TwoFactorStatus(user.ID); err != nil {
+		s.logger.Errorf("Failed to load 2FA status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	} else if enabled {
+		s.auth.SecondFactorPending(attempt)
+		challenge, err := s.auth.IssueChallenge(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+		c.JSON(http.StatusOK, TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			ExpiresIn:         int64(auth.ChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	s.auth.LoginSucceeded(attempt, user)
+	s.completeLogin(c, user)
+}
+
+// beginLogin counts a sign-in attempt before any credential is checked. It
+// responds and returns false if the attempt is throttled.
+func (s *Server) beginLogin(c *gin.Context, email string) (*auth.LoginAttempt, bool) {
+	attempt, err := s.auth.BeginLogin(email, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		if !s.respondThrottled(c, err, "Too many failed sign-in attempts, please try again later") {
+			s.logger.Errorf("Failed to check login throttling: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		}
+		return nil, false
+	}
+	return attempt, true
+}
+
+// respondThrottled answers with 429 and message if err is a
+// *auth.LoginThrottledError
+func (s *Server) respondThrottled(c *gin.Context, err error, message string) bool {
+	var throttled *auth.LoginThrottledError
+	if !errors.As(err, &throttled) {
+		return false
 	}
+	retryAfter := int64(math.Ceil(throttled.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       message,
+		"retry_after": retryAfter,
+		"locked":      throttled.Locked,
+	})
+	return true
+}
 
-	if err := s.store.CreateSession(session.ID, session.UserID, session.Token, session.ExpiresAt); err != nil {
+// completeLogin creates the session once every factor has been verified
+func (s *Server) completeLogin(c *gin.Context, user *storage.User) {
+	tokens, err := s.auth.IssueSession(user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		s.logger.Errorf("Failed to create session: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
 
-	// Set as active user for billing/proxy context
+	// The desktop app's local proxy listeners bill the signed-in user
 	if s.billingManager != nil {
-		s.billingManager.SetActiveUser(user.ID)
+		s.billingManager.SetLocalUser(user.ID)
 	}
 
-	c.JSON(http.StatusOK, AuthResponse{
-		Token: session.Token,
-		User:  user,
-	})
+	c.JSON(http.StatusOK, newAuthResponse(tokens, user))
+}
+
+// handleRefresh exchanges a refresh token for a new access/refresh token pair
+func (s *Server) handleRefresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token required"})
+		return
+	}
+
+	tokens, err := s.auth.Refresh(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
 }
 
 func (s *Server) handleMe(c *gin.Context) {
-	// Middleware should place user in context
-	user, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
 		return
 	}
 
@@ -144,52 +243,121 @@ func (s *Server) handleMe(c *gin.Context) {
 }
 
 func (s *Server) handleLogout(c *gin.Context) {
-	// Token should be available if middleware passed, but for logout we might extracting it again
-	token := c.GetHeader("Authorization")
-	if len(token) > 7 && token[:7] == "Bearer " {
-		token = token[7:]
+	if err := s.auth.RevokeSession(c.GetString("user_id"), c.GetString("session_id")); err != nil {
+		s.logger.Warnf("Failed to revoke session on logout: %v", err)
 	}
 
-	if token != "" {
-		if err := s.store.DeleteSession(token); err != nil {
-			s.logger.Warnf("Failed to delete session on logout: %v", err)
-		}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// handleChangePassword updates the password and signs out every device,
+// returning a fresh session for the caller
+func (s *Server) handleChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Guesses of the current password count like sign-in failures
+	attempt, ok := s.beginLogin(c, user.Email)
+	if !ok {
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+		s.auth.LoginFailed(attempt, user)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	s.auth.LoginSucceeded(attempt, user)
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	if err := s.store.UpdateUserPassword(user.ID, string(hashed)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	if _, err := s.auth.RevokeAllSessions(user.ID, ""); err != nil {
+		s.logger.Errorf("Failed to revoke sessions after password change: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	tokens, err := s.auth.IssueSession(user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newAuthResponse(tokens, user))
 }
 
-func (s *Server) AuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		if token == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization header"})
-			return
-		}
+// handleListSessions lists the devices the user is signed in on
+func (s *Server) handleListSessions(c *gin.Context) {
+	sessions, err := s.auth.ListSessions(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
 
-		if len(token) > 7 && token[:7] == "Bearer " {
-			token = token[7:]
-		}
+	current := c.GetString("session_id")
+	result := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		result = append(result, SessionInfo{
+			ID:         sess.ID,
+			UserAgent:  sess.UserAgent,
+			IPAddress:  sess.IPAddress,
+			CreatedAt:  sess.CreatedAt,
+			LastUsedAt: sess.LastUsedAt,
+			ExpiresAt:  sess.ExpiresAt,
+			Current:    sess.ID == current,
+		})
+	}
 
-		session, err := s.store.GetSession(token)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid session"})
-			return
-		}
+	c.JSON(http.StatusOK, gin.H{"sessions": result})
+}
 
-		if session.ExpiresAt.Before(time.Now()) {
-			s.store.DeleteSession(token)
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session expired"})
-			return
-		}
+// handleRevokeSessions signs out every other device of the user
+func (s *Server) handleRevokeSessions(c *gin.Context) {
+	count, err := s.auth.RevokeAllSessions(c.GetString("user_id"), c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
 
-		user, err := s.store.GetUserByID(session.UserID)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked", "revoked": count})
+}
+
+// handleRevokeSession signs out a single device
+func (s *Server) handleRevokeSession(c *gin.Context) {
+	if err := s.auth.RevokeSession(c.GetString("user_id"), c.Param("id")); err != nil {
+		if err == auth.ErrSessionNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
 			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
 
-		c.Set("user", user)
-		c.Next()
+func newAuthResponse(tokens *auth.TokenPair, user *storage.User) AuthResponse {
+	return AuthResponse{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		User:         user,
 	}
 }
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/atlanticproxy/proxy-client/internal/proxy"
+	"github.com/gin-gonic/gin"
+)
+
+// shaper returns the shaper of the proxy engine, or responds and returns nil
+// if there is no engine
+func (s *Server) shaper(c *gin.Context) *proxy.Shaper {
+	if s.proxy == nil || s.proxy.Shaper() == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Throughput not available"})
+		return nil
+	}
+	return s.proxy.Shaper()
+}
+
+// handleGetThroughput returns the user's bandwidth and how fast their
+// traffic is going
+func (s *Server) handleGetThroughput(c *gin.Context) {
+	shaper := s.shaper(c)
+	if shaper == nil {
+		return
+	}
+	c.JSON(http.StatusOK, shaper.Throughput(c.GetString("user_id")))
+}
+
+// handleAdminListThroughput lists the throughput of every user with traffic,
+// busiest first
+func (s *Server) handleAdminListThroughput(c *gin.Context) {
+	shaper := s.shaper(c)
+	if shaper == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": shaper.Throughputs()})
+}
+
+// handleAdminSetBandwidth overrides the bandwidth of a user's plan until the
+// service restarts
+func (s *Server) handleAdminSetBandwidth(c *gin.Context) {
+	shaper := s.shaper(c)
+	if shaper == nil {
+		return
+	}
+
+	var limits proxy.Limits
+	if err := c.ShouldBindJSON(&limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if limits.UserKbps < 0 || limits.ConnectionKbps < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bandwidth can not be negative"})
+		return
+	}
+	if user, err := s.store.GetUserByID(c.Param("id")); err != nil || user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	shaper.SetLimits(c.Param("id"), &limits)
+	c.JSON(http.StatusOK, shaper.Throughput(c.Param("id")))
+}
+
+// handleAdminClearBandwidth puts a user back on the bandwidth of their plan
+func (s *Server) handleAdminClearBandwidth(c *gin.Context) {
+	shaper := s.shaper(c)
+	if shaper == nil {
+		return
+	}
+	shaper.SetLimits(c.Param("id"), nil)
+	c.JSON(http.StatusOK, shaper.Throughput(c.Param("id")))
+}
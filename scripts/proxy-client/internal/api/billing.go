@@ -1,28 +1,42 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/atlanticproxy/proxy-client/internal/billing"
 	"github.com/atlanticproxy/proxy-client/internal/payment"
 	"github.com/atlanticproxy/proxy-client/internal/validation"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 var paystackClient = payment.NewPaystackClient()
 
-// handleGetPlans returns all available plans
+// handleGetPlans returns all available plans, priced in ?currency= if given
 func (s *Server) handleGetPlans(c *gin.Context) {
 	plans := s.billingManager.GetAvailablePlans()
+	if code := billing.CurrencyCode(strings.ToUpper(c.Query("currency"))); code != "" {
+		if _, ok := billing.Currencies[code]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+			return
+		}
+		plans = billing.AvailablePlansInCurrency(code)
+	}
 	c.JSON(http.StatusOK, gin.H{"plans": plans})
 }
 
 // handleGetSubscription returns the current user's subscription
 func (s *Server) handleGetSubscription(c *gin.Context) {
-	sub := s.billingManager.GetSubscription()
-	plan, _ := billing.GetPlan(sub.PlanID)
+	userID := c.GetString("user_id")
+	sub := s.billingManager.GetSubscription(userID)
+	// The terms of the version the user subscribed to
+	plan := s.billingManager.CurrentPlan(userID)
 
 	c.JSON(http.StatusOK, gin.H{
 		"subscription": sub,
@@ -41,7 +55,7 @@ func (s *Server) handleSubscribe(c *gin.Context) {
 		return
 	}
 
-	sub, err := s.billingManager.Subscribe(req.PlanID)
+	sub, err := s.billingManager.Subscribe(c.GetString("user_id"), req.PlanID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -50,109 +64,287 @@ func (s *Server) handleSubscribe(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Subscription updated", "subscription": sub})
 }
 
-// handleCancelSubscription cancels the auto-renewal
-func (s *Server) handleCancelSubscription(c *gin.Context) {
-	err := s.billingManager.CancelSubscription()
+// PlanChangeRequest asks to move the subscription to another plan
+type PlanChangeRequest struct {
+	PlanID billing.PlanType `json:"plan_id" binding:"required"`
+	// Method and Currency select how the difference of an upgrade is paid
+	Method   billing.PaymentMethod `json:"method"`
+	Currency string                `json:"currency"`
+}
+
+// handlePreviewPlanChange prices a plan change without making it
+func (s *Server) handlePreviewPlanChange(c *gin.Context) {
+	var req PlanChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	change, err := s.billingManager.PreviewPlanChange(c.GetString("user_id"), req.PlanID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Subscription canceled"})
+	c.JSON(http.StatusOK, gin.H{"change": change})
 }
 
-// handleGetUsage returns the current usage statistics
-func (s *Server) handleGetUsage(c *gin.Context) {
-	stats := s.billingManager.Usage.GetStats()
-	c.JSON(http.StatusOK, stats)
+// handleChangePlan changes the plan mid-cycle. Upgrades that cost something
+// return a checkout for the prorated difference and switch once it is paid;
+// downgrades are scheduled for the end of the period.
+func (s *Server) handleChangePlan(c *gin.Context) {
+	var req PlanChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := c.GetString("user_id")
+
+	change, err := s.billingManager.PreviewPlanChange(userID, req.PlanID)
+	if err == nil && change.Kind == billing.ChangeUpgrade && change.AmountDue > 0 {
+		s.checkoutPlanChange(c, req, change)
+		return
+	}
+
+	change, err = s.billingManager.ChangePlan(userID, req.PlanID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"change":       change,
+		"subscription": s.billingManager.GetSubscription(userID),
+	})
 }
 
-// handleCreateCheckoutSession creates a checkout session for a plan using selected method
-func (s *Server) handleCreateCheckoutSession(c *gin.Context) {
-	var req billing.CheckoutRequest
+// checkoutPlanChange creates the checkout for the prorated difference of an
+// upgrade. The payment webhook applies the upgrade.
+func (s *Server) checkoutPlanChange(c *gin.Context, req PlanChangeRequest, change *billing.PlanChange) {
+	user, ok := s.requireVerifiedEmail(c)
+	if !ok {
+		return
+	}
+	sub := s.billingManager.GetSubscription(user.ID)
+
+	method := req.Method
+	if method == "" {
+		method = billing.MethodPaystack
+	}
+	currency := req.Currency
+	if currency == "" && method == billing.MethodPaystack {
+		currency = string(change.Currency)
+	}
+
+	checkout, err := s.billingManager.ProcessCheckout(billing.CheckoutRequest{
+		PlanID:    string(change.To),
+		Email:     user.Email,
+		Method:    method,
+		Currency:  currency,
+		AmountUSD: change.AmountDueUSD,
+		Reference: "CHANGE-" + uuid.New().String(),
+		Metadata: map[string]string{
+			"user_id":         user.ID,
+			"plan_id":         string(change.To),
+			"subscription_id": sub.ID,
+		},
+	})
+	if err != nil {
+		s.logger.Errorf("Failed to create checkout for plan change: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create checkout"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"change":   change,
+		"checkout": checkout,
+	})
+}
+
+// handleGetCredits returns the pay-as-you-go credit balance and a page of the
+// credit ledger
+func (s *Server) handleGetCredits(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
 
+	balance, err := s.billingManager.CreditBalance(userID)
+	if err != nil {
+		s.logger.Errorf("Failed to load credit balance: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credits"})
+		return
+	}
+	entries, total, err := s.billingManager.CreditHistory(userID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load credit history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credits"})
+		return
+	}
+
+	history := make([]gin.H, 0, len(entries))
+	for _, e := range entries {
+		history = append(history, gin.H{
+			"id":          e.TxnID,
+			"kind":        e.Kind,
+			"description": e.Description,
+			"amount":      e.AmountUSD(),
+			"created_at":  e.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"currency": string(billing.CurrencyUSD),
+		"credits":  balance,
+		"history":  history,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// CreditTopUpRequest asks to buy pay-as-you-go credits
+type CreditTopUpRequest struct {
+	AmountUSD float64               `json:"amount" binding:"required"`
+	Method    billing.PaymentMethod `json:"method"`
+	Currency  string                `json:"currency"`
+}
+
+// handleTopUpCredits creates a checkout for a credit purchase. The payment
+// webhook books the credits.
+func (s *Server) handleTopUpCredits(c *gin.Context) {
+	var req CreditTopUpRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.AmountUSD < billing.MinTopUpUSD {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The minimum top-up is $%.2f", billing.MinTopUpUSD)})
+		return
+	}
 
-	resp, err := s.billingManager.ProcessCheckout(req)
+	user, ok := s.requireVerifiedEmail(c)
+	if !ok {
+		return
+	}
+
+	method := req.Method
+	if method == "" {
+		method = billing.MethodPaystack
+	}
+	checkout, err := s.billingManager.ProcessCheckout(billing.CheckoutRequest{
+		PlanID:    string(billing.PlanPAYG),
+		Email:     user.Email,
+		Method:    method,
+		Currency:  req.Currency,
+		AmountUSD: req.AmountUSD,
+		Reference: "CREDIT-" + uuid.New().String(),
+		Metadata: map[string]string{
+			"user_id": user.ID,
+			"plan_id": string(billing.PlanPAYG),
+		},
+	})
+	if err != nil {
+		s.logger.Errorf("Failed to create checkout for credits: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create checkout"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"checkout": checkout})
+}
+
+// handleCancelSubscription cancels the auto-renewal
+func (s *Server) handleCancelSubscription(c *gin.Context) {
+	err := s.billingManager.CancelSubscription(c.GetString("user_id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "Subscription canceled"})
+}
+
+// UsageResponse is the usage of the current period and how the plan's data
+// limit applies to it
+type UsageResponse struct {
+	*billing.UsageStats
+	Quota *billing.QuotaStatus `json:"quota,omitempty"`
+}
+
+// handleGetUsage returns the current usage statistics, with the quota mode
+// and the overage to be charged with the next renewal
+func (s *Server) handleGetUsage(c *gin.Context) {
+	userID := c.GetString("user_id")
+	resp := UsageResponse{UsageStats: s.billingManager.GetUsage(userID)}
+	quota, err := s.billingManager.QuotaStatus(userID)
+	if err != nil {
+		s.logger.Warnf("Failed to load quota of %s: %v", userID, err)
+	}
+	resp.Quota = quota
 	c.JSON(http.StatusOK, resp)
 }
 
-// handleDownloadInvoice generates and downloads a PDF invoice
-func (s *Server) handleDownloadInvoice(c *gin.Context) {
-	id := c.Param("id")
-
-	var data *billing.InvoiceData
-	if id == "test" {
-		// Mock Data for testing
-		data = &billing.InvoiceData{
-			ID:            "INV-TEST-001",
-			Date:          time.Now(),
-			CustomerName:  "Test User",
-			CustomerEmail: "user@example.com",
-			Currency:      "NGN",
-			Symbol:        "₦",
-			Items: []billing.InvoiceItem{
-				{Description: "AtlanticProxy Starter Plan (Monthly)", Quantity: 1, Price: 13635.00, Amount: 13635.00},
-			},
-			Total: 13635.00,
-		}
-	} else {
-		// Fetch transaction from database
-		tx, err := s.store.GetTransaction(id)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
-			return
-		}
+// handleSetQuotaMode sets what happens once the data limit is used up: hard
+// stops traffic, soft bills the overage and throttle slows traffic down
+func (s *Server) handleSetQuotaMode(c *gin.Context) {
+	var req struct {
+		Mode string `json:"mode" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
 
-		// Get user details
-		user, err := s.store.GetUserByID(tx.UserID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user details"})
+	userID := c.GetString("user_id")
+	if _, err := s.billingManager.SetQuotaMode(userID, req.Mode); err != nil {
+		if errors.Is(err, billing.ErrInvalidQuotaMode) || errors.Is(err, billing.ErrQuotaModeUnavailable) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		s.logger.Errorf("Failed to set quota mode: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set quota mode"})
+		return
+	}
 
-		// Get plan details
-		plan, err := billing.GetPlan(billing.PlanType(tx.PlanID))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch plan details"})
-			return
-		}
+	quota, err := s.billingManager.QuotaStatus(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load quota"})
+		return
+	}
+	c.JSON(http.StatusOK, quota)
+}
 
-		// Get currency symbol
-		currencyCode := billing.CurrencyCode(tx.Currency)
-		symbol := billing.GetCurrencySymbol(currencyCode)
-
-		data = &billing.InvoiceData{
-			ID:            "INV-" + tx.ID,
-			Date:          tx.CreatedAt,
-			CustomerName:  "", // Could add name field to users table
-			CustomerEmail: user.Email,
-			Currency:      tx.Currency,
-			Symbol:        symbol,
-			Items: []billing.InvoiceItem{
-				{Description: plan.Name + " Plan (Monthly)", Quantity: 1, Price: tx.Amount, Amount: tx.Amount},
-			},
-			Total: tx.Amount,
-		}
+// handleCreateCheckoutSession creates a checkout session for a plan using selected method
+func (s *Server) handleCreateCheckoutSession(c *gin.Context) {
+	if _, ok := s.requireVerifiedEmail(c); !ok {
+		return
+	}
+
+	var req billing.CheckoutRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	pdfBytes, err := billing.GenerateInvoicePDF(data)
+	// Gateways pass the metadata back, so the payment finds its user
+	req.Metadata = map[string]string{"user_id": c.GetString("user_id")}
+
+	resp, err := s.billingManager.ProcessCheckout(req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice"})
+		if !couponError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	c.Header("Content-Type", "application/pdf")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=invoice_%s.pdf", id))
-	c.Data(http.StatusOK, "application/pdf", pdfBytes)
+	c.JSON(http.StatusOK, resp)
 }
 
 type TrialRequest struct {
@@ -163,39 +355,52 @@ type BillingStatusResponse struct {
 	Plan           string    `json:"plan"`
 	Status         string    `json:"status"`
 	NextBillingDate time.Time `json:"next_billing_date"`
+	GraceUntil     *time.Time `json:"grace_until,omitempty"` // set while a renewal payment is past due
 	DataUsed       int64     `json:"data_used"`
 	DataLimit      int64     `json:"data_limit"`
 	DepositAmount  float64   `json:"deposit_amount"`
-	DepositStatus  string    `json:"deposit_status"`
+	DepositCurrency string   `json:"deposit_currency,omitempty"`
+	DepositStatus  string    `json:"deposit_status"` // held, refund_scheduled, refunded or forfeited; empty without a deposit
 }
 
 func (s *Server) handleStartTrial(c *gin.Context) {
-	var req struct {
-		Email string `json:"email" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	user, ok := s.requireVerifiedEmail(c)
+	if !ok {
 		return
 	}
 
-	// Validate email
-	if err := validation.ValidateEmail(req.Email); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// Initialize combined payment (deposit + first week): $7.99 in NGN at
+	// the current rate, locked for when the payment arrives
+	ref := fmt.Sprintf("TRIAL-%s-%d", user.ID, time.Now().Unix())
+	callbackURL := "http://localhost:3000/payment/callback"
+	rates := billing.ExchangeRates()
+	quote, err := rates.Lock(ref, rates.QuotePrice(billing.TrialChargeUSD, billing.CurrencyNGN))
+	if err != nil {
+		s.logger.Errorf("Failed to price trial: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment initialization failed"})
 		return
 	}
+	amount := int(quote.MinorUnits())
 
-	// Initialize combined payment (deposit + first week)
-	// Total: ₦13,080 ($7.99)
-	ref := fmt.Sprintf("TRIAL-%d", time.Now().Unix())
-	callbackURL := "http://localhost:3000/payment/callback"
-	
 	// Validate amount
-	if err := validation.ValidateAmount(1308000, 1000000, 2000000); err != nil {
+	if err := validation.ValidateAmount(amount, 1, math.MaxInt32); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
 		return
 	}
 	
-	resp, err := paystackClient.InitializeTransaction(req.Email, 1308000, ref, callbackURL)
+	// The trial is paid from the account's own email; the webhook finds the
+	// user and plan in the metadata
+	resp, err := paystackClient.InitializeTransaction(payment.InitializeRequest{
+		Email:       user.Email,
+		Amount:      amount,
+		Currency:    string(quote.Currency),
+		Reference:   ref,
+		CallbackURL: callbackURL,
+		Metadata: map[string]interface{}{
+			"user_id": user.ID,
+			"plan_id": string(billing.PlanPersonal),
+		},
+	})
 	if err != nil {
 		s.logger.Errorf("Payment initialization failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment initialization failed"})
@@ -205,11 +410,13 @@ func (s *Server) handleStartTrial(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"authorization_url": resp.Data.AuthorizationURL,
 		"reference":         resp.Data.Reference,
+		"quote":             quote,
 	})
 }
 
 func (s *Server) handleGetBillingStatus(c *gin.Context) {
-	stats := s.billingManager.Usage.GetStats()
+	userID := c.GetString("user_id")
+	stats := s.billingManager.GetUsage(userID)
 	
 	status := BillingStatusResponse{
 		Plan:            "starter",
@@ -217,8 +424,25 @@ func (s *Server) handleGetBillingStatus(c *gin.Context) {
 		NextBillingDate: time.Now().Add(7 * 24 * time.Hour),
 		DataUsed:        stats.DataTransferred,
 		DataLimit:       10 * 1024 * 1024 * 1024,
-		DepositAmount:   1.00,
-		DepositStatus:   "held",
+	}
+	if deposit, err := s.store.GetDepositTransaction(userID); err != nil {
+		s.logger.Errorf("Failed to load deposit: %v", err)
+	} else if deposit != nil {
+		status.DepositAmount = deposit.DepositAmount
+		status.DepositCurrency = deposit.Currency
+		status.DepositStatus = deposit.DepositStatus
+	}
+	if sub := s.billingManager.GetSubscription(userID); sub != nil {
+		status.Plan = string(sub.PlanID)
+		status.Status = sub.Status
+		status.NextBillingDate = sub.EndDate
+		status.GraceUntil = sub.GraceUntil
+		if plan, err := billing.GetPlanVersion(sub.PlanID, sub.PlanVersion); err == nil {
+			status.DataLimit = -1 // unlimited
+			if plan.DataLimitMB != -1 {
+				status.DataLimit = plan.DataLimitMB * 1024 * 1024
+			}
+		}
 	}
 
 	c.JSON(http.StatusOK, status)
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
+	"github.com/gin-gonic/gin"
+)
+
+// SetCryptoWatcher applies the crypto payments the watcher confirms
+func (s *Server) SetCryptoWatcher(w *billing.CryptoWatcher) {
+	s.cryptoWatcher = w
+	w.HandlePaid(s.cryptoPaid)
+}
+
+// cryptoPaid hands a confirmed intent to the queue, so applying it is retried
+// like a gateway webhook
+func (s *Server) cryptoPaid(intent *billing.CryptoIntent) error {
+	payload, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	if s.queue == nil {
+		return s.processCryptoEvent(&queue.Event{Type: "intent.paid", Key: intent.ID, Payload: payload})
+	}
+	_, err = s.queue.Receive("crypto", "intent.paid", intent.ID, payload)
+	return err
+}
+
+// processCryptoEvent applies a paid crypto intent
+func (s *Server) processCryptoEvent(e *queue.Event) error {
+	var intent billing.CryptoIntent
+	if err := json.Unmarshal(e.Payload, &intent); err != nil {
+		return queue.Permanent(fmt.Errorf("failed to parse intent: %w", err))
+	}
+
+	// An overpayment is kept on the chain; the plan is charged at its quote
+	amount := math.Round(min(intent.AmountPaidUSD(), intent.AmountUSD)*100) / 100
+
+	return s.applyPayment(gatewayPayment{
+		Reference:      intent.ID,
+		UserID:         intent.UserID,
+		PlanID:         intent.PlanID,
+		Email:          intent.Email,
+		SubscriptionID: intent.Metadata["subscription_id"],
+		Amount:         amount,
+		Currency:       "USD",
+		Method:         billing.MethodCrypto,
+		GatewayRef:     strings.Join(intent.TxIDs, ","),
+	})
+}
+
+// handleGetCryptoIntent reports the status of the user's crypto payment
+func (s *Server) handleGetCryptoIntent(c *gin.Context) {
+	if s.cryptoWatcher == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Crypto payments not available"})
+		return
+	}
+
+	intent, err := s.cryptoWatcher.Intent(c.Param("id"))
+	if err != nil || !s.ownsCryptoIntent(c, intent) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+
+	asset := billing.CryptoAssets[intent.Asset]
+	c.JSON(http.StatusOK, gin.H{
+		"id":            intent.ID,
+		"status":        intent.Status,
+		"currency":      strings.ToUpper(intent.Asset),
+		"address":       intent.Address,
+		"amount":        asset.FormatUnits(intent.Amount),
+		"received":      asset.FormatUnits(intent.Received),
+		"confirmations": intent.Confirmations,
+		"expires_at":    intent.ExpiresAt,
+		"paid_at":       intent.PaidAt,
+	})
+}
+
+func (s *Server) ownsCryptoIntent(c *gin.Context, intent *billing.CryptoIntent) bool {
+	userID := c.GetString("user_id")
+	if intent.UserID != "" {
+		return intent.UserID == userID
+	}
+	user, err := s.store.GetUserByID(userID)
+	return err == nil && user != nil && strings.EqualFold(user.Email, intent.Email)
+}
+
+// handleAdminListCryptoIntents lists crypto intents, such as the underpaid
+// and late ones waiting for review
+func (s *Server) handleAdminListCryptoIntents(c *gin.Context) {
+	if s.cryptoWatcher == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Crypto payments not available"})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	intents, total, err := s.cryptoWatcher.Intents(c.Query("status"), pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load crypto intents: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load crypto intents"})
+		return
+	}
+	if intents == nil {
+		intents = []*billing.CryptoIntent{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"intents":  intents,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// handleAdminAcceptCryptoIntent applies an underpaid or late payment after
+// review
+func (s *Server) handleAdminAcceptCryptoIntent(c *gin.Context) {
+	if s.cryptoWatcher == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Crypto payments not available"})
+		return
+	}
+
+	id := c.Param("id")
+	if _, err := s.cryptoWatcher.Intent(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Crypto intent not found"})
+		return
+	}
+
+	intent, err := s.cryptoWatcher.Accept(id, time.Now())
+	if errors.Is(err, billing.ErrIntentNotReviewable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to accept crypto intent %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept payment"})
+		return
+	}
+
+	s.logger.Infof("Crypto intent %s accepted by %s", id, c.GetString("user_id"))
+	c.JSON(http.StatusOK, intent)
+}
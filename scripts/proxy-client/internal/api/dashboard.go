@@ -2,8 +2,10 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/gin-gonic/gin"
 )
 
@@ -129,58 +131,32 @@ func (s *Server) handleGetServersStatus(c *gin.Context) {
 
 // Activity endpoints
 func (s *Server) handleGetActivityLog(c *gin.Context) {
-	stats := s.analyticsManager.GetStats()
-	events := stats["recent_events"]
-
-	// Convert rotation events to activity log format
-	var activities []map[string]interface{}
-	if eventSlice, ok := events.([]interface{}); ok {
-		for _, e := range eventSlice {
-			activities = append(activities, map[string]interface{}{
-				"timestamp": time.Now().Add(-time.Hour),
-				"type":      "rotation",
-				"status":    "success",
-				"details":   e,
-			})
-		}
+	userID := c.GetString("user_id")
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
 	}
 
-	// Add mock activities
-	mockActivities := []map[string]interface{}{
-		{
-			"id":        "1",
-			"timestamp": time.Now().Add(-10 * time.Minute).Format(time.RFC3339),
-			"type":      "connection",
-			"status":    "success",
-			"details":   "Connected to US East server",
-			"ip":        "192.168.1.1",
-			"location":  "New York, US",
-		},
-		{
-			"id":        "2",
-			"timestamp": time.Now().Add(-25 * time.Minute).Format(time.RFC3339),
-			"type":      "rotation",
-			"status":    "success",
-			"details":   "IP rotated (sticky session expired)",
-			"ip":        "192.168.1.2",
-			"location":  "Los Angeles, US",
-		},
-		{
-			"id":        "3",
-			"timestamp": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
-			"type":      "security",
-			"status":    "blocked",
-			"details":   "Blocked malicious request",
-			"ip":        "10.0.0.1",
-			"location":  "Unknown",
-		},
+	activities, total, err := s.store.ListActivities(userID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load activity log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load activity log"})
+		return
+	}
+	if activities == nil {
+		activities = []*storage.Activity{}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"activities": mockActivities,
-		"total":      len(mockActivities),
-		"page":       1,
-		"pageSize":   20,
+		"activities": activities,
+		"total":      total,
+		"page":       page,
+		"pageSize":   pageSize,
 	})
 }
 
@@ -192,6 +168,8 @@ func (s *Server) handleGetSettings(c *gin.Context) {
 		return
 	}
 
+	twoFactorEnabled, _, _ := s.auth.TwoFactorStatus(userID)
+
 	settings := map[string]interface{}{
 		"account": map[string]interface{}{
 			"email":    "user@example.com",
@@ -203,7 +181,7 @@ func (s *Server) handleGetSettings(c *gin.Context) {
 			"notifications": true,
 		},
 		"security": map[string]interface{}{
-			"twoFactorEnabled": false,
+			"twoFactorEnabled": twoFactorEnabled,
 			"sessions": []map[string]interface{}{
 				{
 					"id":         "session-1",
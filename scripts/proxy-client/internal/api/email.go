@@ -0,0 +1,178 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/atlanticproxy/proxy-client/internal/auth"
+	"github.com/atlanticproxy/proxy-client/internal/mailer"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type EmailTokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8"`
+}
+
+// handleVerifyEmail confirms an email address from the emailed link
+func (s *Server) handleVerifyEmail(c *gin.Context) {
+	var req EmailTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token required"})
+		return
+	}
+
+	userID, err := s.auth.ConsumeEmailToken(req.Token, auth.PurposeVerifyEmail)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+
+	if err := s.store.MarkEmailVerified(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// handleResendVerification sends a fresh verification link to the signed-in user
+func (s *Server) handleResendVerification(c *gin.Context) {
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+		return
+	}
+	if !s.checkMailRequest(c, user.Email) {
+		return
+	}
+
+	if err := s.sendVerificationEmail(user); err != nil {
+		s.logger.Errorf("Failed to send verification email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// handleForgotPassword emails a reset link. The response is the same whether
+// or not the account exists so it can not be used to probe for users.
+func (s *Server) handleForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Valid email required"})
+		return
+	}
+	if !s.checkMailRequest(c, req.Email) {
+		return
+	}
+
+	if user, err := s.store.GetUserByEmail(req.Email); err == nil && user != nil {
+		token, err := s.auth.IssueEmailToken(user.ID, auth.PurposePasswordReset, auth.PasswordResetTTL)
+		if err != nil {
+			s.logger.Errorf("Failed to issue reset token: %v", err)
+		} else {
+			msg := mailer.PasswordResetEmail(user.Email, s.appURL, token, auth.PasswordResetTTL)
+			go func() {
+				if err := s.mailer.Send(msg); err != nil {
+					s.logger.Errorf("Failed to send password reset email: %v", err)
+				}
+			}()
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If an account exists for that email, a reset link has been sent"})
+}
+
+// handleResetPassword sets a new password from a reset link and signs out
+// every device
+func (s *Server) handleResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := s.auth.ConsumeEmailToken(req.Token, auth.PurposePasswordReset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	if err := s.store.UpdateUserPassword(userID, string(hashed)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	if _, err := s.auth.RevokeAllSessions(userID, ""); err != nil {
+		s.logger.Errorf("Failed to revoke sessions after password reset: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	// The reset link proved the user controls the mailbox
+	if err := s.store.MarkEmailVerified(userID); err != nil {
+		s.logger.Warnf("Failed to mark email verified: %v", err)
+	}
+	if user, err := s.store.GetUserByID(userID); err == nil && user != nil {
+		s.auth.ClearLoginFailures(user.Email)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset, please sign in again"})
+}
+
+// checkMailRequest throttles requests that send mail to email. It responds
+// and returns false if the request has to wait.
+func (s *Server) checkMailRequest(c *gin.Context, email string) bool {
+	err := s.auth.CheckMailRequest(email, c.ClientIP())
+	if err == nil {
+		return true
+	}
+	if !s.respondThrottled(c, err, "Too many emails requested, please try again later") {
+		s.logger.Errorf("Failed to check mail throttling: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+	}
+	return false
+}
+
+func (s *Server) sendVerificationEmail(user *storage.User) error {
+	token, err := s.auth.IssueEmailToken(user.ID, auth.PurposeVerifyEmail, auth.VerifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(mailer.VerificationEmail(user.Email, s.appURL, token, auth.VerifyEmailTTL))
+}
+
+// requireVerifiedEmail loads the signed-in user and rejects the request if
+// their email address is not verified
+func (s *Server) requireVerifiedEmail(c *gin.Context) (*storage.User, bool) {
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	if !user.EmailVerified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Please verify your email address before making a payment", "email_verification_required": true})
+		return nil, false
+	}
+	return user, true
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/mailer"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// SetInvoicer sets what invoices payments as they are recorded
+func (s *Server) SetInvoicer(iv *billing.Invoicer) {
+	s.invoicer = iv
+}
+
+// issueInvoice invoices a payment just recorded. The subscription, if any,
+// gives the period the payment covers.
+func (s *Server) issueInvoice(tx *storage.Transaction, email string) {
+	if s.invoicer == nil {
+		return
+	}
+	inv, err := s.invoicer.Issue(s.invoiceRequest(tx, email, s.billingManager.GetSubscription(tx.UserID)))
+	if err != nil {
+		s.logger.Errorf("Failed to invoice payment %s: %v", tx.ID, err)
+		return
+	}
+	s.logger.Infof("Issued invoice %s for payment %s", inv.Number, tx.ID)
+}
+
+// invoiceRequest describes what a payment paid for
+func (s *Server) invoiceRequest(tx *storage.Transaction, email string, sub *billing.Subscription) billing.InvoiceRequest {
+	req := billing.InvoiceRequest{
+		TransactionID: tx.ID,
+		UserID:        tx.UserID,
+		Email:         email,
+		Currency:      billing.CurrencyCode(tx.Currency),
+		IssuedAt:      tx.CreatedAt,
+	}
+	if strings.HasPrefix(tx.ID, "CREDIT-") {
+		req.Lines = []billing.InvoiceLine{
+			{Kind: billing.LineCredits, Description: "Pay-as-you-go credit top-up", Quantity: 1, Amount: tx.Amount, Taxable: true},
+		}
+		return req
+	}
+
+	planID := billing.PlanType(tx.PlanID)
+	if sub != nil {
+		if planID == "" {
+			planID = sub.PlanID
+		}
+		start, end := sub.StartDate, sub.EndDate
+		req.PeriodStart, req.PeriodEnd = &start, &end
+	}
+	name := string(planID)
+	if plan, err := billing.GetPlan(planID); err == nil {
+		name = plan.Name
+	}
+
+	description := name + " plan"
+	switch {
+	case strings.HasPrefix(tx.ID, "TRIAL-"):
+		description = name + " plan trial"
+	case strings.HasPrefix(tx.ID, "CHANGE-"):
+		description = "Upgrade to the " + name + " plan, prorated"
+		if req.PeriodStart != nil {
+			start := tx.CreatedAt
+			req.PeriodStart = &start
+		}
+	}
+
+	// A renewal also charges the overage of the period it ends
+	planAmount := tx.Amount - tx.DepositAmount
+	var overage *billing.InvoiceLine
+	if strings.HasPrefix(tx.ID, "RENEW-") {
+		if overage = s.overageLine(tx); overage != nil {
+			planAmount -= overage.Amount
+		}
+	}
+
+	// A coupon is shown as a discount off the full price
+	discount := s.discountLine(tx)
+	if discount != nil {
+		planAmount -= discount.Amount
+	}
+
+	req.Lines = []billing.InvoiceLine{
+		{Kind: billing.LinePlan, Description: description, Quantity: 1, Amount: planAmount, Taxable: true},
+	}
+	if discount != nil {
+		req.Lines = append(req.Lines, *discount)
+	}
+	if overage != nil {
+		req.Lines = append(req.Lines, *overage)
+	}
+	if tx.DepositAmount > 0 {
+		req.Lines = append(req.Lines, billing.InvoiceLine{
+			Kind: billing.LineDeposit, Description: "Refundable trial deposit", Quantity: 1, Amount: tx.DepositAmount,
+		})
+	}
+	return req
+}
+
+// overageLine returns the soft quota overage a renewal charged, in the
+// currency and at the rate of the payment, or nil if there was none
+func (s *Server) overageLine(tx *storage.Transaction) *billing.InvoiceLine {
+	if s.records == nil {
+		return nil
+	}
+	period, err := s.records.GetOverageByReference(tx.ID)
+	if err != nil {
+		s.logger.Warnf("Failed to load overage of renewal %s: %v", tx.ID, err)
+		return nil
+	}
+	if period == nil || period.BilledUSD <= 0 {
+		return nil
+	}
+
+	amount := min(math.Round(period.BilledUSD*paymentRate(tx)*100)/100, tx.Amount-tx.DepositAmount)
+	return &billing.InvoiceLine{
+		Kind:        billing.LineOverage,
+		Description: "Data beyond the plan limit, period from " + period.PeriodStart.Format("2 January 2006") + ", per GB",
+		Quantity:    math.Round(float64(period.OverageBytes)/(1<<30)*100) / 100,
+		Amount:      amount,
+		Taxable:     true,
+	}
+}
+
+// discountLine returns the coupon discount a payment was made with, in the
+// currency and at the rate of the payment, or nil if there was none
+func (s *Server) discountLine(tx *storage.Transaction) *billing.InvoiceLine {
+	if s.records == nil {
+		return nil
+	}
+	r, err := s.records.GetRedemption(tx.ID)
+	if err != nil {
+		s.logger.Warnf("Failed to load coupon of payment %s: %v", tx.ID, err)
+		return nil
+	}
+	if r == nil || r.Status != billing.RedemptionRedeemed || r.DiscountUSD <= 0 {
+		return nil
+	}
+	return &billing.InvoiceLine{
+		Kind:        billing.LineDiscount,
+		Description: "Coupon " + r.Code,
+		Quantity:    1,
+		Amount:      -math.Round(r.DiscountUSD*paymentRate(tx)*100) / 100,
+		Taxable:     true,
+	}
+}
+
+// paymentRate is the exchange rate a payment was made at, units of its
+// currency per USD
+func paymentRate(tx *storage.Transaction) float64 {
+	rate := tx.FXRate
+	if rate <= 0 {
+		rate = billing.ExchangeRates().Rate(billing.CurrencyCode(tx.Currency))
+	}
+	if rate <= 0 {
+		rate = 1
+	}
+	return rate
+}
+
+// userInvoice finds one of the user's invoices by its ID or number. Payments
+// made before invoicing began are invoiced when first asked for, by their
+// transaction ID.
+func (s *Server) userInvoice(c *gin.Context) (*billing.Invoice, bool) {
+	if s.invoicer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Invoices not available"})
+		return nil, false
+	}
+
+	userID := c.GetString("user_id")
+	id := c.Param("id")
+	if inv, err := s.invoicer.Store().GetInvoice(id); err == nil && inv.UserID == userID {
+		return inv, true
+	}
+
+	tx, err := s.store.GetTransaction(id)
+	if err != nil || tx.UserID != userID || tx.Status != "completed" ||
+		(tx.Kind != "" && tx.Kind != storage.TransactionPayment) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return nil, false
+	}
+	user, err := s.store.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user details"})
+		return nil, false
+	}
+	inv, err := s.invoicer.Issue(s.invoiceRequest(tx, user.Email, nil))
+	if err != nil {
+		s.logger.Errorf("Failed to invoice payment %s: %v", tx.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice"})
+		return nil, false
+	}
+	return inv, true
+}
+
+// handleListInvoices lists the user's invoices, newest first
+func (s *Server) handleListInvoices(c *gin.Context) {
+	if s.invoicer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Invoices not available"})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	invoices, total, err := s.invoicer.Store().ListInvoices(c.GetString("user_id"), pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load invoices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invoices"})
+		return
+	}
+	if invoices == nil {
+		invoices = []*billing.Invoice{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invoices": invoices,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// handleDownloadInvoice downloads the PDF of one of the user's invoices
+func (s *Server) handleDownloadInvoice(c *gin.Context) {
+	inv, ok := s.userInvoice(c)
+	if !ok {
+		return
+	}
+
+	pdf, err := s.invoicer.PDF(inv)
+	if err != nil {
+		s.logger.Errorf("Failed to render invoice %s: %v", inv.Number, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", inv.Number))
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
+
+// handleEmailInvoice sends one of the user's invoices to their account email
+func (s *Server) handleEmailInvoice(c *gin.Context) {
+	inv, ok := s.userInvoice(c)
+	if !ok {
+		return
+	}
+
+	user, err := s.store.GetUserByID(inv.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user details"})
+		return
+	}
+	pdf, err := s.invoicer.PDF(inv)
+	if err != nil {
+		s.logger.Errorf("Failed to render invoice %s: %v", inv.Number, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice"})
+		return
+	}
+
+	total := billing.FormatAmount(inv.Total, inv.Currency)
+	if err := s.mailer.Send(mailer.InvoiceEmail(user.Email, s.appURL, inv.Number, total, pdf)); err != nil {
+		s.logger.Errorf("Failed to email invoice %s: %v", inv.Number, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send invoice"})
+		return
+	}
+
+	now := time.Now()
+	if err := s.invoicer.Store().MarkInvoiceEmailed(inv.ID, now); err != nil {
+		s.logger.Warnf("Failed to mark invoice %s emailed: %v", inv.Number, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"number": inv.Number, "email": user.Email, "emailed_at": now})
+}
+
+// handleGetBillingProfile returns who the user's invoices are made out to
+func (s *Server) handleGetBillingProfile(c *gin.Context) {
+	if s.invoicer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Invoices not available"})
+		return
+	}
+
+	profile, err := s.invoicer.Store().GetBillingProfile(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load billing profile"})
+		return
+	}
+	if profile == nil {
+		profile = &billing.BillingProfile{}
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// handleUpdateBillingProfile sets who the user's invoices are made out to.
+// Invoices already issued keep the details they were issued with.
+func (s *Server) handleUpdateBillingProfile(c *gin.Context) {
+	if s.invoicer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Invoices not available"})
+		return
+	}
+
+	var profile billing.BillingProfile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := profile.Normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	profile.UserID = c.GetString("user_id")
+	profile.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+
+	if err := s.invoicer.Store().SaveBillingProfile(&profile); err != nil {
+		s.logger.Errorf("Failed to save billing profile: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save billing profile"})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
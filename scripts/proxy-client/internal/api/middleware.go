@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/atlanticproxy/proxy-client/internal/billing"
-	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
@@ -77,40 +76,15 @@ func RateLimiterMiddleware(bm *billing.Manager) gin.HandlerFunc {
 		burst := 20.0
 
 		// If authenticated, use UserID and Plan Limits
-		if userVal, exists := c.Get("user"); exists {
-			if user, ok := userVal.(*storage.User); ok {
-				key = user.ID
-
-				// Fetch Subscription to get Plan Limits
-				// Ensure we handle concurrent access if needed, but Manager is thread-safe
-				sub := bm.GetSubscription() // This gets ACTIVE user's sub
-				if sub != nil {
-					_, err := billing.GetPlan(sub.PlanID)
-					if err == nil {
-						// Apply Plan Limits
-						// RequestLimit in Plan is "Monthly Limit", not Rate per second.
-						// We probably want a "Rate" derived from tier, or just generic high limits for paid.
-						// Let's interpret tiers:
-						// Starter: 10 req/sec
-						// Personal: 50 req/sec
-						// Team: 500 req/sec
-						// Enterprise: Unlimited (10000 req/sec)
-
-						switch sub.PlanID {
-						case billing.PlanStarter:
-							rate = 10.0
-							burst = 50.0
-						case billing.PlanPersonal:
-							rate = 50.0
-							burst = 200.0
-						case billing.PlanTeam:
-							rate = 500.0
-							burst = 1000.0
-						case billing.PlanEnterprise:
-							rate = 10000.0
-							burst = 10000.0
-						}
-					}
+		if userID := c.GetString("user_id"); userID != "" {
+			key = userID
+
+			// Apply the rate limits of the user's plan. Plans without
+			// limits keep the default.
+			if flags := bm.CurrentPlan(userID).Flags; flags.RateLimit > 0 {
+				rate = flags.RateLimit
+				if flags.RateBurst > 0 {
+					burst = flags.RateBurst
 				}
 			}
 		}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/mailer"
+	"github.com/atlanticproxy/proxy-client/internal/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// orgError responds to an error of an organization request. It reports
+// false if the error is not about the organization.
+func orgError(c *gin.Context, err error) bool {
+	switch {
+	case middleware.DenyEntitlement(c, err):
+	case errors.Is(err, billing.ErrNotOrgMember):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, billing.ErrOrgPermission):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, billing.ErrAlreadyInOrg), errors.Is(err, billing.ErrSeatsFull):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, billing.ErrInvalidOrg), errors.Is(err, billing.ErrInvitationInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+// respondOrg responds to an error of an organization request
+func (s *Server) respondOrg(c *gin.Context, err error, action string) {
+	if !orgError(c, err) {
+		s.logger.Errorf("Failed to %s: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+}
+
+// requireBillingRole rejects changes to a subscription shared by an
+// organization unless the user is its owner or has the billing role
+func (s *Server) requireBillingRole(c *gin.Context) {
+	if err := s.billingManager.CanManageBilling(c.GetString("user_id")); err != nil {
+		if !orgError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organization role"})
+		}
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+type CreateOrgRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// handleCreateOrg creates an organization owned by the user, sharing their
+// subscription with its members
+func (s *Server) handleCreateOrg(c *gin.Context) {
+	var req CreateOrgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	org, err := s.billingManager.CreateOrg(c.GetString("user_id"), req.Name)
+	if err != nil {
+		s.respondOrg(c, err, "create organization")
+		return
+	}
+	c.JSON(http.StatusCreated, org)
+}
+
+// handleGetOrg returns the user's organization, their role in it and the
+// seats of its plan
+func (s *Server) handleGetOrg(c *gin.Context) {
+	org, member, err := s.billingManager.Org(c.GetString("user_id"))
+	if err != nil {
+		s.respondOrg(c, err, "load organization")
+		return
+	}
+	members, err := s.billingManager.ListMembers(c.GetString("user_id"))
+	if err != nil {
+		s.respondOrg(c, err, "load organization")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"organization": org,
+		"role":         member.Role,
+		"seats":        s.billingManager.Seats(org),
+		"members":      len(members),
+	})
+}
+
+// handleListOrgMembers lists the members of the user's organization
+func (s *Server) handleListOrgMembers(c *gin.Context) {
+	members, err := s.billingManager.ListMembers(c.GetString("user_id"))
+	if err != nil {
+		s.respondOrg(c, err, "load members")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// handleUpdateOrgMember changes the role or limits of a member
+func (s *Server) handleUpdateOrgMember(c *gin.Context) {
+	var req billing.MemberUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	member, err := s.billingManager.UpdateMember(c.GetString("user_id"), c.Param("id"), req)
+	if err != nil {
+		s.respondOrg(c, err, "update member")
+		return
+	}
+	c.JSON(http.StatusOK, member)
+}
+
+// handleRemoveOrgMember removes a member, or lets the user leave
+func (s *Server) handleRemoveOrgMember(c *gin.Context) {
+	if err := s.billingManager.RemoveMember(c.GetString("user_id"), c.Param("id")); err != nil {
+		s.respondOrg(c, err, "remove member")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+type InviteRequest struct {
+	Email string `json:"email" binding:"required"`
+	Role  string `json:"role"`
+}
+
+// handleInviteOrgMember emails an invitation to join the organization
+func (s *Server) handleInviteOrgMember(c *gin.Context) {
+	var req InviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	inv, token, err := s.billingManager.Invite(userID, req.Email, req.Role)
+	if err != nil {
+		s.respondOrg(c, err, "create invitation")
+		return
+	}
+	org, _, err := s.billingManager.Org(userID)
+	if err != nil {
+		s.respondOrg(c, err, "create invitation")
+		return
+	}
+
+	ttl := inv.ExpiresAt.Sub(inv.CreatedAt)
+	if err := s.mailer.Send(mailer.OrgInvitationEmail(inv.Email, s.appURL, org.Name, token, ttl)); err != nil {
+		s.logger.Errorf("Failed to email invitation to %s: %v", inv.Email, err)
+	}
+	c.JSON(http.StatusCreated, inv)
+}
+
+// handleListOrgInvitations lists the pending invitations of the organization
+func (s *Server) handleListOrgInvitations(c *gin.Context) {
+	invitations, err := s.billingManager.ListInvitations(c.GetString("user_id"))
+	if err != nil {
+		s.respondOrg(c, err, "load invitations")
+		return
+	}
+	if invitations == nil {
+		invitations = []*billing.Invitation{}
+	}
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// handleRevokeOrgInvitation withdraws a pending invitation
+func (s *Server) handleRevokeOrgInvitation(c *gin.Context) {
+	if err := s.billingManager.RevokeInvitation(c.GetString("user_id"), c.Param("id")); err != nil {
+		s.respondOrg(c, err, "revoke invitation")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+type AcceptInvitationRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// handleAcceptOrgInvitation joins the user to the organization they were
+// invited to
+func (s *Server) handleAcceptOrgInvitation(c *gin.Context) {
+	var req AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	org, err := s.billingManager.AcceptInvitation(c.GetString("user_id"), req.Token)
+	if err != nil {
+		s.respondOrg(c, err, "accept invitation")
+		return
+	}
+	c.JSON(http.StatusOK, org)
+}
+
+// handleGetOrgUsage breaks the organization's usage of the current period
+// down by member
+func (s *Server) handleGetOrgUsage(c *gin.Context) {
+	userID := c.GetString("user_id")
+	usage, err := s.billingManager.OrgUsage(userID)
+	if err != nil {
+		s.respondOrg(c, err, "load usage")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"usage":   s.billingManager.GetUsage(userID),
+		"members": usage,
+	})
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/gin-gonic/gin"
+)
+
+// PlanRequest is the terms of a plan as set by an admin. Changing a plan
+// stores a new version; subscribers stay on the version they signed up for.
+type PlanRequest struct {
+	ID              billing.PlanType  `json:"id"`
+	Name            string            `json:"name" binding:"required"`
+	PriceMonthly    float64           `json:"price_monthly"`
+	PriceAnnual     float64           `json:"price_annual"`
+	DataLimitMB     int64             `json:"data_limit_mb"`
+	RequestLimit    int64             `json:"request_limit"`
+	ConcurrentConns int               `json:"concurrent_conns"`
+	Features        []string          `json:"features"`
+	Flags           billing.PlanFlags `json:"flags"`
+	// Soft and throttled quotas; zero leaves the mode out
+	OverageRatePerGB float64 `json:"overage_rate_per_gb"`
+	ThrottleKbps     int     `json:"throttle_kbps"`
+	// Bandwidth per user and per connection; zero is unlimited
+	BandwidthKbps  int `json:"bandwidth_kbps"`
+	ConnectionKbps int `json:"connection_kbps"`
+}
+
+func (r PlanRequest) plan() billing.Plan {
+	return billing.Plan{
+		ID:              r.ID,
+		Name:            r.Name,
+		PriceMonthly:    r.PriceMonthly,
+		PriceAnnual:     r.PriceAnnual,
+		DataLimitMB:     r.DataLimitMB,
+		RequestLimit:    r.RequestLimit,
+		ConcurrentConns: r.ConcurrentConns,
+		Features:        r.Features,
+		Flags:           r.Flags,
+
+		OverageRatePerGB: r.OverageRatePerGB,
+		ThrottleKbps:     r.ThrottleKbps,
+		BandwidthKbps:    r.BandwidthKbps,
+		ConnectionKbps:   r.ConnectionKbps,
+	}
+}
+
+// requireAdmin only admits accounts listed as catalogue admins
+func (s *Server) requireAdmin(c *gin.Context) {
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil || !s.admins[strings.ToLower(user.Email)] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// handleAdminListPlans lists every plan, including retired ones
+func (s *Server) handleAdminListPlans(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"plans": billing.Plans().All()})
+}
+
+// handleAdminGetPlan returns a plan and all of its versions
+func (s *Server) handleAdminGetPlan(c *gin.Context) {
+	id := billing.PlanType(c.Param("id"))
+	versions, err := billing.Plans().Versions(id)
+	if err != nil {
+		s.writePlanError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plan":     versions[len(versions)-1],
+		"versions": versions,
+	})
+}
+
+// handleAdminCreatePlan adds a plan to the catalogue
+func (s *Server) handleAdminCreatePlan(c *gin.Context) {
+	var req PlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	plan, err := billing.Plans().Create(req.plan())
+	if err != nil {
+		s.writePlanError(c, err)
+		return
+	}
+
+	s.logger.Infof("Plan %s created by %s", plan.ID, c.GetString("user_id"))
+	c.JSON(http.StatusCreated, gin.H{"plan": plan})
+}
+
+// handleAdminUpdatePlan stores new terms for a plan as its next version
+func (s *Server) handleAdminUpdatePlan(c *gin.Context) {
+	var req PlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.ID = billing.PlanType(c.Param("id"))
+
+	plan, err := billing.Plans().Update(req.plan())
+	if err != nil {
+		s.writePlanError(c, err)
+		return
+	}
+
+	s.logger.Infof("Plan %s updated to version %d by %s", plan.ID, plan.Version, c.GetString("user_id"))
+	c.JSON(http.StatusOK, gin.H{"plan": plan})
+}
+
+// handleAdminRetirePlan stops offering a plan. Existing subscribers keep it.
+func (s *Server) handleAdminRetirePlan(c *gin.Context) {
+	s.setPlanActive(c, false)
+}
+
+// handleAdminActivatePlan offers a retired plan again
+func (s *Server) handleAdminActivatePlan(c *gin.Context) {
+	s.setPlanActive(c, true)
+}
+
+func (s *Server) setPlanActive(c *gin.Context, active bool) {
+	id := billing.PlanType(c.Param("id"))
+	if err := billing.Plans().SetActive(id, active); err != nil {
+		s.writePlanError(c, err)
+		return
+	}
+
+	s.logger.Infof("Plan %s active=%v set by %s", id, active, c.GetString("user_id"))
+	plan, _ := billing.Plans().Get(id)
+	c.JSON(http.StatusOK, gin.H{"plan": plan})
+}
+
+func (s *Server) writePlanError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, billing.ErrPlanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, billing.ErrPlanExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, billing.ErrInvalidPlan), errors.Is(err, billing.ErrPlanRequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		s.logger.Errorf("Failed to update plan catalogue: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update plan catalogue"})
+	}
+}
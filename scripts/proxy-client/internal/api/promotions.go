@@ -0,0 +1,195 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/gin-gonic/gin"
+)
+
+// couponError responds to an error of a coupon. It reports false if the
+// error is not about the coupon itself.
+func couponError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, billing.ErrCouponNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Coupon not found"})
+	case errors.Is(err, billing.ErrInvalidCoupon), errors.Is(err, billing.ErrCouponUnavailable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+type ValidateCouponRequest struct {
+	Code   string `json:"code" binding:"required"`
+	PlanID string `json:"plan_id" binding:"required"`
+}
+
+// handleValidateCoupon tells the user what a coupon takes off a plan before
+// they check out
+func (s *Server) handleValidateCoupon(c *gin.Context) {
+	var req ValidateCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	quote, err := s.billingManager.QuoteCoupon(c.GetString("user_id"), req.Code, billing.PlanType(req.PlanID))
+	if err != nil {
+		if !couponError(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, quote)
+}
+
+// handleGetReferral returns the user's referral code and link and what
+// their referrals have earned
+func (s *Server) handleGetReferral(c *gin.Context) {
+	summary, err := s.billingManager.ReferralSummary(c.GetString("user_id"))
+	if err != nil {
+		s.logger.Errorf("Failed to load referrals: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load referrals"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":       summary.Code,
+		"link":       s.appURL + "/register?ref=" + summary.Code,
+		"referred":   summary.Referred,
+		"rewarded":   summary.Rewarded,
+		"earned_usd": summary.EarnedUSD,
+	})
+}
+
+// handleAdminListCoupons lists coupons, newest first
+func (s *Server) handleAdminListCoupons(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	coupons, total, err := s.billingManager.ListCoupons(pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load coupons: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load coupons"})
+		return
+	}
+	if coupons == nil {
+		coupons = []*billing.Coupon{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"coupons":  coupons,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// handleAdminCreateCoupon adds a coupon
+func (s *Server) handleAdminCreateCoupon(c *gin.Context) {
+	var coupon billing.Coupon
+	if err := c.ShouldBindJSON(&coupon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := s.billingManager.CreateCoupon(&coupon); err != nil {
+		if !couponError(c, err) {
+			s.logger.Errorf("Failed to create coupon: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create coupon"})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, coupon)
+}
+
+// handleAdminGetCoupon returns a coupon and a page of the payments it was
+// redeemed on
+func (s *Server) handleAdminGetCoupon(c *gin.Context) {
+	coupon, err := s.billingManager.GetCoupon(c.Param("code"))
+	if err != nil {
+		if !couponError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load coupon"})
+		}
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	redemptions, total, err := s.billingManager.ListRedemptions(coupon.Code, pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load redemptions of %s: %v", coupon.Code, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load redemptions"})
+		return
+	}
+	if redemptions == nil {
+		redemptions = []*billing.CouponRedemption{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"coupon":      coupon,
+		"redemptions": redemptions,
+		"total":       total,
+		"page":        page,
+		"pageSize":    pageSize,
+	})
+}
+
+// handleAdminDeactivateCoupon stops a coupon from being used at checkout
+func (s *Server) handleAdminDeactivateCoupon(c *gin.Context) {
+	coupon, err := s.billingManager.DeactivateCoupon(c.Param("code"))
+	if err != nil {
+		if !couponError(c, err) {
+			s.logger.Errorf("Failed to deactivate coupon: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate coupon"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, coupon)
+}
+
+// handleAdminListReferrals lists referrals, newest first, optionally of one
+// referrer
+func (s *Server) handleAdminListReferrals(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	referrals, total, err := s.billingManager.ListReferrals(c.Query("referrer_id"), pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load referrals: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load referrals"})
+		return
+	}
+	if referrals == nil {
+		referrals = []*billing.Referral{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"referrals": referrals,
+		"total":     total,
+		"page":      page,
+		"pageSize":  pageSize,
+	})
+}
@@ -0,0 +1,387 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// depositRefundDelay is how long after a subscription ends its deposit is refunded
+const depositRefundDelay = 7 * 24 * time.Hour
+
+// jobDepositRefund is the kind of the queued job that refunds a deposit
+const jobDepositRefund = "deposit_refund"
+
+type depositRefund struct {
+	UserID        string `json:"user_id"`
+	TransactionID string `json:"transaction_id"` // payment holding the deposit
+}
+
+// errNotRefundable is returned for transactions that are not completed payments
+var errNotRefundable = errors.New("only completed payments can be refunded")
+
+// refundRequest is an admin's refund of a payment. Without an amount the
+// rest of the payment is refunded.
+type refundRequest struct {
+	Amount float64 `json:"amount"` // in the payment's currency
+	Reason string  `json:"reason"`
+}
+
+// scheduleDepositRefund schedules the refund of a user's held deposit. The
+// job is stored, so it survives restarts, and keyed by the payment, so the
+// deposit is not refunded twice.
+func (s *Server) scheduleDepositRefund(userID string) error {
+	deposit, err := s.store.GetDepositTransaction(userID)
+	if err != nil {
+		return fmt.Errorf("failed to load deposit: %w", err)
+	}
+	if deposit == nil || deposit.DepositStatus != billing.DepositHeld {
+		return nil
+	}
+	if s.queue == nil {
+		s.logger.Warnf("No job queue - deposit refund for user %s not scheduled", userID)
+		return nil
+	}
+
+	job := depositRefund{UserID: userID, TransactionID: deposit.ID}
+	if _, err := s.queue.Schedule(jobDepositRefund, deposit.ID, job, time.Now().Add(depositRefundDelay)); err != nil {
+		return fmt.Errorf("failed to schedule deposit refund: %w", err)
+	}
+	if _, err := s.store.SetDepositStatus(deposit.ID, billing.DepositRefundScheduled, billing.DepositHeld); err != nil {
+		return fmt.Errorf("failed to update deposit: %w", err)
+	}
+	s.logger.Infof("Deposit refund scheduled for user: %s", userID)
+	return nil
+}
+
+// runDepositRefund refunds the deposit of a user whose subscription ended.
+// A deposit that was forfeited or refunded in the meantime is left alone.
+func (s *Server) runDepositRefund(j *queue.Job) error {
+	var job depositRefund
+	if err := json.Unmarshal(j.Payload, &job); err != nil {
+		return queue.Permanent(fmt.Errorf("failed to parse deposit refund: %w", err))
+	}
+
+	deposit, err := s.store.GetTransaction(job.TransactionID)
+	if err != nil {
+		return queue.Permanent(fmt.Errorf("deposit payment %s not found: %w", job.TransactionID, err))
+	}
+	if deposit.DepositStatus != billing.DepositRefundScheduled && deposit.DepositStatus != billing.DepositHeld {
+		s.logger.Infof("Deposit of payment %s is %s - not refunded", deposit.ID, deposit.DepositStatus)
+		return nil
+	}
+
+	_, err = s.refund(deposit, deposit.DepositAmount, "Trial deposit refund", storage.TransactionDepositRefund)
+	switch {
+	case errors.Is(err, billing.ErrDepositNotHeld):
+		return nil
+	case errors.Is(err, billing.ErrRefundUnsupported), errors.Is(err, billing.ErrRefundTooLarge):
+		return queue.Permanent(err)
+	case err != nil:
+		// The failed refund held the deposit again; it stays scheduled
+		// while the job is retried
+		if _, serr := s.store.SetDepositStatus(deposit.ID, billing.DepositRefundScheduled, billing.DepositHeld); serr != nil {
+			s.logger.Errorf("Failed to update deposit: %v", serr)
+		}
+		return err
+	}
+	s.logger.Infof("Deposit refund processed for user: %s", job.UserID)
+	return nil
+}
+
+// refund returns amount of a payment through its gateway. The refund is
+// booked against the payment first, so concurrent refunds can not exceed it,
+// and given back if the gateway rejects it.
+func (s *Server) refund(payment *storage.Transaction, amount float64, reason, kind string) (*storage.Transaction, error) {
+	if payment.Kind != storage.TransactionPayment || payment.Status != "completed" {
+		return nil, errNotRefundable
+	}
+	if amount <= 0 {
+		amount = payment.Amount - payment.RefundedAmount
+	}
+	amount = math.Round(amount*100) / 100
+	if amount <= 0 {
+		return nil, billing.ErrRefundTooLarge
+	}
+
+	refund := &storage.Transaction{
+		ID:            "REFUND-" + uuid.New().String(),
+		UserID:        payment.UserID,
+		PlanID:        payment.PlanID,
+		Amount:        amount,
+		Currency:      payment.Currency,
+		Status:        "pending",
+		PaymentMethod: payment.PaymentMethod,
+		CreatedAt:     time.Now(),
+		Kind:          kind,
+		RefundOf:      payment.ID,
+		Reason:        reason,
+	}
+	if err := s.store.RecordRefund(refund); err != nil {
+		return nil, err
+	}
+
+	result, err := s.billingManager.RefundPayment(billing.PaymentMethod(payment.PaymentMethod), billing.RefundRequest{
+		Reference:  payment.ID,
+		GatewayRef: payment.GatewayRef,
+		Amount:     amount,
+		Currency:   payment.Currency,
+		Reason:     reason,
+	})
+	if err != nil {
+		if ferr := s.store.FailRefund(refund.ID); ferr != nil {
+			s.logger.Errorf("Failed to release refund %s: %v", refund.ID, ferr)
+		}
+		return nil, err
+	}
+
+	refund.GatewayRef = result.ID
+	if result.Status == billing.RefundProcessed {
+		refund.Status = "completed"
+	}
+	if err := s.store.UpdateRefund(refund.ID, refund.Status, refund.GatewayRef); err != nil {
+		// The gateway has the refund; its webhook settles it
+		s.logger.Errorf("Failed to update refund %s: %v", refund.ID, err)
+	}
+
+	s.logger.Infof("Refunded %.2f %s of payment %s (%s)", amount, payment.Currency, payment.ID, refund.ID)
+	return refund, nil
+}
+
+func refundJSON(tx *storage.Transaction) gin.H {
+	return gin.H{
+		"id":          tx.ID,
+		"kind":        tx.Kind,
+		"refund_of":   tx.RefundOf,
+		"amount":      tx.Amount,
+		"currency":    tx.Currency,
+		"status":      tx.Status,
+		"reason":      tx.Reason,
+		"created_at":  tx.CreatedAt,
+		"credit_note": "CN-" + tx.ID,
+	}
+}
+
+func (s *Server) writeRefundError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, billing.ErrDepositNotHeld):
+		c.JSON(http.StatusConflict, gin.H{"error": "Deposit is not held"})
+	case errors.Is(err, billing.ErrRefundTooLarge), errors.Is(err, billing.ErrRefundUnsupported), errors.Is(err, errNotRefundable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		s.logger.Errorf("Refund failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Refund failed"})
+	}
+}
+
+// listRefunds writes a page of the refunds of a user, or of everyone
+func (s *Server) listRefunds(c *gin.Context, userID string) (gin.H, bool) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	refunds, total, err := s.store.ListRefunds(userID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load refunds: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load refunds"})
+		return nil, false
+	}
+
+	list := make([]gin.H, 0, len(refunds))
+	for _, r := range refunds {
+		list = append(list, refundJSON(r))
+	}
+	return gin.H{
+		"refunds":  list,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	}, true
+}
+
+// handleGetRefunds returns the user's refunds and the state of their deposit
+func (s *Server) handleGetRefunds(c *gin.Context) {
+	userID := c.GetString("user_id")
+	resp, ok := s.listRefunds(c, userID)
+	if !ok {
+		return
+	}
+
+	deposit, err := s.store.GetDepositTransaction(userID)
+	if err != nil {
+		s.logger.Errorf("Failed to load deposit: %v", err)
+	}
+	if deposit != nil {
+		resp["deposit"] = gin.H{
+			"amount":   deposit.DepositAmount,
+			"currency": deposit.Currency,
+			"status":   deposit.DepositStatus,
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleRefundDeposit refunds the user's deposit now. Only deposits of
+// subscriptions that have ended or been canceled are refunded.
+func (s *Server) handleRefundDeposit(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if sub := s.billingManager.GetSubscription(userID); sub != nil && sub.PlanID != billing.PlanStarter &&
+		sub.Status != billing.StatusCanceled && sub.Status != billing.StatusExpired {
+		c.JSON(http.StatusConflict, gin.H{"error": "The deposit is refunded once the subscription is canceled"})
+		return
+	}
+
+	deposit, err := s.store.GetDepositTransaction(userID)
+	if err != nil || deposit == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No deposit found"})
+		return
+	}
+
+	refund, err := s.refund(deposit, deposit.DepositAmount, "Trial deposit refund requested by user", storage.TransactionDepositRefund)
+	if err != nil {
+		s.writeRefundError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"refund": refundJSON(refund)})
+}
+
+// handleDownloadCreditNote generates the credit note of one of the user's refunds
+func (s *Server) handleDownloadCreditNote(c *gin.Context) {
+	s.writeCreditNote(c, c.GetString("user_id"))
+}
+
+// handleAdminListRefunds lists refunds, of one user if user_id is given
+func (s *Server) handleAdminListRefunds(c *gin.Context) {
+	resp, ok := s.listRefunds(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleAdminRefundTransaction refunds all or part of a payment
+func (s *Server) handleAdminRefundTransaction(c *gin.Context) {
+	var req refundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Amount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must not be negative"})
+		return
+	}
+
+	payment, err := s.store.GetTransaction(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+
+	refund, err := s.refund(payment, req.Amount, req.Reason, storage.TransactionRefund)
+	if err != nil {
+		s.writeRefundError(c, err)
+		return
+	}
+	s.logger.Infof("Payment %s refunded by %s", payment.ID, c.GetString("user_id"))
+	c.JSON(http.StatusOK, gin.H{"refund": refundJSON(refund)})
+}
+
+// handleAdminRefundDeposit refunds the deposit of a payment now
+func (s *Server) handleAdminRefundDeposit(c *gin.Context) {
+	payment, err := s.store.GetTransaction(c.Param("id"))
+	if err != nil || payment.DepositAmount <= 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deposit not found"})
+		return
+	}
+
+	refund, err := s.refund(payment, payment.DepositAmount, "Trial deposit refund", storage.TransactionDepositRefund)
+	if err != nil {
+		s.writeRefundError(c, err)
+		return
+	}
+	s.logger.Infof("Deposit of payment %s refunded by %s", payment.ID, c.GetString("user_id"))
+	c.JSON(http.StatusOK, gin.H{"refund": refundJSON(refund)})
+}
+
+// handleAdminForfeitDeposit keeps the deposit of a payment, e.g. after abuse
+// or a chargeback. A scheduled refund of it is skipped.
+func (s *Server) handleAdminForfeitDeposit(c *gin.Context) {
+	id := c.Param("id")
+	forfeited, err := s.store.SetDepositStatus(id, billing.DepositForfeited, billing.DepositHeld, billing.DepositRefundScheduled)
+	if err != nil {
+		s.logger.Errorf("Failed to forfeit deposit: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forfeit deposit"})
+		return
+	}
+	if !forfeited {
+		c.JSON(http.StatusConflict, gin.H{"error": "Deposit is not held"})
+		return
+	}
+
+	s.logger.Infof("Deposit of payment %s forfeited by %s", id, c.GetString("user_id"))
+	c.JSON(http.StatusOK, gin.H{"transaction_id": id, "deposit_status": billing.DepositForfeited})
+}
+
+// handleAdminDownloadCreditNote generates the credit note of any refund
+func (s *Server) handleAdminDownloadCreditNote(c *gin.Context) {
+	s.writeCreditNote(c, "")
+}
+
+// writeCreditNote writes the credit note PDF of a refund. A userID limits it
+// to that user's refunds.
+func (s *Server) writeCreditNote(c *gin.Context, userID string) {
+	refund, err := s.store.GetTransaction(c.Param("id"))
+	if err != nil || refund.RefundOf == "" || (userID != "" && refund.UserID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credit note not found"})
+		return
+	}
+
+	user, err := s.store.GetUserByID(refund.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user details"})
+		return
+	}
+
+	description := "Refund of payment " + refund.RefundOf
+	if refund.Kind == storage.TransactionDepositRefund {
+		description = "Refund of trial deposit"
+	}
+	invoiceID := refund.RefundOf
+	if s.invoicer != nil {
+		if inv, err := s.invoicer.Store().GetInvoiceByTransaction(refund.RefundOf); err == nil && inv != nil {
+			invoiceID = inv.Number
+		}
+	}
+	pdfBytes, err := billing.GenerateCreditNotePDF(&billing.CreditNoteData{
+		ID:            "CN-" + refund.ID,
+		InvoiceID:     invoiceID,
+		Date:          refund.CreatedAt,
+		CustomerEmail: user.Email,
+		Description:   description,
+		Reason:        refund.Reason,
+		Currency:      refund.Currency,
+		Amount:        refund.Amount,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate credit note"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=credit_note_%s.pdf", refund.ID))
+	c.Data(http.StatusOK, "application/pdf", pdfBytes)
+}
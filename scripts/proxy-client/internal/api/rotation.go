@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 
+	"github.com/atlanticproxy/proxy-client/internal/middleware"
 	"github.com/atlanticproxy/proxy-client/internal/rotation"
 	"github.com/gin-gonic/gin"
 )
@@ -64,6 +65,10 @@ func (s *Server) handleUpdateRotationConfig(c *gin.Context) {
 	}
 
 	if err := s.rotationManager.UpdateConfig(newConfig); err != nil {
+		// Sticky sessions and exit countries are plan features
+		if middleware.DenyEntitlement(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update rotation config"})
 		return
 	}
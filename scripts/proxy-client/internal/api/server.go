@@ -6,15 +6,19 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/atlanticproxy/proxy-client/internal/adblock"
+	"github.com/atlanticproxy/proxy-client/internal/auth"
 	"github.com/atlanticproxy/proxy-client/internal/billing"
 	"github.com/atlanticproxy/proxy-client/internal/interceptor"
 	"github.com/atlanticproxy/proxy-client/internal/killswitch"
+	"github.com/atlanticproxy/proxy-client/internal/mailer"
 	"github.com/atlanticproxy/proxy-client/internal/middleware"
 	"github.com/atlanticproxy/proxy-client/internal/proxy"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
 	"github.com/atlanticproxy/proxy-client/internal/rotation"
 	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/atlanticproxy/proxy-client/pkg/geo"
@@ -41,12 +45,30 @@ type Server struct {
 	rotationManager  *rotation.Manager
 	analyticsManager *rotation.AnalyticsManager
 	billingManager   *billing.Manager
-	store            *storage.Store
+	lifecycle        *billing.Lifecycle
+	cryptoWatcher    *billing.CryptoWatcher
+	invoicer         *billing.Invoicer
+	queue            *queue.Worker
+	backups          *storage.Backups
+	store            storage.Repository
+	records          billingRecords // nil if the store keeps no quotas, coupons or quotes
+	auth             *auth.Manager
+	mailer           mailer.Mailer
+	appURL           string
+	admins           map[string]bool // emails of catalogue admins
 	geoResolver      *geo.MultiResolver
 	clients          map[*websocket.Conn]bool
 	mu               sync.RWMutex
 }
 
+// billingRecords are the records of billing extras that invoices and
+// payments refer to, kept only by stores that have them
+type billingRecords interface {
+	GetOverageByReference(reference string) (*billing.QuotaPeriod, error)
+	GetRedemption(reference string) (*billing.CouponRedemption, error)
+	GetPriceQuote(reference string) (*billing.PriceQuote, error)
+}
+
 type ProxyStatus struct {
 	Connected       bool    `json:"connected"`
 	IPAddress       string  `json:"ip_address,omitempty"`
@@ -67,7 +89,7 @@ type ConnectRequest struct {
 	Endpoint string `json:"endpoint"`
 }
 
-func NewServer(ab *adblock.Engine, ks *killswitch.Guardian, it *interceptor.TunInterceptor, pr *proxy.Engine, rm *rotation.Manager, am *rotation.AnalyticsManager, bm *billing.Manager, store *storage.Store) *Server {
+func NewServer(ab *adblock.Engine, ks *killswitch.Guardian, it *interceptor.TunInterceptor, pr *proxy.Engine, rm *rotation.Manager, am *rotation.AnalyticsManager, bm *billing.Manager, store storage.Repository, authManager *auth.Manager) *Server {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 
@@ -112,15 +134,54 @@ func NewServer(ab *adblock.Engine, ks *killswitch.Guardian, it *interceptor.TunI
 		analyticsManager: am,
 		billingManager:   bm,
 		store:            store,
+		auth:             authManager,
+		mailer:           mailer.NewLogMailer(),
+		appURL:           "http://localhost:3000",
 		geoResolver:      geo.NewMultiResolver(),
 		clients:          make(map[*websocket.Conn]bool),
 	}
 
+	s.records, _ = store.(billingRecords)
+
 	s.setupRoutes()
 	go s.startStatusUpdater()
 	return s
 }
 
+// SetMailer sets the mailer for account emails and the dashboard URL their links point to
+func (s *Server) SetMailer(m mailer.Mailer, appURL string) {
+	s.mailer = m
+	if appURL != "" {
+		s.appURL = appURL
+	}
+}
+
+// SetLifecycle sets the subscription lifecycle that settles renewal payments
+// reported by webhooks
+func (s *Server) SetLifecycle(l *billing.Lifecycle) {
+	s.lifecycle = l
+}
+
+// SetQueue sets the worker that processes stored webhook events and the
+// jobs they schedule
+func (s *Server) SetQueue(w *queue.Worker) {
+	s.queue = w
+	w.HandleEvents("paystack", s.processPaystackEvent)
+	w.HandleEvents("stripe", s.processStripeEvent)
+	w.HandleEvents("crypto", s.processCryptoEvent)
+	w.HandleJobs(jobDepositRefund, s.runDepositRefund)
+}
+
+// SetAdmins sets the email addresses of the accounts that may manage plans
+func (s *Server) SetAdmins(emails []string) {
+	s.admins = make(map[string]bool)
+	for _, email := range emails {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			s.admins[email] = true
+		}
+	}
+}
+
 func (s *Server) startStatusUpdater() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -189,47 +250,142 @@ func (s *Server) updateStatusLocked() {
 }
 
 func (s *Server) setupRoutes() {
-	s.router.POST("/connect", s.handleConnect)
+	requireAuth := middleware.JWTAuth(s.auth)
+	// requireScope also admits API keys that hold the scope
+	requireScope := func(scope string) gin.HandlerFunc {
+		return middleware.JWTAuth(s.auth, scope)
+	}
+
+	s.router.POST("/connect", requireAuth, s.handleConnect)
 	s.router.GET("/status", s.handleStatus)
-	s.router.POST("/disconnect", s.handleDisconnect)
-	s.router.POST("/killswitch", s.handleKillSwitch)
+	s.router.POST("/disconnect", requireAuth, s.handleDisconnect)
+	s.router.POST("/killswitch", requireAuth, s.handleKillSwitch)
 	s.router.GET("/killswitch", s.handleGetKillSwitch)
 	s.router.GET("/health", s.handleHealth)
 	s.router.GET("/ws", s.handleWS)
 	s.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	// Ad-block Whitelist API
-	s.router.GET("/adblock/whitelist", s.handleGetWhitelist)
-	s.router.POST("/adblock/whitelist", s.handleAddWhitelist)
-	s.router.DELETE("/adblock/whitelist", s.handleRemoveWhitelist)
-
-	// Ad-block Advanced API
-	s.router.POST("/adblock/refresh", s.handleRefreshBlocklists)
-	s.router.GET("/adblock/stats", s.handleGetAdblockStats)
-	s.router.GET("/adblock/custom", s.handleGetCustomRules)
-	s.router.POST("/adblock/custom", s.handleAddCustomRules)
+	adblockGroup := s.router.Group("/adblock", requireScope(auth.ScopeAdblock))
+	{
+		// Ad-block Whitelist API
+		adblockGroup.GET("/whitelist", s.handleGetWhitelist)
+		adblockGroup.POST("/whitelist", s.handleAddWhitelist)
+		adblockGroup.DELETE("/whitelist", s.handleRemoveWhitelist)
+
+		// Ad-block Advanced API
+		adblockGroup.POST("/refresh", s.handleRefreshBlocklists)
+		adblockGroup.GET("/stats", s.handleGetAdblockStats)
+		adblockGroup.GET("/custom", s.handleGetCustomRules)
+		adblockGroup.POST("/custom", s.handleAddCustomRules)
+	}
 
 	// Billing API
 	s.router.GET("/api/billing/plans", s.handleGetPlans)
-	s.router.GET("/api/billing/subscription", middleware.JWTAuth(), s.handleGetSubscription)
-	s.router.POST("/api/billing/subscribe", middleware.JWTAuth(), s.handleSubscribe)
-	s.router.POST("/api/billing/checkout", middleware.JWTAuth(), s.handleCreateCheckoutSession)
-	s.router.POST("/api/billing/cancel", middleware.JWTAuth(), s.handleCancelSubscription)
-	s.router.GET("/api/billing/usage", middleware.JWTAuth(), s.handleGetUsage)
-	s.router.GET("/api/billing/invoices/:id", middleware.JWTAuth(), s.handleDownloadInvoice)
-	s.router.POST("/api/billing/trial/start", s.handleStartTrial)
-	s.router.GET("/api/billing/status", middleware.JWTAuth(), s.handleGetBillingStatus)
+	s.router.GET("/api/billing/subscription", requireScope(auth.ScopeBillingRead), s.handleGetSubscription)
+	s.router.POST("/api/billing/subscribe", requireAuth, s.requireBillingRole, s.handleSubscribe)
+	s.router.POST("/api/billing/checkout", requireAuth, s.requireBillingRole, s.handleCreateCheckoutSession)
+	s.router.POST("/api/billing/cancel", requireAuth, s.requireBillingRole, s.handleCancelSubscription)
+	s.router.POST("/api/billing/preview-change", requireAuth, s.handlePreviewPlanChange)
+	s.router.POST("/api/billing/change", requireAuth, s.requireBillingRole, s.handleChangePlan)
+	s.router.GET("/api/billing/usage", requireScope(auth.ScopeBillingRead), s.handleGetUsage)
+	s.router.PUT("/api/billing/quota-mode", requireAuth, s.requireBillingRole, s.handleSetQuotaMode)
+	s.router.GET("/api/billing/throughput", requireScope(auth.ScopeBillingRead), s.handleGetThroughput)
+	s.router.GET("/api/billing/credits", requireScope(auth.ScopeBillingRead), s.handleGetCredits)
+	s.router.POST("/api/billing/credits/topup", requireAuth, s.requireBillingRole, s.handleTopUpCredits)
+	s.router.GET("/api/billing/invoices", requireScope(auth.ScopeBillingRead), s.handleListInvoices)
+	s.router.GET("/api/billing/invoices/:id", requireScope(auth.ScopeBillingRead), s.handleDownloadInvoice)
+	s.router.POST("/api/billing/invoices/:id/email", requireAuth, s.handleEmailInvoice)
+	s.router.GET("/api/billing/profile", requireScope(auth.ScopeBillingRead), s.handleGetBillingProfile)
+	s.router.PUT("/api/billing/profile", requireAuth, s.requireBillingRole, s.handleUpdateBillingProfile)
+	s.router.POST("/api/billing/trial/start", requireAuth, s.requireBillingRole, s.handleStartTrial)
+	s.router.GET("/api/billing/status", requireScope(auth.ScopeBillingRead), s.handleGetBillingStatus)
+	s.router.GET("/api/billing/refunds", requireScope(auth.ScopeBillingRead), s.handleGetRefunds)
+	s.router.POST("/api/billing/deposit/refund", requireAuth, s.requireBillingRole, s.handleRefundDeposit)
+	s.router.GET("/api/billing/credit-notes/:id", requireScope(auth.ScopeBillingRead), s.handleDownloadCreditNote)
+	s.router.GET("/api/billing/crypto/:id", requireScope(auth.ScopeBillingRead), s.handleGetCryptoIntent)
+	s.router.POST("/api/billing/coupons/validate", requireAuth, s.handleValidateCoupon)
+	s.router.GET("/api/billing/referral", requireScope(auth.ScopeBillingRead), s.handleGetReferral)
+
+	// Organizations share their owner's subscription with their members
+	orgGroup := s.router.Group("/api/orgs", requireAuth)
+	{
+		orgGroup.POST("", s.handleCreateOrg)
+		orgGroup.GET("", s.handleGetOrg)
+		orgGroup.GET("/members", s.handleListOrgMembers)
+		orgGroup.PUT("/members/:id", s.handleUpdateOrgMember)
+		orgGroup.DELETE("/members/:id", s.handleRemoveOrgMember)
+		orgGroup.GET("/invitations", s.handleListOrgInvitations)
+		orgGroup.POST("/invitations", s.handleInviteOrgMember)
+		orgGroup.DELETE("/invitations/:id", s.handleRevokeOrgInvitation)
+		orgGroup.POST("/invitations/accept", s.handleAcceptOrgInvitation)
+		orgGroup.GET("/usage", s.handleGetOrgUsage)
+	}
+
+	// Sub-users resell the user's plan with their own proxy credentials
+	subUserGroup := s.router.Group("/api/subusers", requireScope(auth.ScopeSubUsers))
+	{
+		subUserGroup.GET("", s.handleListSubUsers)
+		subUserGroup.POST("", s.handleCreateSubUser)
+		subUserGroup.GET("/:id", s.handleGetSubUser)
+		subUserGroup.PUT("/:id", s.handleUpdateSubUser)
+		subUserGroup.DELETE("/:id", s.handleDeleteSubUser)
+		subUserGroup.POST("/:id/password", s.handleResetSubUserPassword)
+		subUserGroup.GET("/:id/usage", s.handleGetSubUserUsage)
+	}
+
+	// Plan catalogue administration
+	adminGroup := s.router.Group("/api/admin", requireAuth, s.requireAdmin)
+	{
+		adminGroup.GET("/plans", s.handleAdminListPlans)
+		adminGroup.GET("/plans/:id", s.handleAdminGetPlan)
+		adminGroup.POST("/plans", s.handleAdminCreatePlan)
+		adminGroup.PUT("/plans/:id", s.handleAdminUpdatePlan)
+		adminGroup.DELETE("/plans/:id", s.handleAdminRetirePlan)
+		adminGroup.POST("/plans/:id/activate", s.handleAdminActivatePlan)
+		adminGroup.GET("/webhooks", s.handleAdminListWebhookEvents)
+		adminGroup.POST("/webhooks/:id/replay", s.handleAdminReplayWebhookEvent)
+		adminGroup.GET("/refunds", s.handleAdminListRefunds)
+		adminGroup.POST("/transactions/:id/refund", s.handleAdminRefundTransaction)
+		adminGroup.POST("/transactions/:id/deposit/refund", s.handleAdminRefundDeposit)
+		adminGroup.POST("/transactions/:id/deposit/forfeit", s.handleAdminForfeitDeposit)
+		adminGroup.GET("/credit-notes/:id", s.handleAdminDownloadCreditNote)
+		adminGroup.GET("/crypto/intents", s.handleAdminListCryptoIntents)
+		adminGroup.POST("/crypto/intents/:id/accept", s.handleAdminAcceptCryptoIntent)
+		adminGroup.GET("/throughput", s.handleAdminListThroughput)
+		adminGroup.PUT("/users/:id/bandwidth", s.handleAdminSetBandwidth)
+		adminGroup.DELETE("/users/:id/bandwidth", s.handleAdminClearBandwidth)
+		adminGroup.GET("/coupons", s.handleAdminListCoupons)
+		adminGroup.POST("/coupons", s.handleAdminCreateCoupon)
+		adminGroup.GET("/coupons/:code", s.handleAdminGetCoupon)
+		adminGroup.DELETE("/coupons/:code", s.handleAdminDeactivateCoupon)
+		adminGroup.GET("/referrals", s.handleAdminListReferrals)
+		adminGroup.GET("/users/:id/export", s.handleAdminExportUser)
+		adminGroup.DELETE("/users/:id", s.handleAdminDeleteUser)
+		adminGroup.GET("/backups", s.handleAdminListBackups)
+		adminGroup.POST("/backups", s.handleAdminCreateBackup)
+		adminGroup.GET("/backups/:name", s.handleAdminDownloadBackup)
+	}
 
 	// Security API
-	s.router.GET("/api/security/status", middleware.JWTAuth(), s.handleGetSecurityStatus)
+	s.router.GET("/api/security/status", requireScope(auth.ScopeReadStats), s.handleGetSecurityStatus)
 
 	// Protocol API
-	s.router.GET("/api/protocol/credentials", middleware.JWTAuth(), s.handleGetProtocolCredentials)
+	// Connecting apps to SOCKS5 or Shadowsocks directly is protocol selection
+	s.router.GET("/api/protocol/credentials", requireScope(auth.ScopeProxyAuth),
+		middleware.RequireFeature(s.billingManager.Entitlements(), billing.FeatureProtocolSelection), s.handleGetProtocolCredentials)
 
 	// Rotation API
-	s.router.GET("/api/rotation/config", middleware.JWTAuth(), s.handleGetRotationConfig)
-	s.router.POST("/api/rotation/config", middleware.JWTAuth(), s.handleUpdateRotationConfig)
-	s.router.POST("/api/rotation/session/new", middleware.JWTAuth(), s.handleForceRotation) // Override existing if any
+	rotationGroup := s.router.Group("/api/rotation", requireScope(auth.ScopeRotation))
+	{
+		rotationGroup.GET("/config", s.handleGetRotationConfig)
+		rotationGroup.POST("/config", s.handleUpdateRotationConfig)
+		rotationGroup.POST("/session/new", s.handleForceRotation) // Override existing if any
+
+		// Compatibility Routes
+		rotationGroup.GET("/session/current", s.handleGetCurrentSession)
+		rotationGroup.GET("/stats", s.handleGetRotationStats)
+		rotationGroup.POST("/geo", s.handleSetGeo)
+	}
 
 	// Locations API
 	s.router.GET("/api/locations/available", s.handleGetLocations)
@@ -237,14 +393,9 @@ func (s *Server) setupRoutes() {
 	// Payment verification
 	s.router.GET("/api/billing/verify", s.handleVerifyPayment)
 
-	// Compatibility Routes
-	s.router.GET("/api/rotation/session/current", s.handleGetCurrentSession)
-	s.router.GET("/api/rotation/stats", s.handleGetRotationStats)
-	s.router.POST("/api/rotation/geo", s.handleSetGeo)
-
 	// Adblock Management
-	s.router.GET("/api/adblock/config", s.handleGetAdblockConfig)
-	s.router.POST("/api/adblock/category", s.handleToggleAdblockCategory)
+	s.router.GET("/api/adblock/config", requireScope(auth.ScopeAdblock), s.handleGetAdblockConfig)
+	s.router.POST("/api/adblock/category", requireScope(auth.ScopeAdblock), s.handleToggleAdblockCategory)
 
 	// Statistics API
 	s.router.GET("/api/statistics/hourly", s.handleGetStatisticsHourly)
@@ -256,23 +407,47 @@ func (s *Server) setupRoutes() {
 	s.router.GET("/api/servers/status", s.handleGetServersStatus)
 
 	// Activity API
-	s.router.GET("/api/activity/log", middleware.JWTAuth(), s.handleGetActivityLog)
+	s.router.GET("/api/activity/log", requireScope(auth.ScopeReadStats), s.handleGetActivityLog)
 
 	// Settings API
-	s.router.GET("/api/settings", middleware.JWTAuth(), s.handleGetSettings)
-	s.router.POST("/api/settings", middleware.JWTAuth(), s.handleUpdateSettings)
+	s.router.GET("/api/settings", requireAuth, s.handleGetSettings)
+	s.router.POST("/api/settings", requireAuth, s.handleUpdateSettings)
+
+	// Account API
+	s.router.GET("/api/account/export", requireAuth, s.handleExportAccount)
+	s.router.DELETE("/api/account", requireAuth, s.handleDeleteAccount)
 
 	// Auth API
 	authGroup := s.router.Group("/api/auth")
 	{
 		authGroup.POST("/register", s.handleRegister)
 		authGroup.POST("/login", s.handleLogin)
-		authGroup.GET("/me", s.AuthMiddleware(), s.handleMe)
-		authGroup.POST("/logout", s.AuthMiddleware(), s.handleLogout)
+		authGroup.POST("/refresh", s.handleRefresh)
+		authGroup.POST("/verify", s.handleVerifyEmail)
+		authGroup.POST("/verify/resend", requireAuth, s.handleResendVerification)
+		authGroup.POST("/forgot", s.handleForgotPassword)
+		authGroup.POST("/reset", s.handleResetPassword)
+		authGroup.GET("/me", requireAuth, s.handleMe)
+		authGroup.POST("/logout", requireAuth, s.handleLogout)
+		authGroup.POST("/password", requireAuth, s.handleChangePassword)
+		authGroup.GET("/sessions", requireAuth, s.handleListSessions)
+		authGroup.DELETE("/sessions", requireAuth, s.handleRevokeSessions)
+		authGroup.DELETE("/sessions/:id", requireAuth, s.handleRevokeSession)
+		authGroup.GET("/2fa", requireAuth, s.handleTwoFactorStatus)
+		authGroup.POST("/2fa/setup", requireAuth, s.handleTwoFactorSetup)
+		authGroup.POST("/2fa/enable", requireAuth, s.handleTwoFactorEnable)
+		authGroup.POST("/2fa/verify", s.handleTwoFactorVerify)
+		authGroup.POST("/2fa/disable", requireAuth, s.handleTwoFactorDisable)
+		authGroup.POST("/2fa/reset", requireAuth, s.handleTwoFactorReset)
+		authGroup.POST("/2fa/recovery-codes", requireAuth, s.handleRegenerateRecoveryCodes)
+		authGroup.GET("/api-keys", requireAuth, s.handleListAPIKeys)
+		authGroup.POST("/api-keys", requireAuth, s.handleCreateAPIKey)
+		authGroup.DELETE("/api-keys/:id", requireAuth, s.handleDeleteAPIKey)
 	}
 
 	// Webhooks
 	s.router.POST("/webhooks/paystack", s.handlePaystackWebhook)
+	s.router.POST("/webhooks/stripe", s.handleStripeWebhook)
 }
 
 func (s *Server) handleWS(c *gin.Context) {
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// StripeEvent is a Stripe webhook delivery. The object depends on the type.
+type StripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type stripeCheckoutSession struct {
+	ID                string            `json:"id"`
+	Mode              string            `json:"mode"` // payment or subscription
+	PaymentStatus     string            `json:"payment_status"`
+	ClientReferenceID string            `json:"client_reference_id"`
+	CustomerEmail     string            `json:"customer_email"`
+	AmountTotal       int64             `json:"amount_total"`
+	Currency          string            `json:"currency"`
+	PaymentIntent     string            `json:"payment_intent"`
+	Subscription      string            `json:"subscription"`
+	Metadata          map[string]string `json:"metadata"`
+	CustomerDetails   struct {
+		Email string `json:"email"`
+	} `json:"customer_details"`
+}
+
+type stripeInvoice struct {
+	ID            string `json:"id"`
+	Subscription  string `json:"subscription"`
+	BillingReason string `json:"billing_reason"` // subscription_create, subscription_cycle, ...
+	PaymentIntent string `json:"payment_intent"`
+	AmountPaid    int64  `json:"amount_paid"`
+	Currency      string `json:"currency"`
+	Lines         struct {
+		Data []struct {
+			Period struct {
+				Start int64 `json:"start"`
+				End   int64 `json:"end"`
+			} `json:"period"`
+		} `json:"data"`
+	} `json:"lines"`
+}
+
+type stripeSubscription struct {
+	ID                string `json:"id"`
+	Status            string `json:"status"`
+	CancelAtPeriodEnd bool   `json:"cancel_at_period_end"`
+}
+
+type stripeRefund struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // pending, succeeded, failed or canceled
+}
+
+// handleStripeWebhook processes incoming webhook events from Stripe
+func (s *Server) handleStripeWebhook(c *gin.Context) {
+	const MaxBodyBytes = int64(65536)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxBodyBytes)
+
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		s.logger.Errorf("Error reading request body: %v", err)
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+
+	stripe := s.billingManager.Stripe()
+	if stripe == nil {
+		s.logger.Error("Stripe not configured - webhook rejected")
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	if err := stripe.VerifyWebhook(payload, c.GetHeader("Stripe-Signature"), time.Now()); err != nil {
+		s.logger.Errorf("Invalid Stripe webhook: %v", err)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	var event StripeEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		s.logger.Errorf("Failed to parse Stripe webhook JSON: %v", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Infof("Received Stripe event: %s | ID: %s", event.Type, event.ID)
+
+	// Stripe gives every event an ID, which is kept across redeliveries
+	if s.queue == nil {
+		if err := s.processStripeEvent(&queue.Event{Type: event.Type, Key: event.ID, Payload: payload}); err != nil {
+			s.logger.Errorf("Failed to process Stripe event %s: %v", event.Type, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	recorded, err := s.queue.Receive("stripe", event.Type, event.ID, payload)
+	if err != nil {
+		s.logger.Errorf("Failed to store Stripe event: %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if !recorded {
+		s.logger.Infof("Ignoring duplicate Stripe event: %s | ID: %s", event.Type, event.ID)
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// processStripeEvent handles a stored Stripe event. An error makes the queue
+// retry it.
+func (s *Server) processStripeEvent(e *queue.Event) error {
+	var event StripeEvent
+	if err := json.Unmarshal(e.Payload, &event); err != nil {
+		return queue.Permanent(fmt.Errorf("failed to parse event: %w", err))
+	}
+
+	var err error
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		var session stripeCheckoutSession
+		if err = json.Unmarshal(event.Data.Object, &session); err == nil {
+			return s.handleStripeCheckout(session)
+		}
+	case "invoice.paid":
+		var invoice stripeInvoice
+		if err = json.Unmarshal(event.Data.Object, &invoice); err == nil {
+			return s.handleStripeInvoicePaid(invoice)
+		}
+	case "invoice.payment_failed":
+		var invoice stripeInvoice
+		if err = json.Unmarshal(event.Data.Object, &invoice); err == nil {
+			return s.applyStripeStatus(invoice.Subscription, billing.StatusPastDue)
+		}
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		var sub stripeSubscription
+		if err = json.Unmarshal(event.Data.Object, &sub); err == nil {
+			status := billing.StripeSubscriptionStatus(sub.Status, sub.CancelAtPeriodEnd)
+			if event.Type == "customer.subscription.deleted" {
+				status = billing.StatusExpired
+			}
+			return s.applyStripeStatus(sub.ID, status)
+		}
+	case "refund.updated", "charge.refund.updated":
+		var refund stripeRefund
+		if err = json.Unmarshal(event.Data.Object, &refund); err == nil {
+			return s.handleStripeRefund(refund)
+		}
+	}
+	if err != nil {
+		return queue.Permanent(fmt.Errorf("failed to parse %s: %w", event.Type, err))
+	}
+	return nil
+}
+
+// handleStripeCheckout applies a paid Checkout Session. A subscription
+// bought through Checkout is linked to the Stripe subscription billing it.
+func (s *Server) handleStripeCheckout(session stripeCheckoutSession) error {
+	if session.PaymentStatus == "unpaid" {
+		// Delayed payment methods report the outcome in another event
+		s.logger.Infof("Stripe checkout %s awaits payment", session.ID)
+		return nil
+	}
+
+	email := session.CustomerDetails.Email
+	if email == "" {
+		email = session.CustomerEmail
+	}
+	ref := session.ClientReferenceID
+	if ref == "" {
+		return queue.Permanent(fmt.Errorf("stripe checkout %s has no reference", session.ID))
+	}
+
+	err := s.applyPayment(gatewayPayment{
+		Reference:      ref,
+		UserID:         session.Metadata["user_id"],
+		PlanID:         session.Metadata["plan_id"],
+		Email:          email,
+		SubscriptionID: session.Metadata["subscription_id"],
+		Amount:         float64(session.AmountTotal) / 100.0,
+		Currency:       strings.ToUpper(session.Currency),
+		Method:         billing.MethodStripe,
+		GatewayRef:     session.PaymentIntent,
+	})
+	if err != nil {
+		return err
+	}
+
+	if session.Subscription != "" {
+		// Stripe renews the subscription from now on
+		if err := s.store.SetSubscriptionStripeID(ref, session.Subscription); err != nil {
+			return fmt.Errorf("failed to link stripe subscription: %w", err)
+		}
+	}
+	return nil
+}
+
+// handleStripeInvoicePaid records a payment Stripe collected for a
+// subscription. The first invoice belongs to the checkout; later ones renew.
+func (s *Server) handleStripeInvoicePaid(invoice stripeInvoice) error {
+	if invoice.Subscription == "" {
+		return nil
+	}
+	p, err := s.store.GetSubscriptionByStripeID(invoice.Subscription)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		// The checkout that links the subscription may not be processed yet
+		return fmt.Errorf("no subscription linked to stripe subscription %s", invoice.Subscription)
+	}
+
+	switch invoice.BillingReason {
+	case "subscription_create":
+		// The checkout recorded the payment without its payment intent,
+		// which refunds need
+		if invoice.PaymentIntent == "" {
+			return nil
+		}
+		return s.store.SetTransactionGatewayRef(p.ID, invoice.PaymentIntent)
+	case "subscription_cycle":
+	default:
+		return nil
+	}
+
+	ref := "RENEW-" + invoice.ID
+	if tx, err := s.store.GetTransaction(ref); err == nil && tx != nil {
+		s.logger.Infof("Payment %s was already processed", ref)
+		return nil
+	}
+
+	if s.lifecycle != nil && len(invoice.Lines.Data) > 0 {
+		period := invoice.Lines.Data[0].Period
+		start, end := time.Unix(period.Start, 0).UTC(), time.Unix(period.End, 0).UTC()
+		if err := s.lifecycle.RenewedByGateway(p, start, end); err != nil {
+			return fmt.Errorf("failed to renew subscription: %w", err)
+		}
+	}
+	s.logger.Infof("Stripe renewed subscription %s for user %s", p.ID, p.UserID)
+
+	tx := &storage.Transaction{
+		ID:            ref,
+		UserID:        p.UserID,
+		PlanID:        p.PlanID,
+		Amount:        float64(invoice.AmountPaid) / 100.0,
+		Currency:      strings.ToUpper(invoice.Currency),
+		Status:        "completed",
+		PaymentMethod: string(billing.MethodStripe),
+		GatewayRef:    invoice.PaymentIntent,
+		CreatedAt:     time.Now(),
+	}
+	if err := s.store.CreateTransaction(tx); err != nil {
+		// Don't retry the event - the renewal was already applied
+		s.logger.Errorf("Failed to create transaction record: %v", err)
+	}
+	return nil
+}
+
+// applyStripeStatus moves the subscription a Stripe subscription bills into
+// the state Stripe reports
+func (s *Server) applyStripeStatus(stripeSubID, status string) error {
+	if stripeSubID == "" || status == "" {
+		return nil
+	}
+	p, err := s.store.GetSubscriptionByStripeID(stripeSubID)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		s.logger.Warnf("No subscription linked to stripe subscription %s", stripeSubID)
+		return nil
+	}
+	if s.lifecycle == nil {
+		return errors.New("subscription lifecycle not running")
+	}
+
+	s.logger.Infof("Stripe subscription %s is %s", stripeSubID, status)
+	return s.lifecycle.ApplyGatewayStatus(p, status, time.Now())
+}
+
+// handleStripeRefund settles a refund Stripe reported as pending
+func (s *Server) handleStripeRefund(refund stripeRefund) error {
+	tx, err := s.store.GetRefundByGatewayRef(string(billing.MethodStripe), refund.ID)
+	if err != nil {
+		// Refunds made in the Stripe dashboard are not ours to track
+		s.logger.Infof("Ignoring unknown Stripe refund %s", refund.ID)
+		return nil
+	}
+
+	switch refund.Status {
+	case "succeeded":
+		s.logger.Infof("Refund %s processed", tx.ID)
+		return s.store.UpdateRefund(tx.ID, "completed", tx.GatewayRef)
+	case "failed", "canceled":
+		s.logger.Warnf("Refund %s failed at Stripe", tx.ID)
+		return s.store.FailRefund(tx.ID)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// respondSubUser responds to an error of a sub-user request
+func (s *Server) respondSubUser(c *gin.Context, err error, action string) {
+	switch {
+	case middleware.DenyEntitlement(c, err):
+	case errors.Is(err, billing.ErrSubUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sub-user not found"})
+	case errors.Is(err, billing.ErrSubUserLimit):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, billing.ErrInvalidSubUser):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		s.logger.Errorf("Failed to %s: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+}
+
+// handleListSubUsers lists the user's sub-users with their usage of the
+// current period
+func (s *Server) handleListSubUsers(c *gin.Context) {
+	subUsers, err := s.billingManager.ListSubUsers(c.GetString("user_id"))
+	if err != nil {
+		s.respondSubUser(c, err, "load sub-users")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subusers": subUsers})
+}
+
+// handleCreateSubUser creates a sub-user. Their proxy password is only
+// returned here.
+func (s *Server) handleCreateSubUser(c *gin.Context) {
+	var req billing.SubUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	subUser, password, err := s.billingManager.CreateSubUser(c.GetString("user_id"), req)
+	if err != nil {
+		s.respondSubUser(c, err, "create sub-user")
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"subuser":  subUser,
+		"password": password,
+		"message":  "Store the password now - it will not be shown again",
+	})
+}
+
+// handleGetSubUser returns a sub-user with their usage of the current period
+func (s *Server) handleGetSubUser(c *gin.Context) {
+	report, err := s.billingManager.GetSubUser(c.GetString("user_id"), c.Param("id"))
+	if err != nil {
+		s.respondSubUser(c, err, "load sub-user")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// handleUpdateSubUser changes the caps, countries or state of a sub-user
+func (s *Server) handleUpdateSubUser(c *gin.Context) {
+	var req billing.SubUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	subUser, err := s.billingManager.UpdateSubUser(c.GetString("user_id"), c.Param("id"), req)
+	if err != nil {
+		s.respondSubUser(c, err, "update sub-user")
+		return
+	}
+	c.JSON(http.StatusOK, subUser)
+}
+
+// handleDeleteSubUser removes a sub-user and revokes their credentials
+func (s *Server) handleDeleteSubUser(c *gin.Context) {
+	if err := s.billingManager.DeleteSubUser(c.GetString("user_id"), c.Param("id")); err != nil {
+		s.respondSubUser(c, err, "delete sub-user")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Sub-user deleted"})
+}
+
+// handleResetSubUserPassword gives a sub-user a new proxy password
+func (s *Server) handleResetSubUserPassword(c *gin.Context) {
+	password, err := s.billingManager.ResetSubUserPassword(c.GetString("user_id"), c.Param("id"))
+	if err != nil {
+		s.respondSubUser(c, err, "reset password")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"password": password,
+		"message":  "Store the password now - it will not be shown again",
+	})
+}
+
+// handleGetSubUserUsage reports the usage of a sub-user per period, newest
+// first
+func (s *Server) handleGetSubUserUsage(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "12"))
+	if err != nil || limit < 1 || limit > 100 {
+		limit = 12
+	}
+
+	periods, err := s.billingManager.SubUserUsage(c.GetString("user_id"), c.Param("id"), limit)
+	if err != nil {
+		s.respondSubUser(c, err, "load usage")
+		return
+	}
+	if periods == nil {
+		periods = []billing.SubUserPeriod{}
+	}
+	c.JSON(http.StatusOK, gin.H{"periods": periods})
+}
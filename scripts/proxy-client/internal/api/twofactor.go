@@ -0,0 +1,212 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/atlanticproxy/proxy-client/internal/auth"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TwoFactorChallengeResponse is returned by login when a second factor is needed
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int64  `json:"expires_in"`
+}
+
+type TwoFactorVerifyRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ReauthRequest re-authenticates the user before 2FA is disabled or reset
+type ReauthRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+// handleTwoFactorStatus reports whether 2FA is enabled
+func (s *Server) handleTwoFactorStatus(c *gin.Context) {
+	enabled, remaining, err := s.auth.TwoFactorStatus(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load 2FA status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled, "recovery_codes_remaining": remaining})
+}
+
+// handleTwoFactorSetup starts enrollment and returns the secret and otpauth URI
+func (s *Server) handleTwoFactorSetup(c *gin.Context) {
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	enrollment, err := s.auth.BeginTOTPEnrollment(user)
+	if err == auth.ErrTwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to start 2FA enrollment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start 2FA setup"})
+		return
+	}
+
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// handleTwoFactorEnable confirms enrollment with a code and returns recovery codes
+func (s *Server) handleTwoFactorEnable(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code required"})
+		return
+	}
+
+	codes, err := s.auth.EnableTOTP(c.GetString("user_id"), req.Code)
+	switch err {
+	case nil:
+	case auth.ErrInvalidTwoFactorCode:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	case auth.ErrNoPendingEnrollment:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start 2FA setup first"})
+		return
+	case auth.ErrTwoFactorEnabled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	default:
+		s.logger.Errorf("Failed to enable 2FA: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable 2FA"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// handleTwoFactorVerify completes a login challenge with the second factor
+func (s *Server) handleTwoFactorVerify(c *gin.Context) {
+	var req TwoFactorVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Challenge token and code required"})
+		return
+	}
+
+	user, err := s.auth.CompleteChallenge(req.ChallengeToken, req.Code, c.ClientIP(), c.Request.UserAgent())
+	if s.respondThrottled(c, err, "Too many failed sign-in attempts, please try again later") {
+		return
+	}
+	switch err {
+	case nil:
+	case auth.ErrInvalidTwoFactorCode:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	case auth.ErrTooManyAttempts:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, please sign in again"})
+		return
+	default:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	s.completeLogin(c, user)
+}
+
+// handleTwoFactorDisable turns 2FA off after re-authentication
+func (s *Server) handleTwoFactorDisable(c *gin.Context) {
+	user, ok := s.reauthenticate(c)
+	if !ok {
+		return
+	}
+
+	if err := s.auth.DisableTOTP(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable 2FA"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// handleTwoFactorReset replaces the authenticator after re-authentication.
+// 2FA stays off until the new enrollment is confirmed.
+func (s *Server) handleTwoFactorReset(c *gin.Context) {
+	user, ok := s.reauthenticate(c)
+	if !ok {
+		return
+	}
+
+	enrollment, err := s.auth.ResetTOTP(user)
+	if err != nil {
+		s.logger.Errorf("Failed to reset 2FA: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset 2FA"})
+		return
+	}
+
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// handleRegenerateRecoveryCodes issues a new set of recovery codes after re-authentication
+func (s *Server) handleRegenerateRecoveryCodes(c *gin.Context) {
+	user, ok := s.reauthenticate(c)
+	if !ok {
+		return
+	}
+
+	codes, err := s.auth.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// reauthenticate checks the password and second factor of the signed-in user
+func (s *Server) reauthenticate(c *gin.Context) (*storage.User, bool) {
+	var req ReauthRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password and code required"})
+		return nil, false
+	}
+
+	user, err := s.store.GetUserByID(c.GetString("user_id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return nil, false
+	}
+
+	// Re-authentication guesses count like sign-in failures
+	attempt, ok := s.beginLogin(c, user.Email)
+	if !ok {
+		return nil, false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		s.auth.LoginFailed(attempt, user)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return nil, false
+	}
+
+	if err := s.auth.VerifySecondFactor(user.ID, req.Code); err != nil {
+		if err == auth.ErrTwoFactorNotEnabled {
+			s.auth.AbandonLogin(attempt)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+			return nil, false
+		}
+		s.auth.LoginFailed(attempt, user)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return nil, false
+	}
+
+	s.auth.LoginSucceeded(attempt, user)
+	return user, true
+}
@@ -1,17 +1,22 @@
 package api
 
 import (
-	"context"
 	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
 	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/gin-gonic/gin"
 )
@@ -19,18 +24,25 @@ import (
 type PaystackEvent struct {
 	Event string `json:"event"`
 	Data  struct {
+		ID        int64  `json:"id"` // Paystack's transaction ID
 		Reference string `json:"reference"`
 		Amount    int    `json:"amount"`
+		Currency  string `json:"currency"`
 		Email     string `json:"email"`
 		Status    string `json:"status"`
 		Metadata  struct {
-			PlanID string `json:"plan_id"`
-			UserID string `json:"user_id"`
+			PlanID         string `json:"plan_id"`
+			UserID         string `json:"user_id"`
+			SubscriptionID string `json:"subscription_id"` // set for plan changes
 		} `json:"metadata"`
+		Authorization struct {
+			AuthorizationCode string `json:"authorization_code"`
+			Reusable          bool   `json:"reusable"`
+		} `json:"authorization"`
+		SubscriptionCode string `json:"subscription_code"` // set on subscription events
 	} `json:"data"`
 }
 
-// handleStripeWebhook processes incoming webhook events from Stripe
 // handlePaystackWebhook processes incoming webhook events from Paystack
 func (s *Server) handlePaystackWebhook(c *gin.Context) {
 	const MaxBodyBytes = int64(65536)
@@ -79,96 +91,343 @@ func (s *Server) handlePaystackWebhook(c *gin.Context) {
 
 	s.logger.Infof("Received Paystack event: %s | Ref: %s", event.Event, event.Data.Reference)
 
-	// 3. Handle Events
+	// 3. Store the event; the queue processes it and retries failures.
+	// Without a queue it is processed now and Paystack retries failures.
+	if s.queue == nil {
+		if err := s.processPaystackEvent(&queue.Event{Type: event.Event, Key: paystackEventKey(event, payload), Payload: payload}); err != nil {
+			s.logger.Errorf("Failed to process Paystack event %s: %v", event.Event, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	recorded, err := s.queue.Receive("paystack", event.Event, paystackEventKey(event, payload), payload)
+	if err != nil {
+		s.logger.Errorf("Failed to store Paystack event: %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if !recorded {
+		s.logger.Infof("Ignoring duplicate Paystack event: %s | Ref: %s", event.Event, event.Data.Reference)
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// paystackEventKey identifies a Paystack event, so that a redelivery of it is
+// recognised as a duplicate. Paystack sends no event ID; the reference of the
+// charge or the subscription code is unique per event type.
+func paystackEventKey(event PaystackEvent, payload []byte) string {
+	switch {
+	case event.Data.Reference != "":
+		return event.Event + ":" + event.Data.Reference
+	case event.Data.SubscriptionCode != "":
+		return event.Event + ":" + event.Data.SubscriptionCode
+	case event.Data.ID != 0:
+		return event.Event + ":" + strconv.FormatInt(event.Data.ID, 10)
+	}
+	sum := sha256.Sum256(payload)
+	return event.Event + ":" + hex.EncodeToString(sum[:])
+}
+
+// processPaystackEvent handles a stored Paystack event. An error makes the
+// queue retry it.
+func (s *Server) processPaystackEvent(e *queue.Event) error {
+	var event PaystackEvent
+	if err := json.Unmarshal(e.Payload, &event); err != nil {
+		return queue.Permanent(fmt.Errorf("failed to parse event: %w", err))
+	}
+
 	switch event.Event {
 	case "charge.success":
-		s.handleChargeSuccess(c, event)
+		return s.handleChargeSuccess(event)
 	case "subscription.create":
 		s.logger.Infof("Subscription created: %s", event.Data.Email)
 	case "subscription.disable":
-		s.handleSubscriptionDisable(event)
+		return s.handleSubscriptionDisable(event)
 	case "subscription.not_renew":
 		s.logger.Infof("Subscription will not renew: %s", event.Data.Email)
+	case "refund.processed", "refund.failed":
+		return s.handleRefundEvent(event)
 	}
+	return nil
+}
 
-	c.Status(http.StatusOK)
+func (s *Server) handleChargeSuccess(event PaystackEvent) error {
+	currency := event.Data.Currency
+	if currency == "" {
+		currency = "NGN" // Paystack default
+	}
+
+	p := gatewayPayment{
+		Reference:      event.Data.Reference,
+		UserID:         event.Data.Metadata.UserID,
+		PlanID:         event.Data.Metadata.PlanID,
+		Email:          event.Data.Email,
+		SubscriptionID: event.Data.Metadata.SubscriptionID,
+		Amount:         float64(event.Data.Amount) / 100.0, // Paystack amounts are in kobo/cents
+		Currency:       currency,
+		Method:         billing.MethodPaystack,
+	}
+	if event.Data.ID != 0 {
+		p.GatewayRef = strconv.FormatInt(event.Data.ID, 10)
+	}
+	if auth := event.Data.Authorization; auth.Reusable {
+		p.PaymentAuth = auth.AuthorizationCode
+	}
+	return s.applyPayment(p)
 }
 
-func (s *Server) handleChargeSuccess(c *gin.Context, event PaystackEvent) {
-		userID := event.Data.Metadata.UserID
-		planID := event.Data.Metadata.PlanID
-		email := event.Data.Email
+// gatewayPayment is a successful payment a gateway reported
+type gatewayPayment struct {
+	Reference      string // our reference; its prefix says what was paid for
+	UserID         string // from the checkout metadata, if set
+	PlanID         string
+	Email          string // identifies the user without metadata
+	SubscriptionID string // the subscription a plan change applies to
+	Amount         float64
+	Currency       string
+	Method         billing.PaymentMethod
+	GatewayRef     string // the gateway's ID of the payment, used for refunds
+	PaymentAuth    string // reusable authorization to charge renewals with
+}
 
-		// Fallback: If no metadata, try to find user by email
-		if userID == "" && email != "" {
-			user, err := s.store.GetUserByEmail(email)
-			if err == nil {
-				userID = user.ID
-			}
+// paymentRate returns the rate a payment was charged at and its amount in
+// USD. The quote locked at checkout sets both; payments without one are
+// converted at the current rate.
+func (s *Server) paymentRate(ref string, amount float64, currency string) (float64, float64, error) {
+	var quote *billing.PriceQuote
+	if s.records != nil {
+		var err error
+		if quote, err = s.records.GetPriceQuote(ref); err != nil {
+			return 0, 0, fmt.Errorf("failed to load price quote: %w", err)
+		}
+	}
+	if quote != nil && strings.EqualFold(string(quote.Currency), currency) {
+		if math.Abs(quote.Amount-amount) < 0.01 {
+			return quote.Rate, quote.AmountUSD, nil
 		}
+		s.logger.Warnf("Payment %s of %.2f %s differs from its quote of %.2f", ref, amount, currency, quote.Amount)
+		return quote.Rate, math.Round(amount/quote.Rate*100) / 100, nil
+	}
 
-		if userID == "" {
-			s.logger.Errorf("Could not identify user for payment: %s", email)
-			c.Status(http.StatusOK) // Return 200 to acknowledge receipt even if logic fails
-			return
+	rate := billing.ExchangeRates().Rate(billing.CurrencyCode(currency))
+	if rate == 0 {
+		rate = 1 // recorded as USD
+	}
+	return rate, billing.ConvertToUSD(amount, billing.CurrencyCode(currency)), nil
+}
+
+// applyPayment gives the user what they paid for and records the payment
+func (s *Server) applyPayment(p gatewayPayment) error {
+	userID := p.UserID
+	planID := p.PlanID
+	ref := p.Reference
+
+	// The transaction is recorded last, so a charge that has one was handled
+	// in full. Replays and redeliveries under another key stop here.
+	if tx, err := s.store.GetTransaction(ref); err == nil && tx != nil {
+		s.logger.Infof("Payment %s was already processed", ref)
+		return nil
+	}
+
+	// Fallback: If no metadata, try to find user by email
+	if userID == "" && p.Email != "" {
+		user, err := s.store.GetUserByEmail(p.Email)
+		if err == nil {
+			userID = user.ID
 		}
+	}
+
+	if userID == "" {
+		return queue.Permanent(fmt.Errorf("could not identify user for payment %s: %s", ref, p.Email))
+	}
+
+	fxRate, amountUSD, err := s.paymentRate(ref, p.Amount, p.Currency)
+	if err != nil {
+		return err
+	}
 
+	switch {
+	case strings.HasPrefix(ref, "RENEW-"):
+		// Renewals are charged by the subscription lifecycle. Charges
+		// that were still pending are settled here.
+		s.logger.Infof("Renewal payment received for user %s", userID)
+		if s.lifecycle != nil {
+			if err := s.lifecycle.ConfirmRenewal(ref); err != nil {
+				return fmt.Errorf("failed to settle renewal: %w", err)
+			}
+		}
+	case strings.HasPrefix(ref, "CHANGE-"):
+		// The prorated difference of an upgrade was paid
+		s.logger.Infof("Upgrading user %s to plan %s after prorated payment", userID, planID)
+		if err := s.billingManager.ApplyUpgrade(userID, p.SubscriptionID, billing.PlanType(planID)); err != nil {
+			// The payment is recorded below so it can be refunded
+			s.logger.Errorf("Failed to apply paid upgrade %s: %v", ref, err)
+		}
+	case strings.HasPrefix(ref, "CREDIT-"):
+		// Pay-as-you-go credits were bought; the amount paid is booked
+		s.logger.Infof("Booking credit top-up for user %s", userID)
+		if _, err := s.billingManager.TopUpCredits(userID, amountUSD, ref); err != nil {
+			return fmt.Errorf("failed to book credit top-up: %w", err)
+		}
+	case strings.HasPrefix(ref, "TRIAL-"):
+		if planID == "" {
+			planID = "personal" // Default fallback
+		}
+		s.logger.Infof("Starting %s trial for user %s via %s", planID, userID, p.Method)
+		if err := s.billingManager.StartTrial(userID, billing.PlanType(planID), ref, billing.TrialLength); err != nil {
+			return fmt.Errorf("failed to start trial: %w", err)
+		}
+	default:
 		if planID == "" {
 			planID = "personal" // Default fallback
 		}
 
-		s.logger.Infof("Upgrading user %s to plan %s via Paystack", userID, planID)
+		s.logger.Infof("Upgrading user %s to plan %s via %s", userID, planID, p.Method)
 
 		// Create subscription using BillingManager
-		err := s.billingManager.SubscribeUser(userID, billing.PlanType(planID), event.Data.Reference)
-		if err != nil {
-			s.logger.Errorf("Failed to create subscription: %v", err)
-			c.Status(http.StatusInternalServerError)
-			return
+		if err := s.billingManager.SubscribeUser(userID, billing.PlanType(planID), ref); err != nil {
+			return fmt.Errorf("failed to create subscription: %w", err)
 		}
+	}
+
+	// Keep the card authorization so renewals can be charged without the user
+	subscriptionID := ref
+	if strings.HasPrefix(ref, "CHANGE-") {
+		subscriptionID = p.SubscriptionID
+	}
+	if p.PaymentAuth != "" && !strings.HasPrefix(ref, "RENEW-") && !strings.HasPrefix(ref, "CREDIT-") {
+		if err := s.store.SetSubscriptionPaymentAuth(subscriptionID, p.PaymentAuth, p.Currency); err != nil {
+			s.logger.Errorf("Failed to store payment authorization: %v", err)
+		}
+	}
 
-		// Create transaction record for invoice generation
-		tx := &storage.Transaction{
-			ID:            event.Data.Reference,
-			UserID:        userID,
-			PlanID:        planID,
-			Amount:        float64(event.Data.Amount) / 100.0, // Paystack amounts are in kobo/cents
-			Currency:      "NGN",                              // Paystack default
-			Status:        "completed",
-			PaymentMethod: "paystack",
-			CreatedAt:     time.Now(),
+	// Count the coupon the checkout was made with, and reward the referral
+	// of a referred user's first payment. A refundable trial deposit is not
+	// a payment yet.
+	if _, err := s.billingManager.RedeemCoupon(userID, ref); err != nil {
+		s.logger.Errorf("Failed to redeem coupon of payment %s: %v", ref, err)
+	}
+	if !strings.HasPrefix(ref, "TRIAL-") {
+		if _, err := s.billingManager.RewardReferral(userID, ref); err != nil {
+			s.logger.Errorf("Failed to reward referral of user %s: %v", userID, err)
 		}
+	}
+
+	// Create transaction record for invoice generation
+	tx := &storage.Transaction{
+		ID:            ref,
+		UserID:        userID,
+		PlanID:        planID,
+		Amount:        p.Amount,
+		Currency:      p.Currency,
+		Status:        "completed",
+		PaymentMethod: string(p.Method),
+		GatewayRef:    p.GatewayRef,
+		CreatedAt:     time.Now(),
+		FXRate:        fxRate,
+		AmountUSD:     amountUSD,
+	}
+	if strings.HasPrefix(ref, "TRIAL-") {
+		// Part of the trial payment is a deposit, refunded after the
+		// subscription ends
+		tx.DepositAmount = billing.TrialDeposit(tx.Amount)
+		tx.DepositStatus = billing.DepositHeld
+	}
 
-		if err := s.store.CreateTransaction(tx); err != nil {
-			s.logger.Errorf("Failed to create transaction record: %v", err)
-			// Don't fail the webhook - subscription is already created
+	if err := s.store.CreateTransaction(tx); err != nil {
+		// Don't retry the event - the payment was already applied
+		s.logger.Errorf("Failed to create transaction record: %v", err)
+	} else {
+		email := p.Email
+		if user, err := s.store.GetUserByID(userID); err == nil {
+			email = user.Email
 		}
+		s.issueInvoice(tx, email)
+	}
 
-		s.logger.Info("Subscription and transaction created successfully!")
+	s.logger.Info("Subscription and transaction created successfully!")
+	return nil
 }
 
-func (s *Server) handleSubscriptionDisable(event PaystackEvent) {
+func (s *Server) handleSubscriptionDisable(event PaystackEvent) error {
 	email := event.Data.Email
 	user, err := s.store.GetUserByEmail(email)
 	if err != nil {
-		s.logger.Errorf("User not found for subscription disable: %s", email)
-		return
+		return queue.Permanent(fmt.Errorf("user not found for subscription disable: %s", email))
 	}
 
 	s.logger.Infof("Subscription disabled for user: %s", user.ID)
-	
-	// Schedule deposit refund (7 days) with context
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 8*24*time.Hour)
-		defer cancel()
-		
-		select {
-		case <-ctx.Done():
-			s.logger.Warn("Deposit refund context cancelled")
-			return
-		case <-time.After(7 * 24 * time.Hour):
-			// TODO: Refund deposit transaction
-			s.logger.Infof("Deposit refund processed for user: %s", user.ID)
-		}
-	}()
+	return s.scheduleDepositRefund(user.ID)
+}
+
+// handleRefundEvent settles a refund Paystack reported as pending
+func (s *Server) handleRefundEvent(event PaystackEvent) error {
+	refund, err := s.store.GetRefundByGatewayRef(string(billing.MethodPaystack), strconv.FormatInt(event.Data.ID, 10))
+	if err != nil {
+		return queue.Permanent(fmt.Errorf("refund %d not found: %w", event.Data.ID, err))
+	}
+
+	if event.Event == "refund.failed" {
+		s.logger.Warnf("Refund %s failed at Paystack", refund.ID)
+		return s.store.FailRefund(refund.ID)
+	}
+	s.logger.Infof("Refund %s processed", refund.ID)
+	return s.store.UpdateRefund(refund.ID, "completed", refund.GatewayRef)
+}
+
+// handleAdminListWebhookEvents lists stored webhook events, newest first,
+// optionally only those in one state (pending, processed or dead)
+func (s *Server) handleAdminListWebhookEvents(c *gin.Context) {
+	if s.queue == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Webhook queue not available"})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	events, total, err := s.queue.Events(c.Query("status"), pageSize, (page-1)*pageSize)
+	if err != nil {
+		s.logger.Errorf("Failed to load webhook events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load webhook events"})
+		return
+	}
+	if events == nil {
+		events = []*queue.Event{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":   events,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// handleAdminReplayWebhookEvent processes a stored webhook event again, such
+// as a dead one after the cause of its failures was fixed
+func (s *Server) handleAdminReplayWebhookEvent(c *gin.Context) {
+	if s.queue == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Webhook queue not available"})
+		return
+	}
+
+	event, err := s.queue.Replay(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook event not found"})
+		return
+	}
+
+	s.logger.Infof("Webhook event %s queued for replay by %s", event.ID, c.GetString("user_id"))
+	c.JSON(http.StatusAccepted, gin.H{"event": event})
 }
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// API key scopes
+const (
+	ScopeReadStats   = "read-stats"
+	ScopeRotation    = "rotation"
+	ScopeAdblock     = "adblock"
+	ScopeBillingRead = "billing-read"
+	ScopeProxyAuth   = "proxy-auth"
+	ScopeSubUsers    = "subusers"
+)
+
+// Scopes lists every scope an API key can be granted
+var Scopes = []string{ScopeReadStats, ScopeRotation, ScopeAdblock, ScopeBillingRead, ScopeProxyAuth, ScopeSubUsers}
+
+const (
+	// APIKeyPrefix marks a bearer credential as an API key rather than an access token
+	APIKeyPrefix = "ap_"
+
+	apiKeyVisibleLen = len(APIKeyPrefix) + 8
+	// last_used_at is written at most this often per key
+	apiKeyTouchInterval = time.Minute
+)
+
+var (
+	ErrInvalidAPIKey   = errors.New("invalid api key")
+	ErrAPIKeyExpired   = errors.New("api key expired")
+	ErrAPIKeyNotFound  = errors.New("api key not found")
+	ErrInvalidScope    = errors.New("invalid scope")
+	ErrScopeDenied     = errors.New("api key lacks the required scope")
+	ErrAPIAccessDenied = errors.New("plan does not include API access")
+)
+
+// APIAccessCheck reports whether a user's plan allows API keys to be used
+type APIAccessCheck func(userID string) error
+
+// SubUserCheck authenticates the proxy credentials of a sub-user and returns
+// their ID
+type SubUserCheck func(username, password string) (string, error)
+
+// IsAPIKey reports whether a bearer credential looks like an API key
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// SetAPIAccessCheck installs the plan check applied on every API key use
+func (m *Manager) SetAPIAccessCheck(check APIAccessCheck) {
+	m.apiAccess = check
+}
+
+// SetSubUserCheck installs the check of proxy credentials that are not API
+// keys, which are those of sub-users
+func (m *Manager) SetSubUserCheck(check SubUserCheck) {
+	m.subUsers = check
+}
+
+// CheckAPIAccess applies the plan check to a user
+func (m *Manager) CheckAPIAccess(userID string) error {
+	if m.apiAccess == nil {
+		return nil
+	}
+	if err := m.apiAccess(userID); err != nil {
+		return fmt.Errorf("%w: %w", ErrAPIAccessDenied, err)
+	}
+	return nil
+}
+
+// CreateAPIKey creates a named key for the user. The plaintext key is only
+// returned here; afterwards it can only be recognised by its prefix.
+func (m *Manager) CreateAPIKey(userID, name string, scopes []string, expiresAt *time.Time) (*storage.APIKey, string, error) {
+	if m.store == nil {
+		return nil, "", ErrStoreUnavailable
+	}
+	if err := m.CheckAPIAccess(userID); err != nil {
+		return nil, "", err
+	}
+
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+	plaintext := APIKeyPrefix + hex.EncodeToString(b)
+
+	key := &storage.APIKey{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      strings.TrimSpace(name),
+		Prefix:    plaintext[:apiKeyVisibleLen],
+		KeyHash:   hashToken(plaintext),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	if err := m.store.CreateAPIKey(key); err != nil {
+		return nil, "", fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	return key, plaintext, nil
+}
+
+// ListAPIKeys returns the keys of a user
+func (m *Manager) ListAPIKeys(userID string) ([]*storage.APIKey, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	return m.store.ListUserAPIKeys(userID)
+}
+
+// DeleteAPIKey revokes one of the user's keys
+func (m *Manager) DeleteAPIKey(userID, keyID string) error {
+	if m.store == nil {
+		return ErrStoreUnavailable
+	}
+	if err := m.store.DeleteAPIKey(keyID, userID); err != nil {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// ValidateAPIKey resolves a plaintext key, checks its expiry and the owner's
+// plan, and records the use.
+func (m *Manager) ValidateAPIKey(plaintext string) (*storage.APIKey, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	if !IsAPIKey(plaintext) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := m.store.GetAPIKeyByHash(hashToken(plaintext))
+	if err != nil || key == nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, ErrAPIKeyExpired
+	}
+	if err := m.CheckAPIAccess(key.UserID); err != nil {
+		return nil, err
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		if err := m.store.TouchAPIKey(key.ID, now); err != nil {
+			logrus.Warnf("Failed to record api key use: %v", err)
+		}
+		key.LastUsedAt = &now
+	}
+
+	return key, nil
+}
+
+// ValidateProxyCredentials authenticates a proxy client. The API key may be
+// sent as either the username or the password and must carry the proxy-auth
+// scope. It returns the ID of the key's owner. Other credentials are those
+// of a sub-user, whose ID is returned.
+func (m *Manager) ValidateProxyCredentials(username, password string) (string, error) {
+	credential := password
+	if !IsAPIKey(credential) {
+		credential = username
+	}
+	if !IsAPIKey(credential) && m.subUsers != nil {
+		return m.subUsers(username, password)
+	}
+
+	key, err := m.ValidateAPIKey(credential)
+	if err != nil {
+		return "", err
+	}
+	if !HasScope(key, ScopeProxyAuth) {
+		return "", ErrScopeDenied
+	}
+	return key.UserID, nil
+}
+
+// HasScope reports whether the key was granted scope
+func HasScope(key *storage.APIKey, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		valid := false
+		for _, known := range Scopes {
+			if s == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	key, plaintext, err := m.CreateAPIKey(user.ID, "ci", []string{ScopeReadStats, ScopeProxyAuth}, nil)
+	if err != nil {
+		t.Fatalf("CreateAPIKey failed: %v", err)
+	}
+	if !strings.HasPrefix(plaintext, APIKeyPrefix) || !strings.HasPrefix(plaintext, key.Prefix) {
+		t.Errorf("Unexpected key format %q with prefix %q", plaintext, key.Prefix)
+	}
+	if key.KeyHash == plaintext || strings.Contains(key.KeyHash, plaintext) {
+		t.Error("Key must not be stored in plaintext")
+	}
+
+	got, err := m.ValidateAPIKey(plaintext)
+	if err != nil {
+		t.Fatalf("ValidateAPIKey failed: %v", err)
+	}
+	if got.UserID != user.ID || !HasScope(got, ScopeReadStats) {
+		t.Errorf("Unexpected key: %+v", got)
+	}
+	if got.LastUsedAt == nil {
+		t.Error("Expected last use to be recorded")
+	}
+
+	keys, err := m.ListAPIKeys(user.ID)
+	if err != nil || len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Fatalf("Expected one used key, got %v (err %v)", keys, err)
+	}
+
+	if _, err := m.ValidateAPIKey(plaintext + "x"); err != ErrInvalidAPIKey {
+		t.Errorf("Expected ErrInvalidAPIKey for a wrong key, got %v", err)
+	}
+
+	if err := m.DeleteAPIKey("someone-else", key.ID); err != ErrAPIKeyNotFound {
+		t.Errorf("Expected ErrAPIKeyNotFound for another user's key, got %v", err)
+	}
+	if err := m.DeleteAPIKey(user.ID, key.ID); err != nil {
+		t.Fatalf("DeleteAPIKey failed: %v", err)
+	}
+	if _, err := m.ValidateAPIKey(plaintext); err != ErrInvalidAPIKey {
+		t.Errorf("Expected deleted key to be rejected, got %v", err)
+	}
+}
+
+func TestAPIKeyScopesAndExpiry(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	if _, _, err := m.CreateAPIKey(user.ID, "bad", []string{"admin"}, nil); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("Expected ErrInvalidScope, got %v", err)
+	}
+	if _, _, err := m.CreateAPIKey(user.ID, "none", nil, nil); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("Expected ErrInvalidScope for no scopes, got %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	_, expired, err := m.CreateAPIKey(user.ID, "old", []string{ScopeRotation}, &past)
+	if err != nil {
+		t.Fatalf("CreateAPIKey failed: %v", err)
+	}
+	if _, err := m.ValidateAPIKey(expired); err != ErrAPIKeyExpired {
+		t.Errorf("Expected ErrAPIKeyExpired, got %v", err)
+	}
+
+	_, stats, _ := m.CreateAPIKey(user.ID, "stats", []string{ScopeReadStats}, nil)
+	if _, err := m.ValidateProxyCredentials("user", stats); err != ErrScopeDenied {
+		t.Errorf("Expected ErrScopeDenied without proxy-auth scope, got %v", err)
+	}
+
+	_, proxyKey, _ := m.CreateAPIKey(user.ID, "proxy", []string{ScopeProxyAuth}, nil)
+	for _, creds := range [][2]string{{"user", proxyKey}, {proxyKey, ""}} {
+		userID, err := m.ValidateProxyCredentials(creds[0], creds[1])
+		if err != nil || userID != user.ID {
+			t.Errorf("Expected proxy credentials %v to resolve to the user, got %q (err %v)", creds, userID, err)
+		}
+	}
+}
+
+func TestAPIKeyPlanCheck(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	_, plaintext, err := m.CreateAPIKey(user.ID, "ci", []string{ScopeReadStats}, nil)
+	if err != nil {
+		t.Fatalf("CreateAPIKey failed: %v", err)
+	}
+
+	m.SetAPIAccessCheck(func(userID string) error {
+		return errors.New("upgrade to Personal plan or higher for API access")
+	})
+
+	if _, err := m.ValidateAPIKey(plaintext); !errors.Is(err, ErrAPIAccessDenied) {
+		t.Errorf("Expected ErrAPIAccessDenied after downgrade, got %v", err)
+	}
+	if _, _, err := m.CreateAPIKey(user.ID, "new", []string{ScopeReadStats}, nil); !errors.Is(err, ErrAPIAccessDenied) {
+		t.Errorf("Expected ErrAPIAccessDenied on create, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Email token purposes and lifetimes
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposePasswordReset = "password_reset"
+
+	VerifyEmailTTL   = 48 * time.Hour
+	PasswordResetTTL = time.Hour
+)
+
+var ErrInvalidEmailToken = errors.New("invalid or expired token")
+
+// IssueEmailToken creates a signed single-use token for an email link.
+// Earlier unused tokens of the same purpose are invalidated.
+func (m *Manager) IssueEmailToken(userID, purpose string, ttl time.Duration) (string, error) {
+	if m.store == nil {
+		return "", ErrStoreUnavailable
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	token := id + "." + m.signEmailToken(purpose, id)
+
+	if err := m.store.DeleteEmailTokens(userID, purpose); err != nil {
+		return "", fmt.Errorf("failed to clear old tokens: %w", err)
+	}
+	if err := m.store.CreateEmailToken(hashToken(token), userID, purpose, time.Now().Add(ttl)); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, nil
+}
+
+// ConsumeEmailToken checks the signature of a token, consumes it and
+// returns the user it was issued for
+func (m *Manager) ConsumeEmailToken(token, purpose string) (string, error) {
+	if m.store == nil {
+		return "", ErrStoreUnavailable
+	}
+
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(m.signEmailToken(purpose, id))) {
+		return "", ErrInvalidEmailToken
+	}
+
+	userID, err := m.store.ConsumeEmailToken(hashToken(token), purpose, time.Now())
+	if err != nil {
+		return "", ErrInvalidEmailToken
+	}
+	return userID, nil
+}
+
+// signEmailToken binds a token to its purpose so a verification link can not
+// be used as a reset link
+func (m *Manager) signEmailToken(purpose, id string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(purpose + ":" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
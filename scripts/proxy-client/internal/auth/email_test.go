@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestEmailTokens(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	token, err := m.IssueEmailToken(user.ID, PurposeVerifyEmail, VerifyEmailTTL)
+	if err != nil {
+		t.Fatalf("IssueEmailToken failed: %v", err)
+	}
+
+	// A verification token can not be used to reset a password
+	if _, err := m.ConsumeEmailToken(token, PurposePasswordReset); err != ErrInvalidEmailToken {
+		t.Errorf("Expected ErrInvalidEmailToken for wrong purpose, got %v", err)
+	}
+
+	userID, err := m.ConsumeEmailToken(token, PurposeVerifyEmail)
+	if err != nil || userID != user.ID {
+		t.Fatalf("Expected token to resolve to the user, got %q (err %v)", userID, err)
+	}
+	if _, err := m.ConsumeEmailToken(token, PurposeVerifyEmail); err != ErrInvalidEmailToken {
+		t.Errorf("Expected token to be single-use, got %v", err)
+	}
+}
+
+func TestEmailTokenReissueAndExpiry(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	first, _ := m.IssueEmailToken(user.ID, PurposePasswordReset, PasswordResetTTL)
+	second, _ := m.IssueEmailToken(user.ID, PurposePasswordReset, PasswordResetTTL)
+	if _, err := m.ConsumeEmailToken(first, PurposePasswordReset); err != ErrInvalidEmailToken {
+		t.Errorf("Expected earlier token to be invalidated, got %v", err)
+	}
+	if _, err := m.ConsumeEmailToken(second, PurposePasswordReset); err != nil {
+		t.Errorf("Expected latest token to work, got %v", err)
+	}
+
+	expired, _ := m.IssueEmailToken(user.ID, PurposePasswordReset, -1)
+	if _, err := m.ConsumeEmailToken(expired, PurposePasswordReset); err != ErrInvalidEmailToken {
+		t.Errorf("Expected expired token to be rejected, got %v", err)
+	}
+
+	if _, err := m.ConsumeEmailToken("forged.signature", PurposePasswordReset); err != ErrInvalidEmailToken {
+		t.Errorf("Expected forged token to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Activity log entries written for suspicious sign-ins
+const (
+	ActivitySecurity = "security"
+
+	ActivityStatusWarning = "warning"
+	ActivityStatusBlocked = "blocked"
+)
+
+// LoginGuardConfig sets the brute-force protection thresholds. Failed
+// sign-ins are counted per email address and per client IP. Once a counter
+// passes its free attempts every further attempt has to wait an exponentially
+// growing delay, and at the lockout threshold the key is locked out.
+// A threshold of zero disables that stage.
+type LoginGuardConfig struct {
+	EmailFreeAttempts int `yaml:"email_free_attempts"`
+	EmailLockout      int `yaml:"email_lockout"`
+	IPFreeAttempts    int `yaml:"ip_free_attempts"`
+	IPLockout         int `yaml:"ip_lockout"`
+
+	BaseDelay       time.Duration `yaml:"base_delay"`
+	MaxDelay        time.Duration `yaml:"max_delay"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+	// Window is how long a failure counts; the counter restarts after a
+	// quiet period this long
+	Window time.Duration `yaml:"window"`
+}
+
+// DefaultLoginGuardConfig returns the thresholds used when none are configured
+func DefaultLoginGuardConfig() LoginGuardConfig {
+	return LoginGuardConfig{
+		EmailFreeAttempts: 3,
+		EmailLockout:      10,
+		IPFreeAttempts:    10,
+		IPLockout:         50,
+		BaseDelay:         time.Second,
+		MaxDelay:          5 * time.Minute,
+		LockoutDuration:   15 * time.Minute,
+		Window:            time.Hour,
+	}
+}
+
+// withDefaults fills in unset durations
+func (c LoginGuardConfig) withDefaults() LoginGuardConfig {
+	d := DefaultLoginGuardConfig()
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = d.BaseDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = d.MaxDelay
+	}
+	if c.LockoutDuration <= 0 {
+		c.LockoutDuration = d.LockoutDuration
+	}
+	if c.Window <= 0 {
+		c.Window = d.Window
+	}
+	return c
+}
+
+// staleAfter is the age after which a counter can no longer block anyone
+func (c LoginGuardConfig) staleAfter() time.Duration {
+	if c.LockoutDuration > c.Window {
+		return c.LockoutDuration
+	}
+	return c.Window
+}
+
+// wait returns how long after the last failure the next attempt is allowed
+func (c LoginGuardConfig) wait(failures, free, lockout int) (time.Duration, bool) {
+	if lockout > 0 && failures >= lockout {
+		return c.LockoutDuration, true
+	}
+	if free <= 0 || failures <= free {
+		return 0, false
+	}
+	d := c.BaseDelay
+	for i := free + 1; i < failures && d < c.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > c.MaxDelay {
+		d = c.MaxDelay
+	}
+	return d, false
+}
+
+// LoginThrottledError is returned while sign-ins for an email address or IP
+// are held back
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed sign-ins, locked for %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed sign-ins, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func emailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func mailKey(key string) string {
+	return "mail:" + key
+}
+
+// maxReserveRetries bounds how often a reservation is retried when concurrent
+// attempts keep changing the counter
+const maxReserveRetries = 5
+
+// LoginAttempt is a sign-in attempt that was counted against the email
+// address and IP before the credentials were checked. End it with
+// LoginFailed, LoginSucceeded, SecondFactorPending or AbandonLogin.
+type LoginAttempt struct {
+	email     string
+	ip        string
+	userAgent string
+	// failures of the email address including this attempt
+	emailFailures int
+	ipReserved    bool
+}
+
+// BeginLogin counts a sign-in attempt for the email address and IP before the
+// password or second factor is verified. The counters are updated with a
+// compare-and-set, so concurrent attempts are decided one after another and
+// can not all slip through before any of them is recorded. It returns a
+// *LoginThrottledError if the attempt has to wait.
+func (m *Manager) BeginLogin(email, ip, userAgent string) (*LoginAttempt, error) {
+	a := &LoginAttempt{email: email, ip: ip, userAgent: userAgent}
+	if m.store == nil {
+		return a, nil
+	}
+
+	failures, ipReserved, err := m.reserveBoth(emailKey(email), ip, ipKey(ip))
+	if err != nil {
+		return nil, err
+	}
+	a.emailFailures, a.ipReserved = failures, ipReserved
+	return a, nil
+}
+
+// CheckMailRequest counts a request that sends mail to email, like a password
+// reset link, per email address and per IP. Mail requests have their own
+// counters but the thresholds of failed sign-ins, so they can not be used to
+// flood a mailbox or to lock its owner out of signing in. It returns a
+// *LoginThrottledError if the request has to wait.
+func (m *Manager) CheckMailRequest(email, ip string) error {
+	if m.store == nil {
+		return nil
+	}
+	_, _, err := m.reserveBoth(mailKey(emailKey(email)), ip, mailKey(ipKey(ip)))
+	return err
+}
+
+// reserveBoth reserves an attempt for the email key and, if ip is known, the
+// IP key. It returns the email counter including the attempt.
+func (m *Manager) reserveBoth(emailK, ip, ipK string) (int, bool, error) {
+	now := time.Now()
+	f, err := m.reserve(emailK, m.guard.EmailFreeAttempts, m.guard.EmailLockout, now)
+	if err != nil {
+		return 0, false, err
+	}
+	if ip == "" {
+		return f.Failures, false, nil
+	}
+	if _, err := m.reserve(ipK, m.guard.IPFreeAttempts, m.guard.IPLockout, now); err != nil {
+		// The attempt never happens, so it does not count for the email
+		m.release(emailK)
+		return 0, false, err
+	}
+	return f.Failures, true, nil
+}
+
+// reserve counts an attempt against key unless the key has to wait
+func (m *Manager) reserve(key string, free, lockout int, now time.Time) (*storage.LoginFailure, error) {
+	for i := 0; i < maxReserveRetries; i++ {
+		prev, err := m.store.GetLoginFailure(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load login failures: %w", err)
+		}
+		if prev != nil {
+			wait, locked := m.guard.wait(prev.Failures, free, lockout)
+			if remaining := prev.LastFailureAt.Add(wait).Sub(now); remaining > 0 {
+				return nil, &LoginThrottledError{RetryAfter: remaining, Locked: locked}
+			}
+		}
+
+		f, ok, err := m.store.ReserveLoginAttempt(key, prev, now, m.guard.Window)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record login attempt: %w", err)
+		}
+		if ok {
+			return f, nil
+		}
+	}
+	// Under heavy contention for one key, make the caller back off
+	return nil, &LoginThrottledError{RetryAfter: m.guard.BaseDelay}
+}
+
+func (m *Manager) release(key string) {
+	if err := m.store.ReleaseLoginAttempt(key); err != nil {
+		logrus.Warnf("Failed to release login attempt: %v", err)
+	}
+}
+
+// LoginFailed keeps the attempt counted as a failure. user is the account the
+// email belongs to, or nil if there is none; suspicious activity on an
+// existing account is written to its activity log.
+func (m *Manager) LoginFailed(a *LoginAttempt, user *storage.User) {
+	if m.store == nil {
+		return
+	}
+
+	if user != nil {
+		switch {
+		case m.guard.EmailLockout > 0 && a.emailFailures == m.guard.EmailLockout:
+			m.logActivity(user.ID, ActivityStatusBlocked, a.ip, a.userAgent,
+				fmt.Sprintf("Sign-in locked for %d minutes after %d failed attempts", int(m.guard.LockoutDuration.Minutes()), a.emailFailures))
+		case m.guard.EmailFreeAttempts > 0 && a.emailFailures == m.guard.EmailFreeAttempts+1:
+			m.logActivity(user.ID, ActivityStatusWarning, a.ip, a.userAgent,
+				fmt.Sprintf("%d failed sign-in attempts, further attempts are being slowed down", a.emailFailures))
+		}
+	}
+
+	if a.ipReserved && m.guard.IPLockout > 0 {
+		if f, err := m.store.GetLoginFailure(ipKey(a.ip)); err == nil && f != nil && f.Failures == m.guard.IPLockout {
+			logrus.WithField("ip", a.ip).Warnf("Sign-ins from IP locked for %s after %d failed attempts", m.guard.LockoutDuration, f.Failures)
+		}
+	}
+}
+
+// SecondFactorPending ends an attempt whose password was correct but whose
+// second factor is still outstanding. The attempt keeps counting against the
+// email address until the second factor is verified, so knowing the password
+// does not buy unlimited challenges.
+func (m *Manager) SecondFactorPending(a *LoginAttempt) {
+	if m.store == nil {
+		return
+	}
+	if a.ipReserved {
+		m.release(ipKey(a.ip))
+	}
+}
+
+// LoginSucceeded ends an attempt that passed every factor. It resets the
+// email counter and flags the sign-in if it followed a run of failures. Only
+// this attempt is taken off the IP counter so an attacker can not reset it by
+// signing in to their own account.
+func (m *Manager) LoginSucceeded(a *LoginAttempt, user *storage.User) {
+	if m.store == nil {
+		return
+	}
+
+	if err := m.store.ClearLoginFailures(emailKey(a.email)); err != nil {
+		logrus.Warnf("Failed to clear login failures: %v", err)
+	}
+	if a.ipReserved {
+		m.release(ipKey(a.ip))
+	}
+
+	if failed := a.emailFailures - 1; failed > m.guard.EmailFreeAttempts {
+		m.logActivity(user.ID, ActivityStatusWarning, a.ip, a.userAgent,
+			fmt.Sprintf("Signed in after %d failed attempts", failed))
+	}
+}
+
+// AbandonLogin takes back an attempt that was not decided by a credential,
+// e.g. because the request failed for another reason
+func (m *Manager) AbandonLogin(a *LoginAttempt) {
+	if m.store == nil {
+		return
+	}
+	m.release(emailKey(a.email))
+	if a.ipReserved {
+		m.release(ipKey(a.ip))
+	}
+}
+
+// ClearLoginFailures resets the email counter, e.g. after the user proved
+// control of the mailbox with a password reset
+func (m *Manager) ClearLoginFailures(email string) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.ClearLoginFailures(emailKey(email)); err != nil {
+		logrus.Warnf("Failed to clear login failures: %v", err)
+	}
+}
+
+func (m *Manager) logActivity(userID, status, ip, userAgent, details string) {
+	err := m.store.AddActivity(&storage.Activity{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Type:      ActivitySecurity,
+		Status:    status,
+		Details:   details,
+		IPAddress: ip,
+		UserAgent: userAgent,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		logrus.Warnf("Failed to write activity log: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+)
+
+func TestLoginGuardWait(t *testing.T) {
+	cfg := DefaultLoginGuardConfig()
+	cases := []struct {
+		failures int
+		want     time.Duration
+		locked   bool
+	}{
+		{3, 0, false},
+		{4, time.Second, false},
+		{5, 2 * time.Second, false},
+		{6, 4 * time.Second, false},
+		{9, 32 * time.Second, false},
+		{10, 15 * time.Minute, true},
+	}
+	for _, tc := range cases {
+		got, locked := cfg.wait(tc.failures, cfg.EmailFreeAttempts, cfg.EmailLockout)
+		if got != tc.want || locked != tc.locked {
+			t.Errorf("wait(%d) = %v, %v; want %v, %v", tc.failures, got, locked, tc.want, tc.locked)
+		}
+	}
+
+	if got, _ := cfg.wait(40, cfg.IPFreeAttempts, cfg.IPLockout); got != cfg.MaxDelay {
+		t.Errorf("Expected delay to be capped at %v, got %v", cfg.MaxDelay, got)
+	}
+}
+
+// failLogin makes a sign-in attempt that fails
+func failLogin(m *Manager, email, ip string, user *storage.User) error {
+	attempt, err := m.BeginLogin(email, ip, "test-agent")
+	if err != nil {
+		return err
+	}
+	m.LoginFailed(attempt, user)
+	return nil
+}
+
+func TestLoginGuardEmailLockout(t *testing.T) {
+	m, store, user := newTestManager(t)
+	m.guard = LoginGuardConfig{
+		EmailFreeAttempts: 2,
+		EmailLockout:      4,
+		BaseDelay:         time.Hour,
+		MaxDelay:          time.Hour,
+		LockoutDuration:   2 * time.Hour,
+		Window:            time.Hour,
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := failLogin(m, user.Email, "10.0.0.1", user); err != nil {
+			t.Fatalf("Attempt %d should be allowed, got %v", i+1, err)
+		}
+	}
+
+	var throttled *LoginThrottledError
+	// The counter is per email address, whatever the IP or letter case
+	if _, err := m.BeginLogin("AUTH@Example.com", "10.0.0.2", ""); !errors.As(err, &throttled) || throttled.Locked {
+		t.Fatalf("Expected backoff after the free attempts, got %v", err)
+	}
+	if throttled.RetryAfter <= 0 || throttled.RetryAfter > time.Hour {
+		t.Errorf("Unexpected retry after %v", throttled.RetryAfter)
+	}
+
+	// Once the backoff has passed, the next failure locks the address
+	m.guard.BaseDelay, m.guard.MaxDelay = time.Nanosecond, time.Nanosecond
+	if err := failLogin(m, user.Email, "10.0.0.1", user); err != nil {
+		t.Fatalf("Expected attempt after the backoff, got %v", err)
+	}
+	if _, err := m.BeginLogin(user.Email, "10.0.0.1", ""); !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("Expected lockout, got %v", err)
+	}
+
+	activities, total, err := store.ListActivities(user.ID, 10, 0)
+	if err != nil {
+		t.Fatalf("ListActivities failed: %v", err)
+	}
+	if total != 2 || activities[0].Status != ActivityStatusBlocked || activities[1].Status != ActivityStatusWarning {
+		t.Errorf("Expected a warning and a lockout in the activity log, got %d entries", total)
+	}
+
+	m.guard.LockoutDuration = time.Nanosecond
+	attempt, err := m.BeginLogin(user.Email, "10.0.0.1", "")
+	if err != nil {
+		t.Fatalf("Expected attempt after the lockout, got %v", err)
+	}
+	m.LoginSucceeded(attempt, user)
+	if f, _ := store.GetLoginFailure(emailKey(user.Email)); f != nil {
+		t.Errorf("Expected counter to reset after a successful sign-in, got %+v", f)
+	}
+	if _, total, _ := store.ListActivities(user.ID, 10, 0); total != 3 {
+		t.Errorf("Expected the sign-in after failures to be logged, got %d entries", total)
+	}
+}
+
+func TestLoginGuardIPThrottle(t *testing.T) {
+	m, _, _ := newTestManager(t)
+	m.guard = LoginGuardConfig{
+		IPFreeAttempts:  2,
+		BaseDelay:       time.Hour,
+		MaxDelay:        time.Hour,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	}
+
+	// Credential stuffing: one IP, a different email each time
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if err := failLogin(m, email, "10.0.0.9", nil); err != nil {
+			t.Fatalf("Free attempts should not be throttled, got %v", err)
+		}
+	}
+
+	var throttled *LoginThrottledError
+	if _, err := m.BeginLogin("d@example.com", "10.0.0.9", ""); !errors.As(err, &throttled) {
+		t.Errorf("Expected IP to be throttled, got %v", err)
+	}
+	if _, err := m.BeginLogin("d@example.com", "10.0.0.10", ""); err != nil {
+		t.Errorf("Expected other IPs to be unaffected, got %v", err)
+	}
+}
+
+func TestLoginGuardConcurrentAttempts(t *testing.T) {
+	m, _, user := newTestManager(t)
+	m.guard = LoginGuardConfig{
+		EmailFreeAttempts: 2,
+		BaseDelay:         time.Hour,
+		MaxDelay:          time.Hour,
+		LockoutDuration:   time.Hour,
+		Window:            time.Hour,
+	}
+
+	// Parallel guesses must not all pass the check before any is counted
+	const n = 20
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			results <- failLogin(m, user.Email, "", user)
+		}()
+	}
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if <-results == nil {
+			allowed++
+		}
+	}
+	if allowed == 0 || allowed > 3 {
+		t.Errorf("Expected at most 3 attempts to get through, got %d", allowed)
+	}
+}
+
+func TestLoginGuardCountsSecondFactor(t *testing.T) {
+	m, _, user := newTestManager(t)
+	enrollment, _ := m.BeginTOTPEnrollment(user)
+	codes, err := m.EnableTOTP(user.ID, currentCode(t, enrollment.Secret))
+	if err != nil {
+		t.Fatalf("EnableTOTP failed: %v", err)
+	}
+	m.guard = LoginGuardConfig{
+		EmailFreeAttempts: 2,
+		BaseDelay:         time.Hour,
+		MaxDelay:          time.Hour,
+		LockoutDuration:   time.Hour,
+		Window:            time.Hour,
+	}
+
+	// The password step counts until the second factor is verified
+	attempt, err := m.BeginLogin(user.Email, "10.0.0.1", "")
+	if err != nil {
+		t.Fatalf("BeginLogin failed: %v", err)
+	}
+	m.SecondFactorPending(attempt)
+	challenge, _ := m.IssueChallenge(user)
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.CompleteChallenge(challenge, "nope", "10.0.0.1", ""); err != ErrInvalidTwoFactorCode {
+			t.Fatalf("Expected ErrInvalidTwoFactorCode, got %v", err)
+		}
+	}
+
+	// Guessing codes is throttled like guessing passwords, even for a valid code
+	var throttled *LoginThrottledError
+	if _, err := m.CompleteChallenge(challenge, codes[0], "10.0.0.1", ""); !errors.As(err, &throttled) {
+		t.Errorf("Expected wrong codes to throttle the account, got %v", err)
+	}
+}
+
+func TestMailRequestThrottle(t *testing.T) {
+	m, _, user := newTestManager(t)
+	m.guard = LoginGuardConfig{
+		EmailFreeAttempts: 2,
+		BaseDelay:         time.Hour,
+		MaxDelay:          time.Hour,
+		LockoutDuration:   time.Hour,
+		Window:            time.Hour,
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := m.CheckMailRequest(user.Email, "10.0.0.1"); err != nil {
+			t.Fatalf("Request %d should be allowed, got %v", i+1, err)
+		}
+	}
+	var throttled *LoginThrottledError
+	if err := m.CheckMailRequest(user.Email, "10.0.0.2"); !errors.As(err, &throttled) {
+		t.Errorf("Expected mail requests to be throttled, got %v", err)
+	}
+
+	// Requesting mail does not lock the owner out of signing in
+	if _, err := m.BeginLogin(user.Email, "10.0.0.1", ""); err != nil {
+		t.Errorf("Expected sign-in to be unaffected, got %v", err)
+	}
+}
@@ -0,0 +1,469 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	// revocationCheckTTL is how long a session the store reported as not
+	// revoked is trusted before the store is asked again
+	revocationCheckTTL = 5 * time.Second
+	// maxRevocationChecks bounds the cache of such answers
+	maxRevocationChecks = 10000
+)
+
+var (
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrSessionRevoked      = errors.New("session revoked")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrStoreUnavailable    = errors.New("auth storage unavailable")
+)
+
+// Store is the persistence the auth Manager needs for sessions and revocations
+type Store interface {
+	GetUserByID(id string) (*storage.User, error)
+	CreateSession(id, userID, token string, expiresAt time.Time) error
+	GetSession(token string) (*storage.Session, error)
+	GetSessionByID(id string) (*storage.Session, error)
+	ListUserSessions(userID string) ([]*storage.Session, error)
+	RotateSessionToken(id, oldToken, newToken string, expiresAt time.Time) (bool, error)
+	GetRotatedTokenSession(token string) (string, error)
+	TouchSession(id, userAgent, ipAddress string) error
+	DeleteSessionByID(id string) error
+	RevokeSession(sessionID, userID string, expiresAt time.Time) error
+	GetSessionRevocations() (map[string]time.Time, error)
+	GetSessionRevocation(sessionID string) (*time.Time, error)
+	PruneSessionRevocations(now time.Time) error
+
+	CreateAPIKey(key *storage.APIKey) error
+	GetAPIKeyByHash(hash string) (*storage.APIKey, error)
+	ListUserAPIKeys(userID string) ([]*storage.APIKey, error)
+	TouchAPIKey(id string, usedAt time.Time) error
+	DeleteAPIKey(id, userID string) error
+
+	CreateLoginChallenge(id, userID string, expiresAt time.Time) error
+	ClaimLoginChallenge(id string, maxAttempts int, now time.Time) (*storage.LoginChallenge, bool, error)
+	FinishLoginChallenge(id string, verified bool) error
+
+	GetTOTP(userID string) (*storage.TOTPSecret, error)
+	SetTOTP(userID, secretEnc string, enabled bool) error
+	EnableTOTP(userID string, step int64) error
+	MarkTOTPStepUsed(userID string, step int64) (bool, error)
+	DeleteTOTP(userID string) error
+	ReplaceRecoveryCodes(userID string, hashes []string) error
+	UseRecoveryCode(userID, hash string) (bool, error)
+	CountRecoveryCodes(userID string) (int, error)
+
+	CreateEmailToken(hash, userID, purpose string, expiresAt time.Time) error
+	ConsumeEmailToken(hash, purpose string, now time.Time) (string, error)
+	DeleteEmailTokens(userID, purpose string) error
+
+	ReserveLoginAttempt(key string, prev *storage.LoginFailure, now time.Time, window time.Duration) (*storage.LoginFailure, bool, error)
+	ReleaseLoginAttempt(key string) error
+	GetLoginFailure(key string) (*storage.LoginFailure, error)
+	ClearLoginFailures(key string) error
+	PruneLoginFailures(before time.Time) error
+	AddActivity(a *storage.Activity) error
+}
+
+// Config controls token signing and lifetimes
+type Config struct {
+	Secret          []byte
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// EncryptionKey protects stored TOTP secrets. Derived from Secret if empty.
+	EncryptionKey []byte
+	// LoginGuard sets the brute-force protection thresholds. Defaults if nil.
+	LoginGuard *LoginGuardConfig
+}
+
+// Claims are the claims carried by an access token
+type Claims struct {
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// TokenPair is returned whenever a session is created or refreshed
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // access token lifetime in seconds
+	SessionID    string `json:"-"`
+}
+
+// Manager is the single authentication layer for the API.
+// It issues short-lived access JWTs bound to a session and rotating refresh
+// tokens whose hashes are stored in the sessions table. Revoked sessions are
+// kept in a revocation list until their last access token has expired; the
+// list is shared through the store so every instance honours a sign-out.
+// It also manages the scoped API keys used for programmatic access and
+// TOTP two-factor authentication, and throttles repeated failed sign-ins.
+type Manager struct {
+	store      Store
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	apiAccess  APIAccessCheck
+	subUsers   SubUserCheck
+	encKey     [32]byte
+	guard      LoginGuardConfig
+
+	mu      sync.RWMutex
+	revoked map[string]time.Time // session ID -> when the entry can be dropped
+	checked map[string]time.Time // session ID -> when the store last reported it not revoked
+}
+
+// NewManager creates an auth manager and loads the persisted revocation list.
+// If no secret is configured a random one is generated, which invalidates
+// all tokens on restart.
+func NewManager(store Store, cfg Config) *Manager {
+	m := &Manager{
+		store:      store,
+		secret:     cfg.Secret,
+		accessTTL:  cfg.AccessTokenTTL,
+		refreshTTL: cfg.RefreshTokenTTL,
+		revoked:    make(map[string]time.Time),
+		checked:    make(map[string]time.Time),
+	}
+
+	if m.accessTTL <= 0 {
+		m.accessTTL = DefaultAccessTokenTTL
+	}
+	if m.refreshTTL <= 0 {
+		m.refreshTTL = DefaultRefreshTokenTTL
+	}
+
+	if len(m.secret) == 0 {
+		logrus.Warn("JWT_SECRET not set - using an ephemeral signing key, sessions will not survive restarts")
+		m.secret = make([]byte, 32)
+		if _, err := rand.Read(m.secret); err != nil {
+			panic(fmt.Sprintf("failed to generate JWT secret: %v", err))
+		}
+	}
+
+	if len(cfg.EncryptionKey) > 0 {
+		m.encKey = sha256.Sum256(cfg.EncryptionKey)
+	} else {
+		m.encKey = sha256.Sum256(append([]byte("totp-encryption:"), m.secret...))
+	}
+
+	m.guard = DefaultLoginGuardConfig()
+	if cfg.LoginGuard != nil {
+		m.guard = cfg.LoginGuard.withDefaults()
+	}
+
+	if m.store != nil {
+		if err := m.store.PruneSessionRevocations(time.Now()); err != nil {
+			logrus.Warnf("Failed to prune session revocations: %v", err)
+		}
+		if err := m.store.PruneLoginFailures(time.Now().Add(-m.guard.staleAfter())); err != nil {
+			logrus.Warnf("Failed to prune login failures: %v", err)
+		}
+		if revoked, err := m.store.GetSessionRevocations(); err == nil {
+			m.revoked = revoked
+		} else {
+			logrus.Warnf("Failed to load session revocations: %v", err)
+		}
+	}
+
+	return m
+}
+
+// AccessTokenTTL returns the lifetime of issued access tokens
+func (m *Manager) AccessTokenTTL() time.Duration {
+	return m.accessTTL
+}
+
+// IssueSession creates a new session for the user and returns its first token pair
+func (m *Manager) IssueSession(user *storage.User, userAgent, ipAddress string) (*TokenPair, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID := uuid.New().String()
+	if err := m.store.CreateSession(sessionID, user.ID, hashToken(refresh), time.Now().Add(m.refreshTTL)); err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	if err := m.store.TouchSession(sessionID, userAgent, ipAddress); err != nil {
+		logrus.Warnf("Failed to record session device: %v", err)
+	}
+
+	return m.tokenPair(user, sessionID, refresh)
+}
+
+// Refresh exchanges a refresh token for a new token pair. The presented
+// refresh token is rotated and can not be used again. A rotated-out token
+// that comes back means it was stolen or replayed, so the whole session is
+// revoked.
+func (m *Manager) Refresh(refreshToken, userAgent, ipAddress string) (*TokenPair, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+
+	hash := hashToken(refreshToken)
+	sess, err := m.store.GetSession(hash)
+	if err != nil || sess == nil {
+		m.detectReuse(hash)
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if sess.ExpiresAt.Before(time.Now()) {
+		m.store.DeleteSessionByID(sess.ID)
+		return nil, ErrInvalidRefreshToken
+	}
+	if m.isRevoked(sess.ID) {
+		return nil, ErrSessionRevoked
+	}
+
+	user, err := m.store.GetUserByID(sess.UserID)
+	if err != nil || user == nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := m.store.RotateSessionToken(sess.ID, hash, hashToken(refresh), time.Now().Add(m.refreshTTL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate session: %w", err)
+	}
+	if !rotated {
+		// A concurrent refresh already used this token
+		m.detectReuse(hash)
+		return nil, ErrInvalidRefreshToken
+	}
+	if err := m.store.TouchSession(sess.ID, userAgent, ipAddress); err != nil {
+		logrus.Warnf("Failed to record session device: %v", err)
+	}
+
+	return m.tokenPair(user, sess.ID, refresh)
+}
+
+// ValidateAccessToken verifies an access token and checks its session has not been revoked
+func (m *Manager) ValidateAccessToken(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return m.secret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || claims.UserID == "" || claims.SessionID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if m.isRevoked(claims.SessionID) {
+		return nil, ErrSessionRevoked
+	}
+
+	return claims, nil
+}
+
+// ListSessions returns the active sessions of a user
+func (m *Manager) ListSessions(userID string) ([]*storage.Session, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+
+	sessions, err := m.store.ListUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	active := sessions[:0]
+	for _, sess := range sessions {
+		if sess.ExpiresAt.After(time.Now()) && !m.isRevoked(sess.ID) {
+			active = append(active, sess)
+		}
+	}
+	return active, nil
+}
+
+// RevokeSession signs a single device out. Its refresh token is deleted and
+// any access tokens already issued for it are rejected from now on.
+func (m *Manager) RevokeSession(userID, sessionID string) error {
+	if m.store == nil {
+		return ErrStoreUnavailable
+	}
+
+	sess, err := m.store.GetSessionByID(sessionID)
+	if err != nil || sess == nil || sess.UserID != userID {
+		return ErrSessionNotFound
+	}
+
+	return m.revoke(userID, sessionID)
+}
+
+// RevokeAllSessions signs out every device of a user except keepSessionID,
+// which may be empty. It returns the number of sessions revoked.
+func (m *Manager) RevokeAllSessions(userID, keepSessionID string) (int, error) {
+	if m.store == nil {
+		return 0, ErrStoreUnavailable
+	}
+
+	sessions, err := m.store.ListUserSessions(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, sess := range sessions {
+		if sess.ID == keepSessionID {
+			continue
+		}
+		if err := m.revoke(userID, sess.ID); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (m *Manager) revoke(userID, sessionID string) error {
+	until := time.Now().Add(m.accessTTL)
+	if err := m.store.RevokeSession(sessionID, userID, until); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if err := m.store.DeleteSessionByID(sessionID); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	m.mu.Lock()
+	m.revoked[sessionID] = until
+	delete(m.checked, sessionID)
+	m.mu.Unlock()
+	return nil
+}
+
+// detectReuse revokes the session a rotated-out refresh token belonged to
+func (m *Manager) detectReuse(hash string) {
+	sessionID, err := m.store.GetRotatedTokenSession(hash)
+	if err != nil || sessionID == "" {
+		return
+	}
+	sess, err := m.store.GetSessionByID(sessionID)
+	if err != nil || sess == nil {
+		return
+	}
+
+	logrus.WithField("session", sessionID).Warn("Refresh token reused, revoking session")
+	if err := m.revoke(sess.UserID, sessionID); err != nil {
+		logrus.Warnf("Failed to revoke session after refresh token reuse: %v", err)
+	}
+}
+
+// isRevoked reports whether a session was signed out. Revocations made by
+// other instances are picked up from the store within revocationCheckTTL.
+func (m *Manager) isRevoked(sessionID string) bool {
+	now := time.Now()
+	m.mu.RLock()
+	until, ok := m.revoked[sessionID]
+	checkedAt, checked := m.checked[sessionID]
+	m.mu.RUnlock()
+
+	if ok {
+		if now.Before(until) {
+			return true
+		}
+		m.mu.Lock()
+		delete(m.revoked, sessionID)
+		m.mu.Unlock()
+		return false
+	}
+	if m.store == nil || (checked && now.Sub(checkedAt) < revocationCheckTTL) {
+		return false
+	}
+
+	revokedUntil, err := m.store.GetSessionRevocation(sessionID)
+	if err != nil {
+		// Fail closed; access tokens are short-lived and the client can refresh
+		logrus.Warnf("Failed to check session revocation: %v", err)
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if revokedUntil != nil && now.Before(*revokedUntil) {
+		m.revoked[sessionID] = *revokedUntil
+		delete(m.checked, sessionID)
+		return true
+	}
+	if len(m.checked) >= maxRevocationChecks {
+		for id, at := range m.checked {
+			if now.Sub(at) >= revocationCheckTTL {
+				delete(m.checked, id)
+			}
+		}
+	}
+	m.checked[sessionID] = now
+	return false
+}
+
+func (m *Manager) tokenPair(user *storage.User, sessionID, refresh string) (*TokenPair, error) {
+	now := time.Now()
+	claims := Claims{
+		UserID:    user.ID,
+		Email:     user.Email,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   user.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.accessTTL)),
+		},
+	}
+
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign access token: %w", err)
+	}
+
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(m.accessTTL.Seconds()),
+		SessionID:    sessionID,
+	}, nil
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the form in which refresh tokens and API keys are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
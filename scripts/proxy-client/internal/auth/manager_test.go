@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/google/uuid"
+)
+
+func newTestManager(t *testing.T) (*Manager, *storage.Store, *storage.User) {
+	t.Helper()
+
+	store, err := storage.NewStoreWithPath(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	user := &storage.User{ID: uuid.New().String(), Email: "auth@example.com"}
+	if err := store.CreateUser(user.ID, user.Email, "hash"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	m := NewManager(store, Config{Secret: []byte("test-secret")})
+	return m, store, user
+}
+
+func TestIssueAndValidate(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	tokens, err := m.IssueSession(user, "test-agent", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("IssueSession failed: %v", err)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatal("Expected access and refresh tokens")
+	}
+
+	claims, err := m.ValidateAccessToken(tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateAccessToken failed: %v", err)
+	}
+	if claims.UserID != user.ID || claims.SessionID != tokens.SessionID {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	// A token signed with another key must be rejected
+	other := NewManager(nil, Config{Secret: []byte("other-secret")})
+	if _, err := other.ValidateAccessToken(tokens.AccessToken); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken for foreign signature, got %v", err)
+	}
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	m, store, user := newTestManager(t)
+	m = NewManager(store, Config{Secret: []byte("test-secret"), AccessTokenTTL: time.Second})
+
+	tokens, err := m.IssueSession(user, "", "")
+	if err != nil {
+		t.Fatalf("IssueSession failed: %v", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := m.ValidateAccessToken(tokens.AccessToken); err != ErrInvalidToken {
+		t.Errorf("Expected expired token to be rejected, got %v", err)
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	first, err := m.IssueSession(user, "", "")
+	if err != nil {
+		t.Fatalf("IssueSession failed: %v", err)
+	}
+
+	second, err := m.Refresh(first.RefreshToken, "", "")
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("Expected refresh token to rotate")
+	}
+	if second.SessionID != first.SessionID {
+		t.Error("Expected refresh to keep the same session")
+	}
+
+	// The rotated-out token can not be replayed, and replaying it revokes
+	// the session
+	if _, err := m.Refresh(first.RefreshToken, "", ""); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected ErrInvalidRefreshToken on reuse, got %v", err)
+	}
+	if _, err := m.ValidateAccessToken(second.AccessToken); err != ErrSessionRevoked {
+		t.Errorf("Expected session to be revoked after reuse, got %v", err)
+	}
+	if _, err := m.Refresh(second.RefreshToken, "", ""); err == nil {
+		t.Error("Expected refresh of a revoked session to fail")
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	tokens, err := m.IssueSession(user, "", "")
+	if err != nil {
+		t.Fatalf("IssueSession failed: %v", err)
+	}
+
+	const n = 8
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := m.Refresh(tokens.RefreshToken, "", "")
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < n; i++ {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+	if succeeded > 1 {
+		t.Errorf("Expected at most one refresh to succeed, got %d", succeeded)
+	}
+}
+
+func TestRevocationSeenByOtherInstance(t *testing.T) {
+	m, store, user := newTestManager(t)
+	other := NewManager(store, Config{Secret: []byte("test-secret")})
+
+	tokens, err := m.IssueSession(user, "", "")
+	if err != nil {
+		t.Fatalf("IssueSession failed: %v", err)
+	}
+	if _, err := other.ValidateAccessToken(tokens.AccessToken); err != nil {
+		t.Fatalf("Expected token to be valid on the other instance, got %v", err)
+	}
+
+	if err := m.RevokeSession(user.ID, tokens.SessionID); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+
+	// The other instance asks the store again once its cached answer lapses
+	other.mu.Lock()
+	other.checked[tokens.SessionID] = time.Now().Add(-revocationCheckTTL)
+	other.mu.Unlock()
+	if _, err := other.ValidateAccessToken(tokens.AccessToken); err != ErrSessionRevoked {
+		t.Errorf("Expected ErrSessionRevoked on the other instance, got %v", err)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	m, store, user := newTestManager(t)
+
+	tokens, err := m.IssueSession(user, "", "")
+	if err != nil {
+		t.Fatalf("IssueSession failed: %v", err)
+	}
+
+	if err := m.RevokeSession("someone-else", tokens.SessionID); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound for another user's session, got %v", err)
+	}
+
+	if err := m.RevokeSession(user.ID, tokens.SessionID); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+
+	if _, err := m.ValidateAccessToken(tokens.AccessToken); err != ErrSessionRevoked {
+		t.Errorf("Expected ErrSessionRevoked, got %v", err)
+	}
+	if _, err := m.Refresh(tokens.RefreshToken, "", ""); err == nil {
+		t.Error("Expected refresh of revoked session to fail")
+	}
+
+	// The revocation list survives a restart
+	restarted := NewManager(store, Config{Secret: []byte("test-secret")})
+	if _, err := restarted.ValidateAccessToken(tokens.AccessToken); err != ErrSessionRevoked {
+		t.Errorf("Expected ErrSessionRevoked after restart, got %v", err)
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	m, _, user := newTestManager(t)
+
+	keep, _ := m.IssueSession(user, "laptop", "")
+	m.IssueSession(user, "phone", "")
+	m.IssueSession(user, "tablet", "")
+
+	sessions, err := m.ListSessions(user.ID)
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %d", len(sessions))
+	}
+
+	count, err := m.RevokeAllSessions(user.ID, keep.SessionID)
+	if err != nil {
+		t.Fatalf("RevokeAllSessions failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 sessions revoked, got %d", count)
+	}
+
+	sessions, _ = m.ListSessions(user.ID)
+	if len(sessions) != 1 || sessions[0].ID != keep.SessionID {
+		t.Errorf("Expected only the kept session to remain, got %d", len(sessions))
+	}
+	if _, err := m.ValidateAccessToken(keep.AccessToken); err != nil {
+		t.Errorf("Kept session should stay valid, got %v", err)
+	}
+}
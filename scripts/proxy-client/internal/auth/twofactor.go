@@ -0,0 +1,371 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// TOTPIssuer is the account issuer shown in authenticator apps
+	TOTPIssuer = "AtlanticProxy"
+
+	// ChallengeTTL is how long a login challenge waits for the second factor
+	ChallengeTTL = 5 * time.Minute
+
+	challengeAudience     = "2fa-challenge"
+	maxChallengeAttempts  = 5
+	recoveryCodeCount     = 10
+	recoveryCodeHalfBytes = 5
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrNoPendingEnrollment  = errors.New("no pending two-factor enrollment")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrInvalidChallenge     = errors.New("invalid or expired challenge")
+	ErrTooManyAttempts      = errors.New("too many attempts")
+)
+
+// TOTPEnrollment is returned when a user starts enrolling an authenticator
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type challengeClaims struct {
+	UserID string `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+// TwoFactorStatus reports whether 2FA is enabled for a user and how many
+// recovery codes are left
+func (m *Manager) TwoFactorStatus(userID string) (bool, int, error) {
+	if m.store == nil {
+		return false, 0, ErrStoreUnavailable
+	}
+
+	t, err := m.store.GetTOTP(userID)
+	if err != nil {
+		return false, 0, err
+	}
+	if t == nil || !t.Enabled {
+		return false, 0, nil
+	}
+
+	remaining, err := m.store.CountRecoveryCodes(userID)
+	if err != nil {
+		return true, 0, err
+	}
+	return true, remaining, nil
+}
+
+// BeginTOTPEnrollment generates a new secret for the user. It stays pending
+// until confirmed with EnableTOTP.
+func (m *Manager) BeginTOTPEnrollment(user *storage.User) (*TOTPEnrollment, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+
+	if t, err := m.store.GetTOTP(user.ID); err != nil {
+		return nil, err
+	} else if t != nil && t.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	enc, err := m.encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.SetTOTP(user.ID, enc, false); err != nil {
+		return nil, fmt.Errorf("failed to store totp secret: %w", err)
+	}
+
+	return &TOTPEnrollment{
+		Secret:     secret,
+		OTPAuthURI: totpURI(TOTPIssuer, user.Email, secret),
+	}, nil
+}
+
+// EnableTOTP confirms a pending enrollment with a code from the authenticator
+// and returns the user's recovery codes, which are only shown once.
+func (m *Manager) EnableTOTP(userID, code string) ([]string, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+
+	t, err := m.store.GetTOTP(userID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, ErrNoPendingEnrollment
+	}
+	if t.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	secret, err := m.decrypt(t.SecretEnc)
+	if err != nil {
+		return nil, err
+	}
+	step := matchTOTP(secret, code, time.Now())
+	if step < 0 {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes, err := m.replaceRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.EnableTOTP(userID, step); err != nil {
+		return nil, fmt.Errorf("failed to enable totp: %w", err)
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor checks a TOTP code or, failing that, consumes a recovery code
+func (m *Manager) VerifySecondFactor(userID, code string) error {
+	if m.store == nil {
+		return ErrStoreUnavailable
+	}
+
+	t, err := m.store.GetTOTP(userID)
+	if err != nil {
+		return err
+	}
+	if t == nil || !t.Enabled {
+		return ErrTwoFactorNotEnabled
+	}
+
+	secret, err := m.decrypt(t.SecretEnc)
+	if err != nil {
+		return err
+	}
+	if step := matchTOTP(secret, code, time.Now()); step >= 0 {
+		fresh, err := m.store.MarkTOTPStepUsed(userID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+
+	ok, err := m.store.UseRecoveryCode(userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// DisableTOTP removes the user's enrollment and recovery codes. Callers must
+// re-authenticate the user first.
+func (m *Manager) DisableTOTP(userID string) error {
+	if m.store == nil {
+		return ErrStoreUnavailable
+	}
+	return m.store.DeleteTOTP(userID)
+}
+
+// ResetTOTP replaces an enrolled authenticator with a new pending enrollment.
+// Callers must re-authenticate the user first.
+func (m *Manager) ResetTOTP(user *storage.User) (*TOTPEnrollment, error) {
+	if err := m.DisableTOTP(user.ID); err != nil {
+		return nil, err
+	}
+	return m.BeginTOTPEnrollment(user)
+}
+
+// RegenerateRecoveryCodes invalidates the user's recovery codes and returns a
+// new set. Callers must re-authenticate the user first.
+func (m *Manager) RegenerateRecoveryCodes(userID string) ([]string, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	if enabled, _, err := m.TwoFactorStatus(userID); err != nil {
+		return nil, err
+	} else if !enabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	return m.replaceRecoveryCodes(userID)
+}
+
+// IssueChallenge returns a short-lived token that stands for a login whose
+// password was verified but whose second factor is still outstanding.
+// It can not be used as an access token. The challenge's attempts are kept
+// in the store so any instance can complete it.
+func (m *Manager) IssueChallenge(user *storage.User) (string, error) {
+	if m.store == nil {
+		return "", ErrStoreUnavailable
+	}
+
+	now := time.Now()
+	claims := challengeClaims{
+		UserID: user.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   user.ID,
+			Audience:  jwt.ClaimStrings{challengeAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ChallengeTTL)),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign challenge: %w", err)
+	}
+
+	if err := m.store.CreateLoginChallenge(claims.ID, user.ID, now.Add(ChallengeTTL)); err != nil {
+		return "", fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return token, nil
+}
+
+// CompleteChallenge verifies the second factor for a login challenge and
+// returns the user. A challenge can be completed once and allows a limited
+// number of wrong codes. The challenge is claimed before the code is checked,
+// so concurrent attempts can not complete it twice. Wrong codes count as
+// failed sign-ins for the user's email address and the client IP.
+func (m *Manager) CompleteChallenge(challenge, code, ip, userAgent string) (*storage.User, error) {
+	if m.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+
+	token, err := jwt.ParseWithClaims(challenge, &challengeClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return m.secret, nil
+	}, jwt.WithAudience(challengeAudience))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidChallenge
+	}
+	claims, ok := token.Claims.(*challengeClaims)
+	if !ok || claims.UserID == "" {
+		return nil, ErrInvalidChallenge
+	}
+
+	user, err := m.store.GetUserByID(claims.UserID)
+	if err != nil || user == nil {
+		return nil, ErrInvalidChallenge
+	}
+
+	// Codes are guessed against the same counters as passwords
+	attempt, err := m.BeginLogin(user.Email, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, claimed, err := m.store.ClaimLoginChallenge(claims.ID, maxChallengeAttempts, time.Now())
+	if err != nil {
+		m.AbandonLogin(attempt)
+		return nil, fmt.Errorf("failed to claim challenge: %w", err)
+	}
+	if ch == nil || ch.UserID != claims.UserID {
+		m.AbandonLogin(attempt)
+		return nil, ErrInvalidChallenge
+	}
+	if !claimed {
+		m.AbandonLogin(attempt)
+		if ch.State == storage.ChallengePending && ch.Attempts >= maxChallengeAttempts {
+			return nil, ErrTooManyAttempts
+		}
+		return nil, ErrInvalidChallenge
+	}
+
+	verifyErr := m.VerifySecondFactor(claims.UserID, code)
+	if err := m.store.FinishLoginChallenge(claims.ID, verifyErr == nil); err != nil {
+		m.AbandonLogin(attempt)
+		return nil, fmt.Errorf("failed to update challenge: %w", err)
+	}
+	if verifyErr != nil {
+		m.LoginFailed(attempt, user)
+		return nil, verifyErr
+	}
+
+	m.LoginSucceeded(attempt, user)
+	return user, nil
+}
+
+func (m *Manager) replaceRecoveryCodes(userID string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 2*recoveryCodeHalfBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		first := strings.ToLower(totpEncoding.EncodeToString(b[:recoveryCodeHalfBytes]))
+		second := strings.ToLower(totpEncoding.EncodeToString(b[recoveryCodeHalfBytes:]))
+		codes[i] = first + "-" + second
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	if err := m.store.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// encrypt seals a TOTP secret with AES-GCM for storage
+func (m *Manager) encrypt(plaintext string) (string, error) {
+	gcm, err := m.cipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (m *Manager) decrypt(encoded string) (string, error) {
+	gcm, err := m.cipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+func (m *Manager) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(m.encKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
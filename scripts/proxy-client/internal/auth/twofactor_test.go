@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B (SHA1), truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		got, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("totpCode failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("At %d expected %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := totpCode(secret, totpStep(time.Now()))
+	if err != nil {
+		t.Fatalf("totpCode failed: %v", err)
+	}
+	return code
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	m, store, user := newTestManager(t)
+
+	enrollment, err := m.BeginTOTPEnrollment(user)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment failed: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.OTPAuthURI, "otpauth://totp/") || !strings.Contains(enrollment.OTPAuthURI, enrollment.Secret) {
+		t.Errorf("Unexpected otpauth URI: %s", enrollment.OTPAuthURI)
+	}
+
+	stored, _ := store.GetTOTP(user.ID)
+	if stored == nil || strings.Contains(stored.SecretEnc, enrollment.Secret) {
+		t.Fatal("Expected the secret to be stored encrypted")
+	}
+
+	if enabled, _, _ := m.TwoFactorStatus(user.ID); enabled {
+		t.Error("2FA must stay disabled until confirmed")
+	}
+	if _, err := m.EnableTOTP(user.ID, "12345"); err != ErrInvalidTwoFactorCode {
+		t.Errorf("Expected ErrInvalidTwoFactorCode, got %v", err)
+	}
+
+	codes, err := m.EnableTOTP(user.ID, currentCode(t, enrollment.Secret))
+	if err != nil {
+		t.Fatalf("EnableTOTP failed: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("Expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	enabled, remaining, _ := m.TwoFactorStatus(user.ID)
+	if !enabled || remaining != recoveryCodeCount {
+		t.Errorf("Expected 2FA enabled with all codes left, got %v/%d", enabled, remaining)
+	}
+
+	// The code used for enrollment can not be replayed
+	if err := m.VerifySecondFactor(user.ID, currentCode(t, enrollment.Secret)); err != ErrInvalidTwoFactorCode {
+		t.Errorf("Expected replayed code to be rejected, got %v", err)
+	}
+
+	// Recovery codes work once, in any formatting
+	if err := m.VerifySecondFactor(user.ID, strings.ToUpper(codes[0])); err != nil {
+		t.Errorf("Expected recovery code to be accepted, got %v", err)
+	}
+	if err := m.VerifySecondFactor(user.ID, codes[0]); err != ErrInvalidTwoFactorCode {
+		t.Errorf("Expected used recovery code to be rejected, got %v", err)
+	}
+
+	if _, err := m.BeginTOTPEnrollment(user); err != ErrTwoFactorEnabled {
+		t.Errorf("Expected ErrTwoFactorEnabled, got %v", err)
+	}
+
+	if err := m.DisableTOTP(user.ID); err != nil {
+		t.Fatalf("DisableTOTP failed: %v", err)
+	}
+	if enabled, _, _ := m.TwoFactorStatus(user.ID); enabled {
+		t.Error("Expected 2FA to be disabled")
+	}
+}
+
+func TestLoginChallenge(t *testing.T) {
+	m, _, user := newTestManager(t)
+	// Only the per-challenge limit is under test here
+	m.guard = LoginGuardConfig{}
+
+	enrollment, _ := m.BeginTOTPEnrollment(user)
+	codes, err := m.EnableTOTP(user.ID, currentCode(t, enrollment.Secret))
+	if err != nil {
+		t.Fatalf("EnableTOTP failed: %v", err)
+	}
+
+	challenge, err := m.IssueChallenge(user)
+	if err != nil {
+		t.Fatalf("IssueChallenge failed: %v", err)
+	}
+
+	// A challenge is not an access token
+	if _, err := m.ValidateAccessToken(challenge); err != ErrInvalidToken {
+		t.Errorf("Expected challenge to be rejected as access token, got %v", err)
+	}
+
+	if _, err := m.CompleteChallenge(challenge, "nope", "", ""); err != ErrInvalidTwoFactorCode {
+		t.Errorf("Expected ErrInvalidTwoFactorCode, got %v", err)
+	}
+
+	got, err := m.CompleteChallenge(challenge, codes[1], "", "")
+	if err != nil {
+		t.Fatalf("CompleteChallenge failed: %v", err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("Expected user %s, got %s", user.ID, got.ID)
+	}
+
+	if _, err := m.CompleteChallenge(challenge, codes[2], "", ""); err != ErrInvalidChallenge {
+		t.Errorf("Expected completed challenge to be single-use, got %v", err)
+	}
+
+	// Wrong codes are limited per challenge
+	challenge, _ = m.IssueChallenge(user)
+	for i := 0; i < maxChallengeAttempts; i++ {
+		m.CompleteChallenge(challenge, "nope", "", "")
+	}
+	if _, err := m.CompleteChallenge(challenge, codes[3], "", ""); err != ErrTooManyAttempts {
+		t.Errorf("Expected ErrTooManyAttempts, got %v", err)
+	}
+}
+
+func TestChallengeCompletedOnceAcrossInstances(t *testing.T) {
+	m, store, user := newTestManager(t)
+	other := NewManager(store, Config{Secret: []byte("test-secret")})
+	m.guard, other.guard = LoginGuardConfig{}, LoginGuardConfig{}
+
+	enrollment, _ := m.BeginTOTPEnrollment(user)
+	codes, err := m.EnableTOTP(user.ID, currentCode(t, enrollment.Secret))
+	if err != nil {
+		t.Fatalf("EnableTOTP failed: %v", err)
+	}
+
+	challenge, err := m.IssueChallenge(user)
+	if err != nil {
+		t.Fatalf("IssueChallenge failed: %v", err)
+	}
+
+	// Several instances race to complete the same challenge with valid codes
+	const n = 6
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		mgr := m
+		if i%2 == 1 {
+			mgr = other
+		}
+		code := codes[i]
+		go func() {
+			_, err := mgr.CompleteChallenge(challenge, code, "", "")
+			results <- err
+		}()
+	}
+	completed := 0
+	for i := 0; i < n; i++ {
+		if <-results == nil {
+			completed++
+		}
+	}
+	if completed != 1 {
+		t.Errorf("Expected the challenge to be completed exactly once, got %d", completed)
+	}
+}
@@ -0,0 +1,288 @@
+package billing
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Account is the billing state of one user: their subscription and the usage
+// counted against it in the current period
+type Account struct {
+	UserID string
+	Usage  *UsageTracker
+
+	mu           sync.RWMutex
+	subscription *Subscription
+	synced       UsageStats // usage already written to the store
+	lastSeen     time.Time
+	loaded       chan struct{} // closed once load has finished
+
+	credits       int64 // cached pay-as-you-go balance in micro-USD
+	creditsLoaded bool
+
+	metered   int64 // data of the period already metered for overage
+	unmetered int64 // overage that failed to store, metered again
+	warned    int   // highest quota warning sent in the period
+}
+
+func newAccount(userID string) *Account {
+	return &Account{
+		UserID:   userID,
+		Usage:    NewUsageTracker(),
+		lastSeen: time.Now(),
+		loaded:   make(chan struct{}),
+	}
+}
+
+// isLoaded reports whether the account has finished loading
+func (a *Account) isLoaded() bool {
+	select {
+	case <-a.loaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscription returns a copy of the account's subscription
+func (a *Account) Subscription() *Subscription {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.subscription == nil {
+		return nil
+	}
+	sub := *a.subscription
+	return &sub
+}
+
+func (a *Account) touch() {
+	a.mu.Lock()
+	a.lastSeen = time.Now()
+	a.mu.Unlock()
+}
+
+// idleSince reports whether the account has had no activity since t and
+// holds no open connections
+func (a *Account) idleSince(t time.Time) bool {
+	a.mu.RLock()
+	seen := a.lastSeen
+	a.mu.RUnlock()
+	return seen.Before(t) && a.Usage.GetStats().ActiveConnections == 0
+}
+
+// plan returns the plan the account is currently entitled to. Active
+// subscriptions are renewed by the lifecycle; any other subscription only
+// runs until its end date, or until the grace period ends while past due.
+func (a *Account) plan() (Plan, error) {
+	a.mu.RLock()
+	sub := a.subscription
+	a.mu.RUnlock()
+
+	if sub == nil {
+		return Plan{}, errors.New("no active subscription")
+	}
+
+	until := sub.EndDate
+	switch sub.Status {
+	case StatusActive:
+		until = time.Time{}
+	case StatusExpired:
+		return Plan{}, errors.New("subscription expired")
+	case StatusPastDue:
+		if sub.GraceUntil != nil {
+			until = *sub.GraceUntil
+		}
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		return Plan{}, errors.New("subscription expired")
+	}
+	return GetPlanVersion(sub.PlanID, sub.PlanVersion)
+}
+
+// checkQuota checks the usage of the period against the plan's limits
+func (a *Account) checkQuota() error {
+	if err := a.checkData(); err != nil {
+		return err
+	}
+	plan, err := a.plan()
+	if err != nil {
+		return err
+	}
+
+	// Check Request Limit
+	if plan.RequestLimit != -1 {
+		if a.Usage.GetStats().RequestsMade >= plan.RequestLimit {
+			return errors.New("request limit exceeded")
+		}
+	}
+
+	return nil
+}
+
+// checkData checks the data used in the period against the plan's limit
+func (a *Account) checkData() error {
+	plan, err := a.plan()
+	if err != nil {
+		return err
+	}
+
+	// Soft and throttled quotas let traffic go on
+	if plan.DataLimitMB != -1 && a.quotaMode(plan) == QuotaHard {
+		limitBytes := plan.DataLimitMB * 1024 * 1024
+		if a.Usage.GetStats().DataTransferred >= limitBytes {
+			return errors.New("data limit exceeded")
+		}
+	}
+	return nil
+}
+
+// setSubscription replaces the subscription and persists it. A subscription
+// with a new billing anchor starts a new usage period.
+func (a *Account) setSubscription(store Store, sub *Subscription) error {
+	a.mu.Lock()
+	a.subscription = sub
+	a.mu.Unlock()
+	a.startPeriod(store, sub.StartDate, sub.EndDate)
+
+	if store == nil {
+		return nil
+	}
+	return store.SetSubscription(
+		a.UserID,
+		sub.ID,
+		string(sub.PlanID),
+		sub.PlanVersion,
+		sub.Status,
+		formatTime(sub.StartDate),
+		formatTime(sub.EndDate),
+		sub.AutoRenew,
+	)
+}
+
+// load reads the subscription and the usage of its current period from the
+// store. Users without a subscription are put on Starter.
+func (a *Account) load(store Store) {
+	defer close(a.loaded)
+
+	if store != nil {
+		if s, err := store.GetSubscription(a.UserID); err == nil && s != nil {
+			a.subscription = s.subscription()
+			a.Usage.setPeriod(a.subscription.StartDate, a.subscription.EndDate)
+		}
+
+		if a.subscription != nil {
+			start := a.subscription.StartDate
+			if data, reqs, ads, threats, err := store.GetPeriodUsage(a.UserID, start); err == nil {
+				a.Usage.mu.Lock()
+				a.Usage.currentUsage.DataTransferred = data
+				a.Usage.currentUsage.RequestsMade = reqs
+				a.Usage.currentUsage.AdsBlocked = ads
+				a.Usage.currentUsage.ThreatsBlocked = threats
+				a.synced = *a.Usage.currentUsage
+				a.metered = data
+				a.Usage.mu.Unlock()
+			}
+		}
+	}
+
+	// Auto-subscribe to Starter if no sub
+	if a.subscription == nil {
+		now := time.Now().Truncate(time.Second)
+		// Persist this auto-created sub
+		a.setSubscription(store, &Subscription{
+			ID:        uuid.New().String(),
+			PlanID:    PlanStarter,
+			Status:    StatusActive,
+			StartDate: now,
+			EndDate:   now.AddDate(0, 1, 0),
+			AutoRenew: true,
+		})
+	}
+}
+
+// sync writes the usage counted since the last sync. The store adds the
+// values to the period's totals, so only the difference is sent.
+func (a *Account) sync(store Store) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.syncLocked(store)
+}
+
+func (a *Account) syncLocked(store Store) error {
+	stats := a.Usage.GetStats()
+	data := stats.DataTransferred - a.synced.DataTransferred
+	reqs := stats.RequestsMade - a.synced.RequestsMade
+	ads := stats.AdsBlocked - a.synced.AdsBlocked
+	threats := stats.ThreatsBlocked - a.synced.ThreatsBlocked
+	if data == 0 && reqs == 0 && ads == 0 && threats == 0 {
+		return nil
+	}
+
+	if err := store.UpdateUsage(a.UserID, stats.PeriodStart, stats.PeriodEnd, data, reqs, ads, threats); err != nil {
+		return err
+	}
+	a.synced = *stats
+	return nil
+}
+
+// startPeriod persists the usage of the current period and starts counting
+// from zero for a new one. Open connections carry over. Nothing happens if
+// the period is already current.
+func (a *Account) startPeriod(store Store, start, end time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.Usage.GetStats().PeriodStart.Equal(start) {
+		return
+	}
+	if store != nil {
+		a.syncLocked(store)
+	}
+
+	a.Usage.mu.Lock()
+	a.Usage.currentUsage = &UsageStats{
+		PeriodStart:       start,
+		PeriodEnd:         end,
+		ActiveConnections: a.Usage.currentUsage.ActiveConnections,
+	}
+	a.Usage.mu.Unlock()
+	a.synced = UsageStats{}
+	a.metered, a.unmetered, a.warned = 0, 0, 0
+}
+
+// subscription converts a stored subscription
+func (p *PersistedSubscription) subscription() *Subscription {
+	sub := &Subscription{
+		ID:          p.ID,
+		PlanID:      PlanType(p.PlanID),
+		PlanVersion: p.PlanVersion,
+		Status:      p.Status,
+		StartDate:   parseTime(p.StartDate),
+		EndDate:     parseTime(p.EndDate),
+		AutoRenew:   p.AutoRenew,
+
+		Currency:      p.Currency,
+		ScheduledPlan: PlanType(p.ScheduledPlan),
+		QuotaMode:     p.QuotaMode,
+		Coupon:        p.Coupon,
+	}
+	if p.GraceUntil != "" {
+		grace := parseTime(p.GraceUntil)
+		sub.GraceUntil = &grace
+	}
+	return sub
+}
+
+// formatTime formats stored subscription times. UTC keeps the strings
+// comparable in SQL.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
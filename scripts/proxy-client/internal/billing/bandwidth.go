@@ -0,0 +1,40 @@
+package billing
+
+// Bandwidth is how fast a user's traffic may go, in kbps each way. Zero is
+// unlimited.
+type Bandwidth struct {
+	UserID         string `json:"user_id"`
+	UserKbps       int    `json:"user_kbps"`       // all of the user's traffic together
+	ConnectionKbps int    `json:"connection_kbps"` // each of the user's connections
+	Throttled      bool   `json:"throttled"`       // slowed down by a used up throttled quota
+}
+
+// Bandwidth returns the bandwidth the plan of a user, or the local user if
+// userID is empty, allows them now. Once a throttled quota is used up it
+// drops to the plan's throttled bandwidth.
+func (m *Manager) Bandwidth(userID string) Bandwidth {
+	userID = m.userOrLocal(userID)
+	b := Bandwidth{UserID: userID}
+
+	acct := m.Account(userID)
+	plan, err := acct.plan()
+	if err != nil {
+		return b
+	}
+	b.UserKbps, b.ConnectionKbps = plan.BandwidthKbps, plan.ConnectionKbps
+
+	if acct.throttled(plan) {
+		b.Throttled = true
+		b.UserKbps = slower(b.UserKbps, plan.ThrottleKbps)
+		b.ConnectionKbps = slower(b.ConnectionKbps, plan.ThrottleKbps)
+	}
+	return b
+}
+
+// slower returns the lower of two bandwidths, where zero is unlimited
+func slower(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
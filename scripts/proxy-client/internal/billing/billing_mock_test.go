@@ -2,14 +2,34 @@ package billing
 
 import (
 	"errors"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
 
-// MockStore implements Store interface for testing
+// MockStore implements Store and LifecycleStore for testing
 type MockStore struct {
-	subs  map[string]*PersistedSubscription
-	usage map[string]*mockUsage
+	subs    map[string]*PersistedSubscription
+	usage   map[string]*mockUsage // by user and period start
+	emails  map[string]string
+	entries []*CreditEntry
+	intents map[string]*CryptoIntent
+	indexes map[string]uint32
+	periods map[string]*QuotaPeriod // by subscription and period start
+
+	coupons     map[string]*Coupon
+	redemptions map[string]*CouponRedemption // by reference
+	refCodes    map[string]string            // user by referral code
+	referrals   map[string]*Referral         // by referee
+
+	orgs        map[string]*Organization
+	members     map[string]*Member     // by user
+	invitations map[string]*Invitation // by token hash
+	memberUsage map[string]int64       // by organization, user and period start
+
+	subUsers     map[string]*SubUser
+	subUserUsage map[string]*mockUsage // by sub-user and period start
 }
 
 type mockUsage struct {
@@ -18,42 +38,68 @@ type mockUsage struct {
 
 func NewMockStore() *MockStore {
 	return &MockStore{
-		subs:  make(map[string]*PersistedSubscription),
-		usage: make(map[string]*mockUsage),
+		subs:    make(map[string]*PersistedSubscription),
+		usage:   make(map[string]*mockUsage),
+		emails:  make(map[string]string),
+		intents: make(map[string]*CryptoIntent),
+		indexes: make(map[string]uint32),
+		periods: make(map[string]*QuotaPeriod),
+
+		coupons:     make(map[string]*Coupon),
+		redemptions: make(map[string]*CouponRedemption),
+		refCodes:    make(map[string]string),
+		referrals:   make(map[string]*Referral),
+
+		orgs:        make(map[string]*Organization),
+		members:     make(map[string]*Member),
+		invitations: make(map[string]*Invitation),
+		memberUsage: make(map[string]int64),
+
+		subUsers:     make(map[string]*SubUser),
+		subUserUsage: make(map[string]*mockUsage),
 	}
 }
 
 func (m *MockStore) GetSubscription(userID string) (*PersistedSubscription, error) {
 	if sub, ok := m.subs[userID]; ok {
-		return sub, nil
+		c := *sub
+		return &c, nil
 	}
 	return nil, nil
 }
 
-func (m *MockStore) SetSubscription(userID, id, planID, status, start, end string, autoRenew bool) error {
-	m.subs[userID] = &PersistedSubscription{
-		ID:        id,
-		PlanID:    planID,
-		Status:    status,
-		StartDate: start,
-		EndDate:   end,
-		AutoRenew: autoRenew,
+func (m *MockStore) SetSubscription(userID, id, planID string, planVersion int, status, start, end string, autoRenew bool) error {
+	sub, ok := m.subs[userID]
+	if !ok || sub.ID != id {
+		sub = &PersistedSubscription{ID: id, UserID: userID}
+		m.subs[userID] = sub
 	}
+	sub.PlanID = planID
+	sub.PlanVersion = planVersion
+	sub.Status = status
+	sub.StartDate = start
+	sub.EndDate = end
+	sub.AutoRenew = autoRenew
 	return nil
 }
 
-func (m *MockStore) GetLatestUsage(userID string) (int64, int64, int64, int64, error) {
-	if u, ok := m.usage[userID]; ok {
+func usageKey(userID string, periodStart time.Time) string {
+	return userID + "|" + periodStart.UTC().Format(time.RFC3339)
+}
+
+func (m *MockStore) GetPeriodUsage(userID string, periodStart time.Time) (int64, int64, int64, int64, error) {
+	if u, ok := m.usage[usageKey(userID, periodStart)]; ok {
 		return u.data, u.reqs, u.ads, u.threats, nil
 	}
 	return 0, 0, 0, 0, nil
 }
 
-func (m *MockStore) UpdateUsage(userID string, dataTransferred, requests, ads, threats int64) error {
-	if _, ok := m.usage[userID]; !ok {
-		m.usage[userID] = &mockUsage{}
+func (m *MockStore) UpdateUsage(userID string, periodStart, periodEnd time.Time, dataTransferred, requests, ads, threats int64) error {
+	key := usageKey(userID, periodStart)
+	if _, ok := m.usage[key]; !ok {
+		m.usage[key] = &mockUsage{}
 	}
-	u := m.usage[userID]
+	u := m.usage[key]
 	u.data += dataTransferred
 	u.reqs += requests
 	u.ads += ads
@@ -61,6 +107,220 @@ func (m *MockStore) UpdateUsage(userID string, dataTransferred, requests, ads, t
 	return nil
 }
 
+// totalData returns a user's data usage across all periods
+func (m *MockStore) totalData(userID string) int64 {
+	var total int64
+	for key, u := range m.usage {
+		if strings.HasPrefix(key, userID+"|") {
+			total += u.data
+		}
+	}
+	return total
+}
+
+func (m *MockStore) ListRenewableSubscriptions() ([]*PersistedSubscription, error) {
+	var subs []*PersistedSubscription
+	for _, sub := range m.subs {
+		switch sub.Status {
+		case StatusTrialing, StatusActive, StatusPastDue, StatusCanceled:
+			c := *sub
+			subs = append(subs, &c)
+		}
+	}
+	return subs, nil
+}
+
+func (m *MockStore) UpdateSubscriptionLifecycle(p *PersistedSubscription) error {
+	sub, ok := m.subs[p.UserID]
+	if !ok || sub.ID != p.ID {
+		return errors.New("not found")
+	}
+	sub.PlanID = p.PlanID
+	sub.Status = p.Status
+	sub.StartDate = p.StartDate
+	sub.EndDate = p.EndDate
+	sub.AutoRenew = p.AutoRenew
+	sub.GraceUntil = p.GraceUntil
+	sub.NextRetryAt = p.NextRetryAt
+	sub.RetryCount = p.RetryCount
+	sub.PendingRef = p.PendingRef
+	sub.ScheduledPlan = p.ScheduledPlan
+	return nil
+}
+
+func (m *MockStore) SetScheduledPlan(subscriptionID, planID string) error {
+	sub := m.byID(subscriptionID)
+	if sub == nil {
+		return errors.New("not found")
+	}
+	sub.ScheduledPlan = planID
+	return nil
+}
+
+func (m *MockStore) SetQuotaMode(subscriptionID, mode string) error {
+	sub := m.byID(subscriptionID)
+	if sub == nil {
+		return errors.New("not found")
+	}
+	sub.QuotaMode = mode
+	return nil
+}
+
+func (m *MockStore) quotaPeriod(userID, subscriptionID string, periodStart time.Time) *QuotaPeriod {
+	key := usageKey(subscriptionID, periodStart)
+	if _, ok := m.periods[key]; !ok {
+		m.periods[key] = &QuotaPeriod{SubscriptionID: subscriptionID, UserID: userID, PeriodStart: periodStart}
+	}
+	return m.periods[key]
+}
+
+func (m *MockStore) GetQuotaPeriod(subscriptionID string, periodStart time.Time) (*QuotaPeriod, error) {
+	if p, ok := m.periods[usageKey(subscriptionID, periodStart)]; ok {
+		c := *p
+		return &c, nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) AddOverage(userID, subscriptionID string, periodStart time.Time, bytes int64, amountUSD float64) error {
+	p := m.quotaPeriod(userID, subscriptionID, periodStart)
+	p.OverageBytes += bytes
+	p.OverageUSD += amountUSD
+	return nil
+}
+
+func (m *MockStore) MarkQuotaWarned(userID, subscriptionID string, periodStart time.Time, threshold int) (bool, error) {
+	p := m.quotaPeriod(userID, subscriptionID, periodStart)
+	if p.Warned >= threshold {
+		return false, nil
+	}
+	p.Warned = threshold
+	return true, nil
+}
+
+func (m *MockStore) BillOverage(subscriptionID string, periodStart time.Time, reference string, amountUSD float64) error {
+	p, ok := m.periods[usageKey(subscriptionID, periodStart)]
+	if !ok {
+		return errors.New("not found")
+	}
+	p.Reference, p.BilledUSD = reference, amountUSD
+	return nil
+}
+
+func (m *MockStore) GetOverageByReference(reference string) (*QuotaPeriod, error) {
+	for _, p := range m.periods {
+		if reference != "" && p.Reference == reference {
+			c := *p
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockStore) GetSubscriptionByPendingRenewal(reference string) (*PersistedSubscription, error) {
+	for _, sub := range m.subs {
+		if reference != "" && sub.PendingRef == reference {
+			c := *sub
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockStore) ClearPendingRenewal(id, reference string) (bool, error) {
+	sub := m.byID(id)
+	if sub == nil || sub.PendingRef != reference {
+		return false, nil
+	}
+	sub.PendingRef = ""
+	return true, nil
+}
+
+func (m *MockStore) byID(id string) *PersistedSubscription {
+	for _, sub := range m.subs {
+		if sub.ID == id {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (m *MockStore) ClaimRenewal(id string, now, until time.Time) (bool, error) {
+	sub := m.byID(id)
+	if sub == nil {
+		return false, nil
+	}
+	if sub.NextRetryAt != "" && parseTime(sub.NextRetryAt).After(now) {
+		return false, nil
+	}
+	sub.NextRetryAt = formatTime(until)
+	return true, nil
+}
+
+func (m *MockStore) MarkQuotaReset(id, periodStart string) (bool, error) {
+	sub := m.byID(id)
+	if sub == nil || (sub.LastReset != "" && sub.LastReset >= periodStart) {
+		return false, nil
+	}
+	sub.LastReset = periodStart
+	return true, nil
+}
+
+func (m *MockStore) GetUserEmail(userID string) (string, error) {
+	return m.emails[userID], nil
+}
+
+func (m *MockStore) PostCreditTransaction(tx *CreditTransaction) (bool, error) {
+	for _, e := range m.entries {
+		if e.Reference == tx.Reference {
+			return false, nil
+		}
+	}
+	for _, side := range []struct {
+		account string
+		amount  int64
+	}{{tx.Debit, -tx.Amount}, {tx.Credit, tx.Amount}} {
+		m.entries = append(m.entries, &CreditEntry{
+			TxnID:       tx.ID,
+			Account:     side.account,
+			Kind:        tx.Kind,
+			Reference:   tx.Reference,
+			Description: tx.Description,
+			Amount:      side.amount,
+			CreatedAt:   tx.CreatedAt,
+		})
+	}
+	return true, nil
+}
+
+func (m *MockStore) GetLedgerBalance(account string) (int64, error) {
+	var balance int64
+	for _, e := range m.entries {
+		if e.Account == account {
+			balance += e.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (m *MockStore) ListLedgerEntries(account string, limit, offset int) ([]*CreditEntry, int, error) {
+	var entries []*CreditEntry
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].Account == account {
+			entries = append(entries, m.entries[i])
+		}
+	}
+	total := len(entries)
+	if offset >= total {
+		return nil, total, nil
+	}
+	entries = entries[offset:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, total, nil
+}
+
 func (m *MockStore) CreateTransaction(id, userID, planID string, amount float64, currency, status, method string, createdAt time.Time) error {
 	return nil
 }
@@ -74,27 +334,25 @@ func TestBillingPlanUpgrade(t *testing.T) {
 	manager := NewManager(store)
 
 	userID := "test-user"
-	manager.activeUserID = userID // Force active user
 
 	// 1. Subscribe to Starter
-	// Manager uses activeUserID implicitly
-	_, err := manager.Subscribe(PlanStarter)
+	_, err := manager.Subscribe(userID, PlanStarter)
 	if err != nil {
 		t.Fatalf("Failed to subscribe: %v", err)
 	}
 
-	sub := manager.GetSubscription()
+	sub := manager.GetSubscription(userID)
 	if sub.PlanID != PlanStarter {
 		t.Errorf("Expected plan %s, got %s", PlanStarter, sub.PlanID)
 	}
 
 	// 2. Upgrade to Team
-	_, err = manager.Subscribe(PlanTeam)
+	_, err = manager.Subscribe(userID, PlanTeam)
 	if err != nil {
 		t.Fatalf("Failed to upgrade: %v", err)
 	}
 
-	sub = manager.GetSubscription()
+	sub = manager.GetSubscription(userID)
 	if sub.PlanID != PlanTeam {
 		t.Errorf("Expected plan %s, got %s", PlanTeam, sub.PlanID)
 	}
@@ -104,26 +362,23 @@ func TestQuotaEnforcementMock(t *testing.T) {
 	store := NewMockStore()
 	manager := NewManager(store)
 	userID := "quota-user"
-	manager.activeUserID = userID
 
 	// Subscribe to Free tier (Starter)
-	manager.Subscribe(PlanStarter)
+	manager.Subscribe(userID, PlanStarter)
 
 	// Simulate Usage
 	// 1GB = 1024*1024*1024 bytes
 	usage := int64(1024 * 1024 * 1024)
 
 	// Check quota before update
-	if err := manager.CheckQuota(); err != nil {
+	if err := manager.CheckQuota(userID); err != nil {
 		t.Errorf("Expected quota check to pass initially, got error: %v", err)
 	}
 
-	// Track usage manually via UsageTracker since manager wrapper doesn't exist
-	manager.Usage.AddData(usage)
-	manager.Usage.AddRequest()
+	manager.RecordData(userID, usage)
 
 	// Retrieve usage
-	stats := manager.Usage.GetStats()
+	stats := manager.GetUsage(userID)
 	if stats.DataTransferred < usage {
 		t.Errorf("Expected usage >= %d, got %d", usage, stats.DataTransferred)
 	}
@@ -159,3 +414,598 @@ func TestCurrencySwitchingMock(t *testing.T) {
 		t.Error("Starter plan not found")
 	}
 }
+
+func TestAccountsAreIsolated(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+
+	manager.Subscribe("alice", PlanTeam)
+	manager.RecordData("alice", 1024)
+
+	if sub := manager.GetSubscription("bob"); sub.PlanID != PlanStarter {
+		t.Errorf("Expected bob to stay on Starter, got %s", sub.PlanID)
+	}
+	if stats := manager.GetUsage("bob"); stats.DataTransferred != 0 {
+		t.Errorf("Expected bob to have no usage, got %d", stats.DataTransferred)
+	}
+
+	// Webhook subscriptions update an account that is already loaded
+	if err := manager.SubscribeUser("bob", PlanPersonal, "sub_webhook"); err != nil {
+		t.Fatalf("SubscribeUser failed: %v", err)
+	}
+	if sub := manager.GetSubscription("bob"); sub.PlanID != PlanPersonal || sub.ID != "sub_webhook" {
+		t.Errorf("Expected webhook subscription to apply, got %+v", sub)
+	}
+	if sub := manager.GetSubscription("alice"); sub.PlanID != PlanTeam {
+		t.Errorf("Expected alice to keep Team, got %s", sub.PlanID)
+	}
+}
+
+func TestOpenConnectionLimits(t *testing.T) {
+	manager := NewManager(NewMockStore())
+
+	// Starter allows 5 concurrent connections
+	var releases []func()
+	for i := 0; i < 5; i++ {
+		release, err := manager.OpenConnection("carol")
+		if err != nil {
+			t.Fatalf("Connection %d should be accepted, got %v", i+1, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := manager.OpenConnection("carol"); err == nil {
+		t.Error("Expected concurrent connection limit to be enforced")
+	}
+	if _, err := manager.OpenConnection("dave"); err != nil {
+		t.Errorf("Expected other users to be unaffected, got %v", err)
+	}
+
+	releases[0]()
+	releases[0]() // releasing twice must not free a second slot
+	if _, err := manager.OpenConnection("carol"); err != nil {
+		t.Errorf("Expected a freed slot to be reusable, got %v", err)
+	}
+	if _, err := manager.OpenConnection("carol"); err == nil {
+		t.Error("Expected only one slot to be freed")
+	}
+
+	// Unauthenticated connections are billed to the local user
+	manager.SetLocalUser("dave")
+	manager.OpenConnection("")
+	if stats := manager.GetUsage("dave"); stats.RequestsMade != 2 {
+		t.Errorf("Expected 2 requests for the local user, got %d", stats.RequestsMade)
+	}
+}
+
+func TestSyncUsageAndEviction(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+
+	manager.RecordData("erin", 100)
+	manager.SyncUsage()
+	manager.RecordData("erin", 50)
+	manager.SyncUsage()
+	manager.SyncUsage()
+
+	// The store adds up what it is given, so only new usage is sent
+	if total := store.totalData("erin"); total != 150 {
+		t.Fatalf("Expected 150 bytes persisted, got %d", total)
+	}
+
+	manager.SetIdleTimeout(-time.Second)
+	manager.SyncUsage()
+	manager.mu.RLock()
+	_, loaded := manager.accounts["erin"]
+	manager.mu.RUnlock()
+	if loaded {
+		t.Error("Expected idle account to be evicted")
+	}
+
+	// Reloading picks up the persisted usage
+	if stats := manager.GetUsage("erin"); stats.DataTransferred != 150 {
+		t.Errorf("Expected reloaded usage of 150 bytes, got %d", stats.DataTransferred)
+	}
+}
+
+func TestEvictionRechecksUnderLock(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+
+	acct := manager.Account("fay")
+	idleBefore := time.Now().Add(time.Second)
+
+	// The account was used after SyncUsage decided it was idle
+	manager.RecordData("fay", 10)
+	acct.mu.Lock()
+	acct.lastSeen = time.Now().Add(time.Second)
+	acct.mu.Unlock()
+	if err := manager.evict(acct, idleBefore); err != nil {
+		t.Fatalf("evict failed: %v", err)
+	}
+	if manager.Account("fay") != acct {
+		t.Fatal("Expected an account in use to stay loaded")
+	}
+
+	// Usage recorded since the last sync is flushed before eviction
+	manager.RecordData("fay", 20)
+	if err := manager.evict(acct, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("evict failed: %v", err)
+	}
+	if total := store.totalData("fay"); total != 30 {
+		t.Errorf("Expected 30 bytes flushed on eviction, got %d", total)
+	}
+}
+
+func TestAccountLoadedOnce(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+
+	// Concurrent first requests share one load and one Starter subscription
+	const n = 10
+	accounts := make(chan *Account, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			accounts <- manager.Account("gus")
+		}()
+	}
+	first := <-accounts
+	for i := 1; i < n; i++ {
+		if <-accounts != first {
+			t.Fatal("Expected every request to get the same account")
+		}
+	}
+	if sub := first.Subscription(); sub == nil || store.subs["gus"].ID != sub.ID {
+		t.Errorf("Expected the loaded subscription to be persisted, got %+v", sub)
+	}
+}
+
+func TestPlanEndsWithoutLifecycle(t *testing.T) {
+	manager := NewManager(NewMockStore())
+
+	if err := manager.StartTrial("lou", PlanPersonal, "TRIAL-lou", time.Hour); err != nil {
+		t.Fatalf("StartTrial failed: %v", err)
+	}
+	if err := manager.CheckQuota("lou"); err != nil {
+		t.Fatalf("Expected access during the trial, got %v", err)
+	}
+
+	// A trial past its end date no longer grants the plan, even if no
+	// lifecycle run has expired it yet
+	acct := manager.Account("lou")
+	acct.mu.Lock()
+	acct.subscription.EndDate = time.Now().Add(-time.Minute)
+	acct.mu.Unlock()
+	if err := manager.CheckQuota("lou"); err == nil {
+		t.Error("Expected an ended trial to be refused")
+	}
+}
+
+func (m *MockStore) NextCryptoAddressIndex(asset string) (uint32, error) {
+	index := m.indexes[asset]
+	m.indexes[asset]++
+	return index, nil
+}
+
+func (m *MockStore) CreateCryptoIntent(i *CryptoIntent) error {
+	for _, existing := range m.intents {
+		if existing.ID == i.ID || existing.Address == i.Address {
+			return errors.New("duplicate crypto intent")
+		}
+	}
+	c := *i
+	m.intents[i.ID] = &c
+	return nil
+}
+
+func (m *MockStore) GetCryptoIntent(id string) (*CryptoIntent, error) {
+	i, ok := m.intents[id]
+	if !ok {
+		return nil, errors.New("crypto intent not found")
+	}
+	c := *i
+	return &c, nil
+}
+
+func (m *MockStore) UpdateCryptoIntent(i *CryptoIntent) error {
+	c := *i
+	m.intents[i.ID] = &c
+	return nil
+}
+
+func (m *MockStore) ListWatchedCryptoIntents(since time.Time) ([]*CryptoIntent, error) {
+	var intents []*CryptoIntent
+	for _, i := range m.intents {
+		if i.Status == IntentPending || i.Status == IntentConfirming || (i.Status == IntentExpired && i.ExpiresAt.After(since)) {
+			c := *i
+			intents = append(intents, &c)
+		}
+	}
+	return intents, nil
+}
+
+func (m *MockStore) ListCryptoIntents(status string, limit, offset int) ([]*CryptoIntent, int, error) {
+	var intents []*CryptoIntent
+	for _, i := range m.intents {
+		if status == "" || i.Status == status {
+			c := *i
+			intents = append(intents, &c)
+		}
+	}
+	return intents, len(intents), nil
+}
+
+func (m *MockStore) CreateCoupon(c *Coupon) error {
+	cp := *c
+	m.coupons[c.Code] = &cp
+	return nil
+}
+
+func (m *MockStore) GetCoupon(code string) (*Coupon, error) {
+	if c, ok := m.coupons[code]; ok {
+		cp := *c
+		return &cp, nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) ListCoupons(limit, offset int) ([]*Coupon, int, error) {
+	var coupons []*Coupon
+	for _, c := range m.coupons {
+		coupons = append(coupons, c)
+	}
+	return coupons, len(coupons), nil
+}
+
+func (m *MockStore) SetCouponActive(code string, active bool) error {
+	if c, ok := m.coupons[code]; ok {
+		c.Active = active
+	}
+	return nil
+}
+
+func (m *MockStore) CreateRedemption(r *CouponRedemption) error {
+	if _, ok := m.redemptions[r.Reference]; !ok {
+		cp := *r
+		m.redemptions[r.Reference] = &cp
+	}
+	return nil
+}
+
+func (m *MockStore) GetRedemption(reference string) (*CouponRedemption, error) {
+	if r, ok := m.redemptions[reference]; ok {
+		cp := *r
+		return &cp, nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) ReserveCoupon(r *CouponRedemption) error {
+	c, ok := m.coupons[r.Code]
+	if !ok || (c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions) {
+		return ErrCouponUnavailable
+	}
+	if used, _ := m.HasRedeemed(r.Code, r.UserID); used && r.UserID != "" {
+		return ErrCouponUnavailable
+	}
+	if _, ok := m.redemptions[r.Reference]; ok {
+		return errors.New("redemption exists")
+	}
+	c.Redemptions++
+	cp := *r
+	m.redemptions[r.Reference] = &cp
+	return nil
+}
+
+func (m *MockStore) RedeemCoupon(reference string, at time.Time) (bool, error) {
+	r, ok := m.redemptions[reference]
+	if !ok || (r.Status != RedemptionPending && r.Status != RedemptionReleased) {
+		return false, nil
+	}
+	if r.Status == RedemptionReleased {
+		m.coupons[r.Code].Redemptions++
+	}
+	r.Status, r.RedeemedAt = RedemptionRedeemed, &at
+	return true, nil
+}
+
+func (m *MockStore) ReleaseCoupon(reference string) (bool, error) {
+	r, ok := m.redemptions[reference]
+	if !ok || r.Status != RedemptionPending {
+		return false, nil
+	}
+	r.Status = RedemptionReleased
+	m.coupons[r.Code].Redemptions--
+	return true, nil
+}
+
+func (m *MockStore) ReleaseCoupons(before time.Time) (int, error) {
+	n := 0
+	for ref, r := range m.redemptions {
+		if r.Status == RedemptionPending && r.CreatedAt.Before(before) {
+			m.ReleaseCoupon(ref)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MockStore) HasRedeemed(code, userID string) (bool, error) {
+	for _, r := range m.redemptions {
+		if r.Code == code && r.UserID == userID && !r.Renewal &&
+			(r.Status == RedemptionRedeemed || r.Status == RedemptionPending) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockStore) ListRedemptions(code string, limit, offset int) ([]*CouponRedemption, int, error) {
+	var list []*CouponRedemption
+	for _, r := range m.redemptions {
+		if r.Code == code && r.Status == RedemptionRedeemed {
+			list = append(list, r)
+		}
+	}
+	return list, len(list), nil
+}
+
+func (m *MockStore) SetSubscriptionCoupon(subscriptionID, code string) error {
+	if sub := m.byID(subscriptionID); sub != nil {
+		sub.Coupon = code
+	}
+	return nil
+}
+
+func (m *MockStore) GetReferralCode(userID string) (string, error) {
+	for code, id := range m.refCodes {
+		if id == userID {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+func (m *MockStore) CreateReferralCode(userID, code string) error {
+	if _, ok := m.refCodes[code]; ok {
+		return errors.New("code taken")
+	}
+	m.refCodes[code] = userID
+	return nil
+}
+
+func (m *MockStore) GetReferrer(code string) (string, error) {
+	return m.refCodes[code], nil
+}
+
+func (m *MockStore) CreateReferral(r *Referral) error {
+	if _, ok := m.referrals[r.RefereeID]; !ok {
+		cp := *r
+		m.referrals[r.RefereeID] = &cp
+	}
+	return nil
+}
+
+func (m *MockStore) GetReferral(refereeID string) (*Referral, error) {
+	if r, ok := m.referrals[refereeID]; ok {
+		cp := *r
+		return &cp, nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) RewardReferral(refereeID, reference string, rewardUSD float64, at time.Time) error {
+	if r, ok := m.referrals[refereeID]; ok && r.Status == ReferralPending {
+		r.Status, r.Reference, r.RewardUSD, r.RewardedAt = ReferralRewarded, reference, rewardUSD, &at
+	}
+	return nil
+}
+
+func (m *MockStore) ListReferrals(referrerID string, limit, offset int) ([]*Referral, int, error) {
+	var list []*Referral
+	for _, r := range m.referrals {
+		if referrerID == "" || r.ReferrerID == referrerID {
+			list = append(list, r)
+		}
+	}
+	return list, len(list), nil
+}
+
+func (m *MockStore) CountReferrals(referrerID string) (int, int, float64, error) {
+	var referred, rewarded int
+	var earned float64
+	for _, r := range m.referrals {
+		if r.ReferrerID == referrerID {
+			referred++
+			if r.Status == ReferralRewarded {
+				rewarded++
+				earned += r.RewardUSD
+			}
+		}
+	}
+	return referred, rewarded, earned, nil
+}
+
+func (m *MockStore) CreateOrg(org *Organization, owner *Member) error {
+	m.orgs[org.ID] = org
+	return m.AddMember(owner)
+}
+
+func (m *MockStore) GetOrg(id string) (*Organization, error) {
+	return m.orgs[id], nil
+}
+
+func (m *MockStore) GetMembership(userID string) (*Member, error) {
+	if mem, ok := m.members[userID]; ok {
+		c := *mem
+		c.Email = m.emails[userID]
+		return &c, nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) ListMembers(orgID string) ([]*Member, error) {
+	var list []*Member
+	for userID, mem := range m.members {
+		if mem.OrgID == orgID {
+			c, _ := m.GetMembership(userID)
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+func (m *MockStore) AddMember(mem *Member) error {
+	if _, ok := m.members[mem.UserID]; ok {
+		return errors.New("already a member")
+	}
+	c := *mem
+	m.members[mem.UserID] = &c
+	return nil
+}
+
+func (m *MockStore) UpdateMember(mem *Member) error {
+	c := *mem
+	m.members[mem.UserID] = &c
+	return nil
+}
+
+func (m *MockStore) RemoveMember(orgID, userID string) error {
+	delete(m.members, userID)
+	return nil
+}
+
+func (m *MockStore) CreateInvitation(inv *Invitation) error {
+	m.invitations[inv.TokenHash] = inv
+	return nil
+}
+
+func (m *MockStore) GetInvitationByToken(tokenHash string) (*Invitation, error) {
+	return m.invitations[tokenHash], nil
+}
+
+func (m *MockStore) ListInvitations(orgID string) ([]*Invitation, error) {
+	var list []*Invitation
+	for _, inv := range m.invitations {
+		if inv.OrgID == orgID && inv.AcceptedAt == nil && time.Now().Before(inv.ExpiresAt) {
+			list = append(list, inv)
+		}
+	}
+	return list, nil
+}
+
+func (m *MockStore) AcceptInvitation(id string, at time.Time) (bool, error) {
+	for _, inv := range m.invitations {
+		if inv.ID == id && inv.AcceptedAt == nil {
+			inv.AcceptedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockStore) DeleteInvitation(orgID, id string) error {
+	for hash, inv := range m.invitations {
+		if inv.OrgID == orgID && inv.ID == id {
+			delete(m.invitations, hash)
+		}
+	}
+	return nil
+}
+
+func (m *MockStore) AddMemberUsage(orgID, userID string, periodStart time.Time, bytes int64) error {
+	m.memberUsage[orgID+"|"+usageKey(userID, periodStart)] += bytes
+	return nil
+}
+
+func (m *MockStore) GetMemberUsage(orgID, userID string, periodStart time.Time) (int64, error) {
+	return m.memberUsage[orgID+"|"+usageKey(userID, periodStart)], nil
+}
+
+func (m *MockStore) CreateSubUser(u *SubUser) error {
+	for _, other := range m.subUsers {
+		if other.Username == u.Username {
+			return errors.New("username taken")
+		}
+	}
+	c := *u
+	m.subUsers[u.ID] = &c
+	return nil
+}
+
+func (m *MockStore) GetSubUser(id string) (*SubUser, error) {
+	if u, ok := m.subUsers[id]; ok {
+		c := *u
+		return &c, nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) GetSubUserByUsername(username string) (*SubUser, error) {
+	for _, u := range m.subUsers {
+		if u.Username == username {
+			c := *u
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockStore) ListSubUsers(parentID string) ([]*SubUser, error) {
+	var out []*SubUser
+	for _, u := range m.subUsers {
+		if u.ParentID == parentID {
+			c := *u
+			out = append(out, &c)
+		}
+	}
+	return out, nil
+}
+
+func (m *MockStore) UpdateSubUser(u *SubUser) error {
+	c := *u
+	m.subUsers[u.ID] = &c
+	return nil
+}
+
+func (m *MockStore) DeleteSubUser(parentID, id string) error {
+	if u, ok := m.subUsers[id]; ok && u.ParentID == parentID {
+		delete(m.subUsers, id)
+	}
+	return nil
+}
+
+func (m *MockStore) AddSubUserUsage(id string, periodStart time.Time, bytes, requests int64) error {
+	key := usageKey(id, periodStart)
+	u, ok := m.subUserUsage[key]
+	if !ok {
+		u = &mockUsage{}
+		m.subUserUsage[key] = u
+	}
+	u.data += bytes
+	u.reqs += requests
+	return nil
+}
+
+func (m *MockStore) GetSubUserUsage(id string, periodStart time.Time) (int64, int64, error) {
+	if u, ok := m.subUserUsage[usageKey(id, periodStart)]; ok {
+		return u.data, u.reqs, nil
+	}
+	return 0, 0, nil
+}
+
+func (m *MockStore) ListSubUserUsage(id string, limit int) ([]SubUserPeriod, error) {
+	var out []SubUserPeriod
+	for key, u := range m.subUserUsage {
+		subID, start, _ := strings.Cut(key, "|")
+		if subID != id {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, start)
+		out = append(out, SubUserPeriod{PeriodStart: t, DataTransferred: u.data, RequestsMade: u.reqs})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PeriodStart.After(out[j].PeriodStart) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
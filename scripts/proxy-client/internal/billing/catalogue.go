@@ -0,0 +1,275 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrPlanNotFound = errors.New("plan not found")
+	ErrPlanExists   = errors.New("plan already exists")
+	ErrPlanRetired  = errors.New("plan is no longer offered")
+	ErrPlanRequired = errors.New("plan can not be retired")
+	ErrInvalidPlan  = errors.New("invalid plan")
+)
+
+// PlanFlags are the features a plan includes, as enforced
+type PlanFlags struct {
+	Protocols         []string `json:"protocols"`          // allowed protocols; empty allows all
+	ProtocolSelection bool     `json:"protocol_selection"` // choosing the protocol in the app
+	APIAccess         bool     `json:"api_access"`
+	Countries         []string `json:"countries"` // allowed exit countries; empty allows all
+	StickySessions    bool     `json:"sticky_sessions"`
+	RateLimit         float64  `json:"rate_limit"` // API requests per second; 0 uses the default
+	RateBurst         float64  `json:"rate_burst"`
+	// Seats is how many members an organization on the plan may have: 0
+	// for no organizations, -1 for unlimited
+	Seats int `json:"seats"`
+	// SubUsers is how many sub-users with their own proxy credentials an
+	// account on the plan may create: 0 for none, -1 for unlimited
+	SubUsers int `json:"sub_users"`
+}
+
+// AllowsProtocol reports whether the plan includes a protocol
+func (f PlanFlags) AllowsProtocol(protocol string) bool {
+	return len(f.Protocols) == 0 || containsFold(f.Protocols, protocol)
+}
+
+// AllowsCountry reports whether the plan includes an exit country
+func (f PlanFlags) AllowsCountry(country string) bool {
+	return country == "" || len(f.Countries) == 0 || containsFold(f.Countries, country)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanStore is the persistence of the plan catalogue
+type PlanStore interface {
+	// ListPlans returns every version of every plan in catalogue order,
+	// versions ascending
+	ListPlans() ([]Plan, error)
+	// SavePlan stores a new version of a plan and makes it current
+	SavePlan(p *Plan) error
+	SetPlanActive(id PlanType, active bool) error
+}
+
+// Catalogue holds the plans on offer. Plans are versioned: changing a plan
+// adds a version, new subscriptions get the latest one, and existing
+// subscribers keep the terms of the version they subscribed to.
+type Catalogue struct {
+	mu       sync.RWMutex
+	store    PlanStore
+	order    []PlanType
+	versions map[PlanType][]Plan // ascending
+}
+
+func newCatalogue(store PlanStore, plans []Plan) *Catalogue {
+	c := &Catalogue{store: store, versions: make(map[PlanType][]Plan)}
+	for _, p := range plans {
+		if _, ok := c.versions[p.ID]; !ok {
+			c.order = append(c.order, p.ID)
+		}
+		c.versions[p.ID] = append(c.versions[p.ID], p)
+	}
+	return c
+}
+
+var (
+	catalogueMu sync.RWMutex
+	catalogue   = newCatalogue(nil, defaultPlanVersions())
+)
+
+// Plans returns the plan catalogue in use
+func Plans() *Catalogue {
+	catalogueMu.RLock()
+	defer catalogueMu.RUnlock()
+	return catalogue
+}
+
+// LoadCatalogue makes the plans in store the catalogue in use. A store
+// without plans leaves the built-in plans in place.
+func LoadCatalogue(store PlanStore) (*Catalogue, error) {
+	plans, err := store.ListPlans()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load plans: %w", err)
+	}
+	if len(plans) == 0 {
+		plans = defaultPlanVersions()
+	}
+
+	c := newCatalogue(store, plans)
+	catalogueMu.Lock()
+	catalogue = c
+	catalogueMu.Unlock()
+	return c, nil
+}
+
+// List returns the latest version of each plan on offer
+func (c *Catalogue) List() []Plan {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var plans []Plan
+	for _, id := range c.order {
+		if p := c.latest(id); p.Active {
+			plans = append(plans, p)
+		}
+	}
+	return plans
+}
+
+// All returns the latest version of every plan, including retired ones
+func (c *Catalogue) All() []Plan {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	plans := make([]Plan, 0, len(c.order))
+	for _, id := range c.order {
+		plans = append(plans, c.latest(id))
+	}
+	return plans
+}
+
+// Versions returns every version of a plan, oldest first
+func (c *Catalogue) Versions(id PlanType) ([]Plan, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	versions, ok := c.versions[id]
+	if !ok {
+		return nil, ErrPlanNotFound
+	}
+	return append([]Plan(nil), versions...), nil
+}
+
+// Get returns the latest version of a plan
+func (c *Catalogue) Get(id PlanType) (Plan, error) {
+	return c.Version(id, 0)
+}
+
+// Version returns a version of a plan; version 0 is the latest
+func (c *Catalogue) Version(id PlanType, version int) (Plan, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.versions[id]; !ok {
+		return Plan{}, ErrPlanNotFound
+	}
+	if version <= 0 {
+		return c.latest(id), nil
+	}
+	for _, p := range c.versions[id] {
+		if p.Version == version {
+			return p, nil
+		}
+	}
+	return Plan{}, fmt.Errorf("version %d of plan %s not found", version, id)
+}
+
+// latest returns the newest version of a known plan; callers hold c.mu
+func (c *Catalogue) latest(id PlanType) Plan {
+	versions := c.versions[id]
+	return versions[len(versions)-1]
+}
+
+// Create adds a new plan
+func (c *Catalogue) Create(p Plan) (Plan, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.versions[p.ID]; ok {
+		return Plan{}, ErrPlanExists
+	}
+	p.Version, p.Active = 1, true
+	return c.save(p)
+}
+
+// Update adds a new version of a plan. Subscribers keep their version until
+// they change plans; whether the plan is on offer does not change.
+func (c *Catalogue) Update(p Plan) (Plan, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.versions[p.ID]; !ok {
+		return Plan{}, ErrPlanNotFound
+	}
+	current := c.latest(p.ID)
+	p.Version, p.Active = current.Version+1, current.Active
+	return c.save(p)
+}
+
+// SetActive offers or retires a plan. Retired plans can not be subscribed
+// to, but existing subscribers keep them. Starter is the fallback of every
+// account and is always offered.
+func (c *Catalogue) SetActive(id PlanType, active bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions, ok := c.versions[id]
+	if !ok {
+		return ErrPlanNotFound
+	}
+	if id == PlanStarter && !active {
+		return ErrPlanRequired
+	}
+	if c.store != nil {
+		if err := c.store.SetPlanActive(id, active); err != nil {
+			return err
+		}
+	}
+	for i := range versions {
+		versions[i].Active = active
+	}
+	return nil
+}
+
+// save persists a version and adds it to the catalogue; callers hold c.mu
+func (c *Catalogue) save(p Plan) (Plan, error) {
+	if err := validatePlan(&p); err != nil {
+		return Plan{}, err
+	}
+	// Prices are kept in USD; display prices are computed per request
+	p.DisplayPriceMonthly, p.DisplayPriceAnnual, p.Currency, p.Symbol = 0, 0, "", ""
+
+	if c.store != nil {
+		if err := c.store.SavePlan(&p); err != nil {
+			return Plan{}, err
+		}
+	}
+	if _, ok := c.versions[p.ID]; !ok {
+		c.order = append(c.order, p.ID)
+	}
+	c.versions[p.ID] = append(c.versions[p.ID], p)
+	return p, nil
+}
+
+func validatePlan(p *Plan) error {
+	p.ID = PlanType(strings.ToLower(strings.TrimSpace(string(p.ID))))
+	switch {
+	case p.ID == "":
+		return fmt.Errorf("%w: id is required", ErrInvalidPlan)
+	case strings.TrimSpace(p.Name) == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidPlan)
+	case p.PriceMonthly < 0 || p.PriceAnnual < 0:
+		return fmt.Errorf("%w: prices can not be negative", ErrInvalidPlan)
+	case p.DataLimitMB < -1 || p.RequestLimit < -1 || p.ConcurrentConns < -1 || p.Flags.Seats < -1 || p.Flags.SubUsers < -1:
+		return fmt.Errorf("%w: limits must be -1 (unlimited) or more", ErrInvalidPlan)
+	case p.Flags.RateLimit < 0 || p.Flags.RateBurst < 0:
+		return fmt.Errorf("%w: rate limits can not be negative", ErrInvalidPlan)
+	case p.OverageRatePerGB < 0 || p.ThrottleKbps < 0:
+		return fmt.Errorf("%w: overage rate and throttle can not be negative", ErrInvalidPlan)
+	case p.BandwidthKbps < 0 || p.ConnectionKbps < 0:
+		return fmt.Errorf("%w: bandwidth can not be negative", ErrInvalidPlan)
+	}
+	return nil
+}
+
+// inCurrency returns the plan with display prices in a currency
+func (p Plan) inCurrency(code CurrencyCode) Plan {
+	p.Currency = string(code)
+	p.Symbol = GetCurrencySymbol(code)
+	p.DisplayPriceMonthly = ConvertPrice(p.PriceMonthly, code)
+	p.DisplayPriceAnnual = ConvertPrice(p.PriceAnnual, code)
+	return p
+}
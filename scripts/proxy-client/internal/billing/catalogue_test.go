@@ -0,0 +1,116 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+)
+
+// useCatalogue makes c the catalogue in use for the duration of a test
+func useCatalogue(t *testing.T, c *Catalogue) {
+	catalogueMu.Lock()
+	previous := catalogue
+	catalogue = c
+	catalogueMu.Unlock()
+	t.Cleanup(func() {
+		catalogueMu.Lock()
+		catalogue = previous
+		catalogueMu.Unlock()
+	})
+}
+
+func TestCatalogueVersions(t *testing.T) {
+	c := newCatalogue(nil, defaultPlanVersions())
+
+	personal, _ := c.Get(PlanPersonal)
+	personal.PriceMonthly = 39
+	updated, err := c.Update(personal)
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if updated.Version != 2 || !updated.Active {
+		t.Errorf("Expected active version 2, got %+v", updated)
+	}
+	if v1, _ := c.Version(PlanPersonal, 1); v1.PriceMonthly != 29 {
+		t.Errorf("Expected version 1 to keep its price, got %.2f", v1.PriceMonthly)
+	}
+	if latest, _ := c.Get(PlanPersonal); latest.PriceMonthly != 39 {
+		t.Errorf("Expected the latest price, got %.2f", latest.PriceMonthly)
+	}
+
+	if _, err := c.Create(Plan{ID: PlanTeam, Name: "Team"}); err != ErrPlanExists {
+		t.Errorf("Expected ErrPlanExists, got %v", err)
+	}
+	if _, err := c.Create(Plan{ID: "Pro ", Name: "Pro", PriceMonthly: -1}); !errors.Is(err, ErrInvalidPlan) {
+		t.Errorf("Expected ErrInvalidPlan, got %v", err)
+	}
+	pro, err := c.Create(Plan{ID: "Pro ", Name: "Pro", PriceMonthly: 59, Flags: PlanFlags{APIAccess: true}})
+	if err != nil || pro.ID != "pro" || pro.Version != 1 || !pro.Active {
+		t.Fatalf("Unexpected new plan: %+v, %v", pro, err)
+	}
+
+	if err := c.SetActive(PlanStarter, false); err != ErrPlanRequired {
+		t.Errorf("Expected ErrPlanRequired, got %v", err)
+	}
+	if err := c.SetActive(PlanTeam, false); err != nil {
+		t.Fatalf("SetActive failed: %v", err)
+	}
+	for _, p := range c.List() {
+		if p.ID == PlanTeam {
+			t.Error("Expected retired plans to be left out of the list")
+		}
+	}
+	if len(c.List()) != len(c.All())-1 {
+		t.Errorf("Expected %d plans on offer, got %d", len(c.All())-1, len(c.List()))
+	}
+}
+
+func TestCatalogueKeepsSubscribersOnTheirVersion(t *testing.T) {
+	c := newCatalogue(nil, defaultPlanVersions())
+	useCatalogue(t, c)
+	manager := NewManager(NewMockStore())
+
+	if _, err := manager.Subscribe("early", PlanPersonal); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	personal, _ := c.Get(PlanPersonal)
+	personal.DataLimitMB = 1024
+	personal.Flags.APIAccess = false
+	if _, err := c.Update(personal); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	if plan := manager.CurrentPlan("early"); plan.Version != 1 || plan.DataLimitMB != 10*1024 {
+		t.Errorf("Expected the early subscriber to keep version 1, got %+v", plan)
+	}
+	if err := manager.CheckAPIAccess("early"); err != nil {
+		t.Errorf("Expected the early subscriber to keep API access, got %v", err)
+	}
+
+	if _, err := manager.Subscribe("late", PlanPersonal); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if plan := manager.CurrentPlan("late"); plan.Version != 2 || plan.DataLimitMB != 1024 {
+		t.Errorf("Expected a new subscriber to get version 2, got %+v", plan)
+	}
+	if err := manager.CheckAPIAccess("late"); err == nil {
+		t.Error("Expected version 2 to exclude API access")
+	}
+
+	// Retired plans keep their subscribers but take no new ones
+	if err := c.SetActive(PlanPersonal, false); err != nil {
+		t.Fatalf("SetActive failed: %v", err)
+	}
+	if plan := manager.CurrentPlan("early"); plan.ID != PlanPersonal {
+		t.Errorf("Expected the subscriber to keep a retired plan, got %s", plan.ID)
+	}
+	if _, err := manager.Subscribe("later", PlanPersonal); err != ErrPlanRetired {
+		t.Errorf("Expected ErrPlanRetired, got %v", err)
+	}
+	if err := c.SetActive(PlanTeam, false); err != nil {
+		t.Fatalf("SetActive failed: %v", err)
+	}
+	if _, err := manager.PreviewPlanChange("early", PlanTeam); err != ErrPlanRetired {
+		t.Errorf("Expected ErrPlanRetired for a change to a retired plan, got %v", err)
+	}
+}
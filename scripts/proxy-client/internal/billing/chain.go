@@ -0,0 +1,220 @@
+package billing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChainIndexers routes lookups to the indexer of each asset
+type ChainIndexers map[string]ChainIndexer
+
+func (c ChainIndexers) Payments(asset CryptoAsset, address string) ([]ChainPayment, error) {
+	indexer, ok := c[asset.Symbol]
+	if !ok {
+		return nil, fmt.Errorf("no chain indexer for %s", asset.Symbol)
+	}
+	return indexer.Payments(asset, address)
+}
+
+// NewChainIndexers returns the indexers of the configured chain APIs
+func NewChainIndexers(cfg CryptoConfig) ChainIndexers {
+	cfg = cfg.withDefaults()
+	client := &http.Client{Timeout: 15 * time.Second}
+	return ChainIndexers{
+		"btc": &EsploraIndexer{BaseURL: cfg.BitcoinAPI, client: client},
+		"eth": &EtherscanIndexer{BaseURL: cfg.EthereumAPI, APIKey: cfg.EtherscanKey, client: client},
+	}
+}
+
+// EsploraIndexer reads bitcoin payments from an Esplora API, such as
+// blockstream.info or a self-hosted electrs
+type EsploraIndexer struct {
+	BaseURL string
+	client  *http.Client
+}
+
+func (e *EsploraIndexer) Payments(asset CryptoAsset, address string) ([]ChainPayment, error) {
+	var txs []struct {
+		TxID   string `json:"txid"`
+		Status struct {
+			Confirmed   bool  `json:"confirmed"`
+			BlockHeight int64 `json:"block_height"`
+		} `json:"status"`
+		Vout []struct {
+			Address string `json:"scriptpubkey_address"`
+			Value   int64  `json:"value"`
+		} `json:"vout"`
+	}
+	if err := getJSON(e.client, e.BaseURL+"/address/"+url.PathEscape(address)+"/txs", &txs); err != nil {
+		return nil, err
+	}
+	if len(txs) == 0 {
+		return nil, nil
+	}
+
+	var tip int64
+	if err := getJSON(e.client, e.BaseURL+"/blocks/tip/height", &tip); err != nil {
+		return nil, err
+	}
+
+	var payments []ChainPayment
+	for _, tx := range txs {
+		p := ChainPayment{TxID: tx.TxID}
+		for _, out := range tx.Vout {
+			if out.Address == address {
+				p.Amount += out.Value
+			}
+		}
+		if p.Amount == 0 {
+			continue // spent from the address, not paid to it
+		}
+		if tx.Status.Confirmed {
+			p.Confirmations = int(tip - tx.Status.BlockHeight + 1)
+		}
+		payments = append(payments, p)
+	}
+	return payments, nil
+}
+
+// EtherscanIndexer reads ether payments from an Etherscan-compatible API.
+// Token transfers are not counted.
+type EtherscanIndexer struct {
+	BaseURL string
+	APIKey  string
+	client  *http.Client
+}
+
+func (e *EtherscanIndexer) Payments(asset CryptoAsset, address string) ([]ChainPayment, error) {
+	q := url.Values{}
+	q.Set("module", "account")
+	q.Set("action", "txlist")
+	q.Set("address", address)
+	q.Set("sort", "asc")
+	if e.APIKey != "" {
+		q.Set("apikey", e.APIKey)
+	}
+
+	var resp struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
+	}
+	if err := getJSON(e.client, e.BaseURL+"?"+q.Encode(), &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "1" {
+		if strings.HasPrefix(resp.Message, "No transactions found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("etherscan error: %s", resp.Message)
+	}
+
+	var txs []struct {
+		Hash          string `json:"hash"`
+		To            string `json:"to"`
+		Value         string `json:"value"` // wei
+		Confirmations string `json:"confirmations"`
+		IsError       string `json:"isError"`
+	}
+	if err := json.Unmarshal(resp.Result, &txs); err != nil {
+		return nil, fmt.Errorf("etherscan error: %w", err)
+	}
+
+	// Amounts are kept in the asset's base unit rather than wei
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(18-asset.Decimals)), nil)
+
+	var payments []ChainPayment
+	for _, tx := range txs {
+		if !strings.EqualFold(tx.To, address) || tx.IsError != "0" {
+			continue
+		}
+		wei, ok := new(big.Int).SetString(tx.Value, 10)
+		if !ok || wei.Sign() <= 0 {
+			continue
+		}
+		confirmations, _ := strconv.Atoi(tx.Confirmations)
+		payments = append(payments, ChainPayment{
+			TxID:          tx.Hash,
+			Amount:        wei.Quo(wei, scale).Int64(),
+			Confirmations: confirmations,
+		})
+	}
+	return payments, nil
+}
+
+// CoinGeckoRates prices coins through the CoinGecko simple price API.
+// Prices are cached for a minute, so a burst of checkouts costs one request.
+type CoinGeckoRates struct {
+	BaseURL string
+	client  *http.Client
+
+	mu     sync.Mutex
+	prices map[string]cachedPrice
+}
+
+type cachedPrice struct {
+	usd     float64
+	fetched time.Time
+}
+
+const cryptoPriceTTL = time.Minute
+
+// NewCoinGeckoRates returns rates from baseURL, or the public API if empty
+func NewCoinGeckoRates(baseURL string) *CoinGeckoRates {
+	if baseURL == "" {
+		baseURL = DefaultCryptoConfig().RatesURL
+	}
+	return &CoinGeckoRates{
+		BaseURL: baseURL,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		prices:  make(map[string]cachedPrice),
+	}
+}
+
+func (r *CoinGeckoRates) USDPrice(asset CryptoAsset) (float64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.prices[asset.Name]; ok && time.Since(p.fetched) < cryptoPriceTTL {
+		return p.usd, nil
+	}
+
+	var resp map[string]struct {
+		USD float64 `json:"usd"`
+	}
+	if err := getJSON(r.client, r.BaseURL+"/simple/price?ids="+url.QueryEscape(asset.Name)+"&vs_currencies=usd", &resp); err != nil {
+		return 0, err
+	}
+	price := resp[asset.Name].USD
+	if price <= 0 {
+		return 0, fmt.Errorf("no price for %s", asset.Name)
+	}
+	r.prices[asset.Name] = cachedPrice{usd: price, fetched: time.Now()}
+	return price, nil
+}
+
+// getJSON fetches a URL and decodes the JSON response into v
+func getJSON(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %d: %s", url, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,451 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Discount types of coupons
+const (
+	DiscountPercent = "percent" // Value percent off the price
+	DiscountFixed   = "fixed"   // Value USD off the price
+)
+
+// Coupon redemption states
+const (
+	RedemptionPending  = "pending"  // checkout started, not paid yet
+	RedemptionRedeemed = "redeemed" // paid with the discount
+	RedemptionReleased = "released" // checkout left unpaid, its hold given back
+)
+
+// CouponHold is how long an unpaid checkout holds one of its coupon's
+// redemptions
+const CouponHold = 24 * time.Hour
+
+var (
+	ErrInvalidCoupon     = errors.New("invalid coupon")
+	ErrCouponNotFound    = errors.New("coupon not found")
+	ErrCouponUnavailable = errors.New("coupon can not be used")
+)
+
+var couponCode = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// Coupon is a promo code taking a discount off plan checkouts
+type Coupon struct {
+	Code            string     `json:"code"`
+	Type            string     `json:"type"` // percent or fixed
+	Value           float64    `json:"value"`
+	Plans           []PlanType `json:"plans,omitempty"` // plans it applies to; empty for all
+	MaxRedemptions  int        `json:"max_redemptions"` // 0 for unlimited
+	Redemptions     int        `json:"redemptions"`     // paid or held by unpaid checkouts
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	FirstPeriodOnly bool       `json:"first_period_only"` // otherwise renewals are discounted too
+	Active          bool       `json:"active"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// CouponRedemption is a payment a coupon took a discount off
+type CouponRedemption struct {
+	Reference   string     `json:"reference"` // the payment
+	Code        string     `json:"code"`
+	UserID      string     `json:"user_id"`
+	PlanID      PlanType   `json:"plan_id"`
+	DiscountUSD float64    `json:"discount_usd"`
+	Renewal     bool       `json:"renewal"` // a renewal under a recurring coupon
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RedeemedAt  *time.Time `json:"redeemed_at,omitempty"`
+}
+
+// CouponQuote is what a coupon takes off the monthly price of a plan
+type CouponQuote struct {
+	Code            string   `json:"code"`
+	PlanID          PlanType `json:"plan_id"`
+	PriceUSD        float64  `json:"price_usd"`
+	DiscountUSD     float64  `json:"discount_usd"`
+	TotalUSD        float64  `json:"total_usd"`
+	FirstPeriodOnly bool     `json:"first_period_only"`
+}
+
+// PromotionStore is the persistence of coupons and referrals
+type PromotionStore interface {
+	CreateCoupon(c *Coupon) error
+	GetCoupon(code string) (*Coupon, error) // nil if there is none
+	ListCoupons(limit, offset int) ([]*Coupon, int, error)
+	SetCouponActive(code string, active bool) error
+	// CreateRedemption records a discounted payment; a reference is only
+	// recorded once
+	CreateRedemption(r *CouponRedemption) error
+	// ReserveCoupon records the pending redemption of a checkout and holds
+	// one of its coupon's redemptions, in one step. It fails with
+	// ErrCouponUnavailable if none is left or the user already paid with
+	// the coupon or holds it.
+	ReserveCoupon(r *CouponRedemption) error
+	GetRedemption(reference string) (*CouponRedemption, error) // nil if there is none
+	// RedeemCoupon marks a pending or released redemption paid; a released
+	// one is counted against its coupon again. It reports false if the
+	// redemption was neither.
+	RedeemCoupon(reference string, at time.Time) (bool, error)
+	// ReleaseCoupon gives back the hold of a pending redemption. It reports
+	// false if the redemption was not pending.
+	ReleaseCoupon(reference string) (bool, error)
+	// ReleaseCoupons gives back the holds of redemptions pending since
+	// before a time
+	ReleaseCoupons(before time.Time) (int, error)
+	// HasRedeemed reports whether a user paid with a coupon or holds it
+	HasRedeemed(code, userID string) (bool, error)
+	ListRedemptions(code string, limit, offset int) ([]*CouponRedemption, int, error)
+	SetSubscriptionCoupon(subscriptionID, code string) error
+
+	GetReferralCode(userID string) (string, error) // empty if there is none
+	CreateReferralCode(userID, code string) error
+	GetReferrer(code string) (string, error) // the user ID, empty if there is none
+	CreateReferral(r *Referral) error
+	GetReferral(refereeID string) (*Referral, error) // nil if there is none
+	RewardReferral(refereeID, reference string, rewardUSD float64, at time.Time) error
+	ListReferrals(referrerID string, limit, offset int) ([]*Referral, int, error)
+	// CountReferrals sums up the referrals of a referrer
+	CountReferrals(referrerID string) (referred, rewarded int, earnedUSD float64, err error)
+
+	PostCreditTransaction(tx *CreditTransaction) (bool, error)
+}
+
+// PromotionConfig sets the credits a successful referral earns
+type PromotionConfig struct {
+	ReferrerRewardUSD float64 `yaml:"referrer_reward_usd"` // to the user who referred
+	RefereeRewardUSD  float64 `yaml:"referee_reward_usd"`  // to the user who signed up
+}
+
+// DefaultPromotionConfig returns the rewards used when none are configured
+func DefaultPromotionConfig() PromotionConfig {
+	return PromotionConfig{
+		ReferrerRewardUSD: 10,
+		RefereeRewardUSD:  5,
+	}
+}
+
+// Promotions runs coupons and the referral program
+type Promotions struct {
+	store  PromotionStore
+	cfg    PromotionConfig
+	logger *logrus.Logger
+}
+
+// NewPromotions creates the coupon and referral programs
+func NewPromotions(store PromotionStore, cfg PromotionConfig) *Promotions {
+	d := DefaultPromotionConfig()
+	if cfg.ReferrerRewardUSD <= 0 {
+		cfg.ReferrerRewardUSD = d.ReferrerRewardUSD
+	}
+	if cfg.RefereeRewardUSD <= 0 {
+		cfg.RefereeRewardUSD = d.RefereeRewardUSD
+	}
+	return &Promotions{
+		store:  store,
+		cfg:    cfg,
+		logger: logrus.StandardLogger(),
+	}
+}
+
+// SetPromotions connects the coupon and referral programs
+func (m *Manager) SetPromotions(p *Promotions) { m.promotions = p }
+
+// Normalize checks the terms of a new coupon and puts its code in upper case
+func (c *Coupon) Normalize() error {
+	c.Code = strings.ToUpper(strings.TrimSpace(c.Code))
+	c.Type = strings.ToLower(strings.TrimSpace(c.Type))
+	switch {
+	case !couponCode.MatchString(c.Code):
+		return fmt.Errorf("%w: code must be 3 to 32 letters, digits, dashes or underscores", ErrInvalidCoupon)
+	case c.Type != DiscountPercent && c.Type != DiscountFixed:
+		return fmt.Errorf("%w: type must be percent or fixed", ErrInvalidCoupon)
+	case c.Type == DiscountPercent && (c.Value <= 0 || c.Value >= 100):
+		return fmt.Errorf("%w: percent off must be more than 0 and less than 100", ErrInvalidCoupon)
+	case c.Type == DiscountFixed && c.Value <= 0:
+		return fmt.Errorf("%w: amount off must be positive", ErrInvalidCoupon)
+	case c.MaxRedemptions < 0:
+		return fmt.Errorf("%w: max redemptions can not be negative", ErrInvalidCoupon)
+	}
+	for i, id := range c.Plans {
+		c.Plans[i] = PlanType(strings.ToLower(strings.TrimSpace(string(id))))
+		if _, err := GetPlan(c.Plans[i]); err != nil {
+			return fmt.Errorf("%w: unknown plan %s", ErrInvalidCoupon, id)
+		}
+	}
+	return nil
+}
+
+// Discount returns the USD amount the coupon takes off a price
+func (c *Coupon) Discount(priceUSD float64) float64 {
+	discount := c.Value
+	if c.Type == DiscountPercent {
+		discount = priceUSD * c.Value / 100
+	}
+	return math.Round(min(discount, priceUSD)*100) / 100
+}
+
+// appliesTo reports whether the coupon can discount a plan
+func (c *Coupon) appliesTo(planID PlanType) bool {
+	return len(c.Plans) == 0 || slices.Contains(c.Plans, planID)
+}
+
+// usable checks that a coupon can be used for a new subscription now
+func (c *Coupon) usable(planID PlanType, now time.Time) error {
+	switch {
+	case !c.Active:
+		return fmt.Errorf("%w: %s is no longer offered", ErrCouponUnavailable, c.Code)
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return fmt.Errorf("%w: %s has expired", ErrCouponUnavailable, c.Code)
+	case c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions:
+		return fmt.Errorf("%w: %s has been fully redeemed", ErrCouponUnavailable, c.Code)
+	case !c.appliesTo(planID):
+		return fmt.Errorf("%w: %s does not apply to the %s plan", ErrCouponUnavailable, c.Code, planID)
+	}
+	return nil
+}
+
+// CreateCoupon adds a coupon. Codes are unique regardless of case.
+func (m *Manager) CreateCoupon(c *Coupon) error {
+	if m.promotions == nil {
+		return errors.New("promotions not configured")
+	}
+	if err := c.Normalize(); err != nil {
+		return err
+	}
+	existing, err := m.promotions.store.GetCoupon(c.Code)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%w: %s already exists", ErrInvalidCoupon, c.Code)
+	}
+	c.Redemptions, c.Active = 0, true
+	c.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	return m.promotions.store.CreateCoupon(c)
+}
+
+// DeactivateCoupon stops a coupon from being used for new subscriptions.
+// Subscriptions on a recurring coupon keep their discount.
+func (m *Manager) DeactivateCoupon(code string) (*Coupon, error) {
+	c, err := m.coupon(code)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.promotions.store.SetCouponActive(c.Code, false); err != nil {
+		return nil, err
+	}
+	c.Active = false
+	return c, nil
+}
+
+// GetCoupon returns a coupon by its code in any case
+func (m *Manager) GetCoupon(code string) (*Coupon, error) {
+	return m.coupon(code)
+}
+
+// ListCoupons lists coupons newest first
+func (m *Manager) ListCoupons(limit, offset int) ([]*Coupon, int, error) {
+	if m.promotions == nil {
+		return nil, 0, errors.New("promotions not configured")
+	}
+	return m.promotions.store.ListCoupons(limit, offset)
+}
+
+// ListRedemptions lists the payments a coupon was redeemed on, newest first
+func (m *Manager) ListRedemptions(code string, limit, offset int) ([]*CouponRedemption, int, error) {
+	if m.promotions == nil {
+		return nil, 0, errors.New("promotions not configured")
+	}
+	return m.promotions.store.ListRedemptions(strings.ToUpper(code), limit, offset)
+}
+
+// QuoteCoupon returns what a coupon takes off a plan for a user, checking
+// it could be used at checkout
+func (m *Manager) QuoteCoupon(userID, code string, planID PlanType) (*CouponQuote, error) {
+	c, err := m.usableCoupon(userID, code, planID)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := offeredPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	discount := c.Discount(plan.PriceMonthly)
+	return &CouponQuote{
+		Code:            c.Code,
+		PlanID:          plan.ID,
+		PriceUSD:        plan.PriceMonthly,
+		DiscountUSD:     discount,
+		TotalUSD:        math.Round((plan.PriceMonthly-discount)*100) / 100,
+		FirstPeriodOnly: c.FirstPeriodOnly,
+	}, nil
+}
+
+// applyCoupon checks the coupon of a checkout and records it as pending
+// under the checkout's reference, which the payment is applied with
+func (m *Manager) applyCoupon(req *CheckoutRequest) error {
+	if req.AmountUSD > 0 {
+		return fmt.Errorf("%w: coupons only apply to plan purchases", ErrCouponUnavailable)
+	}
+	userID := req.Metadata["user_id"]
+	c, err := m.usableCoupon(userID, req.Coupon, PlanType(req.PlanID))
+	if err != nil {
+		return err
+	}
+	price, err := checkoutPrice(*req)
+	if err != nil {
+		return err
+	}
+	discount := c.Discount(price)
+	if discount >= price {
+		return fmt.Errorf("%w: %s takes off the whole price", ErrCouponUnavailable, c.Code)
+	}
+
+	if req.Reference == "" {
+		req.Reference = uuid.New().String()
+	}
+	err = m.promotions.store.ReserveCoupon(&CouponRedemption{
+		Reference:   req.Reference,
+		Code:        c.Code,
+		UserID:      userID,
+		PlanID:      PlanType(req.PlanID),
+		DiscountUSD: discount,
+		Status:      RedemptionPending,
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+	})
+	if errors.Is(err, ErrCouponUnavailable) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record coupon: %w", err)
+	}
+	req.coupon, req.discount = c, discount
+	return nil
+}
+
+// ReleaseCoupons gives back the redemptions held by checkouts left unpaid
+// for longer than CouponHold
+func (m *Manager) ReleaseCoupons(now time.Time) (int, error) {
+	if m.promotions == nil {
+		return 0, nil
+	}
+	return m.promotions.store.ReleaseCoupons(now.Add(-CouponHold))
+}
+
+// RedeemCoupon counts the coupon of a paid checkout, if it had one, and puts
+// a recurring coupon on the subscription the payment started. Payments
+// applied again return the redemption without counting it twice.
+func (m *Manager) RedeemCoupon(userID, reference string) (*CouponRedemption, error) {
+	if m.promotions == nil {
+		return nil, nil
+	}
+	r, err := m.promotions.store.GetRedemption(reference)
+	if err != nil || r == nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	redeemed, err := m.promotions.store.RedeemCoupon(reference, now)
+	if err != nil {
+		return nil, err
+	}
+	if !redeemed {
+		return r, nil
+	}
+	r.Status, r.RedeemedAt = RedemptionRedeemed, &now
+
+	c, err := m.promotions.store.GetCoupon(r.Code)
+	if err != nil {
+		return r, err
+	}
+	if c != nil && !c.FirstPeriodOnly {
+		// A new subscription has the ID of the payment that started it
+		if err := m.promotions.store.SetSubscriptionCoupon(reference, c.Code); err != nil {
+			return r, err
+		}
+		acct := m.Account(userID)
+		acct.mu.Lock()
+		if acct.subscription != nil && acct.subscription.ID == reference {
+			acct.subscription.Coupon = c.Code
+		}
+		acct.mu.Unlock()
+	}
+	return r, nil
+}
+
+// renewalDiscount returns what the recurring coupon of a subscription takes
+// off its renewal, recorded under the renewal charge's reference
+func (m *Manager) renewalDiscount(p *PersistedSubscription, plan Plan, reference string) (float64, error) {
+	if p.Coupon == "" || m.promotions == nil {
+		return 0, nil
+	}
+	c, err := m.promotions.store.GetCoupon(p.Coupon)
+	if err != nil {
+		return 0, err
+	}
+	if c == nil || c.FirstPeriodOnly || !c.appliesTo(plan.ID) {
+		return 0, nil
+	}
+
+	discount := c.Discount(plan.PriceMonthly)
+	now := time.Now().UTC().Truncate(time.Second)
+	err = m.promotions.store.CreateRedemption(&CouponRedemption{
+		Reference:   reference,
+		Code:        c.Code,
+		UserID:      p.UserID,
+		PlanID:      plan.ID,
+		DiscountUSD: discount,
+		Renewal:     true,
+		Status:      RedemptionRedeemed,
+		CreatedAt:   now,
+		RedeemedAt:  &now,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return discount, nil
+}
+
+// usableCoupon returns a coupon the user can use on a plan
+func (m *Manager) usableCoupon(userID, code string, planID PlanType) (*Coupon, error) {
+	c, err := m.coupon(code)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.usable(planID, time.Now()); err != nil {
+		return nil, err
+	}
+	if userID != "" {
+		used, err := m.promotions.store.HasRedeemed(c.Code, userID)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			return nil, fmt.Errorf("%w: %s was already used on this account", ErrCouponUnavailable, c.Code)
+		}
+	}
+	return c, nil
+}
+
+// coupon looks up a coupon by its code in any case
+func (m *Manager) coupon(code string) (*Coupon, error) {
+	if m.promotions == nil {
+		return nil, fmt.Errorf("%w: promotions not configured", ErrCouponUnavailable)
+	}
+	c, err := m.promotions.store.GetCoupon(strings.ToUpper(strings.TrimSpace(code)))
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, ErrCouponNotFound
+	}
+	return c, nil
+}
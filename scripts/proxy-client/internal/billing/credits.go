@@ -0,0 +1,362 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Pay-as-you-go credits are kept in a double-entry ledger. Every transaction
+// moves an amount from one ledger account to another, so the entries of a
+// transaction always sum to zero and a user's balance is the sum of the
+// entries on their account. Amounts are in micro-USD.
+
+// Ledger accounts besides the per-user accounts
+const (
+	LedgerPayments = "payments" // money received through checkouts
+	LedgerUsage    = "usage"    // credits spent on metered usage
+)
+
+// Credit transaction kinds
+const (
+	CreditTopUp = "topup"
+	CreditUsage = "usage"
+)
+
+// Metering modes for pay-as-you-go usage
+const (
+	MeterPerGB   = "gb"
+	MeterPerHour = "hour"
+)
+
+const microsPerUSD = 1e6
+
+// MinTopUpUSD is the smallest credit purchase
+const MinTopUpUSD = 5.0
+
+// ErrInsufficientCredits is returned when a pay-as-you-go user has no credits left
+var ErrInsufficientCredits = errors.New("insufficient credits - please purchase more credits")
+
+// UserLedger returns the ledger account holding a user's credits
+func UserLedger(userID string) string {
+	return "user:" + userID
+}
+
+// CreditTransaction moves Amount from the Debit account to the Credit account
+type CreditTransaction struct {
+	ID          string
+	Kind        string
+	Reference   string // unique; a reference is only ever posted once
+	Description string
+	Debit       string
+	Credit      string
+	Amount      int64 // micro-USD, positive
+	CreatedAt   time.Time
+}
+
+// CreditEntry is one side of a posted transaction
+type CreditEntry struct {
+	TxnID       string
+	Account     string
+	Kind        string
+	Reference   string
+	Description string
+	Amount      int64 // micro-USD, negative when leaving the account
+	CreatedAt   time.Time
+}
+
+// AmountUSD returns the entry amount in USD
+func (e *CreditEntry) AmountUSD() float64 {
+	return fromMicros(e.Amount)
+}
+
+// CreditStore is the persistence of the credit ledger
+type CreditStore interface {
+	PostCreditTransaction(tx *CreditTransaction) (bool, error)
+	GetLedgerBalance(account string) (int64, error)
+	ListLedgerEntries(account string, limit, offset int) ([]*CreditEntry, int, error)
+	GetUserEmail(userID string) (string, error)
+}
+
+// CreditConfig sets pay-as-you-go prices
+type CreditConfig struct {
+	Metering     string  `yaml:"metering"` // "gb" or "hour"
+	PricePerGB   float64 `yaml:"price_per_gb"`
+	PricePerHour float64 `yaml:"price_per_hour"`
+	// LowBalance is the balance in USD below which the user is alerted
+	LowBalance float64 `yaml:"low_balance"`
+}
+
+// DefaultCreditConfig returns the prices used when none are configured
+func DefaultCreditConfig() CreditConfig {
+	return CreditConfig{
+		Metering:     MeterPerHour,
+		PricePerGB:   3.00,
+		PricePerHour: PAYGHourlyRate,
+		LowBalance:   2.00,
+	}
+}
+
+// cost prices metered usage in USD
+func (c CreditConfig) cost(bytes int64, connected time.Duration) float64 {
+	if c.Metering == MeterPerGB {
+		return float64(bytes) / (1 << 30) * c.PricePerGB
+	}
+	return connected.Hours() * c.PricePerHour
+}
+
+// CreditLedger books credit purchases and metered usage of pay-as-you-go
+// users. Usage is charged each time the manager syncs usage.
+type CreditLedger struct {
+	store    CreditStore
+	notifier Notifier
+	cfg      CreditConfig
+	logger   *logrus.Logger
+}
+
+// NewCreditLedger creates the ledger. notifier may be nil.
+func NewCreditLedger(store CreditStore, notifier Notifier, cfg CreditConfig) *CreditLedger {
+	d := DefaultCreditConfig()
+	if cfg.Metering != MeterPerGB {
+		cfg.Metering = MeterPerHour
+	}
+	if cfg.PricePerGB <= 0 {
+		cfg.PricePerGB = d.PricePerGB
+	}
+	if cfg.PricePerHour <= 0 {
+		cfg.PricePerHour = d.PricePerHour
+	}
+	if cfg.LowBalance <= 0 {
+		cfg.LowBalance = d.LowBalance
+	}
+	return &CreditLedger{
+		store:    store,
+		notifier: notifier,
+		cfg:      cfg,
+		logger:   logrus.StandardLogger(),
+	}
+}
+
+// SetCredits connects the credit ledger used for pay-as-you-go users
+func (m *Manager) SetCredits(l *CreditLedger) { m.credits = l }
+
+// CreditBalance is a user's credit balance in USD
+type CreditBalance struct {
+	Balance    float64 `json:"balance"`
+	Unbilled   float64 `json:"unbilled"` // usage not yet charged
+	LowBalance bool    `json:"low_balance"`
+	Metering   string  `json:"metering"`
+	Price      float64 `json:"price"` // per GB or per hour
+}
+
+// CreditBalance returns the balance of a user
+func (m *Manager) CreditBalance(userID string) (*CreditBalance, error) {
+	if m.credits == nil {
+		return nil, errors.New("credits not configured")
+	}
+	acct := m.Account(userID)
+	balance, err := m.credits.balance(acct)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := m.credits.cfg
+	price := cfg.PricePerHour
+	if cfg.Metering == MeterPerGB {
+		price = cfg.PricePerGB
+	}
+	unbilled := m.credits.unbilled(acct)
+	return &CreditBalance{
+		Balance:    roundAmount(balance),
+		Unbilled:   roundAmount(unbilled),
+		LowBalance: balance-unbilled < cfg.LowBalance,
+		Metering:   cfg.Metering,
+		Price:      price,
+	}, nil
+}
+
+// CreditHistory returns a page of the ledger entries of a user, newest
+// first, and the total number of entries
+func (m *Manager) CreditHistory(userID string, limit, offset int) ([]*CreditEntry, int, error) {
+	if m.credits == nil {
+		return nil, 0, errors.New("credits not configured")
+	}
+	return m.credits.store.ListLedgerEntries(UserLedger(userID), limit, offset)
+}
+
+// TopUpCredits books a paid credit purchase. Posting the same payment
+// reference again has no effect; the result reports whether it was new.
+func (m *Manager) TopUpCredits(userID string, amountUSD float64, reference string) (bool, error) {
+	if m.credits == nil {
+		return false, errors.New("credits not configured")
+	}
+	amount := toMicros(amountUSD)
+	if amount <= 0 {
+		return false, fmt.Errorf("invalid top-up amount %.2f", amountUSD)
+	}
+
+	posted, err := m.credits.store.PostCreditTransaction(&CreditTransaction{
+		ID:          uuid.New().String(),
+		Kind:        CreditTopUp,
+		Reference:   reference,
+		Description: fmt.Sprintf("Credit top-up of $%.2f", amountUSD),
+		Debit:       LedgerPayments,
+		Credit:      UserLedger(userID),
+		Amount:      amount,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to post top-up: %w", err)
+	}
+	m.forgetBalance(userID)
+	return posted, nil
+}
+
+// checkCredits refuses pay-as-you-go connections once the balance no longer
+// covers the usage already metered
+func (m *Manager) checkCredits(acct *Account) error {
+	var balance, owed float64
+	if m.credits != nil {
+		b, err := m.credits.balance(acct)
+		if err != nil {
+			return err
+		}
+		balance, owed = b, m.credits.unbilled(acct)
+	}
+	if err := CheckCredits(&User{ID: acct.UserID, Plan: PlanPAYG, CreditsUsed: owed, CreditsLimit: balance}); err != nil {
+		return ErrInsufficientCredits
+	}
+	return nil
+}
+
+// forgetBalance drops the cached balance of a loaded account
+func (m *Manager) forgetBalance(userID string) {
+	m.mu.RLock()
+	acct, ok := m.accounts[userID]
+	m.mu.RUnlock()
+	if ok {
+		acct.mu.Lock()
+		acct.creditsLoaded = false
+		acct.mu.Unlock()
+	}
+}
+
+// balance returns the credit balance of an account in USD, loading it from
+// the ledger if it is not cached
+func (l *CreditLedger) balance(acct *Account) (float64, error) {
+	acct.mu.RLock()
+	credits, ok := acct.credits, acct.creditsLoaded
+	acct.mu.RUnlock()
+	if ok {
+		return fromMicros(credits), nil
+	}
+
+	credits, err := l.store.GetLedgerBalance(UserLedger(acct.UserID))
+	if err != nil {
+		return 0, fmt.Errorf("failed to load credit balance: %w", err)
+	}
+	acct.mu.Lock()
+	acct.credits, acct.creditsLoaded = credits, true
+	acct.mu.Unlock()
+	return fromMicros(credits), nil
+}
+
+// unbilled prices the usage of an account that has not been charged yet
+func (l *CreditLedger) unbilled(acct *Account) float64 {
+	bytes, connected := acct.Usage.unbilled(time.Now())
+	return l.cfg.cost(bytes, connected)
+}
+
+// meter charges the usage of a pay-as-you-go account since the last time it
+// was metered. Usage of other plans is not charged.
+func (l *CreditLedger) meter(acct *Account, now time.Time) error {
+	bytes, connected := acct.Usage.takeUnbilled(now)
+	plan, err := acct.plan()
+	if err != nil || plan.ID != PlanPAYG {
+		return nil
+	}
+
+	amount := toMicros(l.cfg.cost(bytes, connected))
+	if amount <= 0 {
+		// Too little to charge yet
+		acct.Usage.returnUnbilled(bytes, connected)
+		return nil
+	}
+
+	before, err := l.balance(acct)
+	if err != nil {
+		acct.Usage.returnUnbilled(bytes, connected)
+		return err
+	}
+
+	_, err = l.store.PostCreditTransaction(&CreditTransaction{
+		ID:          uuid.New().String(),
+		Kind:        CreditUsage,
+		Reference:   "USAGE-" + uuid.New().String(),
+		Description: l.usageDescription(bytes, connected),
+		Debit:       UserLedger(acct.UserID),
+		Credit:      LedgerUsage,
+		Amount:      amount,
+		CreatedAt:   now,
+	})
+	if err != nil {
+		acct.Usage.returnUnbilled(bytes, connected)
+		return fmt.Errorf("failed to charge usage: %w", err)
+	}
+
+	acct.mu.Lock()
+	acct.creditsLoaded = false
+	acct.mu.Unlock()
+	after, err := l.balance(acct)
+	if err != nil {
+		return err
+	}
+
+	// Alert once when the balance runs low and once when it runs out
+	if (before >= l.cfg.LowBalance && after < l.cfg.LowBalance) || (before > 0 && after <= 0) {
+		l.notifyLowBalance(acct, after)
+	}
+	return nil
+}
+
+func (l *CreditLedger) usageDescription(bytes int64, connected time.Duration) string {
+	if l.cfg.Metering == MeterPerGB {
+		return fmt.Sprintf("%.3f GB transferred", float64(bytes)/(1<<30))
+	}
+	return fmt.Sprintf("%.2f hours connected", connected.Hours())
+}
+
+func (l *CreditLedger) notifyLowBalance(acct *Account, balance float64) {
+	if l.notifier == nil {
+		return
+	}
+
+	email, err := l.store.GetUserEmail(acct.UserID)
+	if err != nil {
+		l.logger.Warnf("Failed to load email for low balance notice: %v", err)
+		return
+	}
+
+	err = l.notifier.NotifySubscription(&Notice{
+		Event:        EventLowBalance,
+		UserID:       acct.UserID,
+		Email:        email,
+		Subscription: acct.Subscription(),
+		Balance:      roundAmount(balance),
+	})
+	if err != nil {
+		l.logger.Warnf("Failed to send low balance notice: %v", err)
+	}
+}
+
+func toMicros(usd float64) int64 {
+	return int64(math.Round(usd * microsPerUSD))
+}
+
+func fromMicros(micros int64) float64 {
+	return float64(micros) / microsPerUSD
+}
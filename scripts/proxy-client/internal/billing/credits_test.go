@@ -0,0 +1,127 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+// connectedFor backdates the open connections of a user by d
+func connectedFor(manager *Manager, userID string, d time.Duration) {
+	u := manager.Account(userID).Usage
+	u.mu.Lock()
+	u.connectedSince = u.connectedSince.Add(-d)
+	u.mu.Unlock()
+}
+
+func TestCreditsGateAdmission(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	manager.SetCredits(NewCreditLedger(store, nil, CreditConfig{}))
+
+	if _, err := manager.Subscribe("pat", PlanPAYG); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if _, err := manager.OpenConnection("pat"); err != ErrInsufficientCredits {
+		t.Fatalf("Expected ErrInsufficientCredits without credits, got %v", err)
+	}
+
+	if posted, err := manager.TopUpCredits("pat", 5, "CREDIT-1"); err != nil || !posted {
+		t.Fatalf("TopUpCredits failed: %v", err)
+	}
+	// Webhooks may be delivered more than once
+	if posted, _ := manager.TopUpCredits("pat", 5, "CREDIT-1"); posted {
+		t.Error("Expected a repeated top-up to be ignored")
+	}
+
+	release, err := manager.OpenConnection("pat")
+	if err != nil {
+		t.Fatalf("Expected a connection with credits, got %v", err)
+	}
+	defer release()
+
+	// Usage that is metered but not charged yet counts against the balance
+	connectedFor(manager, "pat", 5*time.Hour)
+	if _, err := manager.OpenConnection("pat"); err != ErrInsufficientCredits {
+		t.Errorf("Expected ErrInsufficientCredits once usage exceeds credits, got %v", err)
+	}
+}
+
+func TestCreditsMeteredUsage(t *testing.T) {
+	store := NewMockStore()
+	store.emails["pat"] = "pat@example.com"
+	notifier := &fakeNotifier{}
+	manager := NewManager(store)
+	manager.SetCredits(NewCreditLedger(store, notifier, CreditConfig{}))
+
+	manager.Subscribe("pat", PlanPAYG)
+	manager.TopUpCredits("pat", 5, "CREDIT-1")
+
+	release, _ := manager.OpenConnection("pat")
+	defer release()
+	connectedFor(manager, "pat", 2*time.Hour)
+	if err := manager.SyncUsage(); err != nil {
+		t.Fatalf("SyncUsage failed: %v", err)
+	}
+
+	balance, err := manager.CreditBalance("pat")
+	if err != nil {
+		t.Fatalf("CreditBalance failed: %v", err)
+	}
+	if balance.Balance != 2.6 {
+		t.Errorf("Expected $2.60 left after 2 hours, got %v", balance.Balance)
+	}
+	if len(notifier.notices) != 0 {
+		t.Errorf("Expected no alert above the threshold, got %d", len(notifier.notices))
+	}
+
+	// Time is not charged twice, and the alert is sent once the balance
+	// drops below the threshold
+	connectedFor(manager, "pat", time.Hour)
+	manager.SyncUsage()
+
+	balance, _ = manager.CreditBalance("pat")
+	if balance.Balance != 1.4 {
+		t.Errorf("Expected $1.40 left after 3 hours, got %v", balance.Balance)
+	}
+	if len(notifier.notices) != 1 || notifier.notices[0].Event != EventLowBalance || notifier.notices[0].Balance != 1.4 {
+		t.Fatalf("Expected one low balance notice, got %+v", notifier.notices)
+	}
+
+	// Every transaction balances
+	var sum int64
+	for _, e := range store.entries {
+		sum += e.Amount
+	}
+	if sum != 0 {
+		t.Errorf("Expected the ledger to sum to zero, got %d", sum)
+	}
+
+	history, total, _ := manager.CreditHistory("pat", 10, 0)
+	if total != 3 || history[0].Kind != CreditUsage || history[2].Kind != CreditTopUp {
+		t.Errorf("Unexpected history: %d entries", total)
+	}
+}
+
+func TestCreditsMeterPerGB(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	manager.SetCredits(NewCreditLedger(store, nil, CreditConfig{Metering: MeterPerGB, PricePerGB: 2}))
+
+	manager.Subscribe("pat", PlanPAYG)
+	manager.TopUpCredits("pat", 10, "CREDIT-1")
+	manager.RecordData("pat", 3<<29) // 1.5 GB
+	manager.SyncUsage()
+
+	if balance, _ := manager.CreditBalance("pat"); balance.Balance != 7 {
+		t.Errorf("Expected $7 left after 1.5 GB, got %v", balance.Balance)
+	}
+
+	// Subscription plans are not charged
+	manager.Subscribe("sam", PlanPersonal)
+	manager.TopUpCredits("sam", 10, "CREDIT-2")
+	manager.RecordData("sam", 1<<30)
+	manager.SyncUsage()
+	if balance, _ := manager.CreditBalance("sam"); balance.Balance != 10 {
+		t.Errorf("Expected Personal usage to be free of credits, got %v", balance.Balance)
+	}
+}
@@ -1,57 +1,433 @@
 package billing
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Crypto payments are payment intents: each checkout gets its own deposit
+// address, derived from the wallet's extended public key, and an amount
+// quoted at the current rate that holds until the intent expires. A watcher
+// polls a chain indexer for payments to open intents and marks them paid
+// once the payments have enough confirmations.
+
+// Crypto intent states
+const (
+	IntentPending    = "pending"    // waiting for a payment
+	IntentConfirming = "confirming" // payment seen, waiting for confirmations
+	IntentPaid       = "paid"
+	IntentExpired    = "expired"   // nothing was paid before the quote expired
+	IntentUnderpaid  = "underpaid" // less than the quote arrived; settled by hand
+	IntentLate       = "late"      // paid after the quote expired; settled by hand
 )
 
+var ErrIntentNotReviewable = errors.New("only underpaid or late intents can be accepted")
+
+// CryptoAsset describes a coin payments can be made in
+type CryptoAsset struct {
+	Symbol   string // "btc"
+	Name     string // "bitcoin"; the ID rate sources know the coin by
+	Decimals int    // digits of the base unit amounts are kept in
+	address  func(k *ExtendedPublicKey) string
+}
+
+// CryptoAssets are the coins deposit addresses can be derived for. Ether
+// amounts are kept in gwei, which leaves room in an int64.
+var CryptoAssets = map[string]CryptoAsset{
+	"btc": {Symbol: "btc", Name: "bitcoin", Decimals: 8, address: (*ExtendedPublicKey).BitcoinAddress},
+	"eth": {Symbol: "eth", Name: "ethereum", Decimals: 9, address: (*ExtendedPublicKey).EthereumAddress},
+}
+
+// FormatUnits formats an amount of base units as a decimal number of coins
+func (a CryptoAsset) FormatUnits(units int64) string {
+	r := new(big.Rat).SetFrac(big.NewInt(units), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(a.Decimals)), nil))
+	return r.FloatString(a.Decimals)
+}
+
+// toUnits converts a USD amount to base units at a USD price per coin,
+// rounding up so the quote never falls short
+func (a CryptoAsset) toUnits(amountUSD, priceUSD float64) int64 {
+	return int64(math.Ceil(amountUSD / priceUSD * math.Pow10(a.Decimals)))
+}
+
+// CryptoIntent is a crypto checkout waiting to be paid
+type CryptoIntent struct {
+	ID            string            `json:"id"` // the checkout reference
+	UserID        string            `json:"user_id,omitempty"`
+	Email         string            `json:"email"`
+	PlanID        string            `json:"plan_id"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Asset         string            `json:"asset"`
+	Address       string            `json:"address"`
+	AddressIndex  uint32            `json:"address_index"`
+	AmountUSD     float64           `json:"amount_usd"`
+	Amount        int64             `json:"amount"` // base units quoted
+	Rate          float64           `json:"rate"`   // USD per coin at the quote
+	Received      int64             `json:"received"`
+	Confirmations int               `json:"confirmations"` // of the least confirmed payment
+	TxIDs         []string          `json:"tx_ids,omitempty"`
+	Status        string            `json:"status"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+	CreatedAt     time.Time         `json:"created_at"`
+	PaidAt        *time.Time        `json:"paid_at,omitempty"`
+}
+
+// AmountPaidUSD is the received amount at the quoted rate
+func (i *CryptoIntent) AmountPaidUSD() float64 {
+	asset := CryptoAssets[i.Asset]
+	return float64(i.Received) / math.Pow10(asset.Decimals) * i.Rate
+}
+
+// CryptoStore is the persistence of crypto intents
+type CryptoStore interface {
+	// NextCryptoAddressIndex reserves the next unused derivation index of
+	// an asset's wallet
+	NextCryptoAddressIndex(asset string) (uint32, error)
+	CreateCryptoIntent(i *CryptoIntent) error
+	GetCryptoIntent(id string) (*CryptoIntent, error)
+	UpdateCryptoIntent(i *CryptoIntent) error
+	// ListWatchedCryptoIntents returns pending and confirming intents and
+	// those that expired after since
+	ListWatchedCryptoIntents(since time.Time) ([]*CryptoIntent, error)
+	ListCryptoIntents(status string, limit, offset int) ([]*CryptoIntent, int, error)
+}
+
+// CryptoRates prices coins in USD
+type CryptoRates interface {
+	USDPrice(asset CryptoAsset) (float64, error)
+}
+
+// CryptoConfig sets up crypto payments
+type CryptoConfig struct {
+	// Wallets maps an asset ("btc", "eth") to the extended public key of
+	// the wallet account deposits go to, e.g. m/84'/0'/0' for bitcoin
+	Wallets       map[string]string `yaml:"wallets"`
+	QuoteTTL      time.Duration     `yaml:"quote_ttl"`     // how long a quoted amount holds
+	Confirmations map[string]int    `yaml:"confirmations"` // needed per asset
+	Interval      time.Duration     `yaml:"interval"`      // how often the chain is polled
+	LateWindow    time.Duration     `yaml:"late_window"`   // expired intents are still watched this long
+	RatesURL      string            `yaml:"rates_url"`
+	BitcoinAPI    string            `yaml:"bitcoin_api"`  // Esplora API
+	EthereumAPI   string            `yaml:"ethereum_api"` // Etherscan-compatible API
+	EtherscanKey  string            `yaml:"etherscan_key"`
+}
+
+// DefaultCryptoConfig returns the settings used when none are configured
+func DefaultCryptoConfig() CryptoConfig {
+	return CryptoConfig{
+		QuoteTTL:      30 * time.Minute,
+		Confirmations: map[string]int{"btc": 2, "eth": 12},
+		Interval:      time.Minute,
+		LateWindow:    24 * time.Hour,
+		RatesURL:      "https://api.coingecko.com/api/v3",
+		BitcoinAPI:    "https://blockstream.info/api",
+		EthereumAPI:   "https://api.etherscan.io/api",
+	}
+}
+
+func (c CryptoConfig) withDefaults() CryptoConfig {
+	d := DefaultCryptoConfig()
+	if c.QuoteTTL <= 0 {
+		c.QuoteTTL = d.QuoteTTL
+	}
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.LateWindow <= 0 {
+		c.LateWindow = d.LateWindow
+	}
+	if c.Confirmations == nil {
+		c.Confirmations = make(map[string]int)
+	}
+	for asset, n := range d.Confirmations {
+		if c.Confirmations[asset] <= 0 {
+			c.Confirmations[asset] = n
+		}
+	}
+	if c.RatesURL == "" {
+		c.RatesURL = d.RatesURL
+	}
+	if c.BitcoinAPI == "" {
+		c.BitcoinAPI = d.BitcoinAPI
+	}
+	if c.EthereumAPI == "" {
+		c.EthereumAPI = d.EthereumAPI
+	}
+	return c
+}
+
+// CryptoProvider takes crypto payments to addresses derived per checkout
 type CryptoProvider struct {
-	apiKey string
+	store   CryptoStore
+	rates   CryptoRates
+	wallets map[string]*ExtendedPublicKey
+	cfg     CryptoConfig
 }
 
-func NewCryptoProvider(apiKey string) *CryptoProvider {
-	return &CryptoProvider{apiKey: apiKey}
+// NewCryptoProvider creates the provider. Assets without a valid wallet key
+// can not be paid in.
+func NewCryptoProvider(store CryptoStore, rates CryptoRates, cfg CryptoConfig) (*CryptoProvider, error) {
+	cfg = cfg.withDefaults()
+	c := &CryptoProvider{store: store, rates: rates, wallets: make(map[string]*ExtendedPublicKey), cfg: cfg}
+	for asset, xpub := range cfg.Wallets {
+		asset = strings.ToLower(asset)
+		if _, ok := CryptoAssets[asset]; !ok {
+			return nil, fmt.Errorf("unsupported crypto asset: %s", asset)
+		}
+		key, err := ParseExtendedPublicKey(xpub)
+		if err != nil {
+			return nil, fmt.Errorf("%s wallet: %w", asset, err)
+		}
+		c.wallets[asset] = key
+	}
+	return c, nil
 }
 
 func (c *CryptoProvider) CreateCheckout(req CheckoutRequest) (*CheckoutResponse, error) {
-	amount := 0.0
-	switch req.PlanID {
-	case "personal":
-		amount = 29.0
-	case "team":
-		amount = 99.0
-	case "enterprise":
-		amount = 499.0
-	default:
-		return nil, fmt.Errorf("invalid plan for crypto")
+	amountUSD, err := checkoutPrice(req)
+	if err != nil {
+		return nil, err
 	}
 
-	payCurrency := req.Currency
-	if payCurrency == "" {
-		payCurrency = "btc"
+	symbol := strings.ToLower(req.Currency)
+	if symbol == "" {
+		symbol = "btc"
+	}
+	asset, ok := CryptoAssets[symbol]
+	wallet := c.wallets[symbol]
+	if !ok || wallet == nil || c.store == nil {
+		return nil, fmt.Errorf("unsupported crypto currency: %s", symbol)
 	}
 
-	// Use Static Addresses provided by user
-	// This mode is used for direct P2P payments
-	staticAddresses := map[string]string{
-		"btc": "bc1q2vvsgycwhf7ne0edq7746g4ppdq3c0sc270ml2",
-		"sol": "Ak5kGfQrVqA7YoFgoAk3R7YQ5xeDeuHHmC6wzk2xx9Kj",
-		"eth": "0x7913F9112c7793B5e507F368Fc7da503AF666426",
+	price, err := c.rates.USDPrice(asset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to price %s: %w", symbol, err)
 	}
 
-	address, ok := staticAddresses[payCurrency]
-	if !ok {
-		return nil, fmt.Errorf("unsupported direct crypto: %s", payCurrency)
+	// Deposits go to the external chain of the account: .../0/index
+	index, err := c.store.NextCryptoAddressIndex(symbol)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wallet.Derive(0, index)
+	if err != nil {
+		return nil, err
 	}
 
-	// If API Key is present, we could still use NOWPayments for automated tracking,
-	// but user has specifically requested these static addresses.
-	// For V1, we will show these direct addresses.
+	reference := req.Reference
+	if reference == "" {
+		reference = uuid.New().String()
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	intent := &CryptoIntent{
+		ID:           reference,
+		UserID:       req.Metadata["user_id"],
+		Email:        req.Email,
+		PlanID:       req.PlanID,
+		Metadata:     req.Metadata,
+		Asset:        symbol,
+		Address:      asset.address(key),
+		AddressIndex: index,
+		AmountUSD:    amountUSD,
+		Amount:       asset.toUnits(amountUSD, price),
+		Rate:         price,
+		Status:       IntentPending,
+		ExpiresAt:    now.Add(c.cfg.QuoteTTL),
+		CreatedAt:    now,
+	}
+	if err := c.store.CreateCryptoIntent(intent); err != nil {
+		return nil, err
+	}
 
 	return &CheckoutResponse{
-		PaymentID: fmt.Sprintf("DIRECT-%d", time.Now().Unix()),
-		Address:   address,
-		Amount:    fmt.Sprintf("%.5f", amount), // Real apps would fetch current price, for now USD value
-		Currency:  payCurrency,
+		PaymentID: intent.ID,
+		Address:   intent.Address,
+		Amount:    asset.FormatUnits(intent.Amount),
+		Currency:  strings.ToUpper(symbol),
+		ExpiresAt: &intent.ExpiresAt,
 	}, nil
 }
+
+// Refund is not supported: crypto payments are returned by hand
+func (c *CryptoProvider) Refund(req RefundRequest) (*RefundResult, error) {
+	return nil, ErrRefundUnsupported
+}
+
+// ChainPayment is a transfer to a watched address
+type ChainPayment struct {
+	TxID          string
+	Amount        int64 // base units of the asset
+	Confirmations int
+}
+
+// ChainIndexer looks up the payments an address received
+type ChainIndexer interface {
+	Payments(asset CryptoAsset, address string) ([]ChainPayment, error)
+}
+
+// CryptoWatcher polls the chain for payments to open crypto intents. A
+// confirmed payment is handed to the paid handler, which applies it like any
+// other checkout; the intent is only marked paid once that succeeded.
+type CryptoWatcher struct {
+	store   CryptoStore
+	indexer ChainIndexer
+	paid    func(*CryptoIntent) error
+	cfg     CryptoConfig
+	logger  *logrus.Logger
+}
+
+func NewCryptoWatcher(store CryptoStore, indexer ChainIndexer, cfg CryptoConfig) *CryptoWatcher {
+	return &CryptoWatcher{
+		store:   store,
+		indexer: indexer,
+		cfg:     cfg.withDefaults(),
+		logger:  logrus.StandardLogger(),
+	}
+}
+
+// HandlePaid sets what applies a paid intent. It is called again for the
+// same intent if it fails.
+func (w *CryptoWatcher) HandlePaid(fn func(*CryptoIntent) error) {
+	w.paid = fn
+}
+
+// Intent returns a crypto intent
+func (w *CryptoWatcher) Intent(id string) (*CryptoIntent, error) {
+	return w.store.GetCryptoIntent(id)
+}
+
+// Intents returns a page of crypto intents, newest first, optionally only
+// those in one state
+func (w *CryptoWatcher) Intents(status string, limit, offset int) ([]*CryptoIntent, int, error) {
+	return w.store.ListCryptoIntents(status, limit, offset)
+}
+
+// Run polls every interval until ctx is done
+func (w *CryptoWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Process(time.Now()); err != nil {
+			w.logger.Errorf("Crypto payment watch failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Process checks every watched intent once
+func (w *CryptoWatcher) Process(now time.Time) error {
+	intents, err := w.store.ListWatchedCryptoIntents(now.Add(-w.cfg.LateWindow))
+	if err != nil {
+		return fmt.Errorf("failed to list crypto intents: %w", err)
+	}
+
+	for _, intent := range intents {
+		if err := w.check(intent, now); err != nil {
+			w.logger.Errorf("Failed to check crypto intent %s: %v", intent.ID, err)
+		}
+	}
+	return nil
+}
+
+func (w *CryptoWatcher) check(intent *CryptoIntent, now time.Time) error {
+	asset, ok := CryptoAssets[intent.Asset]
+	if !ok {
+		return fmt.Errorf("unsupported crypto asset: %s", intent.Asset)
+	}
+	payments, err := w.indexer.Payments(asset, intent.Address)
+	if err != nil {
+		return err
+	}
+
+	var received int64
+	var txIDs []string
+	confirmations := math.MaxInt
+	for _, p := range payments {
+		received += p.Amount
+		txIDs = append(txIDs, p.TxID)
+		confirmations = min(confirmations, p.Confirmations)
+	}
+	if received == 0 {
+		confirmations = 0
+	}
+	expired := !now.Before(intent.ExpiresAt)
+
+	status := intent.Status
+	switch {
+	case received == 0:
+		if expired && status == IntentPending {
+			status = IntentExpired
+		}
+	case intent.Status == IntentExpired:
+		// The quote no longer holds
+		status = IntentLate
+	case received < intent.Amount:
+		status = IntentConfirming
+		if expired {
+			status = IntentUnderpaid
+		}
+	case confirmations >= w.cfg.Confirmations[intent.Asset]:
+		status = IntentPaid
+	default:
+		status = IntentConfirming
+	}
+
+	changed := status != intent.Status || received != intent.Received || confirmations != intent.Confirmations
+	intent.Received = received
+	intent.TxIDs = txIDs
+	intent.Confirmations = confirmations
+	if !changed {
+		return nil
+	}
+
+	if status == IntentPaid {
+		if w.paid == nil {
+			return errors.New("no handler for paid intents")
+		}
+		if err := w.paid(intent); err != nil {
+			return fmt.Errorf("failed to apply payment: %w", err)
+		}
+		paidAt := now.UTC()
+		intent.PaidAt = &paidAt
+		w.logger.Infof("Crypto intent %s paid: %s %s", intent.ID, asset.FormatUnits(received), asset.Symbol)
+	}
+	if status != intent.Status && (status == IntentUnderpaid || status == IntentLate) {
+		w.logger.Warnf("Crypto intent %s is %s and needs review", intent.ID, status)
+	}
+	intent.Status = status
+	return w.store.UpdateCryptoIntent(intent)
+}
+
+// Accept settles an underpaid or late intent by hand, applying it as paid
+func (w *CryptoWatcher) Accept(id string, now time.Time) (*CryptoIntent, error) {
+	intent, err := w.store.GetCryptoIntent(id)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != IntentUnderpaid && intent.Status != IntentLate {
+		return nil, ErrIntentNotReviewable
+	}
+	if w.paid == nil {
+		return nil, errors.New("no handler for paid intents")
+	}
+	if err := w.paid(intent); err != nil {
+		return nil, fmt.Errorf("failed to apply payment: %w", err)
+	}
+	paidAt := now.UTC()
+	intent.PaidAt = &paidAt
+	intent.Status = IntentPaid
+	return intent, w.store.UpdateCryptoIntent(intent)
+}
@@ -0,0 +1,260 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fixedRates map[string]float64
+
+func (r fixedRates) USDPrice(asset CryptoAsset) (float64, error) {
+	price, ok := r[asset.Symbol]
+	if !ok {
+		return 0, errors.New("no price")
+	}
+	return price, nil
+}
+
+// fakeChain is a chain indexer whose payments the test sets by address
+type fakeChain map[string][]ChainPayment
+
+func (c fakeChain) Payments(asset CryptoAsset, address string) ([]ChainPayment, error) {
+	return c[address], nil
+}
+
+func newTestCryptoProvider(t *testing.T, store *MockStore) *CryptoProvider {
+	t.Helper()
+	p, err := NewCryptoProvider(store, fixedRates{"btc": 50000}, CryptoConfig{
+		Wallets:  map[string]string{"btc": testZpub},
+		QuoteTTL: 15 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewCryptoProvider failed: %v", err)
+	}
+	return p
+}
+
+func TestCryptoCheckoutQuotesPerInvoiceAddress(t *testing.T) {
+	store := NewMockStore()
+	p := newTestCryptoProvider(t, store)
+
+	first, err := p.CreateCheckout(CheckoutRequest{PlanID: string(PlanPersonal), Email: "ann@example.com", Currency: "BTC", Reference: "REF-1"})
+	if err != nil {
+		t.Fatalf("CreateCheckout failed: %v", err)
+	}
+	// $29 at $50,000 per coin
+	if first.Address != "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu" || first.Amount != "0.00058000" || first.Currency != "BTC" {
+		t.Errorf("Unexpected checkout: %+v", first)
+	}
+	if first.ExpiresAt == nil || time.Until(*first.ExpiresAt) > 15*time.Minute {
+		t.Errorf("Expected the quote to expire within 15 minutes, got %v", first.ExpiresAt)
+	}
+
+	second, err := p.CreateCheckout(CheckoutRequest{PlanID: string(PlanPersonal), Email: "ann@example.com", Currency: "btc"})
+	if err != nil {
+		t.Fatalf("CreateCheckout failed: %v", err)
+	}
+	if second.Address == first.Address || second.PaymentID == "" {
+		t.Errorf("Expected a new address per checkout, got %+v", second)
+	}
+
+	intent := store.intents["REF-1"]
+	if intent.Amount != 58000 || intent.Rate != 50000 || intent.Status != IntentPending || intent.AddressIndex != 0 {
+		t.Errorf("Unexpected intent: %+v", intent)
+	}
+
+	if _, err := p.CreateCheckout(CheckoutRequest{PlanID: string(PlanPersonal), Email: "ann@example.com", Currency: "eth"}); err == nil {
+		t.Error("Expected an error for an asset without a wallet")
+	}
+	if _, err := NewCryptoProvider(store, nil, CryptoConfig{Wallets: map[string]string{"btc": "xpub-nonsense"}}); err == nil {
+		t.Error("Expected an invalid wallet key to be refused")
+	}
+}
+
+func TestCryptoWatcherConfirmsPayment(t *testing.T) {
+	store := NewMockStore()
+	p := newTestCryptoProvider(t, store)
+	checkout, err := p.CreateCheckout(CheckoutRequest{PlanID: string(PlanPersonal), Email: "ann@example.com", Currency: "btc", Reference: "REF-1"})
+	if err != nil {
+		t.Fatalf("CreateCheckout failed: %v", err)
+	}
+
+	chain := fakeChain{}
+	var paid []*CryptoIntent
+	fail := true
+	w := NewCryptoWatcher(store, chain, CryptoConfig{Confirmations: map[string]int{"btc": 2}})
+	w.HandlePaid(func(i *CryptoIntent) error {
+		if fail {
+			return errors.New("database is locked")
+		}
+		paid = append(paid, i)
+		return nil
+	})
+
+	now := time.Now()
+	w.Process(now)
+	if got := store.intents["REF-1"].Status; got != IntentPending {
+		t.Fatalf("Expected a pending intent before any payment, got %s", got)
+	}
+
+	chain[checkout.Address] = []ChainPayment{{TxID: "tx1", Amount: 58000, Confirmations: 0}}
+	w.Process(now)
+	if i := store.intents["REF-1"]; i.Status != IntentConfirming || i.Received != 58000 {
+		t.Fatalf("Expected a confirming intent, got %+v", i)
+	}
+
+	// Once confirmed, the payment is applied; a failure is retried on the
+	// next poll, even after the quote expired
+	chain[checkout.Address][0].Confirmations = 2
+	w.Process(now)
+	if got := store.intents["REF-1"].Status; got != IntentConfirming {
+		t.Fatalf("Expected the intent to stay confirming while applying fails, got %s", got)
+	}
+	fail = false
+	w.Process(now.Add(time.Hour))
+	if i := store.intents["REF-1"]; i.Status != IntentPaid || i.PaidAt == nil || len(i.TxIDs) != 1 {
+		t.Fatalf("Expected a paid intent, got %+v", i)
+	}
+	if len(paid) != 1 || paid[0].ID != "REF-1" {
+		t.Errorf("Expected the payment applied once, got %d", len(paid))
+	}
+
+	w.Process(now.Add(2 * time.Hour))
+	if len(paid) != 1 {
+		t.Errorf("Expected a paid intent not to be applied again, got %d", len(paid))
+	}
+}
+
+func TestCryptoWatcherExpiresAndFlagsForReview(t *testing.T) {
+	store := NewMockStore()
+	p := newTestCryptoProvider(t, store)
+	chain := fakeChain{}
+	var paid []string
+	w := NewCryptoWatcher(store, chain, CryptoConfig{LateWindow: time.Hour})
+	w.HandlePaid(func(i *CryptoIntent) error {
+		paid = append(paid, i.ID)
+		return nil
+	})
+
+	addresses := map[string]string{}
+	for _, ref := range []string{"UNPAID", "SHORT", "LATE"} {
+		checkout, err := p.CreateCheckout(CheckoutRequest{PlanID: string(PlanPersonal), Email: "ann@example.com", Currency: "btc", Reference: ref})
+		if err != nil {
+			t.Fatalf("CreateCheckout failed: %v", err)
+		}
+		addresses[ref] = checkout.Address
+	}
+	chain[addresses["SHORT"]] = []ChainPayment{{TxID: "tx1", Amount: 50000, Confirmations: 6}}
+
+	expiry := store.intents["UNPAID"].ExpiresAt
+	w.Process(expiry.Add(time.Second))
+	for ref, want := range map[string]string{"UNPAID": IntentExpired, "SHORT": IntentUnderpaid, "LATE": IntentExpired} {
+		if got := store.intents[ref].Status; got != want {
+			t.Errorf("%s: expected %s, got %s", ref, want, got)
+		}
+	}
+
+	// Money arriving after the quote expired is kept for review
+	chain[addresses["LATE"]] = []ChainPayment{{TxID: "tx2", Amount: 58000, Confirmations: 6}}
+	w.Process(expiry.Add(time.Minute))
+	if got := store.intents["LATE"].Status; got != IntentLate {
+		t.Errorf("Expected a late intent, got %s", got)
+	}
+	if len(paid) != 0 {
+		t.Errorf("Expected nothing applied without review, got %v", paid)
+	}
+
+	// Accepted by hand, the payment is applied
+	if _, err := w.Accept("SHORT", time.Now()); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if got := store.intents["SHORT"].Status; got != IntentPaid || len(paid) != 1 {
+		t.Errorf("Expected the accepted intent paid, got %s and %v", got, paid)
+	}
+	if _, err := w.Accept("UNPAID", time.Now()); !errors.Is(err, ErrIntentNotReviewable) {
+		t.Errorf("Expected ErrIntentNotReviewable, got %v", err)
+	}
+}
+
+func TestEsploraIndexer(t *testing.T) {
+	const address = "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/address/" + address + "/txs":
+			fmt.Fprintf(w, `[
+				{"txid":"a","status":{"confirmed":true,"block_height":100},"vout":[{"scriptpubkey_address":%q,"value":30000},{"scriptpubkey_address":"bc1qother","value":5}]},
+				{"txid":"b","status":{"confirmed":false},"vout":[{"scriptpubkey_address":%q,"value":28000}]},
+				{"txid":"c","status":{"confirmed":true,"block_height":101},"vout":[{"scriptpubkey_address":"bc1qother","value":1000}]}
+			]`, address, address)
+		case "/blocks/tip/height":
+			fmt.Fprint(w, "102")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	indexer := NewChainIndexers(CryptoConfig{BitcoinAPI: server.URL})
+	payments, err := indexer.Payments(CryptoAssets["btc"], address)
+	if err != nil {
+		t.Fatalf("Payments failed: %v", err)
+	}
+	want := []ChainPayment{{TxID: "a", Amount: 30000, Confirmations: 3}, {TxID: "b", Amount: 28000}}
+	if fmt.Sprint(payments) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, payments)
+	}
+}
+
+func TestEtherscanIndexer(t *testing.T) {
+	const address = "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("address") != address || r.URL.Query().Get("apikey") != "key" {
+			fmt.Fprint(w, `{"status":"0","message":"No transactions found","result":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"1","message":"OK","result":[
+			{"hash":"0xa","to":"0x7e5f4552091a69125d5dfcb7b8c2659029395bdf","value":"12000000000000000","confirmations":"15","isError":"0"},
+			{"hash":"0xb","to":"0x7e5f4552091a69125d5dfcb7b8c2659029395bdf","value":"5000000000000000","confirmations":"3","isError":"1"},
+			{"hash":"0xc","to":"0x0000000000000000000000000000000000000001","value":"1","confirmations":"3","isError":"0"}
+		]}`)
+	}))
+	defer server.Close()
+
+	indexer := NewChainIndexers(CryptoConfig{EthereumAPI: server.URL, EtherscanKey: "key"})
+	payments, err := indexer.Payments(CryptoAssets["eth"], address)
+	if err != nil {
+		t.Fatalf("Payments failed: %v", err)
+	}
+	// 0.012 ETH in gwei; failed transactions don't count
+	if len(payments) != 1 || payments[0].Amount != 12000000 || payments[0].Confirmations != 15 {
+		t.Errorf("Unexpected payments: %v", payments)
+	}
+
+	if payments, err := indexer.Payments(CryptoAssets["eth"], "0x0000000000000000000000000000000000000002"); err != nil || payments != nil {
+		t.Errorf("Expected no payments, got %v, %v", payments, err)
+	}
+}
+
+func TestCoinGeckoRates(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{%q:{"usd":64000.5}}`, r.URL.Query().Get("ids"))
+	}))
+	defer server.Close()
+
+	rates := NewCoinGeckoRates(server.URL)
+	for i := 0; i < 2; i++ {
+		price, err := rates.USDPrice(CryptoAssets["btc"])
+		if err != nil || price != 64000.5 {
+			t.Fatalf("Expected 64000.5, got %v, %v", price, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the price to be cached, got %d requests", requests)
+	}
+}
@@ -1,6 +1,10 @@
 package billing
 
-import "strings"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
 
 // CurrencyCode represents a supported currency
 type CurrencyCode string
@@ -10,37 +14,123 @@ const (
 	CurrencyNGN CurrencyCode = "NGN"
 	CurrencyEUR CurrencyCode = "EUR"
 	CurrencyGBP CurrencyCode = "GBP"
+	CurrencyGHS CurrencyCode = "GHS"
+	CurrencyKES CurrencyCode = "KES"
+	CurrencyZAR CurrencyCode = "ZAR"
 )
 
-// ExchangeRates holds static rates relative to USD
-var ExchangeRates = map[CurrencyCode]float64{
-	CurrencyUSD: 1.0,
-	CurrencyNGN: 1515.0, // Updated static rate
-	CurrencyEUR: 0.92,
-	CurrencyGBP: 0.79,
+// Currency describes how amounts in a currency are shown and rounded
+type Currency struct {
+	Code     CurrencyCode
+	Symbol   string
+	Decimals int // digits of the minor unit charged by gateways
+
+	// Step is what list prices are rounded up to, e.g. 50 for ₦50.
+	// Zero rounds to the minor unit.
+	Step float64
+	// CharmStep enables psychological pricing: list prices are rounded up
+	// to a multiple of it, less one, e.g. ₦44,000 becomes ₦43,999. It
+	// applies only where psychological pricing is switched on.
+	CharmStep float64
+
+	// Rate is the built-in rate per USD, used until live rates are known
+	Rate float64
+}
+
+// Currencies are the currencies prices can be shown and charged in
+var Currencies = map[CurrencyCode]Currency{
+	CurrencyUSD: {Code: CurrencyUSD, Symbol: "$", Decimals: 2, Rate: 1},
+	CurrencyEUR: {Code: CurrencyEUR, Symbol: "€", Decimals: 2, Rate: 0.92},
+	CurrencyGBP: {Code: CurrencyGBP, Symbol: "£", Decimals: 2, Rate: 0.79},
+	CurrencyNGN: {Code: CurrencyNGN, Symbol: "₦", Decimals: 2, Step: 50, CharmStep: 500, Rate: 1515},
+	CurrencyGHS: {Code: CurrencyGHS, Symbol: "GH₵", Decimals: 2, Step: 0.5, Rate: 15.5},
+	CurrencyKES: {Code: CurrencyKES, Symbol: "KSh", Decimals: 2, Step: 5, Rate: 129},
+	CurrencyZAR: {Code: CurrencyZAR, Symbol: "R", Decimals: 2, Step: 1, Rate: 18.2},
+}
+
+// currencyOf returns a supported currency, or USD
+func currencyOf(code CurrencyCode) Currency {
+	if c, ok := Currencies[CurrencyCode(strings.ToUpper(string(code)))]; ok {
+		return c
+	}
+	return Currencies[CurrencyUSD]
 }
 
-// ConvertPrice converts a USD price to the target currency
+// Round rounds an amount to the minor unit
+func (c Currency) Round(amount float64) float64 {
+	scale := math.Pow10(c.Decimals)
+	return math.Round(amount*scale) / scale
+}
+
+// MinorUnits converts an amount to the minor unit, e.g. kobo or cents
+func (c Currency) MinorUnits(amount float64) int64 {
+	return int64(math.Round(amount * math.Pow10(c.Decimals)))
+}
+
+// Format shows an amount with the currency's symbol and grouped thousands,
+// e.g. ₦43,999.00
+func (c Currency) Format(amount float64) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	digits := strconv.FormatFloat(c.Round(amount), 'f', c.Decimals, 64)
+	whole, frac, _ := strings.Cut(digits, ".")
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+	if frac != "" {
+		whole += "." + frac
+	}
+	return sign + c.Symbol + whole
+}
+
+// FormatAmount shows an amount in a currency, or in USD if it is unknown
+func FormatAmount(amount float64, code CurrencyCode) string {
+	return currencyOf(code).Format(amount)
+}
+
+// RoundPrice rounds a list price up to the currency's step, or to a charm
+// price when charm is set
+func (c Currency) RoundPrice(amount float64, charm bool) float64 {
+	if amount <= 0 {
+		return 0
+	}
+	// Float noise like 43950.0000001 must not round up a whole step
+	amount = c.Round(amount)
+	switch {
+	case charm && c.CharmStep > 0:
+		return math.Ceil(amount/c.CharmStep)*c.CharmStep - 1
+	case c.Step > 0:
+		return c.Round(math.Ceil(amount/c.Step) * c.Step)
+	}
+	return amount
+}
+
+// ConvertPrice converts a USD list price, such as a plan's, to the target
+// currency at the current rate and rounds it by the currency's rules
 func ConvertPrice(priceUSD float64, target CurrencyCode) float64 {
-	rate, exists := ExchangeRates[target]
-	if !exists {
-		return priceUSD // Default to USD if unknown
+	return ExchangeRates().QuotePrice(priceUSD, target).Amount
+}
+
+// ConvertAmount converts a USD amount to the target currency at the current
+// rate, rounded to the minor unit
+func ConvertAmount(amountUSD float64, target CurrencyCode) float64 {
+	return ExchangeRates().QuoteAmount(amountUSD, target).Amount
+}
+
+// ConvertToUSD converts an amount in the given currency to USD
+func ConvertToUSD(amount float64, from CurrencyCode) float64 {
+	rate := ExchangeRates().Rate(from)
+	if rate == 0 {
+		return amount // Assume USD if unknown
 	}
-	return priceUSD * rate
+	return math.Round(amount/rate*100) / 100
 }
 
 // GetCurrencySymbol returns the display symbol
 func GetCurrencySymbol(c CurrencyCode) string {
-	switch c {
-	case CurrencyNGN:
-		return "₦"
-	case CurrencyEUR:
-		return "€"
-	case CurrencyGBP:
-		return "£"
-	default:
-		return "$"
-	}
+	return currencyOf(c).Symbol
 }
 
 // MapRegionToCurrency returns the likely currency for a country code
@@ -49,6 +139,12 @@ func MapRegionToCurrency(countryCode string) CurrencyCode {
 	switch countryCode {
 	case "NG":
 		return CurrencyNGN
+	case "GH":
+		return CurrencyGHS
+	case "KE":
+		return CurrencyKES
+	case "ZA":
+		return CurrencyZAR
 	case "GB":
 		return CurrencyGBP
 	case "DE", "FR", "IT", "ES", "NL", "BE", "AT", "IE", "FI": // Eurozone subset
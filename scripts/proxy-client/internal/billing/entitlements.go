@@ -0,0 +1,180 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Feature is something a plan may or may not include
+type Feature string
+
+const (
+	FeatureProtocol          Feature = "protocol"
+	FeatureCountry           Feature = "country"
+	FeatureProtocolSelection Feature = "protocol_selection"
+	FeatureAPIAccess         Feature = "api_access"
+	FeatureStickySessions    Feature = "sticky_sessions"
+	FeatureTeams             Feature = "teams"
+	FeatureSubUsers          Feature = "sub_users"
+)
+
+// ErrNotEntitled matches every EntitlementError
+var ErrNotEntitled = errors.New("feature not included in plan")
+
+// EntitlementError is returned when a plan does not include a feature. It
+// names the cheapest plan on offer that does, if there is one.
+type EntitlementError struct {
+	Feature   Feature  `json:"feature"`
+	Value     string   `json:"value,omitempty"` // the protocol or country asked for
+	Plan      PlanType `json:"current_plan"`
+	UpgradeTo PlanType `json:"upgrade_to,omitempty"`
+}
+
+func (e *EntitlementError) Error() string {
+	msg := fmt.Sprintf("your %s plan does not include %s", planName(e.Plan), e.describe())
+	if e.UpgradeTo != "" {
+		msg += fmt.Sprintf(" - upgrade to %s", planName(e.UpgradeTo))
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, ErrNotEntitled) hold for entitlement errors
+func (e *EntitlementError) Is(target error) bool {
+	return target == ErrNotEntitled
+}
+
+func (e *EntitlementError) describe() string {
+	switch e.Feature {
+	case FeatureProtocol:
+		return fmt.Sprintf("the %s protocol", e.Value)
+	case FeatureCountry:
+		return fmt.Sprintf("exit country %s", e.Value)
+	case FeatureProtocolSelection:
+		return "protocol selection"
+	case FeatureAPIAccess:
+		return "API access"
+	case FeatureStickySessions:
+		return "sticky sessions"
+	case FeatureTeams:
+		return "team management"
+	case FeatureSubUsers:
+		return "sub-users"
+	}
+	return string(e.Feature)
+}
+
+func planName(id PlanType) string {
+	if p, err := GetPlan(id); err == nil {
+		return p.Name
+	}
+	return string(id)
+}
+
+// notEntitled builds the error for a feature the plan lacks
+func notEntitled(plan PlanType, feature Feature, value string, grants func(PlanFlags) bool) error {
+	return &EntitlementError{
+		Feature:   feature,
+		Value:     value,
+		Plan:      plan,
+		UpgradeTo: cheapestPlanWith(grants),
+	}
+}
+
+// cheapestPlanWith returns the cheapest plan on offer whose flags pass grants
+func cheapestPlanWith(grants func(PlanFlags) bool) PlanType {
+	var best PlanType
+	price := math.Inf(1)
+	for _, p := range Plans().List() {
+		if grants(p.Flags) && p.PriceMonthly < price {
+			best, price = p.ID, p.PriceMonthly
+		}
+	}
+	return best
+}
+
+// grantsFeature returns the test for an on/off feature of a plan
+func grantsFeature(feature Feature) func(PlanFlags) bool {
+	return func(f PlanFlags) bool {
+		switch feature {
+		case FeatureProtocolSelection:
+			return f.ProtocolSelection
+		case FeatureAPIAccess:
+			return f.APIAccess
+		case FeatureStickySessions:
+			return f.StickySessions
+		case FeatureTeams:
+			return f.Seats != 0
+		case FeatureSubUsers:
+			return f.SubUsers != 0
+		}
+		return false
+	}
+}
+
+// Entitlements answers what a user's plan includes. Every listener and API
+// route asks here, so denials look the same everywhere. An empty user ID is
+// the local user, as with connections.
+type Entitlements struct {
+	manager *Manager
+}
+
+// Entitlements returns the entitlement service of the manager. Without a
+// manager nothing is gated.
+func (m *Manager) Entitlements() *Entitlements {
+	if m == nil {
+		return nil
+	}
+	return &Entitlements{manager: m}
+}
+
+func (e *Entitlements) plan(userID string) Plan {
+	return e.manager.CurrentPlan(e.manager.userOrLocal(userID))
+}
+
+// Check reports whether the user's plan includes a feature
+func (e *Entitlements) Check(userID string, feature Feature) error {
+	if e == nil {
+		return nil
+	}
+	plan := e.plan(userID)
+	if grantsFeature(feature)(plan.Flags) {
+		return nil
+	}
+	return notEntitled(plan.ID, feature, "", grantsFeature(feature))
+}
+
+// CheckProtocol reports whether the user's plan includes a protocol
+func (e *Entitlements) CheckProtocol(userID, protocol string) error {
+	if e == nil {
+		return nil
+	}
+	plan := e.plan(userID)
+	if plan.Flags.AllowsProtocol(protocol) {
+		return nil
+	}
+	return notEntitled(plan.ID, FeatureProtocol, protocol, func(f PlanFlags) bool { return f.AllowsProtocol(protocol) })
+}
+
+// CheckCountry reports whether the user's plan includes an exit country
+func (e *Entitlements) CheckCountry(userID, country string) error {
+	if e == nil {
+		return nil
+	}
+	plan := e.plan(userID)
+	if plan.Flags.AllowsCountry(country) {
+		return nil
+	}
+	return notEntitled(plan.ID, FeatureCountry, country, func(f PlanFlags) bool { return f.AllowsCountry(country) })
+}
+
+// CheckRotation reports whether the user's plan includes a rotation setting:
+// sticky sessions and the exit country
+func (e *Entitlements) CheckRotation(userID string, sticky bool, country string) error {
+	if sticky {
+		if err := e.Check(userID, FeatureStickySessions); err != nil {
+			return err
+		}
+	}
+	return e.CheckCountry(userID, country)
+}
@@ -0,0 +1,57 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEntitlements(t *testing.T) {
+	manager := NewManager(NewMockStore())
+	manager.SetLocalUser("sam")
+	if _, err := manager.Subscribe("sam", PlanStarter); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	e := manager.Entitlements()
+
+	if err := e.CheckProtocol("", "https"); err != nil {
+		t.Errorf("Expected Starter to include HTTPS, got %v", err)
+	}
+	err := e.CheckProtocol("", "socks5")
+	var denied *EntitlementError
+	if !errors.As(err, &denied) || !errors.Is(err, ErrNotEntitled) {
+		t.Fatalf("Expected an entitlement error, got %v", err)
+	}
+	if denied.Plan != PlanStarter || denied.Feature != FeatureProtocol || denied.Value != "socks5" || denied.UpgradeTo != PlanPAYG {
+		t.Errorf("Unexpected denial: %+v", denied)
+	}
+
+	if err := e.CheckRotation("sam", false, "us"); err != nil {
+		t.Errorf("Expected Starter to include US exits, got %v", err)
+	}
+	if err := e.CheckRotation("sam", false, "DE"); !errors.As(err, &denied) || denied.Feature != FeatureCountry || denied.UpgradeTo != PlanPAYG {
+		t.Errorf("Expected a country denial, got %v", err)
+	}
+	if err := e.CheckRotation("sam", true, ""); !errors.As(err, &denied) || denied.Feature != FeatureStickySessions || denied.UpgradeTo != PlanPersonal {
+		t.Errorf("Expected a sticky session denial, got %v", err)
+	}
+	if err := e.Check("sam", FeatureAPIAccess); !errors.As(err, &denied) || denied.UpgradeTo != PlanPersonal {
+		t.Errorf("Expected an API access denial, got %v", err)
+	}
+
+	if _, err := manager.Subscribe("sam", PlanPersonal); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	for _, f := range []Feature{FeatureAPIAccess, FeatureProtocolSelection, FeatureStickySessions} {
+		if err := e.Check("sam", f); err != nil {
+			t.Errorf("Expected Personal to include %s, got %v", f, err)
+		}
+	}
+	if err := e.CheckProtocol("sam", "shadowsocks"); err != nil {
+		t.Errorf("Expected Personal to include Shadowsocks, got %v", err)
+	}
+
+	var none *Manager
+	if err := none.Entitlements().CheckProtocol("", "socks5"); err != nil {
+		t.Errorf("Expected no gating without a manager, got %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RateSource fetches exchange rates per USD
+type RateSource interface {
+	FetchRates() (map[CurrencyCode]float64, error)
+}
+
+// RateStore persists the last rates fetched and the quotes checkouts were
+// charged at
+type RateStore interface {
+	// LoadExchangeRates returns the last rates saved, or none
+	LoadExchangeRates() (map[CurrencyCode]float64, time.Time, error)
+	SaveExchangeRates(rates map[CurrencyCode]float64, fetchedAt time.Time) error
+	SavePriceQuote(q *PriceQuote) error
+}
+
+// PriceQuote is a USD amount converted at a known rate. A checkout locks the
+// quote it charges, so the payment is recorded at that rate whatever the rate
+// is when the payment arrives.
+type PriceQuote struct {
+	Reference string       `json:"reference,omitempty"`
+	Currency  CurrencyCode `json:"currency"`
+	Rate      float64      `json:"rate"` // units of the currency per USD
+	AmountUSD float64      `json:"amount_usd"`
+	Amount    float64      `json:"amount"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// MinorUnits returns the quoted amount in the currency's minor unit
+func (q *PriceQuote) MinorUnits() int64 {
+	return currencyOf(q.Currency).MinorUnits(q.Amount)
+}
+
+// ExchangeConfig sets up exchange rates
+type ExchangeConfig struct {
+	URL   string        `yaml:"url"`  // JSON rates per USD, e.g. https://open.er-api.com/v6/latest/USD
+	File  string        `yaml:"file"` // the same JSON, used when the URL fails
+	TTL   time.Duration `yaml:"ttl"`  // how long fetched rates are used
+	Retry time.Duration `yaml:"retry"`
+	// Psychological lists the currencies list prices are charm priced in,
+	// e.g. NGN for ₦43,999 rather than ₦43,950
+	Psychological []CurrencyCode `yaml:"psychological"`
+}
+
+// DefaultExchangeConfig returns the settings used when none are configured
+func DefaultExchangeConfig() ExchangeConfig {
+	return ExchangeConfig{
+		URL:   "https://open.er-api.com/v6/latest/USD",
+		TTL:   6 * time.Hour,
+		Retry: 5 * time.Minute,
+	}
+}
+
+// RateTable holds the exchange rates prices are converted at. Rates are
+// fetched from the sources in order and kept for the TTL; the last good
+// rates are saved, so a restart without network keeps them.
+type RateTable struct {
+	store   RateStore
+	sources []RateSource
+	cfg     ExchangeConfig
+	logger  *logrus.Logger
+
+	mu          sync.RWMutex
+	rates       map[CurrencyCode]float64
+	fetchedAt   time.Time
+	nextAttempt time.Time
+}
+
+// NewRateTable returns rates from the configured sources, starting from the
+// rates last saved in store, or the built-in rates if there are none
+func NewRateTable(store RateStore, cfg ExchangeConfig) *RateTable {
+	var sources []RateSource
+	if cfg.URL != "" {
+		sources = append(sources, NewHTTPRateSource(cfg.URL))
+	}
+	if cfg.File != "" {
+		sources = append(sources, FileRateSource{Path: cfg.File})
+	}
+	return newRateTable(store, sources, cfg)
+}
+
+func newRateTable(store RateStore, sources []RateSource, cfg ExchangeConfig) *RateTable {
+	d := DefaultExchangeConfig()
+	if cfg.TTL <= 0 {
+		cfg.TTL = d.TTL
+	}
+	if cfg.Retry <= 0 {
+		cfg.Retry = d.Retry
+	}
+
+	t := &RateTable{store: store, sources: sources, cfg: cfg, logger: logrus.StandardLogger(), rates: builtinRates()}
+	if store != nil {
+		saved, fetchedAt, err := store.LoadExchangeRates()
+		if err != nil {
+			t.logger.Warnf("Failed to load saved exchange rates: %v", err)
+		}
+		for code, rate := range saved {
+			t.rates[code] = rate
+		}
+		if len(saved) > 0 {
+			t.fetchedAt = fetchedAt
+		}
+	}
+	return t
+}
+
+func builtinRates() map[CurrencyCode]float64 {
+	rates := make(map[CurrencyCode]float64, len(Currencies))
+	for code, c := range Currencies {
+		rates[code] = c.Rate
+	}
+	return rates
+}
+
+var (
+	ratesMu sync.RWMutex
+	rates   = newRateTable(nil, nil, ExchangeConfig{})
+)
+
+// ExchangeRates returns the exchange rates in use
+func ExchangeRates() *RateTable {
+	ratesMu.RLock()
+	defer ratesMu.RUnlock()
+	return rates
+}
+
+// UseExchangeRates makes t the exchange rates in use
+func UseExchangeRates(t *RateTable) {
+	ratesMu.Lock()
+	rates = t
+	ratesMu.Unlock()
+}
+
+// Rate returns the units of a currency per USD, or 0 for an unknown
+// currency
+func (t *RateTable) Rate(code CurrencyCode) float64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.rates[CurrencyCode(strings.ToUpper(string(code)))]
+}
+
+// FetchedAt returns when the rates in use were fetched; zero for the
+// built-in rates
+func (t *RateTable) FetchedAt() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.fetchedAt
+}
+
+// QuotePrice converts a list price, rounded by the currency's price rules
+func (t *RateTable) QuotePrice(priceUSD float64, code CurrencyCode) PriceQuote {
+	q := t.quote(priceUSD, code)
+	c := currencyOf(q.Currency)
+	q.Amount = c.RoundPrice(priceUSD*q.Rate, t.charm(c.Code))
+	return q
+}
+
+// QuoteAmount converts an amount, such as a prorated charge, rounded to the
+// minor unit
+func (t *RateTable) QuoteAmount(amountUSD float64, code CurrencyCode) PriceQuote {
+	q := t.quote(amountUSD, code)
+	q.Amount = currencyOf(q.Currency).Round(amountUSD * q.Rate)
+	return q
+}
+
+func (t *RateTable) quote(amountUSD float64, code CurrencyCode) PriceQuote {
+	c := currencyOf(code)
+	rate := t.Rate(c.Code)
+	if rate <= 0 {
+		c, rate = Currencies[CurrencyUSD], 1
+	}
+	return PriceQuote{Currency: c.Code, Rate: rate, AmountUSD: amountUSD}
+}
+
+func (t *RateTable) charm(code CurrencyCode) bool {
+	for _, c := range t.cfg.Psychological {
+		if strings.EqualFold(string(c), string(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lock records a quote as the price of the payment with the reference
+func (t *RateTable) Lock(reference string, q PriceQuote) (*PriceQuote, error) {
+	q.Reference = reference
+	q.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	if t.store != nil && reference != "" {
+		if err := t.store.SavePriceQuote(&q); err != nil {
+			return nil, fmt.Errorf("failed to lock price quote: %w", err)
+		}
+	}
+	return &q, nil
+}
+
+// Run refreshes the rates once they are older than the TTL, until ctx is
+// done
+func (t *RateTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if err := t.Process(time.Now()); err != nil {
+			t.logger.Warnf("Exchange rate refresh failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Process fetches new rates if the ones in use are older than the TTL. A
+// failed fetch keeps the rates in use and is retried after cfg.Retry.
+func (t *RateTable) Process(now time.Time) error {
+	t.mu.RLock()
+	due := now.Sub(t.fetchedAt) >= t.cfg.TTL && !now.Before(t.nextAttempt)
+	t.mu.RUnlock()
+	if !due || len(t.sources) == 0 {
+		return nil
+	}
+
+	fetched, err := t.fetch()
+	if err != nil {
+		t.mu.Lock()
+		t.nextAttempt = now.Add(t.cfg.Retry)
+		t.mu.Unlock()
+		return err
+	}
+
+	t.mu.Lock()
+	for code, rate := range fetched {
+		t.rates[code] = rate
+	}
+	t.fetchedAt = now
+	t.nextAttempt = time.Time{}
+	t.mu.Unlock()
+
+	if t.store != nil {
+		if err := t.store.SaveExchangeRates(fetched, now); err != nil {
+			return fmt.Errorf("failed to save exchange rates: %w", err)
+		}
+	}
+	return nil
+}
+
+// fetch returns the rates of the first source that has them
+func (t *RateTable) fetch() (map[CurrencyCode]float64, error) {
+	var errs []error
+	for _, source := range t.sources {
+		fetched, err := source.FetchRates()
+		if err == nil {
+			return fetched, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// HTTPRateSource fetches rates from a JSON API with a "rates" object, such as
+// open.er-api.com or exchangerate.host
+type HTTPRateSource struct {
+	URL    string
+	client *http.Client
+}
+
+func NewHTTPRateSource(url string) *HTTPRateSource {
+	return &HTTPRateSource{URL: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *HTTPRateSource) FetchRates() (map[CurrencyCode]float64, error) {
+	resp, err := s.client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("exchange rates: %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return parseRates(body)
+}
+
+// FileRateSource reads rates from a file in the JSON of HTTPRateSource
+type FileRateSource struct {
+	Path string
+}
+
+func (s FileRateSource) FetchRates() (map[CurrencyCode]float64, error) {
+	body, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRates(body)
+}
+
+// parseRates reads the supported currencies from rates quoted against USD or
+// another base
+func parseRates(body []byte) (map[CurrencyCode]float64, error) {
+	var doc struct {
+		Base     string             `json:"base"`
+		BaseCode string             `json:"base_code"`
+		Rates    map[string]float64 `json:"rates"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("invalid exchange rates: %w", err)
+	}
+
+	// Rates against another base are rebased to USD
+	perUSD := 1.0
+	if base := strings.ToUpper(doc.Base + doc.BaseCode); base != "" && base != string(CurrencyUSD) {
+		perUSD = doc.Rates[string(CurrencyUSD)]
+		if perUSD <= 0 {
+			return nil, fmt.Errorf("invalid exchange rates: no USD rate against %s", base)
+		}
+	}
+
+	rates := make(map[CurrencyCode]float64)
+	for code := range Currencies {
+		if rate := doc.Rates[string(code)]; rate > 0 {
+			rates[code] = rate / perUSD
+		}
+	}
+	rates[CurrencyUSD] = 1
+	if len(rates) == 1 {
+		return nil, errors.New("invalid exchange rates: no supported currency")
+	}
+	return rates, nil
+}
@@ -0,0 +1,184 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memoryRateStore keeps saved rates and quotes in memory
+type memoryRateStore struct {
+	rates     map[CurrencyCode]float64
+	fetchedAt time.Time
+	quotes    map[string]*PriceQuote
+}
+
+func (s *memoryRateStore) LoadExchangeRates() (map[CurrencyCode]float64, time.Time, error) {
+	return s.rates, s.fetchedAt, nil
+}
+
+func (s *memoryRateStore) SaveExchangeRates(rates map[CurrencyCode]float64, fetchedAt time.Time) error {
+	s.rates, s.fetchedAt = rates, fetchedAt
+	return nil
+}
+
+func (s *memoryRateStore) SavePriceQuote(q *PriceQuote) error {
+	if s.quotes == nil {
+		s.quotes = make(map[string]*PriceQuote)
+	}
+	s.quotes[q.Reference] = q
+	return nil
+}
+
+type failingSource struct{}
+
+func (failingSource) FetchRates() (map[CurrencyCode]float64, error) {
+	return nil, errors.New("network down")
+}
+
+func TestCurrencyRounding(t *testing.T) {
+	ngn := Currencies[CurrencyNGN]
+	for _, tc := range []struct {
+		amount float64
+		charm  bool
+		want   float64
+	}{
+		{43935, false, 43950},
+		{43950, false, 43950},
+		{43935, true, 43999},
+		{12104.85, true, 12499},
+		{0, true, 0},
+	} {
+		if got := ngn.RoundPrice(tc.amount, tc.charm); got != tc.want {
+			t.Errorf("RoundPrice(%v, %v): expected %v, got %v", tc.amount, tc.charm, tc.want, got)
+		}
+	}
+
+	// Currencies without charm prices keep their own rules
+	if got := Currencies[CurrencyKES].RoundPrice(3741, true); got != 3745 {
+		t.Errorf("Expected KSh 3745, got %v", got)
+	}
+	if got := Currencies[CurrencyUSD].RoundPrice(26.675, false); got != 26.68 {
+		t.Errorf("Expected $26.68, got %v", got)
+	}
+	if got := ngn.MinorUnits(43950); got != 4395000 {
+		t.Errorf("Expected 4395000 kobo, got %d", got)
+	}
+}
+
+func TestRateTableQuotes(t *testing.T) {
+	store := &memoryRateStore{rates: map[CurrencyCode]float64{CurrencyNGN: 1600}, fetchedAt: time.Now()}
+	rates := newRateTable(store, nil, ExchangeConfig{Psychological: []CurrencyCode{"ngn"}})
+
+	// Saved rates are used over the built-in ones
+	if got := rates.Rate(CurrencyNGN); got != 1600 {
+		t.Fatalf("Expected the saved rate, got %v", got)
+	}
+	if got := rates.Rate(CurrencyGHS); got != Currencies[CurrencyGHS].Rate {
+		t.Errorf("Expected the built-in GHS rate, got %v", got)
+	}
+
+	if q := rates.QuotePrice(29, CurrencyNGN); q.Amount != 46499 || q.Rate != 1600 || q.AmountUSD != 29 {
+		t.Errorf("Unexpected charm priced quote: %+v", q)
+	}
+	if q := rates.QuoteAmount(12.345, CurrencyNGN); q.Amount != 19752 {
+		t.Errorf("Expected an exact amount, got %+v", q)
+	}
+	if q := rates.QuotePrice(29, "XYZ"); q.Currency != CurrencyUSD || q.Amount != 29 {
+		t.Errorf("Expected unknown currencies to be quoted in USD, got %+v", q)
+	}
+
+	locked, err := rates.Lock("REF-1", rates.QuotePrice(29, CurrencyNGN))
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if saved := store.quotes["REF-1"]; saved == nil || saved.Amount != 46499 || locked.Reference != "REF-1" || locked.MinorUnits() != 4649900 {
+		t.Errorf("Expected the quote saved under its reference, got %+v", saved)
+	}
+}
+
+func TestRateTableRefresh(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 2 {
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintf(w, `{"result":"success","base_code":"USD","rates":{"USD":1,"NGN":%d,"KES":130,"JPY":150}}`, 1600+requests)
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "rates.json")
+	if err := os.WriteFile(file, []byte(`{"base":"EUR","rates":{"USD":1.25,"NGN":2000}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memoryRateStore{}
+	rates := newRateTable(store, []RateSource{NewHTTPRateSource(server.URL), FileRateSource{Path: file}}, ExchangeConfig{TTL: time.Hour, Retry: time.Minute})
+	if !rates.FetchedAt().IsZero() || rates.Rate(CurrencyNGN) != Currencies[CurrencyNGN].Rate {
+		t.Fatal("Expected the built-in rates before the first fetch")
+	}
+
+	now := time.Now()
+	if err := rates.Process(now); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if rates.Rate(CurrencyNGN) != 1601 || rates.Rate(CurrencyKES) != 130 || store.rates[CurrencyNGN] != 1601 {
+		t.Fatalf("Expected fetched rates to be used and saved, got %v", store.rates)
+	}
+	if _, ok := store.rates["JPY"]; ok {
+		t.Error("Expected unsupported currencies to be dropped")
+	}
+
+	// Rates are cached until the TTL is up
+	rates.Process(now.Add(30 * time.Minute))
+	if requests != 1 {
+		t.Errorf("Expected cached rates, got %d requests", requests)
+	}
+
+	// A failing URL falls back to the file, rebased to USD
+	if err := rates.Process(now.Add(time.Hour)); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if got := rates.Rate(CurrencyNGN); got != 1600 {
+		t.Errorf("Expected the file rate of 2000/1.25, got %v", got)
+	}
+}
+
+func TestRateTableKeepsLastGoodRates(t *testing.T) {
+	store := &memoryRateStore{rates: map[CurrencyCode]float64{CurrencyNGN: 1550}, fetchedAt: time.Now().Add(-24 * time.Hour)}
+	rates := newRateTable(store, []RateSource{failingSource{}}, ExchangeConfig{TTL: time.Hour, Retry: 5 * time.Minute})
+
+	now := time.Now()
+	if err := rates.Process(now); err == nil {
+		t.Fatal("Expected the failed fetch to be reported")
+	}
+	if got := rates.Rate(CurrencyNGN); got != 1550 {
+		t.Errorf("Expected the last good rate, got %v", got)
+	}
+	// The next attempt waits for the retry interval
+	if err := rates.Process(now.Add(time.Minute)); err != nil {
+		t.Errorf("Expected no attempt before the retry interval, got %v", err)
+	}
+	if err := rates.Process(now.Add(5 * time.Minute)); err == nil {
+		t.Error("Expected a retry after the interval")
+	}
+}
+
+func TestParseRatesRejectsBadDocuments(t *testing.T) {
+	for name, body := range map[string]string{
+		"not json":      `rates`,
+		"no currencies": `{"rates":{"JPY":150}}`,
+		"no usd rate":   `{"base":"EUR","rates":{"NGN":2000}}`,
+	} {
+		if _, err := parseRates([]byte(body)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package billing
 
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
 type PaymentMethod string
 
 const (
 	MethodPaystack PaymentMethod = "paystack"
 	MethodCrypto   PaymentMethod = "crypto"
+	MethodStripe   PaymentMethod = "stripe"
 )
 
 type CheckoutRequest struct {
@@ -12,6 +19,50 @@ type CheckoutRequest struct {
 	Email    string        `json:"email" binding:"required"`
 	Method   PaymentMethod `json:"method" binding:"required"`
 	Currency string        `json:"currency"` // e.g. "USD", "NGN", "GHS"
+	Coupon   string        `json:"coupon,omitempty"`
+
+	// Set by the server for payments other than a plan's monthly price,
+	// such as the prorated difference of an upgrade
+	AmountUSD float64           `json:"-"`
+	Reference string            `json:"-"`
+	Metadata  map[string]string `json:"-"`
+
+	// Set once the coupon has been checked
+	coupon   *Coupon
+	discount float64 // USD off the price
+}
+
+// checkoutPrice is the USD amount a checkout charges: the amount set by the
+// server, or else the monthly price of the plan on offer less its coupon
+func checkoutPrice(req CheckoutRequest) (float64, error) {
+	if req.AmountUSD > 0 {
+		return req.AmountUSD, nil
+	}
+	plan, err := offeredPlan(PlanType(req.PlanID))
+	if err != nil {
+		return 0, err
+	}
+	if plan.PriceMonthly <= 0 {
+		return 0, fmt.Errorf("plan %s can not be bought", plan.ID)
+	}
+	return math.Round((plan.PriceMonthly-req.discount)*100) / 100, nil
+}
+
+// checkoutQuote prices a checkout in the currency it is charged in and locks
+// the quote under the checkout's reference. A plan's price follows the
+// currency's price rules; amounts set by the server and discounted prices
+// are converted exactly.
+func checkoutQuote(req CheckoutRequest, currency CurrencyCode) (*PriceQuote, error) {
+	price, err := checkoutPrice(req)
+	if err != nil {
+		return nil, err
+	}
+	rates := ExchangeRates()
+	quote := rates.QuotePrice(price, currency)
+	if req.AmountUSD > 0 || req.discount > 0 {
+		quote = rates.QuoteAmount(price, currency)
+	}
+	return rates.Lock(req.Reference, quote)
 }
 
 type CheckoutResponse struct {
@@ -20,8 +71,15 @@ type CheckoutResponse struct {
 	Address   string `json:"address,omitempty"` // For Crypto
 	Amount    string `json:"amount,omitempty"`  // For Crypto
 	Currency  string `json:"currency,omitempty"`
+
+	Quote     *PriceQuote `json:"quote,omitempty"`      // the price locked for the payment
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"` // when a crypto quote stops holding
+
+	Coupon      string  `json:"coupon,omitempty"`
+	DiscountUSD float64 `json:"discount_usd,omitempty"`
 }
 
 type PaymentGateway interface {
 	CreateCheckout(req CheckoutRequest) (*CheckoutResponse, error)
+	Refund(req RefundRequest) (*RefundResult, error)
 }
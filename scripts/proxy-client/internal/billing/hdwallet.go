@@ -0,0 +1,313 @@
+package billing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/ripemd160"
+	"golang.org/x/crypto/sha3"
+)
+
+// Deposit addresses are derived from an account-level extended public key
+// (BIP32), so the server can hand out a fresh address per payment without
+// holding any private key. Only public, non-hardened derivation is needed.
+
+// secp256k1 curve parameters
+var (
+	secpP, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 16)
+	secpN, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	secpGx, _ = new(big.Int).SetString("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798", 16)
+	secpGy, _ = new(big.Int).SetString("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8", 16)
+)
+
+var ErrInvalidExtendedKey = errors.New("invalid extended public key")
+
+// point is an affine point on secp256k1; nil coordinates are the point at
+// infinity
+type point struct{ x, y *big.Int }
+
+func (p point) infinity() bool { return p.x == nil }
+
+func addPoints(a, b point) point {
+	switch {
+	case a.infinity():
+		return b
+	case b.infinity():
+		return a
+	}
+
+	var lambda *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		if a.y.Cmp(b.y) != 0 || a.y.Sign() == 0 {
+			return point{}
+		}
+		// Doubling: 3x² / 2y
+		num := new(big.Int).Mul(a.x, a.x)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.y, 1)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	} else {
+		num := new(big.Int).Sub(b.y, a.y)
+		den := new(big.Int).Sub(b.x, a.x)
+		den.Mod(den, secpP)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	}
+	lambda.Mod(lambda, secpP)
+
+	x := new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, a.x).Sub(x, b.x).Mod(x, secpP)
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, lambda).Sub(y, a.y).Mod(y, secpP)
+	return point{x, y}
+}
+
+// scalarBaseMult returns k·G
+func scalarBaseMult(k *big.Int) point {
+	result := point{}
+	addend := point{secpGx, secpGy}
+	for i := 0; i < k.BitLen(); i++ {
+		if k.Bit(i) == 1 {
+			result = addPoints(result, addend)
+		}
+		addend = addPoints(addend, addend)
+	}
+	return result
+}
+
+// compress encodes a point as 33 bytes
+func (p point) compress() []byte {
+	out := make([]byte, 33)
+	out[0] = 0x02 + byte(p.y.Bit(0))
+	p.x.FillBytes(out[1:])
+	return out
+}
+
+// uncompressed encodes a point as the 64 bytes X || Y
+func (p point) uncompressed() []byte {
+	out := make([]byte, 64)
+	p.x.FillBytes(out[:32])
+	p.y.FillBytes(out[32:])
+	return out
+}
+
+// decompress parses a 33-byte compressed point
+func decompress(b []byte) (point, error) {
+	if len(b) != 33 || (b[0] != 0x02 && b[0] != 0x03) {
+		return point{}, ErrInvalidExtendedKey
+	}
+	x := new(big.Int).SetBytes(b[1:])
+	if x.Cmp(secpP) >= 0 {
+		return point{}, ErrInvalidExtendedKey
+	}
+	// y² = x³ + 7; p ≡ 3 mod 4, so y = (y²)^((p+1)/4)
+	y2 := new(big.Int).Exp(x, big.NewInt(3), secpP)
+	y2.Add(y2, big.NewInt(7)).Mod(y2, secpP)
+	exp := new(big.Int).Add(secpP, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(y2, exp, secpP)
+	if new(big.Int).Exp(y, big.NewInt(2), secpP).Cmp(y2) != 0 {
+		return point{}, ErrInvalidExtendedKey
+	}
+	if y.Bit(0) != uint(b[0]&1) {
+		y.Sub(secpP, y)
+	}
+	return point{x, y}, nil
+}
+
+// ExtendedPublicKey is a BIP32 public node
+type ExtendedPublicKey struct {
+	key       point
+	chainCode []byte
+	testnet   bool
+}
+
+// Extended public key versions: xpub/tpub (BIP44), ypub/upub (BIP49) and
+// zpub/vpub (BIP84). The version only tells the network apart here.
+var xpubVersions = map[uint32]bool{
+	0x0488B21E: false, 0x049D7CB2: false, 0x04B24746: false,
+	0x043587CF: true, 0x044A5262: true, 0x045F1CF6: true,
+}
+
+// ParseExtendedPublicKey decodes a base58check extended public key
+func ParseExtendedPublicKey(s string) (*ExtendedPublicKey, error) {
+	raw, err := base58CheckDecode(strings.TrimSpace(s))
+	if err != nil || len(raw) != 78 {
+		return nil, ErrInvalidExtendedKey
+	}
+	testnet, ok := xpubVersions[binary.BigEndian.Uint32(raw[:4])]
+	if !ok {
+		return nil, fmt.Errorf("%w: not a public key", ErrInvalidExtendedKey)
+	}
+	key, err := decompress(raw[45:78])
+	if err != nil {
+		return nil, err
+	}
+	return &ExtendedPublicKey{key: key, chainCode: raw[13:45], testnet: testnet}, nil
+}
+
+// Child derives the non-hardened child at index
+func (k *ExtendedPublicKey) Child(index uint32) (*ExtendedPublicKey, error) {
+	if index >= 1<<31 {
+		return nil, errors.New("hardened keys can not be derived from a public key")
+	}
+
+	data := make([]byte, 37)
+	copy(data, k.key.compress())
+	binary.BigEndian.PutUint32(data[33:], index)
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(secpN) >= 0 {
+		return nil, fmt.Errorf("invalid child %d; use the next index", index)
+	}
+	child := addPoints(scalarBaseMult(il), k.key)
+	if child.infinity() {
+		return nil, fmt.Errorf("invalid child %d; use the next index", index)
+	}
+	return &ExtendedPublicKey{key: child, chainCode: sum[32:], testnet: k.testnet}, nil
+}
+
+// Derive follows a path of non-hardened indexes
+func (k *ExtendedPublicKey) Derive(path ...uint32) (*ExtendedPublicKey, error) {
+	var err error
+	for _, index := range path {
+		if k, err = k.Child(index); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// BitcoinAddress returns the native segwit (P2WPKH) address of the key
+func (k *ExtendedPublicKey) BitcoinAddress() string {
+	sha := sha256.Sum256(k.key.compress())
+	h := ripemd160.New()
+	h.Write(sha[:])
+	hrp := "bc"
+	if k.testnet {
+		hrp = "tb"
+	}
+	return segwitAddress(hrp, h.Sum(nil))
+}
+
+// EthereumAddress returns the EIP-55 checksummed address of the key
+func (k *ExtendedPublicKey) EthereumAddress() string {
+	return ethereumAddress(k.key)
+}
+
+func ethereumAddress(p point) string {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(p.uncompressed())
+	addr := hex.EncodeToString(h.Sum(nil)[12:])
+
+	h = sha3.NewLegacyKeccak256()
+	h.Write([]byte(addr))
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	out := []byte(addr)
+	for i, c := range out {
+		if c >= 'a' && hash[i] >= '8' {
+			out[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(out)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58CheckDecode(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, c := range []byte(s) {
+		i := strings.IndexByte(base58Alphabet, c)
+		if i < 0 {
+			return nil, ErrInvalidExtendedKey
+		}
+		n.Mul(n, big.NewInt(58)).Add(n, big.NewInt(int64(i)))
+	}
+	raw := n.Bytes()
+	for _, c := range []byte(s) {
+		if c != '1' {
+			break
+		}
+		raw = append([]byte{0}, raw...)
+	}
+	if len(raw) < 4 {
+		return nil, ErrInvalidExtendedKey
+	}
+
+	payload, checksum := raw[:len(raw)-4], raw[len(raw)-4:]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if !bytes.Equal(second[:4], checksum) {
+		return nil, fmt.Errorf("%w: bad checksum", ErrInvalidExtendedKey)
+	}
+	return payload, nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// segwitAddress encodes a version 0 witness program as bech32 (BIP173)
+func segwitAddress(hrp string, program []byte) string {
+	// Regroup the program from 8-bit to 5-bit words
+	data := []byte{0}
+	acc, bits := 0, 0
+	for _, b := range program {
+		acc = acc<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			data = append(data, byte(acc>>bits&31))
+		}
+	}
+	if bits > 0 {
+		data = append(data, byte(acc<<(5-bits)&31))
+	}
+
+	values := make([]byte, 0, 2*len(hrp)+1+len(data)+6)
+	for _, c := range []byte(hrp) {
+		values = append(values, c>>5)
+	}
+	values = append(values, 0)
+	for _, c := range []byte(hrp) {
+		values = append(values, c&31)
+	}
+	values = append(values, data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(values) ^ 1
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range data {
+		sb.WriteByte(bech32Charset[d])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(mod>>(5*(5-i)))&31])
+	}
+	return sb.String()
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
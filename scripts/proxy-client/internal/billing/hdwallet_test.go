@@ -0,0 +1,86 @@
+package billing
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// BIP84 test vector: the account key of the "abandon ... about" mnemonic
+const testZpub = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+
+func TestDeriveBitcoinAddresses(t *testing.T) {
+	key, err := ParseExtendedPublicKey(testZpub)
+	if err != nil {
+		t.Fatalf("ParseExtendedPublicKey failed: %v", err)
+	}
+
+	for index, want := range []string{
+		"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu",
+		"bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g",
+	} {
+		child, err := key.Derive(0, uint32(index))
+		if err != nil {
+			t.Fatalf("Derive failed: %v", err)
+		}
+		if got := child.BitcoinAddress(); got != want {
+			t.Errorf("Address %d: expected %s, got %s", index, want, got)
+		}
+	}
+}
+
+func TestDerivePublicChild(t *testing.T) {
+	// BIP32 test vector 1: m/0H/1 derived from the public key of m/0H
+	key, err := ParseExtendedPublicKey("xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw")
+	if err != nil {
+		t.Fatalf("ParseExtendedPublicKey failed: %v", err)
+	}
+	child, err := key.Child(1)
+	if err != nil {
+		t.Fatalf("Child failed: %v", err)
+	}
+	if got := hex.EncodeToString(child.key.compress()); got != "03501e454bf00751f24b1b489aa925215d66af2234e3891c3b21a52bedb3cd711c" {
+		t.Errorf("Unexpected child key %s", got)
+	}
+	if got := hex.EncodeToString(child.chainCode); got != "2a7857631386ba23dacac34180dd1983734e444fdbf774041578e9b6adb37c19" {
+		t.Errorf("Unexpected child chain code %s", got)
+	}
+
+	if _, err := key.Child(1 << 31); err == nil {
+		t.Error("Expected hardened derivation to be refused")
+	}
+}
+
+func TestAddressEncodings(t *testing.T) {
+	// The keys of the private keys 1 and 2
+	one := scalarBaseMult(big.NewInt(1))
+	two := scalarBaseMult(big.NewInt(2))
+
+	if got := ethereumAddress(one); got != "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf" {
+		t.Errorf("Unexpected address of key 1: %s", got)
+	}
+	if got := ethereumAddress(two); got != "0x2B5AD5c4795c026514f8317c7a215E218DcCD6cF" {
+		t.Errorf("Unexpected address of key 2: %s", got)
+	}
+	if got := (&ExtendedPublicKey{key: one}).BitcoinAddress(); got != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Errorf("Unexpected segwit address of key 1: %s", got)
+	}
+	if got := (&ExtendedPublicKey{key: one, testnet: true}).BitcoinAddress(); got != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
+		t.Errorf("Unexpected testnet address of key 1: %s", got)
+	}
+}
+
+func TestParseExtendedPublicKeyRejectsBadKeys(t *testing.T) {
+	for name, key := range map[string]string{
+		"empty":        "",
+		"bad checksum": testZpub[:len(testZpub)-1] + "t",
+		"not base58":   "0OIl",
+		// The private key of BIP32 test vector 1
+		"private key": "xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi",
+	} {
+		if _, err := ParseExtendedPublicKey(key); !errors.Is(err, ErrInvalidExtendedKey) {
+			t.Errorf("%s: expected ErrInvalidExtendedKey, got %v", name, err)
+		}
+	}
+}
@@ -2,50 +2,415 @@ package billing
 
 import (
 	"bytes"
+	_ "embed"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-pdf/fpdf"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
-type InvoiceData struct {
+// Kinds of invoice lines
+const (
+	LinePlan     = "plan"
+	LineOverage  = "overage"
+	LineCredits  = "credits"
+	LineDeposit  = "deposit"  // refundable, so not taxed
+	LineDiscount = "discount" // a coupon, negative
+)
+
+// BillingProfile is who a customer's invoices are made out to
+type BillingProfile struct {
+	UserID     string    `json:"-"`
+	Name       string    `json:"name"`
+	Company    string    `json:"company,omitempty"`
+	TaxID      string    `json:"tax_id,omitempty"` // e.g. a VAT number
+	Address    string    `json:"address,omitempty"`
+	City       string    `json:"city,omitempty"`
+	PostalCode string    `json:"postal_code,omitempty"`
+	Country    string    `json:"country,omitempty"` // ISO 3166 alpha-2
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+var countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// ErrInvalidProfile is returned for a billing profile that can't be saved
+var ErrInvalidProfile = errors.New("invalid billing profile")
+
+// Normalize tidies a profile's fields and checks them
+func (p *BillingProfile) Normalize() error {
+	for _, f := range []*string{&p.Name, &p.Company, &p.TaxID, &p.Address, &p.City, &p.PostalCode} {
+		*f = strings.TrimSpace(*f)
+		if len(*f) > 200 {
+			return fmt.Errorf("%w: fields are limited to 200 characters", ErrInvalidProfile)
+		}
+	}
+	p.TaxID = strings.ToUpper(strings.ReplaceAll(p.TaxID, " ", ""))
+	p.Country = strings.ToUpper(strings.TrimSpace(p.Country))
+	if p.Name == "" && p.Company == "" {
+		return fmt.Errorf("%w: a name or company is required", ErrInvalidProfile)
+	}
+	if p.Country != "" && !countryCode.MatchString(p.Country) {
+		return fmt.Errorf("%w: country must be a two-letter code", ErrInvalidProfile)
+	}
+	if p.TaxID != "" && p.Country == "" {
+		return fmt.Errorf("%w: a tax ID needs a country", ErrInvalidProfile)
+	}
+	return nil
+}
+
+// InvoiceLine is a charge on an invoice. Amounts exclude tax once the
+// invoice is issued.
+type InvoiceLine struct {
+	Kind        string  `json:"kind"`
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	Amount      float64 `json:"amount"`
+	Taxable     bool    `json:"taxable"`
+}
+
+// Invoice is the record of a payment as issued to the customer. Invoices are
+// numbered without gaps within each year, e.g. INV-2026-000042.
+type Invoice struct {
+	ID            string         `json:"id"`
+	Number        string         `json:"number"`
+	UserID        string         `json:"-"`
+	TransactionID string         `json:"transaction_id"` // the payment invoiced
+	Email         string         `json:"email"`
+	Customer      BillingProfile `json:"customer"` // as it was when issued
+	Currency      CurrencyCode   `json:"currency"`
+	Lines         []InvoiceLine  `json:"lines"`
+	Subtotal      float64        `json:"subtotal"`
+	TaxName       string         `json:"tax_name,omitempty"`
+	TaxRate       float64        `json:"tax_rate"`
+	TaxAmount     float64        `json:"tax_amount"`
+	ReverseCharge bool           `json:"reverse_charge,omitempty"`
+	Total         float64        `json:"total"`
+	PeriodStart   *time.Time     `json:"period_start,omitempty"`
+	PeriodEnd     *time.Time     `json:"period_end,omitempty"`
+	IssuedAt      time.Time      `json:"issued_at"`
+	EmailedAt     *time.Time     `json:"emailed_at,omitempty"`
+}
+
+// InvoiceNumber formats the seq'th invoice number of a year
+func InvoiceNumber(year, seq int) string {
+	return fmt.Sprintf("INV-%d-%06d", year, seq)
+}
+
+// InvoiceStore persists billing profiles, invoices and their PDFs
+type InvoiceStore interface {
+	// GetBillingProfile returns a user's profile, or nil if they have none
+	GetBillingProfile(userID string) (*BillingProfile, error)
+	SaveBillingProfile(p *BillingProfile) error
+
+	// CreateInvoice stores an invoice under the next number of the year it
+	// is issued in. The number is only taken if the invoice is stored.
+	CreateInvoice(inv *Invoice) error
+	GetInvoice(id string) (*Invoice, error)
+	// GetInvoiceByTransaction returns the invoice of a payment, or nil
+	GetInvoiceByTransaction(transactionID string) (*Invoice, error)
+	ListInvoices(userID string, limit, offset int) ([]*Invoice, int, error)
+	MarkInvoiceEmailed(id string, at time.Time) error
+
+	SaveInvoicePDF(id string, pdf []byte) error
+	// GetInvoicePDF returns an invoice's rendered PDF, or nil if it has none
+	GetInvoicePDF(id string) ([]byte, error)
+}
+
+// InvoiceConfig is the seller shown on invoices
+type InvoiceConfig struct {
+	Seller  string `yaml:"seller"`
+	Address string `yaml:"address"` // lines separated by newlines
+	TaxID   string `yaml:"tax_id"`
+	Email   string `yaml:"email"`
+}
+
+// DefaultInvoiceConfig returns the seller used when none is configured
+func DefaultInvoiceConfig() InvoiceConfig {
+	return InvoiceConfig{Seller: "AtlanticProxy Inc."}
+}
+
+// InvoiceRequest is a payment to invoice. Line amounts are as charged,
+// including tax.
+type InvoiceRequest struct {
+	TransactionID string
+	UserID        string
+	Email         string
+	Currency      CurrencyCode
+	Lines         []InvoiceLine
+	PeriodStart   *time.Time
+	PeriodEnd     *time.Time
+	IssuedAt      time.Time
+}
+
+// Invoicer issues invoices for payments and renders them once
+type Invoicer struct {
+	store  InvoiceStore
+	cfg    InvoiceConfig
+	logger *logrus.Logger
+}
+
+func NewInvoicer(store InvoiceStore, cfg InvoiceConfig) *Invoicer {
+	if cfg.Seller == "" {
+		cfg.Seller = DefaultInvoiceConfig().Seller
+	}
+	return &Invoicer{store: store, cfg: cfg, logger: logrus.StandardLogger()}
+}
+
+// Store returns the store invoices are kept in
+func (iv *Invoicer) Store() InvoiceStore {
+	return iv.store
+}
+
+// Issue invoices a payment, taxed by the customer's billing profile. A
+// payment is invoiced once; issuing it again returns its invoice.
+func (iv *Invoicer) Issue(req InvoiceRequest) (*Invoice, error) {
+	if inv, err := iv.store.GetInvoiceByTransaction(req.TransactionID); err != nil || inv != nil {
+		return inv, err
+	}
+
+	profile, err := iv.store.GetBillingProfile(req.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load billing profile: %w", err)
+	}
+	if req.IssuedAt.IsZero() {
+		req.IssuedAt = time.Now()
+	}
+
+	inv := &Invoice{
+		ID:            uuid.New().String(),
+		UserID:        req.UserID,
+		TransactionID: req.TransactionID,
+		Email:         req.Email,
+		Currency:      currencyOf(req.Currency).Code,
+		Lines:         append([]InvoiceLine(nil), req.Lines...),
+		PeriodStart:   req.PeriodStart,
+		PeriodEnd:     req.PeriodEnd,
+		IssuedAt:      req.IssuedAt.UTC().Truncate(time.Second),
+	}
+	if profile != nil {
+		inv.Customer = *profile
+	}
+	ApplyTax(inv, TaxCountry(profile, inv.Currency))
+
+	if err := iv.store.CreateInvoice(inv); err != nil {
+		// Lost a race with another delivery of the payment
+		if existing, _ := iv.store.GetInvoiceByTransaction(req.TransactionID); existing != nil {
+			return existing, nil
+		}
+		return nil, fmt.Errorf("failed to store invoice: %w", err)
+	}
+
+	// The PDF is kept as issued; a failure here is retried on download
+	if _, err := iv.PDF(inv); err != nil {
+		iv.logger.Warnf("Failed to render invoice %s: %v", inv.Number, err)
+	}
+	return inv, nil
+}
+
+// PDF returns an invoice's stored PDF, rendering and storing it first if it
+// has none
+func (iv *Invoicer) PDF(inv *Invoice) ([]byte, error) {
+	pdf, err := iv.store.GetInvoicePDF(inv.ID)
+	if err != nil || pdf != nil {
+		return pdf, err
+	}
+
+	pdf, err = GenerateInvoicePDF(inv, iv.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := iv.store.SaveInvoicePDF(inv.ID, pdf); err != nil {
+		return nil, fmt.Errorf("failed to store invoice PDF: %w", err)
+	}
+	return pdf, nil
+}
+
+// The PDF core fonts only cover Latin-1, which has no ₦ or ₵, so documents
+// are set in DejaVu Sans
+var (
+	//go:embed fonts/DejaVuSansCondensed.ttf
+	fontRegular []byte
+	//go:embed fonts/DejaVuSansCondensed-Bold.ttf
+	fontBold []byte
+)
+
+const pdfFont = "DejaVu"
+
+func newPDF() *fpdf.Fpdf {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes(pdfFont, "", fontRegular)
+	pdf.AddUTF8FontFromBytes(pdfFont, "B", fontBold)
+	pdf.AddPage()
+	return pdf
+}
+
+func outputPDF(pdf *fpdf.Fpdf) ([]byte, error) {
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	return buf.Bytes(), err
+}
+
+// GenerateInvoicePDF renders an issued invoice
+func GenerateInvoicePDF(inv *Invoice, seller InvoiceConfig) ([]byte, error) {
+	c := currencyOf(inv.Currency)
+	pdf := newPDF()
+
+	// Header, with the seller on the right
+	pdf.SetFont(pdfFont, "B", 18)
+	pdf.Cell(100, 10, "Invoice")
+	pdf.SetFont(pdfFont, "B", 10)
+	pdf.CellFormat(0, 5, seller.Seller, "", 1, "R", false, 0, "")
+	pdf.SetFont(pdfFont, "", 9)
+	for _, line := range sellerLines(seller) {
+		pdf.CellFormat(0, 5, line, "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(8)
+
+	pdf.SetFont(pdfFont, "", 10)
+	pdf.Cell(0, 6, "Invoice number: "+inv.Number)
+	pdf.Ln(6)
+	pdf.Cell(0, 6, "Date of issue: "+inv.IssuedAt.Format("2 January 2006"))
+	pdf.Ln(6)
+	if inv.PeriodStart != nil && inv.PeriodEnd != nil {
+		pdf.Cell(0, 6, fmt.Sprintf("Service period: %s – %s", inv.PeriodStart.Format("2 Jan 2006"), inv.PeriodEnd.Format("2 Jan 2006")))
+		pdf.Ln(6)
+	}
+	pdf.Cell(0, 6, "Payment reference: "+inv.TransactionID)
+	pdf.Ln(12)
+
+	// Bill to
+	pdf.SetFont(pdfFont, "B", 10)
+	pdf.Cell(0, 6, "Bill to")
+	pdf.Ln(6)
+	pdf.SetFont(pdfFont, "", 10)
+	for _, line := range customerLines(inv) {
+		pdf.Cell(0, 5, line)
+		pdf.Ln(5)
+	}
+	pdf.Ln(8)
+
+	// Lines
+	pdf.SetFont(pdfFont, "B", 10)
+	pdf.SetFillColor(240, 240, 240)
+	pdf.CellFormat(100, 8, "Description", "1", 0, "", true, 0, "")
+	pdf.CellFormat(20, 8, "Qty", "1", 0, "R", true, 0, "")
+	pdf.CellFormat(35, 8, "Unit price", "1", 0, "R", true, 0, "")
+	pdf.CellFormat(35, 8, "Amount", "1", 1, "R", true, 0, "")
+
+	pdf.SetFont(pdfFont, "", 10)
+	for _, line := range inv.Lines {
+		pdf.CellFormat(100, 8, line.Description, "1", 0, "", false, 0, "")
+		pdf.CellFormat(20, 8, formatQuantity(line.Quantity), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(35, 8, c.Format(line.UnitPrice), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(35, 8, c.Format(line.Amount), "1", 1, "R", false, 0, "")
+	}
+
+	// Totals
+	pdf.Ln(3)
+	pdf.CellFormat(155, 7, "Subtotal", "", 0, "R", false, 0, "")
+	pdf.CellFormat(35, 7, c.Format(inv.Subtotal), "", 1, "R", false, 0, "")
+	switch {
+	case inv.ReverseCharge:
+		pdf.CellFormat(155, 7, inv.TaxName+" (reverse charge)", "", 0, "R", false, 0, "")
+		pdf.CellFormat(35, 7, c.Format(0), "", 1, "R", false, 0, "")
+	case inv.TaxName != "":
+		pdf.CellFormat(155, 7, fmt.Sprintf("%s %s", inv.TaxName, taxPercent(inv.TaxRate)), "", 0, "R", false, 0, "")
+		pdf.CellFormat(35, 7, c.Format(inv.TaxAmount), "", 1, "R", false, 0, "")
+	}
+	pdf.SetFont(pdfFont, "B", 10)
+	pdf.CellFormat(155, 8, "Total paid", "", 0, "R", false, 0, "")
+	pdf.CellFormat(35, 8, c.Format(inv.Total), "1", 1, "R", true, 0, "")
+
+	if inv.ReverseCharge {
+		pdf.Ln(6)
+		pdf.SetFont(pdfFont, "", 9)
+		pdf.MultiCell(0, 5, "Reverse charge: the customer is liable to account for the "+inv.TaxName+" on this supply.", "", "", false)
+	}
+
+	// Footer
+	pdf.SetY(-30)
+	pdf.SetFont(pdfFont, "", 8)
+	pdf.CellFormat(0, 5, "Thank you for choosing AtlanticProxy.", "", 1, "C", false, 0, "")
+	pdf.CellFormat(0, 5, seller.Seller, "", 1, "C", false, 0, "")
+
+	return outputPDF(pdf)
+}
+
+func sellerLines(seller InvoiceConfig) []string {
+	var lines []string
+	for _, line := range strings.Split(seller.Address, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if seller.TaxID != "" {
+		lines = append(lines, "Tax ID: "+seller.TaxID)
+	}
+	if seller.Email != "" {
+		lines = append(lines, seller.Email)
+	}
+	return lines
+}
+
+func customerLines(inv *Invoice) []string {
+	p := inv.Customer
+	var lines []string
+	for _, line := range []string{p.Company, p.Name, p.Address, strings.TrimSpace(p.PostalCode + " " + p.City), p.Country} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if p.TaxID != "" {
+		lines = append(lines, "Tax ID: "+p.TaxID)
+	}
+	return append(lines, inv.Email)
+}
+
+func formatQuantity(q float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", q), "0"), ".")
+}
+
+// CreditNoteData is a refund as shown to the customer
+type CreditNoteData struct {
 	ID            string
+	InvoiceID     string // invoice of the refunded payment
 	Date          time.Time
 	CustomerName  string
 	CustomerEmail string
-	Items         []InvoiceItem
+	Description   string
+	Reason        string
 	Currency      string
-	Symbol        string
-	Total         float64
+	Amount        float64
 }
 
-type InvoiceItem struct {
-	Description string
-	Quantity    int
-	Price       float64
-	Amount      float64
-}
-
-func GenerateInvoicePDF(data *InvoiceData) ([]byte, error) {
-	pdf := fpdf.New("P", "mm", "A4", "")
-	pdf.AddPage()
-	pdf.SetFont("Arial", "B", 16)
+func GenerateCreditNotePDF(data *CreditNoteData) ([]byte, error) {
+	c := currencyOf(CurrencyCode(data.Currency))
+	pdf := newPDF()
+	pdf.SetFont(pdfFont, "B", 16)
 
 	// Header
-	pdf.Cell(40, 10, "AtlanticProxy Invoice")
+	pdf.Cell(40, 10, "AtlanticProxy Credit Note")
 	pdf.Ln(12)
 
-	pdf.SetFont("Arial", "", 12)
-	pdf.Cell(0, 10, fmt.Sprintf("Invoice #: %s", data.ID))
+	pdf.SetFont(pdfFont, "", 12)
+	pdf.Cell(0, 10, fmt.Sprintf("Credit Note #: %s", data.ID))
+	pdf.Ln(8)
+	pdf.Cell(0, 10, fmt.Sprintf("Original Invoice #: %s", data.InvoiceID))
 	pdf.Ln(8)
 	pdf.Cell(0, 10, fmt.Sprintf("Date: %s", data.Date.Format("2006-01-02")))
 	pdf.Ln(20)
 
-	// Bill To
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(0, 10, "Bill To:")
+	// Credit To
+	pdf.SetFont(pdfFont, "B", 12)
+	pdf.Cell(0, 10, "Credit To:")
 	pdf.Ln(8)
-	pdf.SetFont("Arial", "", 12)
+	pdf.SetFont(pdfFont, "", 12)
 	if data.CustomerName != "" {
 		pdf.Cell(0, 10, data.CustomerName)
 		pdf.Ln(6)
@@ -53,34 +418,33 @@ func GenerateInvoicePDF(data *InvoiceData) ([]byte, error) {
 	pdf.Cell(0, 10, data.CustomerEmail)
 	pdf.Ln(20)
 
-	// Table Header
-	pdf.SetFont("Arial", "B", 12)
+	// Table
+	pdf.SetFont(pdfFont, "B", 12)
 	pdf.SetFillColor(240, 240, 240)
-	pdf.CellFormat(100, 10, "Description", "1", 0, "", true, 0, "")
-	pdf.CellFormat(30, 10, "Price", "1", 0, "R", true, 0, "")
+	pdf.CellFormat(130, 10, "Description", "1", 0, "", true, 0, "")
 	pdf.CellFormat(60, 10, "Amount", "1", 1, "R", true, 0, "")
 
-	// Table Body
-	pdf.SetFont("Arial", "", 12)
-	for _, item := range data.Items {
-		pdf.CellFormat(100, 10, item.Description, "1", 0, "", false, 0, "")
-		pdf.CellFormat(30, 10, fmt.Sprintf("%s %.2f", data.Symbol, item.Price), "1", 0, "R", false, 0, "")
-		pdf.CellFormat(60, 10, fmt.Sprintf("%s %.2f", data.Symbol, item.Amount), "1", 1, "R", false, 0, "")
-	}
+	pdf.SetFont(pdfFont, "", 12)
+	pdf.CellFormat(130, 10, data.Description, "1", 0, "", false, 0, "")
+	pdf.CellFormat(60, 10, c.Format(-data.Amount), "1", 1, "R", false, 0, "")
 
 	// Total
 	pdf.Ln(5)
-	pdf.SetFont("Arial", "B", 12)
-	pdf.CellFormat(130, 10, "Total", "0", 0, "R", false, 0, "")
-	pdf.CellFormat(60, 10, fmt.Sprintf("%s %.2f", data.Symbol, data.Total), "1", 1, "R", true, 0, "")
+	pdf.SetFont(pdfFont, "B", 12)
+	pdf.CellFormat(130, 10, "Total Credited", "0", 0, "R", false, 0, "")
+	pdf.CellFormat(60, 10, c.Format(data.Amount), "1", 1, "R", true, 0, "")
+
+	if data.Reason != "" {
+		pdf.Ln(10)
+		pdf.SetFont(pdfFont, "", 10)
+		pdf.MultiCell(0, 6, "Reason: "+data.Reason, "", "", false)
+	}
 
 	// Footer
 	pdf.SetY(-30)
-	pdf.SetFont("Arial", "I", 8)
-	pdf.CellFormat(0, 10, "Thank you for choosing AtlanticProxy.", "0", 1, "C", false, 0, "")
+	pdf.SetFont(pdfFont, "", 8)
+	pdf.CellFormat(0, 10, "The credited amount is returned to your original payment method.", "0", 1, "C", false, 0, "")
 	pdf.CellFormat(0, 10, "AtlanticProxy Inc.", "0", 1, "C", false, 0, "")
 
-	var buf bytes.Buffer
-	err := pdf.Output(&buf)
-	return buf.Bytes(), err
+	return outputPDF(pdf)
 }
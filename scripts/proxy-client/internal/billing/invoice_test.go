@@ -0,0 +1,205 @@
+package billing
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// memoryInvoiceStore keeps invoices in memory, numbered like the database
+type memoryInvoiceStore struct {
+	profiles map[string]*BillingProfile
+	invoices []*Invoice
+	pdfs     map[string][]byte
+	last     map[int]int
+	pdfSaves int
+}
+
+func newMemoryInvoiceStore() *memoryInvoiceStore {
+	return &memoryInvoiceStore{profiles: map[string]*BillingProfile{}, pdfs: map[string][]byte{}, last: map[int]int{}}
+}
+
+func (s *memoryInvoiceStore) GetBillingProfile(userID string) (*BillingProfile, error) {
+	return s.profiles[userID], nil
+}
+
+func (s *memoryInvoiceStore) SaveBillingProfile(p *BillingProfile) error {
+	s.profiles[p.UserID] = p
+	return nil
+}
+
+func (s *memoryInvoiceStore) CreateInvoice(inv *Invoice) error {
+	year := inv.IssuedAt.Year()
+	s.last[year]++
+	inv.Number = InvoiceNumber(year, s.last[year])
+	s.invoices = append(s.invoices, inv)
+	return nil
+}
+
+func (s *memoryInvoiceStore) GetInvoice(id string) (*Invoice, error) {
+	for _, inv := range s.invoices {
+		if inv.ID == id || inv.Number == id {
+			return inv, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *memoryInvoiceStore) GetInvoiceByTransaction(transactionID string) (*Invoice, error) {
+	for _, inv := range s.invoices {
+		if inv.TransactionID == transactionID {
+			return inv, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryInvoiceStore) ListInvoices(userID string, limit, offset int) ([]*Invoice, int, error) {
+	return s.invoices, len(s.invoices), nil
+}
+
+func (s *memoryInvoiceStore) MarkInvoiceEmailed(id string, at time.Time) error {
+	return nil
+}
+
+func (s *memoryInvoiceStore) SaveInvoicePDF(id string, pdf []byte) error {
+	s.pdfSaves++
+	s.pdfs[id] = pdf
+	return nil
+}
+
+func (s *memoryInvoiceStore) GetInvoicePDF(id string) ([]byte, error) {
+	return s.pdfs[id], nil
+}
+
+func TestApplyTax(t *testing.T) {
+	// Nigerian VAT is included in the ₦43,999 charged
+	inv := &Invoice{Currency: CurrencyNGN, Lines: []InvoiceLine{
+		{Kind: LinePlan, Quantity: 1, Amount: 43999, Taxable: true},
+		{Kind: LineDeposit, Quantity: 1, Amount: 1515},
+	}}
+	ApplyTax(inv, TaxCountry(nil, CurrencyNGN))
+	if inv.TaxName != "VAT" || inv.TaxRate != 0.075 {
+		t.Fatalf("Expected Nigerian VAT, got %q at %v", inv.TaxName, inv.TaxRate)
+	}
+	if inv.Lines[0].Amount != 40929.30 || inv.TaxAmount != 3069.70 {
+		t.Errorf("Expected ₦40,929.30 net and ₦3,069.70 VAT, got %v and %v", inv.Lines[0].Amount, inv.TaxAmount)
+	}
+	if inv.Lines[1].Amount != 1515 || inv.Total != 45514 || inv.Subtotal+inv.TaxAmount != inv.Total {
+		t.Errorf("Expected the untaxed deposit to add up to the amount paid, got %+v", inv)
+	}
+
+	// A business with a VAT number in the EU accounts for the VAT itself
+	b2b := &Invoice{Currency: CurrencyEUR, Customer: BillingProfile{Country: "DE", TaxID: "DE123456789"},
+		Lines: []InvoiceLine{{Quantity: 1, Amount: 26.99, Taxable: true}}}
+	ApplyTax(b2b, TaxCountry(&b2b.Customer, b2b.Currency))
+	if !b2b.ReverseCharge || b2b.TaxAmount != 0 || b2b.Subtotal != 26.99 {
+		t.Errorf("Expected a reverse charge, got %+v", b2b)
+	}
+
+	// Customers elsewhere are not charged tax
+	us := &Invoice{Currency: CurrencyUSD, Customer: BillingProfile{Country: "US"},
+		Lines: []InvoiceLine{{Quantity: 1, Amount: 29, Taxable: true}}}
+	ApplyTax(us, TaxCountry(&us.Customer, us.Currency))
+	if us.TaxName != "" || us.TaxAmount != 0 || us.Total != 29 {
+		t.Errorf("Expected no tax, got %+v", us)
+	}
+}
+
+func TestCurrencyFormat(t *testing.T) {
+	for _, tc := range []struct {
+		amount float64
+		code   CurrencyCode
+		want   string
+	}{
+		{43999, CurrencyNGN, "₦43,999.00"},
+		{1234567.891, CurrencyGHS, "GH₵1,234,567.89"},
+		{-7.5, CurrencyEUR, "-€7.50"},
+		{999, "XYZ", "$999.00"},
+	} {
+		if got := FormatAmount(tc.amount, tc.code); got != tc.want {
+			t.Errorf("FormatAmount(%v, %s): expected %s, got %s", tc.amount, tc.code, tc.want, got)
+		}
+	}
+	if got := taxPercent(0.075); got != "7.5%" {
+		t.Errorf("Expected 7.5%%, got %s", got)
+	}
+}
+
+func TestBillingProfileNormalize(t *testing.T) {
+	p := &BillingProfile{Name: " Ada ", TaxID: "gb 123 4567 89", Country: "gb"}
+	if err := p.Normalize(); err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if p.Name != "Ada" || p.TaxID != "GB123456789" || p.Country != "GB" {
+		t.Errorf("Unexpected profile: %+v", p)
+	}
+
+	for name, bad := range map[string]*BillingProfile{
+		"no name":           {Country: "NG"},
+		"bad country":       {Name: "Ada", Country: "Nigeria"},
+		"tax id no country": {Name: "Ada", TaxID: "123"},
+	} {
+		if err := bad.Normalize(); !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("%s: expected ErrInvalidProfile, got %v", name, err)
+		}
+	}
+}
+
+func TestInvoicerIssue(t *testing.T) {
+	store := newMemoryInvoiceStore()
+	store.profiles["user-1"] = &BillingProfile{UserID: "user-1", Name: "Ada Obi", Company: "Obi Labs", Country: "NG"}
+	iv := NewInvoicer(store, InvoiceConfig{Address: "1 Marina\nLagos", TaxID: "NG-TIN-1"})
+
+	issued := time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC)
+	req := InvoiceRequest{
+		TransactionID: "ref-1", UserID: "user-1", Email: "ada@example.com", Currency: CurrencyNGN, IssuedAt: issued,
+		Lines: []InvoiceLine{{Kind: LinePlan, Description: "Personal plan", Quantity: 1, Amount: 43999, Taxable: true}},
+	}
+	inv, err := iv.Issue(req)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if inv.Number != "INV-2026-000001" || inv.Customer.Company != "Obi Labs" || inv.TaxAmount != 3069.70 {
+		t.Errorf("Unexpected invoice: %+v", inv)
+	}
+
+	// The PDF is rendered once, in a font with the naira sign
+	pdf, err := iv.PDF(inv)
+	if err != nil {
+		t.Fatalf("PDF failed: %v", err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF")) || !bytes.Contains(pdf, []byte("/FontFile2")) || bytes.Contains(pdf, []byte("/Helvetica")) {
+		t.Error("Expected a PDF set in the embedded TrueType font")
+	}
+	if store.pdfSaves != 1 {
+		t.Errorf("Expected the PDF rendered once, got %d saves", store.pdfSaves)
+	}
+
+	// A payment is invoiced once
+	again, err := iv.Issue(req)
+	if err != nil || again.ID != inv.ID || len(store.invoices) != 1 {
+		t.Errorf("Expected the existing invoice, got %+v, %v", again, err)
+	}
+
+	// Numbering starts again each year
+	req.TransactionID, req.IssuedAt = "ref-2", issued.Add(2*time.Hour)
+	next, err := iv.Issue(req)
+	if err != nil || next.Number != "INV-2027-000001" {
+		t.Errorf("Expected the first number of 2027, got %+v, %v", next, err)
+	}
+}
+
+func TestCreditNotePDF(t *testing.T) {
+	pdf, err := GenerateCreditNotePDF(&CreditNoteData{
+		ID: "CN-1", InvoiceID: InvoiceNumber(2026, 7), Date: time.Now(), CustomerEmail: "ada@example.com",
+		Description: "Refund of payment ref-1", Currency: string(CurrencyGHS), Amount: 120.5,
+	})
+	if err != nil {
+		t.Fatalf("GenerateCreditNotePDF failed: %v", err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF")) {
+		t.Error("Expected a PDF")
+	}
+}
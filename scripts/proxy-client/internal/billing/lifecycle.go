@@ -0,0 +1,485 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Subscription states
+const (
+	StatusTrialing = "trialing"
+	StatusActive   = "active"
+	StatusPastDue  = "past_due"
+	StatusCanceled = "canceled" // runs until the end of the period, then expires
+	StatusExpired  = "expired"
+)
+
+// LifecycleEvent is a subscription change the subscriber is told about
+type LifecycleEvent string
+
+const (
+	EventRenewed       LifecycleEvent = "renewed"
+	EventPaymentFailed LifecycleEvent = "payment_failed"
+	EventExpired       LifecycleEvent = "expired"
+	EventLowBalance    LifecycleEvent = "low_balance"
+	EventQuotaWarning  LifecycleEvent = "quota_warning"
+)
+
+// Notice describes a lifecycle event for the Notifier
+type Notice struct {
+	Event        LifecycleEvent
+	UserID       string
+	Email        string
+	Subscription *Subscription
+	Attempt      int     // failed renewal attempts so far
+	Err          error   // why the renewal failed
+	Balance      float64 // pay-as-you-go credits left in USD
+	Threshold    int     // percent of the data limit used
+	Message      string  // what the quota warning says, from ShouldWarnQuota
+}
+
+// Notifier sends lifecycle notices to subscribers, e.g. dunning emails
+type Notifier interface {
+	NotifySubscription(n *Notice) error
+}
+
+// RenewalRequest asks a gateway to charge a stored payment method
+type RenewalRequest struct {
+	UserID         string
+	Email          string
+	SubscriptionID string
+	PlanID         PlanType
+	AmountUSD      float64
+	Currency       string
+	PaymentAuth    string
+	Reference      string
+}
+
+// Renewal charge outcomes a RenewalGateway reports besides success.
+// ErrChargePending means the charge was accepted but not settled; it must not
+// be repeated and its outcome is looked up with VerifyRenewal.
+var (
+	ErrChargePending  = errors.New("renewal charge pending")
+	ErrChargeDeclined = errors.New("renewal charge declined")
+)
+
+// RenewalGateway charges subscription renewals
+type RenewalGateway interface {
+	ChargeRenewal(req RenewalRequest) (reference string, err error)
+	VerifyRenewal(reference string) error
+}
+
+// LifecycleStore is the persistence the lifecycle scheduler needs
+type LifecycleStore interface {
+	Store
+	ListRenewableSubscriptions() ([]*PersistedSubscription, error)
+	UpdateSubscriptionLifecycle(sub *PersistedSubscription) error
+	ClaimRenewal(id string, now, until time.Time) (bool, error)
+	MarkQuotaReset(id, periodStart string) (bool, error)
+	GetUserEmail(userID string) (string, error)
+	GetSubscriptionByPendingRenewal(reference string) (*PersistedSubscription, error)
+	ClearPendingRenewal(id, reference string) (bool, error)
+}
+
+// LifecycleConfig sets the renewal schedule
+type LifecycleConfig struct {
+	Interval      time.Duration `yaml:"interval"`       // how often subscriptions are checked
+	GracePeriod   time.Duration `yaml:"grace_period"`   // access kept after a failed renewal
+	RetryInterval time.Duration `yaml:"retry_interval"` // time between renewal attempts
+}
+
+// TrialLength is how long a paid trial runs before its first renewal
+const TrialLength = 7 * 24 * time.Hour
+
+// DefaultLifecycleConfig returns the schedule used when none is configured
+func DefaultLifecycleConfig() LifecycleConfig {
+	return LifecycleConfig{
+		Interval:      time.Hour,
+		GracePeriod:   7 * 24 * time.Hour,
+		RetryInterval: 24 * time.Hour,
+	}
+}
+
+// Lifecycle moves subscriptions through trialing, active, past_due, canceled
+// and expired. Due subscriptions are renewed through the gateway; a failed
+// renewal makes the subscription past_due, retried until its grace period
+// runs out, after which it expires and the user falls back to Starter.
+// Each renewal starts a new usage period from the subscription's own
+// billing anchor.
+type Lifecycle struct {
+	manager  *Manager
+	store    LifecycleStore
+	gateway  RenewalGateway
+	notifier Notifier
+	cfg      LifecycleConfig
+	logger   *logrus.Logger
+}
+
+// NewLifecycle creates the scheduler. gateway and notifier may be nil.
+func NewLifecycle(m *Manager, store LifecycleStore, gateway RenewalGateway, notifier Notifier, cfg LifecycleConfig) *Lifecycle {
+	d := DefaultLifecycleConfig()
+	if cfg.Interval <= 0 {
+		cfg.Interval = d.Interval
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = d.GracePeriod
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = d.RetryInterval
+	}
+	return &Lifecycle{
+		manager:  m,
+		store:    store,
+		gateway:  gateway,
+		notifier: notifier,
+		cfg:      cfg,
+		logger:   logrus.StandardLogger(),
+	}
+}
+
+// Run processes subscriptions every interval until ctx is done
+func (l *Lifecycle) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := l.Process(time.Now()); err != nil {
+			l.logger.Errorf("Subscription lifecycle run failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Process applies every transition that is due at now
+func (l *Lifecycle) Process(now time.Time) error {
+	subs, err := l.store.ListRenewableSubscriptions()
+	if err != nil {
+		return fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+
+	for _, p := range subs {
+		if err := l.advance(p, now); err != nil {
+			l.logger.Errorf("Failed to process subscription %s: %v", p.ID, err)
+		}
+	}
+
+	if n, err := l.manager.ReleaseCoupons(now); err != nil {
+		l.logger.Errorf("Failed to release coupons of unpaid checkouts: %v", err)
+	} else if n > 0 {
+		l.logger.Infof("Released the coupons of %d unpaid checkouts", n)
+	}
+	return nil
+}
+
+func (l *Lifecycle) advance(p *PersistedSubscription, now time.Time) error {
+	if p.StripeSubID != "" {
+		// Stripe renews and retries these itself and reports the
+		// outcome by webhook
+		return nil
+	}
+	sub := p.subscription()
+
+	switch p.Status {
+	case StatusTrialing, StatusActive:
+		if now.Before(sub.EndDate) {
+			return nil
+		}
+		if !p.AutoRenew {
+			return l.expire(p, now)
+		}
+		return l.renew(p, now)
+	case StatusCanceled:
+		if now.Before(sub.EndDate) {
+			return nil
+		}
+		return l.expire(p, now)
+	case StatusPastDue:
+		if sub.GraceUntil != nil && !now.Before(*sub.GraceUntil) {
+			return l.expire(p, now)
+		}
+		return l.renew(p, now)
+	}
+	return nil
+}
+
+// renew charges the next period. The claim makes sure only one attempt runs
+// per retry interval. A charge the gateway is still processing is looked up
+// again on the next run instead of being charged a second time.
+func (l *Lifecycle) renew(p *PersistedSubscription, now time.Time) error {
+	claimed, err := l.store.ClaimRenewal(p.ID, now, now.Add(l.cfg.RetryInterval))
+	if err != nil || !claimed {
+		return err
+	}
+
+	// A downgrade scheduled during the period is what gets renewed
+	// on the plan's current terms
+	if p.ScheduledPlan != "" && p.PendingRef == "" {
+		p.PlanID = p.ScheduledPlan
+		p.PlanVersion = 0
+		if plan, err := GetPlan(PlanType(p.PlanID)); err == nil {
+			p.PlanVersion = plan.Version
+		}
+		p.ScheduledPlan = ""
+	}
+
+	ref := p.PendingRef
+	if ref != "" {
+		err = l.verify(ref)
+		if err != nil && !errors.Is(err, ErrChargeDeclined) && !errors.Is(err, ErrChargePending) {
+			// Not knowing the outcome is no reason to charge again
+			l.logger.Warnf("Failed to verify renewal %s: %v", ref, err)
+			err = ErrChargePending
+		}
+	} else {
+		ref = renewalReference(p)
+		err = l.charge(p, ref)
+	}
+
+	switch {
+	case errors.Is(err, ErrChargePending):
+		p.PendingRef = ref
+		p.NextRetryAt = formatTime(now.Add(l.cfg.Interval))
+		return l.store.UpdateSubscriptionLifecycle(p)
+	case err != nil:
+		if p.PendingRef != "" {
+			if won, err := l.store.ClearPendingRenewal(p.ID, p.PendingRef); err != nil || !won {
+				return err
+			}
+			p.PendingRef = ""
+		}
+		return l.pastDue(p, now, err)
+	}
+
+	if p.PendingRef != "" {
+		// The webhook may have settled the same charge in the meantime
+		if won, err := l.store.ClearPendingRenewal(p.ID, p.PendingRef); err != nil || !won {
+			return err
+		}
+		p.PendingRef = ""
+	}
+	return l.renewed(p, now)
+}
+
+// ConfirmRenewal settles a pending renewal charge once the gateway reports it
+// paid, e.g. from a webhook. Unknown or already settled references are
+// ignored.
+func (l *Lifecycle) ConfirmRenewal(reference string) error {
+	p, err := l.store.GetSubscriptionByPendingRenewal(reference)
+	if err != nil || p == nil {
+		return err
+	}
+	if won, err := l.store.ClearPendingRenewal(p.ID, reference); err != nil || !won {
+		return err
+	}
+	p.PendingRef = ""
+	return l.renewed(p, time.Now())
+}
+
+// renewed starts the paid period
+func (l *Lifecycle) renewed(p *PersistedSubscription, now time.Time) error {
+	// Advance from the billing anchor, skipping periods missed entirely
+	start := parseTime(p.EndDate)
+	end := start.AddDate(0, 1, 0)
+	for !now.Before(end) {
+		start, end = end, end.AddDate(0, 1, 0)
+	}
+	return l.startPeriod(p, start, end)
+}
+
+// RenewedByGateway starts a period a gateway renewed and charged itself,
+// such as a Stripe subscription. A period that already started is ignored.
+func (l *Lifecycle) RenewedByGateway(p *PersistedSubscription, start, end time.Time) error {
+	if p.Status == StatusActive && !parseTime(p.StartDate).Before(start) {
+		return nil
+	}
+	return l.startPeriod(p, start, end)
+}
+
+// ApplyGatewayStatus moves a subscription whose gateway manages renewals,
+// such as a Stripe subscription, into the state the gateway reports
+func (l *Lifecycle) ApplyGatewayStatus(p *PersistedSubscription, status string, now time.Time) error {
+	if p.Status == status || p.Status == StatusExpired {
+		return nil
+	}
+
+	switch status {
+	case StatusTrialing, StatusActive:
+		p.Status = status
+		p.AutoRenew = true
+		p.GraceUntil = ""
+		p.RetryCount = 0
+	case StatusCanceled:
+		p.Status = status
+		p.AutoRenew = false
+	case StatusPastDue:
+		return l.pastDue(p, now, errors.New("renewal payment failed at the gateway"))
+	case StatusExpired:
+		return l.expire(p, now)
+	default:
+		return fmt.Errorf("unknown subscription status %q", status)
+	}
+
+	if err := l.store.UpdateSubscriptionLifecycle(p); err != nil {
+		return err
+	}
+	l.manager.applySubscription(p.UserID, p.subscription(), false)
+	return nil
+}
+
+// startPeriod makes the subscription active for a paid period
+func (l *Lifecycle) startPeriod(p *PersistedSubscription, start, end time.Time) error {
+	p.Status = StatusActive
+	p.StartDate = formatTime(start)
+	p.EndDate = formatTime(end)
+	p.GraceUntil = ""
+	p.NextRetryAt = ""
+	p.RetryCount = 0
+	if err := l.store.UpdateSubscriptionLifecycle(p); err != nil {
+		return err
+	}
+
+	reset, err := l.store.MarkQuotaReset(p.ID, p.StartDate)
+	if err != nil {
+		l.logger.Warnf("Failed to record quota reset for %s: %v", p.ID, err)
+	}
+	l.manager.applySubscription(p.UserID, p.subscription(), reset)
+
+	if p.PaymentAuth != "" || p.StripeSubID != "" {
+		l.notify(EventRenewed, p, nil)
+	}
+	return nil
+}
+
+// renewalReference identifies one renewal attempt
+func renewalReference(p *PersistedSubscription) string {
+	return fmt.Sprintf("RENEW-%s-%s-%d", p.ID, parseTime(p.EndDate).Format("20060102"), p.RetryCount+1)
+}
+
+// charge collects payment for a renewal in the currency the payment method
+// was first charged in. The default Starter subscription has no payment
+// method on file and renews for free, as does pay-as-you-go, which is paid
+// with credits.
+func (l *Lifecycle) charge(p *PersistedSubscription, reference string) error {
+	plan, err := GetPlanVersion(PlanType(p.PlanID), p.PlanVersion)
+	if err != nil {
+		return err
+	}
+	if plan.PriceMonthly == 0 {
+		return nil
+	}
+	if p.PaymentAuth == "" {
+		if plan.ID == PlanStarter {
+			return nil
+		}
+		return errors.New("no payment method on file")
+	}
+	if l.gateway == nil {
+		return errors.New("no renewal gateway configured")
+	}
+
+	email, err := l.store.GetUserEmail(p.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to load customer email: %w", err)
+	}
+
+	// Overage of a soft quota is charged with the renewal that ends its period
+	overage, err := l.manager.billOverage(p, reference)
+	if err != nil {
+		return fmt.Errorf("failed to bill overage: %w", err)
+	}
+	discount, err := l.manager.renewalDiscount(p, plan, reference)
+	if err != nil {
+		return fmt.Errorf("failed to apply coupon: %w", err)
+	}
+
+	currency := p.Currency
+	if currency == "" {
+		// Authorizations saved before the currency was recorded come from
+		// Paystack checkouts, which charge in NGN by default
+		currency = string(CurrencyNGN)
+	}
+
+	_, err = l.gateway.ChargeRenewal(RenewalRequest{
+		UserID:         p.UserID,
+		Email:          email,
+		SubscriptionID: p.ID,
+		PlanID:         plan.ID,
+		AmountUSD:      plan.PriceMonthly - discount + overage,
+		Currency:       currency,
+		PaymentAuth:    p.PaymentAuth,
+		Reference:      reference,
+	})
+	return err
+}
+
+// verify looks up a pending renewal charge
+func (l *Lifecycle) verify(reference string) error {
+	if l.gateway == nil {
+		return errors.New("no renewal gateway configured")
+	}
+	return l.gateway.VerifyRenewal(reference)
+}
+
+// pastDue records a failed renewal. The grace period runs from the end of
+// the unpaid period.
+func (l *Lifecycle) pastDue(p *PersistedSubscription, now time.Time, cause error) error {
+	if p.Status != StatusPastDue {
+		p.GraceUntil = formatTime(parseTime(p.EndDate).Add(l.cfg.GracePeriod))
+	}
+	p.Status = StatusPastDue
+	p.RetryCount++
+	p.NextRetryAt = formatTime(now.Add(l.cfg.RetryInterval))
+	if err := l.store.UpdateSubscriptionLifecycle(p); err != nil {
+		return err
+	}
+
+	l.manager.applySubscription(p.UserID, p.subscription(), false)
+	l.notify(EventPaymentFailed, p, cause)
+	return nil
+}
+
+// expire ends a subscription and moves the user back to Starter
+func (l *Lifecycle) expire(p *PersistedSubscription, now time.Time) error {
+	p.Status = StatusExpired
+	p.NextRetryAt = ""
+	p.ScheduledPlan = ""
+	if err := l.store.UpdateSubscriptionLifecycle(p); err != nil {
+		return err
+	}
+	l.notify(EventExpired, p, nil)
+
+	_, err := l.manager.Subscribe(p.UserID, PlanStarter)
+	return err
+}
+
+func (l *Lifecycle) notify(event LifecycleEvent, p *PersistedSubscription, cause error) {
+	if l.notifier == nil {
+		return
+	}
+
+	email, err := l.store.GetUserEmail(p.UserID)
+	if err != nil {
+		l.logger.Warnf("Failed to load email for subscription notice: %v", err)
+		return
+	}
+
+	err = l.notifier.NotifySubscription(&Notice{
+		Event:        event,
+		UserID:       p.UserID,
+		Email:        email,
+		Subscription: p.subscription(),
+		Attempt:      p.RetryCount,
+		Err:          cause,
+	})
+	if err != nil {
+		l.logger.Warnf("Failed to send subscription notice: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package billing
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeGateway struct {
+	fail    bool
+	pending bool // charges stay pending until settled is set
+	settled error
+	charges []RenewalRequest
+}
+
+func (g *fakeGateway) ChargeRenewal(req RenewalRequest) (string, error) {
+	g.charges = append(g.charges, req)
+	if g.fail {
+		return "", fmt.Errorf("%w: card declined", ErrChargeDeclined)
+	}
+	if g.pending {
+		return req.Reference, ErrChargePending
+	}
+	return req.Reference, nil
+}
+
+func (g *fakeGateway) VerifyRenewal(reference string) error {
+	if g.pending {
+		return ErrChargePending
+	}
+	return g.settled
+}
+
+type fakeNotifier struct {
+	notices []*Notice
+}
+
+func (n *fakeNotifier) NotifySubscription(notice *Notice) error {
+	n.notices = append(n.notices, notice)
+	return nil
+}
+
+// dueSubscription puts userID on plan with a period that ended a minute ago
+func dueSubscription(t *testing.T, manager *Manager, store *MockStore, userID string, plan PlanType) time.Time {
+	t.Helper()
+	if _, err := manager.Subscribe(userID, plan); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	end := time.Now().Add(-time.Minute).Truncate(time.Second)
+	sub := store.subs[userID]
+	sub.StartDate = formatTime(end.AddDate(0, -1, 0))
+	sub.EndDate = formatTime(end)
+	sub.PaymentAuth = "AUTH_test"
+	store.emails[userID] = userID + "@example.com"
+	return end
+}
+
+func TestLifecycleRenewsFromAnchor(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	gateway := &fakeGateway{}
+	notifier := &fakeNotifier{}
+	lc := NewLifecycle(manager, store, gateway, notifier, LifecycleConfig{})
+
+	end := dueSubscription(t, manager, store, "frank", PlanPersonal)
+	manager.RecordData("frank", 1000)
+
+	if err := lc.Process(time.Now()); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	if len(gateway.charges) != 1 {
+		t.Fatalf("Expected one renewal charge, got %d", len(gateway.charges))
+	}
+	if c := gateway.charges[0]; c.AmountUSD != 29 || c.PaymentAuth != "AUTH_test" || c.Email != "frank@example.com" {
+		t.Errorf("Unexpected renewal charge: %+v", c)
+	}
+
+	sub := manager.GetSubscription("frank")
+	if sub.Status != StatusActive {
+		t.Errorf("Expected active subscription, got %s", sub.Status)
+	}
+	if !sub.StartDate.Equal(end) || !sub.EndDate.Equal(end.AddDate(0, 1, 0)) {
+		t.Errorf("Expected period to follow the anchor, got %s - %s", sub.StartDate, sub.EndDate)
+	}
+	if stats := manager.GetUsage("frank"); stats.DataTransferred != 0 || !stats.PeriodStart.Equal(end) {
+		t.Errorf("Expected usage reset for the new period, got %+v", stats)
+	}
+	if store.subs["frank"].LastReset != formatTime(end) {
+		t.Errorf("Expected last_reset %s, got %s", formatTime(end), store.subs["frank"].LastReset)
+	}
+	if len(notifier.notices) != 1 || notifier.notices[0].Event != EventRenewed {
+		t.Errorf("Expected a renewal notice, got %+v", notifier.notices)
+	}
+
+	// Nothing is due until the next anchor
+	manager.RecordData("frank", 500)
+	lc.Process(time.Now())
+	if len(gateway.charges) != 1 {
+		t.Errorf("Expected no further charge, got %d", len(gateway.charges))
+	}
+	if stats := manager.GetUsage("frank"); stats.DataTransferred != 500 {
+		t.Errorf("Expected usage to keep counting, got %d", stats.DataTransferred)
+	}
+}
+
+func TestLifecycleQuotaResetIsIdempotent(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	lc := NewLifecycle(manager, store, &fakeGateway{}, nil, LifecycleConfig{})
+
+	end := dueSubscription(t, manager, store, "gina", PlanPersonal)
+	// The reset for the coming period was already done, e.g. by another instance
+	store.subs["gina"].LastReset = formatTime(end)
+	manager.RecordData("gina", 1000)
+
+	lc.Process(time.Now())
+
+	if stats := manager.GetUsage("gina"); stats.DataTransferred != 1000 {
+		t.Errorf("Expected usage to be kept, got %d", stats.DataTransferred)
+	}
+}
+
+func TestLifecyclePastDueThenExpires(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	gateway := &fakeGateway{fail: true}
+	notifier := &fakeNotifier{}
+	lc := NewLifecycle(manager, store, gateway, notifier, LifecycleConfig{
+		GracePeriod:   3 * 24 * time.Hour,
+		RetryInterval: 24 * time.Hour,
+	})
+
+	end := dueSubscription(t, manager, store, "hank", PlanPersonal)
+	now := time.Now()
+
+	lc.Process(now)
+	sub := manager.GetSubscription("hank")
+	if sub.Status != StatusPastDue {
+		t.Fatalf("Expected past_due after a failed renewal, got %s", sub.Status)
+	}
+	if sub.GraceUntil == nil || !sub.GraceUntil.Equal(end.Add(3*24*time.Hour)) {
+		t.Errorf("Expected grace until %s, got %v", end.Add(3*24*time.Hour), sub.GraceUntil)
+	}
+	if err := manager.CheckQuota("hank"); err != nil {
+		t.Errorf("Expected access during the grace period, got %v", err)
+	}
+	if len(notifier.notices) != 1 || notifier.notices[0].Event != EventPaymentFailed || notifier.notices[0].Attempt != 1 {
+		t.Errorf("Expected a payment failed notice, got %+v", notifier.notices)
+	}
+
+	// Retries wait for the retry interval
+	lc.Process(now.Add(time.Hour))
+	if len(gateway.charges) != 1 {
+		t.Errorf("Expected no retry within the interval, got %d charges", len(gateway.charges))
+	}
+	lc.Process(now.Add(25 * time.Hour))
+	if len(gateway.charges) != 2 || store.subs["hank"].RetryCount != 2 {
+		t.Errorf("Expected a second attempt, got %d charges", len(gateway.charges))
+	}
+
+	// Once the grace period is over the subscription expires
+	lc.Process(end.Add(3*24*time.Hour + time.Minute))
+	if len(gateway.charges) != 2 {
+		t.Errorf("Expected no charge after the grace period, got %d", len(gateway.charges))
+	}
+	if last := notifier.notices[len(notifier.notices)-1]; last.Event != EventExpired {
+		t.Errorf("Expected an expiry notice, got %s", last.Event)
+	}
+	sub = manager.GetSubscription("hank")
+	if sub.PlanID != PlanStarter || sub.Status != StatusActive {
+		t.Errorf("Expected fallback to an active Starter plan, got %s/%s", sub.PlanID, sub.Status)
+	}
+}
+
+func TestLifecycleCanceledExpiresAtPeriodEnd(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	gateway := &fakeGateway{}
+	lc := NewLifecycle(manager, store, gateway, nil, LifecycleConfig{})
+
+	if _, err := manager.Subscribe("iris", PlanTeam); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := manager.CancelSubscription("iris"); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+
+	// Canceled subscriptions run until the end of the paid period
+	lc.Process(time.Now())
+	if sub := manager.GetSubscription("iris"); sub.PlanID != PlanTeam {
+		t.Errorf("Expected Team until the period ends, got %s", sub.PlanID)
+	}
+
+	lc.Process(time.Now().AddDate(0, 1, 1))
+	if sub := manager.GetSubscription("iris"); sub.PlanID != PlanStarter {
+		t.Errorf("Expected Starter after the period ended, got %s", sub.PlanID)
+	}
+	if len(gateway.charges) != 0 {
+		t.Errorf("Expected canceled subscription never to be charged, got %d charges", len(gateway.charges))
+	}
+}
+
+func TestLifecyclePendingChargeIsNotRepeated(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	gateway := &fakeGateway{pending: true}
+	lc := NewLifecycle(manager, store, gateway, nil, LifecycleConfig{Interval: time.Minute})
+
+	end := dueSubscription(t, manager, store, "jill", PlanPersonal)
+	store.subs["jill"].Currency = "GHS"
+	now := time.Now()
+
+	lc.Process(now)
+	if len(gateway.charges) != 1 || gateway.charges[0].Currency != "GHS" {
+		t.Fatalf("Expected one charge in the subscription's currency, got %+v", gateway.charges)
+	}
+	ref := store.subs["jill"].PendingRef
+	if ref == "" || store.subs["jill"].Status != StatusActive {
+		t.Fatalf("Expected an active subscription waiting for the charge, got %+v", store.subs["jill"])
+	}
+
+	// Later runs look the charge up instead of charging again
+	lc.Process(now.Add(2 * time.Minute))
+	if len(gateway.charges) != 1 {
+		t.Errorf("Expected the pending charge not to be repeated, got %d charges", len(gateway.charges))
+	}
+
+	// The webhook settles the charge once
+	if err := lc.ConfirmRenewal(ref); err != nil {
+		t.Fatalf("ConfirmRenewal failed: %v", err)
+	}
+	lc.ConfirmRenewal(ref)
+	if sub := manager.GetSubscription("jill"); !sub.StartDate.Equal(end) || !sub.EndDate.Equal(end.AddDate(0, 1, 0)) {
+		t.Errorf("Expected one period added, got %s - %s", sub.StartDate, sub.EndDate)
+	}
+	if store.subs["jill"].PendingRef != "" {
+		t.Error("Expected the pending reference to be cleared")
+	}
+}
+
+func TestLifecyclePendingChargeDeclined(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	gateway := &fakeGateway{pending: true}
+	lc := NewLifecycle(manager, store, gateway, nil, LifecycleConfig{Interval: time.Minute})
+
+	dueSubscription(t, manager, store, "kim", PlanPersonal)
+	now := time.Now()
+	lc.Process(now)
+
+	gateway.pending = false
+	gateway.settled = fmt.Errorf("%w: insufficient funds", ErrChargeDeclined)
+	lc.Process(now.Add(2 * time.Minute))
+
+	if sub := store.subs["kim"]; sub.Status != StatusPastDue || sub.PendingRef != "" {
+		t.Errorf("Expected a declined charge to make the subscription past due, got %+v", sub)
+	}
+	if len(gateway.charges) != 1 {
+		t.Errorf("Expected no new charge before the retry interval, got %d", len(gateway.charges))
+	}
+}
+
+func TestLifecycleLeavesGatewayRenewalsToTheGateway(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	gateway := &fakeGateway{}
+	notifier := &fakeNotifier{}
+	lc := NewLifecycle(manager, store, gateway, notifier, LifecycleConfig{})
+
+	end := dueSubscription(t, manager, store, "lena", PlanPersonal)
+	store.subs["lena"].PaymentAuth = ""
+	store.subs["lena"].StripeSubID = "sub_1"
+
+	lc.Process(time.Now())
+	if len(gateway.charges) != 0 || store.subs["lena"].Status != StatusActive {
+		t.Fatalf("Expected Stripe to renew the subscription, got %d charges and %+v", len(gateway.charges), store.subs["lena"])
+	}
+
+	p, _ := store.GetSubscription("lena")
+	if err := lc.RenewedByGateway(p, end, end.AddDate(0, 1, 0)); err != nil {
+		t.Fatalf("RenewedByGateway failed: %v", err)
+	}
+	if sub := manager.GetSubscription("lena"); !sub.StartDate.Equal(end) || !sub.EndDate.Equal(end.AddDate(0, 1, 0)) {
+		t.Errorf("Expected the period Stripe reported, got %s - %s", sub.StartDate, sub.EndDate)
+	}
+
+	// The same renewal reported again changes nothing
+	p, _ = store.GetSubscription("lena")
+	lc.RenewedByGateway(p, end, end.AddDate(0, 1, 0))
+	if len(notifier.notices) != 1 {
+		t.Errorf("Expected one renewal notice, got %d", len(notifier.notices))
+	}
+
+	now := time.Now()
+	for _, step := range []struct{ status, want string }{
+		{StatusPastDue, StatusPastDue},
+		{StatusActive, StatusActive},
+		{StatusCanceled, StatusCanceled},
+		{StatusExpired, StatusExpired},
+	} {
+		p, _ = store.GetSubscription("lena")
+		if err := lc.ApplyGatewayStatus(p, step.status, now); err != nil {
+			t.Fatalf("ApplyGatewayStatus(%s) failed: %v", step.status, err)
+		}
+		if got := store.subs[p.UserID]; got.ID == p.ID && got.Status != step.want {
+			t.Errorf("Expected %s, got %s", step.want, got.Status)
+		}
+	}
+	if sub := manager.GetSubscription("lena"); sub.PlanID != PlanStarter {
+		t.Errorf("Expected Starter once Stripe ended the subscription, got %s", sub.PlanID)
+	}
+}
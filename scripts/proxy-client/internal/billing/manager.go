@@ -10,129 +10,171 @@ import (
 
 type Store interface {
 	GetSubscription(userID string) (*PersistedSubscription, error)
-	SetSubscription(userID, id, planID, status, start, end string, autoRenew bool) error
-	GetLatestUsage(userID string) (int64, int64, int64, int64, error)
-	UpdateUsage(userID string, dataTransferred, requests, ads, threats int64) error
+	SetSubscription(userID, id, planID string, planVersion int, status, start, end string, autoRenew bool) error
+	GetPeriodUsage(userID string, periodStart time.Time) (int64, int64, int64, int64, error)
+	UpdateUsage(userID string, periodStart, periodEnd time.Time, dataTransferred, requests, ads, threats int64) error
+	SetScheduledPlan(subscriptionID, planID string) error
+	SetQuotaMode(subscriptionID, mode string) error
 }
 
+// PersistedSubscription is a subscription as stored. Times are RFC 3339
+// strings; empty strings mean unset.
 type PersistedSubscription struct {
-	ID        string
-	PlanID    string
-	Status    string
-	StartDate string
-	EndDate   string
-	AutoRenew bool
+	ID          string
+	UserID      string
+	PlanID      string
+	PlanVersion int // version of the plan's terms; 0 for the latest
+	Status      string
+	StartDate   string
+	EndDate     string
+	AutoRenew   bool
+
+	LastReset   string // start of the period whose quota was last reset
+	GraceUntil  string // end of the grace period while past_due
+	NextRetryAt string // earliest next renewal attempt
+	RetryCount  int    // failed renewal attempts in a row
+	PaymentAuth string // reusable payment authorization for renewals
+	Currency    string // currency the payment authorization is charged in
+	PendingRef  string // renewal charge the gateway has not settled yet
+	StripeSubID string // set when Stripe bills the subscription
+
+	ScheduledPlan string // plan taking over at the next renewal
+	QuotaMode     string // hard, soft or throttle; empty is hard
+	Coupon        string // recurring coupon discounting renewals
 }
 
+// DefaultIdleTimeout is how long an account stays loaded without activity
+const DefaultIdleTimeout = 30 * time.Minute
+
 // Manager handles all billing, subscription, and quota logic.
 // It is responsible for plan enforcement, usage tracking, and invoice generation.
+// Each user has their own Account, loaded from the store on first use and
+// evicted again once it has been idle for a while.
 type Manager struct {
-	store        Store // Changed from *storage.Store to Store interface to match existing usage
-	subscription *Subscription
-	mu           sync.RWMutex
-	quotaReset   *time.Timer
-	// Retaining other fields from original Manager struct that were not explicitly removed in the instruction's new struct definition
-	activeUserID     string
+	store Store
+	mu    sync.RWMutex
+
+	accounts    map[string]*Account
+	idleTimeout time.Duration
+	// localUserID is billed for connections that did not authenticate,
+	// which is the signed-in user of the desktop app
+	localUserID string
+
 	activeCurrency   CurrencyCode
-	Usage            *UsageTracker
 	paystackProvider *PaystackProvider
 	cryptoProvider   *CryptoProvider
+	stripeProvider   *StripeProvider
+	credits          *CreditLedger
+	quota            *QuotaMeter
+	promotions       *Promotions
+	orgs             *Orgs
+	subUsers         *SubUsers
 }
 
 // NewManager creates a new instance of the Billing Manager.
-// It initializes the manager with the provided store and loads the current subscription if any.
 func NewManager(store Store) *Manager {
-	m := &Manager{
-		Usage:          NewUsageTracker(),
+	return &Manager{
 		store:          store,
-		activeUserID:   "default", // Default to "default" until login
+		accounts:       make(map[string]*Account),
+		idleTimeout:    DefaultIdleTimeout,
+		localUserID:    "default", // Default to "default" until login
 		activeCurrency: CurrencyUSD,
 	}
-
-	// Try to load default user provided they exist or just start fresh
-	m.loadUser("default")
-
-	return m
 }
 
-func (m *Manager) SetActiveUser(userID string) error {
+// SetIdleTimeout sets how long an account stays loaded without activity
+func (m *Manager) SetIdleTimeout(d time.Duration) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.idleTimeout = d
+}
 
-	// Sync current user before switching
-	if m.subscription != nil {
-		m.syncUsageLocked()
-	}
+// SetLocalUser sets the user billed for unauthenticated local connections
+func (m *Manager) SetLocalUser(userID string) {
+	m.mu.Lock()
+	m.localUserID = userID
+	m.mu.Unlock()
 
-	m.activeUserID = userID
-	return m.loadUserLocked(userID)
+	m.Account(userID)
 }
 
-func (m *Manager) loadUser(userID string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	return m.loadUserLocked(userID)
+// LocalUser returns the user billed for unauthenticated local connections
+func (m *Manager) LocalUser() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.localUserID
 }
 
-func (m *Manager) loadUserLocked(userID string) error {
-	// Reset usage tracker for new user
-	m.Usage = NewUsageTracker()
+// Account returns the billing account of a user, loading it from the store
+// if it is not in memory. The account is registered before it is loaded, so
+// concurrent first requests share one load instead of each creating a
+// subscription. Members of an organization share its account.
+func (m *Manager) Account(userID string) *Account {
+	userID = m.billingAccount(userID)
 
-	if m.store != nil {
-		if s, err := m.store.GetSubscription(userID); err == nil && s != nil {
-			start, _ := time.Parse(time.RFC3339, s.StartDate)
-			end, _ := time.Parse(time.RFC3339, s.EndDate)
-			m.subscription = &Subscription{
-				ID:        s.ID,
-				PlanID:    PlanType(s.PlanID),
-				Status:    s.Status,
-				StartDate: start,
-				EndDate:   end,
-				AutoRenew: s.AutoRenew,
-			}
-		} else {
-			m.subscription = nil
+	m.mu.RLock()
+	acct, ok := m.accounts[userID]
+	m.mu.RUnlock()
+
+	if !ok {
+		m.mu.Lock()
+		// Another request may have registered the account in the meantime
+		acct, ok = m.accounts[userID]
+		if !ok {
+			acct = newAccount(userID)
+			m.accounts[userID] = acct
 		}
+		m.mu.Unlock()
 
-		if data, reqs, ads, _, err := m.store.GetLatestUsage(userID); err == nil {
-			m.Usage.mu.Lock()
-			m.Usage.currentUsage.DataTransferred = data
-			m.Usage.currentUsage.RequestsMade = reqs
-			m.Usage.currentUsage.AdsBlocked = ads
-			m.Usage.mu.Unlock()
+		if !ok {
+			acct.load(m.store)
+			return acct
 		}
 	}
 
-	// Auto-subscribe to Starter if no sub
-	if m.subscription == nil {
-		m.subscription = &Subscription{
-			ID:        uuid.New().String(),
-			PlanID:    PlanStarter,
-			Status:    "active",
-			StartDate: time.Now(),
-			EndDate:   time.Now().AddDate(0, 1, 0),
-			AutoRenew: true,
-		}
-		// Persist this auto-created sub
-		if m.store != nil {
-			m.store.SetSubscription(
-				userID,
-				m.subscription.ID,
-				string(m.subscription.PlanID),
-				m.subscription.Status,
-				m.subscription.StartDate.Format(time.RFC3339),
-				m.subscription.EndDate.Format(time.RFC3339),
-				m.subscription.AutoRenew,
-			)
-		}
+	<-acct.loaded
+	acct.touch()
+	return acct
+}
+
+// userOrLocal resolves an empty user ID to the local user
+func (m *Manager) userOrLocal(userID string) string {
+	if userID == "" {
+		return m.LocalUser()
 	}
-	return nil
+	return userID
 }
 
 func (m *Manager) SetPaystack(p *PaystackProvider) { m.paystackProvider = p }
 func (m *Manager) SetCrypto(p *CryptoProvider)     { m.cryptoProvider = p }
+func (m *Manager) SetStripe(p *StripeProvider)     { m.stripeProvider = p }
+
+// Stripe returns the Stripe provider, or nil if Stripe is not configured
+func (m *Manager) Stripe() *StripeProvider { return m.stripeProvider }
 
 func (m *Manager) ProcessCheckout(req CheckoutRequest) (*CheckoutResponse, error) {
+	if req.Coupon != "" {
+		if err := m.applyCoupon(&req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := m.checkout(req)
+	if err != nil && req.coupon != nil {
+		// The checkout never started, so its coupon is free again
+		if _, rerr := m.promotions.store.ReleaseCoupon(req.Reference); rerr != nil {
+			m.promotions.logger.Errorf("Failed to release coupon of checkout %s: %v", req.Reference, rerr)
+		}
+	}
+	if err != nil || req.coupon == nil {
+		return resp, err
+	}
+	resp.Coupon = req.coupon.Code
+	resp.DiscountUSD = req.discount
+	return resp, nil
+}
+
+// checkout creates the checkout with the gateway of its payment method
+func (m *Manager) checkout(req CheckoutRequest) (*CheckoutResponse, error) {
 	switch req.Method {
 	case MethodPaystack:
 		if m.paystackProvider == nil {
@@ -144,6 +186,11 @@ func (m *Manager) ProcessCheckout(req CheckoutRequest) (*CheckoutResponse, error
 			return nil, errors.New("crypto not configured")
 		}
 		return m.cryptoProvider.CreateCheckout(req)
+	case MethodStripe:
+		if m.stripeProvider == nil {
+			return nil, errors.New("stripe not configured")
+		}
+		return m.stripeProvider.CreateCheckout(req)
 	}
 	return nil, errors.New("unsupported payment method")
 }
@@ -162,184 +209,375 @@ func (m *Manager) GetAvailablePlans() []Plan {
 	return AvailablePlansInCurrency(m.activeCurrency)
 }
 
-// GetSubscription returns the current active subscription
-func (m *Manager) GetSubscription() *Subscription {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.subscription
+// GetSubscription returns the subscription of a user
+func (m *Manager) GetSubscription(userID string) *Subscription {
+	return m.Account(userID).Subscription()
 }
 
-// Subscribe updates the current subscription
-func (m *Manager) Subscribe(planID PlanType) (*Subscription, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// GetUsage returns the usage of a user in the current period
+func (m *Manager) GetUsage(userID string) *UsageStats {
+	return m.Account(userID).Usage.GetStats()
+}
 
-	_, err := GetPlan(planID)
-	if err != nil {
+// Subscribe starts a new subscription to a plan for a user
+func (m *Manager) Subscribe(userID string, planID PlanType) (*Subscription, error) {
+	if err := m.SubscribeUser(userID, planID, uuid.New().String()); err != nil {
 		return nil, err
 	}
-
-	m.subscription = &Subscription{
-		ID:        uuid.New().String(),
-		PlanID:    planID,
-		Status:    "active",
-		StartDate: time.Now(),
-		EndDate:   time.Now().AddDate(0, 1, 0),
-		AutoRenew: true,
-	}
-
-	if m.store != nil {
-		m.store.SetSubscription(
-			m.activeUserID,
-			m.subscription.ID,
-			string(m.subscription.PlanID),
-			m.subscription.Status,
-			m.subscription.StartDate.Format(time.RFC3339),
-			m.subscription.EndDate.Format(time.RFC3339),
-			m.subscription.AutoRenew,
-		)
-	}
-
-	return m.subscription, nil
+	return m.GetSubscription(userID), nil
 }
 
-// SubscribeUser creates a subscription for a specific user (for webhook/admin use)
+// SubscribeUser creates a subscription with a known ID for a user, as done by
+// payment webhooks. A loaded account picks up the new plan immediately.
 func (m *Manager) SubscribeUser(userID string, planID PlanType, subscriptionID string) error {
-	_, err := GetPlan(planID)
+	plan, err := offeredPlan(planID)
 	if err != nil {
 		return err
 	}
 
-	if m.store != nil {
-		return m.store.SetSubscription(
-			userID,
-			subscriptionID,
-			string(planID),
-			"active",
-			time.Now().Format(time.RFC3339),
-			time.Now().AddDate(0, 1, 0).Format(time.RFC3339),
-			true,
-		)
+	now := time.Now().Truncate(time.Second)
+	return m.Account(userID).setSubscription(m.store, &Subscription{
+		ID:          subscriptionID,
+		PlanID:      planID,
+		PlanVersion: plan.Version,
+		Status:      StatusActive,
+		StartDate:   now,
+		EndDate:     now.AddDate(0, 1, 0),
+		AutoRenew:   true,
+	})
+}
+
+// StartTrial puts a user on a plan for a trial period. When the trial ends
+// the subscription is renewed like any other.
+func (m *Manager) StartTrial(userID string, planID PlanType, subscriptionID string, length time.Duration) error {
+	plan, err := offeredPlan(planID)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	now := time.Now().Truncate(time.Second)
+	return m.Account(userID).setSubscription(m.store, &Subscription{
+		ID:          subscriptionID,
+		PlanID:      planID,
+		PlanVersion: plan.Version,
+		Status:      StatusTrialing,
+		StartDate:   now,
+		EndDate:     now.Add(length),
+		AutoRenew:   true,
+	})
 }
 
-// CancelSubscription marks the subscription as canceled (no auto-renew)
-func (m *Manager) CancelSubscription() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// offeredPlan returns the latest version of a plan that can be subscribed to
+func offeredPlan(id PlanType) (Plan, error) {
+	plan, err := GetPlan(id)
+	if err != nil {
+		return Plan{}, err
+	}
+	if !plan.Active {
+		return Plan{}, ErrPlanRetired
+	}
+	return plan, nil
+}
 
-	if m.subscription == nil {
+// CancelSubscription marks the subscription as canceled (no auto-renew).
+// A subscription Stripe bills is stopped at Stripe first.
+func (m *Manager) CancelSubscription(userID string) error {
+	acct := m.Account(userID)
+	sub := acct.Subscription()
+	if sub == nil {
 		return nil
 	}
 
-	m.subscription.AutoRenew = false
-	m.subscription.Status = "canceled"
-
 	if m.store != nil {
-		m.store.SetSubscription(
-			m.activeUserID,
-			m.subscription.ID,
-			string(m.subscription.PlanID),
-			m.subscription.Status,
-			m.subscription.StartDate.Format(time.RFC3339),
-			m.subscription.EndDate.Format(time.RFC3339),
-			m.subscription.AutoRenew,
-		)
+		if p, err := m.store.GetSubscription(userID); err == nil && p != nil && p.ID == sub.ID && p.StripeSubID != "" {
+			if m.stripeProvider == nil {
+				return errors.New("stripe not configured")
+			}
+			if err := m.stripeProvider.CancelAtPeriodEnd(p.StripeSubID); err != nil {
+				return err
+			}
+		}
 	}
-	return nil
-}
 
-// SyncUsage persists current usage to storage
-func (m *Manager) SyncUsage() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	return m.syncUsageLocked()
+	sub.AutoRenew = false
+	sub.Status = StatusCanceled
+	return acct.setSubscription(m.store, sub)
 }
 
-func (m *Manager) syncUsageLocked() error {
-	if m.store == nil {
-		return nil
+// CheckQuota checks if the user's usage is within their plan's limits
+func (m *Manager) CheckQuota(userID string) error {
+	acct := m.Account(userID)
+	if err := acct.checkQuota(); err != nil {
+		return err
 	}
-	stats := m.Usage.GetStats()
-	return m.store.UpdateUsage(m.activeUserID, stats.DataTransferred, stats.RequestsMade, stats.AdsBlocked, stats.ThreatsBlocked)
+	return m.checkOwnLimits(userID, acct, false)
 }
 
-// CheckQuota checks if the current usage is within the plan's limits
-func (m *Manager) CheckQuota() error {
-	m.mu.RLock()
-	sub := m.subscription
-	m.mu.RUnlock()
-
-	if sub == nil {
-		return errors.New("no active subscription")
+// CheckData checks that the user has data left. It is checked as traffic
+// flows, to cut off connections that use up the data of their plan, their
+// organization membership or their sub-user.
+func (m *Manager) CheckData(userID string) error {
+	userID = m.userOrLocal(userID)
+	acct := m.Account(userID)
+	if err := acct.checkData(); err != nil {
+		return err
 	}
+	return m.checkOwnLimits(userID, acct, false)
+}
 
-	if sub.Status != "active" && sub.Status != "canceled" {
-		if time.Now().After(sub.EndDate) {
-			return errors.New("subscription expired")
+// checkOwnLimits checks the limits of a user within the account they are
+// billed on: those of an organization member or of a sub-user
+func (m *Manager) checkOwnLimits(userID string, acct *Account, opening bool) error {
+	periodStart := acct.Usage.GetStats().PeriodStart
+	if m.orgs != nil {
+		if err := m.orgs.checkMember(userID, periodStart, opening); err != nil {
+			return err
 		}
 	}
+	if m.subUsers != nil {
+		return m.subUsers.check(userID, periodStart, opening)
+	}
+	return nil
+}
+
+// CanAcceptConnection checks if the user can open a new connection
+func (m *Manager) CanAcceptConnection(userID string) error {
+	acct := m.Account(userID)
+	if err := acct.checkQuota(); err != nil {
+		return err
+	}
 
-	plan, err := GetPlan(sub.PlanID)
+	plan, err := acct.plan()
 	if err != nil {
 		return err
 	}
+	if plan.ID == PlanPAYG {
+		if err := m.checkCredits(acct); err != nil {
+			return err
+		}
+	}
+	stats := acct.Usage.GetStats()
+	if plan.ConcurrentConns != -1 && stats.ActiveConnections >= plan.ConcurrentConns {
+		return errors.New("concurrent connection limit exceeded")
+	}
 
-	stats := m.Usage.GetStats()
+	return m.checkOwnLimits(userID, acct, true)
+}
 
-	// Check Data Limit
-	if plan.DataLimitMB != -1 {
-		limitBytes := plan.DataLimitMB * 1024 * 1024
-		if stats.DataTransferred >= limitBytes {
-			return errors.New("data limit exceeded")
+// OpenConnection admits a connection for a user, or the local user if userID
+// is empty. The request is counted and the connection holds one of the plan's
+// concurrent connection slots until release is called.
+func (m *Manager) OpenConnection(userID string) (release func(), err error) {
+	userID = m.userOrLocal(userID)
+	acct := m.Account(userID)
+	if err := acct.checkQuota(); err != nil {
+		return nil, err
+	}
+	plan, err := acct.plan()
+	if err != nil {
+		return nil, err
+	}
+	// Pay-as-you-go connections need credits left
+	if plan.ID == PlanPAYG {
+		if err := m.checkCredits(acct); err != nil {
+			return nil, err
 		}
 	}
 
-	// Check Request Limit
-	if plan.RequestLimit != -1 {
-		if stats.RequestsMade >= plan.RequestLimit {
-			return errors.New("request limit exceeded")
+	// Organization members and sub-users also count against their own limits
+	periodStart := acct.Usage.GetStats().PeriodStart
+	releaseMember, releaseSubUser := func() {}, func() {}
+	if m.orgs != nil {
+		if releaseMember, err = m.orgs.open(userID, periodStart); err != nil {
+			return nil, err
+		}
+	}
+	if m.subUsers != nil {
+		if releaseSubUser, err = m.subUsers.open(userID, periodStart); err != nil {
+			releaseMember()
+			return nil, err
 		}
 	}
 
-	return nil
+	u := acct.Usage
+	u.mu.Lock()
+	if plan.ConcurrentConns != -1 && u.currentUsage.ActiveConnections >= plan.ConcurrentConns {
+		u.mu.Unlock()
+		releaseMember()
+		releaseSubUser()
+		return nil, errors.New("concurrent connection limit exceeded")
+	}
+	u.connectionOpened(time.Now())
+	u.currentUsage.RequestsMade++
+	u.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			releaseMember()
+			releaseSubUser()
+			u.mu.Lock()
+			u.connectionClosed(time.Now())
+			u.mu.Unlock()
+			acct.touch()
+		})
+	}, nil
 }
 
-// CanAcceptConnection checks if the user can open a new connection
-func (m *Manager) CanAcceptConnection() error {
-	if err := m.CheckQuota(); err != nil {
-		return err
+// RecordData counts transferred bytes for a user, or the local user if
+// userID is empty
+func (m *Manager) RecordData(userID string, bytes int64) {
+	userID = m.userOrLocal(userID)
+	acct := m.Account(userID)
+	acct.Usage.AddData(bytes)
+	periodStart := acct.Usage.GetStats().PeriodStart
+	if m.orgs != nil {
+		m.orgs.record(userID, periodStart, bytes)
+	}
+	if m.subUsers != nil {
+		m.subUsers.record(userID, periodStart, bytes)
 	}
+}
 
+// SyncUsage persists the usage of every loaded account, accrues the overage
+// of soft quotas, charges the metered usage of pay-as-you-go accounts to
+// their credits and evicts accounts that have been idle longer than the idle
+// timeout
+func (m *Manager) SyncUsage() error {
 	m.mu.RLock()
-	sub := m.subscription
+	accounts := make([]*Account, 0, len(m.accounts))
+	for _, acct := range m.accounts {
+		// Accounts still loading have nothing to sync yet
+		if acct.isLoaded() {
+			accounts = append(accounts, acct)
+		}
+	}
+	idleBefore := time.Now().Add(-m.idleTimeout)
+	local := m.localUserID
 	m.mu.RUnlock()
 
-	plan, _ := GetPlan(sub.PlanID)
+	now := time.Now()
+	var firstErr error
+	if m.orgs != nil {
+		firstErr = m.orgs.sync()
+	}
+	if m.subUsers != nil {
+		if err := m.subUsers.sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, acct := range accounts {
+		if m.quota != nil {
+			if err := m.quota.meter(acct); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if m.credits != nil {
+			if err := m.credits.meter(acct, now); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if m.store != nil {
+			if err := acct.sync(m.store); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
 
-	stats := m.Usage.GetStats()
-	if plan.ConcurrentConns != -1 && stats.ActiveConnections >= plan.ConcurrentConns {
-		return errors.New("concurrent connection limit exceeded")
+		if acct.UserID != local && acct.idleSince(idleBefore) {
+			if err := m.evict(acct, idleBefore); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
+	return firstErr
+}
 
+// evict removes an idle account from memory. Idleness is checked again under
+// the lock because a request may have picked the account up since the sync,
+// and usage recorded in the meantime is charged and flushed before the
+// account goes.
+func (m *Manager) evict(acct *Account, idleBefore time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.accounts[acct.UserID] != acct || acct.UserID == m.localUserID || !acct.idleSince(idleBefore) {
+		return nil
+	}
+	if m.quota != nil {
+		if err := m.quota.meter(acct); err != nil {
+			return err
+		}
+	}
+	if m.credits != nil {
+		if err := m.credits.meter(acct, time.Now()); err != nil {
+			return err
+		}
+	}
+	if m.store != nil {
+		if err := acct.sync(m.store); err != nil {
+			return err
+		}
+	}
+	delete(m.accounts, acct.UserID)
 	return nil
 }
 
-// ResetQuotas resets the usage tracking for the new billing cycle
-func (m *Manager) ResetQuotas() error {
+// CloseAccount stops what a user is billed for before their account is
+// deleted. A subscription of their own is canceled; a member leaves their
+// organization and a sub-user is removed from their parent, leaving the
+// subscription they shared alone.
+func (m *Manager) CloseAccount(userID string) error {
+	if m.subUsers != nil && IsSubUser(userID) {
+		return m.DeleteSubUser(m.subUsers.parent(userID), userID)
+	}
+	if m.billingAccount(userID) != userID {
+		return m.RemoveMember(userID, userID)
+	}
+	return m.CancelSubscription(userID)
+}
+
+// Forget drops a user's account from memory without saving it, so an
+// account being deleted is not written back
+func (m *Manager) Forget(userID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	delete(m.accounts, userID)
+}
 
-	m.Usage.mu.Lock()
-	m.Usage.currentUsage = &UsageStats{} // Reset to zero
-	m.Usage.mu.Unlock()
+// CheckAPIAccess reports whether the plan of the given user includes API access.
+// Users without an active subscription are treated as Starter.
+func (m *Manager) CheckAPIAccess(userID string) error {
+	plan := m.CurrentPlan(userID)
+	return CanAccessAPI(&User{ID: userID, Plan: plan.ID, Flags: &plan.Flags})
+}
 
-	if m.store != nil {
-		// Update store with zero values
-		return m.store.UpdateUsage(m.activeUserID, 0, 0, 0, 0)
+// CurrentPlan returns the terms the user is entitled to: the version of the
+// plan they subscribed to. Users without an active subscription get Starter.
+func (m *Manager) CurrentPlan(userID string) Plan {
+	if p, err := m.Account(userID).plan(); err == nil {
+		return p
 	}
+	p, _ := GetPlan(PlanStarter)
+	return p
+}
 
-	return nil
+// applySubscription updates a loaded account after the lifecycle changed its
+// subscription. With resetUsage the account starts counting a new period.
+func (m *Manager) applySubscription(userID string, sub *Subscription, resetUsage bool) {
+	m.mu.RLock()
+	acct, ok := m.accounts[userID]
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	acct.mu.Lock()
+	acct.subscription = sub
+	acct.mu.Unlock()
+	if resetUsage {
+		acct.startPeriod(m.store, sub.StartDate, sub.EndDate)
+	}
 }
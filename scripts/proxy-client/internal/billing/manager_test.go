@@ -6,9 +6,10 @@ import (
 
 func TestSubscriptionLifecycle(t *testing.T) {
 	manager := NewManager(nil)
+	userID := "lifecycle-user"
 
 	// 1. Initial State (Starter)
-	sub := manager.GetSubscription()
+	sub := manager.GetSubscription(userID)
 	if sub.PlanID != PlanStarter {
 		t.Errorf("Expected initial plan to be Starter, got %s", sub.PlanID)
 	}
@@ -17,7 +18,7 @@ func TestSubscriptionLifecycle(t *testing.T) {
 	}
 
 	// 2. Upgrade to Personal
-	newSub, err := manager.Subscribe(PlanPersonal)
+	newSub, err := manager.Subscribe(userID, PlanPersonal)
 	if err != nil {
 		t.Fatalf("Failed to subscribe to Personal: %v", err)
 	}
@@ -26,18 +27,18 @@ func TestSubscriptionLifecycle(t *testing.T) {
 	}
 
 	// Verify manager state updated
-	currentSub := manager.GetSubscription()
+	currentSub := manager.GetSubscription(userID)
 	if currentSub.ID != newSub.ID {
 		t.Error("Manager did not update subscription ID")
 	}
 
 	// 3. Cancel Subscription
-	err = manager.CancelSubscription()
+	err = manager.CancelSubscription(userID)
 	if err != nil {
 		t.Fatalf("Failed to cancel subscription: %v", err)
 	}
 
-	canceledSub := manager.GetSubscription()
+	canceledSub := manager.GetSubscription(userID)
 	if canceledSub.AutoRenew {
 		t.Error("Expected AutoRenew to be false after cancellation")
 	}
@@ -48,15 +49,17 @@ func TestSubscriptionLifecycle(t *testing.T) {
 
 func TestQuotaEnforcement(t *testing.T) {
 	manager := NewManager(nil)
+	userID := "quota-user"
+	acct := manager.Account(userID)
 
 	// Use Starter Plan (500MB Data, 1000 Requests, 5 Conns)
 	// Reset usage for testing
-	manager.Usage = NewUsageTracker()
+	acct.Usage = NewUsageTracker()
 
 	// 1. Test Request Limit
 	// Set requests to 999
-	manager.Usage.currentUsage.RequestsMade = 999
-	if err := manager.CheckQuota(); err != nil {
+	acct.Usage.currentUsage.RequestsMade = 999
+	if err := manager.CheckQuota(userID); err != nil {
 		t.Errorf("Expected quota to be okay at 999 requests, got error: %v", err)
 	}
 
@@ -71,53 +74,55 @@ func TestQuotaEnforcement(t *testing.T) {
 	// Next request: I have made 1000. 1000 >= 1000. Error.
 	// So I can make exactly 1000 requests. Correct.
 
-	manager.Usage.AddRequest() // Now 1000
-	if err := manager.CheckQuota(); err == nil {
+	acct.Usage.AddRequest() // Now 1000
+	if err := manager.CheckQuota(userID); err == nil {
 		t.Error("Expected error at 1000 requests (limit reached), got nil")
 	}
 
 	// 2. Test Data Limit (500MB)
-	manager.Usage = NewUsageTracker() // Reset
+	acct.Usage = NewUsageTracker() // Reset
 	mb := int64(1024 * 1024)
-	manager.Usage.AddData(499 * mb) // 499MB
-	if err := manager.CheckQuota(); err != nil {
+	acct.Usage.AddData(499 * mb) // 499MB
+	if err := manager.CheckQuota(userID); err != nil {
 		t.Errorf("Expected quota okay at 499MB, got error: %v", err)
 	}
 
-	manager.Usage.AddData(1 * mb) // Now 500MB
-	if err := manager.CheckQuota(); err == nil {
+	acct.Usage.AddData(1 * mb) // Now 500MB
+	if err := manager.CheckQuota(userID); err == nil {
 		t.Error("Expected error at 500MB (limit reached), got nil")
 	}
 
 	// 3. Test Concurrent Connections (Limit 5)
-	manager.Usage = NewUsageTracker()
-	manager.Usage.SetActiveConnections(4)
-	if err := manager.CanAcceptConnection(); err != nil {
+	acct.Usage = NewUsageTracker()
+	acct.Usage.SetActiveConnections(4)
+	if err := manager.CanAcceptConnection(userID); err != nil {
 		t.Errorf("Expected connection allowed at 4 conns, got error: %v", err)
 	}
 
-	manager.Usage.SetActiveConnections(5)
-	if err := manager.CanAcceptConnection(); err == nil {
+	acct.Usage.SetActiveConnections(5)
+	if err := manager.CanAcceptConnection(userID); err == nil {
 		t.Error("Expected error at 5 connections (limit reached), got nil")
 	}
 }
 
 func TestUnlimitedPlan(t *testing.T) {
 	manager := NewManager(nil)
+	userID := "enterprise-user"
+	acct := manager.Account(userID)
 
 	// Upgrade to Enterprise (Unlimited)
-	_, err := manager.Subscribe(PlanEnterprise)
+	_, err := manager.Subscribe(userID, PlanEnterprise)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Set insane usage
-	manager.Usage.currentUsage.RequestsMade = 1000000
-	manager.Usage.currentUsage.DataTransferred = 1000 * 1024 * 1024 * 1024 // 1TB
-	manager.Usage.currentUsage.ActiveConnections = 500                     // Limit is 1000, wait Enterprise connections is 1000, not unlimited.
+	acct.Usage.currentUsage.RequestsMade = 1000000
+	acct.Usage.currentUsage.DataTransferred = 1000 * 1024 * 1024 * 1024 // 1TB
+	acct.Usage.currentUsage.ActiveConnections = 500                     // Limit is 1000, wait Enterprise connections is 1000, not unlimited.
 	// Enterprise Data/Reqs are -1 (Unlimited)
 
-	if err := manager.CheckQuota(); err != nil {
+	if err := manager.CheckQuota(userID); err != nil {
 		t.Errorf("Expected no error on unlimited plan, got: %v", err)
 	}
 }
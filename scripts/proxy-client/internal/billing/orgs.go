@@ -0,0 +1,680 @@
+package billing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// An organization shares one subscription and one quota among its members.
+// Both are kept on the organization's billing account, the account of the
+// user who created it, and every member's usage is accounted there. Members
+// may have their own limits on data and connections within the pool.
+
+// Organization roles
+const (
+	RoleOwner   = "owner"   // created the organization; its billing account
+	RoleAdmin   = "admin"   // manages members and invitations
+	RoleBilling = "billing" // manages the subscription and sees usage
+	RoleMember  = "member"
+)
+
+var (
+	ErrNotOrgMember      = errors.New("not a member of an organization")
+	ErrOrgPermission     = errors.New("your organization role does not allow this")
+	ErrInvalidOrg        = errors.New("invalid organization request")
+	ErrAlreadyInOrg      = errors.New("already a member of an organization")
+	ErrSeatsFull         = errors.New("all seats of the plan are taken")
+	ErrInvitationInvalid = errors.New("invitation is invalid or has expired")
+)
+
+// Organization is a team sharing a subscription
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   string    `json:"owner_id"` // the billing account
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Member is a user of an organization and their limits within its pool
+type Member struct {
+	OrgID  string `json:"org_id"`
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+	// Limits within the organization's quota; 0 is no limit of their own
+	DataLimitMB    int64     `json:"data_limit_mb"`
+	MaxConnections int       `json:"max_connections"`
+	JoinedAt       time.Time `json:"joined_at"`
+}
+
+// Invitation asks someone by email to join an organization
+type Invitation struct {
+	ID         string     `json:"id"`
+	OrgID      string     `json:"org_id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	InvitedBy  string     `json:"invited_by"`
+	TokenHash  string     `json:"-"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// MemberUsage is what a member used of the organization's current period
+type MemberUsage struct {
+	UserID            string `json:"user_id"`
+	Email             string `json:"email"`
+	Role              string `json:"role"`
+	DataTransferred   int64  `json:"data_transferred"`
+	ActiveConnections int    `json:"active_connections"`
+	DataLimitMB       int64  `json:"data_limit_mb"`
+	MaxConnections    int    `json:"max_connections"`
+}
+
+// OrgStore is the persistence of organizations
+type OrgStore interface {
+	CreateOrg(org *Organization, owner *Member) error
+	GetOrg(id string) (*Organization, error)      // nil if there is none
+	GetMembership(userID string) (*Member, error) // nil if the user is in no organization
+	ListMembers(orgID string) ([]*Member, error)
+	AddMember(m *Member) error
+	UpdateMember(m *Member) error
+	RemoveMember(orgID, userID string) error
+
+	CreateInvitation(inv *Invitation) error
+	GetInvitationByToken(tokenHash string) (*Invitation, error) // nil if there is none
+	ListInvitations(orgID string) ([]*Invitation, error)        // pending ones
+	// AcceptInvitation marks a pending invitation accepted. It reports
+	// false if it was already accepted.
+	AcceptInvitation(id string, at time.Time) (bool, error)
+	DeleteInvitation(orgID, id string) error
+
+	// AddMemberUsage adds to what a member used of a period
+	AddMemberUsage(orgID, userID string, periodStart time.Time, bytes int64) error
+	GetMemberUsage(orgID, userID string, periodStart time.Time) (int64, error)
+	GetUserEmail(userID string) (string, error)
+}
+
+// OrgConfig configures organizations
+type OrgConfig struct {
+	InviteTTL time.Duration `yaml:"invite_ttl"` // how long an invitation can be accepted
+}
+
+// DefaultOrgConfig returns the configuration used when none is given
+func DefaultOrgConfig() OrgConfig {
+	return OrgConfig{InviteTTL: 7 * 24 * time.Hour}
+}
+
+// Orgs keeps the memberships of users and the usage of each member in the
+// current period of their organization
+type Orgs struct {
+	store  OrgStore
+	cfg    OrgConfig
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	members map[string]*Member        // by user; nil for users in no organization
+	owners  map[string]string         // billing account by organization
+	usage   map[string]*memberTraffic // by user
+}
+
+// memberTraffic is a member's usage of a period
+type memberTraffic struct {
+	orgID       string
+	periodStart time.Time
+	data        int64 // of the period, including what is not stored yet
+	unsynced    int64
+	conns       int
+}
+
+// NewOrgs creates the organization service
+func NewOrgs(store OrgStore, cfg OrgConfig) *Orgs {
+	if cfg.InviteTTL <= 0 {
+		cfg.InviteTTL = DefaultOrgConfig().InviteTTL
+	}
+	return &Orgs{
+		store:   store,
+		cfg:     cfg,
+		logger:  logrus.StandardLogger(),
+		members: make(map[string]*Member),
+		owners:  make(map[string]string),
+		usage:   make(map[string]*memberTraffic),
+	}
+}
+
+// SetOrgs connects organizations. Without them every user is billed on
+// their own.
+func (m *Manager) SetOrgs(o *Orgs) { m.orgs = o }
+
+// InviteTTL returns how long invitations can be accepted
+func (o *Orgs) InviteTTL() time.Duration { return o.cfg.InviteTTL }
+
+// membership returns the organization membership of a user, or nil
+func (o *Orgs) membership(userID string) (*Member, error) {
+	o.mu.Lock()
+	mem, ok := o.members[userID]
+	o.mu.Unlock()
+	if ok {
+		return mem, nil
+	}
+
+	mem, err := o.store.GetMembership(userID)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	o.members[userID] = mem
+	o.mu.Unlock()
+	return mem, nil
+}
+
+// forget drops the cached membership of a user
+func (o *Orgs) forget(userID string) {
+	o.mu.Lock()
+	delete(o.members, userID)
+	o.mu.Unlock()
+}
+
+// billingAccount returns the account a user is billed on: their
+// organization's, or their own. Sub-users are billed as their parent.
+func (m *Manager) billingAccount(userID string) string {
+	if m.subUsers != nil && IsSubUser(userID) {
+		userID = m.subUsers.parent(userID)
+	}
+	if m.orgs == nil || userID == "" {
+		return userID
+	}
+	mem, err := m.orgs.membership(userID)
+	if err != nil {
+		m.orgs.logger.Warnf("Failed to load organization of %s: %v", userID, err)
+		return userID
+	}
+	if mem == nil {
+		return userID
+	}
+
+	// The owner of an organization never changes
+	m.orgs.mu.Lock()
+	owner, ok := m.orgs.owners[mem.OrgID]
+	m.orgs.mu.Unlock()
+	if ok {
+		return owner
+	}
+	org, err := m.orgs.store.GetOrg(mem.OrgID)
+	if err != nil || org == nil {
+		return userID
+	}
+	m.orgs.mu.Lock()
+	m.orgs.owners[org.ID] = org.OwnerID
+	m.orgs.mu.Unlock()
+	return org.OwnerID
+}
+
+// traffic returns a member's usage of a period, starting it from the store
+// when the period is new. o.mu must be held.
+func (o *Orgs) traffic(mem *Member, periodStart time.Time) *memberTraffic {
+	t, ok := o.usage[mem.UserID]
+	if ok && t.orgID == mem.OrgID && t.periodStart.Equal(periodStart) {
+		return t
+	}
+	if ok && t.unsynced > 0 {
+		// Usage of the period just ended is kept under it
+		if err := o.store.AddMemberUsage(t.orgID, mem.UserID, t.periodStart, t.unsynced); err != nil {
+			o.logger.Warnf("Failed to store usage of member %s: %v", mem.UserID, err)
+		}
+	}
+
+	data, err := o.store.GetMemberUsage(mem.OrgID, mem.UserID, periodStart)
+	if err != nil {
+		o.logger.Warnf("Failed to load usage of member %s: %v", mem.UserID, err)
+	}
+	conns := 0
+	if ok {
+		conns = t.conns
+	}
+	t = &memberTraffic{orgID: mem.OrgID, periodStart: periodStart, data: data, conns: conns}
+	o.usage[mem.UserID] = t
+	return t
+}
+
+// checkMember checks a member's usage against their own limits
+func (o *Orgs) checkMember(userID string, periodStart time.Time, opening bool) error {
+	mem, err := o.membership(userID)
+	if err != nil || mem == nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	t := o.traffic(mem, periodStart)
+	if mem.DataLimitMB > 0 && t.data >= mem.DataLimitMB*1024*1024 {
+		return errors.New("member data limit exceeded")
+	}
+	if opening && mem.MaxConnections > 0 && t.conns >= mem.MaxConnections {
+		return errors.New("member connection limit exceeded")
+	}
+	return nil
+}
+
+// open counts a connection of a member. release must be called once it
+// closes.
+func (o *Orgs) open(userID string, periodStart time.Time) (release func(), err error) {
+	if err := o.checkMember(userID, periodStart, true); err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	t, ok := o.usage[userID]
+	if !ok {
+		return func() {}, nil
+	}
+	t.conns++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			o.mu.Lock()
+			t.conns--
+			o.mu.Unlock()
+		})
+	}, nil
+}
+
+// record counts data a member transferred
+func (o *Orgs) record(userID string, periodStart time.Time, bytes int64) {
+	mem, err := o.membership(userID)
+	if err != nil || mem == nil {
+		return
+	}
+	o.mu.Lock()
+	t := o.traffic(mem, periodStart)
+	t.data += bytes
+	t.unsynced += bytes
+	o.mu.Unlock()
+}
+
+// sync stores the usage of members counted since the last sync and drops
+// members without open connections, whose usage is read again when needed
+func (o *Orgs) sync() error {
+	type pending struct {
+		userID string
+		t      memberTraffic
+	}
+	o.mu.Lock()
+	var writes []pending
+	for userID, t := range o.usage {
+		if t.unsynced > 0 {
+			writes = append(writes, pending{userID, *t})
+			t.unsynced = 0
+		}
+		if t.conns == 0 {
+			delete(o.usage, userID)
+		}
+	}
+	o.mu.Unlock()
+
+	var firstErr error
+	for _, w := range writes {
+		if err := o.store.AddMemberUsage(w.t.orgID, w.userID, w.t.periodStart, w.t.unsynced); err != nil {
+			o.logger.Warnf("Failed to store usage of member %s: %v", w.userID, err)
+			o.mu.Lock()
+			if t, ok := o.usage[w.userID]; ok && t.periodStart.Equal(w.t.periodStart) {
+				t.unsynced += w.t.unsynced
+			}
+			o.mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// CreateOrg creates an organization with the user as its owner. The user's
+// account becomes the organization's billing account, so their plan must
+// include team management.
+func (m *Manager) CreateOrg(userID, name string) (*Organization, error) {
+	if m.orgs == nil {
+		return nil, errors.New("organizations not configured")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, fmt.Errorf("%w: name must be 1 to 100 characters", ErrInvalidOrg)
+	}
+	mem, err := m.orgs.membership(userID)
+	if err != nil {
+		return nil, err
+	}
+	if mem != nil {
+		return nil, ErrAlreadyInOrg
+	}
+	if err := m.Entitlements().Check(userID, FeatureTeams); err != nil {
+		return nil, err
+	}
+
+	email, err := m.orgs.store.GetUserEmail(userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	org := &Organization{ID: uuid.New().String(), Name: name, OwnerID: userID, CreatedAt: now}
+	owner := &Member{OrgID: org.ID, UserID: userID, Email: email, Role: RoleOwner, JoinedAt: now}
+	if err := m.orgs.store.CreateOrg(org, owner); err != nil {
+		return nil, fmt.Errorf("failed to create organization: %w", err)
+	}
+	m.orgs.forget(userID)
+	return org, nil
+}
+
+// Org returns the organization of a user and their membership
+func (m *Manager) Org(userID string) (*Organization, *Member, error) {
+	if m.orgs == nil {
+		return nil, nil, ErrNotOrgMember
+	}
+	mem, err := m.orgs.membership(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mem == nil {
+		return nil, nil, ErrNotOrgMember
+	}
+	org, err := m.orgs.store.GetOrg(mem.OrgID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if org == nil {
+		return nil, nil, ErrNotOrgMember
+	}
+	return org, mem, nil
+}
+
+// orgRole returns the organization and membership of a user whose role is
+// one of roles
+func (m *Manager) orgRole(userID string, roles ...string) (*Organization, *Member, error) {
+	org, mem, err := m.Org(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !slices.Contains(roles, mem.Role) {
+		return nil, nil, ErrOrgPermission
+	}
+	return org, mem, nil
+}
+
+// CanManageBilling reports whether a user may change the subscription they
+// are billed on. Users in no organization manage their own.
+func (m *Manager) CanManageBilling(userID string) error {
+	_, _, err := m.orgRole(userID, RoleOwner, RoleBilling)
+	if errors.Is(err, ErrNotOrgMember) {
+		return nil
+	}
+	return err
+}
+
+// Seats returns how many seats an organization's plan has, -1 for
+// unlimited
+func (m *Manager) Seats(org *Organization) int {
+	return m.CurrentPlan(org.OwnerID).Flags.Seats
+}
+
+// ListMembers lists the members of the user's organization
+func (m *Manager) ListMembers(userID string) ([]*Member, error) {
+	org, _, err := m.Org(userID)
+	if err != nil {
+		return nil, err
+	}
+	return m.orgs.store.ListMembers(org.ID)
+}
+
+// Invite invites someone by email into the organization of an owner or
+// admin. The returned token is only known to the invitee's email.
+func (m *Manager) Invite(userID, email, role string) (*Invitation, string, error) {
+	org, _, err := m.orgRole(userID, RoleOwner, RoleAdmin)
+	if err != nil {
+		return nil, "", err
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") {
+		return nil, "", fmt.Errorf("%w: a valid email is required", ErrInvalidOrg)
+	}
+	if role == "" {
+		role = RoleMember
+	}
+	if role != RoleAdmin && role != RoleBilling && role != RoleMember {
+		return nil, "", fmt.Errorf("%w: role must be admin, billing or member", ErrInvalidOrg)
+	}
+
+	members, err := m.orgs.store.ListMembers(org.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, mem := range members {
+		if strings.EqualFold(mem.Email, email) {
+			return nil, "", fmt.Errorf("%w: %s is already a member", ErrInvalidOrg, email)
+		}
+	}
+	invites, err := m.orgs.store.ListInvitations(org.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	// Pending invitations hold a seat
+	if seats := m.Seats(org); seats >= 0 && len(members)+len(invites) >= seats {
+		return nil, "", ErrSeatsFull
+	}
+
+	token := newInviteToken()
+	now := time.Now().UTC().Truncate(time.Second)
+	inv := &Invitation{
+		ID:        uuid.New().String(),
+		OrgID:     org.ID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: userID,
+		TokenHash: hashSecret(token),
+		ExpiresAt: now.Add(m.orgs.cfg.InviteTTL),
+		CreatedAt: now,
+	}
+	if err := m.orgs.store.CreateInvitation(inv); err != nil {
+		return nil, "", fmt.Errorf("failed to create invitation: %w", err)
+	}
+	return inv, token, nil
+}
+
+// ListInvitations lists the pending invitations of an owner's or admin's
+// organization
+func (m *Manager) ListInvitations(userID string) ([]*Invitation, error) {
+	org, _, err := m.orgRole(userID, RoleOwner, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	return m.orgs.store.ListInvitations(org.ID)
+}
+
+// RevokeInvitation withdraws a pending invitation
+func (m *Manager) RevokeInvitation(userID, id string) error {
+	org, _, err := m.orgRole(userID, RoleOwner, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	return m.orgs.store.DeleteInvitation(org.ID, id)
+}
+
+// AcceptInvitation joins a user to the organization an invitation to their
+// email is for
+func (m *Manager) AcceptInvitation(userID, token string) (*Organization, error) {
+	if m.orgs == nil {
+		return nil, ErrInvitationInvalid
+	}
+	inv, err := m.orgs.store.GetInvitationByToken(hashSecret(token))
+	if err != nil {
+		return nil, err
+	}
+	if inv == nil || inv.AcceptedAt != nil || !time.Now().Before(inv.ExpiresAt) {
+		return nil, ErrInvitationInvalid
+	}
+	email, err := m.orgs.store.GetUserEmail(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(email, inv.Email) {
+		return nil, fmt.Errorf("%w: it was sent to another email address", ErrInvitationInvalid)
+	}
+	if mem, err := m.orgs.membership(userID); err != nil {
+		return nil, err
+	} else if mem != nil {
+		return nil, ErrAlreadyInOrg
+	}
+	org, err := m.orgs.store.GetOrg(inv.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	if org == nil {
+		return nil, ErrInvitationInvalid
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	accepted, err := m.orgs.store.AcceptInvitation(inv.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !accepted {
+		return nil, ErrInvitationInvalid
+	}
+	err = m.orgs.store.AddMember(&Member{OrgID: org.ID, UserID: userID, Email: email, Role: inv.Role, JoinedAt: now})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add member: %w", err)
+	}
+	m.orgs.forget(userID)
+	return org, nil
+}
+
+// MemberUpdate changes the role and limits of a member
+type MemberUpdate struct {
+	Role           string `json:"role"`
+	DataLimitMB    int64  `json:"data_limit_mb"`
+	MaxConnections int    `json:"max_connections"`
+}
+
+// UpdateMember changes the role and limits of another member. The owner's
+// role can not be changed.
+func (m *Manager) UpdateMember(userID, memberID string, u MemberUpdate) (*Member, error) {
+	org, _, err := m.orgRole(userID, RoleOwner, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := m.orgs.store.GetMembership(memberID)
+	if err != nil {
+		return nil, err
+	}
+	if mem == nil || mem.OrgID != org.ID {
+		return nil, ErrNotOrgMember
+	}
+	if u.DataLimitMB < 0 || u.MaxConnections < 0 {
+		return nil, fmt.Errorf("%w: limits can not be negative", ErrInvalidOrg)
+	}
+	if u.Role != "" && u.Role != mem.Role {
+		if mem.Role == RoleOwner || u.Role == RoleOwner {
+			return nil, fmt.Errorf("%w: the owner can not be changed", ErrInvalidOrg)
+		}
+		if u.Role != RoleAdmin && u.Role != RoleBilling && u.Role != RoleMember {
+			return nil, fmt.Errorf("%w: role must be admin, billing or member", ErrInvalidOrg)
+		}
+		mem.Role = u.Role
+	}
+	mem.DataLimitMB, mem.MaxConnections = u.DataLimitMB, u.MaxConnections
+	if err := m.orgs.store.UpdateMember(mem); err != nil {
+		return nil, err
+	}
+	m.orgs.forget(memberID)
+	return mem, nil
+}
+
+// RemoveMember removes a member from the organization. Owners and admins
+// remove others; every member but the owner may leave.
+func (m *Manager) RemoveMember(userID, memberID string) error {
+	org, self, err := m.Org(userID)
+	if err != nil {
+		return err
+	}
+	if memberID != userID && self.Role != RoleOwner && self.Role != RoleAdmin {
+		return ErrOrgPermission
+	}
+	mem, err := m.orgs.store.GetMembership(memberID)
+	if err != nil {
+		return err
+	}
+	if mem == nil || mem.OrgID != org.ID {
+		return ErrNotOrgMember
+	}
+	if mem.Role == RoleOwner {
+		return fmt.Errorf("%w: the owner can not leave the organization", ErrInvalidOrg)
+	}
+
+	// What they used stays with the organization's period
+	if err := m.orgs.sync(); err != nil {
+		return err
+	}
+	if err := m.orgs.store.RemoveMember(org.ID, memberID); err != nil {
+		return err
+	}
+	m.orgs.forget(memberID)
+	return nil
+}
+
+// OrgUsage breaks the current period's usage of the user's organization
+// down by member. Owners, admins and billing see every member, others only
+// themselves.
+func (m *Manager) OrgUsage(userID string) ([]MemberUsage, error) {
+	org, self, err := m.Org(userID)
+	if err != nil {
+		return nil, err
+	}
+	members, err := m.orgs.store.ListMembers(org.ID)
+	if err != nil {
+		return nil, err
+	}
+	periodStart := m.Account(org.OwnerID).Usage.GetStats().PeriodStart
+
+	m.orgs.mu.Lock()
+	defer m.orgs.mu.Unlock()
+	var usage []MemberUsage
+	for _, mem := range members {
+		if self.Role == RoleMember && mem.UserID != userID {
+			continue
+		}
+		t := m.orgs.traffic(mem, periodStart)
+		usage = append(usage, MemberUsage{
+			UserID:            mem.UserID,
+			Email:             mem.Email,
+			Role:              mem.Role,
+			DataTransferred:   t.data,
+			ActiveConnections: t.conns,
+			DataLimitMB:       mem.DataLimitMB,
+			MaxConnections:    mem.MaxConnections,
+		})
+	}
+	return usage, nil
+}
+
+func newInviteToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashSecret hashes a random token or password for storage
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
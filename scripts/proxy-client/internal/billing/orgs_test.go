@@ -0,0 +1,212 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newOrgManager returns a manager with organizations and an organization
+// owned by "olga" on Team, which has 10 seats
+func newOrgManager(t *testing.T) (*Manager, *MockStore, *Organization) {
+	t.Helper()
+	store := NewMockStore()
+	manager := NewManager(store)
+	manager.SetOrgs(NewOrgs(store, OrgConfig{}))
+	store.emails["olga"] = "olga@example.com"
+
+	if _, err := manager.CreateOrg("olga", "Acme"); !errors.Is(err, ErrNotEntitled) {
+		t.Fatalf("Expected Starter to be refused organizations, got %v", err)
+	}
+	if _, err := manager.Subscribe("olga", PlanTeam); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	org, err := manager.CreateOrg("olga", "Acme")
+	if err != nil {
+		t.Fatalf("CreateOrg failed: %v", err)
+	}
+	return manager, store, org
+}
+
+// join invites a user into the organization and accepts the invitation
+func join(t *testing.T, manager *Manager, store *MockStore, userID, role string) {
+	t.Helper()
+	store.emails[userID] = userID + "@example.com"
+	_, token, err := manager.Invite("olga", userID+"@Example.com", role)
+	if err != nil {
+		t.Fatalf("Invite failed: %v", err)
+	}
+	if _, err := manager.AcceptInvitation(userID, token); err != nil {
+		t.Fatalf("AcceptInvitation failed: %v", err)
+	}
+}
+
+func TestOrgInvitations(t *testing.T) {
+	manager, store, org := newOrgManager(t)
+
+	store.emails["pete"] = "pete@example.com"
+	store.emails["quinn"] = "quinn@example.com"
+	inv, token, err := manager.Invite("olga", "pete@example.com", "")
+	if err != nil || inv.Role != RoleMember || token == "" || inv.TokenHash == token {
+		t.Fatalf("Invite failed: %+v, %v", inv, err)
+	}
+	if _, err := manager.AcceptInvitation("quinn", token); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("Expected an invitation for another email to be refused, got %v", err)
+	}
+	joined, err := manager.AcceptInvitation("pete", token)
+	if err != nil || joined.ID != org.ID {
+		t.Fatalf("AcceptInvitation failed: %+v, %v", joined, err)
+	}
+	if _, err := manager.AcceptInvitation("pete", token); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("Expected an invitation to be accepted once, got %v", err)
+	}
+
+	// Members can not invite, and expired invitations can not be accepted
+	if _, _, err := manager.Invite("pete", "quinn@example.com", ""); !errors.Is(err, ErrOrgPermission) {
+		t.Errorf("Expected members not to invite, got %v", err)
+	}
+	_, token, _ = manager.Invite("olga", "quinn@example.com", RoleBilling)
+	store.invitations[hashSecret(token)].ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err := manager.AcceptInvitation("quinn", token); !errors.Is(err, ErrInvitationInvalid) {
+		t.Errorf("Expected an expired invitation to be refused, got %v", err)
+	}
+
+	// Invitations hold seats until accepted or revoked
+	for i := len(store.members); i < 10; i++ {
+		if _, _, err := manager.Invite("olga", string(rune('a'+i))+"@example.com", ""); err != nil {
+			t.Fatalf("Invite %d failed: %v", i, err)
+		}
+	}
+	if _, _, err := manager.Invite("olga", "late@example.com", ""); !errors.Is(err, ErrSeatsFull) {
+		t.Errorf("Expected the seats to be full, got %v", err)
+	}
+	pending, _ := manager.ListInvitations("olga")
+	if err := manager.RevokeInvitation("olga", pending[0].ID); err != nil {
+		t.Fatalf("RevokeInvitation failed: %v", err)
+	}
+	if _, _, err := manager.Invite("olga", "late@example.com", ""); err != nil {
+		t.Errorf("Expected a revoked invitation to free its seat, got %v", err)
+	}
+}
+
+func TestOrgSharesSubscriptionAndQuota(t *testing.T) {
+	manager, store, org := newOrgManager(t)
+	join(t, manager, store, "pete", RoleMember)
+	join(t, manager, store, "bea", RoleBilling)
+
+	if sub := manager.GetSubscription("pete"); sub.PlanID != PlanTeam {
+		t.Errorf("Expected members to share the Team plan, got %s", sub.PlanID)
+	}
+	manager.RecordData("pete", 3*1024*1024)
+	manager.RecordData("olga", 1024*1024)
+	if stats := manager.GetUsage("olga"); stats.DataTransferred != 4*1024*1024 {
+		t.Errorf("Expected usage pooled on the organization, got %d", stats.DataTransferred)
+	}
+
+	// Only the owner and billing members manage the subscription
+	if err := manager.CanManageBilling("pete"); !errors.Is(err, ErrOrgPermission) {
+		t.Errorf("Expected members not to manage billing, got %v", err)
+	}
+	if err := manager.CanManageBilling("bea"); err != nil {
+		t.Errorf("Expected billing members to manage billing, got %v", err)
+	}
+	if err := manager.CanManageBilling("stranger"); err != nil {
+		t.Errorf("Expected users outside organizations to manage their own, got %v", err)
+	}
+
+	// Everyone but members sees the whole breakdown
+	all, err := manager.OrgUsage("bea")
+	if err != nil || len(all) != 3 {
+		t.Fatalf("Expected 3 members in the breakdown, got %+v, %v", all, err)
+	}
+	own, _ := manager.OrgUsage("pete")
+	if len(own) != 1 || own[0].UserID != "pete" || own[0].DataTransferred != 3*1024*1024 {
+		t.Errorf("Expected members to see only themselves, got %+v", own)
+	}
+
+	// Member usage is stored on sync
+	if err := manager.SyncUsage(); err != nil {
+		t.Fatalf("SyncUsage failed: %v", err)
+	}
+	start := manager.GetUsage("olga").PeriodStart
+	if used, _ := store.GetMemberUsage(org.ID, "pete", start); used != 3*1024*1024 {
+		t.Errorf("Expected pete's usage stored, got %d", used)
+	}
+
+	// Leaving returns the user to their own account
+	if err := manager.RemoveMember("pete", "pete"); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	if sub := manager.GetSubscription("pete"); sub.PlanID != PlanStarter {
+		t.Errorf("Expected pete back on Starter, got %s", sub.PlanID)
+	}
+	if err := manager.RemoveMember("bea", "olga"); !errors.Is(err, ErrOrgPermission) {
+		t.Errorf("Expected billing members not to remove others, got %v", err)
+	}
+}
+
+func TestMemberLimits(t *testing.T) {
+	manager, store, _ := newOrgManager(t)
+	join(t, manager, store, "pete", RoleMember)
+
+	if _, err := manager.UpdateMember("olga", "olga", MemberUpdate{Role: RoleMember}); !errors.Is(err, ErrInvalidOrg) {
+		t.Errorf("Expected the owner's role to be fixed, got %v", err)
+	}
+	mem, err := manager.UpdateMember("olga", "pete", MemberUpdate{DataLimitMB: 1, MaxConnections: 2})
+	if err != nil || mem.DataLimitMB != 1 || mem.MaxConnections != 2 {
+		t.Fatalf("UpdateMember failed: %+v, %v", mem, err)
+	}
+
+	// Connections are limited per member within the plan's
+	var releases []func()
+	for range 2 {
+		release, err := manager.OpenConnection("pete")
+		if err != nil {
+			t.Fatalf("OpenConnection failed: %v", err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := manager.OpenConnection("pete"); err == nil {
+		t.Error("Expected the member connection limit to be enforced")
+	}
+	if _, err := manager.OpenConnection("olga"); err != nil {
+		t.Errorf("Expected other members to be unaffected, got %v", err)
+	}
+	releases[0]()
+	if err := manager.CanAcceptConnection("pete"); err != nil {
+		t.Errorf("Expected a freed connection to be reusable, got %v", err)
+	}
+
+	// Data is limited per member, the pool is untouched
+	manager.RecordData("pete", 1024*1024)
+	if err := manager.CheckQuota("pete"); err == nil {
+		t.Error("Expected the member data limit to be enforced")
+	}
+	if err := manager.CheckQuota("olga"); err != nil {
+		t.Errorf("Expected the organization to stay within quota, got %v", err)
+	}
+}
+
+func TestCloseAccountKeepsSharedSubscription(t *testing.T) {
+	manager, store, _ := newOrgManager(t)
+	join(t, manager, store, "pete", RoleMember)
+
+	// A member deleting their account only leaves the organization
+	if err := manager.CloseAccount("pete"); err != nil {
+		t.Fatalf("CloseAccount failed: %v", err)
+	}
+	if sub := manager.GetSubscription("olga"); sub.PlanID != PlanTeam || sub.Status != StatusActive || !sub.AutoRenew {
+		t.Errorf("Expected the owner's subscription to stay active, got %+v", sub)
+	}
+	if mem, _ := store.GetMembership("pete"); mem != nil {
+		t.Errorf("Expected pete to have left the organization, got %+v", mem)
+	}
+
+	// The owner's own subscription is canceled
+	if err := manager.CloseAccount("olga"); err != nil {
+		t.Fatalf("CloseAccount failed: %v", err)
+	}
+	if sub := manager.GetSubscription("olga"); sub.Status != StatusCanceled || sub.AutoRenew {
+		t.Errorf("Expected the owner's subscription canceled, got %+v", sub)
+	}
+}
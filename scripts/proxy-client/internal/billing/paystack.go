@@ -2,7 +2,11 @@ package billing
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
+	"github.com/google/uuid"
 	"github.com/rpip/paystack-go"
 )
 
@@ -17,39 +21,26 @@ func NewPaystackProvider(apiKey string) *PaystackProvider {
 }
 
 func (p *PaystackProvider) CreateCheckout(req CheckoutRequest) (*CheckoutResponse, error) {
-	amount := 0
-	currency := req.Currency
-	if currency == "" {
-		currency = "USD"
-	}
-
-	// Base USD prices
-	usdPrice := 0
-	switch req.PlanID {
-	case "personal":
-		usdPrice = 29
-	case "team":
-		usdPrice = 99
-	case "enterprise":
-		usdPrice = 499
-	}
-
-	// Convert based on currency (Mock rates)
-	switch currency {
-	case "NGN":
-		amount = usdPrice * 1600 * 100 // 1600 rate, in kobo
-	case "GHS":
-		amount = usdPrice * 15 * 100 // 15 rate, in pesewas
-	default:
-		currency = "USD"
-		amount = usdPrice * 100 // in cents
+	if req.Reference == "" {
+		req.Reference = uuid.New().String()
+	}
+	quote, err := checkoutQuote(req, paystackCurrency(req.Currency))
+	if err != nil {
+		return nil, err
 	}
 
 	// Create a transaction request
 	treq := &paystack.TransactionRequest{
-		Amount:   float32(amount),
-		Email:    req.Email,
-		Currency: currency,
+		Amount:    float32(quote.MinorUnits()),
+		Email:     req.Email,
+		Currency:  string(quote.Currency),
+		Reference: req.Reference,
+	}
+	if len(req.Metadata) > 0 {
+		treq.Metadata = paystack.Metadata{}
+		for k, v := range req.Metadata {
+			treq.Metadata[k] = v
+		}
 	}
 
 	resp, err := p.client.Transaction.Initialize(treq)
@@ -63,5 +54,98 @@ func (p *PaystackProvider) CreateCheckout(req CheckoutRequest) (*CheckoutRespons
 	}
 
 	url, _ := data["authorization_url"].(string)
-	return &CheckoutResponse{URL: url, Currency: currency}, nil
+	return &CheckoutResponse{URL: url, PaymentID: req.Reference, Currency: string(quote.Currency), Quote: quote}, nil
+}
+
+// ChargeRenewal charges a renewal to the card authorization saved from the
+// customer's first payment
+func (p *PaystackProvider) ChargeRenewal(req RenewalRequest) (string, error) {
+	rates := ExchangeRates()
+	quote, err := rates.Lock(req.Reference, rates.QuotePrice(req.AmountUSD, paystackCurrency(req.Currency)))
+	if err != nil {
+		return "", err
+	}
+
+	txn, err := p.client.Transaction.ChargeAuthorization(&paystack.TransactionRequest{
+		AuthorizationCode: req.PaymentAuth,
+		Email:             req.Email,
+		Amount:            float32(quote.MinorUnits()),
+		Currency:          string(quote.Currency),
+		Reference:         req.Reference,
+		Metadata: paystack.Metadata{
+			"user_id": req.UserID,
+			"plan_id": string(req.PlanID),
+			"renewal": true,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("paystack error: %w", err)
+	}
+	return txn.Reference, paystackChargeStatus(txn)
+}
+
+// VerifyRenewal looks up the outcome of a renewal charge that was pending
+func (p *PaystackProvider) VerifyRenewal(reference string) error {
+	txn, err := p.client.Transaction.Verify(reference)
+	if err != nil {
+		return fmt.Errorf("paystack error: %w", err)
+	}
+	return paystackChargeStatus(txn)
+}
+
+// Refund returns money from a Paystack payment. Paystack reports most
+// refunds as pending and sends refund.processed once the money is returned.
+func (p *PaystackProvider) Refund(req RefundRequest) (*RefundResult, error) {
+	body := map[string]interface{}{"transaction": req.Reference}
+	if req.GatewayRef != "" {
+		body["transaction"] = req.GatewayRef
+	}
+	if req.Amount > 0 {
+		body["amount"] = int(math.Round(req.Amount * 100)) // in kobo/cents
+		body["currency"] = req.Currency
+	}
+	if req.Reason != "" {
+		body["merchant_note"] = req.Reason
+	}
+
+	var refund struct {
+		ID     int64  `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := p.client.Call("POST", "/refund", body, &refund); err != nil {
+		return nil, fmt.Errorf("paystack error: %w", err)
+	}
+
+	result := &RefundResult{ID: strconv.FormatInt(refund.ID, 10), Status: RefundPending}
+	switch refund.Status {
+	case "processed":
+		result.Status = RefundProcessed
+	case "failed":
+		return nil, fmt.Errorf("paystack refund failed")
+	}
+	return result, nil
+}
+
+// paystackChargeStatus maps a transaction status to nil for success,
+// ErrChargePending while Paystack is still processing and an error for a
+// declined charge
+func paystackChargeStatus(txn *paystack.Transaction) error {
+	switch txn.Status {
+	case "success":
+		return nil
+	case "failed", "abandoned", "reversed":
+		return fmt.Errorf("%w: %s: %s", ErrChargeDeclined, txn.Status, txn.GatewayResponse)
+	default:
+		return ErrChargePending
+	}
+}
+
+// paystackCurrency returns the currency Paystack charges in. Currencies
+// Paystack doesn't settle are charged in USD.
+func paystackCurrency(currency string) CurrencyCode {
+	switch c := CurrencyCode(strings.ToUpper(currency)); c {
+	case CurrencyNGN, CurrencyGHS, CurrencyKES, CurrencyZAR:
+		return c
+	}
+	return CurrencyUSD
 }
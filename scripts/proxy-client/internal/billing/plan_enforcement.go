@@ -5,20 +5,13 @@ import (
 	"time"
 )
 
-type Plan string
-
-const (
-	PlanStarter    Plan = "starter"
-	PlanPAYG       Plan = "payg"
-	PlanPersonal   Plan = "personal"
-	PlanTeam       Plan = "team"
-	PlanEnterprise Plan = "enterprise"
-)
-
 type User struct {
 	ID           string
 	Email        string
-	Plan         Plan
+	Plan         PlanType
+	// Flags are the features of the plan version the user is on; nil uses
+	// the plan's latest version
+	Flags        *PlanFlags
 	DataUsed     int64 // bytes
 	DataLimit    int64 // bytes
 	CreditsUsed  float64
@@ -27,26 +20,38 @@ type User struct {
 	SubscriptionEnd    time.Time
 }
 
+// flags returns the features of the user's plan
+func (u *User) flags() PlanFlags {
+	if u.Flags != nil {
+		return *u.Flags
+	}
+	plan, err := GetPlan(u.Plan)
+	if err != nil {
+		plan, _ = GetPlan(PlanStarter)
+	}
+	return plan.Flags
+}
+
 // CanUseProtocol checks if user's plan allows the protocol
 func CanUseProtocol(user *User, protocol string) error {
-	if user.Plan == PlanStarter && protocol != "https" {
-		return errors.New("upgrade to PAYG or higher for HTTP, SOCKS5, and Shadowsocks protocols")
+	if !user.flags().AllowsProtocol(protocol) {
+		return notEntitled(user.Plan, FeatureProtocol, protocol, func(f PlanFlags) bool { return f.AllowsProtocol(protocol) })
 	}
 	return nil
 }
 
 // CanAccessAPI checks if user can access API features
 func CanAccessAPI(user *User) error {
-	if user.Plan == PlanStarter || user.Plan == PlanPAYG {
-		return errors.New("upgrade to Personal plan or higher for API access")
+	if !user.flags().APIAccess {
+		return notEntitled(user.Plan, FeatureAPIAccess, "", grantsFeature(FeatureAPIAccess))
 	}
 	return nil
 }
 
 // CanSelectProtocol checks if user can change protocol via UI
 func CanSelectProtocol(user *User) error {
-	if user.Plan == PlanStarter || user.Plan == PlanPAYG {
-		return errors.New("upgrade to Personal plan or higher for protocol selection")
+	if !user.flags().ProtocolSelection {
+		return notEntitled(user.Plan, FeatureProtocolSelection, "", grantsFeature(FeatureProtocolSelection))
 	}
 	return nil
 }
@@ -92,7 +97,9 @@ func GetDataQuotaPercentage(user *User) float64 {
 func ShouldWarnQuota(user *User) (bool, string) {
 	percentage := GetDataQuotaPercentage(user)
 	
-	if percentage >= 100 {
+	if percentage >= 120 {
+		return true, "120% of data quota used"
+	} else if percentage >= 100 {
 		return true, "Data limit reached"
 	} else if percentage >= 80 {
 		return true, "80% of data quota used"
@@ -100,3 +107,15 @@ func ShouldWarnQuota(user *User) (bool, string) {
 	
 	return false, ""
 }
+
+// QuotaWarningThreshold returns the highest warning threshold, in percent of
+// the data limit, the user has reached: 80, 100 or 120. It is 0 below 80%.
+func QuotaWarningThreshold(user *User) int {
+	percentage := GetDataQuotaPercentage(user)
+	for _, threshold := range []int{120, 100, 80} {
+		if percentage >= float64(threshold) {
+			return threshold
+		}
+	}
+	return 0
+}
@@ -1,7 +1,6 @@
 package billing
 
 import (
-	"errors"
 	"time"
 )
 
@@ -10,6 +9,7 @@ type PlanType string
 
 const (
 	PlanStarter    PlanType = "starter"
+	PlanPAYG       PlanType = "payg"
 	PlanPersonal   PlanType = "personal"
 	PlanTeam       PlanType = "team"
 	PlanEnterprise PlanType = "enterprise"
@@ -17,14 +17,26 @@ const (
 
 // Plan defines the limits and features of a subscription tier
 type Plan struct {
-	ID              PlanType `json:"id"`
-	Name            string   `json:"name"`
-	PriceMonthly    float64  `json:"price_monthly"`
-	PriceAnnual     float64  `json:"price_annual"`
-	DataLimitMB     int64    `json:"data_limit_mb"` // -1 for unlimited
-	RequestLimit    int64    `json:"request_limit"` // -1 for unlimited
-	ConcurrentConns int      `json:"concurrent_conns"`
-	Features        []string `json:"features"`
+	ID              PlanType  `json:"id"`
+	Version         int       `json:"version"`
+	Active          bool      `json:"active"` // offered to new subscribers
+	Name            string    `json:"name"`
+	PriceMonthly    float64   `json:"price_monthly"`
+	PriceAnnual     float64   `json:"price_annual"`
+	DataLimitMB     int64     `json:"data_limit_mb"` // -1 for unlimited
+	RequestLimit    int64     `json:"request_limit"` // -1 for unlimited
+	ConcurrentConns int       `json:"concurrent_conns"`
+	Features        []string  `json:"features"` // marketing copy; Flags are enforced
+	Flags           PlanFlags `json:"flags"`
+	// What is left once the data limit is used: the USD price per GB beyond
+	// it under a soft quota, and the bandwidth under a throttled quota. Zero
+	// means the plan does not offer the mode.
+	OverageRatePerGB float64 `json:"overage_rate_per_gb,omitempty"`
+	ThrottleKbps     int     `json:"throttle_kbps,omitempty"`
+	// Bandwidth of all the user's traffic together and of each of their
+	// connections, in kbps each way. Zero is unlimited.
+	BandwidthKbps  int `json:"bandwidth_kbps,omitempty"`
+	ConnectionKbps int `json:"connection_kbps,omitempty"`
 	// Localized Pricing Fields
 	DisplayPriceMonthly float64 `json:"display_price_monthly"`
 	DisplayPriceAnnual  float64 `json:"display_price_annual"`
@@ -36,21 +48,54 @@ type Plan struct {
 type Subscription struct {
 	ID        string    `json:"id"`
 	PlanID    PlanType  `json:"plan_id"`
-	Status    string    `json:"status"` // active, canceled, past_due
+	Status    string    `json:"status"` // trialing, active, past_due, canceled, expired
 	StartDate time.Time `json:"start_date"`
 	EndDate   time.Time `json:"end_date"`
 	AutoRenew bool      `json:"auto_renew"`
+	// PlanVersion is the version of the plan's terms the subscriber is on
+	PlanVersion int `json:"plan_version,omitempty"`
+	// GraceUntil is when a past_due subscription expires unless paid
+	GraceUntil *time.Time `json:"grace_until,omitempty"`
+	// Currency is what the payment method is charged in, if there is one
+	Currency string `json:"currency,omitempty"`
+	// ScheduledPlan replaces the plan at the end of the period
+	ScheduledPlan PlanType `json:"scheduled_plan,omitempty"`
+	// QuotaMode is what happens once the data limit is used: hard, soft or
+	// throttle. Empty is hard.
+	QuotaMode string `json:"quota_mode,omitempty"`
+	// Coupon is the recurring coupon discounting renewals, if any
+	Coupon string `json:"coupon,omitempty"`
 }
 
-// AvailablePlans returns the hardcoded list of plans (Default USD)
+// AvailablePlans returns the plans on offer (Default USD)
 func AvailablePlans() []Plan {
 	return AvailablePlansInCurrency(CurrencyUSD)
 }
 
-// AvailablePlansInCurrency returns plans with prices converted to the target currency
+// AvailablePlansInCurrency returns the plans on offer with prices converted
+// to the target currency
 func AvailablePlansInCurrency(code CurrencyCode) []Plan {
-	symbol := GetCurrencySymbol(code)
-	plans := []Plan{
+	plans := Plans().List()
+	for i := range plans {
+		plans[i] = plans[i].inCurrency(code)
+	}
+	return plans
+}
+
+// GetPlan returns the latest version of a plan (Default USD)
+func GetPlan(id PlanType) (Plan, error) {
+	return Plans().Get(id)
+}
+
+// GetPlanVersion returns the terms of a plan as of a version; version 0 is
+// the latest
+func GetPlanVersion(id PlanType, version int) (Plan, error) {
+	return Plans().Version(id, version)
+}
+
+// DefaultPlans returns the built-in plans the catalogue is seeded with
+func DefaultPlans() []Plan {
+	return []Plan{
 		{
 			ID:              PlanStarter,
 			Name:            "Starter",
@@ -60,6 +105,32 @@ func AvailablePlansInCurrency(code CurrencyCode) []Plan {
 			RequestLimit:    1000,
 			ConcurrentConns: 5,
 			Features:        []string{"Basic Rotation", "US Only", "Shared Pool"},
+			Flags: PlanFlags{
+				Protocols: []string{"https"},
+				Countries: []string{"US"},
+				RateLimit: 10,
+				RateBurst: 50,
+			},
+			ThrottleKbps:   128,
+			BandwidthKbps:  4096,
+			ConnectionKbps: 2048,
+		},
+		{
+			// Pay-as-you-go usage is charged to prepaid credits
+			ID:              PlanPAYG,
+			Name:            "Pay As You Go",
+			PriceMonthly:    0,
+			PriceAnnual:     0,
+			DataLimitMB:     -1,
+			RequestLimit:    -1,
+			ConcurrentConns: 10,
+			Features:        []string{"Metered Billing", "All Protocols", "50+ Countries"},
+			Flags: PlanFlags{
+				RateLimit: 10,
+				RateBurst: 50,
+			},
+			BandwidthKbps:  20480,
+			ConnectionKbps: 10240,
 		},
 		{
 			ID:              PlanPersonal,
@@ -70,6 +141,17 @@ func AvailablePlansInCurrency(code CurrencyCode) []Plan {
 			RequestLimit:    -1,
 			ConcurrentConns: 20,
 			Features:        []string{"Advanced Rotation", "50+ Countries", "Sticky Sessions"},
+			Flags: PlanFlags{
+				ProtocolSelection: true,
+				APIAccess:         true,
+				StickySessions:    true,
+				RateLimit:         50,
+				RateBurst:         200,
+			},
+			OverageRatePerGB: 4,
+			ThrottleKbps:     512,
+			BandwidthKbps:    51200,
+			ConnectionKbps:   20480,
 		},
 		{
 			ID:              PlanTeam,
@@ -80,6 +162,18 @@ func AvailablePlansInCurrency(code CurrencyCode) []Plan {
 			RequestLimit:    -1,
 			ConcurrentConns: 100,
 			Features:        []string{"All Countries", "Priority Support", "API Access", "Team Management"},
+			Flags: PlanFlags{
+				ProtocolSelection: true,
+				APIAccess:         true,
+				StickySessions:    true,
+				RateLimit:         500,
+				RateBurst:         1000,
+				Seats:             10,
+			},
+			OverageRatePerGB: 3,
+			ThrottleKbps:     1024,
+			BandwidthKbps:    204800,
+			ConnectionKbps:   51200,
 		},
 		{
 			ID:              PlanEnterprise,
@@ -90,26 +184,24 @@ func AvailablePlansInCurrency(code CurrencyCode) []Plan {
 			RequestLimit:    -1,
 			ConcurrentConns: 1000,
 			Features:        []string{"Dedicated Pool", "Account Manager", "SLA", "Custom Integrations"},
+			Flags: PlanFlags{
+				ProtocolSelection: true,
+				APIAccess:         true,
+				StickySessions:    true,
+				RateLimit:         10000,
+				RateBurst:         10000,
+				Seats:             -1,
+				SubUsers:          -1,
+			},
 		},
 	}
+}
 
-	// Apply conversion
+// defaultPlanVersions returns the built-in plans as the first version of each
+func defaultPlanVersions() []Plan {
+	plans := DefaultPlans()
 	for i := range plans {
-		plans[i].Currency = string(code)
-		plans[i].Symbol = symbol
-		plans[i].DisplayPriceMonthly = ConvertPrice(plans[i].PriceMonthly, code)
-		plans[i].DisplayPriceAnnual = ConvertPrice(plans[i].PriceAnnual, code)
+		plans[i].Version, plans[i].Active = 1, true
 	}
-
 	return plans
 }
-
-// GetPlan returns a plan by ID (Default USD)
-func GetPlan(id PlanType) (Plan, error) {
-	for _, p := range AvailablePlans() {
-		if p.ID == id {
-			return p, nil
-		}
-	}
-	return Plan{}, errors.New("plan not found")
-}
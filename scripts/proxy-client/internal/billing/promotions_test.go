@@ -0,0 +1,182 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCouponTerms(t *testing.T) {
+	c := &Coupon{Code: " launch-20 ", Type: "Percent", Value: 20, Plans: []PlanType{"Personal"}}
+	if err := c.Normalize(); err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if c.Code != "LAUNCH-20" || c.Type != DiscountPercent || c.Plans[0] != PlanPersonal {
+		t.Errorf("Unexpected coupon: %+v", c)
+	}
+	if d := c.Discount(29); d != 5.8 {
+		t.Errorf("Expected $5.80 off $29, got %v", d)
+	}
+
+	for _, bad := range []Coupon{
+		{Code: "X", Type: DiscountFixed, Value: 5},
+		{Code: "HUNDRED", Type: DiscountPercent, Value: 100},
+		{Code: "FREE", Type: DiscountFixed, Value: 0},
+		{Code: "NOPLAN", Type: DiscountFixed, Value: 5, Plans: []PlanType{"gold"}},
+	} {
+		if err := bad.Normalize(); !errors.Is(err, ErrInvalidCoupon) {
+			t.Errorf("Expected %s to be invalid, got %v", bad.Code, err)
+		}
+	}
+
+	// A fixed discount never takes off more than the price
+	fixed := &Coupon{Type: DiscountFixed, Value: 50}
+	if d := fixed.Discount(29); d != 29 {
+		t.Errorf("Expected the discount capped at the price, got %v", d)
+	}
+
+	expired := time.Now().Add(-time.Hour)
+	c.Active, c.ExpiresAt = true, &expired
+	if err := c.usable(PlanPersonal, time.Now()); !errors.Is(err, ErrCouponUnavailable) {
+		t.Errorf("Expected an expired coupon to be unavailable, got %v", err)
+	}
+	c.ExpiresAt = nil
+	if err := c.usable(PlanTeam, time.Now()); !errors.Is(err, ErrCouponUnavailable) {
+		t.Errorf("Expected the coupon not to apply to other plans, got %v", err)
+	}
+}
+
+func TestCouponCheckoutAndRenewal(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	manager.SetPromotions(NewPromotions(store, PromotionConfig{}))
+	gateway := &fakeGateway{}
+	lc := NewLifecycle(manager, store, gateway, nil, LifecycleConfig{})
+
+	if err := manager.CreateCoupon(&Coupon{Code: "save10", Type: DiscountFixed, Value: 10, MaxRedemptions: 1}); err != nil {
+		t.Fatalf("CreateCoupon failed: %v", err)
+	}
+
+	req := CheckoutRequest{PlanID: "personal", Coupon: "SAVE10", Metadata: map[string]string{"user_id": "gina"}}
+	if err := manager.applyCoupon(&req); err != nil {
+		t.Fatalf("applyCoupon failed: %v", err)
+	}
+	if price, _ := checkoutPrice(req); price != 19 {
+		t.Errorf("Expected $19 after the coupon, got %v", price)
+	}
+
+	// The payment applies the coupon once, however often it is delivered
+	manager.SubscribeUser("gina", PlanPersonal, req.Reference)
+	for range 2 {
+		if r, err := manager.RedeemCoupon("gina", req.Reference); err != nil || r == nil || r.Status != RedemptionRedeemed {
+			t.Fatalf("RedeemCoupon failed: %+v, %v", r, err)
+		}
+	}
+	if c, _ := manager.GetCoupon("save10"); c.Redemptions != 1 {
+		t.Errorf("Expected one redemption, got %d", c.Redemptions)
+	}
+	if sub := manager.GetSubscription("gina"); sub.Coupon != "SAVE10" {
+		t.Errorf("Expected the recurring coupon on the subscription, got %q", sub.Coupon)
+	}
+
+	// Fully redeemed, it can not be used again
+	other := CheckoutRequest{PlanID: "personal", Coupon: "save10", Metadata: map[string]string{"user_id": "hal"}}
+	if err := manager.applyCoupon(&other); !errors.Is(err, ErrCouponUnavailable) {
+		t.Errorf("Expected the coupon to be used up, got %v", err)
+	}
+
+	// Renewals keep the discount
+	end := time.Now().Add(-time.Minute).Truncate(time.Second)
+	sub := store.subs["gina"]
+	sub.StartDate, sub.EndDate = formatTime(end.AddDate(0, -1, 0)), formatTime(end)
+	sub.PaymentAuth = "AUTH_test"
+	store.emails["gina"] = "gina@example.com"
+	if err := lc.Process(time.Now()); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if len(gateway.charges) != 1 || gateway.charges[0].AmountUSD != 19 {
+		t.Fatalf("Expected a discounted renewal of $19, got %+v", gateway.charges)
+	}
+	if r, _ := store.GetRedemption(gateway.charges[0].Reference); r == nil || !r.Renewal || r.DiscountUSD != 10 {
+		t.Errorf("Expected the renewal discount recorded, got %+v", r)
+	}
+}
+
+func TestCouponHeldByUnpaidCheckouts(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	manager.SetPromotions(NewPromotions(store, PromotionConfig{}))
+	lc := NewLifecycle(manager, store, nil, nil, LifecycleConfig{})
+
+	if err := manager.CreateCoupon(&Coupon{Code: "ONCE", Type: DiscountFixed, Value: 5, MaxRedemptions: 1}); err != nil {
+		t.Fatalf("CreateCoupon failed: %v", err)
+	}
+	checkout := func(userID string) CheckoutRequest {
+		return CheckoutRequest{PlanID: "personal", Coupon: "ONCE", Metadata: map[string]string{"user_id": userID}}
+	}
+
+	// A checkout that could not be started gives its hold back at once
+	if _, err := manager.ProcessCheckout(checkout("ivy")); err == nil {
+		t.Fatal("Expected the checkout without a gateway to fail")
+	}
+	if c, _ := manager.GetCoupon("ONCE"); c.Redemptions != 0 {
+		t.Errorf("Expected the hold given back, got %d redemptions", c.Redemptions)
+	}
+
+	// An unpaid checkout holds the last redemption until it is let go
+	req := checkout("jo")
+	if err := manager.applyCoupon(&req); err != nil {
+		t.Fatalf("applyCoupon failed: %v", err)
+	}
+	other := checkout("kim")
+	if err := manager.applyCoupon(&other); !errors.Is(err, ErrCouponUnavailable) {
+		t.Errorf("Expected the held coupon to be unavailable, got %v", err)
+	}
+	if err := lc.Process(time.Now()); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if c, _ := manager.GetCoupon("ONCE"); c.Redemptions != 1 {
+		t.Errorf("Expected the hold kept for %v, got %d redemptions", CouponHold, c.Redemptions)
+	}
+	if err := lc.Process(time.Now().Add(CouponHold + time.Minute)); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if err := manager.applyCoupon(&other); err != nil {
+		t.Errorf("Expected the coupon free again, got %v", err)
+	}
+}
+
+func TestReferralRewardsBothUsers(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	manager.SetCredits(NewCreditLedger(store, nil, CreditConfig{}))
+	manager.SetPromotions(NewPromotions(store, PromotionConfig{}))
+
+	code, err := manager.ReferralCode("ivy")
+	if err != nil || len(code) != 8 {
+		t.Fatalf("ReferralCode failed: %q, %v", code, err)
+	}
+	if again, _ := manager.ReferralCode("ivy"); again != code {
+		t.Errorf("Expected the same code, got %q and %q", code, again)
+	}
+	if err := manager.Refer("ivy", code); !errors.Is(err, ErrInvalidReferral) {
+		t.Errorf("Expected self-referral to be refused, got %v", err)
+	}
+	if err := manager.Refer("jay", code); err != nil {
+		t.Fatalf("Refer failed: %v", err)
+	}
+
+	for range 2 {
+		manager.RewardReferral("jay", "PAY-1")
+	}
+	for user, want := range map[string]float64{"ivy": 10, "jay": 5} {
+		if b, _ := manager.CreditBalance(user); b.Balance != want {
+			t.Errorf("Expected $%v of credits for %s, got %v", want, user, b.Balance)
+		}
+	}
+
+	summary, err := manager.ReferralSummary("ivy")
+	if err != nil || summary.Referred != 1 || summary.Rewarded != 1 || summary.EarnedUSD != 10 {
+		t.Errorf("Unexpected summary: %+v, %v", summary, err)
+	}
+}
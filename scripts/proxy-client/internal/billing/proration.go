@@ -0,0 +1,243 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Kinds of plan change
+const (
+	ChangeUpgrade   = "upgrade"
+	ChangeDowngrade = "downgrade"
+	// ChangeKeep drops a scheduled downgrade
+	ChangeKeep = "keep"
+)
+
+var (
+	ErrSamePlan             = errors.New("already on this plan")
+	ErrPlanChangeNotAllowed = errors.New("plan can not be changed in the current subscription state")
+)
+
+// PlanChange describes what changing plans mid-cycle costs. Upgrades take
+// effect immediately: the unused part of the current plan is credited
+// against the new plan's price for the rest of the period, and the
+// difference is due now. Downgrades take effect at the end of the period
+// and cost nothing until the next renewal.
+type PlanChange struct {
+	From        PlanType     `json:"from"`
+	To          PlanType     `json:"to"`
+	Kind        string       `json:"kind"`
+	Currency    CurrencyCode `json:"currency"`
+	Symbol      string       `json:"symbol"`
+	Credit      float64      `json:"credit"`     // unused value of the current plan
+	Charge      float64      `json:"charge"`     // price of the new plan for the rest of the period
+	AmountDue   float64      `json:"amount_due"` // charge minus credit, never negative
+	EffectiveAt time.Time    `json:"effective_at"`
+	PeriodEnd   time.Time    `json:"period_end"`
+
+	// AmountDueUSD is what payment gateways are asked for
+	AmountDueUSD float64 `json:"-"`
+}
+
+// Prorate prices a change from the subscription's plan to another plan at
+// now. Prices are the monthly prices of plans.go converted to currency.
+// Without credit only the new plan's price is prorated.
+func Prorate(sub *Subscription, to PlanType, currency CurrencyCode, credit bool, now time.Time) (*PlanChange, error) {
+	if sub.PlanID == to {
+		return nil, ErrSamePlan
+	}
+	from, err := GetPlanVersion(sub.PlanID, sub.PlanVersion)
+	if err != nil {
+		return nil, err
+	}
+	target, err := offeredPlan(to)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &PlanChange{
+		From:      from.ID,
+		To:        target.ID,
+		Currency:  currency,
+		Symbol:    GetCurrencySymbol(currency),
+		PeriodEnd: sub.EndDate,
+	}
+
+	if target.PriceMonthly < from.PriceMonthly {
+		change.Kind = ChangeDowngrade
+		change.EffectiveAt = sub.EndDate
+		return change, nil
+	}
+
+	change.Kind = ChangeUpgrade
+	change.EffectiveAt = now
+
+	remaining := remainingFraction(sub.StartDate, sub.EndDate, now)
+	creditUSD := 0.0
+	if credit {
+		creditUSD = from.PriceMonthly * remaining
+	}
+	chargeUSD := target.PriceMonthly * remaining
+	change.AmountDueUSD = roundAmount(math.Max(chargeUSD-creditUSD, 0))
+
+	change.Credit = ConvertAmount(creditUSD, currency)
+	change.Charge = ConvertAmount(chargeUSD, currency)
+	change.AmountDue = roundAmount(math.Max(change.Charge-change.Credit, 0))
+	return change, nil
+}
+
+// remainingFraction is the share of the period between start and end that is
+// still left at now
+func remainingFraction(start, end, now time.Time) float64 {
+	total := end.Sub(start)
+	if total <= 0 {
+		return 0
+	}
+	left := end.Sub(now)
+	switch {
+	case left <= 0:
+		return 0
+	case left >= total:
+		return 1
+	}
+	return float64(left) / float64(total)
+}
+
+// roundAmount rounds to the smallest unit of most currencies
+func roundAmount(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// PreviewPlanChange prices a change of the user's plan without making it
+func (m *Manager) PreviewPlanChange(userID string, to PlanType) (*PlanChange, error) {
+	acct := m.Account(userID)
+	sub := acct.Subscription()
+	if sub == nil {
+		return nil, errors.New("no active subscription")
+	}
+	if sub.Status != StatusActive && sub.Status != StatusTrialing {
+		return nil, ErrPlanChangeNotAllowed
+	}
+	if sub.ScheduledPlan != "" && sub.ScheduledPlan == to {
+		return nil, fmt.Errorf("a change to %s is already scheduled", to)
+	}
+	return Prorate(sub, to, m.currencyOf(sub), m.earnsCredit(userID, sub), time.Now())
+}
+
+// ChangePlan changes the user's plan. Downgrades, and a change back to the
+// current plan while a downgrade is scheduled, are applied right away and
+// need no payment. For upgrades that cost something, the returned change
+// has a non-zero AmountDue and the caller collects it before calling
+// ApplyUpgrade; free upgrades are applied immediately.
+func (m *Manager) ChangePlan(userID string, to PlanType) (*PlanChange, error) {
+	acct := m.Account(userID)
+	if sub := acct.Subscription(); sub != nil && sub.PlanID == to && sub.ScheduledPlan != "" {
+		// Keeping the current plan after all
+		sub.ScheduledPlan = ""
+		if err := m.scheduleChange(acct, sub); err != nil {
+			return nil, err
+		}
+		currency := m.currencyOf(sub)
+		return &PlanChange{
+			From:        to,
+			To:          to,
+			Kind:        ChangeKeep,
+			Currency:    currency,
+			Symbol:      GetCurrencySymbol(currency),
+			EffectiveAt: time.Now(),
+			PeriodEnd:   sub.EndDate,
+		}, nil
+	}
+
+	change, err := m.PreviewPlanChange(userID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case change.Kind == ChangeDowngrade:
+		sub := acct.Subscription()
+		sub.ScheduledPlan = to
+		if err := m.scheduleChange(acct, sub); err != nil {
+			return nil, err
+		}
+	case change.AmountDue == 0:
+		if err := m.ApplyUpgrade(userID, acct.Subscription().ID, to); err != nil {
+			return nil, err
+		}
+	}
+	return change, nil
+}
+
+// ApplyUpgrade moves a subscription to a higher plan once the prorated
+// difference is paid. The billing anchor and the usage of the period stay;
+// the new plan's limits apply from now on. The subscription must still be
+// the user's current one.
+func (m *Manager) ApplyUpgrade(userID, subscriptionID string, to PlanType) error {
+	plan, err := GetPlan(to)
+	if err != nil {
+		return err
+	}
+
+	acct := m.Account(userID)
+	sub := acct.Subscription()
+	if sub == nil || sub.ID != subscriptionID {
+		return fmt.Errorf("subscription %s is no longer current", subscriptionID)
+	}
+	if sub.PlanID == to {
+		return nil
+	}
+
+	sub.PlanID = to
+	sub.PlanVersion = plan.Version
+	sub.ScheduledPlan = ""
+	if sub.Status == StatusTrialing {
+		sub.Status = StatusActive
+	}
+	if err := acct.setSubscription(m.store, sub); err != nil {
+		return err
+	}
+	if m.store == nil {
+		return nil
+	}
+	return m.store.SetScheduledPlan(sub.ID, "")
+}
+
+func (m *Manager) scheduleChange(acct *Account, sub *Subscription) error {
+	acct.mu.Lock()
+	acct.subscription = sub
+	acct.mu.Unlock()
+	if m.store == nil {
+		return nil
+	}
+	return m.store.SetScheduledPlan(sub.ID, string(sub.ScheduledPlan))
+}
+
+// currencyOf is the currency a subscription is billed in: the currency of
+// its payment method, or the active currency if it has none yet
+func (m *Manager) currencyOf(sub *Subscription) CurrencyCode {
+	if sub.Currency != "" {
+		return CurrencyCode(sub.Currency)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.activeCurrency
+}
+
+// earnsCredit reports whether the unused time of a subscription is worth its
+// price. Trials and the free default Starter subscription earn nothing.
+func (m *Manager) earnsCredit(userID string, sub *Subscription) bool {
+	if sub.Status != StatusActive {
+		return false
+	}
+	if sub.PlanID != PlanStarter {
+		return true
+	}
+	if m.store == nil {
+		return false
+	}
+	p, err := m.store.GetSubscription(userID)
+	return err == nil && p != nil && p.PaymentAuth != ""
+}
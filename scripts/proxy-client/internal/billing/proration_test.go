@@ -0,0 +1,129 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProrate(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sub := &Subscription{PlanID: PlanPersonal, Status: StatusActive, StartDate: start, EndDate: start.Add(30 * 24 * time.Hour)}
+	halfway := start.Add(15 * 24 * time.Hour)
+
+	up, err := Prorate(sub, PlanTeam, CurrencyUSD, true, halfway)
+	if err != nil {
+		t.Fatalf("Prorate failed: %v", err)
+	}
+	if up.Kind != ChangeUpgrade || up.Credit != 14.5 || up.Charge != 49.5 || up.AmountDue != 35 || up.AmountDueUSD != 35 {
+		t.Errorf("Unexpected upgrade: %+v", up)
+	}
+	if !up.EffectiveAt.Equal(halfway) {
+		t.Errorf("Expected the upgrade to take effect now, got %s", up.EffectiveAt)
+	}
+
+	// Amounts are shown in the user's currency, gateways get USD
+	ngn, _ := Prorate(sub, PlanTeam, CurrencyNGN, true, halfway)
+	if ngn.AmountDue != ConvertAmount(35, CurrencyNGN) || ngn.AmountDueUSD != 35 || ngn.Symbol != "₦" {
+		t.Errorf("Unexpected NGN upgrade: %+v", ngn)
+	}
+
+	// Without credit the whole remaining price is due
+	if free, _ := Prorate(sub, PlanTeam, CurrencyUSD, false, halfway); free.AmountDue != 49.5 {
+		t.Errorf("Expected 49.5 due without credit, got %v", free.AmountDue)
+	}
+
+	down, _ := Prorate(sub, PlanStarter, CurrencyUSD, true, halfway)
+	if down.Kind != ChangeDowngrade || down.AmountDue != 0 || !down.EffectiveAt.Equal(sub.EndDate) {
+		t.Errorf("Expected a free downgrade at the period end, got %+v", down)
+	}
+
+	if _, err := Prorate(sub, PlanPersonal, CurrencyUSD, true, halfway); err != ErrSamePlan {
+		t.Errorf("Expected ErrSamePlan, got %v", err)
+	}
+}
+
+func TestUpgradeKeepsAnchorAndUsage(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+
+	before, _ := manager.Subscribe("mia", PlanPersonal)
+	manager.RecordData("mia", 1000)
+
+	change, err := manager.ChangePlan("mia", PlanTeam)
+	if err != nil {
+		t.Fatalf("ChangePlan failed: %v", err)
+	}
+	if change.AmountDue == 0 {
+		t.Fatal("Expected an upgrade to cost something")
+	}
+	// Nothing changes until the difference is paid
+	if sub := manager.GetSubscription("mia"); sub.PlanID != PlanPersonal {
+		t.Fatalf("Expected Personal until paid, got %s", sub.PlanID)
+	}
+
+	if err := manager.ApplyUpgrade("mia", "someone-else", PlanTeam); err == nil {
+		t.Error("Expected upgrade of another subscription to fail")
+	}
+	if err := manager.ApplyUpgrade("mia", before.ID, PlanTeam); err != nil {
+		t.Fatalf("ApplyUpgrade failed: %v", err)
+	}
+
+	sub := manager.GetSubscription("mia")
+	if sub.PlanID != PlanTeam || sub.ID != before.ID || !sub.EndDate.Equal(before.EndDate) {
+		t.Errorf("Expected Team on the same billing anchor, got %+v", sub)
+	}
+	if store.subs["mia"].PlanID != string(PlanTeam) {
+		t.Errorf("Expected the upgrade to be persisted, got %s", store.subs["mia"].PlanID)
+	}
+	if stats := manager.GetUsage("mia"); stats.DataTransferred != 1000 {
+		t.Errorf("Expected usage of the period to carry over, got %d", stats.DataTransferred)
+	}
+}
+
+func TestDowngradeAtPeriodEnd(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	gateway := &fakeGateway{}
+	lc := NewLifecycle(manager, store, gateway, nil, LifecycleConfig{})
+
+	end := dueSubscription(t, manager, store, "ned", PlanTeam)
+	store.subs["ned"].EndDate = formatTime(end.Add(time.Hour))
+	acct := manager.Account("ned")
+	acct.mu.Lock()
+	acct.subscription.EndDate = end.Add(time.Hour)
+	acct.mu.Unlock()
+
+	change, err := manager.ChangePlan("ned", PlanPersonal)
+	if err != nil {
+		t.Fatalf("ChangePlan failed: %v", err)
+	}
+	if change.Kind != ChangeDowngrade || change.AmountDue != 0 {
+		t.Errorf("Expected a free downgrade, got %+v", change)
+	}
+
+	// The limits of the current plan apply until the period ends
+	if sub := manager.GetSubscription("ned"); sub.PlanID != PlanTeam || sub.ScheduledPlan != PlanPersonal {
+		t.Fatalf("Expected Team with Personal scheduled, got %+v", sub)
+	}
+	if store.subs["ned"].ScheduledPlan != string(PlanPersonal) {
+		t.Error("Expected the scheduled downgrade to be persisted")
+	}
+
+	// Changing back keeps the current plan
+	if change, err := manager.ChangePlan("ned", PlanTeam); err != nil || change.Kind != ChangeKeep {
+		t.Fatalf("Expected the downgrade to be dropped, got %+v, %v", change, err)
+	}
+	if store.subs["ned"].ScheduledPlan != "" {
+		t.Error("Expected the schedule to be cleared")
+	}
+
+	manager.ChangePlan("ned", PlanPersonal)
+	lc.Process(end.Add(2 * time.Hour))
+
+	if len(gateway.charges) != 1 || gateway.charges[0].PlanID != PlanPersonal || gateway.charges[0].AmountUSD != 29 {
+		t.Fatalf("Expected the renewal to charge Personal, got %+v", gateway.charges)
+	}
+	if sub := manager.GetSubscription("ned"); sub.PlanID != PlanPersonal || sub.ScheduledPlan != "" {
+		t.Errorf("Expected Personal after the renewal, got %+v", sub)
+	}
+}
@@ -0,0 +1,371 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Quota modes set what happens once a subscription has used the data limit
+// of its plan for the period
+const (
+	QuotaHard     = "hard"     // new connections are refused until the next period
+	QuotaSoft     = "soft"     // traffic goes on and the overage is charged with the renewal
+	QuotaThrottle = "throttle" // traffic goes on at the plan's throttled bandwidth
+)
+
+var (
+	ErrInvalidQuotaMode     = errors.New("quota mode must be hard, soft or throttle")
+	ErrQuotaModeUnavailable = errors.New("quota mode not available")
+)
+
+const bytesPerGB = 1 << 30
+
+// QuotaPeriod is the quota record of one period of a subscription
+type QuotaPeriod struct {
+	SubscriptionID string
+	UserID         string
+	PeriodStart    time.Time
+	OverageBytes   int64   // data a soft quota let through beyond the limit
+	OverageUSD     float64 // what that data costs at the plan's rate
+	Warned         int     // highest warning threshold sent, in percent
+	Reference      string  // renewal charge the overage is billed with
+	BilledUSD      float64 // overage included in that charge
+}
+
+// QuotaStore is the persistence of quota periods
+type QuotaStore interface {
+	GetQuotaPeriod(subscriptionID string, periodStart time.Time) (*QuotaPeriod, error)
+	AddOverage(userID, subscriptionID string, periodStart time.Time, bytes int64, amountUSD float64) error
+	MarkQuotaWarned(userID, subscriptionID string, periodStart time.Time, threshold int) (bool, error)
+	BillOverage(subscriptionID string, periodStart time.Time, reference string, amountUSD float64) error
+	GetOverageByReference(reference string) (*QuotaPeriod, error)
+	GetUserEmail(userID string) (string, error)
+}
+
+// dataLimit returns the plan's data limit in bytes, or -1 if unlimited
+func (p Plan) dataLimit() int64 {
+	if p.DataLimitMB == -1 {
+		return -1
+	}
+	return p.DataLimitMB * 1024 * 1024
+}
+
+// QuotaModes returns the quota modes a plan offers. Plans without a data
+// limit have none.
+func QuotaModes(plan Plan) []string {
+	if plan.DataLimitMB == -1 {
+		return nil
+	}
+	modes := []string{QuotaHard}
+	if plan.OverageRatePerGB > 0 {
+		modes = append(modes, QuotaSoft)
+	}
+	if plan.ThrottleKbps > 0 {
+		modes = append(modes, QuotaThrottle)
+	}
+	return modes
+}
+
+// quotaMode returns the mode in force under a plan. A mode the plan does not
+// offer, e.g. after a change to a plan without overage, falls back to hard.
+func quotaMode(plan Plan, mode string) string {
+	switch {
+	case mode == QuotaSoft && plan.OverageRatePerGB > 0:
+		return QuotaSoft
+	case mode == QuotaThrottle && plan.ThrottleKbps > 0:
+		return QuotaThrottle
+	}
+	return QuotaHard
+}
+
+// quotaMode returns the quota mode of the account's subscription under plan
+func (a *Account) quotaMode(plan Plan) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.subscription == nil {
+		return QuotaHard
+	}
+	return quotaMode(plan, a.subscription.QuotaMode)
+}
+
+// overage returns the data used beyond the plan's limit under a soft quota
+// since the account was last metered, and the period it was used in. With
+// take the data counts as metered.
+func (a *Account) overage(plan Plan, take bool) (time.Time, int64) {
+	mode := a.quotaMode(plan)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := a.Usage.GetStats()
+	bytes := a.unmetered
+	if limit := plan.dataLimit(); limit != -1 && mode == QuotaSoft {
+		bytes += max(stats.DataTransferred, limit) - max(a.metered, limit)
+	}
+	if take {
+		a.metered, a.unmetered = stats.DataTransferred, 0
+	}
+	return stats.PeriodStart, max(bytes, 0)
+}
+
+// returnOverage gives back overage that could not be stored, to be metered
+// again. Overage of a period that has ended is dropped.
+func (a *Account) returnOverage(start time.Time, bytes int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.Usage.GetStats().PeriodStart.Equal(start) {
+		a.unmetered += bytes
+	}
+}
+
+// raiseWarned records that the warning for threshold is due in the period.
+// It reports false if one as high was already sent.
+func (a *Account) raiseWarned(start time.Time, threshold int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if threshold <= a.warned || !a.Usage.GetStats().PeriodStart.Equal(start) {
+		return false
+	}
+	a.warned = threshold
+	return true
+}
+
+// throttled reports whether the account's throttled quota is used up, which
+// slows its traffic down to the plan's throttled bandwidth
+func (a *Account) throttled(plan Plan) bool {
+	if plan.DataLimitMB == -1 || a.quotaMode(plan) != QuotaThrottle {
+		return false
+	}
+	return a.Usage.GetStats().DataTransferred >= plan.dataLimit()
+}
+
+// QuotaMeter accrues the overage of soft quotas and warns subscribers as
+// their usage crosses 80%, 100% and 120% of the data limit. It runs each
+// time the manager syncs usage; the overage is charged with the renewal.
+type QuotaMeter struct {
+	store    QuotaStore
+	notifier Notifier
+	logger   *logrus.Logger
+}
+
+// NewQuotaMeter creates the meter. notifier may be nil.
+func NewQuotaMeter(store QuotaStore, notifier Notifier) *QuotaMeter {
+	return &QuotaMeter{
+		store:    store,
+		notifier: notifier,
+		logger:   logrus.StandardLogger(),
+	}
+}
+
+// SetQuotaMeter connects the meter for overage and quota warnings
+func (m *Manager) SetQuotaMeter(q *QuotaMeter) { m.quota = q }
+
+// meter stores the overage of an account since it was last metered and
+// sends the warning for the highest threshold the period's usage has crossed,
+// once per period
+func (q *QuotaMeter) meter(acct *Account) error {
+	plan, err := acct.plan()
+	sub := acct.Subscription()
+	if err != nil || sub == nil || plan.DataLimitMB == -1 {
+		return nil
+	}
+
+	start, bytes := acct.overage(plan, true)
+	if bytes > 0 {
+		amount := float64(bytes) / bytesPerGB * plan.OverageRatePerGB
+		if err := q.store.AddOverage(acct.UserID, sub.ID, start, bytes, amount); err != nil {
+			acct.returnOverage(start, bytes)
+			return fmt.Errorf("failed to accrue overage: %w", err)
+		}
+	}
+
+	user := &User{ID: acct.UserID, Plan: plan.ID, DataUsed: acct.Usage.GetStats().DataTransferred, DataLimit: plan.dataLimit()}
+	warn, message := ShouldWarnQuota(user)
+	threshold := QuotaWarningThreshold(user)
+	if !warn || !acct.raiseWarned(start, threshold) {
+		return nil
+	}
+	// The store remembers warnings across restarts
+	sent, err := q.store.MarkQuotaWarned(acct.UserID, sub.ID, start, threshold)
+	if err != nil {
+		return fmt.Errorf("failed to record quota warning: %w", err)
+	}
+	if sent {
+		sub.QuotaMode = quotaMode(plan, sub.QuotaMode)
+		q.notify(acct, sub, threshold, message)
+	}
+	return nil
+}
+
+func (q *QuotaMeter) notify(acct *Account, sub *Subscription, threshold int, message string) {
+	if q.notifier == nil {
+		return
+	}
+
+	email, err := q.store.GetUserEmail(acct.UserID)
+	if err != nil {
+		q.logger.Warnf("Failed to load email for quota warning: %v", err)
+		return
+	}
+
+	err = q.notifier.NotifySubscription(&Notice{
+		Event:        EventQuotaWarning,
+		UserID:       acct.UserID,
+		Email:        email,
+		Subscription: sub,
+		Threshold:    threshold,
+		Message:      message,
+	})
+	if err != nil {
+		q.logger.Warnf("Failed to send quota warning: %v", err)
+	}
+}
+
+// bill returns the overage of the period a renewal ends, in USD, and records
+// it as charged with the renewal. Every attempt bills the overage again
+// under its own reference.
+func (q *QuotaMeter) bill(p *PersistedSubscription, reference string) (float64, error) {
+	period, err := q.store.GetQuotaPeriod(p.ID, parseTime(p.StartDate))
+	if err != nil || period == nil {
+		return 0, err
+	}
+	amount := roundAmount(period.OverageUSD)
+	if amount <= 0 {
+		return 0, nil
+	}
+	if err := q.store.BillOverage(p.ID, period.PeriodStart, reference, amount); err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// billOverage meters a loaded account once more, so the renewal charges the
+// period's usage up to now, and returns the overage to add to the renewal
+func (m *Manager) billOverage(p *PersistedSubscription, reference string) (float64, error) {
+	if m.quota == nil {
+		return 0, nil
+	}
+
+	m.mu.RLock()
+	acct, ok := m.accounts[p.UserID]
+	m.mu.RUnlock()
+	if ok && acct.isLoaded() {
+		if err := m.quota.meter(acct); err != nil {
+			return 0, err
+		}
+	}
+	return m.quota.bill(p, reference)
+}
+
+// SetQuotaMode sets what happens once the data limit of the user's plan is
+// used up. The overage of a soft quota is charged with the renewal, so it
+// needs a subscription the lifecycle renews with a saved payment method.
+func (m *Manager) SetQuotaMode(userID, mode string) (*Subscription, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode != QuotaHard && mode != QuotaSoft && mode != QuotaThrottle {
+		return nil, ErrInvalidQuotaMode
+	}
+
+	acct := m.Account(userID)
+	plan, err := acct.plan()
+	if err != nil {
+		return nil, err
+	}
+	sub := acct.Subscription()
+	switch {
+	case plan.DataLimitMB == -1:
+		return nil, fmt.Errorf("%w: the %s plan has no data limit", ErrQuotaModeUnavailable, plan.Name)
+	case !slices.Contains(QuotaModes(plan), mode):
+		return nil, fmt.Errorf("%w: the %s plan has no %s quota", ErrQuotaModeUnavailable, plan.Name, mode)
+	}
+
+	if m.store != nil {
+		if mode == QuotaSoft {
+			p, err := m.store.GetSubscription(userID)
+			if err != nil {
+				return nil, err
+			}
+			if p == nil || p.ID != sub.ID || p.PaymentAuth == "" || p.StripeSubID != "" {
+				return nil, fmt.Errorf("%w: overage is charged with renewals, which needs a saved card", ErrQuotaModeUnavailable)
+			}
+		}
+		if err := m.store.SetQuotaMode(sub.ID, mode); err != nil {
+			return nil, err
+		}
+	}
+
+	acct.mu.Lock()
+	if acct.subscription != nil && acct.subscription.ID == sub.ID {
+		acct.subscription.QuotaMode = mode
+	}
+	acct.mu.Unlock()
+	return acct.Subscription(), nil
+}
+
+// QuotaStatus is how the data limit of a user's plan is enforced and what
+// usage beyond it has cost in the current period
+type QuotaStatus struct {
+	Mode          string   `json:"quota_mode"`
+	Modes         []string `json:"quota_modes"`      // modes the plan offers
+	DataLimit     int64    `json:"data_limit_bytes"` // -1 for unlimited
+	UsedPercent   float64  `json:"used_percent"`
+	Throttled     bool     `json:"throttled"`
+	ThrottleKbps  int      `json:"throttle_kbps,omitempty"`
+	OverageRate   float64  `json:"overage_rate_per_gb,omitempty"` // USD
+	OverageBytes  int64    `json:"overage_bytes"`
+	OverageAmount float64  `json:"overage_amount"` // USD, charged with the next renewal
+}
+
+// QuotaStatus returns the quota of a user in the current period
+func (m *Manager) QuotaStatus(userID string) (*QuotaStatus, error) {
+	acct := m.Account(userID)
+	plan, err := acct.plan()
+	if err != nil {
+		return nil, err
+	}
+	sub := acct.Subscription()
+
+	status := &QuotaStatus{
+		Mode:      acct.quotaMode(plan),
+		Modes:     QuotaModes(plan),
+		DataLimit: plan.dataLimit(),
+	}
+	if status.Modes == nil {
+		status.Modes = []string{}
+	}
+	if status.DataLimit > 0 {
+		used := GetDataQuotaPercentage(&User{DataUsed: acct.Usage.GetStats().DataTransferred, DataLimit: status.DataLimit})
+		status.UsedPercent = math.Round(used*10) / 10
+	}
+	switch status.Mode {
+	case QuotaSoft:
+		status.OverageRate = plan.OverageRatePerGB
+	case QuotaThrottle:
+		status.ThrottleKbps = plan.ThrottleKbps
+		status.Throttled = acct.throttled(plan)
+	}
+
+	// Overage stored so far and what has not been metered yet
+	var overageUSD float64
+	if m.quota != nil && sub != nil {
+		start := acct.Usage.GetStats().PeriodStart
+		period, err := m.quota.store.GetQuotaPeriod(sub.ID, start)
+		if err != nil {
+			return nil, err
+		}
+		if period != nil {
+			status.OverageBytes, overageUSD = period.OverageBytes, period.OverageUSD
+		}
+	}
+	if _, pending := acct.overage(plan, false); pending > 0 {
+		status.OverageBytes += pending
+		overageUSD += float64(pending) / bytesPerGB * plan.OverageRatePerGB
+	}
+	status.OverageAmount = roundAmount(overageUSD)
+	return status, nil
+}
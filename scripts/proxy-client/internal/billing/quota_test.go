@@ -0,0 +1,158 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const gb = int64(1 << 30)
+
+func TestQuotaModes(t *testing.T) {
+	store := NewMockStore()
+	manager := NewManager(store)
+	if _, err := manager.Subscribe("ada", PlanPersonal); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	manager.RecordData("ada", 10*gb)
+
+	// Hard stops traffic at the limit
+	if _, err := manager.OpenConnection("ada"); err == nil {
+		t.Fatal("Expected the hard quota to refuse connections")
+	}
+
+	// Soft needs a saved card to charge the overage to
+	if _, err := manager.SetQuotaMode("ada", QuotaSoft); !errors.Is(err, ErrQuotaModeUnavailable) {
+		t.Errorf("Expected ErrQuotaModeUnavailable without a card, got %v", err)
+	}
+	store.subs["ada"].PaymentAuth = "AUTH_test"
+	sub, err := manager.SetQuotaMode("ada", " Soft ")
+	if err != nil || sub.QuotaMode != QuotaSoft || store.subs["ada"].QuotaMode != QuotaSoft {
+		t.Fatalf("Expected a soft quota, got %+v, %v", sub, err)
+	}
+	release, err := manager.OpenConnection("ada")
+	if err != nil {
+		t.Fatalf("Expected the soft quota to let traffic through, got %v", err)
+	}
+	release()
+	if b := manager.Bandwidth("ada"); b.Throttled || b.UserKbps != 51200 {
+		t.Errorf("Expected the plan's bandwidth under a soft quota, got %+v", b)
+	}
+
+	// Throttle lets traffic through at the plan's bandwidth
+	if _, err := manager.SetQuotaMode("ada", QuotaThrottle); err != nil {
+		t.Fatalf("SetQuotaMode failed: %v", err)
+	}
+	if err := manager.CheckQuota("ada"); err != nil {
+		t.Errorf("Expected the throttled quota to let traffic through, got %v", err)
+	}
+	if b := manager.Bandwidth("ada"); !b.Throttled || b.UserKbps != 512 || b.ConnectionKbps != 512 {
+		t.Fatalf("Expected a 512 kbps throttle, got %+v", b)
+	}
+
+	if _, err := manager.SetQuotaMode("ada", "pause"); err != ErrInvalidQuotaMode {
+		t.Errorf("Expected ErrInvalidQuotaMode, got %v", err)
+	}
+	manager.Subscribe("bob", PlanEnterprise)
+	if _, err := manager.SetQuotaMode("bob", QuotaThrottle); !errors.Is(err, ErrQuotaModeUnavailable) {
+		t.Errorf("Expected unlimited plans to have no quota modes, got %v", err)
+	}
+	manager.Subscribe("cy", PlanStarter)
+	if _, err := manager.SetQuotaMode("cy", QuotaSoft); !errors.Is(err, ErrQuotaModeUnavailable) {
+		t.Errorf("Expected Starter to have no soft quota, got %v", err)
+	}
+}
+
+func TestQuotaOverageBilledWithRenewal(t *testing.T) {
+	store := NewMockStore()
+	end := dueSubscription(t, NewManager(store), store, "ada", PlanPersonal)
+	store.subs["ada"].QuotaMode = QuotaSoft
+
+	// A fresh manager loads the period that is due
+	manager := NewManager(store)
+	manager.SetQuotaMeter(NewQuotaMeter(store, nil))
+	gateway := &fakeGateway{}
+	lc := NewLifecycle(manager, store, gateway, nil, LifecycleConfig{})
+
+	manager.RecordData("ada", 11*gb)
+	if err := manager.SyncUsage(); err != nil {
+		t.Fatalf("SyncUsage failed: %v", err)
+	}
+	// Usage after the sync is metered by the renewal
+	manager.RecordData("ada", gb/2)
+
+	status, err := manager.QuotaStatus("ada")
+	if err != nil {
+		t.Fatalf("QuotaStatus failed: %v", err)
+	}
+	if status.Mode != QuotaSoft || status.OverageBytes != gb+gb/2 || status.OverageAmount != 6 || status.OverageRate != 4 {
+		t.Errorf("Expected 1.5 GB of overage at $4/GB, got %+v", status)
+	}
+
+	if err := lc.Process(time.Now()); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if len(gateway.charges) != 1 || gateway.charges[0].AmountUSD != 35 {
+		t.Fatalf("Expected the $29 renewal plus $6 overage, got %+v", gateway.charges)
+	}
+	billed, err := store.GetOverageByReference(gateway.charges[0].Reference)
+	if err != nil || billed == nil || billed.BilledUSD != 6 {
+		t.Errorf("Expected the overage recorded against the renewal, got %+v, %v", billed, err)
+	}
+
+	// The new period starts without overage and keeps the mode
+	status, _ = manager.QuotaStatus("ada")
+	if status.OverageBytes != 0 || status.OverageAmount != 0 || status.Mode != QuotaSoft {
+		t.Errorf("Expected a new period without overage, got %+v", status)
+	}
+	if sub := manager.GetSubscription("ada"); !sub.StartDate.Equal(end) {
+		t.Errorf("Expected the renewed period to start at %s, got %s", end, sub.StartDate)
+	}
+}
+
+func TestQuotaWarnings(t *testing.T) {
+	store := NewMockStore()
+	store.emails["ada"] = "ada@example.com"
+	notifier := &fakeNotifier{}
+	manager := NewManager(store)
+	manager.SetQuotaMeter(NewQuotaMeter(store, notifier))
+	manager.Subscribe("ada", PlanPersonal)
+	store.subs["ada"].PaymentAuth = "AUTH_test"
+	manager.SetQuotaMode("ada", QuotaSoft)
+
+	expect := func(thresholds ...int) {
+		t.Helper()
+		if err := manager.SyncUsage(); err != nil {
+			t.Fatalf("SyncUsage failed: %v", err)
+		}
+		if len(notifier.notices) != len(thresholds) {
+			t.Fatalf("Expected %d warnings, got %+v", len(thresholds), notifier.notices)
+		}
+		for i, n := range notifier.notices {
+			if n.Event != EventQuotaWarning || n.Threshold != thresholds[i] || n.Email != "ada@example.com" || n.Message == "" {
+				t.Errorf("Unexpected warning: %+v", n)
+			}
+		}
+	}
+
+	manager.RecordData("ada", 7*gb)
+	expect()
+	manager.RecordData("ada", gb)
+	expect(80)
+	expect(80)
+	manager.RecordData("ada", 2*gb)
+	expect(80, 100)
+	manager.RecordData("ada", 3*gb)
+	expect(80, 100, 120)
+	if notifier.notices[2].Message != "120% of data quota used" {
+		t.Errorf("Expected the 120%% warning, got %q", notifier.notices[2].Message)
+	}
+
+	// Warnings are not sent again after a restart
+	restarted := NewManager(store)
+	restarted.SetQuotaMeter(NewQuotaMeter(store, notifier))
+	restarted.RecordData("ada", gb)
+	if err := restarted.SyncUsage(); err != nil || len(notifier.notices) != 3 {
+		t.Errorf("Expected no repeated warnings, got %d, %v", len(notifier.notices), err)
+	}
+}
@@ -0,0 +1,164 @@
+package billing
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LedgerPromotions is the ledger account referral credits are paid from
+const LedgerPromotions = "promotions"
+
+// CreditReferral is the kind of credit transactions rewarding referrals
+const CreditReferral = "referral"
+
+// Referral states
+const (
+	ReferralPending  = "pending"  // the referee has not paid yet
+	ReferralRewarded = "rewarded" // both users have been credited
+)
+
+var ErrInvalidReferral = errors.New("invalid referral code")
+
+// Referral is a user who signed up with another user's referral code
+type Referral struct {
+	RefereeID  string     `json:"referee_id"`
+	ReferrerID string     `json:"referrer_id"`
+	Code       string     `json:"code"`
+	Status     string     `json:"status"`
+	Reference  string     `json:"reference,omitempty"` // the referee's first payment
+	RewardUSD  float64    `json:"reward_usd"`          // credited to the referrer
+	CreatedAt  time.Time  `json:"created_at"`
+	RewardedAt *time.Time `json:"rewarded_at,omitempty"`
+}
+
+// ReferralCode returns the referral code of a user, creating it on first use
+func (m *Manager) ReferralCode(userID string) (string, error) {
+	if m.promotions == nil {
+		return "", errors.New("promotions not configured")
+	}
+	code, err := m.promotions.store.GetReferralCode(userID)
+	if err != nil || code != "" {
+		return code, err
+	}
+
+	// Codes are random, so a clash is unlikely but retried
+	for range 3 {
+		code = newReferralCode()
+		if err = m.promotions.store.CreateReferralCode(userID, code); err == nil {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("failed to create referral code: %w", err)
+}
+
+// Refer records that a new user signed up with a referral code
+func (m *Manager) Refer(refereeID, code string) error {
+	if m.promotions == nil {
+		return errors.New("promotions not configured")
+	}
+	code = strings.ToUpper(strings.TrimSpace(code))
+	referrerID, err := m.promotions.store.GetReferrer(code)
+	if err != nil {
+		return err
+	}
+	if referrerID == "" || referrerID == refereeID {
+		return ErrInvalidReferral
+	}
+	return m.promotions.store.CreateReferral(&Referral{
+		RefereeID:  refereeID,
+		ReferrerID: referrerID,
+		Code:       code,
+		Status:     ReferralPending,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	})
+}
+
+// RewardReferral credits both users of a referral once the referee's first
+// payment succeeds. It reports whether the referral was rewarded by this
+// payment; later payments and users who were not referred are ignored.
+func (m *Manager) RewardReferral(refereeID, reference string) (bool, error) {
+	if m.promotions == nil {
+		return false, nil
+	}
+	r, err := m.promotions.store.GetReferral(refereeID)
+	if err != nil || r == nil || r.Status != ReferralPending {
+		return false, err
+	}
+
+	cfg := m.promotions.cfg
+	rewards := []struct {
+		userID, side string
+		amount       float64
+	}{
+		{r.ReferrerID, "referrer", cfg.ReferrerRewardUSD},
+		{r.RefereeID, "referee", cfg.RefereeRewardUSD},
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	// Each credit has its own reference, so a retried payment posts it once
+	for _, reward := range rewards {
+		_, err := m.promotions.store.PostCreditTransaction(&CreditTransaction{
+			ID:          uuid.New().String(),
+			Kind:        CreditReferral,
+			Reference:   fmt.Sprintf("REFERRAL-%s-%s", r.RefereeID, reward.side),
+			Description: fmt.Sprintf("Referral credit of $%.2f", reward.amount),
+			Debit:       LedgerPromotions,
+			Credit:      UserLedger(reward.userID),
+			Amount:      toMicros(reward.amount),
+			CreatedAt:   now,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to post referral credit: %w", err)
+		}
+		m.forgetBalance(reward.userID)
+	}
+
+	if err := m.promotions.store.RewardReferral(r.RefereeID, reference, cfg.ReferrerRewardUSD, now); err != nil {
+		return false, err
+	}
+	m.promotions.logger.Infof("Referral of %s by %s rewarded", r.RefereeID, r.ReferrerID)
+	return true, nil
+}
+
+// ReferralSummary is how a user's referrals are doing
+type ReferralSummary struct {
+	Code      string  `json:"code"`
+	Referred  int     `json:"referred"`
+	Rewarded  int     `json:"rewarded"`
+	EarnedUSD float64 `json:"earned_usd"`
+}
+
+// ReferralSummary returns a user's referral code and what it has earned
+func (m *Manager) ReferralSummary(userID string) (*ReferralSummary, error) {
+	code, err := m.ReferralCode(userID)
+	if err != nil {
+		return nil, err
+	}
+	s := &ReferralSummary{Code: code}
+	s.Referred, s.Rewarded, s.EarnedUSD, err = m.promotions.store.CountReferrals(userID)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListReferrals lists referrals newest first, of one referrer or all of them
+// if referrerID is empty
+func (m *Manager) ListReferrals(referrerID string, limit, offset int) ([]*Referral, int, error) {
+	if m.promotions == nil {
+		return nil, 0, errors.New("promotions not configured")
+	}
+	return m.promotions.store.ListReferrals(referrerID, limit, offset)
+}
+
+// newReferralCode returns 8 random characters that are easy to read out
+func newReferralCode() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	return base32.StdEncoding.EncodeToString(b)
+}
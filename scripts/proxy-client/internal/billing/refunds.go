@@ -0,0 +1,77 @@
+package billing
+
+import (
+	"errors"
+	"math"
+)
+
+// A paid trial holds part of its first payment as a deposit. The deposit is
+// refunded a while after the subscription ends, unless it is forfeited.
+const (
+	DepositHeld            = "held"
+	DepositRefundScheduled = "refund_scheduled"
+	DepositRefunded        = "refunded"
+	DepositForfeited       = "forfeited"
+)
+
+// The trial is charged TrialChargeUSD, of which TrialDepositUSD is deposit
+const (
+	TrialChargeUSD  = 7.99
+	TrialDepositUSD = 1.00
+)
+
+// TrialDeposit returns the deposit part of a trial payment, in the currency
+// the payment was made in
+func TrialDeposit(amountPaid float64) float64 {
+	return math.Round(amountPaid*TrialDepositUSD/TrialChargeUSD*100) / 100
+}
+
+// Refund outcomes a gateway reports
+const (
+	RefundPending   = "pending" // accepted; the gateway reports completion later
+	RefundProcessed = "processed"
+)
+
+var (
+	ErrRefundUnsupported = errors.New("payment method does not support refunds")
+	ErrRefundTooLarge    = errors.New("refund exceeds the amount left on the payment")
+	ErrDepositNotHeld    = errors.New("deposit is not held")
+)
+
+// RefundRequest asks a gateway to return money from a payment
+type RefundRequest struct {
+	Reference  string  // our reference of the payment
+	GatewayRef string  // the gateway's own ID of the payment, if known
+	Amount     float64 // in Currency; the payment's currency
+	Currency   string
+	Reason     string
+}
+
+// RefundResult is the gateway's record of a refund
+type RefundResult struct {
+	ID     string // the gateway's ID of the refund
+	Status string // RefundPending or RefundProcessed
+}
+
+// RefundPayment returns money from a payment through the gateway it was
+// made with
+func (m *Manager) RefundPayment(method PaymentMethod, req RefundRequest) (*RefundResult, error) {
+	switch method {
+	case MethodPaystack:
+		if m.paystackProvider == nil {
+			return nil, errors.New("paystack not configured")
+		}
+		return m.paystackProvider.Refund(req)
+	case MethodCrypto:
+		if m.cryptoProvider == nil {
+			return nil, errors.New("crypto not configured")
+		}
+		return m.cryptoProvider.Refund(req)
+	case MethodStripe:
+		if m.stripeProvider == nil {
+			return nil, errors.New("stripe not configured")
+		}
+		return m.stripeProvider.Refund(req)
+	}
+	return nil, ErrRefundUnsupported
+}
@@ -0,0 +1,33 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTrialDeposit(t *testing.T) {
+	if got := TrialDeposit(TrialChargeUSD); got != TrialDepositUSD {
+		t.Errorf("Expected a deposit of %.2f, got %.2f", TrialDepositUSD, got)
+	}
+	// A trial paid in naira holds the same share as deposit
+	if got := TrialDeposit(13080); got != 1637.05 {
+		t.Errorf("Expected a deposit of 1637.05, got %.2f", got)
+	}
+}
+
+func TestRefundPayment(t *testing.T) {
+	m := NewManager(NewMockStore())
+
+	if _, err := m.RefundPayment(MethodPaystack, RefundRequest{Reference: "REF-1"}); err == nil {
+		t.Error("Expected an error without Paystack configured")
+	}
+
+	crypto, _ := NewCryptoProvider(nil, nil, CryptoConfig{})
+	m.SetCrypto(crypto)
+	if _, err := m.RefundPayment(MethodCrypto, RefundRequest{Reference: "REF-1"}); !errors.Is(err, ErrRefundUnsupported) {
+		t.Errorf("Expected ErrRefundUnsupported for crypto, got %v", err)
+	}
+	if _, err := m.RefundPayment("cash", RefundRequest{Reference: "REF-1"}); !errors.Is(err, ErrRefundUnsupported) {
+		t.Errorf("Expected ErrRefundUnsupported for an unknown method, got %v", err)
+	}
+}
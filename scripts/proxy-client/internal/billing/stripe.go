@@ -0,0 +1,301 @@
+package billing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StripeConfig sets up card billing through Stripe
+type StripeConfig struct {
+	SecretKey     string `yaml:"secret_key"`
+	WebhookSecret string `yaml:"webhook_secret"` // signs webhook deliveries
+	SuccessURL    string `yaml:"success_url"`    // where Checkout returns after payment
+	CancelURL     string `yaml:"cancel_url"`
+	BaseURL       string `yaml:"base_url"` // the Stripe API; overridden in tests
+}
+
+const stripeAPI = "https://api.stripe.com"
+
+// stripeSignatureTolerance is how old a signed webhook may be
+const stripeSignatureTolerance = 5 * time.Minute
+
+var ErrInvalidStripeSignature = errors.New("invalid stripe signature")
+
+// StripeProvider bills cards in USD, EUR and GBP through Stripe Checkout.
+// Plans are sold as Stripe subscriptions, which Stripe renews and retries
+// itself; its webhooks move our subscription through its states. One-off
+// amounts such as upgrade differences and credits are plain payments.
+type StripeProvider struct {
+	cfg    StripeConfig
+	client *http.Client
+}
+
+func NewStripeProvider(cfg StripeConfig) *StripeProvider {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = stripeAPI
+	}
+	return &StripeProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// stripeCurrency returns the currency Stripe charges in: USD, EUR or GBP
+func stripeCurrency(currency string) CurrencyCode {
+	switch c := CurrencyCode(strings.ToUpper(currency)); c {
+	case CurrencyEUR, CurrencyGBP:
+		return c
+	}
+	return CurrencyUSD
+}
+
+func (p *StripeProvider) CreateCheckout(req CheckoutRequest) (*CheckoutResponse, error) {
+	if req.Reference == "" {
+		req.Reference = uuid.New().String()
+	}
+	reference := req.Reference
+	quote, err := checkoutQuote(req, stripeCurrency(req.Currency))
+	if err != nil {
+		return nil, err
+	}
+	currency := quote.Currency
+
+	metadata := map[string]string{"plan_id": req.PlanID}
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+
+	// A plan's monthly price is a subscription; amounts set by the server
+	// are paid once
+	mode := "subscription"
+	if req.AmountUSD > 0 {
+		mode = "payment"
+	}
+
+	name := "AtlanticProxy " + req.PlanID
+	if plan, err := GetPlan(PlanType(req.PlanID)); err == nil {
+		name = "AtlanticProxy " + plan.Name
+	}
+
+	form := url.Values{}
+	form.Set("mode", mode)
+	form.Set("success_url", p.cfg.SuccessURL)
+	form.Set("cancel_url", p.cfg.CancelURL)
+	form.Set("customer_email", req.Email)
+	form.Set("client_reference_id", reference)
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(string(currency)))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(quote.MinorUnits(), 10))
+	form.Set("line_items[0][price_data][product_data][name]", name)
+	if mode == "subscription" {
+		form.Set("line_items[0][price_data][recurring][interval]", "month")
+		// Stripe bills the renewals itself, so a coupon's discount is a
+		// Stripe coupon on the full price rather than a lower price
+		if req.coupon != nil {
+			full := ExchangeRates().QuotePrice(quote.AmountUSD+req.discount, currency)
+			if off := full.MinorUnits() - quote.MinorUnits(); off > 0 {
+				couponID, err := p.createCoupon(req.coupon, off, currency)
+				if err != nil {
+					return nil, err
+				}
+				form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(full.MinorUnits(), 10))
+				form.Set("discounts[0][coupon]", couponID)
+			}
+		}
+	}
+	for k, v := range metadata {
+		form.Set("metadata["+k+"]", v)
+		if mode == "subscription" {
+			form.Set("subscription_data[metadata]["+k+"]", v)
+		} else {
+			form.Set("payment_intent_data[metadata]["+k+"]", v)
+		}
+	}
+
+	var session struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := p.call("POST", "/v1/checkout/sessions", form, &session); err != nil {
+		return nil, err
+	}
+	return &CheckoutResponse{URL: session.URL, PaymentID: session.ID, Currency: string(currency), Quote: quote}, nil
+}
+
+// createCoupon creates a Stripe coupon taking amount minor units off one
+// subscription, for its first period only or for as long as it runs
+func (p *StripeProvider) createCoupon(c *Coupon, amount int64, currency CurrencyCode) (string, error) {
+	duration := "forever"
+	if c.FirstPeriodOnly {
+		duration = "once"
+	}
+	form := url.Values{}
+	form.Set("name", c.Code)
+	form.Set("amount_off", strconv.FormatInt(amount, 10))
+	form.Set("currency", strings.ToLower(string(currency)))
+	form.Set("duration", duration)
+	form.Set("max_redemptions", "1")
+
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := p.call("POST", "/v1/coupons", form, &out); err != nil {
+		return "", fmt.Errorf("failed to create stripe coupon: %w", err)
+	}
+	return out.ID, nil
+}
+
+// Refund returns money from a payment. Stripe refunds by payment intent,
+// which is the gateway reference of Stripe payments.
+func (p *StripeProvider) Refund(req RefundRequest) (*RefundResult, error) {
+	if req.GatewayRef == "" {
+		return nil, fmt.Errorf("stripe payment %s has no payment intent", req.Reference)
+	}
+
+	form := url.Values{}
+	form.Set("payment_intent", req.GatewayRef)
+	if req.Amount > 0 {
+		form.Set("amount", strconv.FormatInt(int64(math.Round(req.Amount*100)), 10))
+	}
+	form.Set("metadata[reference]", req.Reference)
+	if req.Reason != "" {
+		form.Set("metadata[reason]", req.Reason)
+	}
+
+	var refund struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := p.call("POST", "/v1/refunds", form, &refund); err != nil {
+		return nil, err
+	}
+
+	result := &RefundResult{ID: refund.ID, Status: RefundPending}
+	switch refund.Status {
+	case "succeeded":
+		result.Status = RefundProcessed
+	case "failed", "canceled":
+		return nil, fmt.Errorf("stripe refund %s", refund.Status)
+	}
+	return result, nil
+}
+
+// CancelAtPeriodEnd stops a Stripe subscription from renewing. Stripe ends
+// it at the end of the paid period and reports that by webhook.
+func (p *StripeProvider) CancelAtPeriodEnd(subscriptionID string) error {
+	form := url.Values{}
+	form.Set("cancel_at_period_end", "true")
+	return p.call("POST", "/v1/subscriptions/"+url.PathEscape(subscriptionID), form, nil)
+}
+
+// VerifyWebhook checks the Stripe-Signature header of a webhook delivery:
+// an HMAC-SHA256 of the timestamp and the payload, signed with the webhook
+// secret. Old deliveries are rejected so they can not be replayed.
+func (p *StripeProvider) VerifyWebhook(payload []byte, header string, now time.Time) error {
+	if p.cfg.WebhookSecret == "" {
+		return errors.New("stripe webhook secret not set")
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidStripeSignature
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidStripeSignature)
+	}
+
+	mac := hmac.New(sha256.New, []byte(p.cfg.WebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidStripeSignature
+}
+
+// StripeSubscriptionStatus maps the status of a Stripe subscription to ours.
+// A subscription set to cancel at the end of its period is canceled.
+func StripeSubscriptionStatus(status string, cancelAtPeriodEnd bool) string {
+	switch status {
+	case "trialing":
+		if cancelAtPeriodEnd {
+			return StatusCanceled
+		}
+		return StatusTrialing
+	case "active":
+		if cancelAtPeriodEnd {
+			return StatusCanceled
+		}
+		return StatusActive
+	case "past_due", "unpaid", "incomplete":
+		return StatusPastDue
+	case "canceled", "incomplete_expired":
+		return StatusExpired
+	}
+	return ""
+}
+
+// call makes a form-encoded request to the Stripe API and decodes the JSON
+// response into v
+func (p *StripeProvider) call(method, path string, form url.Values, v any) error {
+	req, err := http.NewRequest(method, p.cfg.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("stripe error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("stripe error: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(body, &apiErr)
+		return fmt.Errorf("stripe error: %d: %s", resp.StatusCode, apiErr.Error.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
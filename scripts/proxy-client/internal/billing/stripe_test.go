@@ -0,0 +1,252 @@
+package billing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeStripe records the requests made to it and answers with canned JSON
+type fakeStripe struct {
+	*httptest.Server
+	requests map[string]url.Values
+	auth     string
+}
+
+func newFakeStripe(t *testing.T) *fakeStripe {
+	t.Helper()
+	f := &fakeStripe{requests: make(map[string]url.Values)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse form: %v", err)
+		}
+		f.requests[r.Method+" "+r.URL.Path] = r.PostForm
+		f.auth = r.Header.Get("Authorization")
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/checkout/sessions":
+			fmt.Fprint(w, `{"id":"cs_test_1","url":"https://checkout.stripe.com/c/pay/cs_test_1"}`)
+		case "/v1/refunds":
+			if r.PostForm.Get("payment_intent") == "pi_declined" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"message":"Charge has already been refunded."}}`)
+				return
+			}
+			fmt.Fprint(w, `{"id":"re_test_1","status":"succeeded"}`)
+		case "/v1/subscriptions/sub_test_1":
+			fmt.Fprint(w, `{"id":"sub_test_1","status":"active","cancel_at_period_end":true}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"message":"Unrecognized request URL"}}`)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeStripe) provider() *StripeProvider {
+	return NewStripeProvider(StripeConfig{
+		SecretKey:     "sk_test_1",
+		WebhookSecret: "whsec_test",
+		SuccessURL:    "https://example.com/success",
+		CancelURL:     "https://example.com/cancel",
+		BaseURL:       f.URL,
+	})
+}
+
+func TestStripeCheckoutSubscription(t *testing.T) {
+	f := newFakeStripe(t)
+	p := f.provider()
+
+	resp, err := p.CreateCheckout(CheckoutRequest{
+		PlanID:    string(PlanPersonal),
+		Email:     "alice@example.com",
+		Currency:  "eur",
+		Reference: "REF-1",
+		Metadata:  map[string]string{"user_id": "alice"},
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckout failed: %v", err)
+	}
+	if resp.PaymentID != "cs_test_1" || resp.URL == "" || resp.Currency != "EUR" {
+		t.Errorf("Unexpected checkout response: %+v", resp)
+	}
+	if f.auth != "Bearer sk_test_1" {
+		t.Errorf("Expected the secret key as bearer token, got %q", f.auth)
+	}
+
+	form := f.requests["POST /v1/checkout/sessions"]
+	want := map[string]string{
+		"mode":                                   "subscription",
+		"client_reference_id":                    "REF-1",
+		"customer_email":                         "alice@example.com",
+		"success_url":                            "https://example.com/success",
+		"line_items[0][price_data][currency]":    "eur",
+		"line_items[0][price_data][unit_amount]": "2668", // €26.68 at the built-in rate
+		"line_items[0][price_data][recurring][interval]": "month",
+		"metadata[plan_id]":                    string(PlanPersonal),
+		"subscription_data[metadata][user_id]": "alice",
+	}
+	for k, v := range want {
+		if got := form.Get(k); got != v {
+			t.Errorf("Expected %s=%q, got %q", k, v, got)
+		}
+	}
+}
+
+func TestStripeCheckoutPayment(t *testing.T) {
+	f := newFakeStripe(t)
+	p := f.provider()
+
+	// Amounts set by the server are paid once, in USD unless Stripe
+	// supports the currency
+	resp, err := p.CreateCheckout(CheckoutRequest{
+		PlanID:    string(PlanTeam),
+		Email:     "bob@example.com",
+		Currency:  "NGN",
+		AmountUSD: 12.50,
+		Reference: "CHANGE-1",
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckout failed: %v", err)
+	}
+	if resp.Currency != "USD" {
+		t.Errorf("Expected a USD checkout, got %s", resp.Currency)
+	}
+
+	form := f.requests["POST /v1/checkout/sessions"]
+	if form.Get("mode") != "payment" || form.Get("line_items[0][price_data][unit_amount]") != "1250" {
+		t.Errorf("Expected a one-off payment of 1250 cents, got %v", form)
+	}
+	if form.Get("line_items[0][price_data][recurring][interval]") != "" {
+		t.Error("Expected no recurring price for a one-off payment")
+	}
+	if form.Get("payment_intent_data[metadata][plan_id]") != string(PlanTeam) {
+		t.Errorf("Expected the plan in the payment intent metadata, got %v", form)
+	}
+}
+
+func TestStripeRefundAndCancel(t *testing.T) {
+	f := newFakeStripe(t)
+	m := NewManager(NewMockStore())
+	m.SetStripe(f.provider())
+
+	result, err := m.RefundPayment(MethodStripe, RefundRequest{Reference: "REF-1", GatewayRef: "pi_1", Amount: 9.99, Currency: "USD"})
+	if err != nil {
+		t.Fatalf("RefundPayment failed: %v", err)
+	}
+	if result.ID != "re_test_1" || result.Status != RefundProcessed {
+		t.Errorf("Unexpected refund result: %+v", result)
+	}
+	if form := f.requests["POST /v1/refunds"]; form.Get("payment_intent") != "pi_1" || form.Get("amount") != "999" {
+		t.Errorf("Unexpected refund request: %v", form)
+	}
+
+	if _, err := m.RefundPayment(MethodStripe, RefundRequest{Reference: "REF-2", GatewayRef: "pi_declined", Amount: 1}); err == nil {
+		t.Error("Expected the Stripe error to be returned")
+	}
+	if _, err := m.RefundPayment(MethodStripe, RefundRequest{Reference: "REF-3"}); err == nil {
+		t.Error("Expected an error refunding a payment without a payment intent")
+	}
+
+	if err := f.provider().CancelAtPeriodEnd("sub_test_1"); err != nil {
+		t.Fatalf("CancelAtPeriodEnd failed: %v", err)
+	}
+	if form := f.requests["POST /v1/subscriptions/sub_test_1"]; form.Get("cancel_at_period_end") != "true" {
+		t.Errorf("Unexpected cancel request: %v", form)
+	}
+}
+
+func TestStripeCancelSubscription(t *testing.T) {
+	f := newFakeStripe(t)
+	store := NewMockStore()
+	m := NewManager(store)
+
+	sub, err := m.Subscribe("carol", PlanPersonal)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	store.subs["carol"].StripeSubID = "sub_test_1"
+
+	// A subscription Stripe bills is not canceled only here
+	if err := m.CancelSubscription("carol"); err == nil {
+		t.Error("Expected an error canceling without Stripe configured")
+	}
+
+	m.SetStripe(f.provider())
+	if err := m.CancelSubscription("carol"); err != nil {
+		t.Fatalf("CancelSubscription failed: %v", err)
+	}
+	if _, ok := f.requests["POST /v1/subscriptions/sub_test_1"]; !ok {
+		t.Error("Expected the Stripe subscription to be canceled")
+	}
+	if got := m.GetSubscription("carol"); got.ID != sub.ID || got.Status != StatusCanceled {
+		t.Errorf("Expected the subscription canceled, got %+v", got)
+	}
+}
+
+func TestStripeVerifyWebhook(t *testing.T) {
+	p := NewStripeProvider(StripeConfig{WebhookSecret: "whsec_test"})
+	payload := []byte(`{"id":"evt_1","type":"invoice.paid"}`)
+	now := time.Unix(1700000000, 0)
+
+	sign := func(ts int64, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%d.%s", ts, payload)
+		return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	if err := p.VerifyWebhook(payload, sign(now.Unix(), "whsec_test"), now); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	// Stripe sends several signatures while a secret is being rolled
+	rolled := sign(now.Unix(), "whsec_old") + ",v1=" + sign(now.Unix(), "whsec_test")[len("t=1700000000,v1="):]
+	if err := p.VerifyWebhook(payload, rolled, now); err != nil {
+		t.Errorf("Expected one matching signature to be enough, got %v", err)
+	}
+
+	cases := map[string]string{
+		"wrong secret":   sign(now.Unix(), "whsec_other"),
+		"too old":        sign(now.Add(-10*time.Minute).Unix(), "whsec_test"),
+		"missing header": "",
+		"no signature":   fmt.Sprintf("t=%d", now.Unix()),
+	}
+	for name, header := range cases {
+		if err := p.VerifyWebhook(payload, header, now); !errors.Is(err, ErrInvalidStripeSignature) {
+			t.Errorf("%s: expected ErrInvalidStripeSignature, got %v", name, err)
+		}
+	}
+	if err := p.VerifyWebhook([]byte(`{"id":"evt_2"}`), sign(now.Unix(), "whsec_test"), now); err == nil {
+		t.Error("Expected a changed payload to fail verification")
+	}
+}
+
+func TestStripeSubscriptionStatus(t *testing.T) {
+	cases := []struct {
+		status      string
+		cancelAtEnd bool
+		want        string
+	}{
+		{"trialing", false, StatusTrialing},
+		{"active", false, StatusActive},
+		{"active", true, StatusCanceled},
+		{"past_due", false, StatusPastDue},
+		{"unpaid", false, StatusPastDue},
+		{"canceled", false, StatusExpired},
+		{"incomplete_expired", false, StatusExpired},
+		{"paused", false, ""},
+	}
+	for _, c := range cases {
+		if got := StripeSubscriptionStatus(c.status, c.cancelAtEnd); got != c.want {
+			t.Errorf("%s (cancel at period end %v): expected %q, got %q", c.status, c.cancelAtEnd, c.want, got)
+		}
+	}
+}
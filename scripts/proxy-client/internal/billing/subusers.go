@@ -0,0 +1,581 @@
+package billing
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Sub-users let an account resell its plan. Each has its own proxy
+// credentials and may be capped in data, requests, connections and exit
+// countries. The caps are carved from the parent's quota, and everything a
+// sub-user does is billed on the parent's account.
+
+// SubUserIDPrefix marks the IDs of sub-users, which are billed on their
+// parent's account instead of their own
+const SubUserIDPrefix = "sub_"
+
+// SubUsernamePrefix marks the proxy usernames of sub-users
+const SubUsernamePrefix = "sub-"
+
+var (
+	ErrSubUserNotFound   = errors.New("sub-user not found")
+	ErrInvalidSubUser    = errors.New("invalid sub-user")
+	ErrSubUserLimit      = errors.New("all sub-users of the plan are taken")
+	ErrSubUserDisabled   = errors.New("sub-user is disabled")
+	ErrInvalidProxyLogin = errors.New("invalid proxy credentials")
+	ErrCountryNotAllowed = errors.New("exit country not allowed")
+)
+
+// SubUser is a reseller's customer with delegated proxy credentials
+type SubUser struct {
+	ID           string `json:"id"`
+	ParentID     string `json:"parent_id"`
+	Label        string `json:"label"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	// Caps within the parent's quota; 0 is no cap of their own
+	DataLimitMB    int64     `json:"data_limit_mb"`
+	RequestLimit   int64     `json:"request_limit"`
+	MaxConnections int       `json:"max_connections"`
+	Countries      []string  `json:"countries"` // allowed exit countries; empty allows the parent's
+	Active         bool      `json:"active"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// SubUserRequest creates or changes a sub-user
+type SubUserRequest struct {
+	Label          string   `json:"label"`
+	DataLimitMB    int64    `json:"data_limit_mb"`
+	RequestLimit   int64    `json:"request_limit"`
+	MaxConnections int      `json:"max_connections"`
+	Countries      []string `json:"countries"`
+	Active         *bool    `json:"active"`
+}
+
+// SubUserPeriod is what a sub-user used of one of the parent's periods
+type SubUserPeriod struct {
+	PeriodStart       time.Time `json:"period_start"`
+	DataTransferred   int64     `json:"data_transferred"`
+	RequestsMade      int64     `json:"requests_made"`
+	ActiveConnections int       `json:"active_connections"`
+}
+
+// SubUserReport is a sub-user and their usage of the current period
+type SubUserReport struct {
+	*SubUser
+	Usage SubUserPeriod `json:"usage"`
+}
+
+// SubUserStore is the persistence of sub-users
+type SubUserStore interface {
+	CreateSubUser(u *SubUser) error
+	GetSubUser(id string) (*SubUser, error)                 // nil if there is none
+	GetSubUserByUsername(username string) (*SubUser, error) // nil if there is none
+	ListSubUsers(parentID string) ([]*SubUser, error)
+	UpdateSubUser(u *SubUser) error
+	DeleteSubUser(parentID, id string) error
+
+	// AddSubUserUsage adds to what a sub-user used of a period
+	AddSubUserUsage(id string, periodStart time.Time, bytes, requests int64) error
+	GetSubUserUsage(id string, periodStart time.Time) (int64, int64, error)
+	// ListSubUserUsage returns the periods of a sub-user, newest first
+	ListSubUserUsage(id string, limit int) ([]SubUserPeriod, error)
+}
+
+// SubUsers keeps the sub-users in use and what they used of the current
+// period of their parent
+type SubUsers struct {
+	store  SubUserStore
+	logger *logrus.Logger
+
+	mu    sync.Mutex
+	users map[string]*SubUser        // by ID; nil for deleted ones
+	usage map[string]*subUserTraffic // by ID
+}
+
+// subUserTraffic is a sub-user's usage of a period
+type subUserTraffic struct {
+	periodStart    time.Time
+	data, requests int64 // of the period, including what is not stored yet
+	unsyncedData   int64
+	unsyncedReqs   int64
+	conns          int
+}
+
+// NewSubUsers creates the sub-user service
+func NewSubUsers(store SubUserStore) *SubUsers {
+	return &SubUsers{
+		store:  store,
+		logger: logrus.StandardLogger(),
+		users:  make(map[string]*SubUser),
+		usage:  make(map[string]*subUserTraffic),
+	}
+}
+
+// SetSubUsers connects sub-users. Without them no account can resell.
+func (m *Manager) SetSubUsers(s *SubUsers) { m.subUsers = s }
+
+// IsSubUser reports whether an ID is the ID of a sub-user
+func IsSubUser(id string) bool {
+	return strings.HasPrefix(id, SubUserIDPrefix)
+}
+
+// get returns a sub-user by ID, or nil
+func (s *SubUsers) get(id string) (*SubUser, error) {
+	s.mu.Lock()
+	u, ok := s.users[id]
+	s.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+
+	u, err := s.store.GetSubUser(id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.users[id] = u
+	s.mu.Unlock()
+	return u, nil
+}
+
+// forget drops a cached sub-user
+func (s *SubUsers) forget(id string) {
+	s.mu.Lock()
+	delete(s.users, id)
+	s.mu.Unlock()
+}
+
+// parent returns the account a sub-user is billed on
+func (s *SubUsers) parent(id string) string {
+	u, err := s.get(id)
+	if err != nil {
+		s.logger.Warnf("Failed to load sub-user %s: %v", id, err)
+		return id
+	}
+	if u == nil {
+		return id
+	}
+	return u.ParentID
+}
+
+// traffic returns a sub-user's usage of a period, starting it from the
+// store when the period is new. s.mu must be held.
+func (s *SubUsers) traffic(id string, periodStart time.Time) *subUserTraffic {
+	t, ok := s.usage[id]
+	if ok && t.periodStart.Equal(periodStart) {
+		return t
+	}
+	if ok && (t.unsyncedData > 0 || t.unsyncedReqs > 0) {
+		// Usage of the period just ended is kept under it
+		if err := s.store.AddSubUserUsage(id, t.periodStart, t.unsyncedData, t.unsyncedReqs); err != nil {
+			s.logger.Warnf("Failed to store usage of sub-user %s: %v", id, err)
+		}
+	}
+
+	data, reqs, err := s.store.GetSubUserUsage(id, periodStart)
+	if err != nil {
+		s.logger.Warnf("Failed to load usage of sub-user %s: %v", id, err)
+	}
+	conns := 0
+	if ok {
+		conns = t.conns
+	}
+	t = &subUserTraffic{periodStart: periodStart, data: data, requests: reqs, conns: conns}
+	s.usage[id] = t
+	return t
+}
+
+// check checks a sub-user's usage against their caps. Requests and
+// connections are only checked as they are opened.
+func (s *SubUsers) check(id string, periodStart time.Time, opening bool) error {
+	if !IsSubUser(id) {
+		return nil
+	}
+	u, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return ErrSubUserNotFound
+	}
+	if !u.Active {
+		return ErrSubUserDisabled
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.traffic(id, periodStart)
+	if u.DataLimitMB > 0 && t.data >= u.DataLimitMB*1024*1024 {
+		return errors.New("sub-user data limit exceeded")
+	}
+	if opening && u.RequestLimit > 0 && t.requests >= u.RequestLimit {
+		return errors.New("sub-user request limit exceeded")
+	}
+	if opening && u.MaxConnections > 0 && t.conns >= u.MaxConnections {
+		return errors.New("sub-user connection limit exceeded")
+	}
+	return nil
+}
+
+// open counts a request and a connection of a sub-user. release must be
+// called once the connection closes.
+func (s *SubUsers) open(id string, periodStart time.Time) (release func(), err error) {
+	if !IsSubUser(id) {
+		return func() {}, nil
+	}
+	if err := s.check(id, periodStart, true); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	t := s.traffic(id, periodStart)
+	t.conns++
+	t.requests++
+	t.unsyncedReqs++
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			t.conns--
+			s.mu.Unlock()
+		})
+	}, nil
+}
+
+// record counts data a sub-user transferred
+func (s *SubUsers) record(id string, periodStart time.Time, bytes int64) {
+	if !IsSubUser(id) {
+		return
+	}
+	s.mu.Lock()
+	t := s.traffic(id, periodStart)
+	t.data += bytes
+	t.unsyncedData += bytes
+	s.mu.Unlock()
+}
+
+// sync stores the usage of sub-users counted since the last sync and drops
+// those without open connections, whose usage is read again when needed
+func (s *SubUsers) sync() error {
+	type pending struct {
+		id string
+		t  subUserTraffic
+	}
+	s.mu.Lock()
+	var writes []pending
+	for id, t := range s.usage {
+		if t.unsyncedData > 0 || t.unsyncedReqs > 0 {
+			writes = append(writes, pending{id, *t})
+			t.unsyncedData, t.unsyncedReqs = 0, 0
+		}
+		if t.conns == 0 {
+			delete(s.usage, id)
+		}
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, w := range writes {
+		if err := s.store.AddSubUserUsage(w.id, w.t.periodStart, w.t.unsyncedData, w.t.unsyncedReqs); err != nil {
+			s.logger.Warnf("Failed to store usage of sub-user %s: %v", w.id, err)
+			s.mu.Lock()
+			if t, ok := s.usage[w.id]; ok && t.periodStart.Equal(w.t.periodStart) {
+				t.unsyncedData += w.t.unsyncedData
+				t.unsyncedReqs += w.t.unsyncedReqs
+			}
+			s.mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// currentSubUserUsage returns a sub-user's usage of the parent's current period
+func (m *Manager) currentSubUserUsage(u *SubUser) SubUserPeriod {
+	periodStart := m.Account(u.ParentID).Usage.GetStats().PeriodStart
+	m.subUsers.mu.Lock()
+	defer m.subUsers.mu.Unlock()
+	t := m.subUsers.traffic(u.ID, periodStart)
+	return SubUserPeriod{
+		PeriodStart:       periodStart,
+		DataTransferred:   t.data,
+		RequestsMade:      t.requests,
+		ActiveConnections: t.conns,
+	}
+}
+
+// CreateSubUser creates a sub-user of an account with generated proxy
+// credentials. The password is only returned here.
+func (m *Manager) CreateSubUser(parentID string, req SubUserRequest) (*SubUser, string, error) {
+	if m.subUsers == nil {
+		return nil, "", errors.New("sub-users not configured")
+	}
+	if err := m.Entitlements().Check(parentID, FeatureSubUsers); err != nil {
+		return nil, "", err
+	}
+	siblings, err := m.subUsers.store.ListSubUsers(parentID)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit := m.CurrentPlan(parentID).Flags.SubUsers; limit > 0 && len(siblings) >= limit {
+		return nil, "", ErrSubUserLimit
+	}
+
+	u := &SubUser{
+		ID:        SubUserIDPrefix + uuid.New().String(),
+		ParentID:  parentID,
+		Active:    true,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := m.applySubUserRequest(u, req, siblings); err != nil {
+		return nil, "", err
+	}
+
+	password := newProxyPassword()
+	u.PasswordHash = hashSecret(password)
+	// Usernames are random, so a clash is unlikely but retried
+	for range 3 {
+		u.Username = newSubUsername()
+		if err = m.subUsers.store.CreateSubUser(u); err == nil {
+			return u, password, nil
+		}
+	}
+	return nil, "", fmt.Errorf("failed to create sub-user: %w", err)
+}
+
+// applySubUserRequest sets the label, caps and countries of a sub-user. The
+// caps of all the parent's sub-users together must fit in its plan.
+func (m *Manager) applySubUserRequest(u *SubUser, req SubUserRequest, siblings []*SubUser) error {
+	label := strings.TrimSpace(req.Label)
+	if len(label) > 100 {
+		return fmt.Errorf("%w: label must be at most 100 characters", ErrInvalidSubUser)
+	}
+	if req.DataLimitMB < 0 || req.RequestLimit < 0 || req.MaxConnections < 0 {
+		return fmt.Errorf("%w: caps can not be negative", ErrInvalidSubUser)
+	}
+
+	plan := m.CurrentPlan(u.ParentID)
+	countries := make([]string, 0, len(req.Countries))
+	for _, c := range req.Countries {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if len(c) != 2 {
+			return fmt.Errorf("%w: %q is not a country code", ErrInvalidSubUser, c)
+		}
+		if !plan.Flags.AllowsCountry(c) {
+			return fmt.Errorf("%w: the plan does not include exit country %s", ErrInvalidSubUser, c)
+		}
+		if !containsFold(countries, c) {
+			countries = append(countries, c)
+		}
+	}
+
+	data, reqs, conns := req.DataLimitMB, req.RequestLimit, int64(req.MaxConnections)
+	for _, s := range siblings {
+		if s.ID != u.ID {
+			data, reqs, conns = data+s.DataLimitMB, reqs+s.RequestLimit, conns+int64(s.MaxConnections)
+		}
+	}
+	switch {
+	case plan.DataLimitMB != -1 && data > plan.DataLimitMB:
+		return fmt.Errorf("%w: data caps of %d MB exceed the plan's %d MB", ErrInvalidSubUser, data, plan.DataLimitMB)
+	case plan.RequestLimit != -1 && reqs > plan.RequestLimit:
+		return fmt.Errorf("%w: request caps of %d exceed the plan's %d", ErrInvalidSubUser, reqs, plan.RequestLimit)
+	case plan.ConcurrentConns != -1 && conns > int64(plan.ConcurrentConns):
+		return fmt.Errorf("%w: connection caps of %d exceed the plan's %d", ErrInvalidSubUser, conns, plan.ConcurrentConns)
+	}
+
+	u.Label = label
+	u.DataLimitMB, u.RequestLimit, u.MaxConnections = req.DataLimitMB, req.RequestLimit, req.MaxConnections
+	u.Countries = countries
+	if req.Active != nil {
+		u.Active = *req.Active
+	}
+	return nil
+}
+
+// subUser returns a sub-user of a parent
+func (m *Manager) subUser(parentID, id string) (*SubUser, error) {
+	if m.subUsers == nil || !IsSubUser(id) {
+		return nil, ErrSubUserNotFound
+	}
+	u, err := m.subUsers.store.GetSubUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || u.ParentID != parentID {
+		return nil, ErrSubUserNotFound
+	}
+	return u, nil
+}
+
+// ListSubUsers returns the sub-users of an account with their usage of the
+// current period
+func (m *Manager) ListSubUsers(parentID string) ([]SubUserReport, error) {
+	if m.subUsers == nil {
+		return nil, errors.New("sub-users not configured")
+	}
+	users, err := m.subUsers.store.ListSubUsers(parentID)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]SubUserReport, 0, len(users))
+	for _, u := range users {
+		reports = append(reports, SubUserReport{SubUser: u, Usage: m.currentSubUserUsage(u)})
+	}
+	return reports, nil
+}
+
+// GetSubUser returns a sub-user of an account with their usage of the
+// current period
+func (m *Manager) GetSubUser(parentID, id string) (*SubUserReport, error) {
+	u, err := m.subUser(parentID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &SubUserReport{SubUser: u, Usage: m.currentSubUserUsage(u)}, nil
+}
+
+// UpdateSubUser changes the label, caps, countries or state of a sub-user
+func (m *Manager) UpdateSubUser(parentID, id string, req SubUserRequest) (*SubUser, error) {
+	u, err := m.subUser(parentID, id)
+	if err != nil {
+		return nil, err
+	}
+	siblings, err := m.subUsers.store.ListSubUsers(parentID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.applySubUserRequest(u, req, siblings); err != nil {
+		return nil, err
+	}
+	if err := m.subUsers.store.UpdateSubUser(u); err != nil {
+		return nil, err
+	}
+	m.subUsers.forget(id)
+	return u, nil
+}
+
+// ResetSubUserPassword gives a sub-user a new proxy password, which is only
+// returned here
+func (m *Manager) ResetSubUserPassword(parentID, id string) (string, error) {
+	u, err := m.subUser(parentID, id)
+	if err != nil {
+		return "", err
+	}
+	password := newProxyPassword()
+	u.PasswordHash = hashSecret(password)
+	if err := m.subUsers.store.UpdateSubUser(u); err != nil {
+		return "", err
+	}
+	m.subUsers.forget(id)
+	return password, nil
+}
+
+// DeleteSubUser removes a sub-user. What they used stays on the parent's
+// account.
+func (m *Manager) DeleteSubUser(parentID, id string) error {
+	if _, err := m.subUser(parentID, id); err != nil {
+		return err
+	}
+	if err := m.subUsers.sync(); err != nil {
+		return err
+	}
+	if err := m.subUsers.store.DeleteSubUser(parentID, id); err != nil {
+		return err
+	}
+	m.subUsers.forget(id)
+	return nil
+}
+
+// SubUserUsage returns the usage of a sub-user in the parent's periods,
+// newest first
+func (m *Manager) SubUserUsage(parentID, id string, limit int) ([]SubUserPeriod, error) {
+	u, err := m.subUser(parentID, id)
+	if err != nil {
+		return nil, err
+	}
+	// Counted usage is stored first, so the current period is complete
+	if err := m.subUsers.sync(); err != nil {
+		return nil, err
+	}
+	periods, err := m.subUsers.store.ListSubUserUsage(u.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	current := m.currentSubUserUsage(u)
+	if len(periods) > 0 && periods[0].PeriodStart.Equal(current.PeriodStart) {
+		periods[0].ActiveConnections = current.ActiveConnections
+	}
+	return periods, nil
+}
+
+// ValidateSubUser authenticates the proxy credentials of a sub-user and
+// returns their ID
+func (m *Manager) ValidateSubUser(username, password string) (string, error) {
+	if m.subUsers == nil || !strings.HasPrefix(username, SubUsernamePrefix) {
+		return "", ErrInvalidProxyLogin
+	}
+	u, err := m.subUsers.store.GetSubUserByUsername(strings.ToLower(username))
+	if err != nil {
+		return "", err
+	}
+	if u == nil || subtle.ConstantTimeCompare([]byte(u.PasswordHash), []byte(hashSecret(password))) != 1 {
+		return "", ErrInvalidProxyLogin
+	}
+	if !u.Active {
+		return "", ErrSubUserDisabled
+	}
+	return u.ID, nil
+}
+
+// ExitCountry returns the exit country of a connection: the one requested,
+// if the user may use it, or else the first a sub-user is restricted to
+func (m *Manager) ExitCountry(userID, requested string) (string, error) {
+	country := strings.ToUpper(strings.TrimSpace(requested))
+	if m.subUsers != nil && IsSubUser(userID) {
+		u, err := m.subUsers.get(userID)
+		if err != nil {
+			return "", err
+		}
+		if u != nil && len(u.Countries) > 0 {
+			if country == "" {
+				country = u.Countries[0]
+			} else if !containsFold(u.Countries, country) {
+				return "", fmt.Errorf("%w: %s", ErrCountryNotAllowed, country)
+			}
+		}
+	}
+	if country != "" {
+		if err := m.Entitlements().CheckCountry(userID, country); err != nil {
+			return "", err
+		}
+	}
+	return country, nil
+}
+
+// newSubUsername returns a proxy username that is easy to read out
+func newSubUsername() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	return SubUsernamePrefix + strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+func newProxyPassword() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,177 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+)
+
+// newResellerManager returns a manager with sub-users and "rita" on
+// Enterprise, which has 1000 connections and unlimited sub-users
+func newResellerManager(t *testing.T) (*Manager, *MockStore) {
+	t.Helper()
+	store := NewMockStore()
+	manager := NewManager(store)
+	manager.SetSubUsers(NewSubUsers(store))
+
+	if _, _, err := manager.CreateSubUser("rita", SubUserRequest{}); !errors.Is(err, ErrNotEntitled) {
+		t.Fatalf("Expected Starter to be refused sub-users, got %v", err)
+	}
+	if _, err := manager.Subscribe("rita", PlanEnterprise); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return manager, store
+}
+
+func TestSubUserCredentials(t *testing.T) {
+	manager, _ := newResellerManager(t)
+
+	u, password, err := manager.CreateSubUser("rita", SubUserRequest{Label: " Client A "})
+	if err != nil || !IsSubUser(u.ID) || u.Label != "Client A" || password == "" || !u.Active {
+		t.Fatalf("CreateSubUser failed: %+v, %v", u, err)
+	}
+	if id, err := manager.ValidateSubUser(u.Username, password); err != nil || id != u.ID {
+		t.Errorf("Expected the credentials to authenticate %s, got %q (err %v)", u.ID, id, err)
+	}
+	if _, err := manager.ValidateSubUser(u.Username, "wrong"); !errors.Is(err, ErrInvalidProxyLogin) {
+		t.Errorf("Expected a wrong password to be refused, got %v", err)
+	}
+
+	// A reset password replaces the old one
+	fresh, err := manager.ResetSubUserPassword("rita", u.ID)
+	if err != nil {
+		t.Fatalf("ResetSubUserPassword failed: %v", err)
+	}
+	if _, err := manager.ValidateSubUser(u.Username, password); err == nil {
+		t.Error("Expected the old password to stop working")
+	}
+	if _, err := manager.ValidateSubUser(u.Username, fresh); err != nil {
+		t.Errorf("Expected the new password to work, got %v", err)
+	}
+
+	// Disabled and deleted sub-users can not connect
+	off := false
+	if _, err := manager.UpdateSubUser("rita", u.ID, SubUserRequest{Active: &off}); err != nil {
+		t.Fatalf("UpdateSubUser failed: %v", err)
+	}
+	if _, err := manager.ValidateSubUser(u.Username, fresh); !errors.Is(err, ErrSubUserDisabled) {
+		t.Errorf("Expected a disabled sub-user to be refused, got %v", err)
+	}
+	if _, err := manager.GetSubUser("other", u.ID); !errors.Is(err, ErrSubUserNotFound) {
+		t.Errorf("Expected sub-users to be private to their parent, got %v", err)
+	}
+	if err := manager.DeleteSubUser("rita", u.ID); err != nil {
+		t.Fatalf("DeleteSubUser failed: %v", err)
+	}
+	if _, err := manager.ValidateSubUser(u.Username, fresh); !errors.Is(err, ErrInvalidProxyLogin) {
+		t.Errorf("Expected a deleted sub-user to be refused, got %v", err)
+	}
+}
+
+func TestSubUserCaps(t *testing.T) {
+	manager, store := newResellerManager(t)
+
+	// Caps are carved from the plan's
+	if _, _, err := manager.CreateSubUser("rita", SubUserRequest{MaxConnections: 1001}); !errors.Is(err, ErrInvalidSubUser) {
+		t.Errorf("Expected caps beyond the plan to be refused, got %v", err)
+	}
+	u, _, err := manager.CreateSubUser("rita", SubUserRequest{DataLimitMB: 1, RequestLimit: 3, MaxConnections: 600})
+	if err != nil {
+		t.Fatalf("CreateSubUser failed: %v", err)
+	}
+	if _, _, err := manager.CreateSubUser("rita", SubUserRequest{MaxConnections: 500}); !errors.Is(err, ErrInvalidSubUser) {
+		t.Errorf("Expected the caps of all sub-users to fit the plan, got %v", err)
+	}
+	if _, err := manager.UpdateSubUser("rita", u.ID, SubUserRequest{DataLimitMB: 1, RequestLimit: 2, MaxConnections: 1000}); err != nil {
+		t.Fatalf("Expected a sub-user's own caps not to count twice, got %v", err)
+	}
+
+	// Sub-users are billed on the parent and count their own requests
+	if sub := manager.GetSubscription(u.ID); sub.PlanID != PlanEnterprise {
+		t.Errorf("Expected the sub-user to use the parent's plan, got %s", sub.PlanID)
+	}
+	for range 2 {
+		release, err := manager.OpenConnection(u.ID)
+		if err != nil {
+			t.Fatalf("OpenConnection failed: %v", err)
+		}
+		release()
+	}
+	if _, err := manager.OpenConnection(u.ID); err == nil {
+		t.Error("Expected the sub-user request limit to be enforced")
+	}
+	if _, err := manager.OpenConnection("rita"); err != nil {
+		t.Errorf("Expected the parent to be unaffected, got %v", err)
+	}
+
+	// Open connections go on until the sub-user's data runs out
+	if err := manager.CheckData(u.ID); err != nil {
+		t.Errorf("Expected data left at the request limit, got %v", err)
+	}
+	manager.RecordData(u.ID, 1024*1024)
+	if err := manager.CheckData(u.ID); err == nil {
+		t.Error("Expected the sub-user data limit to be enforced")
+	}
+	if err := manager.CheckData("rita"); err != nil {
+		t.Errorf("Expected the parent to have data left, got %v", err)
+	}
+	if stats := manager.GetUsage("rita"); stats.DataTransferred != 1024*1024 {
+		t.Errorf("Expected the sub-user's data on the parent, got %d", stats.DataTransferred)
+	}
+	report, err := manager.GetSubUser("rita", u.ID)
+	if err != nil || report.Usage.DataTransferred != 1024*1024 || report.Usage.RequestsMade != 2 {
+		t.Errorf("Expected the sub-user's own usage, got %+v (err %v)", report, err)
+	}
+
+	// Usage is kept per period
+	periods, err := manager.SubUserUsage("rita", u.ID, 12)
+	if err != nil || len(periods) != 1 || periods[0].RequestsMade != 2 {
+		t.Fatalf("Expected one stored period, got %+v (err %v)", periods, err)
+	}
+	if data, _, _ := store.GetSubUserUsage(u.ID, periods[0].PeriodStart); data != 1024*1024 {
+		t.Errorf("Expected the data stored, got %d", data)
+	}
+}
+
+func TestSubUserCountries(t *testing.T) {
+	manager, _ := newResellerManager(t)
+
+	if _, _, err := manager.CreateSubUser("rita", SubUserRequest{Countries: []string{"Germany"}}); !errors.Is(err, ErrInvalidSubUser) {
+		t.Errorf("Expected country names to be refused, got %v", err)
+	}
+	u, _, err := manager.CreateSubUser("rita", SubUserRequest{Countries: []string{"de", "FR", "de"}})
+	if err != nil || len(u.Countries) != 2 || u.Countries[0] != "DE" {
+		t.Fatalf("CreateSubUser failed: %+v, %v", u, err)
+	}
+
+	if country, err := manager.ExitCountry(u.ID, ""); err != nil || country != "DE" {
+		t.Errorf("Expected DE by default, got %q (err %v)", country, err)
+	}
+	if country, err := manager.ExitCountry(u.ID, "fr"); err != nil || country != "FR" {
+		t.Errorf("Expected FR, got %q (err %v)", country, err)
+	}
+	if _, err := manager.ExitCountry(u.ID, "US"); !errors.Is(err, ErrCountryNotAllowed) {
+		t.Errorf("Expected US to be refused, got %v", err)
+	}
+	if country, err := manager.ExitCountry("rita", "US"); err != nil || country != "US" {
+		t.Errorf("Expected the parent to use any country, got %q (err %v)", country, err)
+	}
+}
+
+func TestCloseSubUserAccount(t *testing.T) {
+	manager, _ := newResellerManager(t)
+	u, _, err := manager.CreateSubUser("rita", SubUserRequest{})
+	if err != nil {
+		t.Fatalf("CreateSubUser failed: %v", err)
+	}
+
+	// Closing a sub-user removes them and leaves the parent's plan alone
+	if err := manager.CloseAccount(u.ID); err != nil {
+		t.Fatalf("CloseAccount failed: %v", err)
+	}
+	if _, err := manager.GetSubUser("rita", u.ID); !errors.Is(err, ErrSubUserNotFound) {
+		t.Errorf("Expected the sub-user removed, got %v", err)
+	}
+	if sub := manager.GetSubscription("rita"); sub.PlanID != PlanEnterprise || sub.Status != StatusActive {
+		t.Errorf("Expected the parent's subscription to stay active, got %+v", sub)
+	}
+}
@@ -0,0 +1,97 @@
+package billing
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TaxRule is the sales tax charged to customers in a country
+type TaxRule struct {
+	Name string  `json:"name"` // as printed on invoices, e.g. VAT
+	Rate float64 `json:"rate"` // e.g. 0.075 for 7.5%
+	// ReverseCharge exempts business customers with a tax ID, who account
+	// for the tax themselves
+	ReverseCharge bool `json:"reverse_charge,omitempty"`
+}
+
+// TaxRules are the taxes charged per country (ISO 3166 alpha-2). Prices
+// include them: the tax is the part of the amount paid they make up.
+// Customers in other countries are not charged tax.
+var TaxRules = map[string]TaxRule{
+	"NG": {Name: "VAT", Rate: 0.075},
+	"GH": {Name: "VAT", Rate: 0.15},
+	"KE": {Name: "VAT", Rate: 0.16},
+	"ZA": {Name: "VAT", Rate: 0.15},
+	"GB": {Name: "VAT", Rate: 0.20, ReverseCharge: true},
+	"AT": {Name: "VAT", Rate: 0.20, ReverseCharge: true},
+	"BE": {Name: "VAT", Rate: 0.21, ReverseCharge: true},
+	"DE": {Name: "VAT", Rate: 0.19, ReverseCharge: true},
+	"ES": {Name: "VAT", Rate: 0.21, ReverseCharge: true},
+	"FI": {Name: "VAT", Rate: 0.255, ReverseCharge: true},
+	"FR": {Name: "VAT", Rate: 0.20, ReverseCharge: true},
+	"IE": {Name: "VAT", Rate: 0.23, ReverseCharge: true},
+	"IT": {Name: "VAT", Rate: 0.22, ReverseCharge: true},
+	"NL": {Name: "VAT", Rate: 0.21, ReverseCharge: true},
+	"PT": {Name: "VAT", Rate: 0.23, ReverseCharge: true},
+}
+
+// currencyCountries are the countries assumed for customers without a
+// billing address, by the currency they paid in
+var currencyCountries = map[CurrencyCode]string{
+	CurrencyNGN: "NG",
+	CurrencyGHS: "GH",
+	CurrencyKES: "KE",
+	CurrencyZAR: "ZA",
+	CurrencyGBP: "GB",
+}
+
+// TaxCountry returns the country a customer is taxed in: that of their
+// billing address, or the one of the local currency they paid in
+func TaxCountry(profile *BillingProfile, currency CurrencyCode) string {
+	if profile != nil && profile.Country != "" {
+		return strings.ToUpper(profile.Country)
+	}
+	return currencyCountries[CurrencyCode(strings.ToUpper(string(currency)))]
+}
+
+// ApplyTax splits the tax out of an invoice's lines, whose amounts are as
+// charged, and sets the invoice's totals
+func ApplyTax(inv *Invoice, country string) {
+	rule, taxed := TaxRules[country]
+	if taxed && rule.ReverseCharge && inv.Customer.TaxID != "" {
+		inv.TaxName = rule.Name
+		inv.ReverseCharge = true
+		taxed = false
+	}
+
+	c := currencyOf(inv.Currency)
+	inv.Subtotal, inv.TaxAmount, inv.Total = 0, 0, 0
+	for i := range inv.Lines {
+		line := &inv.Lines[i]
+		gross := c.Round(line.Amount)
+		inv.Total += gross
+		if taxed && line.Taxable {
+			line.Amount = c.Round(gross / (1 + rule.Rate))
+			inv.TaxAmount += gross - line.Amount
+		}
+		if line.Quantity <= 0 {
+			line.Quantity = 1
+		}
+		line.UnitPrice = c.Round(line.Amount / line.Quantity)
+		inv.Subtotal += line.Amount
+	}
+
+	inv.Total = c.Round(inv.Total)
+	inv.Subtotal = c.Round(inv.Subtotal)
+	inv.TaxAmount = c.Round(inv.TaxAmount)
+	if taxed && inv.TaxAmount > 0 {
+		inv.TaxName = rule.Name
+		inv.TaxRate = rule.Rate
+	}
+}
+
+// taxPercent formats a tax rate such as 0.075 as 7.5%
+func taxPercent(rate float64) string {
+	return strconv.FormatFloat(math.Round(rate*10000)/100, 'f', -1, 64) + "%"
+}
@@ -19,6 +19,12 @@ type UsageStats struct {
 type UsageTracker struct {
 	mu           sync.RWMutex
 	currentUsage *UsageStats
+
+	// Usage not yet charged to pay-as-you-go credits. It is kept apart from
+	// the period's stats so a new period does not lose it.
+	unbilledData   int64
+	connected      time.Duration // connected time not yet charged
+	connectedSince time.Time     // set while connections are open
 }
 
 func NewUsageTracker() *UsageTracker {
@@ -35,6 +41,14 @@ func NewUsageTracker() *UsageTracker {
 	}
 }
 
+// setPeriod sets the billing period the tracker counts for
+func (u *UsageTracker) setPeriod(start, end time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.currentUsage.PeriodStart = start
+	u.currentUsage.PeriodEnd = end
+}
+
 func (u *UsageTracker) GetStats() *UsageStats {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
@@ -48,6 +62,57 @@ func (u *UsageTracker) AddData(bytes int64) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 	u.currentUsage.DataTransferred += bytes
+	u.unbilledData += bytes
+}
+
+// connectionOpened counts a new connection; callers hold u.mu. Time is
+// metered while at least one connection is open.
+func (u *UsageTracker) connectionOpened(now time.Time) {
+	if u.currentUsage.ActiveConnections == 0 {
+		u.connectedSince = now
+	}
+	u.currentUsage.ActiveConnections++
+}
+
+// connectionClosed counts a closed connection; callers hold u.mu
+func (u *UsageTracker) connectionClosed(now time.Time) {
+	u.currentUsage.ActiveConnections--
+	if u.currentUsage.ActiveConnections == 0 && !u.connectedSince.IsZero() {
+		u.connected += now.Sub(u.connectedSince)
+		u.connectedSince = time.Time{}
+	}
+}
+
+// unbilled returns the data and connected time not yet charged
+func (u *UsageTracker) unbilled(now time.Time) (int64, time.Duration) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	connected := u.connected
+	if !u.connectedSince.IsZero() {
+		connected += now.Sub(u.connectedSince)
+	}
+	return u.unbilledData, connected
+}
+
+// takeUnbilled returns the usage not yet charged and starts counting anew
+func (u *UsageTracker) takeUnbilled(now time.Time) (int64, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	data, connected := u.unbilledData, u.connected
+	if !u.connectedSince.IsZero() {
+		connected += now.Sub(u.connectedSince)
+		u.connectedSince = now
+	}
+	u.unbilledData, u.connected = 0, 0
+	return data, connected
+}
+
+// returnUnbilled puts back usage that could not be charged
+func (u *UsageTracker) returnUnbilled(data int64, connected time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.unbilledData += data
+	u.connected += connected
 }
 
 func (u *UsageTracker) AddRequest() {
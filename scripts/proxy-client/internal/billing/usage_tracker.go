@@ -5,7 +5,8 @@ import (
 	"time"
 )
 
-type UsageTracker struct {
+// SessionTracker tracks per-connection usage for metered billing
+type SessionTracker struct {
 	mu       sync.RWMutex
 	sessions map[string]*SessionUsage
 }
@@ -20,14 +21,14 @@ type SessionUsage struct {
 	Location        string
 }
 
-func NewUsageTracker() *UsageTracker {
-	return &UsageTracker{
+func NewSessionTracker() *SessionTracker {
+	return &SessionTracker{
 		sessions: make(map[string]*SessionUsage),
 	}
 }
 
 // StartSession begins tracking usage for a session
-func (t *UsageTracker) StartSession(userID, sessionID, protocol, location string) {
+func (t *SessionTracker) StartSession(userID, sessionID, protocol, location string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	
@@ -42,7 +43,7 @@ func (t *UsageTracker) StartSession(userID, sessionID, protocol, location string
 }
 
 // RecordBytes adds bytes transferred to session
-func (t *UsageTracker) RecordBytes(sessionID string, bytes int64) {
+func (t *SessionTracker) RecordBytes(sessionID string, bytes int64) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	
@@ -53,7 +54,7 @@ func (t *UsageTracker) RecordBytes(sessionID string, bytes int64) {
 }
 
 // EndSession stops tracking and returns final usage
-func (t *UsageTracker) EndSession(sessionID string) *SessionUsage {
+func (t *SessionTracker) EndSession(sessionID string) *SessionUsage {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	
@@ -63,7 +64,7 @@ func (t *UsageTracker) EndSession(sessionID string) *SessionUsage {
 }
 
 // GetSessionUsage returns current usage for a session
-func (t *UsageTracker) GetSessionUsage(sessionID string) *SessionUsage {
+func (t *SessionTracker) GetSessionUsage(sessionID string) *SessionUsage {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	
@@ -71,7 +72,7 @@ func (t *UsageTracker) GetSessionUsage(sessionID string) *SessionUsage {
 }
 
 // GetUserTotalUsage calculates total usage for a user
-func (t *UsageTracker) GetUserTotalUsage(userID string) int64 {
+func (t *SessionTracker) GetUserTotalUsage(userID string) int64 {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	
@@ -92,8 +93,11 @@ func CalculateConnectionTime(session *SessionUsage) int64 {
 	return int64(time.Since(session.StartTime).Seconds())
 }
 
+// PAYGHourlyRate is the default pay-as-you-go price per connected hour in USD
+const PAYGHourlyRate = 1.20
+
 // CalculatePAYGCost calculates cost for PAYG users ($1.20/hour)
 func CalculatePAYGCost(connectionSeconds int64) float64 {
 	hours := float64(connectionSeconds) / 3600.0
-	return hours * 1.20
+	return hours * PAYGHourlyRate
 }
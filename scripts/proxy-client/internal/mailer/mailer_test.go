@@ -0,0 +1,92 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New(&Config{Backend: "file", Dir: dir, From: "AtlanticProxy <no-reply@example.com>"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	msg := PasswordResetEmail("user@example.com", "https://app.example.com/", "abc.def", time.Hour)
+	if err := m.Send(msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message file, got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	body := string(data)
+	for _, want := range []string{"To: user@example.com", "Subject: Reset your AtlanticProxy password", "https://app.example.com/reset-password?token=abc.def", "1 hour"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected message to contain %q", want)
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	pdf := bytes.Repeat([]byte("%PDF-1.3 "), 20)
+	msg := InvoiceEmail("user@example.com", "https://app.example.com", "INV-2026-000001", "₦43,999.00", pdf)
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(format("no-reply@example.com", msg)))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Expected a multipart message, got %q", parsed.Header.Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	body, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("Expected the body part: %v", err)
+	}
+	text, _ := io.ReadAll(body)
+	if !strings.Contains(string(text), "invoice INV-2026-000001 for ₦43,999.00") {
+		t.Errorf("Unexpected body: %s", text)
+	}
+
+	attachment, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("Expected the attachment part: %v", err)
+	}
+	if attachment.FileName() != "INV-2026-000001.pdf" || attachment.Header.Get("Content-Type") != `application/pdf; name=INV-2026-000001.pdf` {
+		t.Errorf("Unexpected attachment headers: %v", attachment.Header)
+	}
+	data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	if err != nil || !bytes.Equal(data, pdf) {
+		t.Error("Expected the attachment to round-trip")
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("Expected two parts, got %v", err)
+	}
+}
+
+func TestRejectsHeaderInjection(t *testing.T) {
+	m, _ := NewFileMailer(t.TempDir(), "no-reply@example.com")
+	if err := m.Send(&Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "x"}); err == nil {
+		t.Error("Expected header injection to be rejected")
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := New(&Config{Backend: "pigeon"}); err == nil {
+		t.Error("Expected unknown backend to fail")
+	}
+}
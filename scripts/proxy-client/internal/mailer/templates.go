@@ -0,0 +1,193 @@
+package mailer
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VerificationEmail asks the user to confirm their address
+func VerificationEmail(to, appURL, token string, ttl time.Duration) *Message {
+	link := tokenLink(appURL, "/verify-email", token)
+	return &Message{
+		To:      to,
+		Subject: "Verify your AtlanticProxy email address",
+		Body: fmt.Sprintf(`Welcome to AtlanticProxy!
+
+Please confirm your email address by opening the link below:
+
+%s
+
+The link expires in %s. If you did not create an account, you can ignore this email.
+`, link, humanDuration(ttl)),
+	}
+}
+
+// PasswordResetEmail carries a password reset link
+func PasswordResetEmail(to, appURL, token string, ttl time.Duration) *Message {
+	link := tokenLink(appURL, "/reset-password", token)
+	return &Message{
+		To:      to,
+		Subject: "Reset your AtlanticProxy password",
+		Body: fmt.Sprintf(`We received a request to reset your AtlanticProxy password.
+
+Open the link below to choose a new password:
+
+%s
+
+The link expires in %s. Resetting your password signs you out on all devices.
+If you did not ask for a reset, you can ignore this email.
+`, link, humanDuration(ttl)),
+	}
+}
+
+// PaymentFailedEmail tells the user a renewal payment failed and how long
+// they keep access
+func PaymentFailedEmail(to, appURL, plan string, attempt int, graceUntil time.Time) *Message {
+	return &Message{
+		To:      to,
+		Subject: "Your AtlanticProxy payment failed",
+		Body: fmt.Sprintf(`We could not renew your AtlanticProxy %s plan (attempt %d).
+
+Your plan stays active until %s. We will retry the payment automatically;
+to avoid losing access, please update your payment method:
+
+%s
+
+If your subscription is not paid by then, your account moves to the Starter plan.
+`, plan, attempt, graceUntil.Format("2 January 2006"), billingLink(appURL)),
+	}
+}
+
+// SubscriptionRenewedEmail confirms a renewal
+func SubscriptionRenewedEmail(to, appURL, plan string, nextBilling time.Time) *Message {
+	return &Message{
+		To:      to,
+		Subject: "Your AtlanticProxy subscription was renewed",
+		Body: fmt.Sprintf(`Thank you! Your AtlanticProxy %s plan was renewed.
+
+Your usage quota has been reset. The next renewal is on %s.
+
+Manage your subscription at %s
+`, plan, nextBilling.Format("2 January 2006"), billingLink(appURL)),
+	}
+}
+
+// SubscriptionExpiredEmail tells the user their subscription ended
+func SubscriptionExpiredEmail(to, appURL, plan string) *Message {
+	return &Message{
+		To:      to,
+		Subject: "Your AtlanticProxy subscription has ended",
+		Body: fmt.Sprintf(`Your AtlanticProxy %s plan has ended and your account is now on the Starter plan.
+
+You can subscribe again at any time:
+
+%s
+`, plan, billingLink(appURL)),
+	}
+}
+
+// LowBalanceEmail tells a pay-as-you-go user their credits are running out
+func LowBalanceEmail(to, appURL string, balance float64) *Message {
+	status := fmt.Sprintf("Your AtlanticProxy credit balance is down to $%.2f.", balance)
+	if balance <= 0 {
+		status = "Your AtlanticProxy credits have run out. New connections are refused until you top up."
+	}
+	return &Message{
+		To:      to,
+		Subject: "Your AtlanticProxy credits are running low",
+		Body: fmt.Sprintf(`%s
+
+Top up your credits to keep using pay-as-you-go:
+
+%s
+`, status, billingLink(appURL)),
+	}
+}
+
+// QuotaWarningEmail tells a subscriber how much of their plan's data they
+// have used and what happens beyond the limit under their quota mode: hard,
+// soft or throttle
+func QuotaWarningEmail(to, appURL, plan, status, mode string, resets time.Time) *Message {
+	var beyond string
+	switch mode {
+	case "soft":
+		beyond = "Traffic beyond your data limit carries on and is billed per GB with your next renewal."
+	case "throttle":
+		beyond = "Beyond your data limit, traffic carries on at a reduced speed."
+	default:
+		beyond = "Once your data limit is reached, new connections are refused."
+	}
+	return &Message{
+		To:      to,
+		Subject: "AtlanticProxy data usage: " + status,
+		Body: fmt.Sprintf(`%s on your AtlanticProxy %s plan.
+
+%s Your quota resets on %s.
+
+Upgrade your plan or change what happens at the limit:
+
+%s
+`, status, plan, beyond, resets.Format("2 January 2006"), billingLink(appURL)),
+	}
+}
+
+// InvoiceEmail sends an invoice as a PDF attachment
+func InvoiceEmail(to, appURL, number, total string, pdf []byte) *Message {
+	return &Message{
+		To:      to,
+		Subject: "Your AtlanticProxy invoice " + number,
+		Body: fmt.Sprintf(`Please find attached invoice %s for %s.
+
+All your invoices are available at %s
+`, number, total, billingLink(appURL)),
+		Attachments: []Attachment{{Filename: number + ".pdf", ContentType: "application/pdf", Data: pdf}},
+	}
+}
+
+// OrgInvitationEmail invites someone to join an organization
+func OrgInvitationEmail(to, appURL, org, token string, ttl time.Duration) *Message {
+	link := tokenLink(appURL, "/invite", token)
+	return &Message{
+		To:      to,
+		Subject: "You are invited to join " + org + " on AtlanticProxy",
+		Body: fmt.Sprintf(`You have been invited to join %s on AtlanticProxy and share its plan.
+
+Sign in or create an account with this email address, then open the link below to accept:
+
+%s
+
+The invitation expires in %s. If you were not expecting it, you can ignore this email.
+`, org, link, humanDays(ttl)),
+	}
+}
+
+func billingLink(appURL string) string {
+	return strings.TrimRight(appURL, "/") + "/billing"
+}
+
+func tokenLink(appURL, path, token string) string {
+	return strings.TrimRight(appURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d == time.Hour:
+		return "1 hour"
+	case d > time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+}
+
+func humanDays(d time.Duration) string {
+	if d < 24*time.Hour {
+		return humanDuration(d)
+	}
+	if days := int(d.Hours() / 24); days > 1 {
+		return fmt.Sprintf("%d days", days)
+	}
+	return "1 day"
+}
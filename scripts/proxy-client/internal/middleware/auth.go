@@ -1,24 +1,28 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
-	"os"
 	"strings"
-	"time"
 
+	"github.com/atlanticproxy/proxy-client/internal/auth"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
-
-type Claims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
-	jwt.RegisteredClaims
+// TokenValidator validates bearer access tokens and API keys
+type TokenValidator interface {
+	ValidateAccessToken(token string) (*auth.Claims, error)
+	ValidateAPIKey(key string) (*storage.APIKey, error)
 }
 
-func JWTAuth() gin.HandlerFunc {
+// JWTAuth authenticates requests with an access token issued by the auth layer.
+// On success it sets user_id, email and session_id in the request context.
+//
+// API keys (Bearer ap_...) are only accepted on routes that name the scopes
+// they need, and the key must hold all of them. For API keys user_id,
+// api_key_id and scopes are set instead of the session values.
+func JWTAuth(validator TokenValidator, scopes ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -34,35 +38,66 @@ func JWTAuth() gin.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(parts[1], &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+		if auth.IsAPIKey(parts[1]) {
+			apiKeyAuth(c, validator, parts[1], scopes)
+			return
+		}
 
-		if err != nil || !token.Valid {
+		claims, err := validator.ValidateAccessToken(parts[1])
+		if err == auth.ErrSessionRevoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+			c.Abort()
+			return
+		}
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		if claims, ok := token.Claims.(*Claims); ok {
-			c.Set("user_id", claims.UserID)
-			c.Set("email", claims.Email)
-		}
+		c.Set("user_id", claims.UserID)
+		c.Set("email", claims.Email)
+		c.Set("session_id", claims.SessionID)
 
 		c.Next()
 	}
 }
 
-func GenerateToken(userID, email string) (string, error) {
-	claims := Claims{
-		UserID: userID,
-		Email:  email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+func apiKeyAuth(c *gin.Context, validator TokenValidator, credential string, scopes []string) {
+	key, err := validator.ValidateAPIKey(credential)
+	switch {
+	case errors.Is(err, auth.ErrAPIAccessDenied):
+		if !DenyEntitlement(c, err) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			c.Abort()
+		}
+		return
+	case err == auth.ErrAPIKeyExpired:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "API key expired"})
+		c.Abort()
+		return
+	case err != nil:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+
+	if len(scopes) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys can not be used for this endpoint"})
+		c.Abort()
+		return
+	}
+	for _, scope := range scopes {
+		if !auth.HasScope(key, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key is missing scope " + scope})
+			c.Abort()
+			return
+		}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	c.Set("user_id", key.UserID)
+	c.Set("api_key_id", key.ID)
+	c.Set("scopes", key.Scopes)
+
+	c.Next()
 }
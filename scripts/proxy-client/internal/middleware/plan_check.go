@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/atlanticproxy/proxy-client/internal/billing"
@@ -61,22 +62,38 @@ func PlanCheck() gin.HandlerFunc {
 	}
 }
 
-// RequirePersonalPlan middleware ensures user has Personal plan or higher
-func RequirePersonalPlan() gin.HandlerFunc {
+// RequireFeature middleware ensures the user's plan includes a feature
+func RequireFeature(e *billing.Entitlements, feature billing.Feature) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userInterface, _ := c.Get("user")
-		user := userInterface.(*billing.User)
-		
-		if user.Plan == billing.PlanStarter || user.Plan == billing.PlanPAYG {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error": "This feature requires Personal plan or higher",
-				"upgrade_required": true,
-				"current_plan": user.Plan,
-			})
-			c.Abort()
+		if err := e.Check(c.GetString("user_id"), feature); err != nil {
+			DenyEntitlement(c, err)
 			return
 		}
-		
 		c.Next()
 	}
 }
+
+// DenyEntitlement aborts the request with the uniform response for a feature
+// the user's plan does not include. It reports false, and writes nothing, if
+// err is not an entitlement error.
+func DenyEntitlement(c *gin.Context, err error) bool {
+	var denied *billing.EntitlementError
+	if !errors.As(err, &denied) {
+		return false
+	}
+	body := gin.H{
+		"error":            denied.Error(),
+		"upgrade_required": true,
+		"feature":          denied.Feature,
+		"current_plan":     denied.Plan,
+	}
+	if denied.Value != "" {
+		body["value"] = denied.Value
+	}
+	if denied.UpgradeTo != "" {
+		body["upgrade_to"] = denied.UpgradeTo
+	}
+	c.JSON(http.StatusForbidden, body)
+	c.Abort()
+	return true
+}
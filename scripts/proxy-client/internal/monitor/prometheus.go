@@ -16,6 +16,11 @@ var (
 		Help: "The total number of bytes processed by the proxy",
 	})
 
+	UserThroughput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "atlantic_proxy_user_throughput_bytes_per_second",
+		Help: "Current throughput of each user's proxy traffic by direction",
+	}, []string{"user_id", "direction"})
+
 	RequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name:    "atlantic_proxy_request_duration_seconds",
 		Help:    "Histogram of request durations in seconds",
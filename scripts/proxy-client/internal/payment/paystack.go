@@ -15,10 +15,12 @@ type PaystackClient struct {
 }
 
 type InitializeRequest struct {
-	Email    string `json:"email"`
-	Amount   int    `json:"amount"` // in kobo (NGN) or cents (USD)
-	Currency string `json:"currency"`
-	Metadata map[string]interface{} `json:"metadata"`
+	Email       string                 `json:"email"`
+	Amount      int                    `json:"amount"` // in kobo (NGN) or cents (USD)
+	Currency    string                 `json:"currency"`
+	Reference   string                 `json:"reference,omitempty"`
+	CallbackURL string                 `json:"callback_url,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata"`
 }
 
 type InitializeResponse struct {
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/armon/go-socks5"
+	"github.com/elazarl/goproxy"
+)
+
+// CredentialValidator authenticates proxy clients and returns the ID of the
+// user the credentials belong to
+type CredentialValidator interface {
+	ValidateProxyCredentials(username, password string) (string, error)
+}
+
+const proxyAuthRealm = "AtlanticProxy"
+
+// countrySuffix asks for an exit country in a proxy username, as in
+// "<username>-country-de"
+const countrySuffix = "-country-"
+
+type userIDKey struct{}
+type countryKey struct{}
+
+// proxyClient is who a proxied request authenticated as and the exit country
+// they asked for
+type proxyClient struct {
+	userID  string
+	country string
+}
+
+// UserIDFromContext returns the user a SOCKS5 connection authenticated as
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(userIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// CountryFromContext returns the exit country a connection asked for
+func CountryFromContext(ctx context.Context) (string, bool) {
+	country, ok := ctx.Value(countryKey{}).(string)
+	return country, ok && country != ""
+}
+
+// proxyUser returns the user an HTTP proxy request authenticated as
+func proxyUser(ctx *goproxy.ProxyCtx) (string, bool) {
+	client, ok := ctx.UserData.(proxyClient)
+	return client.userID, ok && client.userID != ""
+}
+
+// proxyCountry returns the exit country an HTTP proxy request asked for
+func proxyCountry(ctx *goproxy.ProxyCtx) string {
+	client, _ := ctx.UserData.(proxyClient)
+	return client.country
+}
+
+// splitCountry takes the exit country off a proxy username
+func splitCountry(username string) (string, string) {
+	if i := strings.LastIndex(username, countrySuffix); i > 0 {
+		return username[:i], strings.ToUpper(username[i+len(countrySuffix):])
+	}
+	return username, ""
+}
+
+// authenticateHTTP checks the Proxy-Authorization header of a request.
+// It returns the client, with no user when no credentials were sent and they
+// are not required. The header is removed so it is never forwarded upstream.
+func authenticateHTTP(req *http.Request, validator CredentialValidator, required bool) (proxyClient, error) {
+	header := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+
+	if header == "" {
+		if required {
+			return proxyClient{}, fmt.Errorf("proxy credentials required")
+		}
+		return proxyClient{}, nil
+	}
+	if validator == nil {
+		return proxyClient{}, fmt.Errorf("proxy authentication not available")
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Basic") {
+		return proxyClient{}, fmt.Errorf("unsupported proxy authorization scheme")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return proxyClient{}, fmt.Errorf("malformed proxy credentials")
+	}
+	username, password, _ := strings.Cut(string(decoded), ":")
+	username, country := splitCountry(username)
+
+	userID, err := validator.ValidateProxyCredentials(username, password)
+	if err != nil {
+		return proxyClient{}, err
+	}
+	return proxyClient{userID: userID, country: country}, nil
+}
+
+// newProxyAuthRequired builds the 407 response sent to unauthenticated clients
+func newProxyAuthRequired(req *http.Request) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "Proxy Authentication Required\n")
+	resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+	return resp
+}
+
+// socks5CredentialAuth is the SOCKS5 username/password method (RFC 1929).
+// Unlike socks5.UserPassAuthenticator it keeps the ID of the authenticated
+// user in the auth context so the dialer can attribute the connection.
+type socks5CredentialAuth struct {
+	server *Socks5Server
+}
+
+func (a socks5CredentialAuth) GetCode() uint8 {
+	return socks5.UserPassAuth
+}
+
+func (a socks5CredentialAuth) Authenticate(reader io.Reader, writer io.Writer) (*socks5.AuthContext, error) {
+	if _, err := writer.Write([]byte{5, socks5.UserPassAuth}); err != nil {
+		return nil, err
+	}
+
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 1 {
+		return nil, fmt.Errorf("unsupported auth version: %v", header[0])
+	}
+
+	user := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(reader, user); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return nil, err
+	}
+	pass := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(reader, pass); err != nil {
+		return nil, err
+	}
+
+	validator := a.server.credentialValidator()
+	if validator == nil {
+		writer.Write([]byte{1, 1})
+		return nil, socks5.UserAuthFailed
+	}
+	username, country := splitCountry(string(user))
+	userID, err := validator.ValidateProxyCredentials(username, string(pass))
+	if err != nil {
+		writer.Write([]byte{1, 1})
+		return nil, socks5.UserAuthFailed
+	}
+
+	if _, err := writer.Write([]byte{1, 0}); err != nil {
+		return nil, err
+	}
+	return &socks5.AuthContext{
+		Method:  socks5.UserPassAuth,
+		Payload: map[string]string{"Username": username, "UserID": userID, "Country": country},
+	}, nil
+}
+
+// socks5UserRules admits every request and carries the authenticated user
+// into the context handed to the dialer
+type socks5UserRules struct{}
+
+func (socks5UserRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.AuthContext != nil {
+		if id := req.AuthContext.Payload["UserID"]; id != "" {
+			ctx = context.WithValue(ctx, userIDKey{}, id)
+		}
+		if country := req.AuthContext.Payload["Country"]; country != "" {
+			ctx = context.WithValue(ctx, countryKey{}, country)
+		}
+	}
+	return ctx, true
+}
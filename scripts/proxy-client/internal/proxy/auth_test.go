@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type fakeValidator map[string]string
+
+func (f fakeValidator) ValidateProxyCredentials(username, password string) (string, error) {
+	if id, ok := f[password]; ok {
+		return id, nil
+	}
+	return "", errors.New("invalid credentials")
+}
+
+func TestAuthenticateHTTP(t *testing.T) {
+	validator := fakeValidator{"ap_good": "user-1"}
+
+	newReq := func(user, pass string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if user != "" || pass != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		}
+		return req
+	}
+
+	req := newReq("any", "ap_good")
+	client, err := authenticateHTTP(req, validator, true)
+	if err != nil || client.userID != "user-1" || client.country != "" {
+		t.Errorf("Expected user-1, got %+v (err %v)", client, err)
+	}
+	if req.Header.Get("Proxy-Authorization") != "" {
+		t.Error("Proxy-Authorization must not be forwarded upstream")
+	}
+
+	if _, err := authenticateHTTP(newReq("any", "ap_bad"), validator, false); err == nil {
+		t.Error("Expected invalid credentials to be rejected even when optional")
+	}
+
+	if client, err := authenticateHTTP(newReq("", ""), validator, false); err != nil || client.userID != "" {
+		t.Errorf("Expected anonymous access when auth is optional, got %+v (err %v)", client, err)
+	}
+	if _, err := authenticateHTTP(newReq("", ""), validator, true); err == nil {
+		t.Error("Expected missing credentials to be rejected when required")
+	}
+}
+
+func TestCountryInUsername(t *testing.T) {
+	var seen string
+	validator := validatorFunc(func(username, password string) (string, error) {
+		seen = username
+		return "sub_1", nil
+	})
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("sub-abc-country-de:secret")))
+	client, err := authenticateHTTP(req, validator, true)
+	if err != nil || client.userID != "sub_1" || client.country != "DE" {
+		t.Errorf("Expected sub_1 exiting in DE, got %+v (err %v)", client, err)
+	}
+	if seen != "sub-abc" {
+		t.Errorf("Expected the country taken off the username, got %q", seen)
+	}
+
+	if name, country := splitCountry("sub-abc"); name != "sub-abc" || country != "" {
+		t.Errorf("Expected no country, got %q %q", name, country)
+	}
+}
+
+type validatorFunc func(username, password string) (string, error)
+
+func (f validatorFunc) ValidateProxyCredentials(username, password string) (string, error) {
+	return f(username, password)
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -35,6 +36,10 @@ type Config struct {
 	ProviderType   string // auto, residential, realtime, pia
 	ListenAddr     string
 	HealthCheckURL string
+
+	// RequireAuth refuses HTTP and SOCKS5 clients that do not present
+	// proxy credentials (an API key with the proxy-auth scope)
+	RequireAuth bool
 }
 
 type Engine struct {
@@ -46,12 +51,14 @@ type Engine struct {
 	rotationManager  *rotation.Manager
 	analyticsManager *rotation.AnalyticsManager
 	billingManager   *billing.Manager
+	shaper           *Shaper
 	proxy            *goproxy.ProxyHttpServer
 	server           *http.Server
 	socks5           *Socks5Server
 	shadowsocks      *ShadowsocksServer
 	healthCheck      *time.Ticker
 	transport        *http.Transport
+	validator        CredentialValidator
 	mu               sync.RWMutex
 	running          bool
 }
@@ -131,16 +138,30 @@ func NewEngine(config *Config, adblocker *adblock.Engine, rm *rotation.Manager,
 		transport:        transport,
 	}
 
+	// Shape every listener's traffic to the bandwidth of the user's plan and
+	// count it towards their usage
+	var source BandwidthSource
+	if bm != nil {
+		source = bm
+	}
+	engine.shaper = NewShaper(source, DefaultShaperConfig())
+	if bm != nil {
+		engine.shaper.SetMeter(bm)
+	}
+
 	// Initialize SOCKS5 server
-	socks5, err := NewSocks5Server("127.0.0.1:1080", oxylabsClient, bm)
+	socks5, err := NewSocks5Server("127.0.0.1:1080", oxylabsClient, bm, config.RequireAuth)
 	if err == nil {
+		socks5.shaper = engine.shaper
 		engine.socks5 = socks5
 	}
 
 	// Initialize Shadowsocks server (Premium Only)
 	// Method: chacha20-ietf-poly1305, Password: proxy-secret
-	ss, err := NewShadowsocksServer("0.0.0.0:8388", "AEAD_CHACHA20_IETF_POLY1305", "proxy-secret", oxylabsClient, bm)
+	// Local only: its clients share the password and are billed to the local user
+	ss, err := NewShadowsocksServer("127.0.0.1:8388", "AEAD_CHACHA20_IETF_POLY1305", "proxy-secret", oxylabsClient, bm)
 	if err == nil {
+		ss.shaper = engine.shaper
 		engine.shadowsocks = ss
 	}
 
@@ -163,6 +184,11 @@ func NewEngine(config *Config, adblocker *adblock.Engine, rm *rotation.Manager,
 			}
 		}
 
+		// A country the client asked for replaces the rotation's location
+		if country, ok := CountryFromContext(req.Context()); ok && !strings.EqualFold(country, proxyConfig.Country) {
+			proxyConfig = oxylabs.ProxyConfig{Country: country}
+		}
+
 		// Use Bright Data if available
 		if engine.brightDataClient != nil && (config.ProviderType == "brightdata" || config.ProviderType == "auto") {
 			var proxyURL string
@@ -182,6 +208,9 @@ func NewEngine(config *Config, adblocker *adblock.Engine, rm *rotation.Manager,
 		return engine.providerManager.GetProxy(req.Context(), proxyConfig)
 	}
 
+	// Authenticate proxy clients before any other request handler
+	proxy.OnRequest().DoFunc(engine.authenticateRequest)
+
 	// Handle Realtime Crawler API requests via Adapter
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		// Check if active provider is Realtime
@@ -198,6 +227,61 @@ func NewEngine(config *Config, adblocker *adblock.Engine, rm *rotation.Manager,
 	return engine
 }
 
+// SetCredentialValidator sets the validator used for proxy credentials on the
+// HTTP and SOCKS5 listeners
+func (e *Engine) SetCredentialValidator(v CredentialValidator) {
+	e.mu.Lock()
+	e.validator = v
+	e.mu.Unlock()
+
+	if e.socks5 != nil {
+		e.socks5.SetCredentialValidator(v)
+	}
+}
+
+// Shaper returns the shaper that limits the bandwidth of proxy traffic
+func (e *Engine) Shaper() *Shaper {
+	return e.shaper
+}
+
+func (e *Engine) credentialValidator() CredentialValidator {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.validator
+}
+
+// handleConnect authenticates CONNECT requests before they are intercepted.
+// The user is kept in ctx.UserData, which goproxy hands on to the requests
+// read from the tunnel.
+func (e *Engine) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	client, err := authenticateHTTP(ctx.Req, e.credentialValidator(), e.config.RequireAuth)
+	if err != nil {
+		ctx.Resp = newProxyAuthRequired(ctx.Req)
+		return goproxy.RejectConnect, host
+	}
+	if client.userID != "" {
+		ctx.UserData = client
+	}
+	return goproxy.MitmConnect, host
+}
+
+// authenticateRequest checks the proxy credentials of plain HTTP requests.
+// Requests read from an intercepted tunnel were already authenticated on CONNECT.
+func (e *Engine) authenticateRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if _, ok := proxyUser(ctx); ok {
+		return req, nil
+	}
+
+	client, err := authenticateHTTP(req, e.credentialValidator(), e.config.RequireAuth)
+	if err != nil {
+		return req, newProxyAuthRequired(req)
+	}
+	if client.userID != "" {
+		ctx.UserData = client
+	}
+	return req, nil
+}
+
 func (e *Engine) Start(ctx context.Context) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -224,6 +308,9 @@ func (e *Engine) Start(ctx context.Context) error {
 	e.healthCheck = time.NewTicker(30 * time.Second)
 	go e.runHealthCheck(ctx)
 
+	// Start sampling throughput
+	go e.shaper.Run(ctx)
+
 	// Start server
 	go func() {
 		if err := e.server.Serve(listener); err != nil && err != http.ErrServerClosed {
@@ -263,14 +350,14 @@ func (e *Engine) setupProxyHandlers() {
 			if leaf, err := x509.ParseCertificate(ca.Certificate[0]); err == nil {
 				ca.Leaf = leaf
 				goproxy.GoproxyCa = ca
-				e.proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+				e.proxy.OnRequest().HandleConnectFunc(e.handleConnect)
 			}
 		}
 	}
 
 	if goproxy.GoproxyCa.Leaf == nil {
 		// Fallback to default if custom fails
-		e.proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		e.proxy.OnRequest().HandleConnectFunc(e.handleConnect)
 	}
 
 	// Handle HTTP requests
@@ -294,9 +381,40 @@ func (e *Engine) setupProxyHandlers() {
 
 			start := time.Now()
 
-			// Billing: Check Quota
+			// Billing: Check Quota of the connection's own user; the local
+			// user when the client did not authenticate
+			userID, _ := proxyUser(ctx)
 			if e.billingManager != nil {
-				if err := e.billingManager.CanAcceptConnection(); err != nil {
+				protocol := "http"
+				if req.URL.Scheme == "https" {
+					protocol = "https"
+				}
+				if err := e.billingManager.Entitlements().CheckProtocol(userID, protocol); err != nil {
+					return NewBlockedResponse(
+						req,
+						"Upgrade Required",
+						"🔒",
+						"Your plan does not include "+strings.ToUpper(protocol)+" proxying. Upgrade now to unlock it.",
+						"Upgrade Plan",
+						http.StatusForbidden,
+					), nil
+				}
+				country, err := e.billingManager.ExitCountry(userID, proxyCountry(ctx))
+				if err != nil {
+					return NewBlockedResponse(
+						req,
+						"Country Not Allowed",
+						"🌍",
+						"Your account can not use this exit country. "+err.Error()+".",
+						"Upgrade Plan",
+						http.StatusForbidden,
+					), nil
+				}
+				if country != "" {
+					req = req.WithContext(context.WithValue(req.Context(), countryKey{}, country))
+				}
+				release, err := e.billingManager.OpenConnection(userID)
+				if err != nil {
 					// Serve intercept page instead of error
 					return NewBlockedResponse(
 						req,
@@ -307,10 +425,22 @@ func (e *Engine) setupProxyHandlers() {
 						http.StatusTooManyRequests,
 					), nil
 				}
-				e.billingManager.Usage.AddRequest()
+				defer release()
+			}
+
+			// Bandwidth & Billing: the request and its response are a flow of
+			// the user, counted as their bodies pass
+			flow := e.shaper.Open(userID)
+			if req.Body != nil {
+				req.Body = flow.Body(req.Body, Upload)
 			}
 
 			resp, err := e.transport.RoundTrip(req)
+			if resp != nil && resp.Body != nil {
+				resp.Body = flow.Body(resp.Body, Download)
+			} else {
+				flow.Close()
+			}
 
 			// Metrics: Duration
 			mon.RequestDuration.Observe(time.Since(start).Seconds())
@@ -326,19 +456,6 @@ func (e *Engine) setupProxyHandlers() {
 				}
 			}
 
-			// Billing & Metrics: Track Bytes
-			if resp != nil {
-				size := resp.ContentLength
-				if size <= 0 {
-					size = 5120 // 5KB estimate for chunks/dynamic
-				}
-
-				if e.billingManager != nil {
-					e.billingManager.Usage.AddData(size)
-				}
-				mon.ProcessedBytes.Add(float64(size))
-			}
-
 			return resp, err
 		})
 
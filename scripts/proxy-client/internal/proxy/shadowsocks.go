@@ -22,11 +22,15 @@ var bufPool = sync.Pool{
 	},
 }
 
+// ShadowsocksServer is the local Shadowsocks listener. Its clients share one
+// password and so can not be told apart: every connection is the local
+// user's, and the listener only accepts connections from this machine.
 type ShadowsocksServer struct {
 	listenAddr     string
 	cipher         core.Cipher
 	oxylabs        *oxylabs.Client
 	billingManager *billing.Manager
+	shaper         *Shaper
 	logger         *logrus.Logger
 }
 
@@ -86,23 +90,20 @@ func (s *ShadowsocksServer) handleConnection(conn net.Conn) {
 	// Shadowsocks2 handles this via Dial logic usually, but here we are a server.
 	// We need to act as a target for SS clients.
 
-	// Check Billing Premium Tier
+	// Check Billing Premium Tier. Shadowsocks clients share the server
+	// password, so connections are billed to the local user.
 	if s.billingManager != nil {
-		sub := s.billingManager.GetSubscription()
-		plan, _ := billing.GetPlan(sub.PlanID)
-
-		// Logic: Shadowsocks is only for Pro and above
-		// Logic: Shadowsocks is only for Pro and above
-		if plan.ID != billing.PlanPersonal && plan.ID != billing.PlanTeam && plan.ID != billing.PlanEnterprise {
-			s.logger.Warn("Shadowsocks access denied: Premium plan required")
+		if err := s.billingManager.Entitlements().CheckProtocol("", "shadowsocks"); err != nil {
+			s.logger.Warnf("Shadowsocks access denied: %v", err)
 			return
 		}
 
-		if err := s.billingManager.CanAcceptConnection(); err != nil {
+		release, err := s.billingManager.OpenConnection("")
+		if err != nil {
 			s.logger.Warnf("Shadowsocks quota check failed: %v", err)
 			return
 		}
-		s.billingManager.Usage.AddRequest()
+		defer release()
 	}
 
 	// We'll use the shadowsocks2 core logic for handling the upstream dial.
@@ -134,6 +135,9 @@ func (s *ShadowsocksServer) handleConnection(conn net.Conn) {
 		s.logger.Errorf("Failed to dial upstream for %s: %v", target, err)
 		return
 	}
+	if s.shaper != nil {
+		upstream = s.shaper.Open("").Conn(upstream)
+	}
 	defer upstream.Close()
 
 	// Relay with Pooled Buffers
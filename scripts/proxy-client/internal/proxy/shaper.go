@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	mon "github.com/atlanticproxy/proxy-client/internal/monitor"
+	"golang.org/x/time/rate"
+)
+
+// Direction is which way traffic flows through the proxy
+type Direction int
+
+const (
+	Upload   Direction = iota // from the client to the target
+	Download                  // from the target to the client
+)
+
+func (d Direction) String() string {
+	if d == Upload {
+		return "upload"
+	}
+	return "download"
+}
+
+// BandwidthSource tells the shaper how fast a user's traffic may go
+type BandwidthSource interface {
+	Bandwidth(userID string) billing.Bandwidth
+}
+
+// Meter counts the traffic of users towards their usage and tells when
+// they have no data left
+type Meter interface {
+	RecordData(userID string, bytes int64)
+	CheckData(userID string) error
+}
+
+// Limits overrides the bandwidth of a user's plan, in kbps each way. Zero
+// is unlimited.
+type Limits struct {
+	UserKbps       int `json:"user_kbps"`
+	ConnectionKbps int `json:"connection_kbps"`
+}
+
+// ShaperConfig configures the bandwidth shaper
+type ShaperConfig struct {
+	// Interval is how often throughput is sampled and limits are refreshed
+	Interval time.Duration
+}
+
+// DefaultShaperConfig returns the default shaper configuration
+func DefaultShaperConfig() ShaperConfig {
+	return ShaperConfig{Interval: time.Second}
+}
+
+// Shaper limits the bandwidth of proxy traffic with token buckets: one per
+// user shared by all their connections, and one per connection. Limits come
+// from the user's plan and are refreshed while traffic flows, so a used up
+// throttled quota or a plan change slows down open connections too.
+type Shaper struct {
+	source BandwidthSource
+	meter  Meter
+	cfg    ShaperConfig
+
+	mu        sync.Mutex
+	users     map[string]*userShape
+	overrides map[string]Limits
+}
+
+// userShape is the traffic of one user
+type userShape struct {
+	bandwidth billing.Bandwidth // as applied to the limiters
+	override  bool
+	limiters  [2]*rate.Limiter // by direction
+	flows     map[*Flow]struct{}
+
+	bytes [2]atomic.Int64 // since the last sample
+	rates [2]float64      // bytes per second at the last sample
+}
+
+// NewShaper creates a shaper. Without a source, traffic is only limited by
+// overrides.
+func NewShaper(source BandwidthSource, cfg ShaperConfig) *Shaper {
+	return &Shaper{
+		source:    source,
+		cfg:       cfg,
+		users:     make(map[string]*userShape),
+		overrides: make(map[string]Limits),
+	}
+}
+
+// SetMeter sets where the traffic of every flow is counted. Flows of users
+// with no data left fail, which cuts off their connections. It must be set
+// before traffic flows.
+func (s *Shaper) SetMeter(m Meter) {
+	s.meter = m
+}
+
+// Run samples throughput and refreshes limits every interval until ctx is
+// done
+func (s *Shaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sample(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// Open starts a flow for a connection of a user, or the local user if
+// userID is empty
+func (s *Shaper) Open(userID string) *Flow {
+	b := s.bandwidth(userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[b.UserID]
+	if !ok {
+		u = &userShape{
+			limiters: [2]*rate.Limiter{newLimiter(0), newLimiter(0)},
+			flows:    make(map[*Flow]struct{}),
+		}
+		s.users[b.UserID] = u
+	}
+	s.apply(u, b)
+
+	f := &Flow{shaper: s, user: u, userID: userID}
+	for d := range f.limiters {
+		f.limiters[d] = newLimiter(u.bandwidth.ConnectionKbps)
+	}
+	u.flows[f] = struct{}{}
+	return f
+}
+
+// SetLimits overrides the bandwidth of a user's plan until the service
+// restarts; nil goes back to the plan. Open connections follow at once.
+func (s *Shaper) SetLimits(userID string, l *Limits) {
+	s.mu.Lock()
+	if l == nil {
+		delete(s.overrides, userID)
+	} else {
+		s.overrides[userID] = *l
+	}
+	_, ok := s.users[userID]
+	s.mu.Unlock()
+
+	if ok {
+		b := s.bandwidth(userID)
+		s.mu.Lock()
+		if u, ok := s.users[userID]; ok {
+			s.apply(u, b)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Throughput is the current bandwidth of a user's traffic and how fast it
+// is going
+type Throughput struct {
+	billing.Bandwidth
+	Override     bool    `json:"override"` // limits set by an admin
+	Connections  int     `json:"connections"`
+	UploadRate   float64 `json:"upload_bytes_per_second"`
+	DownloadRate float64 `json:"download_bytes_per_second"`
+}
+
+// Throughput returns the throughput of a user, or the local user if userID
+// is empty
+func (s *Shaper) Throughput(userID string) Throughput {
+	b := s.bandwidth(userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[b.UserID]; ok {
+		return u.throughput()
+	}
+	t := Throughput{Bandwidth: b}
+	if o, ok := s.overrides[b.UserID]; ok {
+		t.UserKbps, t.ConnectionKbps, t.Override = o.UserKbps, o.ConnectionKbps, true
+	}
+	return t
+}
+
+// Throughputs returns the throughput of every user with traffic, busiest
+// first
+func (s *Shaper) Throughputs() []Throughput {
+	s.mu.Lock()
+	list := make([]Throughput, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u.throughput())
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b Throughput) int {
+		return cmp.Or(
+			cmp.Compare(b.UploadRate+b.DownloadRate, a.UploadRate+a.DownloadRate),
+			cmp.Compare(a.UserID, b.UserID),
+		)
+	})
+	return list
+}
+
+// sample works out the throughput of the interval just ended and refreshes
+// the limits of every user with traffic. Users without open connections or
+// traffic are dropped.
+func (s *Shaper) sample(elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	// The plan is looked up without holding the lock
+	fresh := make(map[string]billing.Bandwidth, len(ids))
+	for _, id := range ids {
+		fresh[id] = s.bandwidth(id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, u := range s.users {
+		for d := range u.rates {
+			u.rates[d] = float64(u.bytes[d].Swap(0)) / elapsed.Seconds()
+		}
+		if len(u.flows) == 0 && u.rates[Upload] == 0 && u.rates[Download] == 0 {
+			delete(s.users, id)
+			mon.UserThroughput.DeleteLabelValues(id, Upload.String())
+			mon.UserThroughput.DeleteLabelValues(id, Download.String())
+			continue
+		}
+		if b, ok := fresh[id]; ok {
+			s.apply(u, b)
+		}
+		mon.UserThroughput.WithLabelValues(id, Upload.String()).Set(u.rates[Upload])
+		mon.UserThroughput.WithLabelValues(id, Download.String()).Set(u.rates[Download])
+	}
+}
+
+// bandwidth returns what the plan of a user allows
+func (s *Shaper) bandwidth(userID string) billing.Bandwidth {
+	if s.source == nil {
+		return billing.Bandwidth{UserID: userID}
+	}
+	return s.source.Bandwidth(userID)
+}
+
+// apply sets the limiters of a user and their flows to the bandwidth of
+// their plan, or their override. s.mu must be held.
+func (s *Shaper) apply(u *userShape, b billing.Bandwidth) {
+	o, override := s.overrides[b.UserID]
+	if override {
+		b.UserKbps, b.ConnectionKbps = o.UserKbps, o.ConnectionKbps
+	}
+	if b.UserKbps == u.bandwidth.UserKbps && b.ConnectionKbps == u.bandwidth.ConnectionKbps {
+		u.bandwidth, u.override = b, override
+		return
+	}
+
+	u.bandwidth, u.override = b, override
+	for _, l := range u.limiters {
+		setLimiter(l, b.UserKbps)
+	}
+	for f := range u.flows {
+		for _, l := range f.limiters {
+			setLimiter(l, b.ConnectionKbps)
+		}
+	}
+}
+
+func (u *userShape) throughput() Throughput {
+	return Throughput{
+		Bandwidth:    u.bandwidth,
+		Override:     u.override,
+		Connections:  len(u.flows),
+		UploadRate:   u.rates[Upload],
+		DownloadRate: u.rates[Download],
+	}
+}
+
+// Flow is the shaped traffic of one connection. HTTP requests, including
+// those read from CONNECT tunnels, are a flow each.
+type Flow struct {
+	shaper   *Shaper
+	user     *userShape
+	userID   string           // as opened, counted towards their usage
+	limiters [2]*rate.Limiter // by direction
+	once     sync.Once
+}
+
+// Close ends the flow
+func (f *Flow) Close() {
+	f.once.Do(func() {
+		f.shaper.mu.Lock()
+		delete(f.user.flows, f)
+		f.shaper.mu.Unlock()
+	})
+}
+
+// Body paces a request or response body. Closing a response body ends the
+// flow.
+func (f *Flow) Body(body io.ReadCloser, dir Direction) io.ReadCloser {
+	return &shapedBody{ReadCloser: body, flow: f, dir: dir}
+}
+
+// Conn paces a connection to the target: what is read from it is download,
+// what is written to it upload. Closing it ends the flow.
+func (f *Flow) Conn(c net.Conn) net.Conn {
+	return &shapedConn{Conn: c, flow: f}
+}
+
+// take counts n bytes in direction dir and waits until they may pass
+func (f *Flow) take(dir Direction, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	f.user.bytes[dir].Add(int64(n))
+	mon.ProcessedBytes.Add(float64(n))
+	if m := f.shaper.meter; m != nil {
+		m.RecordData(f.userID, int64(n))
+		if err := m.CheckData(f.userID); err != nil {
+			return err
+		}
+	}
+	if err := waitN(f.limiters[dir], n); err != nil {
+		return err
+	}
+	return waitN(f.user.limiters[dir], n)
+}
+
+type shapedBody struct {
+	io.ReadCloser
+	flow *Flow
+	dir  Direction
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if werr := b.flow.take(b.dir, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (b *shapedBody) Close() error {
+	if b.dir == Download {
+		b.flow.Close()
+	}
+	return b.ReadCloser.Close()
+}
+
+type shapedConn struct {
+	net.Conn
+	flow *Flow
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if werr := c.flow.take(Download, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	if err := c.flow.take(Upload, len(p)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *shapedConn) Close() error {
+	c.flow.Close()
+	return c.Conn.Close()
+}
+
+// newLimiter returns a token bucket for kbps, holding one second of
+// traffic. Zero is unlimited.
+func newLimiter(kbps int) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, 0)
+	setLimiter(l, kbps)
+	return l
+}
+
+func setLimiter(l *rate.Limiter, kbps int) {
+	if kbps <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	bytesPerSecond := kbps * 1000 / 8
+	l.SetBurst(bytesPerSecond)
+	l.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// waitN waits for n tokens, a burst at a time
+func waitN(l *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := n
+		if l.Limit() != rate.Inf {
+			chunk = min(chunk, l.Burst())
+		}
+		if err := l.WaitN(context.Background(), chunk); err != nil {
+			if l.Limit() != rate.Inf && chunk > l.Burst() {
+				continue // lowered meanwhile
+			}
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"golang.org/x/time/rate"
+)
+
+type fakeBandwidth struct {
+	mu    sync.Mutex
+	plans map[string]billing.Bandwidth
+}
+
+func (f *fakeBandwidth) Bandwidth(userID string) billing.Bandwidth {
+	if userID == "" {
+		userID = "local"
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := f.plans[userID]
+	b.UserID = userID
+	return b
+}
+
+func (f *fakeBandwidth) set(userID string, b billing.Bandwidth) {
+	f.mu.Lock()
+	f.plans[userID] = b
+	f.mu.Unlock()
+}
+
+type fakeMeter struct {
+	mu    sync.Mutex
+	bytes map[string]int64
+}
+
+func (m *fakeMeter) RecordData(userID string, bytes int64) {
+	m.mu.Lock()
+	m.bytes[userID] += bytes
+	m.mu.Unlock()
+}
+
+func (m *fakeMeter) CheckData(userID string) error { return nil }
+
+func (m *fakeMeter) used(userID string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes[userID]
+}
+
+func download(t *testing.T, f *Flow, size int) {
+	t.Helper()
+	body := f.Body(io.NopCloser(bytes.NewReader(make([]byte, size))), Download)
+	if n, err := io.Copy(io.Discard, body); err != nil || n != int64(size) {
+		t.Errorf("Expected %d bytes, got %d, %v", size, n, err)
+	}
+	body.Close()
+}
+
+func TestShaperPacesTraffic(t *testing.T) {
+	// 800 kbps is 100,000 bytes a second, a second of which may burst
+	source := &fakeBandwidth{plans: map[string]billing.Bandwidth{
+		"ada": {UserKbps: 800},
+		"bob": {ConnectionKbps: 800},
+	}}
+	shaper := NewShaper(source, DefaultShaperConfig())
+
+	// The user's connections share one bucket
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			download(t, shaper.Open("ada"), 65000)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected 130,000 bytes to take 300ms at 800 kbps, took %v", elapsed)
+	}
+
+	// Each connection has its own
+	start = time.Now()
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			download(t, shaper.Open("bob"), 65000)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Expected connections within their own limit to go at once, took %v", elapsed)
+	}
+}
+
+func TestShaperRuntimeLimits(t *testing.T) {
+	source := &fakeBandwidth{plans: map[string]billing.Bandwidth{}}
+	shaper := NewShaper(source, DefaultShaperConfig())
+
+	flow := shaper.Open("")
+	download(t, flow, 5000)
+	flow = shaper.Open("")
+	if flow.user.limiters[Download].Limit() != rate.Inf {
+		t.Fatal("Expected unlimited bandwidth")
+	}
+
+	// A throttled quota slows down the open connection
+	source.set("local", billing.Bandwidth{UserKbps: 8, ConnectionKbps: 8, Throttled: true})
+	shaper.sample(time.Second)
+	if flow.user.limiters[Download].Limit() != 1000 || flow.limiters[Upload].Limit() != 1000 {
+		t.Errorf("Expected 1,000 bytes a second, got %v", flow.limiters[Upload].Limit())
+	}
+	got := shaper.Throughput("")
+	if got.UserID != "local" || got.DownloadRate != 5000 || got.Connections != 1 || !got.Throttled {
+		t.Errorf("Unexpected throughput: %+v", got)
+	}
+
+	// An admin override wins over the plan until it is cleared
+	shaper.SetLimits("local", &Limits{UserKbps: 16})
+	if flow.user.limiters[Download].Limit() != 2000 || flow.limiters[Download].Limit() != rate.Inf {
+		t.Errorf("Expected the override, got %v", flow.user.limiters[Download].Limit())
+	}
+	if got := shaper.Throughputs(); len(got) != 1 || !got[0].Override || got[0].UserKbps != 16 {
+		t.Errorf("Expected the override listed, got %+v", got)
+	}
+	shaper.SetLimits("local", nil)
+	if flow.user.limiters[Download].Limit() != 1000 {
+		t.Errorf("Expected the plan's bandwidth back, got %v", flow.user.limiters[Download].Limit())
+	}
+
+	// Users without traffic are dropped
+	flow.Close()
+	shaper.sample(time.Second)
+	if got := shaper.Throughputs(); len(got) != 0 {
+		t.Errorf("Expected no users with traffic, got %+v", got)
+	}
+}
+
+func TestShaperMetersTraffic(t *testing.T) {
+	meter := &fakeMeter{bytes: make(map[string]int64)}
+	shaper := NewShaper(nil, DefaultShaperConfig())
+	shaper.SetMeter(meter)
+
+	// Bodies count what is read of them, in both directions
+	flow := shaper.Open("ada")
+	upload := flow.Body(io.NopCloser(bytes.NewReader(make([]byte, 300))), Upload)
+	io.Copy(io.Discard, upload)
+	download(t, flow, 7000)
+	if got := meter.used("ada"); got != 7300 {
+		t.Errorf("Expected 7,300 bytes counted, got %d", got)
+	}
+
+	// Connections count what is read from and written to the target
+	client, target := net.Pipe()
+	conn := shaper.Open("").Conn(client)
+	go func() {
+		buf := make([]byte, 100)
+		io.ReadFull(target, buf)
+		target.Write(make([]byte, 2000))
+		target.Close()
+	}()
+	conn.Write(make([]byte, 100))
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	if got := meter.used(""); got != 2100 {
+		t.Errorf("Expected 2,100 bytes counted for the local user, got %d", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/armon/go-socks5"
 	"github.com/atlanticproxy/proxy-client/internal/billing"
@@ -17,19 +18,37 @@ type Socks5Server struct {
 	listenAddr     string
 	oxylabs        *oxylabs.Client
 	billingManager *billing.Manager
+	shaper         *Shaper
 	logger         *logrus.Logger
+
+	// dialUpstream connects to addr through the exit country's upstream
+	dialUpstream func(ctx context.Context, network, addr, country string) (net.Conn, error)
+
+	mu        sync.RWMutex
+	validator CredentialValidator
 }
 
-func NewSocks5Server(listenAddr string, ox *oxylabs.Client, bm *billing.Manager) (*Socks5Server, error) {
+// NewSocks5Server creates the local SOCKS5 listener. Clients may authenticate
+// with username/password credentials checked by the CredentialValidator; if
+// requireAuth is set, unauthenticated clients are refused.
+func NewSocks5Server(listenAddr string, ox *oxylabs.Client, bm *billing.Manager, requireAuth bool) (*Socks5Server, error) {
 	s := &Socks5Server{
 		listenAddr:     listenAddr,
 		oxylabs:        ox,
 		billingManager: bm,
 		logger:         logrus.StandardLogger(),
 	}
+	s.dialUpstream = s.dialOxylabs
+
+	authMethods := []socks5.Authenticator{socks5CredentialAuth{server: s}}
+	if !requireAuth {
+		authMethods = append(authMethods, socks5.NoAuthAuthenticator{})
+	}
 
 	conf := &socks5.Config{
-		Dial: s.Dial,
+		AuthMethods: authMethods,
+		Rules:       socks5UserRules{},
+		Dial:        s.Dial,
 	}
 
 	server, err := socks5.New(conf)
@@ -41,17 +60,59 @@ func NewSocks5Server(listenAddr string, ox *oxylabs.Client, bm *billing.Manager)
 	return s, nil
 }
 
+// SetCredentialValidator sets the validator for client credentials
+func (s *Socks5Server) SetCredentialValidator(v CredentialValidator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.validator = v
+}
+
+func (s *Socks5Server) credentialValidator() CredentialValidator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.validator
+}
+
 func (s *Socks5Server) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
-	// Billing check
+	// Billing check against the authenticated user, or the local user
+	userID, _ := UserIDFromContext(ctx)
+	release := func() {}
 	if s.billingManager != nil {
-		if err := s.billingManager.CanAcceptConnection(); err != nil {
+		if err := s.billingManager.Entitlements().CheckProtocol(userID, "socks5"); err != nil {
+			return nil, err
+		}
+		r, err := s.billingManager.OpenConnection(userID)
+		if err != nil {
 			return nil, err
 		}
-		s.billingManager.Usage.AddRequest()
+		release = r
 	}
 
-	// Dial via Oxylabs upstream SOCKS5
-	proxyURL, err := s.oxylabs.GetProxy(ctx)
+	// Dial upstream, in the country the client asked for
+	// or is restricted to
+	country, _ := CountryFromContext(ctx)
+	if s.billingManager != nil {
+		c, err := s.billingManager.ExitCountry(userID, country)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		country = c
+	}
+	conn, err := s.dialUpstream(ctx, network, addr, country)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if s.shaper != nil {
+		conn = s.shaper.Open(userID).Conn(conn)
+	}
+	return &releaseConn{Conn: conn, release: release}, nil
+}
+
+// dialOxylabs connects to addr through an Oxylabs upstream SOCKS5 proxy
+func (s *Socks5Server) dialOxylabs(ctx context.Context, network, addr, country string) (net.Conn, error) {
+	proxyURL, err := s.oxylabs.GetProxyWithConfig(ctx, oxylabs.ProxyConfig{Country: country})
 	if err != nil {
 		return nil, err
 	}
@@ -69,10 +130,20 @@ func (s *Socks5Server) Dial(ctx context.Context, network, addr string) (net.Conn
 	if err != nil {
 		return nil, fmt.Errorf("failed to create upstream socks5 dialer: %w", err)
 	}
-
 	return dialer.Dial(network, addr)
 }
 
+// releaseConn frees the user's connection slot when the connection closes
+type releaseConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *releaseConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
 func (s *Socks5Server) Start(ctx context.Context) error {
 	fmt.Printf("Starting SOCKS5 server on %s...\n", s.listenAddr)
 	return s.server.ListenAndServe("tcp", s.listenAddr)
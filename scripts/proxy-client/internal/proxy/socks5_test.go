@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
+	"golang.org/x/net/proxy"
+)
+
+func TestSocks5CutsOffCappedSubUser(t *testing.T) {
+	store, err := storage.NewStoreWithPath(filepath.Join(t.TempDir(), "proxy.db"))
+	if err != nil {
+		t.Fatalf("NewStoreWithPath failed: %v", err)
+	}
+	defer store.Close()
+	if err := store.CreateUser("rita", "rita@example.com", "hash"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	bm := billing.NewManager(store)
+	bm.SetSubUsers(billing.NewSubUsers(store))
+	if _, err := bm.Subscribe("rita", billing.PlanEnterprise); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	sub, password, err := bm.CreateSubUser("rita", billing.SubUserRequest{DataLimitMB: 1})
+	if err != nil {
+		t.Fatalf("CreateSubUser failed: %v", err)
+	}
+
+	// The target sends more than the sub-user may use
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(make([]byte, 4*1024*1024))
+			}()
+		}
+	}()
+
+	s, err := NewSocks5Server("127.0.0.1:0", nil, bm, true)
+	if err != nil {
+		t.Fatalf("NewSocks5Server failed: %v", err)
+	}
+	s.SetCredentialValidator(validatorFunc(bm.ValidateSubUser))
+	s.shaper = NewShaper(bm, DefaultShaperConfig())
+	s.shaper.SetMeter(bm)
+	s.dialUpstream = func(ctx context.Context, network, addr, country string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go s.server.Serve(listener)
+
+	dialer, err := proxy.SOCKS5("tcp", listener.Addr().String(), &proxy.Auth{User: sub.Username, Password: password}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected the sub-user to connect, got %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	n, _ := io.Copy(io.Discard, conn)
+	conn.Close()
+	if n < 1024*1024 || n >= 4*1024*1024 {
+		t.Errorf("Expected the connection cut off past 1 MB, got %d bytes", n)
+	}
+	if used := bm.GetUsage("rita").DataTransferred; used < 1024*1024 {
+		t.Errorf("Expected the traffic billed on the parent, got %d bytes", used)
+	}
+
+	// The used up sub-user can not connect again
+	if conn, err := dialer.Dial("tcp", target.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("Expected the capped sub-user to be refused")
+	}
+}
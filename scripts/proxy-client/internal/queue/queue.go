@@ -0,0 +1,336 @@
+// Package queue processes stored work in the background: incoming webhook
+// events and scheduled jobs. Work is persisted before it is processed, so it
+// survives restarts, is retried with backoff when it fails, and ends up dead
+// for an operator to inspect and replay once it has failed too often.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Processing states of events and jobs
+const (
+	StatusPending   = "pending" // waiting for its first or next attempt
+	StatusProcessed = "processed"
+	StatusDead      = "dead" // failed permanently or too often
+)
+
+// Event is a webhook delivery as received from a payment provider
+type Event struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	Type     string `json:"type"`
+	// Key identifies the event at the provider. A second delivery with the
+	// same provider and key is a duplicate and is dropped.
+	Key           string          `json:"key"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	ProcessedAt   *time.Time      `json:"processed_at,omitempty"`
+}
+
+// Job is an action scheduled for later, such as a deposit refund
+type Job struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Key makes scheduling idempotent: a job with the kind and key of an
+	// existing job is not scheduled again
+	Key           string          `json:"key"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	RunAt         time.Time       `json:"run_at"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	ProcessedAt   *time.Time      `json:"processed_at,omitempty"`
+}
+
+// Store is the persistence of events and jobs. Claims reserve an item until
+// the given time, so only one worker processes it even with several API
+// instances.
+type Store interface {
+	RecordWebhookEvent(e *Event) (bool, error)
+	GetWebhookEvent(id string) (*Event, error)
+	ListWebhookEvents(status string, limit, offset int) ([]*Event, int, error)
+	ListDueWebhookEvents(now time.Time, limit int) ([]*Event, error)
+	ClaimWebhookEvent(id string, now, until time.Time) (bool, error)
+	UpdateWebhookEvent(e *Event) error
+
+	CreateJob(j *Job) (bool, error)
+	ListDueJobs(now time.Time, limit int) ([]*Job, error)
+	ClaimJob(id string, now, until time.Time) (bool, error)
+	UpdateJob(j *Job) error
+}
+
+// EventHandler processes the events of one provider
+type EventHandler func(e *Event) error
+
+// JobHandler runs the jobs of one kind
+type JobHandler func(j *Job) error
+
+// permanentError marks a failure that retrying will not fix
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error so that the item goes dead without retries
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Config sets the processing schedule
+type Config struct {
+	Interval    time.Duration `yaml:"interval"`     // how often due work is looked for
+	RetryDelay  time.Duration `yaml:"retry_delay"`  // first retry; doubles with every attempt
+	MaxAttempts int           `yaml:"max_attempts"` // attempts before an item goes dead
+	BatchSize   int           `yaml:"batch_size"`
+}
+
+// DefaultConfig returns the schedule used when none is configured
+func DefaultConfig() Config {
+	return Config{
+		Interval:    10 * time.Second,
+		RetryDelay:  time.Minute,
+		MaxAttempts: 8,
+		BatchSize:   50,
+	}
+}
+
+// maxRetryDelay caps the backoff between attempts
+const maxRetryDelay = 6 * time.Hour
+
+// claimFor is how long an attempt holds its claim
+const claimFor = 5 * time.Minute
+
+// Worker processes due events and jobs with the registered handlers
+type Worker struct {
+	store  Store
+	cfg    Config
+	events map[string]EventHandler
+	jobs   map[string]JobHandler
+	wake   chan struct{}
+	logger *logrus.Logger
+}
+
+// NewWorker creates a worker. Handlers are registered before Run.
+func NewWorker(store Store, cfg Config) *Worker {
+	d := DefaultConfig()
+	if cfg.Interval <= 0 {
+		cfg.Interval = d.Interval
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = d.RetryDelay
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = d.MaxAttempts
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = d.BatchSize
+	}
+	return &Worker{
+		store:  store,
+		cfg:    cfg,
+		events: make(map[string]EventHandler),
+		jobs:   make(map[string]JobHandler),
+		wake:   make(chan struct{}, 1),
+		logger: logrus.StandardLogger(),
+	}
+}
+
+// HandleEvents registers the handler for the events of a provider
+func (w *Worker) HandleEvents(provider string, h EventHandler) {
+	w.events[provider] = h
+}
+
+// HandleJobs registers the handler for a kind of job
+func (w *Worker) HandleJobs(kind string, h JobHandler) {
+	w.jobs[kind] = h
+}
+
+// Receive stores a webhook event for processing. It reports false for a
+// duplicate delivery, which is dropped.
+func (w *Worker) Receive(provider, eventType, key string, payload []byte) (bool, error) {
+	now := time.Now().UTC()
+	recorded, err := w.store.RecordWebhookEvent(&Event{
+		ID:            uuid.New().String(),
+		Provider:      provider,
+		Type:          eventType,
+		Key:           key,
+		Payload:       payload,
+		Status:        StatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook event: %w", err)
+	}
+	if recorded {
+		w.Wake()
+	}
+	return recorded, nil
+}
+
+// Schedule stores a job to run at runAt. It reports false if a job of the
+// same kind and key already exists.
+func (w *Worker) Schedule(kind, key string, payload any, runAt time.Time) (bool, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	return w.store.CreateJob(&Job{
+		ID:            uuid.New().String(),
+		Kind:          kind,
+		Key:           key,
+		Payload:       data,
+		Status:        StatusPending,
+		RunAt:         runAt.UTC(),
+		NextAttemptAt: runAt.UTC(),
+		CreatedAt:     now,
+	})
+}
+
+// Replay processes an event again, whatever its state
+func (w *Worker) Replay(id string) (*Event, error) {
+	e, err := w.store.GetWebhookEvent(id)
+	if err != nil {
+		return nil, err
+	}
+	e.Status = StatusPending
+	e.Attempts = 0
+	e.LastError = ""
+	e.NextAttemptAt = time.Now().UTC()
+	if err := w.store.UpdateWebhookEvent(e); err != nil {
+		return nil, err
+	}
+	w.Wake()
+	return e, nil
+}
+
+// Events returns a page of stored events, newest first, optionally only
+// those in a state, and the total number of them
+func (w *Worker) Events(status string, limit, offset int) ([]*Event, int, error) {
+	return w.store.ListWebhookEvents(status, limit, offset)
+}
+
+// Wake makes Run look for due work now instead of at the next interval
+func (w *Worker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes due work every interval, or when woken, until ctx is done
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Process(time.Now()); err != nil {
+			w.logger.Errorf("Queue run failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// Process runs the events and jobs due at now
+func (w *Worker) Process(now time.Time) error {
+	events, err := w.store.ListDueWebhookEvents(now, w.cfg.BatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to list webhook events: %w", err)
+	}
+	for _, e := range events {
+		if err := w.processEvent(e, now); err != nil {
+			w.logger.Errorf("Failed to update webhook event %s: %v", e.ID, err)
+		}
+	}
+
+	jobs, err := w.store.ListDueJobs(now, w.cfg.BatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %w", err)
+	}
+	for _, j := range jobs {
+		if err := w.processJob(j, now); err != nil {
+			w.logger.Errorf("Failed to update job %s: %v", j.ID, err)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) processEvent(e *Event, now time.Time) error {
+	claimed, err := w.store.ClaimWebhookEvent(e.ID, now, now.Add(claimFor))
+	if err != nil || !claimed {
+		return err
+	}
+
+	h, ok := w.events[e.Provider]
+	if !ok {
+		err = Permanent(fmt.Errorf("no handler for %s events", e.Provider))
+	} else {
+		err = h(e)
+	}
+	e.Status, e.Attempts, e.LastError, e.NextAttemptAt, e.ProcessedAt = w.outcome(e.Attempts, err, now)
+	if e.Status == StatusDead {
+		w.logger.Errorf("Webhook event %s (%s %s) is dead after %d attempts: %v", e.ID, e.Provider, e.Type, e.Attempts, err)
+	} else if err != nil {
+		w.logger.Warnf("Webhook event %s (%s %s) failed, retrying: %v", e.ID, e.Provider, e.Type, err)
+	}
+	return w.store.UpdateWebhookEvent(e)
+}
+
+func (w *Worker) processJob(j *Job, now time.Time) error {
+	claimed, err := w.store.ClaimJob(j.ID, now, now.Add(claimFor))
+	if err != nil || !claimed {
+		return err
+	}
+
+	h, ok := w.jobs[j.Kind]
+	if !ok {
+		err = Permanent(fmt.Errorf("no handler for %s jobs", j.Kind))
+	} else {
+		err = h(j)
+	}
+	j.Status, j.Attempts, j.LastError, j.NextAttemptAt, j.ProcessedAt = w.outcome(j.Attempts, err, now)
+	if j.Status == StatusDead {
+		w.logger.Errorf("Job %s (%s) is dead after %d attempts: %v", j.ID, j.Kind, j.Attempts, err)
+	} else if err != nil {
+		w.logger.Warnf("Job %s (%s) failed, retrying: %v", j.ID, j.Kind, err)
+	}
+	return w.store.UpdateJob(j)
+}
+
+// outcome is the state of an item after an attempt that ended in err
+func (w *Worker) outcome(attempts int, err error, now time.Time) (status string, n int, lastError string, next time.Time, processedAt *time.Time) {
+	n = attempts + 1
+	if err == nil {
+		return StatusProcessed, n, "", now, &now
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || n >= w.cfg.MaxAttempts {
+		return StatusDead, n, err.Error(), now, nil
+	}
+	delay := w.cfg.RetryDelay << (n - 1)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return StatusPending, n, err.Error(), now.Add(delay), nil
+}
@@ -0,0 +1,311 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore keeps events and jobs in memory
+type memoryStore struct {
+	mu     sync.Mutex
+	events map[string]*Event
+	jobs   map[string]*Job
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{events: make(map[string]*Event), jobs: make(map[string]*Job)}
+}
+
+func (s *memoryStore) RecordWebhookEvent(e *Event) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.events {
+		if existing.Provider == e.Provider && existing.Key == e.Key {
+			return false, nil
+		}
+	}
+	copied := *e
+	s.events[e.ID] = &copied
+	return true, nil
+}
+
+func (s *memoryStore) GetWebhookEvent(id string) (*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.events[id]
+	if !ok {
+		return nil, fmt.Errorf("webhook event %s not found", id)
+	}
+	copied := *e
+	return &copied, nil
+}
+
+func (s *memoryStore) ListWebhookEvents(status string, limit, offset int) ([]*Event, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []*Event
+	for _, e := range s.events {
+		if status == "" || e.Status == status {
+			copied := *e
+			events = append(events, &copied)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt.After(events[j].CreatedAt) })
+	total := len(events)
+	if offset > total {
+		offset = total
+	}
+	events = events[offset:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, total, nil
+}
+
+func (s *memoryStore) ListDueWebhookEvents(now time.Time, limit int) ([]*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []*Event
+	for _, e := range s.events {
+		if e.Status == StatusPending && !e.NextAttemptAt.After(now) && len(events) < limit {
+			copied := *e
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) ClaimWebhookEvent(id string, now, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.events[id]
+	if !ok || e.Status != StatusPending || e.NextAttemptAt.After(now) {
+		return false, nil
+	}
+	e.NextAttemptAt = until
+	return true, nil
+}
+
+func (s *memoryStore) UpdateWebhookEvent(e *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *e
+	s.events[e.ID] = &copied
+	return nil
+}
+
+func (s *memoryStore) CreateJob(j *Job) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.jobs {
+		if existing.Kind == j.Kind && existing.Key == j.Key {
+			return false, nil
+		}
+	}
+	copied := *j
+	s.jobs[j.ID] = &copied
+	return true, nil
+}
+
+func (s *memoryStore) ListDueJobs(now time.Time, limit int) ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*Job
+	for _, j := range s.jobs {
+		if j.Status == StatusPending && !j.NextAttemptAt.After(now) && len(jobs) < limit {
+			copied := *j
+			jobs = append(jobs, &copied)
+		}
+	}
+	return jobs, nil
+}
+
+func (s *memoryStore) ClaimJob(id string, now, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.Status != StatusPending || j.NextAttemptAt.After(now) {
+		return false, nil
+	}
+	j.NextAttemptAt = until
+	return true, nil
+}
+
+func (s *memoryStore) UpdateJob(j *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *j
+	s.jobs[j.ID] = &copied
+	return nil
+}
+
+func (s *memoryStore) onlyEvent(t *testing.T) *Event {
+	t.Helper()
+	events, total, _ := s.ListWebhookEvents("", 10, 0)
+	if total != 1 {
+		t.Fatalf("Expected 1 event, got %d", total)
+	}
+	return events[0]
+}
+
+func TestReceiveDropsDuplicates(t *testing.T) {
+	store := newMemoryStore()
+	w := NewWorker(store, Config{})
+
+	handled := 0
+	w.HandleEvents("paystack", func(e *Event) error {
+		handled++
+		return nil
+	})
+
+	for i, want := range []bool{true, false} {
+		recorded, err := w.Receive("paystack", "charge.success", "charge.success:REF-1", []byte(`{}`))
+		if err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+		if recorded != want {
+			t.Errorf("Delivery %d: expected recorded=%v, got %v", i+1, want, recorded)
+		}
+	}
+
+	if err := w.Process(time.Now()); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if err := w.Process(time.Now()); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if handled != 1 {
+		t.Errorf("Expected the event to be handled once, got %d", handled)
+	}
+	if e := store.onlyEvent(t); e.Status != StatusProcessed || e.ProcessedAt == nil {
+		t.Errorf("Expected a processed event, got %+v", e)
+	}
+}
+
+func TestFailedEventsAreRetriedThenDead(t *testing.T) {
+	store := newMemoryStore()
+	w := NewWorker(store, Config{RetryDelay: time.Minute, MaxAttempts: 3})
+	w.HandleEvents("paystack", func(e *Event) error { return errors.New("database is locked") })
+
+	if _, err := w.Receive("paystack", "charge.success", "charge.success:REF-1", []byte(`{}`)); err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+
+	now := time.Now()
+	w.Process(now)
+	e := store.onlyEvent(t)
+	if e.Status != StatusPending || e.Attempts != 1 || e.LastError != "database is locked" {
+		t.Fatalf("Expected a pending event after one failure, got %+v", e)
+	}
+	if want := now.Add(time.Minute); !e.NextAttemptAt.Equal(want) {
+		t.Errorf("Expected the retry at %v, got %v", want, e.NextAttemptAt)
+	}
+
+	// Not yet due
+	w.Process(now.Add(30 * time.Second))
+	if e := store.onlyEvent(t); e.Attempts != 1 {
+		t.Errorf("Expected no attempt before the retry is due, got %d", e.Attempts)
+	}
+
+	now = now.Add(time.Minute)
+	w.Process(now)
+	if e := store.onlyEvent(t); e.Attempts != 2 || !e.NextAttemptAt.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("Expected the delay to double, got %+v", e)
+	}
+
+	w.Process(now.Add(2 * time.Minute))
+	if e := store.onlyEvent(t); e.Status != StatusDead || e.Attempts != 3 {
+		t.Errorf("Expected a dead event after 3 attempts, got %+v", e)
+	}
+}
+
+func TestPermanentFailuresGoDeadAndCanBeReplayed(t *testing.T) {
+	store := newMemoryStore()
+	w := NewWorker(store, Config{})
+
+	fixed := false
+	w.HandleEvents("paystack", func(e *Event) error {
+		if !fixed {
+			return Permanent(errors.New("could not identify user"))
+		}
+		return nil
+	})
+
+	if _, err := w.Receive("paystack", "charge.success", "charge.success:REF-1", []byte(`{}`)); err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	w.Process(time.Now())
+	e := store.onlyEvent(t)
+	if e.Status != StatusDead || e.Attempts != 1 {
+		t.Fatalf("Expected a dead event after a permanent failure, got %+v", e)
+	}
+
+	dead, total, _ := w.Events(StatusDead, 10, 0)
+	if total != 1 || dead[0].ID != e.ID {
+		t.Errorf("Expected the event in the dead list, got %d", total)
+	}
+
+	fixed = true
+	if _, err := w.Replay(e.ID); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	w.Process(time.Now())
+	if e := store.onlyEvent(t); e.Status != StatusProcessed {
+		t.Errorf("Expected the replayed event to be processed, got %+v", e)
+	}
+
+	if _, err := w.Replay("missing"); err == nil {
+		t.Error("Expected an error replaying an unknown event")
+	}
+}
+
+func TestEventsWithoutHandlerGoDead(t *testing.T) {
+	store := newMemoryStore()
+	w := NewWorker(store, Config{})
+
+	if _, err := w.Receive("unknown", "ping", "ping:1", []byte(`{}`)); err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	w.Process(time.Now())
+	if e := store.onlyEvent(t); e.Status != StatusDead {
+		t.Errorf("Expected a dead event, got %+v", e)
+	}
+}
+
+func TestScheduledJobs(t *testing.T) {
+	store := newMemoryStore()
+	w := NewWorker(store, Config{})
+
+	var ran []string
+	w.HandleJobs("deposit_refund", func(j *Job) error {
+		ran = append(ran, string(j.Payload))
+		return nil
+	})
+
+	now := time.Now()
+	runAt := now.Add(7 * 24 * time.Hour)
+	for i, want := range []bool{true, false} {
+		created, err := w.Schedule("deposit_refund", "subscription.disable:SUB-1", map[string]string{"user_id": "user-1"}, runAt)
+		if err != nil {
+			t.Fatalf("Schedule failed: %v", err)
+		}
+		if created != want {
+			t.Errorf("Schedule %d: expected created=%v, got %v", i+1, want, created)
+		}
+	}
+
+	w.Process(now)
+	if len(ran) != 0 {
+		t.Fatalf("Expected the job to wait until it is due, ran %v", ran)
+	}
+
+	w.Process(runAt)
+	w.Process(runAt.Add(time.Hour))
+	if len(ran) != 1 || ran[0] != `{"user_id":"user-1"}` {
+		t.Errorf("Expected the job to run once with its payload, ran %v", ran)
+	}
+}
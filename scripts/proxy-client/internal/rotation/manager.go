@@ -31,6 +31,8 @@ type Manager struct {
 	currentSession *Session
 	analytics      *AnalyticsManager
 	stopChan       chan struct{}
+	// allow vets a configuration against the user's plan before it is applied
+	allow func(RotationConfig) error
 }
 
 // NewManager creates a new rotation manager with default settings
@@ -44,6 +46,19 @@ func NewManager(analytics *AnalyticsManager) *Manager {
 	}
 }
 
+// SetEntitlementCheck sets the check that a configuration is included in the
+// user's plan. Without one every valid configuration is allowed.
+func (m *Manager) SetEntitlementCheck(check func(RotationConfig) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.allow = check
+}
+
+// Sticky reports whether the mode keeps the same IP across requests
+func (mode RotationMode) Sticky() bool {
+	return mode != ModePerRequest
+}
+
 // SetMode updates the rotation mode and triggers a rotation if needed
 func (m *Manager) SetMode(mode RotationMode) error {
 	m.mu.Lock()
@@ -52,11 +67,19 @@ func (m *Manager) SetMode(mode RotationMode) error {
 	// Validate mode
 	switch mode {
 	case ModePerRequest, ModeSticky1Min, ModeSticky10Min, ModeSticky30Min:
-		m.config.Mode = mode
 	default:
 		return errors.New("invalid rotation mode")
 	}
 
+	config := m.config
+	config.Mode = mode
+	if m.allow != nil {
+		if err := m.allow(config); err != nil {
+			return err
+		}
+	}
+	m.config.Mode = mode
+
 	// Force a new session when mode changes
 	return m.forceRotationLocked()
 }
@@ -131,6 +154,11 @@ func (m *Manager) UpdateConfig(config RotationConfig) error {
 	default:
 		return errors.New("invalid rotation mode")
 	}
+	if m.allow != nil {
+		if err := m.allow(config); err != nil {
+			return err
+		}
+	}
 
 	m.config = config
 	// Force rotation to apply new geo settings immediately
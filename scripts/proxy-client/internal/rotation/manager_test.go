@@ -1,6 +1,7 @@
 package rotation
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
@@ -77,3 +78,27 @@ func TestManagerRotation(t *testing.T) {
 		t.Error("Session ID should change after rotation")
 	}
 }
+
+func TestEntitlementCheck(t *testing.T) {
+	manager := NewManager(nil)
+	denied := errors.New("not in plan")
+	manager.SetEntitlementCheck(func(cfg RotationConfig) error {
+		if cfg.Mode.Sticky() || cfg.Country != "US" {
+			return denied
+		}
+		return nil
+	})
+
+	if err := manager.UpdateConfig(RotationConfig{Mode: ModePerRequest, Country: "US"}); err != nil {
+		t.Fatalf("UpdateConfig failed: %v", err)
+	}
+	if err := manager.UpdateConfig(RotationConfig{Mode: ModePerRequest, Country: "DE"}); err != denied {
+		t.Errorf("Expected the check to deny DE, got %v", err)
+	}
+	if err := manager.SetMode(ModeSticky30Min); err != denied {
+		t.Errorf("Expected the check to deny sticky sessions, got %v", err)
+	}
+	if cfg := manager.GetConfig(); cfg.Mode != ModePerRequest || cfg.Country != "US" {
+		t.Errorf("Expected denied changes to leave the config alone, got %+v", cfg)
+	}
+}
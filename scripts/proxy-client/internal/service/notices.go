@@ -0,0 +1,45 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/mailer"
+)
+
+// subscriptionMailer emails subscription lifecycle and credit notices
+type subscriptionMailer struct {
+	mailer mailer.Mailer
+	appURL string
+}
+
+func (m *subscriptionMailer) NotifySubscription(n *billing.Notice) error {
+	var plan string
+	if n.Subscription != nil {
+		plan = string(n.Subscription.PlanID)
+		if p, err := billing.GetPlanVersion(n.Subscription.PlanID, n.Subscription.PlanVersion); err == nil {
+			plan = p.Name
+		}
+	}
+
+	var msg *mailer.Message
+	switch n.Event {
+	case billing.EventRenewed:
+		msg = mailer.SubscriptionRenewedEmail(n.Email, m.appURL, plan, n.Subscription.EndDate)
+	case billing.EventPaymentFailed:
+		grace := n.Subscription.EndDate
+		if n.Subscription.GraceUntil != nil {
+			grace = *n.Subscription.GraceUntil
+		}
+		msg = mailer.PaymentFailedEmail(n.Email, m.appURL, plan, n.Attempt, grace)
+	case billing.EventExpired:
+		msg = mailer.SubscriptionExpiredEmail(n.Email, m.appURL, plan)
+	case billing.EventLowBalance:
+		msg = mailer.LowBalanceEmail(n.Email, m.appURL, n.Balance)
+	case billing.EventQuotaWarning:
+		msg = mailer.QuotaWarningEmail(n.Email, m.appURL, plan, n.Message, n.Subscription.QuotaMode, n.Subscription.EndDate)
+	default:
+		return fmt.Errorf("unknown subscription event %q", n.Event)
+	}
+	return m.mailer.Send(msg)
+}
@@ -10,11 +10,14 @@ import (
 
 	"github.com/atlanticproxy/proxy-client/internal/adblock"
 	"github.com/atlanticproxy/proxy-client/internal/api"
+	"github.com/atlanticproxy/proxy-client/internal/auth"
 	"github.com/atlanticproxy/proxy-client/internal/billing"
 	"github.com/atlanticproxy/proxy-client/internal/interceptor"
 	"github.com/atlanticproxy/proxy-client/internal/killswitch"
+	"github.com/atlanticproxy/proxy-client/internal/mailer"
 	"github.com/atlanticproxy/proxy-client/internal/monitor"
 	"github.com/atlanticproxy/proxy-client/internal/proxy"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
 	"github.com/atlanticproxy/proxy-client/internal/rotation"
 	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/atlanticproxy/proxy-client/pkg/cert"
@@ -30,10 +33,11 @@ type Service struct {
 	rotationManager  *rotation.Manager
 	analyticsManager *rotation.AnalyticsManager
 	billingManager   *billing.Manager
+	authManager      *auth.Manager
 	monitor          *monitor.NetworkMonitor
 	killswitch       *killswitch.Guardian
 	apiServer        *api.Server
-	storage          *storage.Store
+	storage          storage.Repository
 	otaManager       *OTAManager
 	logger           *logrus.Logger
 }
@@ -78,11 +82,13 @@ func (s *Service) Run(ctx context.Context) error {
 	}
 
 	// Initialize storage
-	s.storage, err = storage.NewStore()
+	s.storage, err = storage.Open(s.config.DatabaseURL)
 	if err != nil {
 		s.logger.Warnf("Failed to initialize persistent storage: %v. Running in-memory mode.", err)
 		// Leave storage as nil - components must handle nil storage gracefully
 		s.storage = nil
+	} else if _, err := billing.LoadCatalogue(s.storage); err != nil {
+		s.logger.Warnf("Failed to load plan catalogue: %v. Using the built-in plans.", err)
 	}
 
 	// Trust Root CA for HTTPS interception
@@ -108,19 +114,44 @@ func (s *Service) Run(ctx context.Context) error {
 	s.rotationManager = rotation.NewManager(s.analyticsManager)
 
 	// Initialize billing manager
-	s.billingManager = billing.NewManager(s.storage)
+	var billingStore billing.Store
+	if s.storage != nil {
+		billingStore = s.storage
+	}
+	s.billingManager = billing.NewManager(billingStore)
+	// Sticky sessions and exit countries are plan features
+	entitlements := s.billingManager.Entitlements()
+	s.rotationManager.SetEntitlementCheck(func(cfg rotation.RotationConfig) error {
+		return entitlements.CheckRotation("", cfg.Mode.Sticky(), cfg.Country)
+	})
+	// Prices are converted at live exchange rates, falling back to the
+	// last rates saved
+	if s.config.Billing != nil {
+		var rateStore billing.RateStore
+		if store, ok := s.storage.(storage.BillingRepository); ok {
+			rateStore = store
+		}
+		rates := billing.NewRateTable(rateStore, s.config.Billing.ExchangeRates)
+		billing.UseExchangeRates(rates)
+		go rates.Run(ctx)
+	}
 	currency := billing.MapRegionToCurrency(region)
 	s.billingManager.SetCurrency(currency)
 	s.logger.Infof("Detected currency: %s", currency)
 
 	// Initialize Payment Providers
+	var renewals billing.RenewalGateway
 	if s.config.Billing != nil && s.config.Billing.PaystackSecretKey != "" {
-		s.billingManager.SetPaystack(billing.NewPaystackProvider(s.config.Billing.PaystackSecretKey))
+		paystack := billing.NewPaystackProvider(s.config.Billing.PaystackSecretKey)
+		s.billingManager.SetPaystack(paystack)
+		renewals = paystack
 	} else {
 		s.logger.Warn("Paystack secret key not found, using placeholder")
 		s.billingManager.SetPaystack(billing.NewPaystackProvider("sk_test_paystack_placeholder"))
 	}
-	s.billingManager.SetCrypto(billing.NewCryptoProvider("now_key_placeholder"))
+	if s.config.Billing != nil && s.config.Billing.Stripe.SecretKey != "" {
+		s.billingManager.SetStripe(billing.NewStripeProvider(s.config.Billing.Stripe))
+	}
 
 	// Initialize proxy engine
 	s.proxy = proxy.NewEngine(s.config.Proxy, s.adblock, s.rotationManager, s.analyticsManager, s.billingManager)
@@ -128,8 +159,110 @@ func (s *Service) Run(ctx context.Context) error {
 	// Initialize network monitor
 	s.monitor = monitor.New(s.config.Monitor)
 
+	// Initialize auth layer
+	var authStore auth.Store
+	if s.storage != nil {
+		authStore = s.storage
+	}
+	s.authManager = auth.NewManager(authStore, auth.Config{
+		Secret:          []byte(s.config.Auth.JWTSecret),
+		AccessTokenTTL:  s.config.Auth.AccessTokenTTL,
+		RefreshTokenTTL: s.config.Auth.RefreshTokenTTL,
+		EncryptionKey:   []byte(s.config.Auth.EncryptionKey),
+		LoginGuard:      s.config.LoginGuard,
+	})
+	// API keys are only honoured while the owner's plan includes API access
+	s.authManager.SetAPIAccessCheck(s.billingManager.CheckAPIAccess)
+	// Other proxy credentials are those of sub-users
+	s.authManager.SetSubUserCheck(s.billingManager.ValidateSubUser)
+	s.proxy.SetCredentialValidator(s.authManager)
+
 	// Initialize API server
-	s.apiServer = api.NewServer(s.adblock, s.killswitch, s.interceptor, s.proxy, s.rotationManager, s.analyticsManager, s.billingManager, s.storage)
+	s.apiServer = api.NewServer(s.adblock, s.killswitch, s.interceptor, s.proxy, s.rotationManager, s.analyticsManager, s.billingManager, s.storage, s.authManager)
+	s.apiServer.SetAdmins(s.config.API.AdminEmails)
+	var mail mailer.Mailer = mailer.NewLogMailer()
+	if m, err := mailer.New(s.config.Mail); err == nil {
+		mail = m
+		s.apiServer.SetMailer(m, s.config.API.AppURL)
+	} else {
+		s.logger.Warnf("Failed to initialize mailer: %v. Account emails will only be logged.", err)
+	}
+
+	// Renew, retry and expire subscriptions on their own billing anchors,
+	// charge pay-as-you-go usage to credits and overage with the renewal
+	if s.storage != nil {
+		var lifecycleCfg billing.LifecycleConfig
+		var creditCfg billing.CreditConfig
+		var queueCfg queue.Config
+		var invoiceCfg billing.InvoiceConfig
+		var promotionCfg billing.PromotionConfig
+		var orgCfg billing.OrgConfig
+		if s.config.Billing != nil {
+			lifecycleCfg = s.config.Billing.Lifecycle
+			creditCfg = s.config.Billing.Credits
+			queueCfg = s.config.Billing.Webhooks
+			invoiceCfg = s.config.Billing.Invoices
+			promotionCfg = s.config.Billing.Promotions
+			orgCfg = s.config.Billing.Orgs
+		}
+		notifier := &subscriptionMailer{mailer: mail, appURL: s.config.API.AppURL}
+		// Credits, quotas, promotions, organizations, sub-users, invoices,
+		// the webhook queue and crypto payments need a database
+		store, persistent := s.storage.(storage.BillingRepository)
+		if persistent {
+			s.billingManager.SetCredits(billing.NewCreditLedger(store, notifier, creditCfg))
+			s.billingManager.SetQuotaMeter(billing.NewQuotaMeter(store, notifier))
+			s.billingManager.SetPromotions(billing.NewPromotions(store, promotionCfg))
+			s.billingManager.SetOrgs(billing.NewOrgs(store, orgCfg))
+			s.billingManager.SetSubUsers(billing.NewSubUsers(store))
+		} else {
+			s.logger.Warn("Credits, quotas, promotions, organizations, sub-users, invoices, webhooks and crypto payments need a database and are disabled.")
+		}
+		lifecycle := billing.NewLifecycle(s.billingManager, s.storage, renewals, notifier, lifecycleCfg)
+		s.apiServer.SetLifecycle(lifecycle)
+		go lifecycle.Run(ctx)
+
+		if persistent {
+			// Every payment is invoiced, and the PDF kept as issued
+			s.apiServer.SetInvoicer(billing.NewInvoicer(store, invoiceCfg))
+
+			// Webhooks are stored before processing and retried until they succeed
+			webhooks := queue.NewWorker(store, queueCfg)
+			s.apiServer.SetQueue(webhooks)
+			go webhooks.Run(ctx)
+
+			// Crypto is paid to an address per checkout and applied once the
+			// chain confirms it
+			if s.config.Billing != nil && len(s.config.Billing.Crypto.Wallets) > 0 {
+				cryptoCfg := s.config.Billing.Crypto
+				crypto, err := billing.NewCryptoProvider(store, billing.NewCoinGeckoRates(cryptoCfg.RatesURL), cryptoCfg)
+				if err != nil {
+					s.logger.Errorf("Failed to initialize crypto payments: %v", err)
+				} else {
+					s.billingManager.SetCrypto(crypto)
+					watcher := billing.NewCryptoWatcher(store, billing.NewChainIndexers(cryptoCfg), cryptoCfg)
+					s.apiServer.SetCryptoWatcher(watcher)
+					go watcher.Run(ctx)
+				}
+			}
+		}
+
+		// Backups are taken on schedule and on demand by admins, and the
+		// oldest dropped beyond the number kept
+		if backuper, ok := s.storage.(storage.Backuper); ok {
+			backupCfg := storage.DefaultBackupConfig()
+			if s.config.Backup != nil {
+				backupCfg = *s.config.Backup
+			}
+			backups, err := storage.NewBackups(backuper, backupCfg)
+			if err != nil {
+				s.logger.Errorf("Failed to initialize backups: %v", err)
+			} else {
+				s.apiServer.SetBackups(backups)
+				go backups.Run(ctx)
+			}
+		}
+	}
 
 	// Initialize OTA Manager (Phase 5.2)
 	s.otaManager = NewOTAManager("1.5.0", s.logger)
@@ -205,7 +338,7 @@ func (s *Service) Run(ctx context.Context) error {
 		}
 	}()
 
-	// Periodic usage sync and quota reset check
+	// Periodic usage sync
 	go func() {
 		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
@@ -215,17 +348,8 @@ func (s *Service) Run(ctx context.Context) error {
 				return
 			case <-ticker.C:
 				if s.billingManager != nil {
-					s.billingManager.SyncUsage()
-
-					// Check if it's the first day of the month to reset quotas
-					// NOTE: In production, this needs a more robust state to avoid multiple resets
-					// For Validation: We assume this runs efficiently
-					if time.Now().Day() == 1 && s.billingManager.Usage.GetStats().DataTransferred > 0 {
-						// Only reset if we haven't already (simple heuristic: data > 0 on day 1 means we need to reset)
-						// A better approach is storing "LastResetDate" in DB
-						// For now, this suffices for V1 validation
-						s.logger.Info("First day of month detected. Resetting quotas...")
-						s.billingManager.ResetQuotas()
+					if err := s.billingManager.SyncUsage(); err != nil {
+						s.logger.Warnf("Failed to sync usage: %v", err)
 					}
 				}
 			}
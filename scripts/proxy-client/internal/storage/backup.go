@@ -0,0 +1,690 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Backups are consistent copies of a database taken while it is in use.
+// SQLite is copied with VACUUM INTO. Postgres is exported as a SQL script
+// that empties every table and inserts its rows, and lists the migrations
+// its schema is at in a header. Scheduled backups are named
+// atlantic-<UTC time>.db or .sql and rotated.
+
+const (
+	backupPrefix     = "atlantic-"
+	backupTimeFormat = "20060102T150405.000Z"
+	// pgBackupHeader starts every Postgres backup
+	pgBackupHeader = "-- AtlanticProxy logical backup\n"
+)
+
+// sqliteHeader starts every SQLite database file
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+var ErrBackupNotFound = errors.New("backup not found")
+
+// BackupConfig sets where backups are kept and how often they are taken
+type BackupConfig struct {
+	Dir      string        `yaml:"dir"`      // empty is backups/ beside the default database
+	Interval time.Duration `yaml:"interval"` // between scheduled backups; 0 takes none
+	Keep     int           `yaml:"keep"`     // newest backups kept; 0 keeps all
+}
+
+// DefaultBackupConfig returns the rotation used when none is configured
+func DefaultBackupConfig() BackupConfig {
+	return BackupConfig{Keep: 7}
+}
+
+// DefaultBackupDir returns the backup directory beside the default database
+func DefaultBackupDir() (string, error) {
+	dbPath, err := DefaultPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dbPath), "backups"), nil
+}
+
+// Backuper takes consistent backups of a database while it is in use
+type Backuper interface {
+	Backup(path string) error
+	Dialect() Dialect
+}
+
+var (
+	_ Backuper = (*Store)(nil)
+	_ Backuper = (*PostgresStore)(nil)
+)
+
+// BackupFile is a backup in the backup directory
+type BackupFile struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"-"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Backups takes backups into a directory and keeps the newest of them
+type Backups struct {
+	store  Backuper
+	cfg    BackupConfig
+	mu     sync.Mutex // one backup at a time
+	logger *logrus.Logger
+}
+
+// NewBackups creates the backup schedule of a database
+func NewBackups(store Backuper, cfg BackupConfig) (*Backups, error) {
+	if cfg.Dir == "" {
+		dir, err := DefaultBackupDir()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Dir = dir
+	}
+	return &Backups{store: store, cfg: cfg, logger: logrus.StandardLogger()}, nil
+}
+
+// backupExt returns the file extension of a dialect's backups
+func backupExt(dialect Dialect) string {
+	if dialect == DialectPostgres {
+		return ".sql"
+	}
+	return ".db"
+}
+
+// Create takes a backup into the backup directory and drops the oldest
+// backups beyond the number kept
+func (b *Backups) Create() (*BackupFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := os.MkdirAll(b.cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	name := backupPrefix + now.Format(backupTimeFormat) + backupExt(b.store.Dialect())
+	path := filepath.Join(b.cfg.Dir, name)
+	if err := b.store.Backup(path); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.rotate(); err != nil {
+		b.logger.Warnf("Failed to rotate backups: %v", err)
+	}
+	return &BackupFile{Name: name, Path: path, Size: info.Size(), CreatedAt: now}, nil
+}
+
+// List returns the backups in the backup directory, newest first
+func (b *Backups) List() ([]BackupFile, error) {
+	entries, err := os.ReadDir(b.cfg.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []BackupFile
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), backupPrefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".db"), ".sql")
+		created, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, BackupFile{Name: e.Name(), Path: filepath.Join(b.cfg.Dir, e.Name()), Size: info.Size(), CreatedAt: created})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// Get returns a backup by name
+func (b *Backups) Get(name string) (*BackupFile, error) {
+	files, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Name == name {
+			return &f, nil
+		}
+	}
+	return nil, ErrBackupNotFound
+}
+
+// rotate drops the oldest backups beyond the number kept
+func (b *Backups) rotate() error {
+	if b.cfg.Keep <= 0 {
+		return nil
+	}
+	files, err := b.List()
+	if err != nil {
+		return err
+	}
+	for i := b.cfg.Keep; i < len(files); i++ {
+		if err := os.Remove(files[i].Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run takes a backup every interval until ctx is done. A backup is taken
+// right away if the newest one is older than the interval.
+func (b *Backups) Run(ctx context.Context) {
+	if b.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+
+	if files, err := b.List(); err == nil && (len(files) == 0 || time.Since(files[0].CreatedAt) >= b.cfg.Interval) {
+		b.runOnce()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.runOnce()
+		}
+	}
+}
+
+func (b *Backups) runOnce() {
+	if f, err := b.Create(); err != nil {
+		b.logger.Errorf("Scheduled backup failed: %v", err)
+	} else {
+		b.logger.Infof("Database backed up to %s", f.Path)
+	}
+}
+
+// --- SQLite ---
+
+// Backup writes a consistent copy of the database to path with VACUUM INTO
+func (s *Store) Backup(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup %s already exists", path)
+	}
+	if _, err := s.db.Exec("VACUUM INTO ?", path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) Dialect() Dialect {
+	return DialectSQLite
+}
+
+// --- Postgres ---
+
+// Backup writes a logical export of the database to path. It is read in one
+// repeatable-read transaction, so it is consistent while the database is in
+// use.
+func (s *PostgresStore) Backup(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup %s already exists", path)
+	}
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	err = writePGBackup(tx, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *PostgresStore) Dialect() Dialect {
+	return DialectPostgres
+}
+
+// writePGBackup writes the header listing the applied migrations, then a
+// transaction that empties every table, inserts its rows parents first and
+// moves the sequences past them
+func writePGBackup(tx *sql.Tx, w io.Writer) error {
+	fmt.Fprint(w, pgBackupHeader)
+	rows, err := tx.Query(`SELECT version, name, checksum FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		var name, checksum string
+		if err := rows.Scan(&version, &name, &checksum); err != nil {
+			rows.Close()
+			return err
+		}
+		fmt.Fprintf(w, "-- migration: %d %s %s\n", version, name, checksum)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tables, err := pgTables(tx)
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(tables))
+	for i, t := range tables {
+		quoted[i] = pq.QuoteIdentifier(t)
+	}
+	fmt.Fprintf(w, "\nBEGIN;\nTRUNCATE %s CASCADE;\n", strings.Join(quoted, ", "))
+	for _, t := range tables {
+		if err := writePGRows(tx, w, t); err != nil {
+			return fmt.Errorf("failed to export %s: %w", t, err)
+		}
+	}
+
+	rows, err = tx.Query(`
+		SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'
+		AND (column_default LIKE 'nextval(%' OR is_identity = 'YES')
+		ORDER BY table_name, column_name
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "SELECT setval(pg_get_serial_sequence(%s, %s), COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false);\n",
+			pq.QuoteLiteral(table), pq.QuoteLiteral(column), pq.QuoteIdentifier(column), pq.QuoteIdentifier(table))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(w, "COMMIT;\n")
+	return err
+}
+
+// pgTables returns the tables of the current schema but schema_migrations,
+// each after the tables its foreign keys refer to
+func pgTables(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT tablename FROM pg_tables
+		WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'
+		ORDER BY tablename
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(`
+		SELECT conrelid::regclass::text, confrelid::regclass::text FROM pg_constraint
+		WHERE contype = 'f' AND connamespace = current_schema()::regnamespace
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	parents := make(map[string][]string)
+	for rows.Next() {
+		var child, parent string
+		if err := rows.Scan(&child, &parent); err != nil {
+			return nil, err
+		}
+		parents[child] = append(parents[child], parent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(names))
+	for _, t := range names {
+		known[t] = true
+	}
+	var ordered []string
+	seen := make(map[string]bool)
+	var visit func(string)
+	visit = func(t string) {
+		if seen[t] || !known[t] {
+			return
+		}
+		seen[t] = true
+		for _, p := range parents[t] {
+			visit(p)
+		}
+		ordered = append(ordered, t)
+	}
+	for _, t := range names {
+		visit(t)
+	}
+	return ordered, nil
+}
+
+// writePGRows writes an INSERT for every row of a table
+func writePGRows(tx *sql.Tx, w io.Writer, table string) error {
+	rows, err := tx.Query("SELECT * FROM " + pq.QuoteIdentifier(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	cols := make([]string, len(types))
+	for i, ct := range types {
+		cols[i] = pq.QuoteIdentifier(ct.Name())
+	}
+	insert := "INSERT INTO " + pq.QuoteIdentifier(table) + " (" + strings.Join(cols, ", ") + ") VALUES ("
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	literals := make([]string, len(cols))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			literals[i] = pgLiteral(v, types[i].DatabaseTypeName())
+		}
+		if _, err := fmt.Fprintf(w, "%s%s);\n", insert, strings.Join(literals, ", ")); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// pgLiteral returns a value read from a column of the given type as a SQL
+// literal
+func pgLiteral(v any, dbType string) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return pq.QuoteLiteral(strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return pq.QuoteLiteral(v.Format(time.RFC3339Nano))
+	case []byte:
+		if dbType == "BYTEA" {
+			return `'\x` + hex.EncodeToString(v) + `'::bytea`
+		}
+		return pq.QuoteLiteral(string(v))
+	case string:
+		return pq.QuoteLiteral(v)
+	default:
+		return pq.QuoteLiteral(fmt.Sprint(v))
+	}
+}
+
+// --- Restore ---
+
+// Restore replaces the database at url with a backup and returns the
+// backup's schema version. The backup must be a database of this release:
+// every migration it has applied must be one this release has, unchanged.
+//
+// A SQLite database must not be in use while it is restored; the file it
+// replaces is kept beside it with a .pre-restore suffix. A Postgres backup
+// is loaded into the database migrated to the backup's version, which must
+// not be newer, and the later migrations are applied after.
+func Restore(url, backupPath string) (int, error) {
+	f, err := os.Open(backupPath)
+	if err != nil {
+		return 0, err
+	}
+	head := make([]byte, len(pgBackupHeader))
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, sqliteHeader):
+		if isPostgresURL(url) {
+			return 0, errors.New("a SQLite backup cannot be restored into Postgres")
+		}
+		dbPath, err := sqlitePath(url)
+		if err != nil {
+			return 0, err
+		}
+		return restoreSQLite(backupPath, dbPath)
+	case string(head) == pgBackupHeader:
+		if !isPostgresURL(url) {
+			return 0, errors.New("a Postgres backup can only be restored into Postgres")
+		}
+		return restorePostgres(url, backupPath)
+	default:
+		return 0, fmt.Errorf("%s is not a database backup", backupPath)
+	}
+}
+
+// restoreSQLite checks a copy of the backup and moves it into place
+func restoreSQLite(backupPath, dbPath string) (int, error) {
+	tmp := dbPath + ".restore"
+	if err := copyFile(backupPath, tmp); err != nil {
+		return 0, fmt.Errorf("failed to copy backup: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	version, err := checkSQLiteBackup(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			err := os.Rename(dbPath+suffix, dbPath+".pre-restore"+suffix)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return 0, fmt.Errorf("failed to set the current database aside: %w", err)
+			}
+		}
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// checkSQLiteBackup checks a SQLite backup is intact and of this release,
+// and returns its schema version
+func checkSQLiteBackup(path string) (int, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return 0, fmt.Errorf("failed to check backup: %w", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("backup is damaged: %s", result)
+	}
+
+	migrator, err := NewMigrator(db, DialectSQLite)
+	if err != nil {
+		return 0, err
+	}
+	if err := migrator.Verify(); err != nil {
+		return 0, fmt.Errorf("backup does not match this release: %w", err)
+	}
+	version, err := migrator.Version()
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, errors.New("backup has no schema version")
+	}
+	return version, nil
+}
+
+// pgBackupVersion checks the migrations a Postgres backup lists are this
+// release's, unchanged, and returns its schema version
+func pgBackupVersion(script []byte, migrator *Migrator) (int, error) {
+	known := make(map[int]Migration)
+	for _, m := range migrator.Migrations() {
+		known[m.Version] = m
+	}
+
+	version := 0
+	for _, line := range strings.Split(string(script), "\n") {
+		rest, ok := strings.CutPrefix(line, "-- migration: ")
+		if !ok {
+			if line == "" || strings.HasPrefix(line, "--") {
+				continue
+			}
+			break // past the header
+		}
+		fields := strings.Fields(rest)
+		if len(fields) != 3 {
+			return 0, fmt.Errorf("invalid backup header line %q", line)
+		}
+		v, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return 0, fmt.Errorf("invalid backup header line %q", line)
+		}
+		m, ok := known[v]
+		switch {
+		case !ok:
+			return 0, fmt.Errorf("backup does not match this release: %w: %d_%s", ErrUnknownMigration, v, fields[1])
+		case m.Checksum != fields[2]:
+			return 0, fmt.Errorf("backup does not match this release: %w: %d_%s", ErrChecksumMismatch, v, fields[1])
+		}
+		version = max(version, v)
+	}
+	if version == 0 {
+		return 0, errors.New("backup has no schema version")
+	}
+	return version, nil
+}
+
+// restorePostgres loads a Postgres backup
+func restorePostgres(url, backupPath string) (int, error) {
+	script, err := os.ReadFile(backupPath)
+	if err != nil {
+		return 0, err
+	}
+	db, _, err := OpenDatabase(url)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	migrator, err := NewMigrator(db, DialectPostgres)
+	if err != nil {
+		return 0, err
+	}
+	version, err := pgBackupVersion(script, migrator)
+	if err != nil {
+		return 0, err
+	}
+	current, err := migrator.Version()
+	if err != nil {
+		return 0, err
+	}
+	if current > version {
+		return 0, fmt.Errorf("database is at schema version %d, newer than the backup's %d; restore into an empty database", current, version)
+	}
+
+	if _, err := migrator.UpTo(version); err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(string(script)); err != nil {
+		return 0, fmt.Errorf("failed to load backup: %w", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// copyFile copies src to dst, replacing it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupAndRestoreSQLite(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.db")
+	store, err := NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.CreateUser("u1", "a@example.com", "hash")
+
+	backups, err := NewBackups(store, BackupConfig{Dir: filepath.Join(dir, "backups"), Keep: 2})
+	if err != nil {
+		t.Fatalf("Failed to create backups: %v", err)
+	}
+	var latest *BackupFile
+	for i := 0; i < 3; i++ {
+		if latest, err = backups.Create(); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	files, err := backups.List()
+	if err != nil || len(files) != 2 || files[0].Name != latest.Name {
+		t.Fatalf("Expected the two newest backups kept, got %+v, %v", files, err)
+	}
+	if f, err := backups.Get(latest.Name); err != nil || f.Size == 0 {
+		t.Errorf("Get = %+v, %v", f, err)
+	}
+	if _, err := backups.Get("atlantic-missing.db"); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("Expected ErrBackupNotFound, got %v", err)
+	}
+
+	store.CreateUser("u2", "b@example.com", "hash")
+	store.Close()
+
+	version, err := Restore("sqlite://"+dbPath, latest.Path)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	migrator, _ := NewMigrator(nil, DialectSQLite)
+	if version != migrator.Latest() {
+		t.Errorf("Expected schema version %d, got %d", migrator.Latest(), version)
+	}
+	if _, err := os.Stat(dbPath + ".pre-restore"); err != nil {
+		t.Errorf("Expected the replaced database kept: %v", err)
+	}
+
+	store, err = NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer store.Close()
+	if u, _ := store.GetUserByID("u1"); u == nil {
+		t.Error("Expected the backed up user restored")
+	}
+	if u, _ := store.GetUserByID("u2"); u != nil {
+		t.Error("Expected the user added after the backup gone")
+	}
+}
+
+func TestRestoreRejectsForeignBackups(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStoreWithPath(filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+	backup := filepath.Join(dir, "backup.db")
+	if err := store.Backup(backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := store.Backup(backup); err == nil {
+		t.Error("Expected an existing backup not to be overwritten")
+	}
+
+	db, err := sql.Open("sqlite", backup)
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (999, 'future', 'x', '')`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to add migration: %v", err)
+	}
+
+	target := filepath.Join(dir, "target.db")
+	if _, err := Restore("sqlite://"+target, backup); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("Expected ErrUnknownMigration, got %v", err)
+	}
+	if _, err := os.Stat(target); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected a rejected backup not to be restored")
+	}
+
+	if _, err := Restore("postgres://localhost/atlantic", backup); err == nil {
+		t.Error("Expected a SQLite backup not to restore into Postgres")
+	}
+	junk := filepath.Join(dir, "junk.db")
+	os.WriteFile(junk, []byte("not a database"), 0600)
+	if _, err := Restore("sqlite://"+target, junk); err == nil {
+		t.Error("Expected a file that is no backup to be refused")
+	}
+}
+
+func TestPGBackupVersion(t *testing.T) {
+	migrator, err := NewMigrator(nil, DialectPostgres)
+	if err != nil {
+		t.Fatalf("Failed to create migrator: %v", err)
+	}
+	header := pgBackupHeader
+	for _, m := range migrator.Migrations()[:3] {
+		header += fmt.Sprintf("-- migration: %d %s %s\n", m.Version, m.Name, m.Checksum)
+	}
+
+	version, err := pgBackupVersion([]byte(header+"\nBEGIN;\n-- migration: 999 x y\nCOMMIT;\n"), migrator)
+	if err != nil || version != migrator.Migrations()[2].Version {
+		t.Errorf("pgBackupVersion = %d, %v", version, err)
+	}
+	first := migrator.Migrations()[0]
+	changed := fmt.Sprintf("%s-- migration: %d %s changed\n", pgBackupHeader, first.Version, first.Name)
+	if _, err := pgBackupVersion([]byte(changed), migrator); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+	unknown := pgBackupHeader + "-- migration: 999 future x\n"
+	if _, err := pgBackupVersion([]byte(unknown), migrator); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("Expected ErrUnknownMigration, got %v", err)
+	}
+	if _, err := pgBackupVersion([]byte(pgBackupHeader), migrator); err == nil {
+		t.Error("Expected a backup without migrations to be refused")
+	}
+}
+
+func TestPGLiteral(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value  any
+		dbType string
+		want   string
+	}{
+		{nil, "TEXT", "NULL"},
+		{true, "BOOL", "TRUE"},
+		{int64(42), "INT8", "42"},
+		{1.5, "FLOAT8", "1.5"},
+		{"it's", "TEXT", "'it''s'"},
+		{[]byte("text"), "TEXT", "'text'"},
+		{[]byte{0xde, 0xad}, "BYTEA", `'\xdead'::bytea`},
+		{at, "TIMESTAMP", "'2026-01-02T03:04:05Z'"},
+	}
+	for _, tt := range tests {
+		if got := pgLiteral(tt.value, tt.dbType); got != tt.want {
+			t.Errorf("pgLiteral(%v, %s) = %s, want %s", tt.value, tt.dbType, got, tt.want)
+		}
+	}
+}
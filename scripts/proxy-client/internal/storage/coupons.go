@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+)
+
+// Coupon holds are kept the same way on SQLite and Postgres. A checkout
+// holds one of its coupon's redemptions from the moment it starts, taken
+// with a conditional update so concurrent checkouts can not go past the
+// coupon's limit. Every step starts with a write, which locks the rows it
+// goes on with until the transaction ends.
+
+// reserveCoupon records the pending redemption of a checkout and holds one
+// of its coupon's redemptions
+func reserveCoupon(db *sql.DB, dialect Dialect, r *billing.CouponRedemption) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(rebind(dialect, `
+		UPDATE coupons SET redemptions = redemptions + 1
+		WHERE code = ? AND (max_redemptions = 0 OR redemptions < max_redemptions)
+	`), r.Code)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: %s has been fully redeemed", billing.ErrCouponUnavailable, r.Code)
+	}
+
+	// The coupon stays locked, so the user's other checkouts wait here
+	if r.UserID != "" {
+		var held int
+		err := tx.QueryRow(rebind(dialect, `
+			SELECT COUNT(*) FROM coupon_redemptions
+			WHERE user_id = ? AND code = ? AND status IN (?, ?) AND renewal = FALSE
+		`), r.UserID, r.Code, billing.RedemptionRedeemed, billing.RedemptionPending).Scan(&held)
+		if err != nil {
+			return err
+		}
+		if held > 0 {
+			return fmt.Errorf("%w: %s was already used on this account", billing.ErrCouponUnavailable, r.Code)
+		}
+	}
+
+	if _, err := tx.Exec(rebind(dialect, `
+		INSERT INTO coupon_redemptions (reference, code, user_id, plan_id, discount_usd, renewal, status, created_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, FALSE, ?, ?)
+	`), r.Reference, r.Code, r.UserID, r.PlanID, r.DiscountUSD, billing.RedemptionPending, queueTime(r.CreatedAt)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// redeemCoupon marks a pending or released redemption paid, counting a
+// released one against its coupon again
+func redeemCoupon(db *sql.DB, dialect Dialect, reference, at string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(rebind(dialect, `
+		UPDATE coupon_redemptions SET redeemed_at = ?
+		WHERE reference = ? AND status IN (?, ?)
+	`), at, reference, billing.RedemptionPending, billing.RedemptionReleased)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	var code, status string
+	if err := tx.QueryRow(rebind(dialect, "SELECT code, status FROM coupon_redemptions WHERE reference = ?"),
+		reference).Scan(&code, &status); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(rebind(dialect, "UPDATE coupon_redemptions SET status = ? WHERE reference = ?"),
+		billing.RedemptionRedeemed, reference); err != nil {
+		return false, err
+	}
+	if status == billing.RedemptionReleased {
+		if _, err := tx.Exec(rebind(dialect, "UPDATE coupons SET redemptions = redemptions + 1 WHERE code = ?"), code); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// releaseCoupons gives back the holds of the pending redemptions where
+// selects, with one ? for arg
+func releaseCoupons(db *sql.DB, dialect Dialect, where string, arg any) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(rebind(dialect, `
+		UPDATE coupon_redemptions SET status = ?
+		WHERE status = ? AND renewal = FALSE AND `+where+`
+		RETURNING code
+	`), billing.RedemptionReleased, billing.RedemptionPending, arg)
+	if err != nil {
+		return 0, err
+	}
+	released := make(map[string]int)
+	n := 0
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		released[code]++
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for code, count := range released {
+		if _, err := tx.Exec(rebind(dialect, "UPDATE coupons SET redemptions = redemptions - ? WHERE code = ?"),
+			count, code); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
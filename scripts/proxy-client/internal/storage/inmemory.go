@@ -1,20 +1,1347 @@
 package storage
 
-// InMemoryStore is a no-op implementation of the Store interface
-// Used as a fallback when SQLite initialization fails
-type InMemoryStore struct{}
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-// NewInMemoryStore creates a new in-memory store that does nothing
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+)
+
+// InMemoryStore implements Repository in memory. Nothing survives a restart;
+// it serves tests and runs the client when no database can be opened.
+type InMemoryStore struct {
+	mu sync.Mutex
+
+	users       map[string]*User
+	userByEmail map[string]string
+
+	sessions      map[string]*Session
+	rotatedTokens map[string]rotatedToken
+	revocations   map[string]time.Time
+	apiKeys       map[string]*APIKey
+	emailTokens   map[string]*emailToken
+	challenges    map[string]*LoginChallenge
+	totp          map[string]*TOTPSecret
+	recoveryCodes map[string]map[string]bool // user -> code hash -> used
+	loginFailures map[string]*LoginFailure
+	activities    []*Activity
+
+	subscriptions []*billing.PersistedSubscription // in the order they were added
+	planOrder     []billing.PlanType
+	planVersions  map[billing.PlanType][]planTerms // oldest version first
+	planActive    map[billing.PlanType]bool
+	usage         map[usageKey]*usagePeriod
+	transactions  []*Transaction // in the order they were added
+
+	whitelist   []string
+	customRules []string
+}
+
+type rotatedToken struct {
+	sessionID string
+	expiresAt time.Time
+}
+
+type emailToken struct {
+	userID    string
+	purpose   string
+	expiresAt time.Time
+	used      bool
+}
+
+type planTerms struct {
+	version int
+	terms   string
+}
+
+type usageKey struct {
+	userID     string
+	start, end time.Time
+}
+
+type usagePeriod struct {
+	data, requests, ads, threats int64
+}
+
+// NewInMemoryStore creates an empty in-memory store holding the built-in plans
 func NewInMemoryStore() *InMemoryStore {
-	return &InMemoryStore{}
-}
-
-// No-op implementations for all Store interface methods
-func (s *InMemoryStore) GetWhitelist() ([]string, error)                  { return []string{}, nil }
-func (s *InMemoryStore) AddToWhitelist(domain string) error               { return nil }
-func (s *InMemoryStore) RemoveFromWhitelist(domain string) error          { return nil }
-func (s *InMemoryStore) GetCustomRules() ([]string, error)                { return []string{}, nil }
-func (s *InMemoryStore) AddCustomRule(rule string) error                  { return nil }
-func (s *InMemoryStore) RemoveCustomRule(rule string) error               { return nil }
-func (s *InMemoryStore) UpdateUsage(userID string, bytesUsed int64) error { return nil }
-func (s *InMemoryStore) Close() error                                     { return nil }
+	s := &InMemoryStore{
+		users:         make(map[string]*User),
+		userByEmail:   make(map[string]string),
+		sessions:      make(map[string]*Session),
+		rotatedTokens: make(map[string]rotatedToken),
+		revocations:   make(map[string]time.Time),
+		apiKeys:       make(map[string]*APIKey),
+		emailTokens:   make(map[string]*emailToken),
+		challenges:    make(map[string]*LoginChallenge),
+		totp:          make(map[string]*TOTPSecret),
+		recoveryCodes: make(map[string]map[string]bool),
+		loginFailures: make(map[string]*LoginFailure),
+		planVersions:  make(map[billing.PlanType][]planTerms),
+		planActive:    make(map[billing.PlanType]bool),
+		usage:         make(map[usageKey]*usagePeriod),
+	}
+	// The built-in plans always encode
+	_ = seedPlans(s)
+	return s
+}
+
+func (s *InMemoryStore) Close() error {
+	return nil
+}
+
+// --- Whitelist ---
+
+func (s *InMemoryStore) GetWhitelist() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.whitelist), nil
+}
+
+func (s *InMemoryStore) AddToWhitelist(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.whitelist, domain) {
+		s.whitelist = append(s.whitelist, domain)
+	}
+	return nil
+}
+
+func (s *InMemoryStore) RemoveFromWhitelist(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.whitelist = slices.DeleteFunc(s.whitelist, func(d string) bool { return d == domain })
+	return nil
+}
+
+// --- Custom Rules ---
+
+func (s *InMemoryStore) GetCustomRules() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.customRules), nil
+}
+
+func (s *InMemoryStore) SetCustomRules(rules []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.customRules = nil
+	for _, r := range rules {
+		if !slices.Contains(s.customRules, r) {
+			s.customRules = append(s.customRules, r)
+		}
+	}
+	return nil
+}
+
+// --- Usage ---
+
+// UpdateUsage adds usage to a user's billing period. Periods are kept to the
+// second, as on SQLite.
+func (s *InMemoryStore) UpdateUsage(userID string, periodStart, periodEnd time.Time, dataTransferred, requests, ads, threats int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := usageKey{userID, periodStart.UTC().Truncate(time.Second), periodEnd.UTC().Truncate(time.Second)}
+	p := s.usage[key]
+	if p == nil {
+		p = &usagePeriod{}
+		s.usage[key] = p
+	}
+	p.data += dataTransferred
+	p.requests += requests
+	p.ads += ads
+	p.threats += threats
+	return nil
+}
+
+// GetPeriodUsage returns a user's usage in the billing period starting at periodStart
+func (s *InMemoryStore) GetPeriodUsage(userID string, periodStart time.Time) (int64, int64, int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := periodStart.UTC().Truncate(time.Second)
+	var data, reqs, ads, threats int64
+	for key, p := range s.usage {
+		if key.userID == userID && key.start.Equal(start) {
+			data, reqs, ads, threats = data+p.data, reqs+p.requests, ads+p.ads, threats+p.threats
+		}
+	}
+	return data, reqs, ads, threats, nil
+}
+
+func (s *InMemoryStore) GetLatestUsage(userID string) (int64, int64, int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	for key, p := range s.usage {
+		if key.userID == userID && !key.start.After(now) && !key.end.Before(now) {
+			return p.data, p.requests, p.ads, p.threats, nil
+		}
+	}
+	return 0, 0, 0, 0, nil
+}
+
+// --- Subscriptions ---
+
+// latestSubscription returns the subscription a user added last, or nil
+func (s *InMemoryStore) latestSubscription(match func(*billing.PersistedSubscription) bool) *billing.PersistedSubscription {
+	for i := len(s.subscriptions) - 1; i >= 0; i-- {
+		if match(s.subscriptions[i]) {
+			return s.subscriptions[i]
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStore) subscription(id string) *billing.PersistedSubscription {
+	return s.latestSubscription(func(sub *billing.PersistedSubscription) bool { return sub.ID == id })
+}
+
+// copySubscription returns a copy of a subscription, or nil
+func copySubscription(sub *billing.PersistedSubscription) *billing.PersistedSubscription {
+	if sub == nil {
+		return nil
+	}
+	c := *sub
+	return &c
+}
+
+func (s *InMemoryStore) GetSubscription(userID string) (*billing.PersistedSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copySubscription(s.latestSubscription(func(sub *billing.PersistedSubscription) bool { return sub.UserID == userID })), nil
+}
+
+func (s *InMemoryStore) SetSubscription(userID, id, planID string, planVersion int, status, start, end string, autoRenew bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := s.subscription(id)
+	if sub == nil {
+		sub = &billing.PersistedSubscription{ID: id, UserID: userID}
+		s.subscriptions = append(s.subscriptions, sub)
+	}
+	sub.PlanID, sub.PlanVersion, sub.Status = planID, planVersion, status
+	sub.StartDate, sub.EndDate, sub.AutoRenew = start, end, autoRenew
+	return nil
+}
+
+// ListRenewableSubscriptions returns the current subscription of every user
+// whose subscription can still change state: trialing, active, past_due or
+// canceled. Older subscriptions a user has replaced are ignored.
+func (s *InMemoryStore) ListRenewableSubscriptions() ([]*billing.PersistedSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	var subs []*billing.PersistedSubscription
+	for i := len(s.subscriptions) - 1; i >= 0; i-- {
+		sub := s.subscriptions[i]
+		if seen[sub.UserID] {
+			continue
+		}
+		seen[sub.UserID] = true
+		switch sub.Status {
+		case "trialing", "active", "past_due", "canceled":
+			subs = append(subs, copySubscription(sub))
+		}
+	}
+	return subs, nil
+}
+
+// UpdateSubscriptionLifecycle stores a state transition of a subscription
+func (s *InMemoryStore) UpdateSubscriptionLifecycle(sub *billing.PersistedSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored := s.subscription(sub.ID); stored != nil {
+		stored.PlanID, stored.PlanVersion, stored.Status = sub.PlanID, sub.PlanVersion, sub.Status
+		stored.StartDate, stored.EndDate, stored.AutoRenew = sub.StartDate, sub.EndDate, sub.AutoRenew
+		stored.GraceUntil, stored.NextRetryAt, stored.RetryCount = sub.GraceUntil, sub.NextRetryAt, sub.RetryCount
+		stored.PendingRef, stored.ScheduledPlan = sub.PendingRef, sub.ScheduledPlan
+	}
+	return nil
+}
+
+// updateSubscription changes a stored subscription, if there is one
+func (s *InMemoryStore) updateSubscription(id string, update func(*billing.PersistedSubscription)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub := s.subscription(id); sub != nil {
+		update(sub)
+	}
+}
+
+// SetScheduledPlan schedules the plan a subscription renews into, or clears
+// the schedule if planID is empty
+func (s *InMemoryStore) SetScheduledPlan(subscriptionID, planID string) error {
+	s.updateSubscription(subscriptionID, func(sub *billing.PersistedSubscription) { sub.ScheduledPlan = planID })
+	return nil
+}
+
+// SetQuotaMode sets what happens once a subscription's data limit is used up
+func (s *InMemoryStore) SetQuotaMode(subscriptionID, mode string) error {
+	s.updateSubscription(subscriptionID, func(sub *billing.PersistedSubscription) { sub.QuotaMode = mode })
+	return nil
+}
+
+// GetSubscriptionByPendingRenewal returns the subscription waiting for the
+// renewal charge with the given reference, or nil
+func (s *InMemoryStore) GetSubscriptionByPendingRenewal(reference string) (*billing.PersistedSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reference == "" {
+		return nil, nil
+	}
+	return copySubscription(s.latestSubscription(func(sub *billing.PersistedSubscription) bool { return sub.PendingRef == reference })), nil
+}
+
+// ClearPendingRenewal settles a pending renewal charge. It reports false if
+// the charge was already settled, so only one caller starts the new period.
+func (s *InMemoryStore) ClearPendingRenewal(id, reference string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := s.subscription(id)
+	if sub == nil || sub.PendingRef != reference {
+		return false, nil
+	}
+	sub.PendingRef = ""
+	return true, nil
+}
+
+// ClaimRenewal reserves a renewal attempt until the given time so that a
+// subscription is never charged twice. It reports false if another attempt
+// holds the claim.
+func (s *InMemoryStore) ClaimRenewal(id string, now, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := s.subscription(id)
+	if sub == nil || (sub.NextRetryAt != "" && sub.NextRetryAt > now.UTC().Format(time.RFC3339)) {
+		return false, nil
+	}
+	sub.NextRetryAt = until.UTC().Format(time.RFC3339)
+	return true, nil
+}
+
+// MarkQuotaReset records that the usage quota of a subscription was reset for
+// the period starting at periodStart. It reports false if that reset was
+// already recorded, which keeps resets idempotent.
+func (s *InMemoryStore) MarkQuotaReset(id, periodStart string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := s.subscription(id)
+	if sub == nil || (sub.LastReset != "" && sub.LastReset >= periodStart) {
+		return false, nil
+	}
+	sub.LastReset = periodStart
+	return true, nil
+}
+
+// SetSubscriptionPaymentAuth stores the reusable payment authorization used
+// to charge renewals and the currency it was first charged in
+func (s *InMemoryStore) SetSubscriptionPaymentAuth(id, auth, currency string) error {
+	s.updateSubscription(id, func(sub *billing.PersistedSubscription) { sub.PaymentAuth, sub.Currency = auth, currency })
+	return nil
+}
+
+// SetSubscriptionStripeID links a subscription to the Stripe subscription
+// that bills it
+func (s *InMemoryStore) SetSubscriptionStripeID(id, stripeSubID string) error {
+	s.updateSubscription(id, func(sub *billing.PersistedSubscription) { sub.StripeSubID = stripeSubID })
+	return nil
+}
+
+// GetSubscriptionByStripeID returns the subscription billed by a Stripe
+// subscription, or nil
+func (s *InMemoryStore) GetSubscriptionByStripeID(stripeSubID string) (*billing.PersistedSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stripeSubID == "" {
+		return nil, nil
+	}
+	return copySubscription(s.latestSubscription(func(sub *billing.PersistedSubscription) bool { return sub.StripeSubID == stripeSubID })), nil
+}
+
+// --- Plans ---
+
+// ListPlans returns every version of every plan, in the order the plans were
+// added and oldest version first
+func (s *InMemoryStore) ListPlans() ([]billing.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var plans []billing.Plan
+	for _, id := range s.planOrder {
+		for _, v := range s.planVersions[id] {
+			var p billing.Plan
+			if err := json.Unmarshal([]byte(v.terms), &p); err != nil {
+				return nil, fmt.Errorf("failed to decode plan terms: %w", err)
+			}
+			p.Active = s.planActive[id]
+			plans = append(plans, p)
+		}
+	}
+	return plans, nil
+}
+
+// SavePlan stores a new version of a plan and makes it the plan's current
+// terms
+func (s *InMemoryStore) SavePlan(p *billing.Plan) error {
+	terms, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.planVersions[p.ID]
+	i, found := slices.BinarySearchFunc(versions, p.Version, func(v planTerms, version int) int { return v.version - version })
+	if found {
+		return fmt.Errorf("plan %s already has version %d", p.ID, p.Version)
+	}
+	if _, ok := s.planActive[p.ID]; !ok {
+		s.planOrder = append(s.planOrder, p.ID)
+	}
+	s.planVersions[p.ID] = slices.Insert(versions, i, planTerms{p.Version, string(terms)})
+	s.planActive[p.ID] = p.Active
+	return nil
+}
+
+// SetPlanActive offers or retires a plan
+func (s *InMemoryStore) SetPlanActive(id billing.PlanType, active bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.planActive[id]; !ok {
+		return billing.ErrPlanNotFound
+	}
+	s.planActive[id] = active
+	return nil
+}
+
+// --- Auth: Users ---
+
+func copyUser(u *User) *User {
+	c := *u
+	return &c
+}
+
+func (s *InMemoryStore) CreateUser(id, email, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; ok {
+		return fmt.Errorf("user %s already exists", id)
+	}
+	if _, ok := s.userByEmail[email]; ok {
+		return fmt.Errorf("email %s is already registered", email)
+	}
+	s.users[id] = &User{ID: id, Email: email, PasswordHash: passwordHash, CreatedAt: time.Now().UTC()}
+	s.userByEmail[email] = id
+	return nil
+}
+
+func (s *InMemoryStore) GetUserByEmail(email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.userByEmail[email]
+	if !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+	return copyUser(s.users[id]), nil
+}
+
+func (s *InMemoryStore) GetUserByID(id string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyUser(u), nil
+}
+
+// MarkEmailVerified records that the user confirmed their email address
+func (s *InMemoryStore) MarkEmailVerified(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[id]; ok {
+		u.EmailVerified = true
+	}
+	return nil
+}
+
+func (s *InMemoryStore) UpdateUserPassword(id, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+	u.PasswordHash = passwordHash
+	return nil
+}
+
+// GetUserEmail returns the email address of a user
+func (s *InMemoryStore) GetUserEmail(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return u.Email, nil
+}
+
+// --- Auth: Sessions ---
+
+func copySession(sess *Session) *Session {
+	c := *sess
+	return &c
+}
+
+func (s *InMemoryStore) CreateSession(id, userID, token string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; ok {
+		return fmt.Errorf("session %s already exists", id)
+	}
+	if s.sessionByToken(token) != nil {
+		return fmt.Errorf("session token already in use")
+	}
+	now := time.Now().UTC()
+	s.sessions[id] = &Session{ID: id, UserID: userID, Token: token, CreatedAt: now, ExpiresAt: expiresAt.UTC(), LastUsedAt: now}
+	return nil
+}
+
+func (s *InMemoryStore) sessionByToken(token string) *Session {
+	for _, sess := range s.sessions {
+		if sess.Token == token {
+			return sess
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStore) GetSession(token string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.sessionByToken(token)
+	if sess == nil {
+		return nil, fmt.Errorf("session not found")
+	}
+	return copySession(sess), nil
+}
+
+func (s *InMemoryStore) GetSessionByID(id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session not found")
+	}
+	return copySession(sess), nil
+}
+
+// ListUserSessions returns all sessions of a user, most recently used first
+func (s *InMemoryStore) ListUserSessions(userID string) ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []*Session
+	for _, sess := range s.sessions {
+		if sess.UserID == userID {
+			sessions = append(sessions, copySession(sess))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+// RotateSessionToken replaces the refresh token hash of a session and extends
+// its expiry, but only while oldToken is still the session's current token.
+// It reports false if the token was already rotated. The replaced hash is
+// kept so that its reuse can be detected.
+func (s *InMemoryStore) RotateSessionToken(id, oldToken, newToken string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || sess.Token != oldToken {
+		return false, nil
+	}
+	sess.Token, sess.ExpiresAt, sess.LastUsedAt = newToken, expiresAt.UTC(), time.Now().UTC()
+	if _, ok := s.rotatedTokens[oldToken]; !ok {
+		s.rotatedTokens[oldToken] = rotatedToken{sessionID: id, expiresAt: expiresAt.UTC()}
+	}
+	return true, nil
+}
+
+// GetRotatedTokenSession returns the session a replaced refresh token hash
+// belonged to, or "" if the hash was never rotated
+func (s *InMemoryStore) GetRotatedTokenSession(token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotatedTokens[token].sessionID, nil
+}
+
+// TouchSession records the device a session was last used from
+func (s *InMemoryStore) TouchSession(id, userAgent, ipAddress string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		sess.UserAgent, sess.IPAddress, sess.LastUsedAt = userAgent, ipAddress, time.Now().UTC()
+	}
+	return nil
+}
+
+func (s *InMemoryStore) DeleteSession(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.sessionByToken(token); sess != nil {
+		delete(s.sessions, sess.ID)
+	}
+	return nil
+}
+
+func (s *InMemoryStore) DeleteSessionByID(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, r := range s.rotatedTokens {
+		if r.sessionID == id {
+			delete(s.rotatedTokens, token)
+		}
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+// --- Auth: Session Revocations ---
+
+// RevokeSession adds a session to the revocation list until expiresAt, by which
+// time every access token issued for it has expired on its own.
+func (s *InMemoryStore) RevokeSession(sessionID, userID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revocations[sessionID] = expiresAt.UTC()
+	return nil
+}
+
+// GetSessionRevocations returns revoked session IDs with the time their entry lapses
+func (s *InMemoryStore) GetSessionRevocations() (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revoked := make(map[string]time.Time, len(s.revocations))
+	for id, expiresAt := range s.revocations {
+		revoked[id] = expiresAt
+	}
+	return revoked, nil
+}
+
+// GetSessionRevocation returns when the revocation of a session lapses, or
+// nil if the session is not revoked
+func (s *InMemoryStore) GetSessionRevocation(sessionID string) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.revocations[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	return &expiresAt, nil
+}
+
+// PruneSessionRevocations drops revocation entries and rotated refresh token
+// hashes that lapsed before now
+func (s *InMemoryStore) PruneSessionRevocations(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, r := range s.rotatedTokens {
+		if r.expiresAt.Before(now) {
+			delete(s.rotatedTokens, token)
+		}
+	}
+	for id, expiresAt := range s.revocations {
+		if expiresAt.Before(now) {
+			delete(s.revocations, id)
+		}
+	}
+	return nil
+}
+
+// --- Auth: API Keys ---
+
+func copyAPIKey(key *APIKey) *APIKey {
+	c := *key
+	c.Scopes = slices.Clone(key.Scopes)
+	if key.ExpiresAt != nil {
+		t := *key.ExpiresAt
+		c.ExpiresAt = &t
+	}
+	if key.LastUsedAt != nil {
+		t := *key.LastUsedAt
+		c.LastUsedAt = &t
+	}
+	return &c
+}
+
+func (s *InMemoryStore) CreateAPIKey(key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.apiKeys[key.ID]; ok {
+		return fmt.Errorf("api key %s already exists", key.ID)
+	}
+	for _, k := range s.apiKeys {
+		if k.KeyHash == key.KeyHash {
+			return fmt.Errorf("api key hash already in use")
+		}
+	}
+	stored := copyAPIKey(key)
+	stored.CreatedAt = key.CreatedAt.UTC()
+	if stored.ExpiresAt != nil {
+		*stored.ExpiresAt = stored.ExpiresAt.UTC()
+	}
+	stored.LastUsedAt = nil
+	s.apiKeys[key.ID] = stored
+	return nil
+}
+
+func (s *InMemoryStore) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.apiKeys {
+		if k.KeyHash == hash {
+			return copyAPIKey(k), nil
+		}
+	}
+	return nil, fmt.Errorf("api key not found")
+}
+
+// ListUserAPIKeys returns all API keys of a user, newest first
+func (s *InMemoryStore) ListUserAPIKeys(userID string) ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*APIKey
+	for _, k := range s.apiKeys {
+		if k.UserID == userID {
+			keys = append(keys, copyAPIKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// TouchAPIKey records when a key was last used
+func (s *InMemoryStore) TouchAPIKey(id string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.apiKeys[id]; ok {
+		t := usedAt.UTC()
+		k.LastUsedAt = &t
+	}
+	return nil
+}
+
+// DeleteAPIKey removes a key owned by userID
+func (s *InMemoryStore) DeleteAPIKey(id, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.apiKeys[id]
+	if !ok || k.UserID != userID {
+		return fmt.Errorf("api key not found")
+	}
+	delete(s.apiKeys, id)
+	return nil
+}
+
+// --- Auth: Email Tokens ---
+
+// CreateEmailToken stores the hash of an email verification or password reset token
+func (s *InMemoryStore) CreateEmailToken(hash, userID, purpose string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.emailTokens[hash]; ok {
+		return fmt.Errorf("email token already exists")
+	}
+	s.emailTokens[hash] = &emailToken{userID: userID, purpose: purpose, expiresAt: expiresAt.UTC()}
+	return nil
+}
+
+// ConsumeEmailToken marks an unused, unexpired token as used and returns its user.
+// Each token can be consumed once.
+func (s *InMemoryStore) ConsumeEmailToken(hash, purpose string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.emailTokens[hash]
+	if !ok || t.purpose != purpose || t.used || !t.expiresAt.After(now) {
+		return "", fmt.Errorf("token not found")
+	}
+	t.used = true
+	return t.userID, nil
+}
+
+// DeleteEmailTokens removes the outstanding tokens of a user for one purpose
+func (s *InMemoryStore) DeleteEmailTokens(userID, purpose string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, t := range s.emailTokens {
+		if t.userID == userID && t.purpose == purpose {
+			delete(s.emailTokens, hash)
+		}
+	}
+	return nil
+}
+
+// --- Auth: Login Challenges ---
+
+// CreateLoginChallenge stores a new challenge and drops expired ones
+func (s *InMemoryStore) CreateLoginChallenge(id, userID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for cid, ch := range s.challenges {
+		if ch.ExpiresAt.Before(now) {
+			delete(s.challenges, cid)
+		}
+	}
+	if _, ok := s.challenges[id]; ok {
+		return fmt.Errorf("login challenge %s already exists", id)
+	}
+	s.challenges[id] = &LoginChallenge{ID: id, UserID: userID, State: ChallengePending, ExpiresAt: expiresAt.UTC()}
+	return nil
+}
+
+// ClaimLoginChallenge atomically moves a pending, unexpired challenge with
+// attempts left into the verifying state and counts the attempt. It reports
+// whether the claim succeeded and returns the challenge as stored, or nil if
+// there is none. Only one code can be checked against a challenge at a time.
+func (s *InMemoryStore) ClaimLoginChallenge(id string, maxAttempts int, now time.Time) (*LoginChallenge, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.challenges[id]
+	if !ok {
+		return nil, false, nil
+	}
+	claimed := ch.State == ChallengePending && ch.Attempts < maxAttempts && ch.ExpiresAt.After(now)
+	if claimed {
+		ch.State = ChallengeVerifying
+		ch.Attempts++
+	}
+	c := *ch
+	return &c, claimed, nil
+}
+
+// FinishLoginChallenge ends a verification started by ClaimLoginChallenge.
+// A verified challenge is used up, otherwise it is pending again.
+func (s *InMemoryStore) FinishLoginChallenge(id string, verified bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.challenges[id]
+	if !ok || ch.State != ChallengeVerifying {
+		return nil
+	}
+	ch.State = ChallengePending
+	if verified {
+		ch.State = ChallengeUsed
+	}
+	return nil
+}
+
+// --- Auth: Two-Factor ---
+
+func (s *InMemoryStore) GetTOTP(userID string) (*TOTPSecret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[userID]
+	if !ok {
+		return nil, nil
+	}
+	c := *t
+	return &c, nil
+}
+
+// SetTOTP stores a (new) enrollment for the user, replacing any previous one
+func (s *InMemoryStore) SetTOTP(userID, secretEnc string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totp[userID] = &TOTPSecret{UserID: userID, SecretEnc: secretEnc, Enabled: enabled, CreatedAt: time.Now().UTC()}
+	return nil
+}
+
+// EnableTOTP activates a pending enrollment
+func (s *InMemoryStore) EnableTOTP(userID string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.totp[userID]; ok {
+		t.Enabled, t.LastUsedStep = true, step
+	}
+	return nil
+}
+
+// MarkTOTPStepUsed records the last accepted time step so a code can not be
+// replayed. It reports false if an equal or later step was already used.
+func (s *InMemoryStore) MarkTOTPStepUsed(userID string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[userID]
+	if !ok || t.LastUsedStep >= step {
+		return false, nil
+	}
+	t.LastUsedStep = step
+	return true, nil
+}
+
+// DeleteTOTP removes the enrollment and recovery codes of a user
+func (s *InMemoryStore) DeleteTOTP(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.totp, userID)
+	delete(s.recoveryCodes, userID)
+	return nil
+}
+
+// ReplaceRecoveryCodes discards the user's recovery codes and stores new hashes
+func (s *InMemoryStore) ReplaceRecoveryCodes(userID string, hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		if _, ok := codes[h]; ok {
+			return fmt.Errorf("duplicate recovery code")
+		}
+		codes[h] = false
+	}
+	s.recoveryCodes[userID] = codes
+	return nil
+}
+
+// UseRecoveryCode consumes an unused recovery code. It reports whether the code was valid.
+func (s *InMemoryStore) UseRecoveryCode(userID, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, ok := s.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	s.recoveryCodes[userID][hash] = true
+	return true, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (s *InMemoryStore) CountRecoveryCodes(userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, used := range s.recoveryCodes[userID] {
+		if !used {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// --- Auth: Login Protection ---
+
+// ReserveLoginAttempt counts an attempt against key, but only if the counter
+// is still as seen in prev (nil if there was none). It reports false when a
+// concurrent attempt changed the counter first, in which case the caller
+// should look again. The count starts over when the previous failure is
+// older than window.
+func (s *InMemoryStore) ReserveLoginAttempt(key string, prev *LoginFailure, now time.Time, window time.Duration) (*LoginFailure, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now = now.UTC()
+	f := &LoginFailure{Key: key, Failures: 1, FirstFailureAt: now, LastFailureAt: now}
+	stored, ok := s.loginFailures[key]
+
+	if prev == nil {
+		if ok {
+			return f, false, nil
+		}
+		c := *f
+		s.loginFailures[key] = &c
+		return f, true, nil
+	}
+
+	if !prev.LastFailureAt.Before(now.Add(-window)) {
+		f.Failures = prev.Failures + 1
+		f.FirstFailureAt = prev.FirstFailureAt.UTC()
+	}
+	if !ok || stored.Failures != prev.Failures || !stored.LastFailureAt.Equal(prev.LastFailureAt) {
+		return f, false, nil
+	}
+	*stored = *f
+	return f, true, nil
+}
+
+// ReleaseLoginAttempt takes one attempt off the counter of key again
+func (s *InMemoryStore) ReleaseLoginAttempt(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.loginFailures[key]; ok && f.Failures > 0 {
+		f.Failures--
+	}
+	return nil
+}
+
+// GetLoginFailure returns the failure counter of a key, or nil if there is none
+func (s *InMemoryStore) GetLoginFailure(key string) (*LoginFailure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.loginFailures[key]
+	if !ok {
+		return nil, nil
+	}
+	c := *f
+	return &c, nil
+}
+
+// ClearLoginFailures resets the failure counter of a key
+func (s *InMemoryStore) ClearLoginFailures(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.loginFailures, key)
+	return nil
+}
+
+// PruneLoginFailures drops counters whose last failure is before the cutoff
+func (s *InMemoryStore) PruneLoginFailures(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, f := range s.loginFailures {
+		if f.LastFailureAt.Before(before) {
+			delete(s.loginFailures, key)
+		}
+	}
+	return nil
+}
+
+// --- Activity Log ---
+
+func (s *InMemoryStore) AddActivity(a *Activity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *a
+	c.CreatedAt = a.CreatedAt.UTC()
+	s.activities = append(s.activities, &c)
+	return nil
+}
+
+// ListActivities returns a page of a user's activity, newest first, and the
+// total number of entries
+func (s *InMemoryStore) ListActivities(userID string, limit, offset int) ([]*Activity, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []*Activity
+	for _, a := range s.activities {
+		if a.UserID == userID {
+			c := *a
+			all = append(all, &c)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].CreatedAt.After(all[j].CreatedAt) })
+	return page(all, limit, offset), len(all), nil
+}
+
+// page returns the items of a page of a list
+func page[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// --- Transactions ---
+
+func copyTransaction(tx *Transaction) *Transaction {
+	c := *tx
+	return &c
+}
+
+func (s *InMemoryStore) transaction(id string) *Transaction {
+	for _, tx := range s.transactions {
+		if tx.ID == id {
+			return tx
+		}
+	}
+	return nil
+}
+
+// newest returns the transactions that match, newest first
+func (s *InMemoryStore) newest(match func(*Transaction) bool) []*Transaction {
+	var txs []*Transaction
+	for i := len(s.transactions) - 1; i >= 0; i-- {
+		if match(s.transactions[i]) {
+			txs = append(txs, copyTransaction(s.transactions[i]))
+		}
+	}
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].CreatedAt.After(txs[j].CreatedAt) })
+	return txs
+}
+
+func isRefund(tx *Transaction) bool {
+	return tx.Kind == TransactionRefund || tx.Kind == TransactionDepositRefund
+}
+
+func (s *InMemoryStore) CreateTransaction(tx *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createTransaction(tx)
+}
+
+func (s *InMemoryStore) createTransaction(tx *Transaction) error {
+	if s.transaction(tx.ID) != nil {
+		return fmt.Errorf("transaction %s already exists", tx.ID)
+	}
+	stored := copyTransaction(tx)
+	stored.Kind = transactionKind(tx)
+	stored.CreatedAt = tx.CreatedAt.UTC()
+	s.transactions = append(s.transactions, stored)
+	return nil
+}
+
+func (s *InMemoryStore) GetTransaction(id string) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.transaction(id)
+	if tx == nil {
+		return nil, sql.ErrNoRows
+	}
+	return copyTransaction(tx), nil
+}
+
+// SetTransactionGatewayRef stores the gateway's ID of a payment once the
+// gateway reports it
+func (s *InMemoryStore) SetTransactionGatewayRef(id, ref string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tx := s.transaction(id); tx != nil {
+		tx.GatewayRef = ref
+	}
+	return nil
+}
+
+// GetRefundByGatewayRef returns the refund the gateway knows by ref
+func (s *InMemoryStore) GetRefundByGatewayRef(method, ref string) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tx := range s.transactions {
+		if tx.PaymentMethod == method && tx.GatewayRef == ref && isRefund(tx) {
+			return copyTransaction(tx), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// GetDepositTransaction returns the latest payment of a user that included a
+// deposit, or nil if there is none
+func (s *InMemoryStore) GetDepositTransaction(userID string) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	txs := s.newest(func(tx *Transaction) bool { return tx.UserID == userID && tx.DepositAmount > 0 })
+	if len(txs) == 0 {
+		return nil, nil
+	}
+	return txs[0], nil
+}
+
+// SetDepositStatus moves the deposit of a payment to status if it is in one
+// of the from states. It reports whether it did.
+func (s *InMemoryStore) SetDepositStatus(id, status string, from ...string) (bool, error) {
+	if len(from) == 0 {
+		return false, fmt.Errorf("no deposit states to move from")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.transaction(id)
+	if tx == nil || !slices.Contains(from, tx.DepositStatus) {
+		return false, nil
+	}
+	tx.DepositStatus = status
+	return true, nil
+}
+
+// ListRefunds returns a page of refunds, newest first, of one user or of
+// everyone if userID is empty, and the total number of them
+func (s *InMemoryStore) ListRefunds(userID string, limit, offset int) ([]*Transaction, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refunds := s.newest(func(tx *Transaction) bool { return isRefund(tx) && (userID == "" || tx.UserID == userID) })
+	return page(refunds, limit, offset), len(refunds), nil
+}
+
+// RecordRefund stores a refund before it is sent to the gateway and books
+// its amount against the payment. A deposit refund also marks the deposit
+// refunded, and fails with billing.ErrDepositNotHeld if it is not held.
+// A refund larger than what is left of the payment fails with
+// billing.ErrRefundTooLarge.
+func (s *InMemoryStore) RecordRefund(refund *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payment := s.transaction(refund.RefundOf)
+	if payment == nil || payment.Kind != TransactionPayment || payment.RefundedAmount+refund.Amount > payment.Amount+0.005 {
+		return billing.ErrRefundTooLarge
+	}
+	deposit := refund.Kind == TransactionDepositRefund
+	if deposit && payment.DepositStatus != billing.DepositHeld && payment.DepositStatus != billing.DepositRefundScheduled {
+		return billing.ErrDepositNotHeld
+	}
+	if err := s.createTransaction(refund); err != nil {
+		return err
+	}
+
+	payment.RefundedAmount += refund.Amount
+	if deposit {
+		payment.DepositStatus = billing.DepositRefunded
+	}
+	return nil
+}
+
+// UpdateRefund stores the gateway's ID and the status of a refund
+func (s *InMemoryStore) UpdateRefund(id, status, gatewayRef string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tx := s.transaction(id); tx != nil && isRefund(tx) {
+		tx.Status, tx.GatewayRef = status, gatewayRef
+	}
+	return nil
+}
+
+// FailRefund marks a refund failed and gives its amount back to the payment.
+// The deposit of a failed deposit refund is held again.
+func (s *InMemoryStore) FailRefund(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refund := s.transaction(id)
+	if refund == nil {
+		return sql.ErrNoRows
+	}
+	if refund.Status == "failed" {
+		return nil
+	}
+
+	refund.Status = "failed"
+	if payment := s.transaction(refund.RefundOf); payment != nil {
+		payment.RefundedAmount = max(payment.RefundedAmount-refund.Amount, 0)
+		if refund.Kind == TransactionDepositRefund && payment.DepositStatus == billing.DepositRefunded {
+			payment.DepositStatus = billing.DepositHeld
+		}
+	}
+	return nil
+}
+
+// --- User Data ---
+
+// ExportUser returns everything kept about a user, as rows named after the
+// SQL schema
+func (s *InMemoryStore) ExportUser(id string) (*UserExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	out := &UserExport{UserID: id, ExportedAt: time.Now().UTC(), Tables: make(map[string][]map[string]any)}
+	add := func(table string, record map[string]any) {
+		out.Tables[table] = append(out.Tables[table], record)
+	}
+
+	add("users", map[string]any{"id": u.ID, "email": u.Email, "created_at": u.CreatedAt, "email_verified": u.EmailVerified})
+	for _, sub := range s.subscriptions {
+		if sub.UserID == id {
+			add("subscriptions", map[string]any{
+				"id": sub.ID, "plan_id": sub.PlanID, "plan_version": sub.PlanVersion, "status": sub.Status,
+				"start_date": sub.StartDate, "end_date": sub.EndDate, "auto_renew": sub.AutoRenew,
+				"scheduled_plan": sub.ScheduledPlan, "quota_mode": sub.QuotaMode, "currency": sub.Currency,
+			})
+		}
+	}
+	for key, p := range s.usage {
+		if key.userID == id {
+			add("usage_tracking", map[string]any{
+				"period_start": key.start, "period_end": key.end, "data_transferred_bytes": p.data,
+				"requests_made": p.requests, "ads_blocked": p.ads, "threats_blocked": p.threats,
+			})
+		}
+	}
+	for _, tx := range s.transactions {
+		if tx.UserID == id {
+			add("payment_transactions", map[string]any{
+				"id": tx.ID, "plan_id": tx.PlanID, "amount": tx.Amount, "currency": tx.Currency, "status": tx.Status,
+				"payment_method": tx.PaymentMethod, "created_at": tx.CreatedAt, "kind": tx.Kind,
+				"deposit_amount": tx.DepositAmount, "deposit_status": tx.DepositStatus,
+				"refunded_amount": tx.RefundedAmount, "refund_of": tx.RefundOf, "reason": tx.Reason,
+				"fx_rate": tx.FXRate, "amount_usd": tx.AmountUSD,
+			})
+		}
+	}
+	for _, sess := range s.sessions {
+		if sess.UserID == id {
+			add("sessions", map[string]any{
+				"id": sess.ID, "user_agent": sess.UserAgent, "ip_address": sess.IPAddress,
+				"created_at": sess.CreatedAt, "expires_at": sess.ExpiresAt, "last_used_at": sess.LastUsedAt,
+			})
+		}
+	}
+	for _, key := range s.apiKeys {
+		if key.UserID == id {
+			add("api_keys", map[string]any{
+				"id": key.ID, "name": key.Name, "prefix": key.Prefix, "scopes": strings.Join(key.Scopes, ","),
+				"expires_at": key.ExpiresAt, "last_used_at": key.LastUsedAt, "created_at": key.CreatedAt,
+			})
+		}
+	}
+	if t, ok := s.totp[id]; ok {
+		add("user_totp", map[string]any{"enabled": t.Enabled, "last_used_step": t.LastUsedStep, "created_at": t.CreatedAt})
+	}
+	for _, used := range s.recoveryCodes[id] {
+		add("recovery_codes", map[string]any{"used": used})
+	}
+	for _, a := range s.activities {
+		if a.UserID == id {
+			add("activity_log", map[string]any{
+				"id": a.ID, "type": a.Type, "status": a.Status, "details": a.Details,
+				"ip_address": a.IPAddress, "user_agent": a.UserAgent, "created_at": a.CreatedAt,
+			})
+		}
+	}
+	return out, nil
+}
+
+// DeleteUser deletes a user and everything kept about them but their
+// payments, which are anonymised. Session revocations stay until they
+// expire.
+func (s *InMemoryStore) DeleteUser(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	s.subscriptions = slices.DeleteFunc(s.subscriptions, func(sub *billing.PersistedSubscription) bool { return sub.UserID == id })
+	// Payments stay for the books, no longer saying whose they were
+	for _, tx := range s.transactions {
+		if tx.UserID == id {
+			tx.UserID = ""
+		}
+	}
+	s.activities = slices.DeleteFunc(s.activities, func(a *Activity) bool { return a.UserID == id })
+	maps.DeleteFunc(s.usage, func(key usageKey, _ *usagePeriod) bool { return key.userID == id })
+	maps.DeleteFunc(s.sessions, func(_ string, sess *Session) bool { return sess.UserID == id })
+	maps.DeleteFunc(s.rotatedTokens, func(_ string, t rotatedToken) bool {
+		_, ok := s.sessions[t.sessionID]
+		return !ok
+	})
+	maps.DeleteFunc(s.apiKeys, func(_ string, key *APIKey) bool { return key.UserID == id })
+	maps.DeleteFunc(s.emailTokens, func(_ string, t *emailToken) bool { return t.userID == id })
+	maps.DeleteFunc(s.challenges, func(_ string, ch *LoginChallenge) bool { return ch.UserID == id })
+	delete(s.totp, id)
+	delete(s.recoveryCodes, id)
+	delete(s.loginFailures, "email:"+strings.ToLower(u.Email))
+	delete(s.userByEmail, u.Email)
+	delete(s.users, id)
+	return nil
+}
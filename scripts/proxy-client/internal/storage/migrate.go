@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are SQL files embedded per dialect under migrations/<dialect>,
+// named <version>_<name>.up.sql and <version>_<name>.down.sql. Versions
+// run from 1 without gaps. Each migration runs in a transaction
+// and is recorded in schema_migrations with the checksum of its up script,
+// so a migration edited after it was applied is noticed.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Dialect is the SQL dialect of a database
+type Dialect string
+
+const (
+	DialectSQLite   Dialect = "sqlite"
+	DialectPostgres Dialect = "postgres"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("migration was changed after it was applied")
+	ErrUnknownMigration = errors.New("database has a migration this release does not know")
+)
+
+// Migration is one version of the schema
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // sha256 of Up
+}
+
+// MigrationStatus is a migration and whether it was applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	// Modified is set when the applied migration differs from this release's
+	Modified bool
+	// Unknown is set for applied migrations this release does not have
+	Unknown bool
+}
+
+// Migrator applies and reverts the migrations of a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// NewMigrator returns a migrator for the embedded migrations of a dialect
+func NewMigrator(db *sql.DB, dialect Dialect) (*Migrator, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// loadMigrations reads the embedded migrations of a dialect, sorted by version
+func loadMigrations(dialect Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", string(dialect))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %s: %w", dialect, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		base, up := strings.CutSuffix(name, ".up.sql")
+		if !up {
+			var down bool
+			if base, down = strings.CutSuffix(name, ".down.sql"); !down {
+				continue
+			}
+		}
+		num, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, label)
+		}
+		if up {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down script", m.Version, m.Name)
+		}
+		sum := sha256.Sum256([]byte(m.Up))
+		m.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrations returns the migrations of this release
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// rebind turns ? placeholders into the dialect's
+func (m *Migrator) rebind(query string) string {
+	return rebind(m.dialect, query)
+}
+
+// ensureTable creates schema_migrations
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// applied returns the applied migrations by version
+func (m *Migrator) applied() (map[int]appliedMigration, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.Query(`SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		var at string
+		if err := rows.Scan(&a.version, &a.name, &a.checksum, &at); err != nil {
+			return nil, err
+		}
+		a.appliedAt, _ = time.Parse(time.RFC3339, at)
+		out[a.version] = a
+	}
+	return out, rows.Err()
+}
+
+// Version returns the latest applied migration, 0 if there is none
+func (m *Migrator) Version() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+// Status lists the migrations of this release and the applied ones it does
+// not know, by version
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []MigrationStatus
+	for _, mig := range m.migrations {
+		st := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if a, ok := applied[mig.Version]; ok {
+			at := a.appliedAt
+			st.AppliedAt = &at
+			st.Modified = a.checksum != mig.Checksum
+			delete(applied, mig.Version)
+		}
+		out = append(out, st)
+	}
+	for _, a := range applied {
+		at := a.appliedAt
+		out = append(out, MigrationStatus{Version: a.version, Name: a.name, AppliedAt: &at, Unknown: true})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Verify checks that every applied migration is one of this release,
+// unchanged
+func (m *Migrator) Verify() error {
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	for _, st := range status {
+		switch {
+		case st.Unknown:
+			return fmt.Errorf("%w: %d_%s", ErrUnknownMigration, st.Version, st.Name)
+		case st.Modified:
+			return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, st.Version, st.Name)
+		}
+	}
+	return nil
+}
+
+// Up applies the pending migrations and returns how many it applied. The
+// applied migrations are verified first.
+func (m *Migrator) Up() (int, error) {
+	return m.UpTo(m.Latest())
+}
+
+// Latest returns the version of the newest migration of this release
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// UpTo applies the pending migrations up to and including version, and
+// returns how many it applied
+func (m *Migrator) UpTo(version int) (int, error) {
+	if err := m.Verify(); err != nil {
+		return 0, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	if m.dialect == DialectSQLite && len(applied) == 0 {
+		if err := upgradeLegacySchema(m.db); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok || mig.Version > version {
+			continue
+		}
+		if err := m.run(mig, true); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Down reverts the latest steps applied migrations and returns how many it
+// reverted
+func (m *Migrator) Down(steps int) (int, error) {
+	if err := m.Verify(); err != nil {
+		return 0, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := len(m.migrations) - 1; i >= 0 && n < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		if err := m.run(mig, false); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Redo reverts the latest applied migration and applies it again
+func (m *Migrator) Redo() error {
+	n, err := m.Down(1)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("no migration to redo")
+	}
+	_, err = m.Up()
+	return err
+}
+
+// run applies or reverts a migration in a transaction
+func (m *Migrator) run(mig Migration, up bool) error {
+	direction, script := "apply", mig.Up
+	if !up {
+		direction, script = "revert", mig.Down
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return fmt.Errorf("failed to %s migration %d_%s: %w", direction, mig.Version, mig.Name, err)
+	}
+	if up {
+		_, err = tx.Exec(m.rebind(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`),
+			mig.Version, mig.Name, mig.Checksum, time.Now().UTC().Format(time.RFC3339))
+	} else {
+		_, err = tx.Exec(m.rebind(`DELETE FROM schema_migrations WHERE version = ?`), mig.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d_%s: %w", mig.Version, mig.Name, err)
+	}
+	return tx.Commit()
+}
+
+// OpenDatabase opens a database without migrating it: a postgres:// URL, or
+// else the path of a SQLite database, the default one if empty
+func OpenDatabase(url string) (*sql.DB, Dialect, error) {
+	if isPostgresURL(url) {
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to open database: %w", err)
+		}
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return nil, "", fmt.Errorf("failed to ping database: %w", err)
+		}
+		return db, DialectPostgres, nil
+	}
+
+	dbPath, err := sqlitePath(url)
+	if err != nil {
+		return nil, "", err
+	}
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		db.Close()
+		return nil, "", err
+	}
+	return db, DialectSQLite, nil
+}
+
+// isPostgresURL reports whether a database URL selects Postgres
+func isPostgresURL(url string) bool {
+	return strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://")
+}
+
+// sqlitePath returns the path of the SQLite database a URL selects, the
+// default one if empty
+func sqlitePath(url string) (string, error) {
+	if dbPath := strings.TrimPrefix(url, "sqlite://"); dbPath != "" {
+		return dbPath, nil
+	}
+	return DefaultPath()
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	for _, dialect := range []Dialect{DialectSQLite, DialectPostgres} {
+		migrations, err := loadMigrations(dialect)
+		if err != nil {
+			t.Fatalf("Failed to load %s migrations: %v", dialect, err)
+		}
+		if len(migrations) == 0 || migrations[0].Version != 1 {
+			t.Fatalf("Expected %s migrations from version 1, got %+v", dialect, migrations)
+		}
+		for i := 1; i < len(migrations); i++ {
+			if migrations[i].Version != migrations[i-1].Version+1 {
+				t.Errorf("Expected %s migrations numbered without gaps, got %d after %d", dialect, migrations[i].Version, migrations[i-1].Version)
+			}
+		}
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.Close()
+
+	db, dialect, err := OpenDatabase("sqlite://" + dbPath)
+	if err != nil || dialect != DialectSQLite {
+		t.Fatalf("OpenDatabase failed: %s, %v", dialect, err)
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+
+	status, err := migrator.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	for _, st := range status {
+		if st.AppliedAt == nil || st.Modified || st.Unknown {
+			t.Errorf("Expected %d_%s applied, got %+v", st.Version, st.Name, st)
+		}
+	}
+	if n, err := migrator.Up(); err != nil || n != 0 {
+		t.Errorf("Expected nothing pending, got %d (err %v)", n, err)
+	}
+
+	// Reverting everything drops the tables
+	if n, err := migrator.Down(len(status)); err != nil || n != len(status) {
+		t.Fatalf("Down failed: %d, %v", n, err)
+	}
+	if version, _ := migrator.Version(); version != 0 || tableExists(t, db, "users") {
+		t.Errorf("Expected an empty schema, got version %d", version)
+	}
+	if n, err := migrator.Up(); err != nil || n != len(status) {
+		t.Fatalf("Up failed: %d, %v", n, err)
+	}
+	if err := migrator.Redo(); err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	if !tableExists(t, db, "subusers") {
+		t.Error("Expected the schema back after redo")
+	}
+}
+
+func TestMigrationVerification(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.db.Exec(`UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1`)
+	store.Close()
+	if _, err := NewStoreWithPath(dbPath); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected an edited migration to be refused, got %v", err)
+	}
+
+	dbPath = filepath.Join(t.TempDir(), "newer.db")
+	store, _ = NewStoreWithPath(dbPath)
+	store.db.Exec(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (999, 'future', 'x', '2030-01-01T00:00:00Z')`)
+	store.Close()
+	if _, err := NewStoreWithPath(dbPath); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("Expected a newer database to be refused, got %v", err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	// A database from before migrations were versioned, missing columns
+	// added since
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, q := range []string{
+		`CREATE TABLE users (id TEXT PRIMARY KEY, email TEXT UNIQUE NOT NULL, password_hash TEXT NOT NULL, created_at DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`CREATE TABLE payment_transactions (id TEXT PRIMARY KEY, user_id TEXT REFERENCES users(id), plan_id TEXT NOT NULL,
+			amount REAL NOT NULL, currency TEXT NOT NULL, status TEXT NOT NULL, payment_method TEXT NOT NULL, created_at DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO users (id, email, password_hash) VALUES ('user-1', 'old@example.com', 'hash')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Failed to create legacy schema: %v", err)
+		}
+	}
+	db.Close()
+
+	store, err := NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Expected the legacy database to be migrated, got %v", err)
+	}
+	defer store.Close()
+	if err := store.MarkEmailVerified("user-1"); err != nil {
+		t.Errorf("Expected added columns to be usable, got %v", err)
+	}
+	if u, err := store.GetUserByEmail("old@example.com"); err != nil || u.ID != "user-1" {
+		t.Errorf("Expected existing users kept, got %+v, %v", u, err)
+	}
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+		t.Fatalf("Failed to inspect schema: %v", err)
+	}
+	return n > 0
+}
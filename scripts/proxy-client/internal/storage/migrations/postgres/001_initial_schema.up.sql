@@ -1,5 +1,5 @@
--- PostgreSQL Migration Script
--- Converts SQLite schema to PostgreSQL
+-- The first schema: users, plans, subscriptions, usage and payments.
+-- Amounts are stored in cents.
 
 -- Users table
 CREATE TABLE IF NOT EXISTS users (
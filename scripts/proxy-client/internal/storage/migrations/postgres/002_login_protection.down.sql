@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS activity_log;
+DROP TABLE IF EXISTS login_failures;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_subscriptions_end_date;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS pending_ref;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS currency;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS payment_auth;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS retry_count;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS next_retry_at;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS grace_until;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS last_reset;
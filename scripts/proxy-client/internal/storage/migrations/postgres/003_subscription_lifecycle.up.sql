@@ -0,0 +1,10 @@
+-- Subscription lifecycle: renewals, grace periods and idempotent quota resets
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS last_reset TEXT;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS grace_until TEXT;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS next_retry_at TEXT;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS retry_count INTEGER DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS payment_auth TEXT DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS currency TEXT DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS pending_ref TEXT DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_end_date ON subscriptions(end_date);
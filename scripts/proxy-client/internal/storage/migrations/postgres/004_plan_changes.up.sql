@@ -0,0 +1,2 @@
+-- Plan changes: downgrades scheduled for the end of the period
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS scheduled_plan TEXT DEFAULT '';
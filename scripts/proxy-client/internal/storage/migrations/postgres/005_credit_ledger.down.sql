@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS credit_entries;
+DROP TABLE IF EXISTS credit_transactions;
@@ -0,0 +1,18 @@
+-- Pay-as-you-go credits: a double-entry ledger in micro-USD
+CREATE TABLE IF NOT EXISTS credit_transactions (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    reference TEXT NOT NULL UNIQUE,
+    description TEXT DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS credit_entries (
+    id BIGSERIAL PRIMARY KEY,
+    txn_id TEXT NOT NULL REFERENCES credit_transactions(id),
+    account TEXT NOT NULL,
+    amount BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_credit_entries_account ON credit_entries(account, id DESC);
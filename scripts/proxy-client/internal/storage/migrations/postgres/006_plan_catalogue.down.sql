@@ -0,0 +1,8 @@
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS plan_version;
+
+DROP TABLE IF EXISTS plan_versions;
+
+ALTER TABLE plans DROP COLUMN IF EXISTS active;
+ALTER TABLE plans DROP COLUMN IF EXISTS version;
+ALTER TABLE plans DROP COLUMN IF EXISTS flags;
+ALTER TABLE plans DROP COLUMN IF EXISTS price_annual_cents;
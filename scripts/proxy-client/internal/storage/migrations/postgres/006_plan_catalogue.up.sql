@@ -0,0 +1,16 @@
+-- Plan catalogue: plans carry their feature flags and are versioned so that
+-- subscribers keep the terms they signed up for
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS price_annual_cents INTEGER DEFAULT 0;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS flags JSONB DEFAULT '{}';
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS version INTEGER DEFAULT 1;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS active BOOLEAN DEFAULT TRUE;
+
+CREATE TABLE IF NOT EXISTS plan_versions (
+    plan_id TEXT NOT NULL REFERENCES plans(id),
+    version INTEGER NOT NULL,
+    terms JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (plan_id, version)
+);
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS plan_version INTEGER DEFAULT 1;
@@ -0,0 +1,35 @@
+-- Webhook deliveries are stored before they are processed, deduplicated by
+-- the provider's event key, and retried until they succeed or go dead.
+-- Scheduled actions such as deposit refunds are persisted as jobs.
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    event_key TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT DEFAULT '',
+    next_attempt_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    processed_at TEXT DEFAULT '',
+    UNIQUE (provider, event_key)
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    job_key TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT DEFAULT '',
+    run_at TEXT NOT NULL,
+    next_attempt_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    processed_at TEXT DEFAULT '',
+    UNIQUE (kind, job_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_events_due ON webhook_events(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_jobs_due ON jobs(status, next_attempt_at);
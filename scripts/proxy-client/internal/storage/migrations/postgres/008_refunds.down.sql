@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_tx_gateway_ref;
+
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS reason;
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS refund_of;
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS refunded_cents;
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS deposit_status;
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS deposit_cents;
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,11 @@
+-- Refunds: refunds are payment transactions of their own that point at the
+-- payment they return money from. Trial payments carry a deposit whose
+-- state is tracked on the payment.
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS kind TEXT DEFAULT 'payment';
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS deposit_cents INTEGER DEFAULT 0;
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS deposit_status TEXT DEFAULT '';
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS refunded_cents INTEGER DEFAULT 0;
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS refund_of TEXT DEFAULT '';
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS reason TEXT DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_tx_gateway_ref ON payment_transactions(gateway, gateway_ref_id);
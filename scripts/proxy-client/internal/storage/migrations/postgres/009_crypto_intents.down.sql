@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS crypto_address_index;
+DROP TABLE IF EXISTS crypto_intents;
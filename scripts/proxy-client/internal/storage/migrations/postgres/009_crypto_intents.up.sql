@@ -0,0 +1,31 @@
+-- Crypto checkouts: each is paid to its own address derived from the
+-- wallet's extended public key, for an amount quoted until expires_at.
+-- Amounts are in the asset's base unit (satoshi, gwei).
+CREATE TABLE IF NOT EXISTS crypto_intents (
+    id TEXT PRIMARY KEY,
+    user_id TEXT DEFAULT '',
+    email TEXT DEFAULT '',
+    plan_id TEXT DEFAULT '',
+    metadata TEXT DEFAULT '{}',
+    asset TEXT NOT NULL,
+    address TEXT NOT NULL UNIQUE,
+    address_index INTEGER NOT NULL,
+    amount_usd NUMERIC(12, 2) NOT NULL,
+    amount BIGINT NOT NULL,
+    rate DOUBLE PRECISION NOT NULL,
+    received BIGINT DEFAULT 0,
+    confirmations INTEGER DEFAULT 0,
+    tx_ids TEXT DEFAULT '[]',
+    status TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    paid_at TEXT DEFAULT '',
+    UNIQUE (asset, address_index)
+);
+
+CREATE TABLE IF NOT EXISTS crypto_address_index (
+    asset TEXT PRIMARY KEY,
+    next_index INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_crypto_intents_status ON crypto_intents(status, expires_at);
@@ -0,0 +1,5 @@
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS amount_usd_cents;
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS fx_rate;
+
+DROP TABLE IF EXISTS price_quotes;
+DROP TABLE IF EXISTS exchange_rates;
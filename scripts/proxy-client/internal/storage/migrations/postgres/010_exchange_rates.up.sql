@@ -0,0 +1,20 @@
+-- Exchange rates: the last rates fetched are kept as a fallback, and every
+-- checkout and renewal locks the price it was charged at. Payments record
+-- the rate and the USD amount they were charged at.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    currency TEXT PRIMARY KEY,
+    rate DOUBLE PRECISION NOT NULL,
+    fetched_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS price_quotes (
+    reference TEXT PRIMARY KEY,
+    currency TEXT NOT NULL,
+    rate DOUBLE PRECISION NOT NULL,
+    amount_usd NUMERIC(12, 2) NOT NULL,
+    amount NUMERIC(14, 2) NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS fx_rate DOUBLE PRECISION DEFAULT 0;
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS amount_usd_cents INTEGER DEFAULT 0;
@@ -0,0 +1,45 @@
+-- Invoicing: every payment is invoiced once under a number that runs
+-- without gaps within its year (INV-2026-000001), taxed by the customer's
+-- billing profile, and rendered to a PDF that is stored as issued. Amounts
+-- are in the invoice's currency; lines and the customer are kept as JSON
+-- as they were when the invoice was issued.
+CREATE TABLE IF NOT EXISTS billing_profiles (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    name TEXT NOT NULL DEFAULT '',
+    company TEXT NOT NULL DEFAULT '',
+    tax_id TEXT NOT NULL DEFAULT '',
+    address TEXT NOT NULL DEFAULT '',
+    city TEXT NOT NULL DEFAULT '',
+    postal_code TEXT NOT NULL DEFAULT '',
+    country TEXT NOT NULL DEFAULT '',
+    updated_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS invoice_sequences (
+    year INTEGER PRIMARY KEY,
+    last_number INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS invoices (
+    id TEXT PRIMARY KEY,
+    number TEXT NOT NULL UNIQUE,
+    user_id TEXT REFERENCES users(id),
+    transaction_id TEXT NOT NULL UNIQUE,
+    email TEXT NOT NULL,
+    customer TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    lines TEXT NOT NULL,
+    subtotal NUMERIC(14, 2) NOT NULL,
+    tax_name TEXT NOT NULL DEFAULT '',
+    tax_rate NUMERIC(6, 4) NOT NULL DEFAULT 0,
+    tax_amount NUMERIC(14, 2) NOT NULL DEFAULT 0,
+    reverse_charge BOOLEAN NOT NULL DEFAULT FALSE,
+    total NUMERIC(14, 2) NOT NULL,
+    period_start TEXT,
+    period_end TEXT,
+    issued_at TEXT NOT NULL,
+    emailed_at TEXT,
+    pdf BYTEA
+);
+
+CREATE INDEX IF NOT EXISTS idx_invoices_user ON invoices(user_id, issued_at DESC);
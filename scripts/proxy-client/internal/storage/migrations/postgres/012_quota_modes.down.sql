@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS quota_periods;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS quota_mode;
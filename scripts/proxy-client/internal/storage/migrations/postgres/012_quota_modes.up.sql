@@ -0,0 +1,21 @@
+-- Quota modes: once a plan's data limit is used, a subscription either stops
+-- (hard), carries on with the overage billed per GB with the renewal (soft),
+-- or carries on at the plan's throttled bandwidth (throttle). The overage
+-- rate and throttle are part of each plan version's terms. Each period keeps
+-- its overage in USD, the highest usage warning sent (80, 100 or 120 percent)
+-- and the renewal charge that billed the overage.
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS quota_mode TEXT DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS quota_periods (
+    subscription_id TEXT NOT NULL,
+    period_start TEXT NOT NULL,
+    user_id TEXT REFERENCES users(id),
+    overage_bytes BIGINT NOT NULL DEFAULT 0,
+    overage_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+    warned INTEGER NOT NULL DEFAULT 0,
+    reference TEXT NOT NULL DEFAULT '',
+    billed_usd NUMERIC(12, 2) NOT NULL DEFAULT 0,
+    PRIMARY KEY (subscription_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_quota_periods_reference ON quota_periods(reference);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS referrals;
+DROP TABLE IF EXISTS referral_codes;
+DROP TABLE IF EXISTS coupon_redemptions;
+DROP TABLE IF EXISTS coupons;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS coupon;
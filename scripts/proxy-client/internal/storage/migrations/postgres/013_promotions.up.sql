@@ -0,0 +1,53 @@
+-- Promotions: coupons take a percent or fixed discount off plan checkouts,
+-- optionally only for some plans, a number of redemptions, until a date or
+-- for the first period only. Each discounted payment is a redemption under
+-- its reference, pending until paid. A recurring coupon is kept on the
+-- subscription and discounts its renewals. Every user has a referral code;
+-- a referral is rewarded with credits to both users on the referee's first
+-- payment.
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS coupon TEXT DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS coupons (
+    code TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    value NUMERIC(12, 2) NOT NULL,
+    plans TEXT NOT NULL DEFAULT '',
+    max_redemptions INTEGER NOT NULL DEFAULT 0,
+    redemptions INTEGER NOT NULL DEFAULT 0,
+    expires_at TEXT,
+    first_period_only BOOLEAN NOT NULL DEFAULT FALSE,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    reference TEXT PRIMARY KEY,
+    code TEXT NOT NULL REFERENCES coupons(code),
+    user_id TEXT REFERENCES users(id),
+    plan_id TEXT NOT NULL,
+    discount_usd NUMERIC(12, 2) NOT NULL,
+    renewal BOOLEAN NOT NULL DEFAULT FALSE,
+    status TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    redeemed_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS referral_codes (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    code TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS referrals (
+    referee_id TEXT PRIMARY KEY REFERENCES users(id),
+    referrer_id TEXT NOT NULL REFERENCES users(id),
+    code TEXT NOT NULL,
+    status TEXT NOT NULL,
+    reference TEXT NOT NULL DEFAULT '',
+    reward_usd NUMERIC(12, 2) NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL,
+    rewarded_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_redemptions_code ON coupon_redemptions(code, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_redemptions_user ON coupon_redemptions(user_id, code);
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON referrals(referrer_id, created_at DESC);
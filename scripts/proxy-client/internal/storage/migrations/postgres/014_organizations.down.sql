@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS org_member_usage;
+DROP TABLE IF EXISTS org_invitations;
+DROP TABLE IF EXISTS org_members;
+DROP TABLE IF EXISTS organizations;
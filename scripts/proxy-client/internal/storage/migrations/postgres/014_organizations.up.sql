@@ -0,0 +1,48 @@
+-- Organizations: a team shares one subscription and quota, kept on the
+-- account of the user who created the organization. Every user is a member
+-- of one organization at most, as owner, admin, billing or member, and may
+-- have their own data and connection limits within the shared quota. Members
+-- join by accepting an emailed invitation. What each member used of a period
+-- is kept for the organization's usage breakdown.
+--
+-- Plans offer seats through the "seats" flag of their terms. Plans seeded
+-- before it existed have none; publish a new version of Team and Enterprise
+-- with seats to offer organizations on existing databases.
+CREATE TABLE IF NOT EXISTS organizations (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    owner_id TEXT NOT NULL REFERENCES users(id),
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS org_members (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    org_id TEXT NOT NULL REFERENCES organizations(id),
+    role TEXT NOT NULL,
+    data_limit_mb BIGINT NOT NULL DEFAULT 0,
+    max_connections INTEGER NOT NULL DEFAULT 0,
+    joined_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS org_invitations (
+    id TEXT PRIMARY KEY,
+    org_id TEXT NOT NULL REFERENCES organizations(id),
+    email TEXT NOT NULL,
+    role TEXT NOT NULL,
+    invited_by TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TEXT NOT NULL,
+    accepted_at TEXT,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS org_member_usage (
+    org_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    period_start TEXT NOT NULL,
+    data_transferred BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (org_id, user_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_org_members_org ON org_members(org_id);
+CREATE INDEX IF NOT EXISTS idx_org_invitations_org ON org_invitations(org_id, accepted_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS subuser_usage;
+DROP TABLE IF EXISTS subusers;
@@ -0,0 +1,31 @@
+-- Sub-users: an account on a plan with the "sub_users" flag may resell it
+-- through sub-users with generated proxy credentials. Each may be capped in
+-- data, requests, concurrent connections and exit countries within the
+-- parent's quota; their usage is billed on the parent's account and kept
+-- per period for usage reports.
+--
+-- Plans seeded before the flag existed have none; publish a new version of
+-- Enterprise with sub_users to offer them on existing databases.
+CREATE TABLE IF NOT EXISTS subusers (
+    id TEXT PRIMARY KEY,
+    parent_id TEXT NOT NULL REFERENCES users(id),
+    label TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    data_limit_mb BIGINT NOT NULL DEFAULT 0,
+    request_limit BIGINT NOT NULL DEFAULT 0,
+    max_connections INTEGER NOT NULL DEFAULT 0,
+    countries TEXT NOT NULL DEFAULT '',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS subuser_usage (
+    subuser_id TEXT NOT NULL,
+    period_start TEXT NOT NULL,
+    data_transferred BIGINT NOT NULL DEFAULT 0,
+    requests_made BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (subuser_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_subusers_parent ON subusers(parent_id, created_at);
@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS adblock_custom;
+DROP TABLE IF EXISTS adblock_whitelist;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+DROP TABLE IF EXISTS login_challenges;
+DROP TABLE IF EXISTS email_tokens;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS rotated_refresh_tokens;
+DROP TABLE IF EXISTS session_revocations;
+
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at;
+ALTER TABLE sessions DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE sessions RENAME COLUMN token TO session_token;
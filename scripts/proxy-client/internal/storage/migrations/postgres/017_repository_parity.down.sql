@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_tx_user_created;
+DROP INDEX IF EXISTS idx_subscriptions_stripe;
+
+ALTER TABLE payment_transactions DROP COLUMN IF EXISTS plan_id;
+
+ALTER TABLE subscriptions ALTER COLUMN end_date TYPE TIMESTAMP
+    USING NULLIF(end_date, '')::timestamp;
+ALTER TABLE subscriptions ALTER COLUMN start_date TYPE TIMESTAMP
+    USING NULLIF(start_date, '')::timestamp;
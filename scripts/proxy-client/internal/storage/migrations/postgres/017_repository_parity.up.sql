@@ -0,0 +1,11 @@
+-- Repository parity: subscriptions keep their period as RFC 3339 text and
+-- payments record the plan they bought, as on SQLite.
+ALTER TABLE subscriptions ALTER COLUMN start_date TYPE TEXT
+    USING to_char(start_date, 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+ALTER TABLE subscriptions ALTER COLUMN end_date TYPE TEXT
+    USING to_char(end_date, 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+
+ALTER TABLE payment_transactions ADD COLUMN IF NOT EXISTS plan_id TEXT DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_stripe ON subscriptions(stripe_sub_id);
+CREATE INDEX IF NOT EXISTS idx_tx_user_created ON payment_transactions(user_id, created_at DESC);
@@ -0,0 +1,40 @@
+DROP TABLE IF EXISTS subuser_usage;
+DROP TABLE IF EXISTS subusers;
+DROP TABLE IF EXISTS org_member_usage;
+DROP TABLE IF EXISTS org_invitations;
+DROP TABLE IF EXISTS org_members;
+DROP TABLE IF EXISTS organizations;
+DROP TABLE IF EXISTS referrals;
+DROP TABLE IF EXISTS referral_codes;
+DROP TABLE IF EXISTS coupon_redemptions;
+DROP TABLE IF EXISTS coupons;
+DROP TABLE IF EXISTS plan_versions;
+DROP TABLE IF EXISTS quota_periods;
+DROP TABLE IF EXISTS invoices;
+DROP TABLE IF EXISTS invoice_sequences;
+DROP TABLE IF EXISTS billing_profiles;
+DROP TABLE IF EXISTS price_quotes;
+DROP TABLE IF EXISTS exchange_rates;
+DROP TABLE IF EXISTS crypto_address_index;
+DROP TABLE IF EXISTS crypto_intents;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS webhook_events;
+DROP TABLE IF EXISTS adblock_custom;
+DROP TABLE IF EXISTS adblock_whitelist;
+DROP TABLE IF EXISTS credit_entries;
+DROP TABLE IF EXISTS credit_transactions;
+DROP TABLE IF EXISTS payment_transactions;
+DROP TABLE IF EXISTS activity_log;
+DROP TABLE IF EXISTS login_failures;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+DROP TABLE IF EXISTS login_challenges;
+DROP TABLE IF EXISTS email_tokens;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS rotated_refresh_tokens;
+DROP TABLE IF EXISTS session_revocations;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS usage_tracking;
+DROP TABLE IF EXISTS subscriptions;
+DROP TABLE IF EXISTS plans;
+DROP TABLE IF EXISTS users;
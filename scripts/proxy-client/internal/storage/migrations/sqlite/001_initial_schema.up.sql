@@ -0,0 +1,459 @@
+-- The schema as of the first versioned release. Databases created before
+-- schema_migrations existed already have some of these tables, so every
+-- statement is idempotent; the columns added to them over time are added
+-- before this runs (see upgradeLegacySchema).
+CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY,
+    email TEXT UNIQUE NOT NULL,
+    password_hash TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    email_verified_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS plans (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    price_cents INTEGER NOT NULL,
+    currency TEXT DEFAULT 'USD',
+    data_quota_mb INTEGER NOT NULL,
+    request_limit INTEGER NOT NULL,
+    concurrent_conns INTEGER NOT NULL,
+    features TEXT,
+    price_annual_cents INTEGER DEFAULT 0,
+    flags TEXT DEFAULT '{}',
+    version INTEGER DEFAULT 1,
+    active BOOLEAN DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    plan_id TEXT REFERENCES plans(id),
+    status TEXT NOT NULL,
+    stripe_sub_id TEXT,
+    start_date DATETIME NOT NULL,
+    end_date DATETIME NOT NULL,
+    auto_renew BOOLEAN DEFAULT TRUE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_reset TEXT,
+    grace_until TEXT,
+    next_retry_at TEXT,
+    retry_count INTEGER DEFAULT 0,
+    payment_auth TEXT DEFAULT '',
+    currency TEXT DEFAULT '',
+    pending_ref TEXT DEFAULT '',
+    scheduled_plan TEXT DEFAULT '',
+    plan_version INTEGER DEFAULT 1,
+    quota_mode TEXT DEFAULT '',
+    coupon TEXT DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS usage_tracking (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT REFERENCES users(id),
+    period_start DATETIME NOT NULL,
+    period_end DATETIME NOT NULL,
+    data_transferred_bytes INTEGER DEFAULT 0,
+    requests_made INTEGER DEFAULT 0,
+    ads_blocked INTEGER DEFAULT 0,
+    threats_blocked INTEGER DEFAULT 0,
+    UNIQUE(user_id, period_start, period_end)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    token TEXT UNIQUE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    user_agent TEXT DEFAULT '',
+    ip_address TEXT DEFAULT '',
+    last_used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS session_revocations (
+    session_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rotated_refresh_tokens (
+    token TEXT PRIMARY KEY,
+    session_id TEXT NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    key_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT NOT NULL,
+    expires_at DATETIME,
+    last_used_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS email_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    purpose TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    attempts INTEGER DEFAULT 0,
+    state TEXT NOT NULL DEFAULT 'pending',
+    expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    secret_enc TEXT NOT NULL,
+    enabled BOOLEAN DEFAULT FALSE,
+    last_used_step INTEGER DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    enabled_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT REFERENCES users(id),
+    code_hash TEXT NOT NULL,
+    used_at DATETIME,
+    UNIQUE(user_id, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS login_failures (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    first_failure_at DATETIME NOT NULL,
+    last_failure_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS activity_log (
+    id TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    type TEXT NOT NULL,
+    status TEXT NOT NULL,
+    details TEXT NOT NULL,
+    ip_address TEXT DEFAULT '',
+    user_agent TEXT DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS payment_transactions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    plan_id TEXT NOT NULL,
+    amount REAL NOT NULL,
+    currency TEXT NOT NULL,
+    status TEXT NOT NULL,
+    payment_method TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    gateway_ref TEXT,
+    kind TEXT DEFAULT 'payment',
+    deposit_amount REAL DEFAULT 0,
+    deposit_status TEXT DEFAULT '',
+    refunded_amount REAL DEFAULT 0,
+    refund_of TEXT DEFAULT '',
+    reason TEXT DEFAULT '',
+    fx_rate REAL DEFAULT 0,
+    amount_usd REAL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS credit_transactions (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    reference TEXT NOT NULL UNIQUE,
+    description TEXT DEFAULT '',
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS credit_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    txn_id TEXT NOT NULL REFERENCES credit_transactions(id),
+    account TEXT NOT NULL,
+    amount INTEGER NOT NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS adblock_whitelist (
+    domain TEXT PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS adblock_custom (
+    domain TEXT PRIMARY KEY
+);
+
+-- Webhook deliveries, deduplicated by provider and event key
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    event_key TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT DEFAULT '',
+    next_attempt_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    processed_at TEXT DEFAULT '',
+    UNIQUE (provider, event_key)
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    job_key TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT DEFAULT '',
+    run_at TEXT NOT NULL,
+    next_attempt_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    processed_at TEXT DEFAULT '',
+    UNIQUE (kind, job_key)
+);
+
+-- Crypto checkouts, each paid to its own derived address
+CREATE TABLE IF NOT EXISTS crypto_intents (
+    id TEXT PRIMARY KEY,
+    user_id TEXT DEFAULT '',
+    email TEXT DEFAULT '',
+    plan_id TEXT DEFAULT '',
+    metadata TEXT DEFAULT '{}',
+    asset TEXT NOT NULL,
+    address TEXT NOT NULL UNIQUE,
+    address_index INTEGER NOT NULL,
+    amount_usd REAL NOT NULL,
+    amount INTEGER NOT NULL,
+    rate REAL NOT NULL,
+    received INTEGER DEFAULT 0,
+    confirmations INTEGER DEFAULT 0,
+    tx_ids TEXT DEFAULT '[]',
+    status TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    paid_at TEXT DEFAULT '',
+    UNIQUE (asset, address_index)
+);
+
+-- The next unused derivation index of each crypto wallet
+CREATE TABLE IF NOT EXISTS crypto_address_index (
+    asset TEXT PRIMARY KEY,
+    next_index INTEGER NOT NULL
+);
+
+-- The last exchange rates fetched, per USD
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    currency TEXT PRIMARY KEY,
+    rate REAL NOT NULL,
+    fetched_at TEXT NOT NULL
+);
+
+-- The price each checkout and renewal was charged at
+CREATE TABLE IF NOT EXISTS price_quotes (
+    reference TEXT PRIMARY KEY,
+    currency TEXT NOT NULL,
+    rate REAL NOT NULL,
+    amount_usd REAL NOT NULL,
+    amount REAL NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+-- Who each user's invoices are made out to
+CREATE TABLE IF NOT EXISTS billing_profiles (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    name TEXT NOT NULL DEFAULT '',
+    company TEXT NOT NULL DEFAULT '',
+    tax_id TEXT NOT NULL DEFAULT '',
+    address TEXT NOT NULL DEFAULT '',
+    city TEXT NOT NULL DEFAULT '',
+    postal_code TEXT NOT NULL DEFAULT '',
+    country TEXT NOT NULL DEFAULT '',
+    updated_at TEXT NOT NULL
+);
+
+-- The last invoice number taken in each year
+CREATE TABLE IF NOT EXISTS invoice_sequences (
+    year INTEGER PRIMARY KEY,
+    last_number INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS invoices (
+    id TEXT PRIMARY KEY,
+    number TEXT NOT NULL UNIQUE,
+    user_id TEXT REFERENCES users(id),
+    transaction_id TEXT NOT NULL UNIQUE,
+    email TEXT NOT NULL,
+    customer TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    lines TEXT NOT NULL,
+    subtotal REAL NOT NULL,
+    tax_name TEXT NOT NULL DEFAULT '',
+    tax_rate REAL NOT NULL DEFAULT 0,
+    tax_amount REAL NOT NULL DEFAULT 0,
+    reverse_charge INTEGER NOT NULL DEFAULT 0,
+    total REAL NOT NULL,
+    period_start TEXT,
+    period_end TEXT,
+    issued_at TEXT NOT NULL,
+    emailed_at TEXT,
+    pdf BLOB
+);
+
+-- Overage and quota warnings of each subscription period
+CREATE TABLE IF NOT EXISTS quota_periods (
+    subscription_id TEXT NOT NULL,
+    period_start TEXT NOT NULL,
+    user_id TEXT REFERENCES users(id),
+    overage_bytes INTEGER NOT NULL DEFAULT 0,
+    overage_usd REAL NOT NULL DEFAULT 0,
+    warned INTEGER NOT NULL DEFAULT 0,
+    reference TEXT NOT NULL DEFAULT '',
+    billed_usd REAL NOT NULL DEFAULT 0,
+    PRIMARY KEY (subscription_id, period_start)
+);
+
+-- Every version of a plan's terms, kept for the subscribers on it
+CREATE TABLE IF NOT EXISTS plan_versions (
+    plan_id TEXT NOT NULL REFERENCES plans(id),
+    version INTEGER NOT NULL,
+    terms TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (plan_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS coupons (
+    code TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    value REAL NOT NULL,
+    plans TEXT NOT NULL DEFAULT '',
+    max_redemptions INTEGER NOT NULL DEFAULT 0,
+    redemptions INTEGER NOT NULL DEFAULT 0,
+    expires_at TEXT,
+    first_period_only INTEGER NOT NULL DEFAULT 0,
+    active INTEGER NOT NULL DEFAULT 1,
+    created_at TEXT NOT NULL
+);
+
+-- Payments a coupon took a discount off, keyed by payment reference
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    reference TEXT PRIMARY KEY,
+    code TEXT NOT NULL REFERENCES coupons(code),
+    user_id TEXT REFERENCES users(id),
+    plan_id TEXT NOT NULL,
+    discount_usd REAL NOT NULL,
+    renewal INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    redeemed_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS referral_codes (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    code TEXT NOT NULL UNIQUE
+);
+
+-- Users who signed up with a referral code, one referrer each
+CREATE TABLE IF NOT EXISTS referrals (
+    referee_id TEXT PRIMARY KEY REFERENCES users(id),
+    referrer_id TEXT NOT NULL REFERENCES users(id),
+    code TEXT NOT NULL,
+    status TEXT NOT NULL,
+    reference TEXT NOT NULL DEFAULT '',
+    reward_usd REAL NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL,
+    rewarded_at TEXT
+);
+
+-- Organizations bill their members on the owner's account
+CREATE TABLE IF NOT EXISTS organizations (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    owner_id TEXT NOT NULL REFERENCES users(id),
+    created_at TEXT NOT NULL
+);
+
+-- A user is a member of one organization at most
+CREATE TABLE IF NOT EXISTS org_members (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    org_id TEXT NOT NULL REFERENCES organizations(id),
+    role TEXT NOT NULL,
+    data_limit_mb INTEGER NOT NULL DEFAULT 0,
+    max_connections INTEGER NOT NULL DEFAULT 0,
+    joined_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS org_invitations (
+    id TEXT PRIMARY KEY,
+    org_id TEXT NOT NULL REFERENCES organizations(id),
+    email TEXT NOT NULL,
+    role TEXT NOT NULL,
+    invited_by TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TEXT NOT NULL,
+    accepted_at TEXT,
+    created_at TEXT NOT NULL
+);
+
+-- What each member used of the organization's periods
+CREATE TABLE IF NOT EXISTS org_member_usage (
+    org_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    period_start TEXT NOT NULL,
+    data_transferred INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (org_id, user_id, period_start)
+);
+
+-- Sub-users resell their parent's plan with their own proxy credentials
+CREATE TABLE IF NOT EXISTS subusers (
+    id TEXT PRIMARY KEY,
+    parent_id TEXT NOT NULL REFERENCES users(id),
+    label TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    data_limit_mb INTEGER NOT NULL DEFAULT 0,
+    request_limit INTEGER NOT NULL DEFAULT 0,
+    max_connections INTEGER NOT NULL DEFAULT 0,
+    countries TEXT NOT NULL DEFAULT '',
+    active INTEGER NOT NULL DEFAULT 1,
+    created_at TEXT NOT NULL
+);
+
+-- What each sub-user used of their parent's periods
+CREATE TABLE IF NOT EXISTS subuser_usage (
+    subuser_id TEXT NOT NULL,
+    period_start TEXT NOT NULL,
+    data_transferred INTEGER NOT NULL DEFAULT 0,
+    requests_made INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (subuser_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_subs_user_created ON subscriptions(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_usage_user_period ON usage_tracking(user_id, period_start, period_end);
+CREATE INDEX IF NOT EXISTS idx_tx_user_created ON payment_transactions(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_tx_gateway_ref ON payment_transactions(payment_method, gateway_ref);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id);
+CREATE INDEX IF NOT EXISTS idx_email_tokens_user ON email_tokens(user_id, purpose);
+CREATE INDEX IF NOT EXISTS idx_activity_user_created ON activity_log(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_credit_entries_account ON credit_entries(account, id DESC);
+CREATE INDEX IF NOT EXISTS idx_webhook_events_due ON webhook_events(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_jobs_due ON jobs(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_crypto_intents_status ON crypto_intents(status, expires_at);
+CREATE INDEX IF NOT EXISTS idx_invoices_user ON invoices(user_id, issued_at DESC);
+CREATE INDEX IF NOT EXISTS idx_quota_periods_reference ON quota_periods(reference);
+CREATE INDEX IF NOT EXISTS idx_redemptions_code ON coupon_redemptions(code, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_redemptions_user ON coupon_redemptions(user_id, code);
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON referrals(referrer_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_org_members_org ON org_members(org_id);
+CREATE INDEX IF NOT EXISTS idx_org_invitations_org ON org_invitations(org_id, accepted_at);
+CREATE INDEX IF NOT EXISTS idx_subusers_parent ON subusers(parent_id, created_at);
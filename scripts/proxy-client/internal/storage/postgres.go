@@ -2,12 +2,21 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
 )
 
+// PostgresStore implements Repository using PostgreSQL. Money is stored in
+// cents and timestamps in UTC.
 type PostgresStore struct {
 	db *sql.DB
 }
@@ -27,119 +36,2334 @@ func NewPostgresStore(connStr string) (*PostgresStore, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &PostgresStore{db: db}, nil
+	migrator, err := NewMigrator(db, DialectPostgres)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := migrator.Up(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &PostgresStore{db: db}
+	if err := seedPlans(s); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *PostgresStore) Close() error {
 	return s.db.Close()
 }
 
+// cents converts an amount to the cents it is stored in
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// pgTime is a time as stored in a TIMESTAMP column, which keeps microseconds
+func pgTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// placeholders returns n numbered placeholders starting at $from
+func placeholders(from, n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = "$" + strconv.Itoa(from+i)
+	}
+	return strings.Join(p, ", ")
+}
+
+// --- Whitelist ---
+
+func (s *PostgresStore) GetWhitelist() ([]string, error) {
+	return s.queryStrings("SELECT domain FROM adblock_whitelist")
+}
+
+func (s *PostgresStore) AddToWhitelist(domain string) error {
+	_, err := s.db.Exec("INSERT INTO adblock_whitelist (domain) VALUES ($1) ON CONFLICT DO NOTHING", domain)
+	return err
+}
+
+func (s *PostgresStore) RemoveFromWhitelist(domain string) error {
+	_, err := s.db.Exec("DELETE FROM adblock_whitelist WHERE domain = $1", domain)
+	return err
+}
+
+// --- Custom Rules ---
+
+func (s *PostgresStore) GetCustomRules() ([]string, error) {
+	return s.queryStrings("SELECT domain FROM adblock_custom")
+}
+
+func (s *PostgresStore) SetCustomRules(rules []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM adblock_custom"); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if _, err := tx.Exec("INSERT INTO adblock_custom (domain) VALUES ($1) ON CONFLICT DO NOTHING", r); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) queryStrings(query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// --- Usage ---
+
+// UpdateUsage adds usage to a user's billing period. Periods are kept to the
+// second, as on SQLite.
+func (s *PostgresStore) UpdateUsage(userID string, periodStart, periodEnd time.Time, dataTransferred, requests, ads, threats int64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO usage_tracking (user_id, period_start, period_end, data_transferred_bytes, requests_made, ads_blocked, threats_blocked)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, period_start, period_end) DO UPDATE SET
+			data_transferred_bytes = usage_tracking.data_transferred_bytes + excluded.data_transferred_bytes,
+			requests_made = usage_tracking.requests_made + excluded.requests_made,
+			ads_blocked = usage_tracking.ads_blocked + excluded.ads_blocked,
+			threats_blocked = usage_tracking.threats_blocked + excluded.threats_blocked
+	`, userID, periodStart.UTC().Truncate(time.Second), periodEnd.UTC().Truncate(time.Second), dataTransferred, requests, ads, threats)
+	return err
+}
+
+// GetPeriodUsage returns a user's usage in the billing period starting at periodStart
+func (s *PostgresStore) GetPeriodUsage(userID string, periodStart time.Time) (int64, int64, int64, int64, error) {
+	var data, reqs, ads, threats int64
+	err := s.db.QueryRow(`
+		SELECT COALESCE(SUM(data_transferred_bytes), 0), COALESCE(SUM(requests_made), 0),
+			COALESCE(SUM(ads_blocked), 0), COALESCE(SUM(threats_blocked), 0)
+		FROM usage_tracking
+		WHERE user_id = $1 AND period_start = $2
+	`, userID, periodStart.UTC().Truncate(time.Second)).Scan(&data, &reqs, &ads, &threats)
+	return data, reqs, ads, threats, err
+}
+
+func (s *PostgresStore) GetLatestUsage(userID string) (int64, int64, int64, int64, error) {
+	var data, reqs, ads, threats int64
+	err := s.db.QueryRow(`
+		SELECT data_transferred_bytes, requests_made, ads_blocked, threats_blocked
+		FROM usage_tracking
+		WHERE user_id = $1 AND period_start <= $2 AND period_end >= $2
+		LIMIT 1
+	`, userID, time.Now().UTC()).Scan(&data, &reqs, &ads, &threats)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, 0, nil
+	}
+	return data, reqs, ads, threats, err
+}
+
+// --- Quota periods ---
+
+// GetQuotaPeriod returns the quota record of a subscription period, or nil
+// if nothing was recorded yet
+func (s *PostgresStore) GetQuotaPeriod(subscriptionID string, periodStart time.Time) (*billing.QuotaPeriod, error) {
+	p, err := scanQuotaPeriod(s.db.QueryRow("SELECT "+quotaPeriodColumns+" FROM quota_periods WHERE subscription_id = $1 AND period_start = $2",
+		subscriptionID, queueTime(periodStart)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// AddOverage adds data used beyond the limit under a soft quota, and its
+// cost, to a subscription period
+func (s *PostgresStore) AddOverage(userID, subscriptionID string, periodStart time.Time, bytes int64, amountUSD float64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO quota_periods (subscription_id, period_start, user_id, overage_bytes, overage_usd)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (subscription_id, period_start) DO UPDATE SET
+			overage_bytes = quota_periods.overage_bytes + excluded.overage_bytes,
+			overage_usd = quota_periods.overage_usd + excluded.overage_usd
+	`, subscriptionID, queueTime(periodStart), userID, bytes, amountUSD)
+	return err
+}
+
+// MarkQuotaWarned records the quota warning threshold reached in a
+// subscription period. It reports false if a warning at or above it was
+// already recorded, so each warning is sent once.
+func (s *PostgresStore) MarkQuotaWarned(userID, subscriptionID string, periodStart time.Time, threshold int) (bool, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO quota_periods (subscription_id, period_start, user_id, warned)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subscription_id, period_start) DO UPDATE SET warned = excluded.warned
+		WHERE quota_periods.warned < excluded.warned
+	`, subscriptionID, queueTime(periodStart), userID, threshold)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// BillOverage records the renewal charge a period's overage is billed with
+func (s *PostgresStore) BillOverage(subscriptionID string, periodStart time.Time, reference string, amountUSD float64) error {
+	_, err := s.db.Exec("UPDATE quota_periods SET reference = $1, billed_usd = $2 WHERE subscription_id = $3 AND period_start = $4",
+		reference, amountUSD, subscriptionID, queueTime(periodStart))
+	return err
+}
+
+// GetOverageByReference returns the period whose overage a renewal charge
+// billed, or nil
+func (s *PostgresStore) GetOverageByReference(reference string) (*billing.QuotaPeriod, error) {
+	p, err := scanQuotaPeriod(s.db.QueryRow("SELECT "+quotaPeriodColumns+" FROM quota_periods WHERE reference = $1 AND reference != ''", reference))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// --- Subscriptions ---
+
+func (s *PostgresStore) GetSubscription(userID string) (*billing.PersistedSubscription, error) {
+	sub, err := scanSubscription(s.db.QueryRow(`
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions
+		WHERE user_id = $1
+		ORDER BY created_at DESC LIMIT 1
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+func (s *PostgresStore) SetSubscription(userID, id, planID string, planVersion int, status, start, end string, autoRenew bool) error {
+	_, err := s.db.Exec(`
+		INSERT INTO subscriptions (id, user_id, plan_id, plan_version, status, start_date, end_date, auto_renew)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			plan_id = excluded.plan_id,
+			plan_version = excluded.plan_version,
+			status = excluded.status,
+			start_date = excluded.start_date,
+			end_date = excluded.end_date,
+			auto_renew = excluded.auto_renew
+	`, id, userID, planID, planVersion, status, start, end, autoRenew)
+	return err
+}
+
+// ListRenewableSubscriptions returns the current subscription of every user
+// whose subscription can still change state: trialing, active, past_due or
+// canceled. Older subscriptions a user has replaced are ignored.
+func (s *PostgresStore) ListRenewableSubscriptions() ([]*billing.PersistedSubscription, error) {
+	rows, err := s.db.Query(`
+		SELECT ` + subscriptionColumns + `
+		FROM (
+			SELECT DISTINCT ON (user_id) * FROM subscriptions
+			ORDER BY user_id, created_at DESC
+		) s
+		WHERE status IN ('trialing', 'active', 'past_due', 'canceled')
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*billing.PersistedSubscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// UpdateSubscriptionLifecycle stores a state transition of a subscription
+func (s *PostgresStore) UpdateSubscriptionLifecycle(sub *billing.PersistedSubscription) error {
+	_, err := s.db.Exec(`
+		UPDATE subscriptions SET
+			plan_id = $1, plan_version = $2, status = $3, start_date = $4, end_date = $5, auto_renew = $6,
+			grace_until = $7, next_retry_at = $8, retry_count = $9, pending_ref = $10,
+			scheduled_plan = $11
+		WHERE id = $12
+	`, sub.PlanID, sub.PlanVersion, sub.Status, sub.StartDate, sub.EndDate, sub.AutoRenew, sub.GraceUntil, sub.NextRetryAt, sub.RetryCount, sub.PendingRef,
+		sub.ScheduledPlan, sub.ID)
+	return err
+}
+
+// SetScheduledPlan schedules the plan a subscription renews into, or clears
+// the schedule if planID is empty
+func (s *PostgresStore) SetScheduledPlan(subscriptionID, planID string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET scheduled_plan = $1 WHERE id = $2", planID, subscriptionID)
+	return err
+}
+
+// SetQuotaMode sets what happens once a subscription's data limit is used up
+func (s *PostgresStore) SetQuotaMode(subscriptionID, mode string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET quota_mode = $1 WHERE id = $2", mode, subscriptionID)
+	return err
+}
+
+// GetSubscriptionByPendingRenewal returns the subscription waiting for the
+// renewal charge with the given reference, or nil
+func (s *PostgresStore) GetSubscriptionByPendingRenewal(reference string) (*billing.PersistedSubscription, error) {
+	sub, err := scanSubscription(s.db.QueryRow(`
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions
+		WHERE pending_ref = $1 AND pending_ref != ''
+	`, reference))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+// ClearPendingRenewal settles a pending renewal charge. It reports false if
+// the charge was already settled, so only one caller starts the new period.
+func (s *PostgresStore) ClearPendingRenewal(id, reference string) (bool, error) {
+	return s.execChanged("UPDATE subscriptions SET pending_ref = '' WHERE id = $1 AND pending_ref = $2", id, reference)
+}
+
+// ClaimRenewal reserves a renewal attempt until the given time so that a
+// subscription is never charged twice, even by several API instances.
+// It reports false if another attempt holds the claim.
+func (s *PostgresStore) ClaimRenewal(id string, now, until time.Time) (bool, error) {
+	return s.execChanged(`
+		UPDATE subscriptions SET next_retry_at = $1
+		WHERE id = $2 AND (next_retry_at IS NULL OR next_retry_at = '' OR next_retry_at <= $3)
+	`, until.UTC().Format(time.RFC3339), id, now.UTC().Format(time.RFC3339))
+}
+
+// MarkQuotaReset records that the usage quota of a subscription was reset for
+// the period starting at periodStart. It reports false if that reset was
+// already recorded, which keeps resets idempotent.
+func (s *PostgresStore) MarkQuotaReset(id, periodStart string) (bool, error) {
+	return s.execChanged(`
+		UPDATE subscriptions SET last_reset = $1
+		WHERE id = $2 AND (last_reset IS NULL OR last_reset = '' OR last_reset < $1)
+	`, periodStart, id)
+}
+
+// SetSubscriptionPaymentAuth stores the reusable payment authorization used
+// to charge renewals and the currency it was first charged in
+func (s *PostgresStore) SetSubscriptionPaymentAuth(id, auth, currency string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET payment_auth = $1, currency = $2 WHERE id = $3", auth, currency, id)
+	return err
+}
+
+// SetSubscriptionStripeID links a subscription to the Stripe subscription
+// that bills it
+func (s *PostgresStore) SetSubscriptionStripeID(id, stripeSubID string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET stripe_sub_id = $1 WHERE id = $2", stripeSubID, id)
+	return err
+}
+
+// GetSubscriptionByStripeID returns the subscription billed by a Stripe
+// subscription, or nil
+func (s *PostgresStore) GetSubscriptionByStripeID(stripeSubID string) (*billing.PersistedSubscription, error) {
+	sub, err := scanSubscription(s.db.QueryRow(`
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions
+		WHERE stripe_sub_id = $1 AND stripe_sub_id != ''
+		ORDER BY created_at DESC LIMIT 1
+	`, stripeSubID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+// execChanged runs a conditional update and reports whether it changed a row
+func (s *PostgresStore) execChanged(query string, args ...any) (bool, error) {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// --- Plans ---
+
+// ListPlans returns every version of every plan, in the order the plans were
+// added and oldest version first
+func (s *PostgresStore) ListPlans() ([]billing.Plan, error) {
+	rows, err := s.db.Query(`
+		SELECT v.terms, p.active
+		FROM plan_versions v
+		JOIN plans p ON p.id = v.plan_id
+		ORDER BY (SELECT MIN(f.created_at) FROM plan_versions f WHERE f.plan_id = p.id), p.id, v.version
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []billing.Plan
+	for rows.Next() {
+		var terms string
+		var active bool
+		if err := rows.Scan(&terms, &active); err != nil {
+			return nil, err
+		}
+		var p billing.Plan
+		if err := json.Unmarshal([]byte(terms), &p); err != nil {
+			return nil, fmt.Errorf("failed to decode plan terms: %w", err)
+		}
+		p.Active = active
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+// SavePlan stores a new version of a plan and makes it the plan's current
+// terms
+func (s *PostgresStore) SavePlan(p *billing.Plan) error {
+	terms, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	features, err := json.Marshal(p.Features)
+	if err != nil {
+		return err
+	}
+	flags, err := json.Marshal(p.Flags)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO plans (id, name, price_cents, price_annual_cents, currency, data_quota_mb, request_limit,
+			concurrent_conns, features, flags, version, active)
+		VALUES ($1, $2, $3, $4, 'USD', $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name,
+			price_cents = excluded.price_cents,
+			price_annual_cents = excluded.price_annual_cents,
+			data_quota_mb = excluded.data_quota_mb,
+			request_limit = excluded.request_limit,
+			concurrent_conns = excluded.concurrent_conns,
+			features = excluded.features,
+			flags = excluded.flags,
+			version = excluded.version,
+			active = excluded.active
+	`, string(p.ID), p.Name, cents(p.PriceMonthly), cents(p.PriceAnnual),
+		p.DataLimitMB, p.RequestLimit, p.ConcurrentConns, string(features), string(flags), p.Version, p.Active)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO plan_versions (plan_id, version, terms, created_at) VALUES ($1, $2, $3, $4)",
+		string(p.ID), p.Version, string(terms), pgTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPlanActive offers or retires a plan
+func (s *PostgresStore) SetPlanActive(id billing.PlanType, active bool) error {
+	changed, err := s.execChanged("UPDATE plans SET active = $1 WHERE id = $2", active, string(id))
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return billing.ErrPlanNotFound
+	}
+	return nil
+}
+
+// --- Auth: Users ---
+
 func (s *PostgresStore) CreateUser(id, email, passwordHash string) error {
 	_, err := s.db.Exec(
-		"INSERT INTO users (id, email, password_hash) VALUES ($1, $2, $3)",
-		id, email, passwordHash,
+		"INSERT INTO users (id, email, password_hash, created_at) VALUES ($1, $2, $3, $4)",
+		id, email, passwordHash, pgTime(time.Now()),
 	)
 	return err
 }
 
 func (s *PostgresStore) GetUserByEmail(email string) (*User, error) {
-	var u User
-	err := s.db.QueryRow(
-		"SELECT id, email, password_hash, created_at FROM users WHERE email = $1",
-		email,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt)
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = $1`, email))
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return nil, err
 	}
-	return &u, err
+	return u, nil
 }
 
 func (s *PostgresStore) GetUserByID(id string) (*User, error) {
-	var u User
-	err := s.db.QueryRow(
-		"SELECT id, email, password_hash, created_at FROM users WHERE id = $1",
-		id,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt)
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = $1`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &u, err
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
-func (s *PostgresStore) CreateSubscription(sub *Subscription) error {
-	_, err := s.db.Exec(
-		`INSERT INTO subscriptions (id, user_id, plan_id, status, stripe_sub_id, start_date, end_date, auto_renew)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
-		sub.ID, sub.UserID, sub.PlanID, sub.Status, sub.StripeSubID, sub.StartDate, sub.EndDate, sub.AutoRenew,
-	)
+// MarkEmailVerified records that the user confirmed their email address
+func (s *PostgresStore) MarkEmailVerified(id string) error {
+	_, err := s.db.Exec(`
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, $1) WHERE id = $2
+	`, pgTime(time.Now()), id)
 	return err
 }
 
-func (s *PostgresStore) GetSubscriptionByUserID(userID string) (*Subscription, error) {
-	var sub Subscription
-	err := s.db.QueryRow(
-		`SELECT id, user_id, plan_id, status, stripe_sub_id, start_date, end_date, auto_renew, created_at
-		FROM subscriptions WHERE user_id = $1 AND status = 'active' ORDER BY created_at DESC LIMIT 1`,
-		userID,
-	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StripeSubID, &sub.StartDate, &sub.EndDate, &sub.AutoRenew, &sub.CreatedAt)
+func (s *PostgresStore) UpdateUserPassword(id, passwordHash string) error {
+	changed, err := s.execChanged("UPDATE users SET password_hash = $1 WHERE id = $2", passwordHash, id)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// GetUserEmail returns the email address of a user
+func (s *PostgresStore) GetUserEmail(id string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM users WHERE id = $1", id).Scan(&email)
+	return email, err
+}
+
+// --- Auth: Sessions ---
+
+func (s *PostgresStore) CreateSession(id, userID, token string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (id, user_id, token, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, id, userID, token, pgTime(time.Now()), pgTime(expiresAt))
+	return err
+}
+
+func (s *PostgresStore) GetSession(token string) (*Session, error) {
+	sess, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE token = $1`, token))
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, fmt.Errorf("session not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *PostgresStore) GetSessionByID(id string) (*Session, error) {
+	sess, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("session not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// ListUserSessions returns all sessions of a user, most recently used first
+func (s *PostgresStore) ListUserSessions(userID string) ([]*Session, error) {
+	rows, err := s.db.Query(`
+		SELECT `+sessionColumns+`
+		FROM sessions WHERE user_id = $1
+		ORDER BY COALESCE(last_used_at, created_at) DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// RotateSessionToken replaces the refresh token hash of a session and extends
+// its expiry, but only while oldToken is still the session's current token.
+// It reports false if the token was already rotated, e.g. by a concurrent
+// refresh. The replaced hash is kept so that its reuse can be detected.
+func (s *PostgresStore) RotateSessionToken(id, oldToken, newToken string, expiresAt time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE sessions SET token = $1, expires_at = $2, last_used_at = $3 WHERE id = $4 AND token = $5
+	`, newToken, pgTime(expiresAt), pgTime(time.Now()), id, oldToken)
+	if err != nil {
+		return false, err
 	}
-	return &sub, err
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO rotated_refresh_tokens (token, session_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO NOTHING
+	`, oldToken, id, pgTime(expiresAt)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetRotatedTokenSession returns the session a replaced refresh token hash
+// belonged to, or "" if the hash was never rotated
+func (s *PostgresStore) GetRotatedTokenSession(token string) (string, error) {
+	var sessionID string
+	err := s.db.QueryRow("SELECT session_id FROM rotated_refresh_tokens WHERE token = $1", token).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return sessionID, err
 }
 
-func (s *PostgresStore) UpdateSubscriptionStatus(id, status string) error {
-	_, err := s.db.Exec("UPDATE subscriptions SET status = $1 WHERE id = $2", status, id)
+// TouchSession records the device a session was last used from
+func (s *PostgresStore) TouchSession(id, userAgent, ipAddress string) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions SET user_agent = $1, ip_address = $2, last_used_at = $3 WHERE id = $4
+	`, userAgent, ipAddress, pgTime(time.Now()), id)
 	return err
 }
 
-func (s *PostgresStore) CreateTransaction(tx *Transaction) error {
-	_, err := s.db.Exec(
-		`INSERT INTO payment_transactions (id, user_id, amount_cents, currency, status, gateway, gateway_ref_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		tx.ID, tx.UserID, tx.AmountCents, tx.Currency, tx.Status, tx.Gateway, tx.GatewayRefID,
-	)
+func (s *PostgresStore) DeleteSession(token string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE token = $1", token)
 	return err
 }
 
-func (s *PostgresStore) GetPlanByID(id string) (*Plan, error) {
-	var p Plan
-	err := s.db.QueryRow(
-		"SELECT id, name, price_cents, currency, data_quota_mb, request_limit, concurrent_conns FROM plans WHERE id = $1",
-		id,
-	).Scan(&p.ID, &p.Name, &p.PriceCents, &p.Currency, &p.DataQuotaMB, &p.RequestLimit, &p.ConcurrentConns)
+func (s *PostgresStore) DeleteSessionByID(id string) error {
+	if _, err := s.db.Exec("DELETE FROM rotated_refresh_tokens WHERE session_id = $1", id); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = $1", id)
+	return err
+}
+
+// --- Auth: Session Revocations ---
+
+// RevokeSession adds a session to the revocation list until expiresAt, by which
+// time every access token issued for it has expired on its own.
+func (s *PostgresStore) RevokeSession(sessionID, userID string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO session_revocations (session_id, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (session_id) DO UPDATE SET expires_at = excluded.expires_at
+	`, sessionID, userID, pgTime(expiresAt))
+	return err
+}
+
+// GetSessionRevocations returns revoked session IDs with the time their entry lapses
+func (s *PostgresStore) GetSessionRevocations() (map[string]time.Time, error) {
+	rows, err := s.db.Query("SELECT session_id, expires_at FROM session_revocations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var expiresAt time.Time
+		if err := rows.Scan(&id, &expiresAt); err != nil {
+			return nil, err
+		}
+		revoked[id] = expiresAt
+	}
+	return revoked, rows.Err()
+}
+
+// GetSessionRevocation returns when the revocation of a session lapses, or
+// nil if the session is not revoked
+func (s *PostgresStore) GetSessionRevocation(sessionID string) (*time.Time, error) {
+	var expiresAt time.Time
+	err := s.db.QueryRow("SELECT expires_at FROM session_revocations WHERE session_id = $1", sessionID).Scan(&expiresAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &p, err
+	if err != nil {
+		return nil, err
+	}
+	return &expiresAt, nil
 }
 
-func (s *PostgresStore) TrackUsage(userID string, dataBytes int64) error {
-	now := time.Now()
-	periodStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-	periodEnd := periodStart.AddDate(0, 1, 0).Add(-time.Second)
+// PruneSessionRevocations drops revocation entries and rotated refresh token
+// hashes that lapsed before now
+func (s *PostgresStore) PruneSessionRevocations(now time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM rotated_refresh_tokens WHERE expires_at < $1", pgTime(now)); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM session_revocations WHERE expires_at < $1", pgTime(now))
+	return err
+}
 
-	_, err := s.db.Exec(
-		`INSERT INTO usage_tracking (user_id, period_start, period_end, data_transferred_bytes, requests_made)
-		VALUES ($1, $2, $3, $4, 1)
-		ON CONFLICT (user_id, period_start, period_end)
-		DO UPDATE SET data_transferred_bytes = usage_tracking.data_transferred_bytes + $4,
-		requests_made = usage_tracking.requests_made + 1`,
-		userID, periodStart, periodEnd, dataBytes,
-	)
+// --- Auth: API Keys ---
+
+func (s *PostgresStore) CreateAPIKey(key *APIKey) error {
+	var expiresAt any
+	if key.ExpiresAt != nil {
+		expiresAt = pgTime(*key.ExpiresAt)
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, key.ID, key.UserID, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), expiresAt, pgTime(key.CreatedAt))
 	return err
 }
 
-func (s *PostgresStore) GetUsage(userID string, periodStart, periodEnd time.Time) (*UsageStats, error) {
-	var stats UsageStats
-	err := s.db.QueryRow(
-		`SELECT COALESCE(SUM(data_transferred_bytes), 0), COALESCE(SUM(requests_made), 0),
-		COALESCE(SUM(ads_blocked), 0), COALESCE(SUM(threats_blocked), 0)
-		FROM usage_tracking WHERE user_id = $1 AND period_start >= $2 AND period_end <= $3`,
-		userID, periodStart, periodEnd,
-	).Scan(&stats.DataTransferredBytes, &stats.RequestsMade, &stats.AdsBlocked, &stats.ThreatsBlocked)
-	
-	stats.PeriodStart = periodStart
-	stats.PeriodEnd = periodEnd
-	return &stats, err
+func (s *PostgresStore) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = $1`, hash))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("api key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListUserAPIKeys returns all API keys of a user, newest first
+func (s *PostgresStore) ListUserAPIKeys(userID string) ([]*APIKey, error) {
+	rows, err := s.db.Query(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// TouchAPIKey records when a key was last used
+func (s *PostgresStore) TouchAPIKey(id string, usedAt time.Time) error {
+	_, err := s.db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", pgTime(usedAt), id)
+	return err
+}
+
+// DeleteAPIKey removes a key owned by userID
+func (s *PostgresStore) DeleteAPIKey(id, userID string) error {
+	changed, err := s.execChanged("DELETE FROM api_keys WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return fmt.Errorf("api key not found")
+	}
+	return nil
+}
+
+// --- Auth: Email Tokens ---
+
+// CreateEmailToken stores the hash of an email verification or password reset token
+func (s *PostgresStore) CreateEmailToken(hash, userID, purpose string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO email_tokens (token_hash, user_id, purpose, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, hash, userID, purpose, pgTime(expiresAt))
+	return err
+}
+
+// ConsumeEmailToken marks an unused, unexpired token as used and returns its user.
+// Each token can be consumed once.
+func (s *PostgresStore) ConsumeEmailToken(hash, purpose string, now time.Time) (string, error) {
+	var userID string
+	err := s.db.QueryRow(`
+		UPDATE email_tokens SET used_at = $1
+		WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id
+	`, pgTime(now), hash, purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("token not found")
+	}
+	return userID, err
+}
+
+// DeleteEmailTokens removes the outstanding tokens of a user for one purpose
+func (s *PostgresStore) DeleteEmailTokens(userID, purpose string) error {
+	_, err := s.db.Exec("DELETE FROM email_tokens WHERE user_id = $1 AND purpose = $2", userID, purpose)
+	return err
+}
+
+// --- Auth: Login Challenges ---
+
+// CreateLoginChallenge stores a new challenge and drops expired ones
+func (s *PostgresStore) CreateLoginChallenge(id, userID string, expiresAt time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM login_challenges WHERE expires_at < $1", pgTime(time.Now())); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO login_challenges (id, user_id, expires_at) VALUES ($1, $2, $3)
+	`, id, userID, pgTime(expiresAt))
+	return err
+}
+
+// ClaimLoginChallenge atomically moves a pending, unexpired challenge with
+// attempts left into the verifying state and counts the attempt. It reports
+// whether the claim succeeded and returns the challenge as stored, or nil if
+// there is none. Only one code can be checked against a challenge at a time.
+func (s *PostgresStore) ClaimLoginChallenge(id string, maxAttempts int, now time.Time) (*LoginChallenge, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE login_challenges SET state = $1, attempts = attempts + 1
+		WHERE id = $2 AND state = $3 AND attempts < $4 AND expires_at > $5
+	`, ChallengeVerifying, id, ChallengePending, maxAttempts, pgTime(now))
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ch LoginChallenge
+	err = tx.QueryRow(`
+		SELECT id, user_id, attempts, state, expires_at FROM login_challenges WHERE id = $1
+	`, id).Scan(&ch.ID, &ch.UserID, &ch.Attempts, &ch.State, &ch.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &ch, n == 1, tx.Commit()
+}
+
+// FinishLoginChallenge ends a verification started by ClaimLoginChallenge.
+// A verified challenge is used up, otherwise it is pending again.
+func (s *PostgresStore) FinishLoginChallenge(id string, verified bool) error {
+	state := ChallengePending
+	if verified {
+		state = ChallengeUsed
+	}
+	_, err := s.db.Exec(`
+		UPDATE login_challenges SET state = $1 WHERE id = $2 AND state = $3
+	`, state, id, ChallengeVerifying)
+	return err
+}
+
+// --- Auth: Two-Factor ---
+
+func (s *PostgresStore) GetTOTP(userID string) (*TOTPSecret, error) {
+	var t TOTPSecret
+	err := s.db.QueryRow(`
+		SELECT user_id, secret_enc, enabled, last_used_step, created_at
+		FROM user_totp WHERE user_id = $1
+	`, userID).Scan(&t.UserID, &t.SecretEnc, &t.Enabled, &t.LastUsedStep, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetTOTP stores a (new) enrollment for the user, replacing any previous one
+func (s *PostgresStore) SetTOTP(userID, secretEnc string, enabled bool) error {
+	now := pgTime(time.Now())
+	var enabledAt any
+	if enabled {
+		enabledAt = now
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO user_totp (user_id, secret_enc, enabled, last_used_step, created_at, enabled_at)
+		VALUES ($1, $2, $3, 0, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET
+			secret_enc = excluded.secret_enc,
+			enabled = excluded.enabled,
+			last_used_step = 0,
+			created_at = excluded.created_at,
+			enabled_at = excluded.enabled_at
+	`, userID, secretEnc, enabled, now, enabledAt)
+	return err
+}
+
+// EnableTOTP activates a pending enrollment
+func (s *PostgresStore) EnableTOTP(userID string, step int64) error {
+	_, err := s.db.Exec(`
+		UPDATE user_totp SET enabled = TRUE, enabled_at = $1, last_used_step = $2 WHERE user_id = $3
+	`, pgTime(time.Now()), step, userID)
+	return err
+}
+
+// MarkTOTPStepUsed records the last accepted time step so a code can not be
+// replayed. It reports false if an equal or later step was already used.
+func (s *PostgresStore) MarkTOTPStepUsed(userID string, step int64) (bool, error) {
+	return s.execChanged(`
+		UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1
+	`, step, userID)
+}
+
+// DeleteTOTP removes the enrollment and recovery codes of a user
+func (s *PostgresStore) DeleteTOTP(userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes discards the user's recovery codes and stores new hashes
+func (s *PostgresStore) ReplaceRecoveryCodes(userID string, hashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes an unused recovery code. It reports whether the code was valid.
+func (s *PostgresStore) UseRecoveryCode(userID, hash string) (bool, error) {
+	return s.execChanged(`
+		UPDATE recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL
+	`, pgTime(time.Now()), userID, hash)
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (s *PostgresStore) CountRecoveryCodes(userID string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+// --- Auth: Login Protection ---
+
+// ReserveLoginAttempt counts an attempt against key, but only if the counter
+// is still as seen in prev (nil if there was none). It reports false when a
+// concurrent attempt changed the counter first, in which case the caller
+// should look again. The count starts over when the previous failure is
+// older than window.
+func (s *PostgresStore) ReserveLoginAttempt(key string, prev *LoginFailure, now time.Time, window time.Duration) (*LoginFailure, bool, error) {
+	now = pgTime(now)
+	f := &LoginFailure{Key: key, Failures: 1, FirstFailureAt: now, LastFailureAt: now}
+
+	if prev == nil {
+		ok, err := s.execChanged(`
+			INSERT INTO login_failures (key, failures, first_failure_at, last_failure_at)
+			VALUES ($1, 1, $2, $2)
+			ON CONFLICT (key) DO NOTHING
+		`, key, now)
+		return f, ok, err
+	}
+
+	if !prev.LastFailureAt.Before(now.Add(-window)) {
+		f.Failures = prev.Failures + 1
+		f.FirstFailureAt = prev.FirstFailureAt
+	}
+	ok, err := s.execChanged(`
+		UPDATE login_failures SET failures = $1, first_failure_at = $2, last_failure_at = $3
+		WHERE key = $4 AND failures = $5 AND last_failure_at = $6
+	`, f.Failures, pgTime(f.FirstFailureAt), now, key, prev.Failures, pgTime(prev.LastFailureAt))
+	return f, ok, err
+}
+
+// ReleaseLoginAttempt takes one attempt off the counter of key again
+func (s *PostgresStore) ReleaseLoginAttempt(key string) error {
+	_, err := s.db.Exec("UPDATE login_failures SET failures = failures - 1 WHERE key = $1 AND failures > 0", key)
+	return err
+}
+
+// GetLoginFailure returns the failure counter of a key, or nil if there is none
+func (s *PostgresStore) GetLoginFailure(key string) (*LoginFailure, error) {
+	f := &LoginFailure{Key: key}
+	err := s.db.QueryRow(
+		"SELECT failures, first_failure_at, last_failure_at FROM login_failures WHERE key = $1", key,
+	).Scan(&f.Failures, &f.FirstFailureAt, &f.LastFailureAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ClearLoginFailures resets the failure counter of a key
+func (s *PostgresStore) ClearLoginFailures(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE key = $1", key)
+	return err
+}
+
+// PruneLoginFailures drops counters whose last failure is before the cutoff
+func (s *PostgresStore) PruneLoginFailures(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE last_failure_at < $1", pgTime(before))
+	return err
+}
+
+// --- Activity Log ---
+
+func (s *PostgresStore) AddActivity(a *Activity) error {
+	_, err := s.db.Exec(`
+		INSERT INTO activity_log (id, user_id, type, status, details, ip_address, user_agent, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, a.ID, a.UserID, a.Type, a.Status, a.Details, a.IPAddress, a.UserAgent, pgTime(a.CreatedAt))
+	return err
+}
+
+// ListActivities returns a page of a user's activity, newest first, and the
+// total number of entries
+func (s *PostgresStore) ListActivities(userID string, limit, offset int) ([]*Activity, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM activity_log WHERE user_id = $1", userID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, user_id, type, status, details, COALESCE(ip_address, ''), COALESCE(user_agent, ''), created_at
+		FROM activity_log WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3
+	`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var activities []*Activity
+	for rows.Next() {
+		var a Activity
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Type, &a.Status, &a.Details, &a.IPAddress, &a.UserAgent, &a.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		activities = append(activities, &a)
+	}
+	return activities, total, rows.Err()
+}
+
+// --- Credit Ledger ---
+
+// PostCreditTransaction books a transaction as a pair of entries that sum to
+// zero. A reference that was already posted is left alone and reported as
+// not posted.
+func (s *PostgresStore) PostCreditTransaction(t *billing.CreditTransaction) (bool, error) {
+	if t.Amount <= 0 || t.Debit == t.Credit {
+		return false, fmt.Errorf("invalid credit transaction")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO credit_transactions (id, kind, reference, description, created_at)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (reference) DO NOTHING
+	`, t.ID, t.Kind, t.Reference, t.Description, pgTime(t.CreatedAt))
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	for _, e := range []struct {
+		account string
+		amount  int64
+	}{{t.Debit, -t.Amount}, {t.Credit, t.Amount}} {
+		if _, err := tx.Exec(`
+			INSERT INTO credit_entries (txn_id, account, amount, created_at) VALUES ($1, $2, $3, $4)
+		`, t.ID, e.account, e.amount, pgTime(t.CreatedAt)); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// GetLedgerBalance returns the sum of the entries of a ledger account
+func (s *PostgresStore) GetLedgerBalance(account string) (int64, error) {
+	var balance int64
+	err := s.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM credit_entries WHERE account = $1", account).Scan(&balance)
+	return balance, err
+}
+
+// ListLedgerEntries returns a page of the entries of a ledger account, newest
+// first, and the total number of entries
+func (s *PostgresStore) ListLedgerEntries(account string, limit, offset int) ([]*billing.CreditEntry, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM credit_entries WHERE account = $1", account).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT e.txn_id, e.account, t.kind, t.reference, COALESCE(t.description, ''), e.amount, e.created_at
+		FROM credit_entries e JOIN credit_transactions t ON t.id = e.txn_id
+		WHERE e.account = $1 ORDER BY e.id DESC LIMIT $2 OFFSET $3
+	`, account, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []*billing.CreditEntry
+	for rows.Next() {
+		var e billing.CreditEntry
+		if err := rows.Scan(&e.TxnID, &e.Account, &e.Kind, &e.Reference, &e.Description, &e.Amount, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, total, rows.Err()
+}
+
+// --- Transactions ---
+
+const pgTransactionColumns = `id, COALESCE(user_id, ''), COALESCE(plan_id, ''), amount_cents, currency, status, gateway,
+	COALESCE(gateway_ref_id, ''), created_at, COALESCE(kind, ''), COALESCE(deposit_cents, 0),
+	COALESCE(deposit_status, ''), COALESCE(refunded_cents, 0), COALESCE(refund_of, ''), COALESCE(reason, ''),
+	COALESCE(fx_rate, 0), COALESCE(amount_usd_cents, 0)`
+
+func scanPGTransaction(row interface{ Scan(...any) error }) (*Transaction, error) {
+	var tx Transaction
+	var amount, deposit, refunded, amountUSD int64
+	err := row.Scan(&tx.ID, &tx.UserID, &tx.PlanID, &amount, &tx.Currency, &tx.Status, &tx.PaymentMethod,
+		&tx.GatewayRef, &tx.CreatedAt, &tx.Kind, &deposit, &tx.DepositStatus, &refunded, &tx.RefundOf, &tx.Reason,
+		&tx.FXRate, &amountUSD)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Kind == "" {
+		tx.Kind = TransactionPayment
+	}
+	tx.Amount = float64(amount) / 100
+	tx.DepositAmount = float64(deposit) / 100
+	tx.RefundedAmount = float64(refunded) / 100
+	tx.AmountUSD = float64(amountUSD) / 100
+	return &tx, nil
+}
+
+func (s *PostgresStore) CreateTransaction(tx *Transaction) error {
+	return createPGTransaction(s.db, tx)
+}
+
+func createPGTransaction(db interface {
+	Exec(string, ...any) (sql.Result, error)
+}, tx *Transaction) error {
+	_, err := db.Exec(`
+		INSERT INTO payment_transactions (id, user_id, plan_id, amount_cents, currency, status, gateway, gateway_ref_id, created_at,
+			kind, deposit_cents, deposit_status, refunded_cents, refund_of, reason, fx_rate, amount_usd_cents)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+	`, tx.ID, tx.UserID, tx.PlanID, cents(tx.Amount), tx.Currency, tx.Status, tx.PaymentMethod, tx.GatewayRef, pgTime(tx.CreatedAt),
+		transactionKind(tx), cents(tx.DepositAmount), tx.DepositStatus, cents(tx.RefundedAmount), tx.RefundOf, tx.Reason,
+		tx.FXRate, cents(tx.AmountUSD))
+	return err
+}
+
+func (s *PostgresStore) GetTransaction(id string) (*Transaction, error) {
+	return scanPGTransaction(s.db.QueryRow("SELECT "+pgTransactionColumns+" FROM payment_transactions WHERE id = $1", id))
+}
+
+// SetTransactionGatewayRef stores the gateway's ID of a payment once the
+// gateway reports it
+func (s *PostgresStore) SetTransactionGatewayRef(id, ref string) error {
+	_, err := s.db.Exec("UPDATE payment_transactions SET gateway_ref_id = $1 WHERE id = $2", ref, id)
+	return err
+}
+
+// GetRefundByGatewayRef returns the refund the gateway knows by ref
+func (s *PostgresStore) GetRefundByGatewayRef(method, ref string) (*Transaction, error) {
+	return scanPGTransaction(s.db.QueryRow(`
+		SELECT `+pgTransactionColumns+` FROM payment_transactions
+		WHERE gateway = $1 AND gateway_ref_id = $2 AND kind IN ($3, $4)
+	`, method, ref, TransactionRefund, TransactionDepositRefund))
+}
+
+// GetDepositTransaction returns the latest payment of a user that included a
+// deposit, or nil if there is none
+func (s *PostgresStore) GetDepositTransaction(userID string) (*Transaction, error) {
+	tx, err := scanPGTransaction(s.db.QueryRow(`
+		SELECT `+pgTransactionColumns+` FROM payment_transactions
+		WHERE user_id = $1 AND deposit_cents > 0
+		ORDER BY created_at DESC LIMIT 1
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return tx, err
+}
+
+// SetDepositStatus moves the deposit of a payment to status if it is in one
+// of the from states. It reports whether it did.
+func (s *PostgresStore) SetDepositStatus(id, status string, from ...string) (bool, error) {
+	if len(from) == 0 {
+		return false, fmt.Errorf("no deposit states to move from")
+	}
+	args := []any{status, id}
+	for _, f := range from {
+		args = append(args, f)
+	}
+	return s.execChanged(`
+		UPDATE payment_transactions SET deposit_status = $1
+		WHERE id = $2 AND deposit_status IN (`+placeholders(3, len(from))+`)
+	`, args...)
+}
+
+// ListRefunds returns a page of refunds, newest first, of one user or of
+// everyone if userID is empty, and the total number of them
+func (s *PostgresStore) ListRefunds(userID string, limit, offset int) ([]*Transaction, int, error) {
+	const where = "kind IN ($1, $2) AND ($3 = '' OR user_id = $3)"
+	args := []any{TransactionRefund, TransactionDepositRefund, userID}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM payment_transactions WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+pgTransactionColumns+" FROM payment_transactions WHERE "+where+
+		" ORDER BY created_at DESC LIMIT $4 OFFSET $5", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var refunds []*Transaction
+	for rows.Next() {
+		tx, err := scanPGTransaction(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		refunds = append(refunds, tx)
+	}
+	return refunds, total, rows.Err()
+}
+
+// RecordRefund stores a refund before it is sent to the gateway and books
+// its amount against the payment. A deposit refund also marks the deposit
+// refunded, and fails with billing.ErrDepositNotHeld if it is not held.
+// A refund larger than what is left of the payment fails with
+// billing.ErrRefundTooLarge.
+func (s *PostgresStore) RecordRefund(refund *Transaction) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE payment_transactions SET refunded_cents = COALESCE(refunded_cents, 0) + $1
+		WHERE id = $2 AND COALESCE(kind, $3) = $3 AND COALESCE(refunded_cents, 0) + $1 <= amount_cents
+	`, cents(refund.Amount), refund.RefundOf, TransactionPayment)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return billing.ErrRefundTooLarge
+	}
+
+	if refund.Kind == TransactionDepositRefund {
+		res, err := tx.Exec(`
+			UPDATE payment_transactions SET deposit_status = $1
+			WHERE id = $2 AND deposit_status IN ($3, $4)
+		`, billing.DepositRefunded, refund.RefundOf, billing.DepositHeld, billing.DepositRefundScheduled)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return billing.ErrDepositNotHeld
+		}
+	}
+
+	if err := createPGTransaction(tx, refund); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateRefund stores the gateway's ID and the status of a refund
+func (s *PostgresStore) UpdateRefund(id, status, gatewayRef string) error {
+	_, err := s.db.Exec(`
+		UPDATE payment_transactions SET status = $1, gateway_ref_id = $2 WHERE id = $3 AND kind IN ($4, $5)
+	`, status, gatewayRef, id, TransactionRefund, TransactionDepositRefund)
+	return err
+}
+
+// FailRefund marks a refund failed and gives its amount back to the payment.
+// The deposit of a failed deposit refund is held again.
+func (s *PostgresStore) FailRefund(id string) error {
+	refund, err := s.GetTransaction(id)
+	if err != nil {
+		return err
+	}
+	if refund.Status == "failed" {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE payment_transactions SET status = 'failed' WHERE id = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE payment_transactions SET refunded_cents = GREATEST(COALESCE(refunded_cents, 0) - $1, 0) WHERE id = $2
+	`, cents(refund.Amount), refund.RefundOf); err != nil {
+		return err
+	}
+	if refund.Kind == TransactionDepositRefund {
+		if _, err := tx.Exec(`
+			UPDATE payment_transactions SET deposit_status = $1 WHERE id = $2 AND deposit_status = $3
+		`, billing.DepositHeld, refund.RefundOf, billing.DepositRefunded); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// --- Webhook events and jobs ---
+
+// RecordWebhookEvent stores a webhook delivery. A delivery the provider
+// already sent is left alone and reported as not recorded.
+func (s *PostgresStore) RecordWebhookEvent(e *queue.Event) (bool, error) {
+	return s.execChanged(`
+		INSERT INTO webhook_events (id, provider, event_type, event_key, payload, status, attempts, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (provider, event_key) DO NOTHING
+	`, e.ID, e.Provider, e.Type, e.Key, string(e.Payload), e.Status, e.Attempts, queueTime(e.NextAttemptAt), queueTime(e.CreatedAt))
+}
+
+// GetWebhookEvent returns a stored webhook event
+func (s *PostgresStore) GetWebhookEvent(id string) (*queue.Event, error) {
+	e, err := scanWebhookEvent(s.db.QueryRow("SELECT "+webhookEventColumns+" FROM webhook_events WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("webhook event %s not found", id)
+	}
+	return e, err
+}
+
+// ListWebhookEvents returns a page of webhook events, newest first, in the
+// given state or all of them, and the total number of matching events
+func (s *PostgresStore) ListWebhookEvents(status string, limit, offset int) ([]*queue.Event, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM webhook_events WHERE $1 = '' OR status = $1", status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+webhookEventColumns+` FROM webhook_events
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3
+	`, status, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []*queue.Event
+	for rows.Next() {
+		e, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+	return events, total, rows.Err()
+}
+
+// ListDueWebhookEvents returns pending events whose next attempt is due,
+// oldest first
+func (s *PostgresStore) ListDueWebhookEvents(now time.Time, limit int) ([]*queue.Event, error) {
+	rows, err := s.db.Query(`
+		SELECT `+webhookEventColumns+` FROM webhook_events
+		WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY created_at, id LIMIT $3
+	`, queue.StatusPending, queueTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*queue.Event
+	for rows.Next() {
+		e, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ClaimWebhookEvent reserves an attempt at an event until the given time.
+// It reports false if another worker holds the claim.
+func (s *PostgresStore) ClaimWebhookEvent(id string, now, until time.Time) (bool, error) {
+	return s.execChanged(`
+		UPDATE webhook_events SET next_attempt_at = $1
+		WHERE id = $2 AND status = $3 AND next_attempt_at <= $4
+	`, queueTime(until), id, queue.StatusPending, queueTime(now))
+}
+
+// UpdateWebhookEvent stores the outcome of an attempt at an event
+func (s *PostgresStore) UpdateWebhookEvent(e *queue.Event) error {
+	_, err := s.db.Exec(`
+		UPDATE webhook_events SET status = $1, attempts = $2, last_error = $3, next_attempt_at = $4, processed_at = $5
+		WHERE id = $6
+	`, e.Status, e.Attempts, e.LastError, queueTime(e.NextAttemptAt), queueTimePtr(e.ProcessedAt), e.ID)
+	return err
+}
+
+// CreateJob schedules a job. A job with the kind and key of an existing one
+// is not scheduled again and is reported as not created.
+func (s *PostgresStore) CreateJob(j *queue.Job) (bool, error) {
+	return s.execChanged(`
+		INSERT INTO jobs (id, kind, job_key, payload, status, attempts, run_at, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (kind, job_key) DO NOTHING
+	`, j.ID, j.Kind, j.Key, string(j.Payload), j.Status, j.Attempts, queueTime(j.RunAt), queueTime(j.NextAttemptAt), queueTime(j.CreatedAt))
+}
+
+// ListDueJobs returns pending jobs whose next attempt is due, oldest first
+func (s *PostgresStore) ListDueJobs(now time.Time, limit int) ([]*queue.Job, error) {
+	rows, err := s.db.Query(`
+		SELECT `+jobColumns+` FROM jobs
+		WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY run_at, id LIMIT $3
+	`, queue.StatusPending, queueTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*queue.Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimJob reserves an attempt at a job until the given time. It reports
+// false if another worker holds the claim.
+func (s *PostgresStore) ClaimJob(id string, now, until time.Time) (bool, error) {
+	return s.execChanged(`
+		UPDATE jobs SET next_attempt_at = $1
+		WHERE id = $2 AND status = $3 AND next_attempt_at <= $4
+	`, queueTime(until), id, queue.StatusPending, queueTime(now))
+}
+
+// UpdateJob stores the outcome of an attempt at a job
+func (s *PostgresStore) UpdateJob(j *queue.Job) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs SET status = $1, attempts = $2, last_error = $3, next_attempt_at = $4, processed_at = $5
+		WHERE id = $6
+	`, j.Status, j.Attempts, j.LastError, queueTime(j.NextAttemptAt), queueTimePtr(j.ProcessedAt), j.ID)
+	return err
+}
+
+// --- Crypto intents ---
+
+// NextCryptoAddressIndex reserves the next unused derivation index of an
+// asset's wallet. Indexes are never handed out twice.
+func (s *PostgresStore) NextCryptoAddressIndex(asset string) (uint32, error) {
+	var index uint32
+	err := s.db.QueryRow(`
+		INSERT INTO crypto_address_index (asset, next_index) VALUES ($1, 1)
+		ON CONFLICT (asset) DO UPDATE SET next_index = crypto_address_index.next_index + 1
+		RETURNING next_index - 1
+	`, asset).Scan(&index)
+	return index, err
+}
+
+func (s *PostgresStore) CreateCryptoIntent(i *billing.CryptoIntent) error {
+	metadata, _ := json.Marshal(i.Metadata)
+	txIDs, _ := json.Marshal(i.TxIDs)
+	_, err := s.db.Exec(`
+		INSERT INTO crypto_intents (id, user_id, email, plan_id, metadata, asset, address, address_index,
+			amount_usd, amount, rate, received, confirmations, tx_ids, status, expires_at, created_at, paid_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+	`, i.ID, i.UserID, i.Email, i.PlanID, string(metadata), i.Asset, i.Address, i.AddressIndex,
+		i.AmountUSD, i.Amount, i.Rate, i.Received, i.Confirmations, string(txIDs), i.Status,
+		queueTime(i.ExpiresAt), queueTime(i.CreatedAt), queueTimePtr(i.PaidAt))
+	return err
+}
+
+func (s *PostgresStore) GetCryptoIntent(id string) (*billing.CryptoIntent, error) {
+	i, err := scanCryptoIntent(s.db.QueryRow("SELECT "+cryptoIntentColumns+" FROM crypto_intents WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("crypto intent %s not found", id)
+	}
+	return i, err
+}
+
+// UpdateCryptoIntent stores what the watcher saw on the chain
+func (s *PostgresStore) UpdateCryptoIntent(i *billing.CryptoIntent) error {
+	txIDs, _ := json.Marshal(i.TxIDs)
+	_, err := s.db.Exec(`
+		UPDATE crypto_intents SET received = $1, confirmations = $2, tx_ids = $3, status = $4, paid_at = $5
+		WHERE id = $6
+	`, i.Received, i.Confirmations, string(txIDs), i.Status, queueTimePtr(i.PaidAt), i.ID)
+	return err
+}
+
+// ListWatchedCryptoIntents returns the intents a payment may still arrive
+// for: pending and confirming ones, and those that expired after since
+func (s *PostgresStore) ListWatchedCryptoIntents(since time.Time) ([]*billing.CryptoIntent, error) {
+	rows, err := s.db.Query(`
+		SELECT `+cryptoIntentColumns+` FROM crypto_intents
+		WHERE status IN ($1, $2) OR (status = $3 AND expires_at > $4)
+		ORDER BY created_at, id
+	`, billing.IntentPending, billing.IntentConfirming, billing.IntentExpired, queueTime(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var intents []*billing.CryptoIntent
+	for rows.Next() {
+		i, err := scanCryptoIntent(rows)
+		if err != nil {
+			return nil, err
+		}
+		intents = append(intents, i)
+	}
+	return intents, rows.Err()
+}
+
+// ListCryptoIntents returns a page of crypto intents, newest first, in the
+// given state or all of them, and the total number of matching intents
+func (s *PostgresStore) ListCryptoIntents(status string, limit, offset int) ([]*billing.CryptoIntent, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM crypto_intents WHERE $1 = '' OR status = $1", status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+cryptoIntentColumns+` FROM crypto_intents
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3
+	`, status, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var intents []*billing.CryptoIntent
+	for rows.Next() {
+		i, err := scanCryptoIntent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		intents = append(intents, i)
+	}
+	return intents, total, rows.Err()
+}
+
+// --- Exchange rates ---
+
+// LoadExchangeRates returns the last exchange rates saved
+func (s *PostgresStore) LoadExchangeRates() (map[billing.CurrencyCode]float64, time.Time, error) {
+	rows, err := s.db.Query("SELECT currency, rate, fetched_at FROM exchange_rates")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	rates := make(map[billing.CurrencyCode]float64)
+	var fetchedAt time.Time
+	for rows.Next() {
+		var currency, fetched string
+		var rate float64
+		if err := rows.Scan(&currency, &rate, &fetched); err != nil {
+			return nil, time.Time{}, err
+		}
+		rates[billing.CurrencyCode(currency)] = rate
+		if t := parseQueueTime(fetched); t != nil && (fetchedAt.IsZero() || t.Before(fetchedAt)) {
+			fetchedAt = *t // the oldest rate dates the set
+		}
+	}
+	return rates, fetchedAt, rows.Err()
+}
+
+// SaveExchangeRates stores the rates fetched, keeping those of currencies
+// the fetch didn't include
+func (s *PostgresStore) SaveExchangeRates(rates map[billing.CurrencyCode]float64, fetchedAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for currency, rate := range rates {
+		if _, err := tx.Exec(`
+			INSERT INTO exchange_rates (currency, rate, fetched_at) VALUES ($1, $2, $3)
+			ON CONFLICT (currency) DO UPDATE SET rate = excluded.rate, fetched_at = excluded.fetched_at
+		`, string(currency), rate, queueTime(fetchedAt)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SavePriceQuote records the price a payment was charged at
+func (s *PostgresStore) SavePriceQuote(q *billing.PriceQuote) error {
+	_, err := s.db.Exec(`
+		INSERT INTO price_quotes (reference, currency, rate, amount_usd, amount, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (reference) DO UPDATE SET currency = excluded.currency, rate = excluded.rate,
+			amount_usd = excluded.amount_usd, amount = excluded.amount, created_at = excluded.created_at
+	`, q.Reference, string(q.Currency), q.Rate, q.AmountUSD, q.Amount, queueTime(q.CreatedAt))
+	return err
+}
+
+// GetPriceQuote returns the price locked for a payment, or nil if none was
+func (s *PostgresStore) GetPriceQuote(reference string) (*billing.PriceQuote, error) {
+	var q billing.PriceQuote
+	var currency, created string
+	err := s.db.QueryRow(`
+		SELECT reference, currency, rate, amount_usd, amount, created_at FROM price_quotes WHERE reference = $1
+	`, reference).Scan(&q.Reference, &currency, &q.Rate, &q.AmountUSD, &q.Amount, &created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.Currency = billing.CurrencyCode(currency)
+	if t := parseQueueTime(created); t != nil {
+		q.CreatedAt = *t
+	}
+	return &q, nil
+}
+
+// --- Invoices ---
+
+// GetBillingProfile returns who a user's invoices are made out to, or nil if
+// they haven't said
+func (s *PostgresStore) GetBillingProfile(userID string) (*billing.BillingProfile, error) {
+	p := billing.BillingProfile{UserID: userID}
+	var updated string
+	err := s.db.QueryRow(`
+		SELECT name, company, tax_id, address, city, postal_code, country, updated_at
+		FROM billing_profiles WHERE user_id = $1
+	`, userID).Scan(&p.Name, &p.Company, &p.TaxID, &p.Address, &p.City, &p.PostalCode, &p.Country, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(updated); t != nil {
+		p.UpdatedAt = *t
+	}
+	return &p, nil
+}
+
+func (s *PostgresStore) SaveBillingProfile(p *billing.BillingProfile) error {
+	_, err := s.db.Exec(`
+		INSERT INTO billing_profiles (user_id, name, company, tax_id, address, city, postal_code, country, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id) DO UPDATE SET name = excluded.name, company = excluded.company,
+			tax_id = excluded.tax_id, address = excluded.address, city = excluded.city,
+			postal_code = excluded.postal_code, country = excluded.country, updated_at = excluded.updated_at
+	`, p.UserID, p.Name, p.Company, p.TaxID, p.Address, p.City, p.PostalCode, p.Country, queueTime(p.UpdatedAt))
+	return err
+}
+
+// CreateInvoice numbers and stores an invoice in one transaction, so a
+// failed insert gives its number back
+func (s *PostgresStore) CreateInvoice(inv *billing.Invoice) error {
+	customer, _ := json.Marshal(inv.Customer)
+	lines, _ := json.Marshal(inv.Lines)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	year := inv.IssuedAt.UTC().Year()
+	var seq int
+	if err := tx.QueryRow(`
+		INSERT INTO invoice_sequences (year, last_number) VALUES ($1, 1)
+		ON CONFLICT (year) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+		RETURNING last_number
+	`, year).Scan(&seq); err != nil {
+		return err
+	}
+	number := billing.InvoiceNumber(year, seq)
+
+	if _, err := tx.Exec(`
+		INSERT INTO invoices (id, number, user_id, transaction_id, email, customer, currency, lines, subtotal,
+			tax_name, tax_rate, tax_amount, reverse_charge, total, period_start, period_end, issued_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+	`, inv.ID, number, inv.UserID, inv.TransactionID, inv.Email, string(customer), string(inv.Currency), string(lines),
+		inv.Subtotal, inv.TaxName, inv.TaxRate, inv.TaxAmount, inv.ReverseCharge, inv.Total,
+		queueTimePtr(inv.PeriodStart), queueTimePtr(inv.PeriodEnd), queueTime(inv.IssuedAt)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	inv.Number = number
+	return nil
+}
+
+// GetInvoice returns an invoice by its ID or number
+func (s *PostgresStore) GetInvoice(id string) (*billing.Invoice, error) {
+	inv, err := scanInvoice(s.db.QueryRow("SELECT "+invoiceColumns+" FROM invoices WHERE id = $1 OR number = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invoice %s not found", id)
+	}
+	return inv, err
+}
+
+func (s *PostgresStore) GetInvoiceByTransaction(transactionID string) (*billing.Invoice, error) {
+	inv, err := scanInvoice(s.db.QueryRow("SELECT "+invoiceColumns+" FROM invoices WHERE transaction_id = $1", transactionID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+// ListInvoices returns a page of a user's invoices, newest first, and how
+// many they have
+func (s *PostgresStore) ListInvoices(userID string, limit, offset int) ([]*billing.Invoice, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM invoices WHERE user_id = $1", userID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+invoiceColumns+` FROM invoices WHERE user_id = $1
+		ORDER BY issued_at DESC, number DESC LIMIT $2 OFFSET $3
+	`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var invoices []*billing.Invoice
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, total, rows.Err()
+}
+
+func (s *PostgresStore) MarkInvoiceEmailed(id string, at time.Time) error {
+	_, err := s.db.Exec("UPDATE invoices SET emailed_at = $1 WHERE id = $2", queueTime(at), id)
+	return err
+}
+
+func (s *PostgresStore) SaveInvoicePDF(id string, pdf []byte) error {
+	_, err := s.db.Exec("UPDATE invoices SET pdf = $1 WHERE id = $2", pdf, id)
+	return err
+}
+
+func (s *PostgresStore) GetInvoicePDF(id string) ([]byte, error) {
+	var pdf []byte
+	err := s.db.QueryRow("SELECT pdf FROM invoices WHERE id = $1", id).Scan(&pdf)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invoice %s not found", id)
+	}
+	return pdf, err
+}
+
+// --- Promotions ---
+
+func (s *PostgresStore) CreateCoupon(c *billing.Coupon) error {
+	plans := make([]string, len(c.Plans))
+	for i, id := range c.Plans {
+		plans[i] = string(id)
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO coupons (code, type, value, plans, max_redemptions, redemptions, expires_at, first_period_only, active, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, c.Code, c.Type, c.Value, strings.Join(plans, ","), c.MaxRedemptions, c.Redemptions, queueTimePtr(c.ExpiresAt),
+		c.FirstPeriodOnly, c.Active, queueTime(c.CreatedAt))
+	return err
+}
+
+// GetCoupon returns a coupon by its code, or nil
+func (s *PostgresStore) GetCoupon(code string) (*billing.Coupon, error) {
+	c, err := scanCoupon(s.db.QueryRow("SELECT "+couponColumns+" FROM coupons WHERE code = $1", code))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// ListCoupons returns a page of coupons, newest first
+func (s *PostgresStore) ListCoupons(limit, offset int) ([]*billing.Coupon, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM coupons").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+couponColumns+" FROM coupons ORDER BY created_at DESC, code LIMIT $1 OFFSET $2", limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var coupons []*billing.Coupon
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		coupons = append(coupons, c)
+	}
+	return coupons, total, rows.Err()
+}
+
+func (s *PostgresStore) SetCouponActive(code string, active bool) error {
+	_, err := s.db.Exec("UPDATE coupons SET active = $1 WHERE code = $2", active, code)
+	return err
+}
+
+// CreateRedemption records a discounted payment. A reference that was
+// already recorded is left as it is.
+func (s *PostgresStore) CreateRedemption(r *billing.CouponRedemption) error {
+	_, err := s.db.Exec(`
+		INSERT INTO coupon_redemptions (reference, code, user_id, plan_id, discount_usd, renewal, status, created_at, redeemed_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, NULLIF($9, ''))
+		ON CONFLICT (reference) DO NOTHING
+	`, r.Reference, r.Code, r.UserID, r.PlanID, r.DiscountUSD, r.Renewal, r.Status,
+		queueTime(r.CreatedAt), queueTimePtr(r.RedeemedAt))
+	return err
+}
+
+// GetRedemption returns the redemption of a payment, or nil
+func (s *PostgresStore) GetRedemption(reference string) (*billing.CouponRedemption, error) {
+	r, err := scanRedemption(s.db.QueryRow("SELECT "+redemptionColumns+" FROM coupon_redemptions WHERE reference = $1", reference))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// ReserveCoupon records the pending redemption of a checkout and holds one
+// of its coupon's redemptions. It fails with billing.ErrCouponUnavailable if
+// the coupon is fully redeemed or the user already paid with it or holds it.
+func (s *PostgresStore) ReserveCoupon(r *billing.CouponRedemption) error {
+	return reserveCoupon(s.db, DialectPostgres, r)
+}
+
+// RedeemCoupon marks a pending or released redemption paid. A released one
+// is counted against its coupon again, as its payment went through anyway.
+// It reports false otherwise, so a payment is only counted once.
+func (s *PostgresStore) RedeemCoupon(reference string, at time.Time) (bool, error) {
+	return redeemCoupon(s.db, DialectPostgres, reference, queueTime(at))
+}
+
+// ReleaseCoupon gives back the hold of a pending redemption
+func (s *PostgresStore) ReleaseCoupon(reference string) (bool, error) {
+	n, err := releaseCoupons(s.db, DialectPostgres, "reference = ?", reference)
+	return n > 0, err
+}
+
+// ReleaseCoupons gives back the holds of redemptions pending since before a
+// time
+func (s *PostgresStore) ReleaseCoupons(before time.Time) (int, error) {
+	return releaseCoupons(s.db, DialectPostgres, "created_at < ?", queueTime(before))
+}
+
+// HasRedeemed reports whether a user paid with a coupon or holds it
+func (s *PostgresStore) HasRedeemed(code, userID string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM coupon_redemptions
+		WHERE user_id = $1 AND code = $2 AND status IN ($3, $4) AND renewal = FALSE
+	`, userID, code, billing.RedemptionRedeemed, billing.RedemptionPending).Scan(&n)
+	return n > 0, err
+}
+
+// ListRedemptions returns a page of the payments a coupon was redeemed on,
+// newest first. Checkouts that were never paid are left out.
+func (s *PostgresStore) ListRedemptions(code string, limit, offset int) ([]*billing.CouponRedemption, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM coupon_redemptions WHERE code = $1 AND status = $2",
+		code, billing.RedemptionRedeemed).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+redemptionColumns+` FROM coupon_redemptions WHERE code = $1 AND status = $2
+		ORDER BY created_at DESC, reference LIMIT $3 OFFSET $4
+	`, code, billing.RedemptionRedeemed, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var redemptions []*billing.CouponRedemption
+	for rows.Next() {
+		r, err := scanRedemption(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, total, rows.Err()
+}
+
+// SetSubscriptionCoupon puts a recurring coupon on a subscription
+func (s *PostgresStore) SetSubscriptionCoupon(subscriptionID, code string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET coupon = $1 WHERE id = $2", code, subscriptionID)
+	return err
+}
+
+// GetReferralCode returns the referral code of a user, or an empty string
+func (s *PostgresStore) GetReferralCode(userID string) (string, error) {
+	var code string
+	err := s.db.QueryRow("SELECT code FROM referral_codes WHERE user_id = $1", userID).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return code, err
+}
+
+func (s *PostgresStore) CreateReferralCode(userID, code string) error {
+	_, err := s.db.Exec("INSERT INTO referral_codes (user_id, code) VALUES ($1, $2)", userID, code)
+	return err
+}
+
+// GetReferrer returns the user a referral code belongs to, or an empty string
+func (s *PostgresStore) GetReferrer(code string) (string, error) {
+	var userID string
+	err := s.db.QueryRow("SELECT user_id FROM referral_codes WHERE code = $1", code).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return userID, err
+}
+
+// CreateReferral records who referred a new user. A user is only ever
+// referred once.
+func (s *PostgresStore) CreateReferral(r *billing.Referral) error {
+	_, err := s.db.Exec(`
+		INSERT INTO referrals (referee_id, referrer_id, code, status, created_at)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (referee_id) DO NOTHING
+	`, r.RefereeID, r.ReferrerID, r.Code, r.Status, queueTime(r.CreatedAt))
+	return err
+}
+
+// GetReferral returns who referred a user, or nil
+func (s *PostgresStore) GetReferral(refereeID string) (*billing.Referral, error) {
+	r, err := scanReferral(s.db.QueryRow("SELECT "+referralColumns+" FROM referrals WHERE referee_id = $1", refereeID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// RewardReferral marks a pending referral rewarded by the referee's payment
+func (s *PostgresStore) RewardReferral(refereeID, reference string, rewardUSD float64, at time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE referrals SET status = $1, reference = $2, reward_usd = $3, rewarded_at = $4
+		WHERE referee_id = $5 AND status = $6
+	`, billing.ReferralRewarded, reference, rewardUSD, queueTime(at), refereeID, billing.ReferralPending)
+	return err
+}
+
+// ListReferrals returns a page of the referrals of a referrer, or of every
+// referrer if referrerID is empty, newest first
+func (s *PostgresStore) ListReferrals(referrerID string, limit, offset int) ([]*billing.Referral, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM referrals WHERE $1 = '' OR referrer_id = $1", referrerID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+referralColumns+` FROM referrals WHERE $1 = '' OR referrer_id = $1
+		ORDER BY created_at DESC, referee_id LIMIT $2 OFFSET $3
+	`, referrerID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var referrals []*billing.Referral
+	for rows.Next() {
+		r, err := scanReferral(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		referrals = append(referrals, r)
+	}
+	return referrals, total, rows.Err()
+}
+
+// CountReferrals returns how many users a referrer referred, how many of
+// them were rewarded and the credits the referrer earned
+func (s *PostgresStore) CountReferrals(referrerID string) (int, int, float64, error) {
+	var referred, rewarded int
+	var earned float64
+	err := s.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN status = $1 THEN 1 ELSE 0 END), 0), COALESCE(SUM(reward_usd), 0)
+		FROM referrals WHERE referrer_id = $2
+	`, billing.ReferralRewarded, referrerID).Scan(&referred, &rewarded, &earned)
+	return referred, rewarded, earned, err
+}
+
+// --- Organizations ---
+
+// CreateOrg creates an organization with its owner as the first member
+func (s *PostgresStore) CreateOrg(org *billing.Organization, owner *billing.Member) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO organizations (id, name, owner_id, created_at) VALUES ($1, $2, $3, $4)",
+		org.ID, org.Name, org.OwnerID, queueTime(org.CreatedAt)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO org_members (user_id, org_id, role, data_limit_mb, max_connections, joined_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, owner.UserID, owner.OrgID, owner.Role, owner.DataLimitMB, owner.MaxConnections, queueTime(owner.JoinedAt)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetOrg returns an organization, or nil
+func (s *PostgresStore) GetOrg(id string) (*billing.Organization, error) {
+	var org billing.Organization
+	var created string
+	err := s.db.QueryRow("SELECT id, name, owner_id, created_at FROM organizations WHERE id = $1", id).
+		Scan(&org.ID, &org.Name, &org.OwnerID, &created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(created); t != nil {
+		org.CreatedAt = *t
+	}
+	return &org, nil
+}
+
+// GetMembership returns the organization membership of a user, or nil
+func (s *PostgresStore) GetMembership(userID string) (*billing.Member, error) {
+	m, err := scanMember(s.db.QueryRow("SELECT "+memberColumns+
+		" FROM org_members m JOIN users u ON u.id = m.user_id WHERE m.user_id = $1", userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// ListMembers returns the members of an organization in the order they
+// joined
+func (s *PostgresStore) ListMembers(orgID string) ([]*billing.Member, error) {
+	rows, err := s.db.Query("SELECT "+memberColumns+
+		" FROM org_members m JOIN users u ON u.id = m.user_id WHERE m.org_id = $1 ORDER BY m.joined_at, u.email", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*billing.Member
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *PostgresStore) AddMember(m *billing.Member) error {
+	_, err := s.db.Exec(`
+		INSERT INTO org_members (user_id, org_id, role, data_limit_mb, max_connections, joined_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, m.UserID, m.OrgID, m.Role, m.DataLimitMB, m.MaxConnections, queueTime(m.JoinedAt))
+	return err
+}
+
+func (s *PostgresStore) UpdateMember(m *billing.Member) error {
+	_, err := s.db.Exec(`
+		UPDATE org_members SET role = $1, data_limit_mb = $2, max_connections = $3
+		WHERE org_id = $4 AND user_id = $5
+	`, m.Role, m.DataLimitMB, m.MaxConnections, m.OrgID, m.UserID)
+	return err
+}
+
+func (s *PostgresStore) RemoveMember(orgID, userID string) error {
+	_, err := s.db.Exec("DELETE FROM org_members WHERE org_id = $1 AND user_id = $2", orgID, userID)
+	return err
+}
+
+func (s *PostgresStore) CreateInvitation(inv *billing.Invitation) error {
+	_, err := s.db.Exec(`
+		INSERT INTO org_invitations (id, org_id, email, role, invited_by, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, inv.ID, inv.OrgID, inv.Email, inv.Role, inv.InvitedBy, inv.TokenHash,
+		queueTime(inv.ExpiresAt), queueTime(inv.CreatedAt))
+	return err
+}
+
+// GetInvitationByToken returns the invitation with a token hash, or nil
+func (s *PostgresStore) GetInvitationByToken(tokenHash string) (*billing.Invitation, error) {
+	inv, err := scanInvitation(s.db.QueryRow("SELECT "+invitationColumns+
+		" FROM org_invitations WHERE token_hash = $1", tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+// ListInvitations returns the invitations of an organization that were
+// neither accepted nor have expired, newest first
+func (s *PostgresStore) ListInvitations(orgID string) ([]*billing.Invitation, error) {
+	rows, err := s.db.Query("SELECT "+invitationColumns+` FROM org_invitations
+		WHERE org_id = $1 AND accepted_at IS NULL AND expires_at > $2
+		ORDER BY created_at DESC`, orgID, queueTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []*billing.Invitation
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// AcceptInvitation marks a pending invitation accepted and reports whether
+// it was still pending
+func (s *PostgresStore) AcceptInvitation(id string, at time.Time) (bool, error) {
+	res, err := s.db.Exec("UPDATE org_invitations SET accepted_at = $1 WHERE id = $2 AND accepted_at IS NULL",
+		queueTime(at), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *PostgresStore) DeleteInvitation(orgID, id string) error {
+	_, err := s.db.Exec("DELETE FROM org_invitations WHERE org_id = $1 AND id = $2 AND accepted_at IS NULL", orgID, id)
+	return err
+}
+
+// AddMemberUsage adds to what a member used of a period
+func (s *PostgresStore) AddMemberUsage(orgID, userID string, periodStart time.Time, bytes int64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO org_member_usage (org_id, user_id, period_start, data_transferred) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (org_id, user_id, period_start) DO UPDATE SET data_transferred = org_member_usage.data_transferred + excluded.data_transferred
+	`, orgID, userID, queueTime(periodStart), bytes)
+	return err
+}
+
+// GetMemberUsage returns what a member used of a period
+func (s *PostgresStore) GetMemberUsage(orgID, userID string, periodStart time.Time) (int64, error) {
+	var bytes int64
+	err := s.db.QueryRow(`
+		SELECT COALESCE(SUM(data_transferred), 0) FROM org_member_usage
+		WHERE org_id = $1 AND user_id = $2 AND period_start = $3
+	`, orgID, userID, queueTime(periodStart)).Scan(&bytes)
+	return bytes, err
+}
+
+// --- Sub-users ---
+
+func (s *PostgresStore) CreateSubUser(u *billing.SubUser) error {
+	_, err := s.db.Exec(`
+		INSERT INTO subusers (id, parent_id, label, username, password_hash, data_limit_mb, request_limit,
+			max_connections, countries, active, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, u.ID, u.ParentID, u.Label, u.Username, u.PasswordHash, u.DataLimitMB, u.RequestLimit,
+		u.MaxConnections, strings.Join(u.Countries, ","), u.Active, queueTime(u.CreatedAt))
+	return err
+}
+
+// GetSubUser returns a sub-user, or nil
+func (s *PostgresStore) GetSubUser(id string) (*billing.SubUser, error) {
+	u, err := scanSubUser(s.db.QueryRow("SELECT "+subUserColumns+" FROM subusers WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// GetSubUserByUsername returns the sub-user with a proxy username, or nil
+func (s *PostgresStore) GetSubUserByUsername(username string) (*billing.SubUser, error) {
+	u, err := scanSubUser(s.db.QueryRow("SELECT "+subUserColumns+" FROM subusers WHERE username = $1", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// ListSubUsers returns the sub-users of a parent, oldest first
+func (s *PostgresStore) ListSubUsers(parentID string) ([]*billing.SubUser, error) {
+	rows, err := s.db.Query("SELECT "+subUserColumns+" FROM subusers WHERE parent_id = $1 ORDER BY created_at, id", parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*billing.SubUser
+	for rows.Next() {
+		u, err := scanSubUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *PostgresStore) UpdateSubUser(u *billing.SubUser) error {
+	_, err := s.db.Exec(`
+		UPDATE subusers SET label = $1, password_hash = $2, data_limit_mb = $3, request_limit = $4,
+			max_connections = $5, countries = $6, active = $7
+		WHERE id = $8 AND parent_id = $9
+	`, u.Label, u.PasswordHash, u.DataLimitMB, u.RequestLimit, u.MaxConnections,
+		strings.Join(u.Countries, ","), u.Active, u.ID, u.ParentID)
+	return err
+}
+
+// DeleteSubUser removes a sub-user and their usage
+func (s *PostgresStore) DeleteSubUser(parentID, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM subusers WHERE id = $1 AND parent_id = $2", id, parentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM subuser_usage WHERE subuser_id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddSubUserUsage adds to what a sub-user used of a period
+func (s *PostgresStore) AddSubUserUsage(id string, periodStart time.Time, bytes, requests int64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO subuser_usage (subuser_id, period_start, data_transferred, requests_made) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subuser_id, period_start) DO UPDATE SET
+			data_transferred = subuser_usage.data_transferred + excluded.data_transferred,
+			requests_made = subuser_usage.requests_made + excluded.requests_made
+	`, id, queueTime(periodStart), bytes, requests)
+	return err
+}
+
+// GetSubUserUsage returns the bytes and requests a sub-user used of a period
+func (s *PostgresStore) GetSubUserUsage(id string, periodStart time.Time) (int64, int64, error) {
+	var bytes, requests int64
+	err := s.db.QueryRow(`
+		SELECT COALESCE(SUM(data_transferred), 0), COALESCE(SUM(requests_made), 0) FROM subuser_usage
+		WHERE subuser_id = $1 AND period_start = $2
+	`, id, queueTime(periodStart)).Scan(&bytes, &requests)
+	return bytes, requests, err
+}
+
+// ListSubUserUsage returns the periods a sub-user used, newest first
+func (s *PostgresStore) ListSubUserUsage(id string, limit int) ([]billing.SubUserPeriod, error) {
+	rows, err := s.db.Query(`
+		SELECT period_start, data_transferred, requests_made FROM subuser_usage
+		WHERE subuser_id = $1 ORDER BY period_start DESC LIMIT $2
+	`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var periods []billing.SubUserPeriod
+	for rows.Next() {
+		var p billing.SubUserPeriod
+		var start string
+		if err := rows.Scan(&start, &p.DataTransferred, &p.RequestsMade); err != nil {
+			return nil, err
+		}
+		if t := parseQueueTime(start); t != nil {
+			p.PeriodStart = *t
+		}
+		periods = append(periods, p)
+	}
+	return periods, rows.Err()
 }
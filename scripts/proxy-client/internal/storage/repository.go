@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/adblock"
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
+)
+
+// Repository is the persistence every backend provides: users, sessions and
+// sign-in security, subscriptions and plans, usage, payment transactions and
+// ad-block rules. Store (SQLite), PostgresStore and InMemoryStore implement
+// it and behave the same; the conformance tests hold them to that.
+type Repository interface {
+	UserRepository
+	SessionRepository
+	SubscriptionRepository
+	UsageRepository
+	TransactionRepository
+	AdblockRepository
+	Close() error
+}
+
+// UserRepository stores accounts and answers data access and deletion
+// requests
+type UserRepository interface {
+	CreateUser(id, email, passwordHash string) error
+	GetUserByEmail(email string) (*User, error) // fails if there is none
+	GetUserByID(id string) (*User, error)       // nil if there is none
+	GetUserEmail(id string) (string, error)
+	MarkEmailVerified(id string) error
+	UpdateUserPassword(id, passwordHash string) error
+	ExportUser(id string) (*UserExport, error) // ErrUserNotFound if there is none
+	DeleteUser(id string) error                // keeps payments and invoices, anonymised
+}
+
+// SessionRepository stores signed-in devices and what guards sign-ins: token
+// revocations, API keys, email tokens, second factors, failed attempts and
+// the activity log
+type SessionRepository interface {
+	CreateSession(id, userID, token string, expiresAt time.Time) error
+	GetSession(token string) (*Session, error)
+	GetSessionByID(id string) (*Session, error)
+	ListUserSessions(userID string) ([]*Session, error)
+	RotateSessionToken(id, oldToken, newToken string, expiresAt time.Time) (bool, error)
+	GetRotatedTokenSession(token string) (string, error)
+	TouchSession(id, userAgent, ipAddress string) error
+	DeleteSession(token string) error
+	DeleteSessionByID(id string) error
+	RevokeSession(sessionID, userID string, expiresAt time.Time) error
+	GetSessionRevocations() (map[string]time.Time, error)
+	GetSessionRevocation(sessionID string) (*time.Time, error)
+	PruneSessionRevocations(now time.Time) error
+
+	CreateAPIKey(key *APIKey) error
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	ListUserAPIKeys(userID string) ([]*APIKey, error)
+	TouchAPIKey(id string, usedAt time.Time) error
+	DeleteAPIKey(id, userID string) error
+
+	CreateEmailToken(hash, userID, purpose string, expiresAt time.Time) error
+	ConsumeEmailToken(hash, purpose string, now time.Time) (string, error)
+	DeleteEmailTokens(userID, purpose string) error
+
+	CreateLoginChallenge(id, userID string, expiresAt time.Time) error
+	ClaimLoginChallenge(id string, maxAttempts int, now time.Time) (*LoginChallenge, bool, error)
+	FinishLoginChallenge(id string, verified bool) error
+
+	GetTOTP(userID string) (*TOTPSecret, error)
+	SetTOTP(userID, secretEnc string, enabled bool) error
+	EnableTOTP(userID string, step int64) error
+	MarkTOTPStepUsed(userID string, step int64) (bool, error)
+	DeleteTOTP(userID string) error
+	ReplaceRecoveryCodes(userID string, hashes []string) error
+	UseRecoveryCode(userID, hash string) (bool, error)
+	CountRecoveryCodes(userID string) (int, error)
+
+	ReserveLoginAttempt(key string, prev *LoginFailure, now time.Time, window time.Duration) (*LoginFailure, bool, error)
+	ReleaseLoginAttempt(key string) error
+	GetLoginFailure(key string) (*LoginFailure, error)
+	ClearLoginFailures(key string) error
+	PruneLoginFailures(before time.Time) error
+
+	AddActivity(a *Activity) error
+	ListActivities(userID string, limit, offset int) ([]*Activity, int, error)
+}
+
+// SubscriptionRepository stores subscriptions through their lifecycle and
+// the versioned plan catalogue they subscribe to
+type SubscriptionRepository interface {
+	GetSubscription(userID string) (*billing.PersistedSubscription, error)
+	SetSubscription(userID, id, planID string, planVersion int, status, start, end string, autoRenew bool) error
+	ListRenewableSubscriptions() ([]*billing.PersistedSubscription, error)
+	UpdateSubscriptionLifecycle(sub *billing.PersistedSubscription) error
+	SetScheduledPlan(subscriptionID, planID string) error
+	SetQuotaMode(subscriptionID, mode string) error
+	ClaimRenewal(id string, now, until time.Time) (bool, error)
+	MarkQuotaReset(id, periodStart string) (bool, error)
+	GetSubscriptionByPendingRenewal(reference string) (*billing.PersistedSubscription, error)
+	ClearPendingRenewal(id, reference string) (bool, error)
+	SetSubscriptionPaymentAuth(id, auth, currency string) error
+	SetSubscriptionStripeID(id, stripeSubID string) error
+	GetSubscriptionByStripeID(stripeSubID string) (*billing.PersistedSubscription, error)
+
+	ListPlans() ([]billing.Plan, error)
+	SavePlan(p *billing.Plan) error
+	SetPlanActive(id billing.PlanType, active bool) error
+}
+
+// UsageRepository stores usage per user and billing period
+type UsageRepository interface {
+	UpdateUsage(userID string, periodStart, periodEnd time.Time, dataTransferred, requests, ads, threats int64) error
+	GetPeriodUsage(userID string, periodStart time.Time) (int64, int64, int64, int64, error)
+	GetLatestUsage(userID string) (int64, int64, int64, int64, error)
+}
+
+// TransactionRepository stores payments, their deposits and refunds
+type TransactionRepository interface {
+	CreateTransaction(tx *Transaction) error
+	GetTransaction(id string) (*Transaction, error) // sql.ErrNoRows if there is none
+	SetTransactionGatewayRef(id, ref string) error
+	GetRefundByGatewayRef(method, ref string) (*Transaction, error)
+	GetDepositTransaction(userID string) (*Transaction, error)
+	SetDepositStatus(id, status string, from ...string) (bool, error)
+	ListRefunds(userID string, limit, offset int) ([]*Transaction, int, error)
+	RecordRefund(refund *Transaction) error
+	UpdateRefund(id, status, gatewayRef string) error
+	FailRefund(id string) error
+}
+
+// AdblockRepository stores the ad-block whitelist and custom rules
+type AdblockRepository interface {
+	GetWhitelist() ([]string, error)
+	AddToWhitelist(domain string) error
+	RemoveFromWhitelist(domain string) error
+	GetCustomRules() ([]string, error)
+	SetCustomRules(rules []string) error
+}
+
+// BillingRepository is a Repository that also keeps credits, quotas,
+// promotions, organizations, sub-users, invoices, crypto payments, exchange
+// rates and the webhook queue. Store and PostgresStore are; InMemoryStore is
+// not, so those features are off without a database.
+type BillingRepository interface {
+	Repository
+	billing.CreditStore
+	billing.QuotaStore
+	billing.PromotionStore
+	billing.OrgStore
+	billing.SubUserStore
+	billing.InvoiceStore
+	billing.CryptoStore
+	billing.RateStore
+	queue.Store
+}
+
+var (
+	_ Repository = (*Store)(nil)
+	_ Repository = (*PostgresStore)(nil)
+	_ Repository = (*InMemoryStore)(nil)
+
+	_ BillingRepository = (*Store)(nil)
+	_ BillingRepository = (*PostgresStore)(nil)
+
+	_ billing.LifecycleStore = Repository(nil)
+	_ billing.PlanStore      = Repository(nil)
+	_ adblock.Store          = Repository(nil)
+)
+
+// MemoryURL selects the in-memory backend
+const MemoryURL = "memory://"
+
+// Open returns the backend a database URL selects, migrated to the latest
+// schema: a postgres:// URL, MemoryURL, or else the path of a SQLite
+// database, the default one if empty
+func Open(url string) (Repository, error) {
+	if url == MemoryURL {
+		return NewInMemoryStore(), nil
+	}
+	if isPostgresURL(url) {
+		store, err := NewPostgresStore(url)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	dbPath, err := sqlitePath(url)
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewStoreWithPath(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return store, nil
+}
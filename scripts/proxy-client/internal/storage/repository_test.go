@@ -0,0 +1,1526 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
+)
+
+// backends returns a constructor of an empty repository for every backend:
+// SQLite, in memory, and Postgres if TEST_DATABASE_URL points at a database
+// the tests may wipe
+func backends(t *testing.T) map[string]func(t *testing.T) Repository {
+	out := map[string]func(t *testing.T) Repository{
+		"sqlite": func(t *testing.T) Repository {
+			store, err := NewStoreWithPath(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatalf("Failed to create store: %v", err)
+			}
+			return store
+		},
+		"memory": func(t *testing.T) Repository {
+			return NewInMemoryStore()
+		},
+	}
+	if url := os.Getenv("TEST_DATABASE_URL"); url != "" {
+		out["postgres"] = func(t *testing.T) Repository {
+			store, err := NewPostgresStore(url)
+			if err != nil {
+				t.Fatalf("Failed to create store: %v", err)
+			}
+			// Every table but the migrations and the seeded plans
+			_, err = store.db.Exec(`DO $$ BEGIN
+				EXECUTE (SELECT 'TRUNCATE ' || string_agg(quote_ident(tablename), ', ') || ' CASCADE'
+					FROM pg_tables WHERE schemaname = current_schema()
+					AND tablename NOT IN ('schema_migrations', 'plans', 'plan_versions'));
+			END $$`)
+			if err != nil {
+				t.Fatalf("Failed to reset database: %v", err)
+			}
+			return store
+		}
+	}
+	return out
+}
+
+// conform runs a test against every backend
+func conform(t *testing.T, test func(t *testing.T, repo Repository)) {
+	for name, open := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := open(t)
+			defer repo.Close()
+			test(t, repo)
+		})
+	}
+}
+
+// conformSQL runs a test against every SQL backend, as S: the SQLite store
+// and the Postgres store implement more than Repository
+func conformSQL[S any](t *testing.T, test func(t *testing.T, store S)) {
+	for name, open := range backends(t) {
+		if name == "memory" {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			repo := open(t)
+			defer repo.Close()
+			store, ok := repo.(S)
+			if !ok {
+				t.Fatalf("%T does not implement %v", repo, reflect.TypeFor[S]())
+			}
+			test(t, store)
+		})
+	}
+}
+
+// sqlDB returns the database of a SQL store
+func sqlDB(store any) *sql.DB {
+	switch s := store.(type) {
+	case *Store:
+		return s.db
+	case *PostgresStore:
+		return s.db
+	}
+	return nil
+}
+
+func TestOpen(t *testing.T) {
+	repo, err := Open(MemoryURL)
+	if err != nil {
+		t.Fatalf("Failed to open in-memory backend: %v", err)
+	}
+	if _, ok := repo.(*InMemoryStore); !ok {
+		t.Errorf("Expected an in-memory store, got %T", repo)
+	}
+
+	repo, err = Open("sqlite://" + filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite backend: %v", err)
+	}
+	defer repo.Close()
+	if _, ok := repo.(*Store); !ok {
+		t.Errorf("Expected a SQLite store, got %T", repo)
+	}
+}
+
+func TestRepositoryUsers(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		if err := repo.CreateUser("u1", "a@example.com", "hash"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		if err := repo.CreateUser("u2", "a@example.com", "hash"); err == nil {
+			t.Error("Expected a duplicate email to be refused")
+		}
+
+		u, err := repo.GetUserByEmail("a@example.com")
+		if err != nil || u.ID != "u1" || u.PasswordHash != "hash" || u.EmailVerified {
+			t.Fatalf("GetUserByEmail = %+v, %v", u, err)
+		}
+		if _, err := repo.GetUserByEmail("b@example.com"); err == nil {
+			t.Error("Expected an unknown email to fail")
+		}
+		if u, err := repo.GetUserByID("missing"); u != nil || err != nil {
+			t.Errorf("Expected no user for an unknown ID, got %+v, %v", u, err)
+		}
+		if email, err := repo.GetUserEmail("u1"); err != nil || email != "a@example.com" {
+			t.Errorf("GetUserEmail = %q, %v", email, err)
+		}
+
+		if err := repo.MarkEmailVerified("u1"); err != nil {
+			t.Fatalf("MarkEmailVerified failed: %v", err)
+		}
+		if err := repo.UpdateUserPassword("u1", "new"); err != nil {
+			t.Fatalf("UpdateUserPassword failed: %v", err)
+		}
+		if err := repo.UpdateUserPassword("missing", "new"); err == nil {
+			t.Error("Expected a password change of an unknown user to fail")
+		}
+		u, err = repo.GetUserByID("u1")
+		if err != nil || !u.EmailVerified || u.PasswordHash != "new" {
+			t.Errorf("GetUserByID = %+v, %v", u, err)
+		}
+	})
+}
+
+func TestRepositorySessions(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		expires := time.Now().Add(time.Hour)
+		if err := repo.CreateSession("s1", "u1", "tok1", expires); err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		if err := repo.CreateSession("s2", "u1", "tok2", expires); err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+
+		sess, err := repo.GetSession("tok1")
+		if err != nil || sess.ID != "s1" || sess.UserID != "u1" {
+			t.Fatalf("GetSession = %+v, %v", sess, err)
+		}
+		if _, err := repo.GetSession("unknown"); err == nil {
+			t.Error("Expected an unknown token to fail")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		if err := repo.TouchSession("s1", "agent", "10.0.0.1"); err != nil {
+			t.Fatalf("TouchSession failed: %v", err)
+		}
+		sessions, err := repo.ListUserSessions("u1")
+		if err != nil || len(sessions) != 2 || sessions[0].ID != "s1" || sessions[0].UserAgent != "agent" || sessions[0].IPAddress != "10.0.0.1" {
+			t.Fatalf("Expected the touched session first, got %+v, %v", sessions, err)
+		}
+
+		ok, err := repo.RotateSessionToken("s1", "tok1", "tok3", expires)
+		if err != nil || !ok {
+			t.Fatalf("RotateSessionToken = %v, %v", ok, err)
+		}
+		if ok, _ := repo.RotateSessionToken("s1", "tok1", "tok4", expires); ok {
+			t.Error("Expected a rotated token not to rotate again")
+		}
+		if id, err := repo.GetRotatedTokenSession("tok1"); err != nil || id != "s1" {
+			t.Errorf("GetRotatedTokenSession = %q, %v", id, err)
+		}
+		if id, err := repo.GetRotatedTokenSession("tok2"); err != nil || id != "" {
+			t.Errorf("Expected no session for a current token, got %q, %v", id, err)
+		}
+		if sess, err := repo.GetSessionByID("s1"); err != nil || sess.Token != "tok3" {
+			t.Errorf("GetSessionByID = %+v, %v", sess, err)
+		}
+
+		if err := repo.DeleteSession("tok2"); err != nil {
+			t.Fatalf("DeleteSession failed: %v", err)
+		}
+		if err := repo.DeleteSessionByID("s1"); err != nil {
+			t.Fatalf("DeleteSessionByID failed: %v", err)
+		}
+		if sessions, _ := repo.ListUserSessions("u1"); len(sessions) != 0 {
+			t.Errorf("Expected no sessions left, got %d", len(sessions))
+		}
+		if id, _ := repo.GetRotatedTokenSession("tok1"); id != "" {
+			t.Errorf("Expected the rotated tokens of a deleted session gone, got %q", id)
+		}
+	})
+}
+
+func TestRepositoryRevocations(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		now := time.Now()
+		repo.RevokeSession("old", "u1", now.Add(-time.Minute))
+		repo.RevokeSession("new", "u1", now.Add(time.Hour))
+
+		revoked, err := repo.GetSessionRevocations()
+		if err != nil || len(revoked) != 2 {
+			t.Fatalf("GetSessionRevocations = %v, %v", revoked, err)
+		}
+		if at, err := repo.GetSessionRevocation("new"); err != nil || at == nil || at.Unix() != now.Add(time.Hour).Unix() {
+			t.Errorf("GetSessionRevocation = %v, %v", at, err)
+		}
+		if at, err := repo.GetSessionRevocation("other"); err != nil || at != nil {
+			t.Errorf("Expected no revocation, got %v, %v", at, err)
+		}
+
+		if err := repo.PruneSessionRevocations(now); err != nil {
+			t.Fatalf("PruneSessionRevocations failed: %v", err)
+		}
+		revoked, _ = repo.GetSessionRevocations()
+		if _, ok := revoked["new"]; len(revoked) != 1 || !ok {
+			t.Errorf("Expected only the unexpired revocation left, got %v", revoked)
+		}
+	})
+}
+
+func TestRepositoryAPIKeys(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		expires := time.Now().Add(time.Hour)
+		first := &APIKey{ID: "k1", UserID: "u1", Name: "ci", Prefix: "ap_1", KeyHash: "h1", Scopes: []string{"read", "billing"}, ExpiresAt: &expires, CreatedAt: time.Now().Add(-time.Hour)}
+		second := &APIKey{ID: "k2", UserID: "u1", Name: "cli", Prefix: "ap_2", KeyHash: "h2", CreatedAt: time.Now()}
+		for _, k := range []*APIKey{first, second} {
+			if err := repo.CreateAPIKey(k); err != nil {
+				t.Fatalf("CreateAPIKey failed: %v", err)
+			}
+		}
+
+		key, err := repo.GetAPIKeyByHash("h1")
+		if err != nil || key.ID != "k1" || !slices.Equal(key.Scopes, []string{"read", "billing"}) || key.ExpiresAt == nil || key.LastUsedAt != nil {
+			t.Fatalf("GetAPIKeyByHash = %+v, %v", key, err)
+		}
+		if _, err := repo.GetAPIKeyByHash("h3"); err == nil {
+			t.Error("Expected an unknown key to fail")
+		}
+
+		if err := repo.TouchAPIKey("k1", time.Now()); err != nil {
+			t.Fatalf("TouchAPIKey failed: %v", err)
+		}
+		keys, err := repo.ListUserAPIKeys("u1")
+		if err != nil || len(keys) != 2 || keys[0].ID != "k2" || keys[1].LastUsedAt == nil {
+			t.Fatalf("Expected the newest key first and the used one touched, got %+v, %v", keys, err)
+		}
+
+		if err := repo.DeleteAPIKey("k1", "u2"); err == nil {
+			t.Error("Expected a key of another user not to be deleted")
+		}
+		if err := repo.DeleteAPIKey("k1", "u1"); err != nil {
+			t.Fatalf("DeleteAPIKey failed: %v", err)
+		}
+		if keys, _ := repo.ListUserAPIKeys("u1"); len(keys) != 1 {
+			t.Errorf("Expected one key left, got %d", len(keys))
+		}
+	})
+}
+
+func TestRepositoryEmailTokensAndChallenges(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		now := time.Now()
+		repo.CreateEmailToken("t1", "u1", "verify", now.Add(time.Hour))
+		repo.CreateEmailToken("t2", "u1", "reset", now.Add(time.Hour))
+		repo.CreateEmailToken("t3", "u1", "reset", now.Add(-time.Minute))
+
+		if _, err := repo.ConsumeEmailToken("t1", "reset", now); err == nil {
+			t.Error("Expected a token of another purpose to fail")
+		}
+		if _, err := repo.ConsumeEmailToken("t3", "reset", now); err == nil {
+			t.Error("Expected an expired token to fail")
+		}
+		if userID, err := repo.ConsumeEmailToken("t1", "verify", now); err != nil || userID != "u1" {
+			t.Fatalf("ConsumeEmailToken = %q, %v", userID, err)
+		}
+		if _, err := repo.ConsumeEmailToken("t1", "verify", now); err == nil {
+			t.Error("Expected a used token to fail")
+		}
+		repo.DeleteEmailTokens("u1", "reset")
+		if _, err := repo.ConsumeEmailToken("t2", "reset", now); err == nil {
+			t.Error("Expected a deleted token to fail")
+		}
+
+		if err := repo.CreateLoginChallenge("c1", "u1", now.Add(5*time.Minute)); err != nil {
+			t.Fatalf("CreateLoginChallenge failed: %v", err)
+		}
+		ch, ok, err := repo.ClaimLoginChallenge("c1", 2, now)
+		if err != nil || !ok || ch.State != ChallengeVerifying || ch.Attempts != 1 || ch.UserID != "u1" {
+			t.Fatalf("ClaimLoginChallenge = %+v, %v, %v", ch, ok, err)
+		}
+		if _, ok, _ := repo.ClaimLoginChallenge("c1", 2, now); ok {
+			t.Error("Expected a challenge being verified not to be claimed")
+		}
+		repo.FinishLoginChallenge("c1", false)
+		if _, ok, _ := repo.ClaimLoginChallenge("c1", 2, now); !ok {
+			t.Error("Expected a failed challenge to be claimable again")
+		}
+		repo.FinishLoginChallenge("c1", false)
+		if ch, ok, _ := repo.ClaimLoginChallenge("c1", 2, now); ok || ch.Attempts != 2 {
+			t.Errorf("Expected no attempts left, got %+v, %v", ch, ok)
+		}
+		if ch, ok, err := repo.ClaimLoginChallenge("missing", 2, now); ch != nil || ok || err != nil {
+			t.Errorf("Expected no challenge, got %+v, %v, %v", ch, ok, err)
+		}
+	})
+}
+
+func TestRepositoryTwoFactor(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		if totp, err := repo.GetTOTP("u1"); totp != nil || err != nil {
+			t.Fatalf("Expected no enrollment, got %+v, %v", totp, err)
+		}
+
+		repo.SetTOTP("u1", "secret", false)
+		if err := repo.EnableTOTP("u1", 10); err != nil {
+			t.Fatalf("EnableTOTP failed: %v", err)
+		}
+		totp, err := repo.GetTOTP("u1")
+		if err != nil || !totp.Enabled || totp.SecretEnc != "secret" || totp.LastUsedStep != 10 {
+			t.Fatalf("GetTOTP = %+v, %v", totp, err)
+		}
+		if ok, _ := repo.MarkTOTPStepUsed("u1", 10); ok {
+			t.Error("Expected a used step to be refused")
+		}
+		if ok, _ := repo.MarkTOTPStepUsed("u1", 11); !ok {
+			t.Error("Expected a later step to be accepted")
+		}
+
+		repo.ReplaceRecoveryCodes("u1", []string{"r1", "r2"})
+		if ok, _ := repo.UseRecoveryCode("u1", "r1"); !ok {
+			t.Error("Expected a recovery code to be accepted")
+		}
+		if ok, _ := repo.UseRecoveryCode("u1", "r1"); ok {
+			t.Error("Expected a used recovery code to be refused")
+		}
+		if n, err := repo.CountRecoveryCodes("u1"); err != nil || n != 1 {
+			t.Errorf("CountRecoveryCodes = %d, %v", n, err)
+		}
+
+		repo.DeleteTOTP("u1")
+		if totp, _ := repo.GetTOTP("u1"); totp != nil {
+			t.Error("Expected the enrollment deleted")
+		}
+		if n, _ := repo.CountRecoveryCodes("u1"); n != 0 {
+			t.Errorf("Expected the recovery codes deleted, got %d", n)
+		}
+	})
+}
+
+func TestRepositoryLoginFailures(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		now := time.Now()
+		f, ok, err := repo.ReserveLoginAttempt("ip", nil, now, time.Hour)
+		if err != nil || !ok || f.Failures != 1 {
+			t.Fatalf("ReserveLoginAttempt = %+v, %v, %v", f, ok, err)
+		}
+		if _, ok, _ := repo.ReserveLoginAttempt("ip", nil, now, time.Hour); ok {
+			t.Error("Expected a stale counter to be refused")
+		}
+
+		prev, err := repo.GetLoginFailure("ip")
+		if err != nil || prev == nil || prev.Failures != 1 {
+			t.Fatalf("GetLoginFailure = %+v, %v", prev, err)
+		}
+		f, ok, err = repo.ReserveLoginAttempt("ip", prev, now.Add(time.Minute), time.Hour)
+		if err != nil || !ok || f.Failures != 2 {
+			t.Fatalf("ReserveLoginAttempt = %+v, %v, %v", f, ok, err)
+		}
+		repo.ReleaseLoginAttempt("ip")
+		if f, _ := repo.GetLoginFailure("ip"); f.Failures != 1 {
+			t.Errorf("Expected one failure after a release, got %d", f.Failures)
+		}
+
+		repo.ReserveLoginAttempt("email", nil, now.Add(-2*time.Hour), time.Hour)
+		if err := repo.PruneLoginFailures(now.Add(-time.Hour)); err != nil {
+			t.Fatalf("PruneLoginFailures failed: %v", err)
+		}
+		if f, _ := repo.GetLoginFailure("email"); f != nil {
+			t.Error("Expected the old counter pruned")
+		}
+		repo.ClearLoginFailures("ip")
+		if f, _ := repo.GetLoginFailure("ip"); f != nil {
+			t.Error("Expected the counter cleared")
+		}
+	})
+}
+
+func TestRepositoryActivity(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		base := time.Now().Add(-time.Hour)
+		for i, typ := range []string{"login", "password", "logout"} {
+			a := &Activity{ID: typ, UserID: "u1", Type: typ, Status: "success", Details: typ, CreatedAt: base.Add(time.Duration(i) * time.Minute)}
+			if err := repo.AddActivity(a); err != nil {
+				t.Fatalf("AddActivity failed: %v", err)
+			}
+		}
+
+		activities, total, err := repo.ListActivities("u1", 2, 0)
+		if err != nil || total != 3 || len(activities) != 2 || activities[0].Type != "logout" || activities[1].Type != "password" {
+			t.Fatalf("ListActivities = %+v, %d, %v", activities, total, err)
+		}
+		activities, _, _ = repo.ListActivities("u1", 2, 2)
+		if len(activities) != 1 || activities[0].Type != "login" {
+			t.Errorf("Expected the oldest entry on the second page, got %+v", activities)
+		}
+	})
+}
+
+func TestRepositorySubscriptions(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		repo.CreateUser("u2", "b@example.com", "hash")
+		start := time.Now().UTC().Format(time.RFC3339)
+		end := time.Now().UTC().AddDate(0, 1, 0).Format(time.RFC3339)
+
+		if sub, err := repo.GetSubscription("u1"); sub != nil || err != nil {
+			t.Fatalf("Expected no subscription, got %+v, %v", sub, err)
+		}
+		if err := repo.SetSubscription("u1", "sub1", "starter", 1, "expired", start, end, true); err != nil {
+			t.Fatalf("SetSubscription failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		repo.SetSubscription("u1", "sub2", "personal", 1, "active", start, end, true)
+		repo.SetSubscription("u2", "sub3", "team", 1, "expired", start, end, false)
+
+		sub, err := repo.GetSubscription("u1")
+		if err != nil || sub.ID != "sub2" || sub.PlanID != "personal" || sub.StartDate != start || sub.EndDate != end || !sub.AutoRenew {
+			t.Fatalf("Expected the latest subscription, got %+v, %v", sub, err)
+		}
+		if err := repo.SetSubscription("u1", "sub2", "team", 2, "active", start, end, false); err != nil {
+			t.Fatalf("SetSubscription update failed: %v", err)
+		}
+		if sub, _ := repo.GetSubscription("u1"); sub.ID != "sub2" || sub.PlanID != "team" || sub.PlanVersion != 2 || sub.AutoRenew {
+			t.Errorf("Expected the subscription updated, got %+v", sub)
+		}
+
+		subs, err := repo.ListRenewableSubscriptions()
+		if err != nil || len(subs) != 1 || subs[0].ID != "sub2" {
+			t.Fatalf("Expected only the current active subscription renewable, got %+v, %v", subs, err)
+		}
+
+		now := time.Now()
+		if ok, _ := repo.ClaimRenewal("sub2", now, now.Add(time.Minute)); !ok {
+			t.Error("Expected the first renewal claim to succeed")
+		}
+		if ok, _ := repo.ClaimRenewal("sub2", now, now.Add(time.Minute)); ok {
+			t.Error("Expected a held claim to be refused")
+		}
+		if ok, _ := repo.ClaimRenewal("sub2", now.Add(2*time.Minute), now.Add(3*time.Minute)); !ok {
+			t.Error("Expected a lapsed claim to be taken over")
+		}
+		if ok, _ := repo.MarkQuotaReset("sub2", start); !ok {
+			t.Error("Expected the first quota reset to be recorded")
+		}
+		if ok, _ := repo.MarkQuotaReset("sub2", start); ok {
+			t.Error("Expected a repeated quota reset to be refused")
+		}
+
+		sub, _ = repo.GetSubscription("u1")
+		sub.Status, sub.PendingRef, sub.RetryCount, sub.ScheduledPlan = "past_due", "renew-1", 2, "starter"
+		if err := repo.UpdateSubscriptionLifecycle(sub); err != nil {
+			t.Fatalf("UpdateSubscriptionLifecycle failed: %v", err)
+		}
+		repo.SetQuotaMode("sub2", "soft")
+		repo.SetSubscriptionPaymentAuth("sub2", "AUTH_1", "NGN")
+		repo.SetSubscriptionStripeID("sub2", "stripe_1")
+
+		pending, err := repo.GetSubscriptionByPendingRenewal("renew-1")
+		if err != nil || pending == nil || pending.Status != "past_due" || pending.RetryCount != 2 || pending.ScheduledPlan != "starter" ||
+			pending.QuotaMode != "soft" || pending.PaymentAuth != "AUTH_1" || pending.Currency != "NGN" || pending.LastReset != start {
+			t.Fatalf("GetSubscriptionByPendingRenewal = %+v, %v", pending, err)
+		}
+		if ok, _ := repo.ClearPendingRenewal("sub2", "renew-1"); !ok {
+			t.Error("Expected the pending renewal to clear")
+		}
+		if ok, _ := repo.ClearPendingRenewal("sub2", "renew-1"); ok {
+			t.Error("Expected a settled renewal not to clear again")
+		}
+		if sub, _ := repo.GetSubscriptionByPendingRenewal(""); sub != nil {
+			t.Error("Expected no subscription for an empty reference")
+		}
+
+		if sub, err := repo.GetSubscriptionByStripeID("stripe_1"); err != nil || sub == nil || sub.ID != "sub2" {
+			t.Errorf("GetSubscriptionByStripeID = %+v, %v", sub, err)
+		}
+		if sub, _ := repo.GetSubscriptionByStripeID("stripe_2"); sub != nil {
+			t.Error("Expected no subscription for an unknown Stripe ID")
+		}
+
+		repo.SetScheduledPlan("sub2", "")
+		if sub, _ := repo.GetSubscription("u1"); sub.ScheduledPlan != "" {
+			t.Errorf("Expected the schedule cleared, got %q", sub.ScheduledPlan)
+		}
+	})
+}
+
+func TestRepositoryPlans(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		plans, err := repo.ListPlans()
+		if err != nil || len(plans) != len(billing.DefaultPlans()) {
+			t.Fatalf("Expected the built-in plans seeded, got %d, %v", len(plans), err)
+		}
+		for i, p := range billing.DefaultPlans() {
+			if plans[i].ID != p.ID || plans[i].Version != 1 || !plans[i].Active {
+				t.Errorf("Expected plan %s version 1 at %d, got %s version %d", p.ID, i, plans[i].ID, plans[i].Version)
+			}
+		}
+
+		next := plans[0]
+		next.Version, next.PriceMonthly = 2, 9.99
+		if err := repo.SavePlan(&next); err != nil {
+			t.Fatalf("SavePlan failed: %v", err)
+		}
+		if err := repo.SavePlan(&next); err == nil {
+			t.Error("Expected a saved version not to be saved again")
+		}
+		if err := repo.SetPlanActive(next.ID, false); err != nil {
+			t.Fatalf("SetPlanActive failed: %v", err)
+		}
+		if err := repo.SetPlanActive("missing", false); !errors.Is(err, billing.ErrPlanNotFound) {
+			t.Errorf("Expected ErrPlanNotFound, got %v", err)
+		}
+
+		plans, _ = repo.ListPlans()
+		if len(plans) != len(billing.DefaultPlans())+1 || plans[1].ID != next.ID || plans[1].Version != 2 || plans[1].PriceMonthly != 9.99 || plans[0].Active {
+			t.Errorf("Expected the new version after the first and the plan retired, got %+v", plans[:2])
+		}
+	})
+}
+
+func TestRepositoryUsage(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		start := time.Now().Add(-24 * time.Hour)
+		end := start.AddDate(0, 1, 0)
+
+		repo.UpdateUsage("u1", start, end, 100, 1, 2, 3)
+		repo.UpdateUsage("u1", start, end, 50, 1, 0, 1)
+		repo.UpdateUsage("u1", start.AddDate(0, -1, 0), start, 999, 9, 9, 9)
+
+		data, reqs, ads, threats, err := repo.GetPeriodUsage("u1", start)
+		if err != nil || data != 150 || reqs != 2 || ads != 2 || threats != 4 {
+			t.Errorf("GetPeriodUsage = %d %d %d %d, %v", data, reqs, ads, threats, err)
+		}
+		data, reqs, ads, threats, err = repo.GetLatestUsage("u1")
+		if err != nil || data != 150 || reqs != 2 || ads != 2 || threats != 4 {
+			t.Errorf("GetLatestUsage = %d %d %d %d, %v", data, reqs, ads, threats, err)
+		}
+		if data, _, _, _, err := repo.GetLatestUsage("u2"); err != nil || data != 0 {
+			t.Errorf("Expected no usage, got %d, %v", data, err)
+		}
+	})
+}
+
+func TestRepositoryTransactions(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		created := time.Now().Add(-time.Hour)
+		payment := &Transaction{ID: "pay1", UserID: "u1", PlanID: "personal", Amount: 30, Currency: "USD", Status: "success",
+			PaymentMethod: "paystack", CreatedAt: created, DepositAmount: 10, DepositStatus: billing.DepositHeld, FXRate: 1, AmountUSD: 30}
+		if err := repo.CreateTransaction(payment); err != nil {
+			t.Fatalf("CreateTransaction failed: %v", err)
+		}
+
+		tx, err := repo.GetTransaction("pay1")
+		if err != nil || tx.Kind != TransactionPayment || tx.PlanID != "personal" || tx.Amount != 30 || tx.DepositAmount != 10 ||
+			tx.AmountUSD != 30 || tx.FXRate != 1 || tx.CreatedAt.Unix() != created.Unix() {
+			t.Fatalf("GetTransaction = %+v, %v", tx, err)
+		}
+		if _, err := repo.GetTransaction("missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Expected sql.ErrNoRows, got %v", err)
+		}
+		repo.SetTransactionGatewayRef("pay1", "ref_1")
+		if tx, _ := repo.GetTransaction("pay1"); tx.GatewayRef != "ref_1" {
+			t.Errorf("Expected the gateway ref stored, got %q", tx.GatewayRef)
+		}
+		if tx, err := repo.GetDepositTransaction("u1"); err != nil || tx == nil || tx.ID != "pay1" {
+			t.Errorf("GetDepositTransaction = %+v, %v", tx, err)
+		}
+
+		if ok, _ := repo.SetDepositStatus("pay1", billing.DepositRefundScheduled, billing.DepositRefunded); ok {
+			t.Error("Expected a deposit in another state not to move")
+		}
+		if ok, _ := repo.SetDepositStatus("pay1", billing.DepositRefundScheduled, billing.DepositHeld); !ok {
+			t.Error("Expected a held deposit to be scheduled for refund")
+		}
+
+		deposit := &Transaction{ID: "ref1", UserID: "u1", PlanID: "personal", Amount: 10, Currency: "USD", Status: "pending",
+			PaymentMethod: "paystack", CreatedAt: time.Now(), Kind: TransactionDepositRefund, RefundOf: "pay1", Reason: "trial"}
+		if err := repo.RecordRefund(deposit); err != nil {
+			t.Fatalf("RecordRefund failed: %v", err)
+		}
+		again := *deposit
+		again.ID = "ref2"
+		if err := repo.RecordRefund(&again); !errors.Is(err, billing.ErrDepositNotHeld) {
+			t.Errorf("Expected ErrDepositNotHeld, got %v", err)
+		}
+		tooLarge := &Transaction{ID: "ref3", UserID: "u1", PlanID: "personal", Amount: 25, Currency: "USD", Status: "pending",
+			PaymentMethod: "paystack", CreatedAt: time.Now(), Kind: TransactionRefund, RefundOf: "pay1"}
+		if err := repo.RecordRefund(tooLarge); !errors.Is(err, billing.ErrRefundTooLarge) {
+			t.Errorf("Expected ErrRefundTooLarge, got %v", err)
+		}
+		if tx, _ := repo.GetTransaction("pay1"); tx.RefundedAmount != 10 || tx.DepositStatus != billing.DepositRefunded {
+			t.Errorf("Expected the deposit refunded, got %+v", tx)
+		}
+
+		if err := repo.UpdateRefund("ref1", "processing", "gw_1"); err != nil {
+			t.Fatalf("UpdateRefund failed: %v", err)
+		}
+		if tx, err := repo.GetRefundByGatewayRef("paystack", "gw_1"); err != nil || tx.ID != "ref1" || tx.Status != "processing" {
+			t.Errorf("GetRefundByGatewayRef = %+v, %v", tx, err)
+		}
+		refunds, total, err := repo.ListRefunds("u1", 10, 0)
+		if err != nil || total != 1 || len(refunds) != 1 || refunds[0].ID != "ref1" || refunds[0].Reason != "trial" {
+			t.Errorf("ListRefunds = %+v, %d, %v", refunds, total, err)
+		}
+		if _, total, _ := repo.ListRefunds("", 10, 0); total != 1 {
+			t.Errorf("Expected one refund in all, got %d", total)
+		}
+
+		if err := repo.FailRefund("ref1"); err != nil {
+			t.Fatalf("FailRefund failed: %v", err)
+		}
+		if err := repo.FailRefund("ref1"); err != nil {
+			t.Fatalf("Repeated FailRefund failed: %v", err)
+		}
+		if tx, _ := repo.GetTransaction("pay1"); tx.RefundedAmount != 0 || tx.DepositStatus != billing.DepositHeld {
+			t.Errorf("Expected the failed refund given back, got %+v", tx)
+		}
+		if tx, _ := repo.GetTransaction("ref1"); tx.Status != "failed" {
+			t.Errorf("Expected the refund failed, got %q", tx.Status)
+		}
+	})
+}
+
+func TestRepositoryAdblock(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.AddToWhitelist("example.com")
+		repo.AddToWhitelist("example.org")
+		repo.AddToWhitelist("example.com")
+		repo.RemoveFromWhitelist("example.org")
+		if domains, err := repo.GetWhitelist(); err != nil || !slices.Equal(domains, []string{"example.com"}) {
+			t.Errorf("GetWhitelist = %v, %v", domains, err)
+		}
+
+		repo.SetCustomRules([]string{"ads.example", "track.example"})
+		repo.SetCustomRules([]string{"ads.example"})
+		if rules, err := repo.GetCustomRules(); err != nil || !slices.Equal(rules, []string{"ads.example"}) {
+			t.Errorf("GetCustomRules = %v, %v", rules, err)
+		}
+	})
+}
+
+func TestRepositoryUserData(t *testing.T) {
+	conform(t, func(t *testing.T, repo Repository) {
+		repo.CreateUser("u1", "a@example.com", "hash")
+		repo.CreateUser("u2", "b@example.com", "hash")
+		expires := time.Now().Add(time.Hour)
+		repo.CreateSession("s1", "u1", "tok1", expires)
+		repo.CreateSession("s2", "u2", "tok2", expires)
+		repo.CreateAPIKey(&APIKey{ID: "k1", UserID: "u1", Name: "ci", Prefix: "ap_1", KeyHash: "h1", CreatedAt: time.Now()})
+		repo.SetTOTP("u1", "secret", true)
+		repo.AddActivity(&Activity{ID: "a1", UserID: "u1", Type: "login", Status: "success", Details: "login", CreatedAt: time.Now()})
+		start := time.Now().UTC()
+		repo.SetSubscription("u1", "sub1", "personal", 1, "active", start.Format(time.RFC3339), start.AddDate(0, 1, 0).Format(time.RFC3339), true)
+		repo.UpdateUsage("u1", start, start.AddDate(0, 1, 0), 100, 1, 0, 0)
+		repo.CreateTransaction(&Transaction{ID: "pay1", UserID: "u1", PlanID: "personal", Amount: 30, Currency: "USD",
+			Status: "success", PaymentMethod: "paystack", CreatedAt: time.Now()})
+
+		export, err := repo.ExportUser("u1")
+		if err != nil {
+			t.Fatalf("ExportUser failed: %v", err)
+		}
+		for _, table := range []string{"users", "sessions", "api_keys", "user_totp", "activity_log", "subscriptions", "usage_tracking", "payment_transactions"} {
+			if len(export.Tables[table]) != 1 {
+				t.Errorf("Expected one %s row, got %d", table, len(export.Tables[table]))
+			}
+		}
+		for table, records := range export.Tables {
+			for _, record := range records {
+				for _, col := range []string{"password_hash", "token", "key_hash", "secret_enc"} {
+					if _, ok := record[col]; ok {
+						t.Errorf("Expected %s left out of %s", col, table)
+					}
+				}
+			}
+		}
+		if _, err := json.Marshal(export); err != nil {
+			t.Errorf("Failed to encode export: %v", err)
+		}
+
+		if err := repo.DeleteUser("u1"); err != nil {
+			t.Fatalf("DeleteUser failed: %v", err)
+		}
+		if u, _ := repo.GetUserByID("u1"); u != nil {
+			t.Error("Expected the user deleted")
+		}
+		if _, err := repo.GetSession("tok1"); err == nil {
+			t.Error("Expected the user's sessions deleted")
+		}
+		if keys, _ := repo.ListUserAPIKeys("u1"); len(keys) != 0 {
+			t.Error("Expected the user's API keys deleted")
+		}
+		if totp, _ := repo.GetTOTP("u1"); totp != nil {
+			t.Error("Expected the user's second factor deleted")
+		}
+		if sub, _ := repo.GetSubscription("u1"); sub != nil {
+			t.Error("Expected the user's subscriptions deleted")
+		}
+		if data, _, _, _, _ := repo.GetLatestUsage("u1"); data != 0 {
+			t.Error("Expected the user's usage deleted")
+		}
+		if tx, err := repo.GetTransaction("pay1"); err != nil || tx.UserID != "" || tx.Amount != 30 {
+			t.Errorf("Expected the user's transactions kept without their name, got %+v, %v", tx, err)
+		}
+		if _, total, _ := repo.ListActivities("u1", 10, 0); total != 0 {
+			t.Error("Expected the user's activity deleted")
+		}
+
+		if _, err := repo.GetSession("tok2"); err != nil {
+			t.Errorf("Expected other users' sessions kept, got %v", err)
+		}
+		if err := repo.CreateUser("u3", "a@example.com", "hash"); err != nil {
+			t.Errorf("Expected the email free again, got %v", err)
+		}
+		if _, err := repo.ExportUser("u1"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+		if err := repo.DeleteUser("u1"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+	})
+}
+
+func TestRepositoryDeleteUserKeepsInvoices(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.InvoiceStore
+	}) {
+		store.CreateUser("u1", "ada@example.com", "hash")
+		store.CreateUser("u2", "bo@example.com", "hash")
+		now := time.Now().UTC().Truncate(time.Second)
+		profile := billing.BillingProfile{UserID: "u1", Name: "Ada Obi", Address: "1 Marina", City: "Lagos", Country: "NG", UpdatedAt: now}
+		store.SaveBillingProfile(&profile)
+		if err := store.CreateTransaction(&Transaction{ID: "pay1", UserID: "u1", PlanID: "personal", Amount: 30, Currency: "USD",
+			Status: "success", PaymentMethod: "paystack", CreatedAt: now}); err != nil {
+			t.Fatalf("CreateTransaction failed: %v", err)
+		}
+		if err := store.RecordRefund(&Transaction{ID: "ref1", UserID: "u1", PlanID: "personal", Amount: 10, Currency: "USD",
+			Status: "pending", PaymentMethod: "paystack", CreatedAt: now, Kind: TransactionRefund, RefundOf: "pay1"}); err != nil {
+			t.Fatalf("RecordRefund failed: %v", err)
+		}
+		store.UpdateRefund("ref1", "processing", "gw_1")
+
+		invoice := func(id, userID, txID, email string, customer billing.BillingProfile) *billing.Invoice {
+			return &billing.Invoice{
+				ID: id, UserID: userID, TransactionID: txID, Email: email, Customer: customer,
+				Currency: billing.CurrencyUSD, Subtotal: 27.91, TaxName: "VAT", TaxRate: 0.075, TaxAmount: 2.09, Total: 30,
+				Lines:    []billing.InvoiceLine{{Kind: billing.LinePlan, Description: "Personal plan", Quantity: 1, UnitPrice: 27.91, Amount: 27.91, Taxable: true}},
+				IssuedAt: now,
+			}
+		}
+		first := invoice("inv-1", "u1", "pay1", "ada@example.com", profile)
+		if err := store.CreateInvoice(first); err != nil {
+			t.Fatalf("CreateInvoice failed: %v", err)
+		}
+		store.SaveInvoicePDF("inv-1", []byte("%PDF Ada Obi"))
+
+		if err := store.DeleteUser("u1"); err != nil {
+			t.Fatalf("DeleteUser failed: %v", err)
+		}
+
+		// The invoice keeps its number, amounts and tax, but not who it was for
+		inv, err := store.GetInvoice(first.Number)
+		if err != nil || inv.ID != "inv-1" || inv.Total != 30 || inv.TaxAmount != 2.09 || len(inv.Lines) != 1 {
+			t.Fatalf("Expected the invoice kept, got %+v, %v", inv, err)
+		}
+		if inv.UserID != "" || inv.Email != "" || inv.Customer.Name != "" || inv.Customer.Address != "" {
+			t.Errorf("Expected the invoice anonymised, got %+v", inv)
+		}
+		if pdf, err := store.GetInvoicePDF("inv-1"); err != nil || pdf != nil {
+			t.Errorf("Expected the rendered PDF dropped, got %q, %v", pdf, err)
+		}
+		if inv, err := store.GetInvoiceByTransaction("pay1"); err != nil || inv == nil || inv.ID != "inv-1" {
+			t.Errorf("Expected the invoice found by its payment, got %+v, %v", inv, err)
+		}
+		if p, _ := store.GetBillingProfile("u1"); p != nil {
+			t.Errorf("Expected the billing profile deleted, got %+v", p)
+		}
+
+		// Numbering carries on after the kept invoice
+		second := invoice("inv-2", "u2", "pay2", "bo@example.com", billing.BillingProfile{UserID: "u2"})
+		if err := store.CreateInvoice(second); err != nil {
+			t.Fatalf("CreateInvoice failed: %v", err)
+		}
+		if want := billing.InvoiceNumber(now.Year(), 2); second.Number != want {
+			t.Errorf("Expected number %s, got %s", want, second.Number)
+		}
+
+		// Refunds of the payment are still found when the gateway reports them
+		refund, err := store.GetRefundByGatewayRef("paystack", "gw_1")
+		if err != nil || refund.ID != "ref1" || refund.RefundOf != "pay1" || refund.UserID != "" {
+			t.Errorf("GetRefundByGatewayRef = %+v, %v", refund, err)
+		}
+		if tx, err := store.GetTransaction("pay1"); err != nil || tx.RefundedAmount != 10 {
+			t.Errorf("Expected the refunded payment kept, got %+v, %v", tx, err)
+		}
+	})
+}
+
+func TestRepositoryCreditLedger(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store billing.CreditStore) {
+		now := time.Now().Truncate(time.Second)
+		post := func(id, ref, debit, credit string, amount int64) bool {
+			t.Helper()
+			ok, err := store.PostCreditTransaction(&billing.CreditTransaction{
+				ID: id, Kind: billing.CreditTopUp, Reference: ref, Description: id,
+				Debit: debit, Credit: credit, Amount: amount, CreatedAt: now,
+			})
+			if err != nil {
+				t.Fatalf("PostCreditTransaction failed: %v", err)
+			}
+			return ok
+		}
+
+		user := billing.UserLedger("u1")
+		if !post("t1", "CREDIT-1", billing.LedgerPayments, user, 5000000) {
+			t.Fatal("Expected the top-up to be posted")
+		}
+		if post("t2", "CREDIT-1", billing.LedgerPayments, user, 5000000) {
+			t.Error("Expected a repeated reference to be ignored")
+		}
+		post("t3", "USAGE-1", user, billing.LedgerUsage, 1200000)
+
+		if balance, _ := store.GetLedgerBalance(user); balance != 3800000 {
+			t.Errorf("Expected a balance of 3800000, got %d", balance)
+		}
+		var sum int64
+		sqlDB(store).QueryRow("SELECT SUM(amount) FROM credit_entries").Scan(&sum)
+		if sum != 0 {
+			t.Errorf("Expected the ledger to sum to zero, got %d", sum)
+		}
+
+		entries, total, err := store.ListLedgerEntries(user, 1, 0)
+		if err != nil {
+			t.Fatalf("ListLedgerEntries failed: %v", err)
+		}
+		if total != 2 || len(entries) != 1 || entries[0].Reference != "USAGE-1" || entries[0].Amount != -1200000 ||
+			!entries[0].CreatedAt.Equal(now) {
+			t.Errorf("Unexpected entries: %d, %+v", total, entries[0])
+		}
+	})
+}
+
+func TestRepositoryWebhookQueue(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store queue.Store) {
+		w := queue.NewWorker(store, queue.Config{RetryDelay: time.Minute})
+		failures := 1
+		w.HandleEvents("paystack", func(e *queue.Event) error {
+			if failures > 0 {
+				failures--
+				return errors.New("temporary failure")
+			}
+			return nil
+		})
+		var refunds []string
+		w.HandleJobs("deposit_refund", func(j *queue.Job) error {
+			refunds = append(refunds, j.Key)
+			return nil
+		})
+
+		payload := []byte(`{"event":"charge.success","data":{"reference":"REF-1"}}`)
+		for i, want := range []bool{true, false} {
+			recorded, err := w.Receive("paystack", "charge.success", "charge.success:REF-1", payload)
+			if err != nil {
+				t.Fatalf("Receive failed: %v", err)
+			}
+			if recorded != want {
+				t.Errorf("Delivery %d: expected recorded=%v, got %v", i+1, want, recorded)
+			}
+		}
+
+		now := time.Now().Truncate(time.Second)
+		if err := w.Process(now); err != nil {
+			t.Fatalf("Process failed: %v", err)
+		}
+		events, total, err := store.ListWebhookEvents(queue.StatusPending, 10, 0)
+		if err != nil || total != 1 {
+			t.Fatalf("Expected 1 pending event, got %d, %v", total, err)
+		}
+		e := events[0]
+		if e.Attempts != 1 || e.LastError != "temporary failure" || !e.NextAttemptAt.Equal(now.Add(time.Minute).UTC()) {
+			t.Errorf("Unexpected event after a failure: %+v", e)
+		}
+		if string(e.Payload) != string(payload) {
+			t.Errorf("Expected the payload to be kept, got %s", e.Payload)
+		}
+
+		// A second worker cannot claim an event that is already claimed
+		if claimed, _ := store.ClaimWebhookEvent(e.ID, now.Add(time.Minute), now.Add(time.Hour)); !claimed {
+			t.Error("Expected the due event to be claimed")
+		}
+		if claimed, _ := store.ClaimWebhookEvent(e.ID, now.Add(time.Minute), now.Add(time.Hour)); claimed {
+			t.Error("Expected a claimed event not to be claimed again")
+		}
+
+		if err := w.Process(now.Add(time.Hour)); err != nil {
+			t.Fatalf("Process failed: %v", err)
+		}
+		got, err := store.GetWebhookEvent(e.ID)
+		if err != nil {
+			t.Fatalf("GetWebhookEvent failed: %v", err)
+		}
+		if got.Status != queue.StatusProcessed || got.Attempts != 2 || got.ProcessedAt == nil {
+			t.Errorf("Expected a processed event, got %+v", got)
+		}
+		if _, err := store.GetWebhookEvent("missing"); err == nil {
+			t.Error("Expected an error for an unknown event")
+		}
+
+		runAt := now.Add(7 * 24 * time.Hour)
+		for i, want := range []bool{true, false} {
+			created, err := w.Schedule("deposit_refund", "subscription.disable:SUB-1", map[string]string{"user_id": "user-1"}, runAt)
+			if err != nil {
+				t.Fatalf("Schedule failed: %v", err)
+			}
+			if created != want {
+				t.Errorf("Schedule %d: expected created=%v, got %v", i+1, want, created)
+			}
+		}
+		w.Process(now)
+		if len(refunds) != 0 {
+			t.Fatalf("Expected the job to wait until it is due, ran %v", refunds)
+		}
+		w.Process(runAt)
+		w.Process(runAt.Add(time.Minute))
+		if len(refunds) != 1 {
+			t.Errorf("Expected the job to run once, ran %v", refunds)
+		}
+	})
+}
+
+func TestRepositoryCryptoIntents(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store billing.CryptoStore) {
+		for want := uint32(0); want < 3; want++ {
+			index, err := store.NextCryptoAddressIndex("btc")
+			if err != nil || index != want {
+				t.Fatalf("Expected index %d, got %d, %v", want, index, err)
+			}
+		}
+		if index, _ := store.NextCryptoAddressIndex("eth"); index != 0 {
+			t.Errorf("Expected eth indexes to start at 0, got %d", index)
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		intent := &billing.CryptoIntent{
+			ID: "REF-1", UserID: "user-1", Email: "ann@example.com", PlanID: "personal",
+			Metadata: map[string]string{"user_id": "user-1"}, Asset: "btc", Address: "bc1qaddress", AddressIndex: 0,
+			AmountUSD: 29, Amount: 58000, Rate: 50000, Status: billing.IntentPending,
+			ExpiresAt: now.Add(30 * time.Minute), CreatedAt: now,
+		}
+		if err := store.CreateCryptoIntent(intent); err != nil {
+			t.Fatalf("CreateCryptoIntent failed: %v", err)
+		}
+		reused := *intent
+		reused.ID = "REF-2"
+		if err := store.CreateCryptoIntent(&reused); err == nil {
+			t.Error("Expected an address to be handed out once")
+		}
+
+		intent.Received, intent.Confirmations, intent.TxIDs = 58000, 2, []string{"tx1"}
+		intent.Status, intent.PaidAt = billing.IntentPaid, &now
+		if err := store.UpdateCryptoIntent(intent); err != nil {
+			t.Fatalf("UpdateCryptoIntent failed: %v", err)
+		}
+		got, err := store.GetCryptoIntent("REF-1")
+		if err != nil || got.Status != billing.IntentPaid || got.PaidAt == nil || !got.ExpiresAt.Equal(intent.ExpiresAt) ||
+			len(got.TxIDs) != 1 || got.Metadata["user_id"] != "user-1" {
+			t.Fatalf("Unexpected intent: %+v, %v", got, err)
+		}
+		if _, err := store.GetCryptoIntent("missing"); err == nil {
+			t.Error("Expected an error for a missing intent")
+		}
+
+		// Pending intents are watched, and expired ones within the late window
+		for n, status := range []string{billing.IntentPending, billing.IntentExpired} {
+			i := *intent
+			i.ID, i.Address, i.AddressIndex = fmt.Sprintf("REF-%d", n+3), fmt.Sprintf("bc1q%d", n+3), uint32(n+1)
+			i.Status, i.PaidAt = status, nil
+			if err := store.CreateCryptoIntent(&i); err != nil {
+				t.Fatalf("CreateCryptoIntent failed: %v", err)
+			}
+		}
+		watched, err := store.ListWatchedCryptoIntents(now)
+		if err != nil || len(watched) != 2 {
+			t.Errorf("Expected 2 watched intents, got %d, %v", len(watched), err)
+		}
+		if watched, _ := store.ListWatchedCryptoIntents(now.Add(time.Hour)); len(watched) != 1 || watched[0].ID != "REF-3" {
+			t.Errorf("Expected only the pending intent past the late window, got %v", watched)
+		}
+
+		page, total, err := store.ListCryptoIntents(billing.IntentPaid, 10, 0)
+		if err != nil || total != 1 || len(page) != 1 || page[0].ID != "REF-1" {
+			t.Errorf("Expected the paid intent, got %v, %d, %v", page, total, err)
+		}
+		if _, total, _ := store.ListCryptoIntents("", 10, 0); total != 3 {
+			t.Errorf("Expected 3 intents, got %d", total)
+		}
+	})
+}
+
+func TestRepositoryExchangeRatesAndQuotes(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.RateStore
+		GetPriceQuote(reference string) (*billing.PriceQuote, error)
+	}) {
+		if rates, _, err := store.LoadExchangeRates(); err != nil || len(rates) != 0 {
+			t.Fatalf("Expected no saved rates, got %v, %v", rates, err)
+		}
+
+		first := time.Now().UTC().Truncate(time.Second)
+		if err := store.SaveExchangeRates(map[billing.CurrencyCode]float64{billing.CurrencyNGN: 1600, billing.CurrencyKES: 130}, first); err != nil {
+			t.Fatalf("SaveExchangeRates failed: %v", err)
+		}
+		later := first.Add(time.Hour)
+		if err := store.SaveExchangeRates(map[billing.CurrencyCode]float64{billing.CurrencyNGN: 1610}, later); err != nil {
+			t.Fatalf("SaveExchangeRates failed: %v", err)
+		}
+		rates, fetchedAt, err := store.LoadExchangeRates()
+		if err != nil || rates[billing.CurrencyNGN] != 1610 || rates[billing.CurrencyKES] != 130 {
+			t.Fatalf("Unexpected rates: %v, %v", rates, err)
+		}
+		if !fetchedAt.Equal(first) {
+			t.Errorf("Expected the rates dated by the oldest, got %s", fetchedAt)
+		}
+
+		quote := &billing.PriceQuote{Reference: "REF-1", Currency: billing.CurrencyNGN, Rate: 1610, AmountUSD: 29, Amount: 46749, CreatedAt: later}
+		if err := store.SavePriceQuote(quote); err != nil {
+			t.Fatalf("SavePriceQuote failed: %v", err)
+		}
+		got, err := store.GetPriceQuote("REF-1")
+		if err != nil || got == nil || *got != *quote {
+			t.Fatalf("Expected the saved quote, got %+v, %v", got, err)
+		}
+		if none, err := store.GetPriceQuote("REF-2"); none != nil || err != nil {
+			t.Errorf("Expected no quote, got %+v, %v", none, err)
+		}
+
+		if err := store.CreateUser("user-1", "fx@example.com", "hash"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		if err := store.CreateTransaction(&Transaction{ID: "REF-1", UserID: "user-1", PlanID: "personal", Amount: 46749, Currency: "NGN",
+			Status: "completed", PaymentMethod: "paystack", CreatedAt: later, FXRate: 1610, AmountUSD: 29}); err != nil {
+			t.Fatalf("CreateTransaction failed: %v", err)
+		}
+		tx, err := store.GetTransaction("REF-1")
+		if err != nil || tx.FXRate != 1610 || tx.AmountUSD != 29 {
+			t.Errorf("Expected the rate recorded on the transaction, got %+v, %v", tx, err)
+		}
+	})
+}
+
+func TestRepositoryInvoices(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.InvoiceStore
+	}) {
+		if err := store.CreateUser("user-1", "ada@example.com", "hash"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+
+		if p, err := store.GetBillingProfile("user-1"); err != nil || p != nil {
+			t.Fatalf("Expected no profile, got %+v, %v", p, err)
+		}
+		profile := &billing.BillingProfile{UserID: "user-1", Name: "Ada Obi", TaxID: "NG123", Country: "NG", UpdatedAt: time.Now()}
+		if err := store.SaveBillingProfile(profile); err != nil {
+			t.Fatalf("SaveBillingProfile failed: %v", err)
+		}
+		profile.Company = "Obi Labs"
+		if err := store.SaveBillingProfile(profile); err != nil {
+			t.Fatalf("SaveBillingProfile failed: %v", err)
+		}
+		if p, err := store.GetBillingProfile("user-1"); err != nil || p.Company != "Obi Labs" || p.TaxID != "NG123" {
+			t.Fatalf("Unexpected profile: %+v, %v", p, err)
+		}
+
+		issued := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+		newInvoice := func(id, txID string, at time.Time) *billing.Invoice {
+			return &billing.Invoice{
+				ID: id, UserID: "user-1", TransactionID: txID, Email: "ada@example.com", Customer: *profile,
+				Currency: billing.CurrencyNGN, Subtotal: 40929.30, TaxName: "VAT", TaxRate: 0.075, TaxAmount: 3069.70, Total: 43999,
+				Lines:    []billing.InvoiceLine{{Kind: billing.LinePlan, Description: "Personal plan", Quantity: 1, UnitPrice: 40929.30, Amount: 40929.30, Taxable: true}},
+				IssuedAt: at, PeriodStart: &at,
+			}
+		}
+
+		first := newInvoice("inv-1", "ref-1", issued)
+		if err := store.CreateInvoice(first); err != nil {
+			t.Fatalf("CreateInvoice failed: %v", err)
+		}
+		// A second invoice for the same payment fails without using up a number
+		if err := store.CreateInvoice(newInvoice("inv-dup", "ref-1", issued)); err == nil {
+			t.Fatal("Expected a payment to be invoiced once")
+		}
+		second := newInvoice("inv-2", "ref-2", issued.Add(time.Hour))
+		if err := store.CreateInvoice(second); err != nil {
+			t.Fatalf("CreateInvoice failed: %v", err)
+		}
+		nextYear := newInvoice("inv-3", "ref-3", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC))
+		if err := store.CreateInvoice(nextYear); err != nil {
+			t.Fatalf("CreateInvoice failed: %v", err)
+		}
+		if first.Number != "INV-2026-000001" || second.Number != "INV-2026-000002" || nextYear.Number != "INV-2027-000001" {
+			t.Errorf("Expected gap-free numbers per year, got %s, %s, %s", first.Number, second.Number, nextYear.Number)
+		}
+
+		inv, err := store.GetInvoice("INV-2026-000002")
+		if err != nil || inv.ID != "inv-2" || inv.Customer.Company != "Obi Labs" || len(inv.Lines) != 1 || inv.Lines[0].Amount != 40929.30 {
+			t.Fatalf("Unexpected invoice: %+v, %v", inv, err)
+		}
+		if inv.PeriodStart == nil || !inv.PeriodStart.Equal(issued.Add(time.Hour)) || inv.PeriodEnd != nil || inv.EmailedAt != nil {
+			t.Errorf("Unexpected invoice dates: %+v", inv)
+		}
+		if inv, err := store.GetInvoiceByTransaction("ref-9"); err != nil || inv != nil {
+			t.Errorf("Expected no invoice, got %+v, %v", inv, err)
+		}
+
+		invoices, total, err := store.ListInvoices("user-1", 2, 0)
+		if err != nil || total != 3 || len(invoices) != 2 || invoices[0].ID != "inv-3" {
+			t.Fatalf("Unexpected invoices: %d of %d, %v", len(invoices), total, err)
+		}
+
+		if pdf, err := store.GetInvoicePDF("inv-1"); err != nil || pdf != nil {
+			t.Fatalf("Expected no PDF yet, got %v", err)
+		}
+		if err := store.SaveInvoicePDF("inv-1", []byte("%PDF-1.3")); err != nil {
+			t.Fatalf("SaveInvoicePDF failed: %v", err)
+		}
+		if pdf, err := store.GetInvoicePDF("inv-1"); err != nil || string(pdf) != "%PDF-1.3" {
+			t.Errorf("Unexpected PDF: %q, %v", pdf, err)
+		}
+		if err := store.MarkInvoiceEmailed("inv-1", issued); err != nil {
+			t.Fatalf("MarkInvoiceEmailed failed: %v", err)
+		}
+		if inv, _ := store.GetInvoice("inv-1"); inv.EmailedAt == nil {
+			t.Error("Expected the invoice marked emailed")
+		}
+	})
+}
+
+func TestRepositoryQuotaPeriods(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.QuotaStore
+	}) {
+		if err := store.CreateUser("user-1", "ada@example.com", "hash"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+
+		now := time.Now().Truncate(time.Second)
+		if err := store.SetSubscription("user-1", "sub-1", "personal", 1, "active", now.Format(time.RFC3339), now.AddDate(0, 1, 0).Format(time.RFC3339), true); err != nil {
+			t.Fatalf("SetSubscription failed: %v", err)
+		}
+		if err := store.SetQuotaMode("sub-1", billing.QuotaSoft); err != nil {
+			t.Fatalf("SetQuotaMode failed: %v", err)
+		}
+		if sub, err := store.GetSubscription("user-1"); err != nil || sub.QuotaMode != billing.QuotaSoft {
+			t.Fatalf("Expected a soft quota, got %+v, %v", sub, err)
+		}
+
+		start := now.Add(-time.Hour)
+		if p, err := store.GetQuotaPeriod("sub-1", start); err != nil || p != nil {
+			t.Fatalf("Expected no quota period, got %+v, %v", p, err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := store.AddOverage("user-1", "sub-1", start, 1<<30, 4); err != nil {
+				t.Fatalf("AddOverage failed: %v", err)
+			}
+		}
+
+		// Each threshold is recorded once, and never below one already sent
+		for _, tc := range []struct {
+			threshold int
+			want      bool
+		}{{80, true}, {80, false}, {120, true}, {100, false}} {
+			if sent, err := store.MarkQuotaWarned("user-1", "sub-1", start, tc.threshold); err != nil || sent != tc.want {
+				t.Errorf("MarkQuotaWarned(%d): expected %v, got %v, %v", tc.threshold, tc.want, sent, err)
+			}
+		}
+
+		if err := store.BillOverage("sub-1", start, "RENEW-sub-1", 8); err != nil {
+			t.Fatalf("BillOverage failed: %v", err)
+		}
+		p, err := store.GetOverageByReference("RENEW-sub-1")
+		if err != nil || p == nil {
+			t.Fatalf("GetOverageByReference failed: %+v, %v", p, err)
+		}
+		if p.OverageBytes != 2<<30 || p.OverageUSD != 8 || p.Warned != 120 || p.BilledUSD != 8 || !p.PeriodStart.Equal(start) || p.UserID != "user-1" {
+			t.Errorf("Unexpected quota period: %+v", p)
+		}
+		if p, err := store.GetOverageByReference(""); err != nil || p != nil {
+			t.Errorf("Expected no period without a reference, got %+v, %v", p, err)
+		}
+	})
+}
+
+func TestRepositoryPromotions(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.PromotionStore
+	}) {
+		for _, u := range []string{"user-1", "user-2"} {
+			if err := store.CreateUser(u, u+"@example.com", "hash"); err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		expires := now.AddDate(0, 1, 0)
+		coupon := &billing.Coupon{Code: "SPRING", Type: billing.DiscountPercent, Value: 25, MaxRedemptions: 10,
+			Plans: []billing.PlanType{billing.PlanPersonal, billing.PlanTeam}, ExpiresAt: &expires, Active: true, CreatedAt: now}
+		if err := store.CreateCoupon(coupon); err != nil {
+			t.Fatalf("CreateCoupon failed: %v", err)
+		}
+		got, err := store.GetCoupon("SPRING")
+		if err != nil || got == nil || len(got.Plans) != 2 || !got.ExpiresAt.Equal(expires) || !got.Active {
+			t.Fatalf("Unexpected coupon: %+v, %v", got, err)
+		}
+		if c, err := store.GetCoupon("NONE"); err != nil || c != nil {
+			t.Errorf("Expected no coupon, got %+v, %v", c, err)
+		}
+
+		// A checkout holds a redemption until it is paid, and is paid only once
+		store.SetSubscription("user-1", "sub-1", "personal", 1, "active", now.Format(time.RFC3339), expires.Format(time.RFC3339), true)
+		r := &billing.CouponRedemption{Reference: "sub-1", Code: "SPRING", UserID: "user-1", PlanID: billing.PlanPersonal,
+			DiscountUSD: 7.25, Status: billing.RedemptionPending, CreatedAt: now}
+		if err := store.ReserveCoupon(r); err != nil {
+			t.Fatalf("ReserveCoupon failed: %v", err)
+		}
+		if used, _ := store.HasRedeemed("SPRING", "user-1"); !used {
+			t.Error("Expected the held redemption to count")
+		}
+		again := *r
+		again.Reference = "sub-2"
+		if err := store.ReserveCoupon(&again); !errors.Is(err, billing.ErrCouponUnavailable) {
+			t.Errorf("Expected a second hold of the user to be refused, got %v", err)
+		}
+		for _, want := range []bool{true, false} {
+			if redeemed, err := store.RedeemCoupon("sub-1", now); err != nil || redeemed != want {
+				t.Errorf("RedeemCoupon: expected %v, got %v, %v", want, redeemed, err)
+			}
+		}
+		if c, _ := store.GetCoupon("SPRING"); c.Redemptions != 1 {
+			t.Errorf("Expected one redemption, got %d", c.Redemptions)
+		}
+		if released, err := store.ReleaseCoupon("sub-1"); err != nil || released {
+			t.Errorf("Expected a paid redemption to be kept, got %v, %v", released, err)
+		}
+
+		// Unpaid checkouts give their hold back, but still count once paid late
+		late := &billing.CouponRedemption{Reference: "sub-3", Code: "SPRING", UserID: "user-2", PlanID: billing.PlanTeam,
+			DiscountUSD: 7.25, CreatedAt: now.Add(-2 * time.Hour)}
+		if err := store.ReserveCoupon(late); err != nil {
+			t.Fatalf("ReserveCoupon failed: %v", err)
+		}
+		if n, err := store.ReleaseCoupons(now.Add(-time.Hour)); err != nil || n != 1 {
+			t.Errorf("Expected one hold released, got %d, %v", n, err)
+		}
+		if c, _ := store.GetCoupon("SPRING"); c.Redemptions != 1 {
+			t.Errorf("Expected the hold given back, got %d redemptions", c.Redemptions)
+		}
+		if redeemed, err := store.RedeemCoupon("sub-3", now); err != nil || !redeemed {
+			t.Errorf("Expected the late payment redeemed, got %v, %v", redeemed, err)
+		}
+		if c, _ := store.GetCoupon("SPRING"); c.Redemptions != 2 {
+			t.Errorf("Expected the late payment counted, got %d redemptions", c.Redemptions)
+		}
+		if list, total, err := store.ListRedemptions("SPRING", 10, 0); err != nil || total != 2 || list[0].RedeemedAt == nil {
+			t.Errorf("Unexpected redemptions: %+v, %d, %v", list, total, err)
+		}
+		if err := store.SetSubscriptionCoupon("sub-1", "SPRING"); err != nil {
+			t.Fatalf("SetSubscriptionCoupon failed: %v", err)
+		}
+		if sub, _ := store.GetSubscription("user-1"); sub.Coupon != "SPRING" {
+			t.Errorf("Expected the coupon on the subscription, got %q", sub.Coupon)
+		}
+
+		// Referrals
+		if err := store.CreateReferralCode("user-1", "ABCD2345"); err != nil {
+			t.Fatalf("CreateReferralCode failed: %v", err)
+		}
+		if err := store.CreateReferralCode("user-2", "ABCD2345"); err == nil {
+			t.Error("Expected referral codes to be unique")
+		}
+		if id, err := store.GetReferrer("ABCD2345"); err != nil || id != "user-1" {
+			t.Errorf("Unexpected referrer: %q, %v", id, err)
+		}
+		ref := &billing.Referral{RefereeID: "user-2", ReferrerID: "user-1", Code: "ABCD2345", Status: billing.ReferralPending, CreatedAt: now}
+		if err := store.CreateReferral(ref); err != nil {
+			t.Fatalf("CreateReferral failed: %v", err)
+		}
+		if err := store.RewardReferral("user-2", "PAY-1", 10, now); err != nil {
+			t.Fatalf("RewardReferral failed: %v", err)
+		}
+		if r, err := store.GetReferral("user-2"); err != nil || r.Status != billing.ReferralRewarded || r.Reference != "PAY-1" || r.RewardedAt == nil {
+			t.Errorf("Unexpected referral: %+v, %v", r, err)
+		}
+		if referred, rewarded, earned, err := store.CountReferrals("user-1"); err != nil || referred != 1 || rewarded != 1 || earned != 10 {
+			t.Errorf("Unexpected counts: %d, %d, %v, %v", referred, rewarded, earned, err)
+		}
+		if list, total, err := store.ListReferrals("", 10, 0); err != nil || total != 1 || len(list) != 1 {
+			t.Errorf("Unexpected referrals: %+v, %d, %v", list, total, err)
+		}
+	})
+}
+
+func TestRepositoryCouponLimitUnderConcurrentCheckouts(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.PromotionStore
+	}) {
+		now := time.Now().UTC().Truncate(time.Second)
+		if err := store.CreateCoupon(&billing.Coupon{Code: "FEW", Type: billing.DiscountFixed, Value: 5,
+			MaxRedemptions: 3, Active: true, CreatedAt: now}); err != nil {
+			t.Fatalf("CreateCoupon failed: %v", err)
+		}
+		if err := store.CreateUser("user-1", "user-1@example.com", "hash"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+
+		// Checkouts by many users, and several by one, race for the coupon
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		held, ofUser := 0, 0
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := &billing.CouponRedemption{Reference: fmt.Sprintf("pay-%d", i), Code: "FEW",
+					PlanID: billing.PlanPersonal, DiscountUSD: 5, CreatedAt: now}
+				if i%2 == 0 {
+					r.UserID = "user-1"
+				}
+				err := store.ReserveCoupon(r)
+				if err != nil && !errors.Is(err, billing.ErrCouponUnavailable) {
+					t.Errorf("ReserveCoupon failed: %v", err)
+				}
+				if err == nil {
+					mu.Lock()
+					held++
+					if r.UserID != "" {
+						ofUser++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if held != 3 || ofUser > 1 {
+			t.Errorf("Expected 3 holds and at most one of the user, got %d and %d", held, ofUser)
+		}
+		if c, _ := store.GetCoupon("FEW"); c.Redemptions != 3 {
+			t.Errorf("Expected 3 redemptions, got %d", c.Redemptions)
+		}
+	})
+}
+
+func TestRepositoryOrganizations(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.OrgStore
+	}) {
+		for _, u := range []string{"user-1", "user-2"} {
+			if err := store.CreateUser(u, u+"@example.com", "hash"); err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		org := &billing.Organization{ID: "org-1", Name: "Acme", OwnerID: "user-1", CreatedAt: now}
+		if err := store.CreateOrg(org, &billing.Member{OrgID: "org-1", UserID: "user-1", Role: billing.RoleOwner, JoinedAt: now}); err != nil {
+			t.Fatalf("CreateOrg failed: %v", err)
+		}
+		if got, err := store.GetOrg("org-1"); err != nil || got == nil || got.OwnerID != "user-1" || !got.CreatedAt.Equal(now) {
+			t.Fatalf("Unexpected organization: %+v, %v", got, err)
+		}
+		if m, err := store.GetMembership("user-2"); err != nil || m != nil {
+			t.Errorf("Expected no membership, got %+v, %v", m, err)
+		}
+
+		// An invitation is accepted once
+		inv := &billing.Invitation{ID: "inv-1", OrgID: "org-1", Email: "user-2@example.com", Role: billing.RoleMember,
+			InvitedBy: "user-1", TokenHash: "hash-1", ExpiresAt: now.Add(time.Hour), CreatedAt: now}
+		if err := store.CreateInvitation(inv); err != nil {
+			t.Fatalf("CreateInvitation failed: %v", err)
+		}
+		if pending, err := store.ListInvitations("org-1"); err != nil || len(pending) != 1 {
+			t.Fatalf("Expected one pending invitation, got %d, %v", len(pending), err)
+		}
+		if ok, err := store.AcceptInvitation("inv-1", now); err != nil || !ok {
+			t.Fatalf("AcceptInvitation failed: %v, %v", ok, err)
+		}
+		if ok, _ := store.AcceptInvitation("inv-1", now); ok {
+			t.Error("Expected an invitation to be accepted once")
+		}
+		if got, _ := store.GetInvitationByToken("hash-1"); got == nil || got.AcceptedAt == nil {
+			t.Errorf("Expected the invitation accepted, got %+v", got)
+		}
+		if pending, _ := store.ListInvitations("org-1"); len(pending) != 0 {
+			t.Errorf("Expected no pending invitations, got %d", len(pending))
+		}
+
+		member := &billing.Member{OrgID: "org-1", UserID: "user-2", Role: billing.RoleMember, JoinedAt: now.Add(time.Second)}
+		if err := store.AddMember(member); err != nil {
+			t.Fatalf("AddMember failed: %v", err)
+		}
+		member.DataLimitMB, member.MaxConnections, member.Role = 500, 3, billing.RoleBilling
+		if err := store.UpdateMember(member); err != nil {
+			t.Fatalf("UpdateMember failed: %v", err)
+		}
+		members, err := store.ListMembers("org-1")
+		if err != nil || len(members) != 2 || members[1].Email != "user-2@example.com" ||
+			members[1].DataLimitMB != 500 || members[1].MaxConnections != 3 || members[1].Role != billing.RoleBilling {
+			t.Fatalf("Unexpected members: %+v, %v", members, err)
+		}
+
+		// Member usage adds up per period
+		store.AddMemberUsage("org-1", "user-2", now, 100)
+		store.AddMemberUsage("org-1", "user-2", now, 50)
+		store.AddMemberUsage("org-1", "user-2", now.AddDate(0, -1, 0), 7)
+		if used, err := store.GetMemberUsage("org-1", "user-2", now); err != nil || used != 150 {
+			t.Errorf("Expected 150 bytes used, got %d, %v", used, err)
+		}
+
+		if err := store.RemoveMember("org-1", "user-2"); err != nil {
+			t.Fatalf("RemoveMember failed: %v", err)
+		}
+		if m, _ := store.GetMembership("user-2"); m != nil {
+			t.Errorf("Expected user-2 to have left, got %+v", m)
+		}
+	})
+}
+
+func TestRepositorySubUsers(t *testing.T) {
+	conformSQL(t, func(t *testing.T, store interface {
+		Repository
+		billing.SubUserStore
+	}) {
+		if err := store.CreateUser("user-1", "user-1@example.com", "hash"); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		u := &billing.SubUser{ID: "sub_1", ParentID: "user-1", Label: "Client", Username: "sub-abc", PasswordHash: "h",
+			DataLimitMB: 100, MaxConnections: 5, Countries: []string{"DE", "FR"}, Active: true, CreatedAt: now}
+		if err := store.CreateSubUser(u); err != nil {
+			t.Fatalf("CreateSubUser failed: %v", err)
+		}
+		if err := store.CreateSubUser(&billing.SubUser{ID: "sub_2", ParentID: "user-1", Username: "sub-abc", CreatedAt: now}); err == nil {
+			t.Error("Expected usernames to be unique")
+		}
+		got, err := store.GetSubUserByUsername("sub-abc")
+		if err != nil || got == nil || got.ID != "sub_1" || len(got.Countries) != 2 || got.Countries[1] != "FR" || !got.CreatedAt.Equal(now) {
+			t.Fatalf("Unexpected sub-user: %+v, %v", got, err)
+		}
+		if got, err := store.GetSubUser("sub_2"); err != nil || got != nil {
+			t.Errorf("Expected no sub-user, got %+v, %v", got, err)
+		}
+
+		got.Countries, got.Active = nil, false
+		if err := store.UpdateSubUser(got); err != nil {
+			t.Fatalf("UpdateSubUser failed: %v", err)
+		}
+		if list, err := store.ListSubUsers("user-1"); err != nil || len(list) != 1 || list[0].Active || len(list[0].Countries) != 0 {
+			t.Errorf("Unexpected sub-users: %+v, %v", list, err)
+		}
+
+		// Usage adds up per period, newest first
+		earlier := now.AddDate(0, -1, 0)
+		store.AddSubUserUsage("sub_1", earlier, 10, 1)
+		store.AddSubUserUsage("sub_1", now, 20, 2)
+		store.AddSubUserUsage("sub_1", now, 5, 1)
+		if data, reqs, err := store.GetSubUserUsage("sub_1", now); err != nil || data != 25 || reqs != 3 {
+			t.Errorf("Expected 25 bytes in 3 requests, got %d, %d, %v", data, reqs, err)
+		}
+		periods, err := store.ListSubUserUsage("sub_1", 10)
+		if err != nil || len(periods) != 2 || !periods[0].PeriodStart.Equal(now) || periods[1].DataTransferred != 10 {
+			t.Errorf("Unexpected periods: %+v, %v", periods, err)
+		}
+
+		if err := store.DeleteSubUser("user-1", "sub_1"); err != nil {
+			t.Fatalf("DeleteSubUser failed: %v", err)
+		}
+		if periods, _ := store.ListSubUserUsage("sub_1", 10); len(periods) != 0 {
+			t.Errorf("Expected the usage deleted too, got %+v", periods)
+		}
+	})
+}
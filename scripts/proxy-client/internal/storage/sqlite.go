@@ -2,17 +2,21 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
 
 	"github.com/atlanticproxy/proxy-client/internal/billing"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
 )
 
-// Store implements the storage.Store interface using SQLite.
+// Store implements Repository using SQLite.
 // It manages persistence for users, subscriptions, usage tracking, and ad-block rules.
 type Store struct {
 	db *sql.DB
@@ -21,19 +25,26 @@ type Store struct {
 // NewStore creates a new SQLite store at the default location.
 // It automatically initializes the database schema if it doesn't exist.
 func NewStore() (*Store, error) {
-	// Use a standard path for the database
-	home, err := os.UserHomeDir()
+	dbPath, err := DefaultPath()
 	if err != nil {
 		return nil, err
 	}
+	return NewStoreWithPath(dbPath)
+}
+
+// DefaultPath returns the path of the default SQLite database, creating its
+// directory
+func DefaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
 
 	dbDir := filepath.Join(home, ".atlanticproxy")
 	if err := os.MkdirAll(dbDir, 0755); err != nil {
-		return nil, err
+		return "", err
 	}
-
-	dbPath := filepath.Join(dbDir, "atlantic.db")
-	return NewStoreWithPath(dbPath)
+	return filepath.Join(dbDir, "atlantic.db"), nil
 }
 
 func NewStoreWithPath(dbPath string) (*Store, error) {
@@ -66,95 +77,109 @@ func (s *Store) Init() error {
 		}
 	}
 
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS plans (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			price_cents INTEGER NOT NULL,
-			currency TEXT DEFAULT 'USD',
-			data_quota_mb INTEGER NOT NULL,
-			request_limit INTEGER NOT NULL,
-			concurrent_conns INTEGER NOT NULL,
-			features TEXT
-		)`,
-		`CREATE TABLE IF NOT EXISTS subscriptions (
-			id TEXT PRIMARY KEY,
-			user_id TEXT REFERENCES users(id),
-			plan_id TEXT REFERENCES plans(id),
-			status TEXT NOT NULL,
-			stripe_sub_id TEXT,
-			start_date DATETIME NOT NULL,
-			end_date DATETIME NOT NULL,
-			auto_renew BOOLEAN DEFAULT TRUE,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS usage_tracking (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT REFERENCES users(id),
-			period_start DATETIME NOT NULL,
-			period_end DATETIME NOT NULL,
-			data_transferred_bytes INTEGER DEFAULT 0,
-			requests_made INTEGER DEFAULT 0,
-			ads_blocked INTEGER DEFAULT 0,
-			threats_blocked INTEGER DEFAULT 0,
-			UNIQUE(user_id, period_start, period_end)
-		)`,
-		`CREATE TABLE IF NOT EXISTS sessions (
-			id TEXT PRIMARY KEY,
-			user_id TEXT REFERENCES users(id),
-			token TEXT UNIQUE NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			expires_at DATETIME NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS payment_transactions (
-			id TEXT PRIMARY KEY,
-			user_id TEXT REFERENCES users(id),
-			plan_id TEXT NOT NULL,
-			amount REAL NOT NULL,
-			currency TEXT NOT NULL,
-			status TEXT NOT NULL,
-			payment_method TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS adblock_whitelist (
-			domain TEXT PRIMARY KEY
-		)`,
-		`CREATE TABLE IF NOT EXISTS adblock_custom (
-			domain TEXT PRIMARY KEY
-		)`,
-		// Seed default plans if not exist
-		`INSERT OR IGNORE INTO plans (id, name, price_cents, data_quota_mb, request_limit, concurrent_conns, features) VALUES 
-		('starter', 'Starter', 900, 500, 1000, 5, '["Basic Support", "Shared Pool"]'),
-		('personal', 'Personal', 2900, 5000, 10000, 20, '["Priority Support", "Residential IPs"]'),
-		('team', 'Team', 9900, 50000, 100000, 50, '["Team Dashboard", "API Access"]'),
-		('enterprise', 'Enterprise', 29900, -1, -1, 500, '["Dedicated Account Manager", "Custom Solutions"]')`,
-	}
-
-	for _, q := range queries {
-		if _, err := s.db.Exec(q); err != nil {
-			return fmt.Errorf("failed to execute query: %s, error: %w", q, err)
-		}
-	}
-
-	// Performance Indexes
-	indexes := []string{
-		`CREATE INDEX IF NOT EXISTS idx_subs_user_created ON subscriptions(user_id, created_at DESC)`,
-		`CREATE INDEX IF NOT EXISTS idx_usage_user_period ON usage_tracking(user_id, period_start, period_end)`,
-		`CREATE INDEX IF NOT EXISTS idx_tx_user_created ON payment_transactions(user_id, created_at DESC)`,
-	}
-
-	for _, idx := range indexes {
-		if _, err := s.db.Exec(idx); err != nil {
-			return fmt.Errorf("failed to create index: %s, error: %w", idx, err)
+	migrator, err := NewMigrator(s.db, DialectSQLite)
+	if err != nil {
+		return err
+	}
+	if _, err := migrator.Up(); err != nil {
+		return err
+	}
+
+	if err := seedPlans(s); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// upgradeLegacySchema adds the columns added to tables before migrations
+// were versioned. Databases from those releases have the tables of the
+// first migration, but maybe not all their columns.
+func upgradeLegacySchema(db *sql.DB) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	columns := []struct{ table, name, def string }{
+		{"payment_transactions", "gateway_ref", "TEXT"},
+		{"payment_transactions", "kind", "TEXT DEFAULT 'payment'"},
+		{"payment_transactions", "deposit_amount", "REAL DEFAULT 0"},
+		{"payment_transactions", "deposit_status", "TEXT DEFAULT ''"},
+		{"payment_transactions", "refunded_amount", "REAL DEFAULT 0"},
+		{"payment_transactions", "refund_of", "TEXT DEFAULT ''"},
+		{"payment_transactions", "reason", "TEXT DEFAULT ''"},
+		{"payment_transactions", "fx_rate", "REAL DEFAULT 0"},
+		{"payment_transactions", "amount_usd", "REAL DEFAULT 0"},
+		{"sessions", "user_agent", "TEXT DEFAULT ''"},
+		{"sessions", "ip_address", "TEXT DEFAULT ''"},
+		{"sessions", "last_used_at", "DATETIME"},
+		{"users", "email_verified_at", "DATETIME"},
+		{"subscriptions", "last_reset", "TEXT"},
+		{"subscriptions", "grace_until", "TEXT"},
+		{"subscriptions", "next_retry_at", "TEXT"},
+		{"subscriptions", "retry_count", "INTEGER DEFAULT 0"},
+		{"subscriptions", "payment_auth", "TEXT DEFAULT ''"},
+		{"subscriptions", "currency", "TEXT DEFAULT ''"},
+		{"subscriptions", "pending_ref", "TEXT DEFAULT ''"},
+		{"subscriptions", "scheduled_plan", "TEXT DEFAULT ''"},
+		{"subscriptions", "plan_version", "INTEGER DEFAULT 1"},
+		{"subscriptions", "quota_mode", "TEXT DEFAULT ''"},
+		{"subscriptions", "coupon", "TEXT DEFAULT ''"},
+		{"plans", "price_annual_cents", "INTEGER DEFAULT 0"},
+		{"plans", "flags", "TEXT DEFAULT '{}'"},
+		{"plans", "version", "INTEGER DEFAULT 1"},
+		{"plans", "active", "BOOLEAN DEFAULT TRUE"},
+	}
+	s := &Store{db: db}
+	for _, col := range columns {
+		if err := s.addColumnIfMissing(col.table, col.name, col.def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already
+// present
+func (s *Store) addColumnIfMissing(table, column, def string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	exists := false
+	for rows.Next() {
+		exists = true
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if !exists {
+		// Missing tables are created with all their columns
+		return nil
+	}
 
+	if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -234,19 +259,39 @@ func (s *Store) SetCustomRules(rules []string) error {
 
 // --- Usage ---
 
-func (s *Store) UpdateUsage(userID string, dataTransferred, requests, ads, threats int64) error {
+// sqliteTime formats a time like SQLite's datetime() so stored values
+// compare correctly with datetime('now')
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// UpdateUsage adds usage to a user's billing period. Periods follow each
+// subscription's billing anchor rather than calendar months.
+func (s *Store) UpdateUsage(userID string, periodStart, periodEnd time.Time, dataTransferred, requests, ads, threats int64) error {
 	_, err := s.db.Exec(`
 		INSERT INTO usage_tracking (user_id, period_start, period_end, data_transferred_bytes, requests_made, ads_blocked, threats_blocked)
-		VALUES (?, datetime('now','start of month'), datetime('now','start of month','+1 month','-1 second'), ?, ?, ?, ?)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(user_id, period_start, period_end) DO UPDATE SET
 			data_transferred_bytes = data_transferred_bytes + excluded.data_transferred_bytes,
 			requests_made = requests_made + excluded.requests_made,
 			ads_blocked = ads_blocked + excluded.ads_blocked,
 			threats_blocked = threats_blocked + excluded.threats_blocked
-	`, userID, dataTransferred, requests, ads, threats)
+	`, userID, sqliteTime(periodStart), sqliteTime(periodEnd), dataTransferred, requests, ads, threats)
 	return err
 }
 
+// GetPeriodUsage returns a user's usage in the billing period starting at periodStart
+func (s *Store) GetPeriodUsage(userID string, periodStart time.Time) (int64, int64, int64, int64, error) {
+	var data, reqs, ads, threats int64
+	err := s.db.QueryRow(`
+		SELECT COALESCE(SUM(data_transferred_bytes), 0), COALESCE(SUM(requests_made), 0),
+			COALESCE(SUM(ads_blocked), 0), COALESCE(SUM(threats_blocked), 0)
+		FROM usage_tracking
+		WHERE user_id = ? AND period_start = ?
+	`, userID, sqliteTime(periodStart)).Scan(&data, &reqs, &ads, &threats)
+	return data, reqs, ads, threats, err
+}
+
 func (s *Store) GetLatestUsage(userID string) (int64, int64, int64, int64, error) {
 	var data, reqs, ads, threats int64
 	err := s.db.QueryRow(`
@@ -261,24 +306,255 @@ func (s *Store) GetLatestUsage(userID string) (int64, int64, int64, int64, error
 	return data, reqs, ads, threats, err
 }
 
+// --- Quota periods ---
+
+const quotaPeriodColumns = `subscription_id, period_start, COALESCE(user_id, ''), overage_bytes, overage_usd, warned, reference, billed_usd`
+
+func scanQuotaPeriod(row interface{ Scan(...any) error }) (*billing.QuotaPeriod, error) {
+	var p billing.QuotaPeriod
+	var start string
+	err := row.Scan(&p.SubscriptionID, &start, &p.UserID, &p.OverageBytes, &p.OverageUSD, &p.Warned, &p.Reference, &p.BilledUSD)
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(start); t != nil {
+		p.PeriodStart = *t
+	}
+	return &p, nil
+}
+
+// GetQuotaPeriod returns the quota record of a subscription period, or nil
+// if nothing was recorded yet
+func (s *Store) GetQuotaPeriod(subscriptionID string, periodStart time.Time) (*billing.QuotaPeriod, error) {
+	p, err := scanQuotaPeriod(s.db.QueryRow("SELECT "+quotaPeriodColumns+" FROM quota_periods WHERE subscription_id = ? AND period_start = ?",
+		subscriptionID, queueTime(periodStart)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// AddOverage adds data used beyond the limit under a soft quota, and its
+// cost, to a subscription period
+func (s *Store) AddOverage(userID, subscriptionID string, periodStart time.Time, bytes int64, amountUSD float64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO quota_periods (subscription_id, period_start, user_id, overage_bytes, overage_usd)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(subscription_id, period_start) DO UPDATE SET
+			overage_bytes = overage_bytes + excluded.overage_bytes,
+			overage_usd = overage_usd + excluded.overage_usd
+	`, subscriptionID, queueTime(periodStart), userID, bytes, amountUSD)
+	return err
+}
+
+// MarkQuotaWarned records the quota warning threshold reached in a
+// subscription period. It reports false if a warning at or above it was
+// already recorded, so each warning is sent once.
+func (s *Store) MarkQuotaWarned(userID, subscriptionID string, periodStart time.Time, threshold int) (bool, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO quota_periods (subscription_id, period_start, user_id, warned)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(subscription_id, period_start) DO UPDATE SET warned = excluded.warned
+		WHERE quota_periods.warned < excluded.warned
+	`, subscriptionID, queueTime(periodStart), userID, threshold)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// BillOverage records the renewal charge a period's overage is billed with
+func (s *Store) BillOverage(subscriptionID string, periodStart time.Time, reference string, amountUSD float64) error {
+	_, err := s.db.Exec("UPDATE quota_periods SET reference = ?, billed_usd = ? WHERE subscription_id = ? AND period_start = ?",
+		reference, amountUSD, subscriptionID, queueTime(periodStart))
+	return err
+}
+
+// GetOverageByReference returns the period whose overage a renewal charge
+// billed, or nil
+func (s *Store) GetOverageByReference(reference string) (*billing.QuotaPeriod, error) {
+	p, err := scanQuotaPeriod(s.db.QueryRow("SELECT "+quotaPeriodColumns+" FROM quota_periods WHERE reference = ? AND reference != ''", reference))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
 // --- Subscriptions ---
 
-func (s *Store) GetSubscription(userID string) (*billing.PersistedSubscription, error) {
+const subscriptionColumns = `id, user_id, plan_id, COALESCE(plan_version, 0), status, start_date, end_date, auto_renew,
+	COALESCE(last_reset, ''), COALESCE(grace_until, ''), COALESCE(next_retry_at, ''),
+	COALESCE(retry_count, 0), COALESCE(payment_auth, ''), COALESCE(currency, ''), COALESCE(pending_ref, ''),
+	COALESCE(scheduled_plan, ''), COALESCE(stripe_sub_id, ''), COALESCE(quota_mode, ''),
+	COALESCE(coupon, '')`
+
+func scanSubscription(row interface{ Scan(...any) error }) (*billing.PersistedSubscription, error) {
 	var sub billing.PersistedSubscription
-	err := s.db.QueryRow(`
-		SELECT id, plan_id, status, start_date, end_date, auto_renew 
+	err := row.Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.PlanVersion, &sub.Status, &sub.StartDate, &sub.EndDate, &sub.AutoRenew,
+		&sub.LastReset, &sub.GraceUntil, &sub.NextRetryAt, &sub.RetryCount, &sub.PaymentAuth, &sub.Currency, &sub.PendingRef,
+		&sub.ScheduledPlan, &sub.StripeSubID, &sub.QuotaMode, &sub.Coupon)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (s *Store) GetSubscription(userID string) (*billing.PersistedSubscription, error) {
+	sub, err := scanSubscription(s.db.QueryRow(`
+		SELECT `+subscriptionColumns+`
 		FROM subscriptions 
 		WHERE user_id = ? 
-		ORDER BY created_at DESC LIMIT 1
-	`, userID).Scan(&sub.ID, &sub.PlanID, &sub.Status, &sub.StartDate, &sub.EndDate, &sub.AutoRenew)
+		ORDER BY created_at DESC, rowid DESC LIMIT 1
+	`, userID))
 
 	if err == sql.ErrNoRows {
 		return nil, nil // No subscription found
 	}
-	return &sub, err
+	return sub, err
+}
+
+// ListRenewableSubscriptions returns the current subscription of every user
+// whose subscription can still change state: trialing, active, past_due or
+// canceled. Older subscriptions a user has replaced are ignored.
+func (s *Store) ListRenewableSubscriptions() ([]*billing.PersistedSubscription, error) {
+	rows, err := s.db.Query(`
+		SELECT ` + subscriptionColumns + `
+		FROM subscriptions s
+		WHERE status IN ('trialing', 'active', 'past_due', 'canceled')
+		AND rowid = (
+			SELECT rowid FROM subscriptions
+			WHERE user_id = s.user_id
+			ORDER BY created_at DESC, rowid DESC LIMIT 1
+		)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*billing.PersistedSubscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// UpdateSubscriptionLifecycle stores a state transition of a subscription
+func (s *Store) UpdateSubscriptionLifecycle(sub *billing.PersistedSubscription) error {
+	_, err := s.db.Exec(`
+		UPDATE subscriptions SET
+			plan_id = ?, plan_version = ?, status = ?, start_date = ?, end_date = ?, auto_renew = ?,
+			grace_until = ?, next_retry_at = ?, retry_count = ?, pending_ref = ?,
+			scheduled_plan = ?
+		WHERE id = ?
+	`, sub.PlanID, sub.PlanVersion, sub.Status, sub.StartDate, sub.EndDate, sub.AutoRenew, sub.GraceUntil, sub.NextRetryAt, sub.RetryCount, sub.PendingRef,
+		sub.ScheduledPlan, sub.ID)
+	return err
+}
+
+// SetScheduledPlan schedules the plan a subscription renews into, or clears
+// the schedule if planID is empty
+func (s *Store) SetScheduledPlan(subscriptionID, planID string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET scheduled_plan = ? WHERE id = ?", planID, subscriptionID)
+	return err
+}
+
+// SetQuotaMode sets what happens once a subscription's data limit is used up
+func (s *Store) SetQuotaMode(subscriptionID, mode string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET quota_mode = ? WHERE id = ?", mode, subscriptionID)
+	return err
+}
+
+// GetSubscriptionByPendingRenewal returns the subscription waiting for the
+// renewal charge with the given reference, or nil
+func (s *Store) GetSubscriptionByPendingRenewal(reference string) (*billing.PersistedSubscription, error) {
+	sub, err := scanSubscription(s.db.QueryRow(`
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions
+		WHERE pending_ref = ? AND pending_ref != ''
+	`, reference))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+// ClearPendingRenewal settles a pending renewal charge. It reports false if
+// the charge was already settled, so only one caller starts the new period.
+func (s *Store) ClearPendingRenewal(id, reference string) (bool, error) {
+	res, err := s.db.Exec("UPDATE subscriptions SET pending_ref = '' WHERE id = ? AND pending_ref = ?", id, reference)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimRenewal reserves a renewal attempt until the given time so that a
+// subscription is never charged twice, even by several API instances.
+// It reports false if another attempt holds the claim.
+func (s *Store) ClaimRenewal(id string, now, until time.Time) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE subscriptions SET next_retry_at = ?
+		WHERE id = ? AND (next_retry_at IS NULL OR next_retry_at = '' OR next_retry_at <= ?)
+	`, until.UTC().Format(time.RFC3339), id, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// MarkQuotaReset records that the usage quota of a subscription was reset for
+// the period starting at periodStart. It reports false if that reset was
+// already recorded, which keeps resets idempotent.
+func (s *Store) MarkQuotaReset(id, periodStart string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE subscriptions SET last_reset = ?
+		WHERE id = ? AND (last_reset IS NULL OR last_reset = '' OR last_reset < ?)
+	`, periodStart, id, periodStart)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetSubscriptionPaymentAuth stores the reusable payment authorization used
+// to charge renewals and the currency it was first charged in
+func (s *Store) SetSubscriptionPaymentAuth(id, auth, currency string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET payment_auth = ?, currency = ? WHERE id = ?", auth, currency, id)
+	return err
+}
+
+// SetSubscriptionStripeID links a subscription to the Stripe subscription
+// that bills it
+func (s *Store) SetSubscriptionStripeID(id, stripeSubID string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET stripe_sub_id = ? WHERE id = ?", stripeSubID, id)
+	return err
+}
+
+// GetSubscriptionByStripeID returns the subscription billed by a Stripe
+// subscription, or nil
+func (s *Store) GetSubscriptionByStripeID(stripeSubID string) (*billing.PersistedSubscription, error) {
+	sub, err := scanSubscription(s.db.QueryRow(`
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions
+		WHERE stripe_sub_id = ? AND stripe_sub_id != ''
+		ORDER BY created_at DESC, rowid DESC LIMIT 1
+	`, stripeSubID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
 }
 
-func (s *Store) SetSubscription(userID, id, planID, status, start, end string, autoRenew bool) error {
+func (s *Store) SetSubscription(userID, id, planID string, planVersion int, status, start, end string, autoRenew bool) error {
 	// Upsert or simple insert? For MVP, we might just track the active one.
 	// Let's insert a new record or update existing if ID matches?
 	// The Manager generates a NEW ID every subscribe call, so we insert.
@@ -296,29 +572,164 @@ func (s *Store) SetSubscription(userID, id, planID, status, start, end string, a
 	// Let's just insert.
 
 	_, err = tx.Exec(`
-		INSERT INTO subscriptions (id, user_id, plan_id, status, start_date, end_date, auto_renew)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO subscriptions (id, user_id, plan_id, plan_version, status, start_date, end_date, auto_renew)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(id) DO UPDATE SET
 			plan_id=excluded.plan_id,
+			plan_version=excluded.plan_version,
 			status=excluded.status,
 			start_date=excluded.start_date,
 			end_date=excluded.end_date,
 			auto_renew=excluded.auto_renew
-	`, id, userID, planID, status, start, end, autoRenew)
+	`, id, userID, planID, planVersion, status, start, end, autoRenew)
+
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// --- Plans ---
+
+// seedPlans stores the built-in plans that have no versions yet. Their terms
+// are the ones the client enforced before plans were kept here, so they
+// replace whatever an older release seeded.
+func seedPlans(store billing.PlanStore) error {
+	plans, err := store.ListPlans()
+	if err != nil {
+		return fmt.Errorf("failed to check plans: %w", err)
+	}
+	versioned := make(map[billing.PlanType]bool)
+	for _, p := range plans {
+		versioned[p.ID] = true
+	}
+
+	for _, p := range billing.DefaultPlans() {
+		if versioned[p.ID] {
+			continue
+		}
+		p.Version, p.Active = 1, true
+		if err := store.SavePlan(&p); err != nil {
+			return fmt.Errorf("failed to seed plan %s: %w", p.ID, err)
+		}
+	}
+	return nil
+}
+
+// ListPlans returns every version of every plan, in the order the plans were
+// added and oldest version first
+func (s *Store) ListPlans() ([]billing.Plan, error) {
+	rows, err := s.db.Query(`
+		SELECT v.terms, p.active
+		FROM plan_versions v
+		JOIN plans p ON p.id = v.plan_id
+		ORDER BY p.rowid, v.version
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []billing.Plan
+	for rows.Next() {
+		var terms string
+		var active bool
+		if err := rows.Scan(&terms, &active); err != nil {
+			return nil, err
+		}
+		var p billing.Plan
+		if err := json.Unmarshal([]byte(terms), &p); err != nil {
+			return nil, fmt.Errorf("failed to decode plan terms: %w", err)
+		}
+		p.Active = active
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+// SavePlan stores a new version of a plan and makes it the plan's current
+// terms
+func (s *Store) SavePlan(p *billing.Plan) error {
+	terms, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	features, err := json.Marshal(p.Features)
+	if err != nil {
+		return err
+	}
+	flags, err := json.Marshal(p.Flags)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO plans (id, name, price_cents, price_annual_cents, currency, data_quota_mb, request_limit,
+			concurrent_conns, features, flags, version, active)
+		VALUES (?, ?, ?, ?, 'USD', ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			name=excluded.name,
+			price_cents=excluded.price_cents,
+			price_annual_cents=excluded.price_annual_cents,
+			data_quota_mb=excluded.data_quota_mb,
+			request_limit=excluded.request_limit,
+			concurrent_conns=excluded.concurrent_conns,
+			features=excluded.features,
+			flags=excluded.flags,
+			version=excluded.version,
+			active=excluded.active
+	`, p.ID, p.Name, int64(math.Round(p.PriceMonthly*100)), int64(math.Round(p.PriceAnnual*100)),
+		p.DataLimitMB, p.RequestLimit, p.ConcurrentConns, string(features), string(flags), p.Version, p.Active)
+	if err != nil {
+		return err
+	}
 
+	_, err = tx.Exec("INSERT INTO plan_versions (plan_id, version, terms, created_at) VALUES (?, ?, ?, ?)",
+		p.ID, p.Version, string(terms), time.Now())
 	if err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
+// SetPlanActive offers or retires a plan
+func (s *Store) SetPlanActive(id billing.PlanType, active bool) error {
+	res, err := s.db.Exec("UPDATE plans SET active = ? WHERE id = ?", active, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return billing.ErrPlanNotFound
+	}
+	return nil
+}
+
 // --- Auth: Users ---
 
 type User struct {
-	ID           string
-	Email        string
-	PasswordHash string
-	CreatedAt    time.Time
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	PasswordHash  string    `json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+const userColumns = `id, email, password_hash, created_at, email_verified_at`
+
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	var u User
+	var verifiedAt sql.NullTime
+	if err := row.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt, &verifiedAt); err != nil {
+		return nil, err
+	}
+	u.EmailVerified = verifiedAt.Valid
+	return &u, nil
 }
 
 func (s *Store) CreateUser(id, email, passwordHash string) error {
@@ -330,45 +741,82 @@ func (s *Store) CreateUser(id, email, passwordHash string) error {
 }
 
 func (s *Store) GetUserByEmail(email string) (*User, error) {
-	var u User
-	err := s.db.QueryRow(`
-		SELECT id, email, password_hash, created_at
-		FROM users WHERE email = ?
-	`, email).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt)
-
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("user not found")
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &u, nil
+	return u, nil
 }
 
 func (s *Store) GetUserByID(id string) (*User, error) {
-	var u User
-	err := s.db.QueryRow(`
-		SELECT id, email, password_hash, created_at
-		FROM users WHERE id = ?
-	`, id).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt)
-
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &u, nil
+	return u, nil
+}
+
+// MarkEmailVerified records that the user confirmed their email address
+func (s *Store) MarkEmailVerified(id string) error {
+	_, err := s.db.Exec(`
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?
+	`, time.Now().UTC(), id)
+	return err
+}
+
+func (s *Store) UpdateUserPassword(id, passwordHash string) error {
+	res, err := s.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// GetUserEmail returns the email address of a user
+func (s *Store) GetUserEmail(id string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM users WHERE id = ?", id).Scan(&email)
+	return email, err
 }
 
 // --- Auth: Sessions ---
 
+// Session is one signed-in device. Token holds the hash of the device's
+// current refresh token, never the token itself.
 type Session struct {
-	ID        string
-	UserID    string
-	Token     string
-	CreatedAt time.Time
-	ExpiresAt time.Time
+	ID         string
+	UserID     string
+	Token      string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+}
+
+const sessionColumns = `id, user_id, token, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, expires_at, last_used_at`
+
+func scanSession(row interface{ Scan(...any) error }) (*Session, error) {
+	var sess Session
+	var lastUsed sql.NullTime
+	if err := row.Scan(&sess.ID, &sess.UserID, &sess.Token, &sess.UserAgent, &sess.IPAddress, &sess.CreatedAt, &sess.ExpiresAt, &lastUsed); err != nil {
+		return nil, err
+	}
+	if lastUsed.Valid {
+		sess.LastUsedAt = lastUsed.Time
+	} else {
+		sess.LastUsedAt = sess.CreatedAt
+	}
+	return &sess, nil
 }
 
 func (s *Store) CreateSession(id, userID, token string, expiresAt time.Time) error {
@@ -380,28 +828,741 @@ func (s *Store) CreateSession(id, userID, token string, expiresAt time.Time) err
 }
 
 func (s *Store) GetSession(token string) (*Session, error) {
-	var sess Session
-	err := s.db.QueryRow(`
-		SELECT id, user_id, token, created_at, expires_at
-		FROM sessions WHERE token = ?
-	`, token).Scan(&sess.ID, &sess.UserID, &sess.Token, &sess.CreatedAt, &sess.ExpiresAt)
-
+	sess, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE token = ?`, token))
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("session not found")
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &sess, nil
+	return sess, nil
 }
 
-func (s *Store) DeleteSession(token string) error {
-	_, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", token)
-	return err
+func (s *Store) GetSessionByID(id string) (*Session, error) {
+	sess, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("session not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
 }
 
-// --- Transactions ---
-
+// ListUserSessions returns all sessions of a user, most recently used first
+func (s *Store) ListUserSessions(userID string) ([]*Session, error) {
+	rows, err := s.db.Query(`
+		SELECT `+sessionColumns+`
+		FROM sessions WHERE user_id = ?
+		ORDER BY COALESCE(last_used_at, created_at) DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// RotateSessionToken replaces the refresh token hash of a session and extends
+// its expiry, but only while oldToken is still the session's current token.
+// It reports false if the token was already rotated, e.g. by a concurrent
+// refresh. The replaced hash is kept so that its reuse can be detected.
+func (s *Store) RotateSessionToken(id, oldToken, newToken string, expiresAt time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE sessions SET token = ?, expires_at = ?, last_used_at = ? WHERE id = ? AND token = ?
+	`, newToken, expiresAt, time.Now().UTC(), id, oldToken)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO rotated_refresh_tokens (token, session_id, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(token) DO NOTHING
+	`, oldToken, id, expiresAt.UTC()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetRotatedTokenSession returns the session a replaced refresh token hash
+// belonged to, or "" if the hash was never rotated
+func (s *Store) GetRotatedTokenSession(token string) (string, error) {
+	var sessionID string
+	err := s.db.QueryRow("SELECT session_id FROM rotated_refresh_tokens WHERE token = ?", token).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return sessionID, err
+}
+
+// TouchSession records the device a session was last used from
+func (s *Store) TouchSession(id, userAgent, ipAddress string) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions SET user_agent = ?, ip_address = ?, last_used_at = ? WHERE id = ?
+	`, userAgent, ipAddress, time.Now().UTC(), id)
+	return err
+}
+
+func (s *Store) DeleteSession(token string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return err
+}
+
+func (s *Store) DeleteSessionByID(id string) error {
+	if _, err := s.db.Exec("DELETE FROM rotated_refresh_tokens WHERE session_id = ?", id); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// --- Auth: Session Revocations ---
+
+// RevokeSession adds a session to the revocation list until expiresAt, by which
+// time every access token issued for it has expired on its own.
+func (s *Store) RevokeSession(sessionID, userID string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO session_revocations (session_id, user_id, expires_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(session_id) DO UPDATE SET expires_at = excluded.expires_at
+	`, sessionID, userID, expiresAt.UTC())
+	return err
+}
+
+// GetSessionRevocations returns revoked session IDs with the time their entry lapses
+func (s *Store) GetSessionRevocations() (map[string]time.Time, error) {
+	rows, err := s.db.Query("SELECT session_id, expires_at FROM session_revocations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var expiresAt time.Time
+		if err := rows.Scan(&id, &expiresAt); err != nil {
+			return nil, err
+		}
+		revoked[id] = expiresAt
+	}
+	return revoked, rows.Err()
+}
+
+// GetSessionRevocation returns when the revocation of a session lapses, or
+// nil if the session is not revoked
+func (s *Store) GetSessionRevocation(sessionID string) (*time.Time, error) {
+	var expiresAt time.Time
+	err := s.db.QueryRow("SELECT expires_at FROM session_revocations WHERE session_id = ?", sessionID).Scan(&expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &expiresAt, nil
+}
+
+// PruneSessionRevocations drops revocation entries and rotated refresh token
+// hashes that lapsed before now
+func (s *Store) PruneSessionRevocations(now time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM rotated_refresh_tokens WHERE expires_at < ?", now.UTC()); err != nil {
+		return err
+	}
+
+	revoked, err := s.GetSessionRevocations()
+	if err != nil {
+		return err
+	}
+	for id, expiresAt := range revoked {
+		if expiresAt.Before(now) {
+			if _, err := s.db.Exec("DELETE FROM session_revocations WHERE session_id = ?", id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// --- Auth: API Keys ---
+
+// APIKey is a long-lived credential for programmatic access. Only the hash of
+// the key is stored; Prefix is the visible start of the key used to tell keys apart.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, created_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt, lastUsed sql.NullTime
+	if err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &scopes, &expiresAt, &lastUsed, &key.CreatedAt); err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	return &key, nil
+}
+
+func (s *Store) CreateAPIKey(key *APIKey) error {
+	var expiresAt interface{}
+	if key.ExpiresAt != nil {
+		expiresAt = key.ExpiresAt.UTC()
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, key.ID, key.UserID, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), expiresAt, key.CreatedAt.UTC())
+	return err
+}
+
+func (s *Store) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("api key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListUserAPIKeys returns all API keys of a user, newest first
+func (s *Store) ListUserAPIKeys(userID string) ([]*APIKey, error) {
+	rows, err := s.db.Query(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// TouchAPIKey records when a key was last used
+func (s *Store) TouchAPIKey(id string, usedAt time.Time) error {
+	_, err := s.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", usedAt.UTC(), id)
+	return err
+}
+
+// DeleteAPIKey removes a key owned by userID
+func (s *Store) DeleteAPIKey(id, userID string) error {
+	res, err := s.db.Exec("DELETE FROM api_keys WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("api key not found")
+	}
+	return nil
+}
+
+// --- Auth: Email Tokens ---
+
+// CreateEmailToken stores the hash of an email verification or password reset token
+func (s *Store) CreateEmailToken(hash, userID, purpose string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO email_tokens (token_hash, user_id, purpose, expires_at)
+		VALUES (?, ?, ?, ?)
+	`, hash, userID, purpose, expiresAt.UTC())
+	return err
+}
+
+// ConsumeEmailToken marks an unused, unexpired token as used and returns its user.
+// Each token can be consumed once.
+func (s *Store) ConsumeEmailToken(hash, purpose string, now time.Time) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE email_tokens SET used_at = ?
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	`, now.UTC(), hash, purpose, now.UTC())
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", fmt.Errorf("token not found")
+	}
+
+	var userID string
+	if err := tx.QueryRow("SELECT user_id FROM email_tokens WHERE token_hash = ?", hash).Scan(&userID); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+// DeleteEmailTokens removes the outstanding tokens of a user for one purpose
+func (s *Store) DeleteEmailTokens(userID, purpose string) error {
+	_, err := s.db.Exec("DELETE FROM email_tokens WHERE user_id = ? AND purpose = ?", userID, purpose)
+	return err
+}
+
+// --- Auth: Login Challenges ---
+
+// Login challenge states
+const (
+	ChallengePending   = "pending"
+	ChallengeVerifying = "verifying" // a code is being checked
+	ChallengeUsed      = "used"
+)
+
+// LoginChallenge is a sign-in waiting for its second factor
+type LoginChallenge struct {
+	ID        string
+	UserID    string
+	Attempts  int
+	State     string
+	ExpiresAt time.Time
+}
+
+// CreateLoginChallenge stores a new challenge and drops expired ones
+func (s *Store) CreateLoginChallenge(id, userID string, expiresAt time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM login_challenges WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO login_challenges (id, user_id, expires_at) VALUES (?, ?, ?)
+	`, id, userID, expiresAt.UTC())
+	return err
+}
+
+// ClaimLoginChallenge atomically moves a pending, unexpired challenge with
+// attempts left into the verifying state and counts the attempt. It reports
+// whether the claim succeeded and returns the challenge as stored, or nil if
+// there is none. Only one code can be checked against a challenge at a time.
+func (s *Store) ClaimLoginChallenge(id string, maxAttempts int, now time.Time) (*LoginChallenge, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE login_challenges SET state = ?, attempts = attempts + 1
+		WHERE id = ? AND state = ? AND attempts < ? AND expires_at > ?
+	`, ChallengeVerifying, id, ChallengePending, maxAttempts, now.UTC())
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ch LoginChallenge
+	err = tx.QueryRow(`
+		SELECT id, user_id, attempts, state, expires_at FROM login_challenges WHERE id = ?
+	`, id).Scan(&ch.ID, &ch.UserID, &ch.Attempts, &ch.State, &ch.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &ch, n == 1, tx.Commit()
+}
+
+// FinishLoginChallenge ends a verification started by ClaimLoginChallenge.
+// A verified challenge is used up, otherwise it is pending again.
+func (s *Store) FinishLoginChallenge(id string, verified bool) error {
+	state := ChallengePending
+	if verified {
+		state = ChallengeUsed
+	}
+	_, err := s.db.Exec(`
+		UPDATE login_challenges SET state = ? WHERE id = ? AND state = ?
+	`, state, id, ChallengeVerifying)
+	return err
+}
+
+// --- Auth: Two-Factor ---
+
+// TOTPSecret is a user's TOTP enrollment. SecretEnc is the encrypted shared
+// secret; the enrollment only applies to logins once Enabled is set.
+type TOTPSecret struct {
+	UserID       string
+	SecretEnc    string
+	Enabled      bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+func (s *Store) GetTOTP(userID string) (*TOTPSecret, error) {
+	var t TOTPSecret
+	err := s.db.QueryRow(`
+		SELECT user_id, secret_enc, enabled, last_used_step, created_at
+		FROM user_totp WHERE user_id = ?
+	`, userID).Scan(&t.UserID, &t.SecretEnc, &t.Enabled, &t.LastUsedStep, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetTOTP stores a (new) enrollment for the user, replacing any previous one
+func (s *Store) SetTOTP(userID, secretEnc string, enabled bool) error {
+	var enabledAt interface{}
+	if enabled {
+		enabledAt = time.Now().UTC()
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO user_totp (user_id, secret_enc, enabled, last_used_step, created_at, enabled_at)
+		VALUES (?, ?, ?, 0, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			secret_enc = excluded.secret_enc,
+			enabled = excluded.enabled,
+			last_used_step = 0,
+			created_at = excluded.created_at,
+			enabled_at = excluded.enabled_at
+	`, userID, secretEnc, enabled, time.Now().UTC(), enabledAt)
+	return err
+}
+
+// EnableTOTP activates a pending enrollment
+func (s *Store) EnableTOTP(userID string, step int64) error {
+	_, err := s.db.Exec(`
+		UPDATE user_totp SET enabled = TRUE, enabled_at = ?, last_used_step = ? WHERE user_id = ?
+	`, time.Now().UTC(), step, userID)
+	return err
+}
+
+// MarkTOTPStepUsed records the last accepted time step so a code can not be
+// replayed. It reports false if an equal or later step was already used.
+func (s *Store) MarkTOTPStepUsed(userID string, step int64) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?
+	`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// DeleteTOTP removes the enrollment and recovery codes of a user
+func (s *Store) DeleteTOTP(userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes discards the user's recovery codes and stores new hashes
+func (s *Store) ReplaceRecoveryCodes(userID string, hashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes an unused recovery code. It reports whether the code was valid.
+func (s *Store) UseRecoveryCode(userID, hash string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now().UTC(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (s *Store) CountRecoveryCodes(userID string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+// --- Auth: Login Protection ---
+
+// LoginFailure counts the recent failed sign-ins for one key, such as an
+// email address or a client IP
+type LoginFailure struct {
+	Key            string
+	Failures       int
+	FirstFailureAt time.Time
+	LastFailureAt  time.Time
+}
+
+// ReserveLoginAttempt counts an attempt against key, but only if the counter
+// is still as seen in prev (nil if there was none). It reports false when a
+// concurrent attempt changed the counter first, in which case the caller
+// should look again. The count starts over when the previous failure is
+// older than window.
+func (s *Store) ReserveLoginAttempt(key string, prev *LoginFailure, now time.Time, window time.Duration) (*LoginFailure, bool, error) {
+	now = now.UTC()
+	f := &LoginFailure{Key: key, Failures: 1, FirstFailureAt: now, LastFailureAt: now}
+
+	if prev == nil {
+		res, err := s.db.Exec(`
+			INSERT INTO login_failures (key, failures, first_failure_at, last_failure_at)
+			VALUES (?, 1, ?, ?)
+			ON CONFLICT(key) DO NOTHING
+		`, key, now, now)
+		if err != nil {
+			return nil, false, err
+		}
+		n, err := res.RowsAffected()
+		return f, n == 1, err
+	}
+
+	if !prev.LastFailureAt.Before(now.Add(-window)) {
+		f.Failures = prev.Failures + 1
+		f.FirstFailureAt = prev.FirstFailureAt
+	}
+	res, err := s.db.Exec(`
+		UPDATE login_failures SET failures = ?, first_failure_at = ?, last_failure_at = ?
+		WHERE key = ? AND failures = ? AND last_failure_at = ?
+	`, f.Failures, f.FirstFailureAt.UTC(), now, key, prev.Failures, prev.LastFailureAt.UTC())
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	return f, n == 1, err
+}
+
+// ReleaseLoginAttempt takes one attempt off the counter of key again
+func (s *Store) ReleaseLoginAttempt(key string) error {
+	_, err := s.db.Exec("UPDATE login_failures SET failures = failures - 1 WHERE key = ? AND failures > 0", key)
+	return err
+}
+
+// GetLoginFailure returns the failure counter of a key, or nil if there is none
+func (s *Store) GetLoginFailure(key string) (*LoginFailure, error) {
+	f := &LoginFailure{Key: key}
+	err := s.db.QueryRow(
+		"SELECT failures, first_failure_at, last_failure_at FROM login_failures WHERE key = ?", key,
+	).Scan(&f.Failures, &f.FirstFailureAt, &f.LastFailureAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ClearLoginFailures resets the failure counter of a key
+func (s *Store) ClearLoginFailures(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE key = ?", key)
+	return err
+}
+
+// PruneLoginFailures drops counters whose last failure is before the cutoff
+func (s *Store) PruneLoginFailures(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE last_failure_at < ?", before.UTC())
+	return err
+}
+
+// --- Activity Log ---
+
+// Activity is an entry of a user's account activity log
+type Activity struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Details   string    `json:"details"`
+	IPAddress string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"timestamp"`
+}
+
+func (s *Store) AddActivity(a *Activity) error {
+	_, err := s.db.Exec(`
+		INSERT INTO activity_log (id, user_id, type, status, details, ip_address, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.ID, a.UserID, a.Type, a.Status, a.Details, a.IPAddress, a.UserAgent, a.CreatedAt.UTC())
+	return err
+}
+
+// ListActivities returns a page of a user's activity, newest first, and the
+// total number of entries
+func (s *Store) ListActivities(userID string, limit, offset int) ([]*Activity, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM activity_log WHERE user_id = ?", userID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, user_id, type, status, details, ip_address, user_agent, created_at
+		FROM activity_log WHERE user_id = ? ORDER BY created_at DESC LIMIT ? OFFSET ?
+	`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var activities []*Activity
+	for rows.Next() {
+		var a Activity
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Type, &a.Status, &a.Details, &a.IPAddress, &a.UserAgent, &a.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		activities = append(activities, &a)
+	}
+	return activities, total, rows.Err()
+}
+
+// --- Credit Ledger ---
+
+// PostCreditTransaction books a transaction as a pair of entries that sum to
+// zero. A reference that was already posted is left alone and reported as
+// not posted.
+func (s *Store) PostCreditTransaction(t *billing.CreditTransaction) (bool, error) {
+	if t.Amount <= 0 || t.Debit == t.Credit {
+		return false, fmt.Errorf("invalid credit transaction")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO credit_transactions (id, kind, reference, description, created_at)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT(reference) DO NOTHING
+	`, t.ID, t.Kind, t.Reference, t.Description, t.CreatedAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	for _, e := range []struct {
+		account string
+		amount  int64
+	}{{t.Debit, -t.Amount}, {t.Credit, t.Amount}} {
+		if _, err := tx.Exec(`
+			INSERT INTO credit_entries (txn_id, account, amount, created_at) VALUES (?, ?, ?, ?)
+		`, t.ID, e.account, e.amount, t.CreatedAt.UTC()); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// GetLedgerBalance returns the sum of the entries of a ledger account
+func (s *Store) GetLedgerBalance(account string) (int64, error) {
+	var balance int64
+	err := s.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM credit_entries WHERE account = ?", account).Scan(&balance)
+	return balance, err
+}
+
+// ListLedgerEntries returns a page of the entries of a ledger account, newest
+// first, and the total number of entries
+func (s *Store) ListLedgerEntries(account string, limit, offset int) ([]*billing.CreditEntry, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM credit_entries WHERE account = ?", account).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT e.txn_id, e.account, t.kind, t.reference, t.description, e.amount, e.created_at
+		FROM credit_entries e JOIN credit_transactions t ON t.id = e.txn_id
+		WHERE e.account = ? ORDER BY e.id DESC LIMIT ? OFFSET ?
+	`, account, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []*billing.CreditEntry
+	for rows.Next() {
+		var e billing.CreditEntry
+		if err := rows.Scan(&e.TxnID, &e.Account, &e.Kind, &e.Reference, &e.Description, &e.Amount, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, total, rows.Err()
+}
+
+// --- Transactions ---
+
+// Kinds of payment transactions
+const (
+	TransactionPayment       = "payment"
+	TransactionRefund        = "refund"
+	TransactionDepositRefund = "deposit_refund" // returns a trial deposit
+)
+
 type Transaction struct {
 	ID            string
 	UserID        string
@@ -410,31 +1571,1477 @@ type Transaction struct {
 	Currency      string
 	Status        string
 	PaymentMethod string
+	GatewayRef    string // the payment gateway's own transaction ID, if known
 	CreatedAt     time.Time
+
+	Kind           string  // TransactionPayment if empty
+	DepositAmount  float64 // refundable deposit included in a payment
+	DepositStatus  string  // state of that deposit; see billing.DepositHeld
+	RefundedAmount float64 // refunded from a payment so far
+	RefundOf       string  // payment a refund returns money from
+	Reason         string  // why a refund was made
+
+	FXRate    float64 // units of Currency per USD the payment was charged at
+	AmountUSD float64 // Amount in USD at that rate
+}
+
+const transactionColumns = `id, COALESCE(user_id, ''), plan_id, amount, currency, status, payment_method,
+	COALESCE(gateway_ref, ''), created_at, COALESCE(kind, ''), COALESCE(deposit_amount, 0),
+	COALESCE(deposit_status, ''), COALESCE(refunded_amount, 0), COALESCE(refund_of, ''), COALESCE(reason, ''),
+	COALESCE(fx_rate, 0), COALESCE(amount_usd, 0)`
+
+func scanTransaction(row interface{ Scan(...any) error }) (*Transaction, error) {
+	var tx Transaction
+	var createdAt string
+	err := row.Scan(&tx.ID, &tx.UserID, &tx.PlanID, &tx.Amount, &tx.Currency, &tx.Status, &tx.PaymentMethod,
+		&tx.GatewayRef, &createdAt, &tx.Kind, &tx.DepositAmount, &tx.DepositStatus, &tx.RefundedAmount, &tx.RefundOf, &tx.Reason,
+		&tx.FXRate, &tx.AmountUSD)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Kind == "" {
+		tx.Kind = TransactionPayment
+	}
+	tx.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return &tx, nil
+}
+
+func (s *Store) CreateTransaction(tx *Transaction) error {
+	return createTransaction(s.db, tx)
+}
+
+// transactionKind is the kind of a transaction, a payment unless set
+func transactionKind(tx *Transaction) string {
+	if tx.Kind == "" {
+		return TransactionPayment
+	}
+	return tx.Kind
+}
+
+func createTransaction(db interface {
+	Exec(string, ...any) (sql.Result, error)
+}, tx *Transaction) error {
+	_, err := db.Exec(`
+		INSERT INTO payment_transactions (id, user_id, plan_id, amount, currency, status, payment_method, gateway_ref, created_at,
+			kind, deposit_amount, deposit_status, refunded_amount, refund_of, reason, fx_rate, amount_usd)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, tx.ID, tx.UserID, tx.PlanID, tx.Amount, tx.Currency, tx.Status, tx.PaymentMethod, tx.GatewayRef, tx.CreatedAt.Format(time.RFC3339),
+		transactionKind(tx), tx.DepositAmount, tx.DepositStatus, tx.RefundedAmount, tx.RefundOf, tx.Reason, tx.FXRate, tx.AmountUSD)
+	return err
+}
+
+func (s *Store) GetTransaction(id string) (*Transaction, error) {
+	return scanTransaction(s.db.QueryRow("SELECT "+transactionColumns+" FROM payment_transactions WHERE id = ?", id))
+}
+
+// SetTransactionGatewayRef stores the gateway's ID of a payment once the
+// gateway reports it
+func (s *Store) SetTransactionGatewayRef(id, ref string) error {
+	_, err := s.db.Exec("UPDATE payment_transactions SET gateway_ref = ? WHERE id = ?", ref, id)
+	return err
+}
+
+// GetRefundByGatewayRef returns the refund the gateway knows by ref
+func (s *Store) GetRefundByGatewayRef(method, ref string) (*Transaction, error) {
+	return scanTransaction(s.db.QueryRow(`
+		SELECT `+transactionColumns+` FROM payment_transactions
+		WHERE payment_method = ? AND gateway_ref = ? AND kind IN (?, ?)
+	`, method, ref, TransactionRefund, TransactionDepositRefund))
+}
+
+// GetDepositTransaction returns the latest payment of a user that included a
+// deposit, or nil if there is none
+func (s *Store) GetDepositTransaction(userID string) (*Transaction, error) {
+	tx, err := scanTransaction(s.db.QueryRow(`
+		SELECT `+transactionColumns+` FROM payment_transactions
+		WHERE user_id = ? AND deposit_amount > 0
+		ORDER BY created_at DESC, rowid DESC LIMIT 1
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return tx, err
+}
+
+// SetDepositStatus moves the deposit of a payment to status if it is in one
+// of the from states. It reports whether it did.
+func (s *Store) SetDepositStatus(id, status string, from ...string) (bool, error) {
+	if len(from) == 0 {
+		return false, fmt.Errorf("no deposit states to move from")
+	}
+	args := []any{status, id}
+	for _, f := range from {
+		args = append(args, f)
+	}
+	res, err := s.db.Exec(`
+		UPDATE payment_transactions SET deposit_status = ?
+		WHERE id = ? AND deposit_status IN (?`+strings.Repeat(", ?", len(from)-1)+`)
+	`, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListRefunds returns a page of refunds, newest first, of one user or of
+// everyone if userID is empty, and the total number of them
+func (s *Store) ListRefunds(userID string, limit, offset int) ([]*Transaction, int, error) {
+	const where = "kind IN (?, ?) AND (? = '' OR user_id = ?)"
+	args := []any{TransactionRefund, TransactionDepositRefund, userID, userID}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM payment_transactions WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+transactionColumns+" FROM payment_transactions WHERE "+where+
+		" ORDER BY created_at DESC, rowid DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var refunds []*Transaction
+	for rows.Next() {
+		tx, err := scanTransaction(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		refunds = append(refunds, tx)
+	}
+	return refunds, total, rows.Err()
+}
+
+// RecordRefund stores a refund before it is sent to the gateway and books
+// its amount against the payment. A deposit refund also marks the deposit
+// refunded, and fails with billing.ErrDepositNotHeld if it is not held.
+// A refund larger than what is left of the payment fails with
+// billing.ErrRefundTooLarge.
+func (s *Store) RecordRefund(refund *Transaction) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE payment_transactions SET refunded_amount = COALESCE(refunded_amount, 0) + ?
+		WHERE id = ? AND COALESCE(kind, ?) = ? AND COALESCE(refunded_amount, 0) + ? <= amount + 0.005
+	`, refund.Amount, refund.RefundOf, TransactionPayment, TransactionPayment, refund.Amount)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return billing.ErrRefundTooLarge
+	}
+
+	if refund.Kind == TransactionDepositRefund {
+		res, err := tx.Exec(`
+			UPDATE payment_transactions SET deposit_status = ?
+			WHERE id = ? AND deposit_status IN (?, ?)
+		`, billing.DepositRefunded, refund.RefundOf, billing.DepositHeld, billing.DepositRefundScheduled)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return billing.ErrDepositNotHeld
+		}
+	}
+
+	if err := createTransaction(tx, refund); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateRefund stores the gateway's ID and the status of a refund
+func (s *Store) UpdateRefund(id, status, gatewayRef string) error {
+	_, err := s.db.Exec(`
+		UPDATE payment_transactions SET status = ?, gateway_ref = ? WHERE id = ? AND kind IN (?, ?)
+	`, status, gatewayRef, id, TransactionRefund, TransactionDepositRefund)
+	return err
+}
+
+// FailRefund marks a refund failed and gives its amount back to the payment.
+// The deposit of a failed deposit refund is held again.
+func (s *Store) FailRefund(id string) error {
+	refund, err := s.GetTransaction(id)
+	if err != nil {
+		return err
+	}
+	if refund.Status == "failed" {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE payment_transactions SET status = 'failed' WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE payment_transactions SET refunded_amount = MAX(COALESCE(refunded_amount, 0) - ?, 0) WHERE id = ?
+	`, refund.Amount, refund.RefundOf); err != nil {
+		return err
+	}
+	if refund.Kind == TransactionDepositRefund {
+		if _, err := tx.Exec(`
+			UPDATE payment_transactions SET deposit_status = ? WHERE id = ? AND deposit_status = ?
+		`, billing.DepositHeld, refund.RefundOf, billing.DepositRefunded); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// --- Webhook events and jobs ---
+
+// Queue times are stored as UTC RFC 3339 strings so they compare in SQL
+func queueTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func queueTimePtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return queueTime(*t)
+}
+
+func parseQueueTime(s string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+const webhookEventColumns = `id, provider, event_type, event_key, payload, status, attempts,
+	COALESCE(last_error, ''), next_attempt_at, created_at, COALESCE(processed_at, '')`
+
+func scanWebhookEvent(row interface{ Scan(...any) error }) (*queue.Event, error) {
+	var e queue.Event
+	var payload, next, created, processed string
+	err := row.Scan(&e.ID, &e.Provider, &e.Type, &e.Key, &payload, &e.Status, &e.Attempts,
+		&e.LastError, &next, &created, &processed)
+	if err != nil {
+		return nil, err
+	}
+	e.Payload = []byte(payload)
+	if t := parseQueueTime(next); t != nil {
+		e.NextAttemptAt = *t
+	}
+	if t := parseQueueTime(created); t != nil {
+		e.CreatedAt = *t
+	}
+	e.ProcessedAt = parseQueueTime(processed)
+	return &e, nil
+}
+
+// RecordWebhookEvent stores a webhook delivery. A delivery the provider
+// already sent is left alone and reported as not recorded.
+func (s *Store) RecordWebhookEvent(e *queue.Event) (bool, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO webhook_events (id, provider, event_type, event_key, payload, status, attempts, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(provider, event_key) DO NOTHING
+	`, e.ID, e.Provider, e.Type, e.Key, string(e.Payload), e.Status, e.Attempts, queueTime(e.NextAttemptAt), queueTime(e.CreatedAt))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetWebhookEvent returns a stored webhook event
+func (s *Store) GetWebhookEvent(id string) (*queue.Event, error) {
+	e, err := scanWebhookEvent(s.db.QueryRow("SELECT "+webhookEventColumns+" FROM webhook_events WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("webhook event %s not found", id)
+	}
+	return e, err
+}
+
+// ListWebhookEvents returns a page of webhook events, newest first, in the
+// given state or all of them, and the total number of matching events
+func (s *Store) ListWebhookEvents(status string, limit, offset int) ([]*queue.Event, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM webhook_events WHERE ? = '' OR status = ?", status, status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+webhookEventColumns+` FROM webhook_events
+		WHERE ? = '' OR status = ?
+		ORDER BY created_at DESC, rowid DESC LIMIT ? OFFSET ?
+	`, status, status, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []*queue.Event
+	for rows.Next() {
+		e, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+	return events, total, rows.Err()
+}
+
+// ListDueWebhookEvents returns pending events whose next attempt is due,
+// oldest first
+func (s *Store) ListDueWebhookEvents(now time.Time, limit int) ([]*queue.Event, error) {
+	rows, err := s.db.Query(`
+		SELECT `+webhookEventColumns+` FROM webhook_events
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY created_at, rowid LIMIT ?
+	`, queue.StatusPending, queueTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*queue.Event
+	for rows.Next() {
+		e, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ClaimWebhookEvent reserves an attempt at an event until the given time.
+// It reports false if another worker holds the claim.
+func (s *Store) ClaimWebhookEvent(id string, now, until time.Time) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE webhook_events SET next_attempt_at = ?
+		WHERE id = ? AND status = ? AND next_attempt_at <= ?
+	`, queueTime(until), id, queue.StatusPending, queueTime(now))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateWebhookEvent stores the outcome of an attempt at an event
+func (s *Store) UpdateWebhookEvent(e *queue.Event) error {
+	_, err := s.db.Exec(`
+		UPDATE webhook_events SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, processed_at = ?
+		WHERE id = ?
+	`, e.Status, e.Attempts, e.LastError, queueTime(e.NextAttemptAt), queueTimePtr(e.ProcessedAt), e.ID)
+	return err
+}
+
+const jobColumns = `id, kind, job_key, payload, status, attempts, COALESCE(last_error, ''),
+	run_at, next_attempt_at, created_at, COALESCE(processed_at, '')`
+
+func scanJob(row interface{ Scan(...any) error }) (*queue.Job, error) {
+	var j queue.Job
+	var payload, runAt, next, created, processed string
+	err := row.Scan(&j.ID, &j.Kind, &j.Key, &payload, &j.Status, &j.Attempts, &j.LastError,
+		&runAt, &next, &created, &processed)
+	if err != nil {
+		return nil, err
+	}
+	j.Payload = []byte(payload)
+	for _, t := range []struct {
+		dst *time.Time
+		src string
+	}{{&j.RunAt, runAt}, {&j.NextAttemptAt, next}, {&j.CreatedAt, created}} {
+		if parsed := parseQueueTime(t.src); parsed != nil {
+			*t.dst = *parsed
+		}
+	}
+	j.ProcessedAt = parseQueueTime(processed)
+	return &j, nil
+}
+
+// CreateJob schedules a job. A job with the kind and key of an existing one
+// is not scheduled again and is reported as not created.
+func (s *Store) CreateJob(j *queue.Job) (bool, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO jobs (id, kind, job_key, payload, status, attempts, run_at, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(kind, job_key) DO NOTHING
+	`, j.ID, j.Kind, j.Key, string(j.Payload), j.Status, j.Attempts, queueTime(j.RunAt), queueTime(j.NextAttemptAt), queueTime(j.CreatedAt))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListDueJobs returns pending jobs whose next attempt is due, oldest first
+func (s *Store) ListDueJobs(now time.Time, limit int) ([]*queue.Job, error) {
+	rows, err := s.db.Query(`
+		SELECT `+jobColumns+` FROM jobs
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY run_at, rowid LIMIT ?
+	`, queue.StatusPending, queueTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*queue.Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimJob reserves an attempt at a job until the given time. It reports
+// false if another worker holds the claim.
+func (s *Store) ClaimJob(id string, now, until time.Time) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE jobs SET next_attempt_at = ?
+		WHERE id = ? AND status = ? AND next_attempt_at <= ?
+	`, queueTime(until), id, queue.StatusPending, queueTime(now))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateJob stores the outcome of an attempt at a job
+func (s *Store) UpdateJob(j *queue.Job) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, processed_at = ?
+		WHERE id = ?
+	`, j.Status, j.Attempts, j.LastError, queueTime(j.NextAttemptAt), queueTimePtr(j.ProcessedAt), j.ID)
+	return err
+}
+
+// --- Crypto intents ---
+
+const cryptoIntentColumns = `id, user_id, email, plan_id, metadata, asset, address, address_index,
+	amount_usd, amount, rate, received, confirmations, tx_ids, status, expires_at, created_at, COALESCE(paid_at, '')`
+
+func scanCryptoIntent(row interface{ Scan(...any) error }) (*billing.CryptoIntent, error) {
+	var i billing.CryptoIntent
+	var metadata, txIDs, expires, created, paid string
+	err := row.Scan(&i.ID, &i.UserID, &i.Email, &i.PlanID, &metadata, &i.Asset, &i.Address, &i.AddressIndex,
+		&i.AmountUSD, &i.Amount, &i.Rate, &i.Received, &i.Confirmations, &txIDs, &i.Status, &expires, &created, &paid)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(metadata), &i.Metadata)
+	json.Unmarshal([]byte(txIDs), &i.TxIDs)
+	if t := parseQueueTime(expires); t != nil {
+		i.ExpiresAt = *t
+	}
+	if t := parseQueueTime(created); t != nil {
+		i.CreatedAt = *t
+	}
+	i.PaidAt = parseQueueTime(paid)
+	return &i, nil
+}
+
+// NextCryptoAddressIndex reserves the next unused derivation index of an
+// asset's wallet. Indexes are never handed out twice.
+func (s *Store) NextCryptoAddressIndex(asset string) (uint32, error) {
+	var index uint32
+	err := s.db.QueryRow(`
+		INSERT INTO crypto_address_index (asset, next_index) VALUES (?, 1)
+		ON CONFLICT(asset) DO UPDATE SET next_index = next_index + 1
+		RETURNING next_index - 1
+	`, asset).Scan(&index)
+	return index, err
+}
+
+func (s *Store) CreateCryptoIntent(i *billing.CryptoIntent) error {
+	metadata, _ := json.Marshal(i.Metadata)
+	txIDs, _ := json.Marshal(i.TxIDs)
+	_, err := s.db.Exec(`
+		INSERT INTO crypto_intents (id, user_id, email, plan_id, metadata, asset, address, address_index,
+			amount_usd, amount, rate, received, confirmations, tx_ids, status, expires_at, created_at, paid_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, i.ID, i.UserID, i.Email, i.PlanID, string(metadata), i.Asset, i.Address, i.AddressIndex,
+		i.AmountUSD, i.Amount, i.Rate, i.Received, i.Confirmations, string(txIDs), i.Status,
+		queueTime(i.ExpiresAt), queueTime(i.CreatedAt), queueTimePtr(i.PaidAt))
+	return err
+}
+
+func (s *Store) GetCryptoIntent(id string) (*billing.CryptoIntent, error) {
+	i, err := scanCryptoIntent(s.db.QueryRow("SELECT "+cryptoIntentColumns+" FROM crypto_intents WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("crypto intent %s not found", id)
+	}
+	return i, err
+}
+
+// UpdateCryptoIntent stores what the watcher saw on the chain
+func (s *Store) UpdateCryptoIntent(i *billing.CryptoIntent) error {
+	txIDs, _ := json.Marshal(i.TxIDs)
+	_, err := s.db.Exec(`
+		UPDATE crypto_intents SET received = ?, confirmations = ?, tx_ids = ?, status = ?, paid_at = ?
+		WHERE id = ?
+	`, i.Received, i.Confirmations, string(txIDs), i.Status, queueTimePtr(i.PaidAt), i.ID)
+	return err
+}
+
+// ListWatchedCryptoIntents returns the intents a payment may still arrive
+// for: pending and confirming ones, and those that expired after since
+func (s *Store) ListWatchedCryptoIntents(since time.Time) ([]*billing.CryptoIntent, error) {
+	rows, err := s.db.Query(`
+		SELECT `+cryptoIntentColumns+` FROM crypto_intents
+		WHERE status IN (?, ?) OR (status = ? AND expires_at > ?)
+		ORDER BY created_at, rowid
+	`, billing.IntentPending, billing.IntentConfirming, billing.IntentExpired, queueTime(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var intents []*billing.CryptoIntent
+	for rows.Next() {
+		i, err := scanCryptoIntent(rows)
+		if err != nil {
+			return nil, err
+		}
+		intents = append(intents, i)
+	}
+	return intents, rows.Err()
+}
+
+// ListCryptoIntents returns a page of crypto intents, newest first, in the
+// given state or all of them, and the total number of matching intents
+func (s *Store) ListCryptoIntents(status string, limit, offset int) ([]*billing.CryptoIntent, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM crypto_intents WHERE ? = '' OR status = ?", status, status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+cryptoIntentColumns+` FROM crypto_intents
+		WHERE ? = '' OR status = ?
+		ORDER BY created_at DESC, rowid DESC LIMIT ? OFFSET ?
+	`, status, status, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var intents []*billing.CryptoIntent
+	for rows.Next() {
+		i, err := scanCryptoIntent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		intents = append(intents, i)
+	}
+	return intents, total, rows.Err()
+}
+
+// --- Exchange rates ---
+
+// LoadExchangeRates returns the last exchange rates saved
+func (s *Store) LoadExchangeRates() (map[billing.CurrencyCode]float64, time.Time, error) {
+	rows, err := s.db.Query("SELECT currency, rate, fetched_at FROM exchange_rates")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	rates := make(map[billing.CurrencyCode]float64)
+	var fetchedAt time.Time
+	for rows.Next() {
+		var currency, fetched string
+		var rate float64
+		if err := rows.Scan(&currency, &rate, &fetched); err != nil {
+			return nil, time.Time{}, err
+		}
+		rates[billing.CurrencyCode(currency)] = rate
+		if t := parseQueueTime(fetched); t != nil && (fetchedAt.IsZero() || t.Before(fetchedAt)) {
+			fetchedAt = *t // the oldest rate dates the set
+		}
+	}
+	return rates, fetchedAt, rows.Err()
+}
+
+// SaveExchangeRates stores the rates fetched, keeping those of currencies
+// the fetch didn't include
+func (s *Store) SaveExchangeRates(rates map[billing.CurrencyCode]float64, fetchedAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for currency, rate := range rates {
+		if _, err := tx.Exec(`
+			INSERT INTO exchange_rates (currency, rate, fetched_at) VALUES (?, ?, ?)
+			ON CONFLICT(currency) DO UPDATE SET rate = excluded.rate, fetched_at = excluded.fetched_at
+		`, string(currency), rate, queueTime(fetchedAt)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SavePriceQuote records the price a payment was charged at
+func (s *Store) SavePriceQuote(q *billing.PriceQuote) error {
+	_, err := s.db.Exec(`
+		INSERT INTO price_quotes (reference, currency, rate, amount_usd, amount, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(reference) DO UPDATE SET currency = excluded.currency, rate = excluded.rate,
+			amount_usd = excluded.amount_usd, amount = excluded.amount, created_at = excluded.created_at
+	`, q.Reference, string(q.Currency), q.Rate, q.AmountUSD, q.Amount, queueTime(q.CreatedAt))
+	return err
+}
+
+// GetPriceQuote returns the price locked for a payment, or nil if none was
+func (s *Store) GetPriceQuote(reference string) (*billing.PriceQuote, error) {
+	var q billing.PriceQuote
+	var currency, created string
+	err := s.db.QueryRow(`
+		SELECT reference, currency, rate, amount_usd, amount, created_at FROM price_quotes WHERE reference = ?
+	`, reference).Scan(&q.Reference, &currency, &q.Rate, &q.AmountUSD, &q.Amount, &created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.Currency = billing.CurrencyCode(currency)
+	if t := parseQueueTime(created); t != nil {
+		q.CreatedAt = *t
+	}
+	return &q, nil
+}
+
+// --- Invoices ---
+
+// GetBillingProfile returns who a user's invoices are made out to, or nil if
+// they haven't said
+func (s *Store) GetBillingProfile(userID string) (*billing.BillingProfile, error) {
+	p := billing.BillingProfile{UserID: userID}
+	var updated string
+	err := s.db.QueryRow(`
+		SELECT name, company, tax_id, address, city, postal_code, country, updated_at
+		FROM billing_profiles WHERE user_id = ?
+	`, userID).Scan(&p.Name, &p.Company, &p.TaxID, &p.Address, &p.City, &p.PostalCode, &p.Country, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(updated); t != nil {
+		p.UpdatedAt = *t
+	}
+	return &p, nil
+}
+
+func (s *Store) SaveBillingProfile(p *billing.BillingProfile) error {
+	_, err := s.db.Exec(`
+		INSERT INTO billing_profiles (user_id, name, company, tax_id, address, city, postal_code, country, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET name = excluded.name, company = excluded.company,
+			tax_id = excluded.tax_id, address = excluded.address, city = excluded.city,
+			postal_code = excluded.postal_code, country = excluded.country, updated_at = excluded.updated_at
+	`, p.UserID, p.Name, p.Company, p.TaxID, p.Address, p.City, p.PostalCode, p.Country, queueTime(p.UpdatedAt))
+	return err
+}
+
+const invoiceColumns = `id, number, COALESCE(user_id, ''), transaction_id, email, customer, currency, lines, subtotal,
+	tax_name, tax_rate, tax_amount, reverse_charge, total, COALESCE(period_start, ''), COALESCE(period_end, ''),
+	issued_at, COALESCE(emailed_at, '')`
+
+func scanInvoice(row interface{ Scan(...any) error }) (*billing.Invoice, error) {
+	var inv billing.Invoice
+	var customer, currency, lines, periodStart, periodEnd, issued, emailed string
+	err := row.Scan(&inv.ID, &inv.Number, &inv.UserID, &inv.TransactionID, &inv.Email, &customer, &currency, &lines,
+		&inv.Subtotal, &inv.TaxName, &inv.TaxRate, &inv.TaxAmount, &inv.ReverseCharge, &inv.Total,
+		&periodStart, &periodEnd, &issued, &emailed)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(customer), &inv.Customer)
+	json.Unmarshal([]byte(lines), &inv.Lines)
+	inv.Customer.UserID = inv.UserID
+	inv.Currency = billing.CurrencyCode(currency)
+	inv.PeriodStart = parseQueueTime(periodStart)
+	inv.PeriodEnd = parseQueueTime(periodEnd)
+	if t := parseQueueTime(issued); t != nil {
+		inv.IssuedAt = *t
+	}
+	inv.EmailedAt = parseQueueTime(emailed)
+	return &inv, nil
+}
+
+// CreateInvoice numbers and stores an invoice in one transaction, so a
+// failed insert gives its number back
+func (s *Store) CreateInvoice(inv *billing.Invoice) error {
+	customer, _ := json.Marshal(inv.Customer)
+	lines, _ := json.Marshal(inv.Lines)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	year := inv.IssuedAt.UTC().Year()
+	var seq int
+	if err := tx.QueryRow(`
+		INSERT INTO invoice_sequences (year, last_number) VALUES (?, 1)
+		ON CONFLICT(year) DO UPDATE SET last_number = last_number + 1
+		RETURNING last_number
+	`, year).Scan(&seq); err != nil {
+		return err
+	}
+	number := billing.InvoiceNumber(year, seq)
+
+	if _, err := tx.Exec(`
+		INSERT INTO invoices (id, number, user_id, transaction_id, email, customer, currency, lines, subtotal,
+			tax_name, tax_rate, tax_amount, reverse_charge, total, period_start, period_end, issued_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, inv.ID, number, inv.UserID, inv.TransactionID, inv.Email, string(customer), string(inv.Currency), string(lines),
+		inv.Subtotal, inv.TaxName, inv.TaxRate, inv.TaxAmount, inv.ReverseCharge, inv.Total,
+		queueTimePtr(inv.PeriodStart), queueTimePtr(inv.PeriodEnd), queueTime(inv.IssuedAt)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	inv.Number = number
+	return nil
+}
+
+// GetInvoice returns an invoice by its ID or number
+func (s *Store) GetInvoice(id string) (*billing.Invoice, error) {
+	inv, err := scanInvoice(s.db.QueryRow("SELECT "+invoiceColumns+" FROM invoices WHERE id = ? OR number = ?", id, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invoice %s not found", id)
+	}
+	return inv, err
+}
+
+func (s *Store) GetInvoiceByTransaction(transactionID string) (*billing.Invoice, error) {
+	inv, err := scanInvoice(s.db.QueryRow("SELECT "+invoiceColumns+" FROM invoices WHERE transaction_id = ?", transactionID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+// ListInvoices returns a page of a user's invoices, newest first, and how
+// many they have
+func (s *Store) ListInvoices(userID string, limit, offset int) ([]*billing.Invoice, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM invoices WHERE user_id = ?", userID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+invoiceColumns+` FROM invoices WHERE user_id = ?
+		ORDER BY issued_at DESC, number DESC LIMIT ? OFFSET ?
+	`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var invoices []*billing.Invoice
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, total, rows.Err()
+}
+
+func (s *Store) MarkInvoiceEmailed(id string, at time.Time) error {
+	_, err := s.db.Exec("UPDATE invoices SET emailed_at = ? WHERE id = ?", queueTime(at), id)
+	return err
+}
+
+func (s *Store) SaveInvoicePDF(id string, pdf []byte) error {
+	_, err := s.db.Exec("UPDATE invoices SET pdf = ? WHERE id = ?", pdf, id)
+	return err
+}
+
+func (s *Store) GetInvoicePDF(id string) ([]byte, error) {
+	var pdf []byte
+	err := s.db.QueryRow("SELECT pdf FROM invoices WHERE id = ?", id).Scan(&pdf)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invoice %s not found", id)
+	}
+	return pdf, err
+}
+
+// --- Promotions ---
+
+const couponColumns = `code, type, value, plans, max_redemptions, redemptions, COALESCE(expires_at, ''),
+	first_period_only, active, created_at`
+
+func scanCoupon(row interface{ Scan(...any) error }) (*billing.Coupon, error) {
+	var c billing.Coupon
+	var plans, expires, created string
+	err := row.Scan(&c.Code, &c.Type, &c.Value, &plans, &c.MaxRedemptions, &c.Redemptions, &expires,
+		&c.FirstPeriodOnly, &c.Active, &created)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range strings.Split(plans, ",") {
+		if id != "" {
+			c.Plans = append(c.Plans, billing.PlanType(id))
+		}
+	}
+	c.ExpiresAt = parseQueueTime(expires)
+	if t := parseQueueTime(created); t != nil {
+		c.CreatedAt = *t
+	}
+	return &c, nil
+}
+
+func (s *Store) CreateCoupon(c *billing.Coupon) error {
+	plans := make([]string, len(c.Plans))
+	for i, id := range c.Plans {
+		plans[i] = string(id)
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO coupons (code, type, value, plans, max_redemptions, redemptions, expires_at, first_period_only, active, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, c.Code, c.Type, c.Value, strings.Join(plans, ","), c.MaxRedemptions, c.Redemptions, queueTimePtr(c.ExpiresAt),
+		c.FirstPeriodOnly, c.Active, queueTime(c.CreatedAt))
+	return err
+}
+
+// GetCoupon returns a coupon by its code, or nil
+func (s *Store) GetCoupon(code string) (*billing.Coupon, error) {
+	c, err := scanCoupon(s.db.QueryRow("SELECT "+couponColumns+" FROM coupons WHERE code = ?", code))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// ListCoupons returns a page of coupons, newest first
+func (s *Store) ListCoupons(limit, offset int) ([]*billing.Coupon, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM coupons").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+couponColumns+" FROM coupons ORDER BY created_at DESC, code LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var coupons []*billing.Coupon
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		coupons = append(coupons, c)
+	}
+	return coupons, total, rows.Err()
+}
+
+func (s *Store) SetCouponActive(code string, active bool) error {
+	_, err := s.db.Exec("UPDATE coupons SET active = ? WHERE code = ?", active, code)
+	return err
 }
 
-func (s *Store) CreateTransaction(tx *Transaction) error {
+const redemptionColumns = `reference, code, COALESCE(user_id, ''), plan_id, discount_usd, renewal, status,
+	created_at, COALESCE(redeemed_at, '')`
+
+func scanRedemption(row interface{ Scan(...any) error }) (*billing.CouponRedemption, error) {
+	var r billing.CouponRedemption
+	var created, redeemed string
+	err := row.Scan(&r.Reference, &r.Code, &r.UserID, &r.PlanID, &r.DiscountUSD, &r.Renewal, &r.Status,
+		&created, &redeemed)
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(created); t != nil {
+		r.CreatedAt = *t
+	}
+	r.RedeemedAt = parseQueueTime(redeemed)
+	return &r, nil
+}
+
+// CreateRedemption records a discounted payment. A reference that was
+// already recorded is left as it is.
+func (s *Store) CreateRedemption(r *billing.CouponRedemption) error {
+	_, err := s.db.Exec(`
+		INSERT INTO coupon_redemptions (reference, code, user_id, plan_id, discount_usd, renewal, status, created_at, redeemed_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, NULLIF(?, ''))
+		ON CONFLICT(reference) DO NOTHING
+	`, r.Reference, r.Code, r.UserID, r.PlanID, r.DiscountUSD, r.Renewal, r.Status,
+		queueTime(r.CreatedAt), queueTimePtr(r.RedeemedAt))
+	return err
+}
+
+// GetRedemption returns the redemption of a payment, or nil
+func (s *Store) GetRedemption(reference string) (*billing.CouponRedemption, error) {
+	r, err := scanRedemption(s.db.QueryRow("SELECT "+redemptionColumns+" FROM coupon_redemptions WHERE reference = ?", reference))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// ReserveCoupon records the pending redemption of a checkout and holds one
+// of its coupon's redemptions. It fails with billing.ErrCouponUnavailable if
+// the coupon is fully redeemed or the user already paid with it or holds it.
+func (s *Store) ReserveCoupon(r *billing.CouponRedemption) error {
+	return reserveCoupon(s.db, DialectSQLite, r)
+}
+
+// RedeemCoupon marks a pending or released redemption paid. A released one
+// is counted against its coupon again, as its payment went through anyway.
+// It reports false otherwise, so a payment is only counted once.
+func (s *Store) RedeemCoupon(reference string, at time.Time) (bool, error) {
+	return redeemCoupon(s.db, DialectSQLite, reference, queueTime(at))
+}
+
+// ReleaseCoupon gives back the hold of a pending redemption
+func (s *Store) ReleaseCoupon(reference string) (bool, error) {
+	n, err := releaseCoupons(s.db, DialectSQLite, "reference = ?", reference)
+	return n > 0, err
+}
+
+// ReleaseCoupons gives back the holds of redemptions pending since before a
+// time
+func (s *Store) ReleaseCoupons(before time.Time) (int, error) {
+	return releaseCoupons(s.db, DialectSQLite, "created_at < ?", queueTime(before))
+}
+
+// HasRedeemed reports whether a user paid with a coupon or holds it
+func (s *Store) HasRedeemed(code, userID string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM coupon_redemptions
+		WHERE user_id = ? AND code = ? AND status IN (?, ?) AND renewal = FALSE
+	`, userID, code, billing.RedemptionRedeemed, billing.RedemptionPending).Scan(&n)
+	return n > 0, err
+}
+
+// ListRedemptions returns a page of the payments a coupon was redeemed on,
+// newest first. Checkouts that were never paid are left out.
+func (s *Store) ListRedemptions(code string, limit, offset int) ([]*billing.CouponRedemption, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM coupon_redemptions WHERE code = ? AND status = ?",
+		code, billing.RedemptionRedeemed).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+redemptionColumns+` FROM coupon_redemptions WHERE code = ? AND status = ?
+		ORDER BY created_at DESC, reference LIMIT ? OFFSET ?
+	`, code, billing.RedemptionRedeemed, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var redemptions []*billing.CouponRedemption
+	for rows.Next() {
+		r, err := scanRedemption(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, total, rows.Err()
+}
+
+// SetSubscriptionCoupon puts a recurring coupon on a subscription
+func (s *Store) SetSubscriptionCoupon(subscriptionID, code string) error {
+	_, err := s.db.Exec("UPDATE subscriptions SET coupon = ? WHERE id = ?", code, subscriptionID)
+	return err
+}
+
+// GetReferralCode returns the referral code of a user, or an empty string
+func (s *Store) GetReferralCode(userID string) (string, error) {
+	var code string
+	err := s.db.QueryRow("SELECT code FROM referral_codes WHERE user_id = ?", userID).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return code, err
+}
+
+func (s *Store) CreateReferralCode(userID, code string) error {
+	_, err := s.db.Exec("INSERT INTO referral_codes (user_id, code) VALUES (?, ?)", userID, code)
+	return err
+}
+
+// GetReferrer returns the user a referral code belongs to, or an empty string
+func (s *Store) GetReferrer(code string) (string, error) {
+	var userID string
+	err := s.db.QueryRow("SELECT user_id FROM referral_codes WHERE code = ?", code).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return userID, err
+}
+
+const referralColumns = `referee_id, referrer_id, code, status, reference, reward_usd, created_at,
+	COALESCE(rewarded_at, '')`
+
+func scanReferral(row interface{ Scan(...any) error }) (*billing.Referral, error) {
+	var r billing.Referral
+	var created, rewarded string
+	err := row.Scan(&r.RefereeID, &r.ReferrerID, &r.Code, &r.Status, &r.Reference, &r.RewardUSD, &created, &rewarded)
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(created); t != nil {
+		r.CreatedAt = *t
+	}
+	r.RewardedAt = parseQueueTime(rewarded)
+	return &r, nil
+}
+
+// CreateReferral records who referred a new user. A user is only ever
+// referred once.
+func (s *Store) CreateReferral(r *billing.Referral) error {
+	_, err := s.db.Exec(`
+		INSERT INTO referrals (referee_id, referrer_id, code, status, created_at)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT(referee_id) DO NOTHING
+	`, r.RefereeID, r.ReferrerID, r.Code, r.Status, queueTime(r.CreatedAt))
+	return err
+}
+
+// GetReferral returns who referred a user, or nil
+func (s *Store) GetReferral(refereeID string) (*billing.Referral, error) {
+	r, err := scanReferral(s.db.QueryRow("SELECT "+referralColumns+" FROM referrals WHERE referee_id = ?", refereeID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// RewardReferral marks a pending referral rewarded by the referee's payment
+func (s *Store) RewardReferral(refereeID, reference string, rewardUSD float64, at time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE referrals SET status = ?, reference = ?, reward_usd = ?, rewarded_at = ?
+		WHERE referee_id = ? AND status = ?
+	`, billing.ReferralRewarded, reference, rewardUSD, queueTime(at), refereeID, billing.ReferralPending)
+	return err
+}
+
+// ListReferrals returns a page of the referrals of a referrer, or of every
+// referrer if referrerID is empty, newest first
+func (s *Store) ListReferrals(referrerID string, limit, offset int) ([]*billing.Referral, int, error) {
+	where, args := "", []any{}
+	if referrerID != "" {
+		where, args = "WHERE referrer_id = ?", append(args, referrerID)
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM referrals "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+referralColumns+" FROM referrals "+where+
+		" ORDER BY created_at DESC, referee_id LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var referrals []*billing.Referral
+	for rows.Next() {
+		r, err := scanReferral(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		referrals = append(referrals, r)
+	}
+	return referrals, total, rows.Err()
+}
+
+// CountReferrals returns how many users a referrer referred, how many of
+// them were rewarded and the credits the referrer earned
+func (s *Store) CountReferrals(referrerID string) (int, int, float64, error) {
+	var referred, rewarded int
+	var earned float64
+	err := s.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0), COALESCE(SUM(reward_usd), 0)
+		FROM referrals WHERE referrer_id = ?
+	`, billing.ReferralRewarded, referrerID).Scan(&referred, &rewarded, &earned)
+	return referred, rewarded, earned, err
+}
+
+// --- Organizations ---
+
+// CreateOrg creates an organization with its owner as the first member
+func (s *Store) CreateOrg(org *billing.Organization, owner *billing.Member) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO organizations (id, name, owner_id, created_at) VALUES (?, ?, ?, ?)",
+		org.ID, org.Name, org.OwnerID, queueTime(org.CreatedAt)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO org_members (user_id, org_id, role, data_limit_mb, max_connections, joined_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, owner.UserID, owner.OrgID, owner.Role, owner.DataLimitMB, owner.MaxConnections, queueTime(owner.JoinedAt)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetOrg returns an organization, or nil
+func (s *Store) GetOrg(id string) (*billing.Organization, error) {
+	var org billing.Organization
+	var created string
+	err := s.db.QueryRow("SELECT id, name, owner_id, created_at FROM organizations WHERE id = ?", id).
+		Scan(&org.ID, &org.Name, &org.OwnerID, &created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(created); t != nil {
+		org.CreatedAt = *t
+	}
+	return &org, nil
+}
+
+const memberColumns = `m.org_id, m.user_id, u.email, m.role, m.data_limit_mb, m.max_connections, m.joined_at`
+
+func scanMember(row interface{ Scan(...any) error }) (*billing.Member, error) {
+	var m billing.Member
+	var joined string
+	if err := row.Scan(&m.OrgID, &m.UserID, &m.Email, &m.Role, &m.DataLimitMB, &m.MaxConnections, &joined); err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(joined); t != nil {
+		m.JoinedAt = *t
+	}
+	return &m, nil
+}
+
+// GetMembership returns the organization membership of a user, or nil
+func (s *Store) GetMembership(userID string) (*billing.Member, error) {
+	m, err := scanMember(s.db.QueryRow("SELECT "+memberColumns+
+		" FROM org_members m JOIN users u ON u.id = m.user_id WHERE m.user_id = ?", userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// ListMembers returns the members of an organization in the order they
+// joined
+func (s *Store) ListMembers(orgID string) ([]*billing.Member, error) {
+	rows, err := s.db.Query("SELECT "+memberColumns+
+		" FROM org_members m JOIN users u ON u.id = m.user_id WHERE m.org_id = ? ORDER BY m.joined_at, u.email", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*billing.Member
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *Store) AddMember(m *billing.Member) error {
+	_, err := s.db.Exec(`
+		INSERT INTO org_members (user_id, org_id, role, data_limit_mb, max_connections, joined_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, m.UserID, m.OrgID, m.Role, m.DataLimitMB, m.MaxConnections, queueTime(m.JoinedAt))
+	return err
+}
+
+func (s *Store) UpdateMember(m *billing.Member) error {
+	_, err := s.db.Exec(`
+		UPDATE org_members SET role = ?, data_limit_mb = ?, max_connections = ?
+		WHERE org_id = ? AND user_id = ?
+	`, m.Role, m.DataLimitMB, m.MaxConnections, m.OrgID, m.UserID)
+	return err
+}
+
+func (s *Store) RemoveMember(orgID, userID string) error {
+	_, err := s.db.Exec("DELETE FROM org_members WHERE org_id = ? AND user_id = ?", orgID, userID)
+	return err
+}
+
+const invitationColumns = `id, org_id, email, role, invited_by, token_hash, expires_at, COALESCE(accepted_at, ''), created_at`
+
+func scanInvitation(row interface{ Scan(...any) error }) (*billing.Invitation, error) {
+	var inv billing.Invitation
+	var expires, accepted, created string
+	err := row.Scan(&inv.ID, &inv.OrgID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.TokenHash,
+		&expires, &accepted, &created)
+	if err != nil {
+		return nil, err
+	}
+	if t := parseQueueTime(expires); t != nil {
+		inv.ExpiresAt = *t
+	}
+	inv.AcceptedAt = parseQueueTime(accepted)
+	if t := parseQueueTime(created); t != nil {
+		inv.CreatedAt = *t
+	}
+	return &inv, nil
+}
+
+func (s *Store) CreateInvitation(inv *billing.Invitation) error {
 	_, err := s.db.Exec(`
-		INSERT INTO payment_transactions (id, user_id, plan_id, amount, currency, status, payment_method, created_at)
+		INSERT INTO org_invitations (id, org_id, email, role, invited_by, token_hash, expires_at, created_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, tx.ID, tx.UserID, tx.PlanID, tx.Amount, tx.Currency, tx.Status, tx.PaymentMethod, tx.CreatedAt.Format(time.RFC3339))
+	`, inv.ID, inv.OrgID, inv.Email, inv.Role, inv.InvitedBy, inv.TokenHash,
+		queueTime(inv.ExpiresAt), queueTime(inv.CreatedAt))
 	return err
 }
 
-func (s *Store) GetTransaction(id string) (*Transaction, error) {
-	var tx Transaction
-	var createdAt string
+// GetInvitationByToken returns the invitation with a token hash, or nil
+func (s *Store) GetInvitationByToken(tokenHash string) (*billing.Invitation, error) {
+	inv, err := scanInvitation(s.db.QueryRow("SELECT "+invitationColumns+
+		" FROM org_invitations WHERE token_hash = ?", tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+// ListInvitations returns the invitations of an organization that were
+// neither accepted nor have expired, newest first
+func (s *Store) ListInvitations(orgID string) ([]*billing.Invitation, error) {
+	rows, err := s.db.Query("SELECT "+invitationColumns+` FROM org_invitations
+		WHERE org_id = ? AND accepted_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC`, orgID, queueTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []*billing.Invitation
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// AcceptInvitation marks a pending invitation accepted and reports whether
+// it was still pending
+func (s *Store) AcceptInvitation(id string, at time.Time) (bool, error) {
+	res, err := s.db.Exec("UPDATE org_invitations SET accepted_at = ? WHERE id = ? AND accepted_at IS NULL",
+		queueTime(at), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Store) DeleteInvitation(orgID, id string) error {
+	_, err := s.db.Exec("DELETE FROM org_invitations WHERE org_id = ? AND id = ? AND accepted_at IS NULL", orgID, id)
+	return err
+}
+
+// AddMemberUsage adds to what a member used of a period
+func (s *Store) AddMemberUsage(orgID, userID string, periodStart time.Time, bytes int64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO org_member_usage (org_id, user_id, period_start, data_transferred) VALUES (?, ?, ?, ?)
+		ON CONFLICT(org_id, user_id, period_start) DO UPDATE SET data_transferred = data_transferred + excluded.data_transferred
+	`, orgID, userID, queueTime(periodStart), bytes)
+	return err
+}
 
+// GetMemberUsage returns what a member used of a period
+func (s *Store) GetMemberUsage(orgID, userID string, periodStart time.Time) (int64, error) {
+	var bytes int64
 	err := s.db.QueryRow(`
-		SELECT id, user_id, plan_id, amount, currency, status, payment_method, created_at
-		FROM payment_transactions
-		WHERE id = ?
-	`, id).Scan(&tx.ID, &tx.UserID, &tx.PlanID, &tx.Amount, &tx.Currency, &tx.Status, &tx.PaymentMethod, &createdAt)
+		SELECT COALESCE(SUM(data_transferred), 0) FROM org_member_usage
+		WHERE org_id = ? AND user_id = ? AND period_start = ?
+	`, orgID, userID, queueTime(periodStart)).Scan(&bytes)
+	return bytes, err
+}
+
+// --- Sub-users ---
+
+const subUserColumns = `id, parent_id, label, username, password_hash, data_limit_mb, request_limit,
+	max_connections, countries, active, created_at`
+
+func scanSubUser(row interface{ Scan(...any) error }) (*billing.SubUser, error) {
+	var u billing.SubUser
+	var countries, created string
+	err := row.Scan(&u.ID, &u.ParentID, &u.Label, &u.Username, &u.PasswordHash, &u.DataLimitMB, &u.RequestLimit,
+		&u.MaxConnections, &countries, &u.Active, &created)
+	if err != nil {
+		return nil, err
+	}
+	u.Countries = []string{}
+	for _, c := range strings.Split(countries, ",") {
+		if c != "" {
+			u.Countries = append(u.Countries, c)
+		}
+	}
+	if t := parseQueueTime(created); t != nil {
+		u.CreatedAt = *t
+	}
+	return &u, nil
+}
+
+func (s *Store) CreateSubUser(u *billing.SubUser) error {
+	_, err := s.db.Exec(`
+		INSERT INTO subusers (id, parent_id, label, username, password_hash, data_limit_mb, request_limit,
+			max_connections, countries, active, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, u.ID, u.ParentID, u.Label, u.Username, u.PasswordHash, u.DataLimitMB, u.RequestLimit,
+		u.MaxConnections, strings.Join(u.Countries, ","), u.Active, queueTime(u.CreatedAt))
+	return err
+}
+
+// GetSubUser returns a sub-user, or nil
+func (s *Store) GetSubUser(id string) (*billing.SubUser, error) {
+	u, err := scanSubUser(s.db.QueryRow("SELECT "+subUserColumns+" FROM subusers WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// GetSubUserByUsername returns the sub-user with a proxy username, or nil
+func (s *Store) GetSubUserByUsername(username string) (*billing.SubUser, error) {
+	u, err := scanSubUser(s.db.QueryRow("SELECT "+subUserColumns+" FROM subusers WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
 
+// ListSubUsers returns the sub-users of a parent, oldest first
+func (s *Store) ListSubUsers(parentID string) ([]*billing.SubUser, error) {
+	rows, err := s.db.Query("SELECT "+subUserColumns+" FROM subusers WHERE parent_id = ? ORDER BY created_at, id", parentID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	tx.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
-	return &tx, nil
+	var users []*billing.SubUser
+	for rows.Next() {
+		u, err := scanSubUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *Store) UpdateSubUser(u *billing.SubUser) error {
+	_, err := s.db.Exec(`
+		UPDATE subusers SET label = ?, password_hash = ?, data_limit_mb = ?, request_limit = ?,
+			max_connections = ?, countries = ?, active = ?
+		WHERE id = ? AND parent_id = ?
+	`, u.Label, u.PasswordHash, u.DataLimitMB, u.RequestLimit, u.MaxConnections,
+		strings.Join(u.Countries, ","), u.Active, u.ID, u.ParentID)
+	return err
+}
+
+// DeleteSubUser removes a sub-user and their usage
+func (s *Store) DeleteSubUser(parentID, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM subusers WHERE id = ? AND parent_id = ?", id, parentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM subuser_usage WHERE subuser_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddSubUserUsage adds to what a sub-user used of a period
+func (s *Store) AddSubUserUsage(id string, periodStart time.Time, bytes, requests int64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO subuser_usage (subuser_id, period_start, data_transferred, requests_made) VALUES (?, ?, ?, ?)
+		ON CONFLICT(subuser_id, period_start) DO UPDATE SET
+			data_transferred = data_transferred + excluded.data_transferred,
+			requests_made = requests_made + excluded.requests_made
+	`, id, queueTime(periodStart), bytes, requests)
+	return err
+}
+
+// GetSubUserUsage returns the bytes and requests a sub-user used of a period
+func (s *Store) GetSubUserUsage(id string, periodStart time.Time) (int64, int64, error) {
+	var bytes, requests int64
+	err := s.db.QueryRow(`
+		SELECT COALESCE(SUM(data_transferred), 0), COALESCE(SUM(requests_made), 0) FROM subuser_usage
+		WHERE subuser_id = ? AND period_start = ?
+	`, id, queueTime(periodStart)).Scan(&bytes, &requests)
+	return bytes, requests, err
+}
+
+// ListSubUserUsage returns the periods a sub-user used, newest first
+func (s *Store) ListSubUserUsage(id string, limit int) ([]billing.SubUserPeriod, error) {
+	rows, err := s.db.Query(`
+		SELECT period_start, data_transferred, requests_made FROM subuser_usage
+		WHERE subuser_id = ? ORDER BY period_start DESC LIMIT ?
+	`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var periods []billing.SubUserPeriod
+	for rows.Next() {
+		var p billing.SubUserPeriod
+		var start string
+		if err := rows.Scan(&start, &p.DataTransferred, &p.RequestsMade); err != nil {
+			return nil, err
+		}
+		if t := parseQueueTime(start); t != nil {
+			p.PeriodStart = *t
+		}
+		periods = append(periods, p)
+	}
+	return periods, rows.Err()
 }
@@ -1,10 +1,12 @@
 package storage
 
 import (
+	"errors"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/atlanticproxy/proxy-client/internal/billing"
 	"github.com/google/uuid"
 )
 
@@ -42,8 +44,8 @@ func TestNewStore(t *testing.T) {
 	}
 	rows.Close()
 
-	if count != 4 {
-		t.Errorf("Expected 4 default plans, got %d", count)
+	if count != len(billing.DefaultPlans()) {
+		t.Errorf("Expected %d default plans, got %d", len(billing.DefaultPlans()), count)
 	}
 }
 
@@ -139,7 +141,7 @@ func TestSubscriptionCRUD(t *testing.T) {
 	now := time.Now().UTC().Format(time.RFC3339)
 	end := time.Now().AddDate(0, 1, 0).UTC().Format(time.RFC3339)
 
-	err = store.SetSubscription("default", id, planID, "active", now, end, true)
+	err = store.SetSubscription("default", id, planID, 1, "active", now, end, true)
 	if err != nil {
 		t.Fatalf("Failed to set subscription: %v", err)
 	}
@@ -177,8 +179,12 @@ func TestUsageTracking(t *testing.T) {
 		t.Fatalf("Failed to create user: %v", err)
 	}
 
+	// Usage is kept per billing period
+	periodStart := time.Now().Add(-time.Hour).Truncate(time.Second)
+	periodEnd := periodStart.AddDate(0, 1, 0)
+
 	// Update usage
-	err = store.UpdateUsage(userID, 1000, 10, 5, 1)
+	err = store.UpdateUsage(userID, periodStart, periodEnd, 1000, 10, 5, 1)
 	if err != nil {
 		t.Fatalf("Failed to update usage: %v", err)
 	}
@@ -193,7 +199,7 @@ func TestUsageTracking(t *testing.T) {
 	}
 
 	// Accumulate usage
-	err = store.UpdateUsage(userID, 500, 5, 1, 0)
+	err = store.UpdateUsage(userID, periodStart, periodEnd, 500, 5, 1, 0)
 	if err != nil {
 		t.Fatalf("Failed to accumulate usage: %v", err)
 	}
@@ -206,8 +212,162 @@ func TestUsageTracking(t *testing.T) {
 	if data != 1500 || reqs != 15 || ads != 6 || threats != 1 {
 		t.Errorf("Accumulated usage mismatch: got %d, %d, %d, %d", data, reqs, ads, threats)
 	}
+
+	// The next period starts from zero
+	if err := store.UpdateUsage(userID, periodEnd, periodEnd.AddDate(0, 1, 0), 200, 2, 0, 0); err != nil {
+		t.Fatalf("Failed to update next period: %v", err)
+	}
+	if data, _, _, _, _ := store.GetPeriodUsage(userID, periodEnd); data != 200 {
+		t.Errorf("Expected 200 bytes in the next period, got %d", data)
+	}
+	if data, _, _, _, _ := store.GetPeriodUsage(userID, periodStart); data != 1500 {
+		t.Errorf("Expected 1500 bytes in the first period, got %d", data)
+	}
 }
 
+func TestSubscriptionLifecycleColumns(t *testing.T) {
+	store, err := NewStoreWithPath(filepath.Join(t.TempDir(), "test_lifecycle.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.CreateUser("u1", "u1@example.com", "hash"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	start := time.Now().UTC().Truncate(time.Second)
+	end := start.AddDate(0, 1, 0)
+	if err := store.SetSubscription("u1", "sub1", "personal", 1, "active", start.Format(time.RFC3339), end.Format(time.RFC3339), true); err != nil {
+		t.Fatalf("Failed to set subscription: %v", err)
+	}
+	if err := store.SetSubscriptionPaymentAuth("sub1", "AUTH_x", "GHS"); err != nil {
+		t.Fatalf("Failed to set payment auth: %v", err)
+	}
+
+	subs, err := store.ListRenewableSubscriptions()
+	if err != nil || len(subs) != 1 || subs[0].PaymentAuth != "AUTH_x" || subs[0].Currency != "GHS" || subs[0].UserID != "u1" {
+		t.Fatalf("Unexpected renewable subscriptions: %+v, %v", subs, err)
+	}
+
+	// Only one renewal attempt can hold the claim
+	now := time.Now()
+	if ok, err := store.ClaimRenewal("sub1", now, now.Add(time.Hour)); err != nil || !ok {
+		t.Fatalf("Expected first claim to succeed: %v", err)
+	}
+	if ok, _ := store.ClaimRenewal("sub1", now, now.Add(time.Hour)); ok {
+		t.Error("Expected second claim to fail while the first holds")
+	}
+	if ok, _ := store.ClaimRenewal("sub1", now.Add(2*time.Hour), now.Add(3*time.Hour)); !ok {
+		t.Error("Expected claim to succeed after it lapsed")
+	}
+
+	// A quota reset is recorded once per period
+	period := end.Format(time.RFC3339)
+	if ok, _ := store.MarkQuotaReset("sub1", period); !ok {
+		t.Error("Expected first reset to be recorded")
+	}
+	if ok, _ := store.MarkQuotaReset("sub1", period); ok {
+		t.Error("Expected repeated reset to be ignored")
+	}
+
+	subs[0].Status = "past_due"
+	subs[0].GraceUntil = end.Add(7 * 24 * time.Hour).Format(time.RFC3339)
+	subs[0].RetryCount = 1
+	if err := store.UpdateSubscriptionLifecycle(subs[0]); err != nil {
+		t.Fatalf("Failed to update lifecycle: %v", err)
+	}
+	sub, err := store.GetSubscription("u1")
+	if err != nil || sub.Status != "past_due" || sub.RetryCount != 1 || sub.GraceUntil == "" || sub.LastReset != period {
+		t.Errorf("Unexpected subscription after update: %+v, %v", sub, err)
+	}
+
+	// A pending renewal charge is settled once
+	sub.PendingRef = "RENEW-sub1"
+	if err := store.UpdateSubscriptionLifecycle(sub); err != nil {
+		t.Fatalf("Failed to update lifecycle: %v", err)
+	}
+	if pending, err := store.GetSubscriptionByPendingRenewal("RENEW-sub1"); err != nil || pending == nil || pending.ID != "sub1" {
+		t.Fatalf("Expected to find the pending renewal, got %+v, %v", pending, err)
+	}
+	if ok, _ := store.ClearPendingRenewal("sub1", "RENEW-sub1"); !ok {
+		t.Error("Expected the pending renewal to be settled")
+	}
+	if ok, _ := store.ClearPendingRenewal("sub1", "RENEW-sub1"); ok {
+		t.Error("Expected a settled renewal not to be settled again")
+	}
+	if pending, _ := store.GetSubscriptionByPendingRenewal(""); pending != nil {
+		t.Error("Expected no subscription for an empty reference")
+	}
+}
+
+func TestPlanCatalogue(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_plans.db")
+	store, err := NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	plans, err := store.ListPlans()
+	if err != nil || len(plans) != len(billing.DefaultPlans()) {
+		t.Fatalf("Expected the default plans to be seeded: %+v, %v", plans, err)
+	}
+	if plans[0].ID != billing.PlanStarter || plans[0].Version != 1 || !plans[0].Active || plans[0].Flags.RateLimit != 10 {
+		t.Errorf("Unexpected seeded plan: %+v", plans[0])
+	}
+
+	personal := billing.DefaultPlans()[2]
+	personal.Version, personal.Active, personal.PriceMonthly = 2, true, 39
+	if err := store.SavePlan(&personal); err != nil {
+		t.Fatalf("Failed to save plan: %v", err)
+	}
+	if err := store.SetPlanActive(billing.PlanTeam, false); err != nil {
+		t.Fatalf("Failed to retire plan: %v", err)
+	}
+	if err := store.SetPlanActive("missing", false); err != billing.ErrPlanNotFound {
+		t.Errorf("Expected ErrPlanNotFound, got %v", err)
+	}
+	store.Close()
+
+	// Reopening keeps the changes and seeds nothing twice
+	store, err = NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	catalogue, err := billing.LoadCatalogue(store)
+	if err != nil {
+		t.Fatalf("Failed to load catalogue: %v", err)
+	}
+	defer billing.LoadCatalogue(emptyPlanStore{})
+
+	versions, err := catalogue.Versions(billing.PlanPersonal)
+	if err != nil || len(versions) != 2 || versions[0].PriceMonthly != 29 || versions[1].PriceMonthly != 39 {
+		t.Errorf("Unexpected personal versions: %+v, %v", versions, err)
+	}
+	if team, _ := catalogue.Get(billing.PlanTeam); team.Active {
+		t.Error("Expected team to stay retired")
+	}
+
+	// Subscribers keep the version they are on
+	if err := store.CreateUser("u1", "u1@example.com", "hash"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := store.SetSubscription("u1", "sub1", "personal", 1, "active", now, now, true); err != nil {
+		t.Fatalf("Failed to set subscription: %v", err)
+	}
+	if sub, err := store.GetSubscription("u1"); err != nil || sub.PlanVersion != 1 {
+		t.Errorf("Expected plan version 1, got %+v, %v", sub, err)
+	}
+}
+
+// emptyPlanStore restores the built-in catalogue after a test
+type emptyPlanStore struct{}
+
+func (emptyPlanStore) ListPlans() ([]billing.Plan, error)         { return nil, nil }
+func (emptyPlanStore) SavePlan(*billing.Plan) error               { return nil }
+func (emptyPlanStore) SetPlanActive(billing.PlanType, bool) error { return nil }
+
 func TestUserAndSession(t *testing.T) {
 	tmpDir := t.TempDir()
 	dbPath := filepath.Join(tmpDir, "test_auth.db")
@@ -293,3 +453,277 @@ func TestUserAndSession(t *testing.T) {
 		t.Errorf("Expected session to be nil after deletion, got %v", sess)
 	}
 }
+
+func TestSessionDevicesAndRevocations(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test_sessions.db")
+
+	store, err := NewStoreWithPath(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	userID := uuid.New().String()
+	if err := store.CreateUser(userID, "devices@example.com", "hash"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	expires := time.Now().Add(time.Hour).UTC()
+	if err := store.CreateSession("sess-1", userID, "hash-1", expires); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := store.TouchSession("sess-1", "curl/8.0", "10.0.0.1"); err != nil {
+		t.Fatalf("Failed to touch session: %v", err)
+	}
+
+	// Rotate the refresh token hash
+	if ok, err := store.RotateSessionToken("sess-1", "hash-1", "hash-2", expires.Add(time.Hour)); err != nil || !ok {
+		t.Fatalf("Failed to rotate session token: %v", err)
+	}
+	if _, err := store.GetSession("hash-1"); err == nil {
+		t.Error("Expected old token hash to be gone after rotation")
+	}
+
+	// A second rotation from the same token loses the race
+	if ok, err := store.RotateSessionToken("sess-1", "hash-1", "hash-3", expires.Add(time.Hour)); err != nil || ok {
+		t.Errorf("Expected rotation from a replaced token to fail, got %v, %v", ok, err)
+	}
+	if id, _ := store.GetRotatedTokenSession("hash-1"); id != "sess-1" {
+		t.Errorf("Expected replaced token to map to sess-1, got %q", id)
+	}
+
+	sessions, err := store.ListUserSessions(userID)
+	if err != nil {
+		t.Fatalf("Failed to list sessions: %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].Token != "hash-2" || sessions[0].UserAgent != "curl/8.0" || sessions[0].IPAddress != "10.0.0.1" {
+		t.Errorf("Unexpected session: %+v", sessions[0])
+	}
+
+	// Revocations
+	if err := store.RevokeSession("sess-1", userID, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Failed to revoke session: %v", err)
+	}
+	if err := store.RevokeSession("sess-old", userID, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("Failed to revoke session: %v", err)
+	}
+	if err := store.PruneSessionRevocations(time.Now()); err != nil {
+		t.Fatalf("Failed to prune revocations: %v", err)
+	}
+
+	revoked, err := store.GetSessionRevocations()
+	if err != nil {
+		t.Fatalf("Failed to get revocations: %v", err)
+	}
+	if _, ok := revoked["sess-1"]; !ok || len(revoked) != 1 {
+		t.Errorf("Expected only sess-1 to remain revoked, got %v", revoked)
+	}
+	if until, err := store.GetSessionRevocation("sess-1"); err != nil || until == nil {
+		t.Errorf("Expected sess-1 revocation, got %v, %v", until, err)
+	}
+	if until, _ := store.GetSessionRevocation("sess-2"); until != nil {
+		t.Errorf("Expected no revocation for sess-2, got %v", until)
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	store, err := NewStoreWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	// reserve reserves an attempt against the counter as currently stored
+	reserve := func(now time.Time) (*LoginFailure, bool) {
+		t.Helper()
+		prev, err := store.GetLoginFailure("ip:10.0.0.1")
+		if err != nil {
+			t.Fatalf("GetLoginFailure failed: %v", err)
+		}
+		f, ok, err := store.ReserveLoginAttempt("ip:10.0.0.1", prev, now, time.Hour)
+		if err != nil {
+			t.Fatalf("ReserveLoginAttempt failed: %v", err)
+		}
+		return f, ok
+	}
+
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		if f, ok := reserve(now); !ok || f.Failures != i {
+			t.Errorf("Expected %d failures, got %+v", i, f)
+		}
+	}
+
+	// A reservation against an outdated counter is refused
+	if _, ok, _ := store.ReserveLoginAttempt("ip:10.0.0.1", nil, now, time.Hour); ok {
+		t.Error("Expected reservation against a stale counter to fail")
+	}
+
+	if err := store.ReleaseLoginAttempt("ip:10.0.0.1"); err != nil {
+		t.Fatalf("ReleaseLoginAttempt failed: %v", err)
+	}
+	if f, _ := store.GetLoginFailure("ip:10.0.0.1"); f == nil || f.Failures != 2 {
+		t.Errorf("Expected 2 failures after a release, got %+v", f)
+	}
+
+	// A failure after a quiet period longer than the window starts over
+	if f, ok := reserve(now.Add(2 * time.Hour)); !ok || f.Failures != 1 {
+		t.Errorf("Expected counter to restart, got %+v", f)
+	}
+
+	if err := store.ClearLoginFailures("ip:10.0.0.1"); err != nil {
+		t.Fatalf("ClearLoginFailures failed: %v", err)
+	}
+	if f, err := store.GetLoginFailure("ip:10.0.0.1"); err != nil || f != nil {
+		t.Errorf("Expected counter to be cleared, got %+v (err %v)", f, err)
+	}
+}
+
+func TestRefunds(t *testing.T) {
+	store, err := NewStoreWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.CreateUser("user-1", "refunds@example.com", "hash"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	payment := &Transaction{
+		ID: "TRIAL-1", UserID: "user-1", PlanID: "personal", Amount: 79.90, Currency: "USD",
+		Status: "completed", PaymentMethod: "paystack", GatewayRef: "1001", CreatedAt: now,
+		DepositAmount: 10, DepositStatus: billing.DepositHeld,
+	}
+	if err := store.CreateTransaction(payment); err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	deposit, err := store.GetDepositTransaction("user-1")
+	if err != nil || deposit == nil || deposit.ID != "TRIAL-1" || deposit.Kind != TransactionPayment {
+		t.Fatalf("Expected the trial payment as deposit, got %+v, %v", deposit, err)
+	}
+	if none, err := store.GetDepositTransaction("nobody"); none != nil || err != nil {
+		t.Errorf("Expected no deposit, got %+v, %v", none, err)
+	}
+
+	refund := func(id, kind string, amount float64) error {
+		return store.RecordRefund(&Transaction{
+			ID: id, UserID: "user-1", PlanID: "personal", Amount: amount, Currency: "USD",
+			Status: "pending", PaymentMethod: "paystack", CreatedAt: now, Kind: kind, RefundOf: "TRIAL-1",
+		})
+	}
+
+	if ok, _ := store.SetDepositStatus("TRIAL-1", billing.DepositRefundScheduled, billing.DepositHeld); !ok {
+		t.Fatal("Expected the deposit to be scheduled for refund")
+	}
+	if err := refund("REFUND-1", TransactionDepositRefund, 10); err != nil {
+		t.Fatalf("RecordRefund failed: %v", err)
+	}
+	if err := refund("REFUND-2", TransactionDepositRefund, 10); !errors.Is(err, billing.ErrDepositNotHeld) {
+		t.Errorf("Expected ErrDepositNotHeld for a second deposit refund, got %v", err)
+	}
+	got, _ := store.GetTransaction("TRIAL-1")
+	if got.DepositStatus != billing.DepositRefunded || got.RefundedAmount != 10 {
+		t.Errorf("Expected a refunded deposit, got %+v", got)
+	}
+
+	// A failed refund gives its amount back and holds the deposit again
+	if err := store.UpdateRefund("REFUND-1", "pending", "9001"); err != nil {
+		t.Fatalf("UpdateRefund failed: %v", err)
+	}
+	byRef, err := store.GetRefundByGatewayRef("paystack", "9001")
+	if err != nil || byRef.ID != "REFUND-1" {
+		t.Fatalf("Expected to find the refund by its gateway ID, got %+v, %v", byRef, err)
+	}
+	if err := store.FailRefund("REFUND-1"); err != nil {
+		t.Fatalf("FailRefund failed: %v", err)
+	}
+	got, _ = store.GetTransaction("TRIAL-1")
+	if got.DepositStatus != billing.DepositHeld || got.RefundedAmount != 0 {
+		t.Errorf("Expected the deposit held again, got %+v", got)
+	}
+
+	if err := refund("REFUND-3", TransactionRefund, 79.90); err != nil {
+		t.Fatalf("RecordRefund failed: %v", err)
+	}
+	if err := refund("REFUND-4", TransactionRefund, 0.01); !errors.Is(err, billing.ErrRefundTooLarge) {
+		t.Errorf("Expected ErrRefundTooLarge once the payment is refunded, got %v", err)
+	}
+
+	if forfeited, _ := store.SetDepositStatus("TRIAL-1", billing.DepositForfeited, billing.DepositHeld, billing.DepositRefundScheduled); !forfeited {
+		t.Error("Expected a held deposit to be forfeited")
+	}
+	if again, _ := store.SetDepositStatus("TRIAL-1", billing.DepositRefundScheduled, billing.DepositHeld); again {
+		t.Error("Expected a forfeited deposit to stay forfeited")
+	}
+
+	refunds, total, err := store.ListRefunds("user-1", 10, 0)
+	if err != nil || total != 2 || len(refunds) != 2 {
+		t.Fatalf("Expected 2 refunds, got %d, %v", total, err)
+	}
+	if all, _, _ := store.ListRefunds("", 10, 0); len(all) != 2 {
+		t.Errorf("Expected 2 refunds of everyone, got %d", len(all))
+	}
+	for _, r := range refunds {
+		if r.RefundOf != "TRIAL-1" {
+			t.Errorf("Expected refunds of TRIAL-1, got %+v", r)
+		}
+	}
+}
+
+func TestStripeSubscriptionLink(t *testing.T) {
+	store, err := NewStoreWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.CreateUser("user-1", "stripe@example.com", "hash"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	start := time.Now().UTC().Truncate(time.Second)
+	end := start.AddDate(0, 1, 0)
+	if err := store.SetSubscription("user-1", "REF-1", "personal", 1, "active", start.Format(time.RFC3339), end.Format(time.RFC3339), true); err != nil {
+		t.Fatalf("SetSubscription failed: %v", err)
+	}
+
+	if sub, err := store.GetSubscriptionByStripeID("sub_1"); sub != nil || err != nil {
+		t.Errorf("Expected no linked subscription yet, got %+v, %v", sub, err)
+	}
+	if err := store.SetSubscriptionStripeID("REF-1", "sub_1"); err != nil {
+		t.Fatalf("SetSubscriptionStripeID failed: %v", err)
+	}
+	sub, err := store.GetSubscriptionByStripeID("sub_1")
+	if err != nil || sub == nil || sub.ID != "REF-1" || sub.StripeSubID != "sub_1" {
+		t.Fatalf("Expected the linked subscription, got %+v, %v", sub, err)
+	}
+	if none, _ := store.GetSubscriptionByStripeID(""); none != nil {
+		t.Error("Expected no subscription for an empty Stripe ID")
+	}
+
+	// Updating the subscription keeps the link
+	if err := store.SetSubscription("user-1", "REF-1", "personal", 1, "canceled", start.Format(time.RFC3339), end.Format(time.RFC3339), false); err != nil {
+		t.Fatalf("SetSubscription failed: %v", err)
+	}
+	if sub, _ := store.GetSubscription("user-1"); sub.StripeSubID != "sub_1" || sub.Status != "canceled" {
+		t.Errorf("Expected the link to survive an update, got %+v", sub)
+	}
+
+	if err := store.CreateTransaction(&Transaction{
+		ID: "REF-1", UserID: "user-1", PlanID: "personal", Amount: 29, Currency: "USD",
+		Status: "completed", PaymentMethod: "stripe", CreatedAt: time.Now(),
+	}); err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+	if err := store.SetTransactionGatewayRef("REF-1", "pi_1"); err != nil {
+		t.Fatalf("SetTransactionGatewayRef failed: %v", err)
+	}
+	if tx, err := store.GetTransaction("REF-1"); err != nil || tx.GatewayRef != "pi_1" {
+		t.Errorf("Expected the payment intent stored, got %+v, %v", tx, err)
+	}
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUserNotFound is returned when exporting or deleting an unknown user
+var ErrUserNotFound = errors.New("user not found")
+
+// UserExport is everything kept about a user, by table, for data access
+// requests. Secrets such as password and token hashes are left out.
+type UserExport struct {
+	UserID     string                      `json:"user_id"`
+	ExportedAt time.Time                   `json:"exported_at"`
+	Tables     map[string][]map[string]any `json:"tables"`
+}
+
+// userTable is where rows of a user are kept. where selects them, with a ?
+// for each mention of the user ID.
+type userTable struct {
+	name  string
+	where string
+	keep  bool // exported but kept when the user is deleted
+	purge bool // deleted with the user but not exported, being others' rows
+	// anonymise keeps the rows when the user is deleted, with these columns
+	// set to clear who they were about
+	anonymise string
+}
+
+// userTables lists the rows of a user, dependents first so deleting them in
+// order keeps foreign keys intact. Credit entries stay so the ledger still
+// balances; they only name the account. Invoices and payments stay for the
+// books, their numbers, amounts and taxes intact, but no longer say whose
+// they were. Session revocations stay until they expire so access tokens
+// issued before the deletion remain rejected.
+var userTables = []userTable{
+	{name: "subuser_usage", where: "subuser_id IN (SELECT id FROM subusers WHERE parent_id = ?)"},
+	{name: "subusers", where: "parent_id = ?"},
+	{name: "org_member_usage", where: "org_id IN (SELECT id FROM organizations WHERE owner_id = ?)", purge: true},
+	{name: "org_invitations", where: "org_id IN (SELECT id FROM organizations WHERE owner_id = ?)", purge: true},
+	{name: "org_members", where: "org_id IN (SELECT id FROM organizations WHERE owner_id = ?)", purge: true},
+	{name: "org_member_usage", where: "user_id = ?"},
+	{name: "org_members", where: "user_id = ?"},
+	{name: "organizations", where: "owner_id = ?"},
+	{name: "referrals", where: "referee_id = ? OR referrer_id = ?"},
+	{name: "referral_codes", where: "user_id = ?"},
+	{name: "coupon_redemptions", where: "user_id = ?"},
+	{name: "quota_periods", where: "user_id = ?"},
+	{name: "invoices", where: "user_id = ?", anonymise: "user_id = NULL, email = '', customer = '{}', pdf = NULL"},
+	{name: "billing_profiles", where: "user_id = ?"},
+	{name: "crypto_intents", where: "user_id = ?"},
+	{name: "credit_entries", where: "account = 'user:' || ?", keep: true},
+	{name: "payment_transactions", where: "user_id = ?", anonymise: "user_id = NULL"},
+	{name: "activity_log", where: "user_id = ?"},
+	{name: "recovery_codes", where: "user_id = ?"},
+	{name: "user_totp", where: "user_id = ?"},
+	{name: "login_challenges", where: "user_id = ?"},
+	{name: "email_tokens", where: "user_id = ?"},
+	{name: "api_keys", where: "user_id = ?"},
+	{name: "rotated_refresh_tokens", where: "session_id IN (SELECT id FROM sessions WHERE user_id = ?)", purge: true},
+	{name: "sessions", where: "user_id = ?"},
+	{name: "usage_tracking", where: "user_id = ?"},
+	{name: "subscriptions", where: "user_id = ?"},
+	{name: "login_failures", where: "key = (SELECT 'email:' || lower(email) FROM users WHERE id = ?)", purge: true},
+	{name: "users", where: "id = ?"},
+}
+
+// secretColumns are left out of exports
+var secretColumns = map[string]bool{
+	"password_hash": true,
+	"token":         true,
+	"token_hash":    true,
+	"key_hash":      true,
+	"secret_enc":    true,
+	"code_hash":     true,
+	"payment_auth":  true,
+	"pdf":           true, // invoices are downloaded on their own
+}
+
+// userQuery returns a statement on the rows of a user in a table, from its
+// head up to the WHERE clause, and its arguments
+func userQuery(dialect Dialect, head string, t userTable, userID string) (string, []any) {
+	n := strings.Count(t.where, "?")
+	args := make([]any, n)
+	for i := range args {
+		args[i] = userID
+	}
+	return rebind(dialect, head+" WHERE "+t.where), args
+}
+
+// exportUser reads every row of a user in one transaction
+func exportUser(db *sql.DB, dialect Dialect, userID string) (*UserExport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	out := &UserExport{UserID: userID, ExportedAt: time.Now().UTC(), Tables: make(map[string][]map[string]any)}
+	for _, t := range userTables {
+		if t.purge {
+			continue
+		}
+		query, args := userQuery(dialect, "SELECT * FROM "+t.name, t, userID)
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", t.name, err)
+		}
+		records, err := scanRecords(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", t.name, err)
+		}
+		if len(records) > 0 {
+			out.Tables[t.name] = append(out.Tables[t.name], records...)
+		}
+	}
+	if len(out.Tables["users"]) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return out, nil
+}
+
+// scanRecords reads rows as maps of column to value, leaving secrets out
+func scanRecords(rows *sql.Rows) ([]map[string]any, error) {
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []map[string]any
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		record := make(map[string]any, len(cols))
+		for i, col := range cols {
+			if secretColumns[col] {
+				continue
+			}
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			record[col] = values[i]
+		}
+		out = append(out, record)
+	}
+	return out, rows.Err()
+}
+
+// deleteUser deletes a user and everything kept about them in one
+// transaction
+func deleteUser(db *sql.DB, dialect Dialect, userID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow(rebind(dialect, `SELECT COUNT(*) FROM users WHERE id = ?`), userID).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+
+	for _, t := range userTables {
+		if t.keep {
+			continue
+		}
+		if t.anonymise != "" {
+			query, args := userQuery(dialect, "UPDATE "+t.name+" SET "+t.anonymise, t, userID)
+			if _, err := tx.Exec(query, args...); err != nil {
+				return fmt.Errorf("failed to anonymise %s: %w", t.name, err)
+			}
+			continue
+		}
+		query, args := userQuery(dialect, "DELETE FROM "+t.name, t, userID)
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", t.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// rebind turns ? placeholders into the dialect's
+func rebind(dialect Dialect, query string) string {
+	if dialect != DialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ExportUser returns everything kept about a user
+func (s *Store) ExportUser(id string) (*UserExport, error) {
+	return exportUser(s.db, DialectSQLite, id)
+}
+
+// DeleteUser deletes a user and everything kept about them, but for their
+// payments and invoices, which are anonymised
+func (s *Store) DeleteUser(id string) error {
+	return deleteUser(s.db, DialectSQLite, id)
+}
+
+// ExportUser returns everything kept about a user
+func (s *PostgresStore) ExportUser(id string) (*UserExport, error) {
+	return exportUser(s.db, DialectPostgres, id)
+}
+
+// DeleteUser deletes a user and everything kept about them, but for their
+// payments and invoices, which are anonymised
+func (s *PostgresStore) DeleteUser(id string) error {
+	return deleteUser(s.db, DialectPostgres, id)
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlanticproxy/proxy-client/internal/billing"
+)
+
+func TestDeleteUserCascades(t *testing.T) {
+	store, err := NewStoreWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	store.CreateUser("owner", "owner@example.com", "hash")
+	store.CreateUser("member", "member@example.com", "hash")
+	if err := store.CreateOrg(&billing.Organization{ID: "org1", Name: "Acme", OwnerID: "owner", CreatedAt: now},
+		&billing.Member{OrgID: "org1", UserID: "owner", Role: billing.RoleOwner, JoinedAt: now}); err != nil {
+		t.Fatalf("Failed to create organization: %v", err)
+	}
+	if err := store.AddMember(&billing.Member{OrgID: "org1", UserID: "member", Role: billing.RoleMember, JoinedAt: now}); err != nil {
+		t.Fatalf("Failed to add member: %v", err)
+	}
+	if err := store.CreateSubUser(&billing.SubUser{ID: "su1", ParentID: "owner", Username: "reseller-1", PasswordHash: "hash", Active: true, CreatedAt: now}); err != nil {
+		t.Fatalf("Failed to create sub-user: %v", err)
+	}
+	store.AddSubUserUsage("su1", now, 100, 1)
+	store.CreateReferralCode("owner", "OWNER1")
+	if err := store.CreateReferral(&billing.Referral{RefereeID: "member", ReferrerID: "owner", Code: "OWNER1", Status: billing.ReferralPending, CreatedAt: now}); err != nil {
+		t.Fatalf("Failed to create referral: %v", err)
+	}
+	store.SaveBillingProfile(&billing.BillingProfile{UserID: "owner", Name: "Owner", Country: "DE", UpdatedAt: now})
+
+	export, err := store.ExportUser("owner")
+	if err != nil {
+		t.Fatalf("ExportUser failed: %v", err)
+	}
+	for _, table := range []string{"organizations", "org_members", "subusers", "subuser_usage", "referral_codes", "referrals", "billing_profiles"} {
+		if len(export.Tables[table]) != 1 {
+			t.Errorf("Expected one %s row, got %d", table, len(export.Tables[table]))
+		}
+	}
+
+	if err := store.DeleteUser("owner"); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if org, _ := store.GetOrg("org1"); org != nil {
+		t.Error("Expected the owned organization deleted")
+	}
+	if m, _ := store.GetMembership("member"); m != nil {
+		t.Error("Expected the members of the organization released")
+	}
+	if subs, _ := store.ListSubUsers("owner"); len(subs) != 0 {
+		t.Error("Expected the sub-users deleted")
+	}
+	if r, _ := store.GetReferral("member"); r != nil {
+		t.Error("Expected the referral deleted")
+	}
+	if u, _ := store.GetUserByID("member"); u == nil {
+		t.Error("Expected the member's account kept")
+	}
+}
@@ -2,30 +2,64 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/atlanticproxy/proxy-client/internal/auth"
+	"github.com/atlanticproxy/proxy-client/internal/billing"
 	"github.com/atlanticproxy/proxy-client/internal/interceptor"
 	"github.com/atlanticproxy/proxy-client/internal/killswitch"
+	"github.com/atlanticproxy/proxy-client/internal/mailer"
 	"github.com/atlanticproxy/proxy-client/internal/monitor"
 	"github.com/atlanticproxy/proxy-client/internal/proxy"
+	"github.com/atlanticproxy/proxy-client/internal/queue"
+	"github.com/atlanticproxy/proxy-client/internal/storage"
 	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Interceptor *interceptor.Config `yaml:"interceptor"`
-	Proxy       *proxy.Config       `yaml:"proxy"`
-	KillSwitch  *killswitch.Config  `yaml:"killswitch"`
-	Monitor     *monitor.Config     `yaml:"monitor"`
-	Billing     *BillingConfig      `yaml:"billing"`
-	API         *APIConfig          `yaml:"api"`
+	// DatabaseURL selects the storage backend: a postgres:// URL, memory://,
+	// or the path of a SQLite database, the default one if empty
+	DatabaseURL string                 `yaml:"database_url"`
+	Interceptor *interceptor.Config    `yaml:"interceptor"`
+	Proxy       *proxy.Config          `yaml:"proxy"`
+	KillSwitch  *killswitch.Config     `yaml:"killswitch"`
+	Monitor     *monitor.Config        `yaml:"monitor"`
+	Billing     *BillingConfig         `yaml:"billing"`
+	API         *APIConfig             `yaml:"api"`
+	Auth        *AuthConfig            `yaml:"auth"`
+	Mail        *mailer.Config         `yaml:"mail"`
+	LoginGuard  *auth.LoginGuardConfig `yaml:"login_guard"`
+	Backup      *storage.BackupConfig  `yaml:"backup"`
 }
 
 type APIConfig struct {
-	Port string `yaml:"port"`
+	Port   string `yaml:"port"`
+	AppURL string `yaml:"app_url"` // dashboard base URL used in emailed links
+	// AdminEmails are the accounts allowed to manage the plan catalogue
+	AdminEmails []string `yaml:"admin_emails"`
+}
+
+type AuthConfig struct {
+	JWTSecret       string        `yaml:"jwt_secret"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	EncryptionKey   string        `yaml:"encryption_key"` // protects stored 2FA secrets
 }
 
 type BillingConfig struct {
-	PaystackSecretKey string `yaml:"paystack_secret_key"`
+	PaystackSecretKey string                  `yaml:"paystack_secret_key"`
+	Stripe            billing.StripeConfig    `yaml:"stripe"`
+	Lifecycle         billing.LifecycleConfig `yaml:"lifecycle"`
+	Credits           billing.CreditConfig    `yaml:"credits"`
+	Crypto            billing.CryptoConfig    `yaml:"crypto"`
+	ExchangeRates     billing.ExchangeConfig  `yaml:"exchange_rates"`
+	Invoices          billing.InvoiceConfig   `yaml:"invoices"`   // the seller shown on invoices
+	Promotions        billing.PromotionConfig `yaml:"promotions"` // referral rewards
+	Orgs              billing.OrgConfig       `yaml:"orgs"`       // organization invitations
+	Webhooks          queue.Config            `yaml:"webhooks"`   // retries of stored webhook events and jobs
 }
 
 func Load() *Config {
@@ -33,6 +67,7 @@ func Load() *Config {
 	_ = godotenv.Load()
 
 	config := &Config{
+		DatabaseURL: getEnv("DATABASE_URL", ""),
 		Interceptor: &interceptor.Config{
 			InterfaceName: "utun9",
 			TunIP:         "10.8.0.1",
@@ -49,6 +84,7 @@ func Load() *Config {
 			ProviderType:   getEnv("PROVIDER_TYPE", "auto"),
 			ListenAddr:     "127.0.0.1:8080",
 			HealthCheckURL: "https://httpbin.org/ip",
+			RequireAuth:    getEnv("PROXY_REQUIRE_AUTH", "") == "true",
 		},
 		KillSwitch: &killswitch.Config{
 			Enabled: true,
@@ -64,9 +100,86 @@ func Load() *Config {
 		},
 		Billing: &BillingConfig{
 			PaystackSecretKey: getEnv("PAYSTACK_SECRET_KEY", ""),
+			Stripe: billing.StripeConfig{
+				SecretKey:     getEnv("STRIPE_SECRET_KEY", ""),
+				WebhookSecret: getEnv("STRIPE_WEBHOOK_SECRET", ""),
+				SuccessURL:    getEnv("STRIPE_SUCCESS_URL", "http://localhost:3000/payment/callback"),
+				CancelURL:     getEnv("STRIPE_CANCEL_URL", "http://localhost:3000/billing"),
+				BaseURL:       getEnv("STRIPE_API_URL", ""),
+			},
+			Lifecycle: billing.LifecycleConfig{
+				Interval:      time.Hour,
+				GracePeriod:   getEnvDuration("SUBSCRIPTION_GRACE_PERIOD", 7*24*time.Hour),
+				RetryInterval: getEnvDuration("SUBSCRIPTION_RETRY_INTERVAL", 24*time.Hour),
+			},
+			Credits: billing.CreditConfig{
+				Metering:     getEnv("PAYG_METERING", billing.MeterPerHour),
+				PricePerGB:   getEnvFloat("PAYG_PRICE_PER_GB", 3.00),
+				PricePerHour: getEnvFloat("PAYG_PRICE_PER_HOUR", billing.PAYGHourlyRate),
+				LowBalance:   getEnvFloat("PAYG_LOW_BALANCE", 2.00),
+			},
+			Crypto: billing.CryptoConfig{
+				Wallets:      cryptoWallets(),
+				QuoteTTL:     getEnvDuration("CRYPTO_QUOTE_TTL", 30*time.Minute),
+				RatesURL:     getEnv("CRYPTO_RATES_URL", ""),
+				BitcoinAPI:   getEnv("BITCOIN_API_URL", ""),
+				EthereumAPI:  getEnv("ETHEREUM_API_URL", ""),
+				EtherscanKey: getEnv("ETHERSCAN_API_KEY", ""),
+			},
+			ExchangeRates: billing.ExchangeConfig{
+				URL:           getEnv("EXCHANGE_RATES_URL", billing.DefaultExchangeConfig().URL),
+				File:          getEnv("EXCHANGE_RATES_FILE", ""),
+				TTL:           getEnvDuration("EXCHANGE_RATES_TTL", 6*time.Hour),
+				Psychological: currencyList("PSYCHOLOGICAL_PRICING"),
+			},
+			Invoices: billing.InvoiceConfig{
+				Seller:  getEnv("INVOICE_SELLER", billing.DefaultInvoiceConfig().Seller),
+				Address: strings.ReplaceAll(getEnv("INVOICE_SELLER_ADDRESS", ""), `\n`, "\n"),
+				TaxID:   getEnv("INVOICE_SELLER_TAX_ID", ""),
+				Email:   getEnv("INVOICE_SELLER_EMAIL", ""),
+			},
+			Promotions: billing.PromotionConfig{
+				ReferrerRewardUSD: getEnvFloat("REFERRER_REWARD_USD", billing.DefaultPromotionConfig().ReferrerRewardUSD),
+				RefereeRewardUSD:  getEnvFloat("REFEREE_REWARD_USD", billing.DefaultPromotionConfig().RefereeRewardUSD),
+			},
+			Orgs: billing.OrgConfig{
+				InviteTTL: getEnvDuration("ORG_INVITE_TTL", billing.DefaultOrgConfig().InviteTTL),
+			},
 		},
 		API: &APIConfig{
-			Port: getEnv("SERVER_PORT", "8082"),
+			Port:        getEnv("SERVER_PORT", "8082"),
+			AppURL:      getEnv("APP_URL", "http://localhost:3000"),
+			AdminEmails: getEnvList("ADMIN_EMAILS"),
+		},
+		Auth: &AuthConfig{
+			JWTSecret:       getEnv("JWT_SECRET", ""),
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+			EncryptionKey:   getEnv("AUTH_ENCRYPTION_KEY", ""),
+		},
+		Mail: &mailer.Config{
+			Backend:      getEnv("MAIL_BACKEND", "log"),
+			From:         getEnv("MAIL_FROM", "AtlanticProxy <no-reply@atlanticproxy.com>"),
+			SMTPHost:     getEnv("SMTP_HOST", ""),
+			SMTPPort:     getEnv("SMTP_PORT", "587"),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+			Dir:          getEnv("MAIL_DIR", ""),
+		},
+		LoginGuard: &auth.LoginGuardConfig{
+			EmailFreeAttempts: getEnvInt("LOGIN_EMAIL_FREE_ATTEMPTS", 3),
+			EmailLockout:      getEnvInt("LOGIN_EMAIL_LOCKOUT", 10),
+			IPFreeAttempts:    getEnvInt("LOGIN_IP_FREE_ATTEMPTS", 10),
+			IPLockout:         getEnvInt("LOGIN_IP_LOCKOUT", 50),
+			BaseDelay:         time.Second,
+			MaxDelay:          5 * time.Minute,
+			LockoutDuration:   getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+			Window:            time.Hour,
+		},
+		Backup: &storage.BackupConfig{
+			Dir:      getEnv("BACKUP_DIR", ""),
+			Interval: getEnvDuration("BACKUP_INTERVAL", 0),
+			Keep:     getEnvInt("BACKUP_KEEP", storage.DefaultBackupConfig().Keep),
 		},
 	}
 
@@ -94,3 +207,56 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvList splits a comma separated variable, dropping empty items
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// cryptoWallets reads the extended public keys crypto deposits go to. Assets
+// without one can't be paid with.
+func cryptoWallets() map[string]string {
+	wallets := make(map[string]string)
+	for asset, key := range map[string]string{"btc": "CRYPTO_BTC_XPUB", "eth": "CRYPTO_ETH_XPUB"} {
+		if xpub := os.Getenv(key); xpub != "" {
+			wallets[asset] = xpub
+		}
+	}
+	return wallets
+}
+
+// currencyList reads a comma-separated list of currency codes
+func currencyList(key string) []billing.CurrencyCode {
+	var codes []billing.CurrencyCode
+	for _, code := range getEnvList(key) {
+		codes = append(codes, billing.CurrencyCode(strings.ToUpper(code)))
+	}
+	return codes
+}